@@ -0,0 +1,215 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/appservice/queue"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputRoomEvent consumes events that originated in the room server.
+type OutputRoomEvent struct {
+	roomServerConsumer *common.ContinualConsumer
+	cfg                *config.Dendrite
+	queues             *queue.AppServiceQueues
+	query              api.RoomserverQueryAPI
+}
+
+// NewOutputRoomEvent creates a new OutputRoomEvent consumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.AppServiceQueues,
+	store *storage.Database,
+	queryAPI api.RoomserverQueryAPI,
+) *OutputRoomEvent {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputRoomEvent{
+		roomServerConsumer: &consumer,
+		cfg:                cfg,
+		queues:             queues,
+		query:              queryAPI,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEvent) Start() error {
+	return s.roomServerConsumer.Start()
+}
+
+// onMessage is called when the application service server receives a new
+// event from the room server output log. The event is sent to the application
+// services interested in it.
+func (s *OutputRoomEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	// Parse out the event JSON
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+	if output.Type != api.OutputTypeNewRoomEvent {
+		log.WithField("type", output.Type).Debug(
+			"roomserver output log: ignoring unknown output type",
+		)
+		return nil
+	}
+	ev := &output.NewRoomEvent.Event
+
+	appServiceIDs, err := s.interestedAppServices(context.TODO(), ev)
+	if err != nil {
+		// panic rather than skip the event, which the application services
+		// would never receive
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: failed to find the interested application services")
+		return nil
+	}
+	if len(appServiceIDs) == 0 {
+		return nil
+	}
+
+	if err = s.queues.SendEvent(ev, appServiceIDs); err != nil {
+		log.WithFields(log.Fields{
+			"event_id":   ev.EventID(),
+			log.ErrorKey: err,
+		}).Panicf("roomserver output log: failed to queue event for the application services")
+	}
+	return nil
+}
+
+// interestedAppServices returns the IDs of the application services the event
+// is sent to. An application service is interested in the event if its
+// namespaces contain the sender, the user targeted by a m.room.member event,
+// the room ID, one of the aliases of the room or one of its joined members.
+// The current state of the room is only looked up if the event itself isn't
+// enough to tell.
+// Returns an error if there was a problem talking to the room server.
+func (s *OutputRoomEvent) interestedAppServices(
+	ctx context.Context, ev *gomatrixserverlib.Event,
+) ([]string, error) {
+	var appServiceIDs []string
+	var remaining []*config.ApplicationService
+	for i := range s.cfg.ApplicationServices.Registrations {
+		registration := &s.cfg.ApplicationServices.Registrations[i]
+		if isInterestedInEvent(registration, ev) {
+			appServiceIDs = append(appServiceIDs, registration.ID)
+		} else {
+			remaining = append(remaining, registration)
+		}
+	}
+	if len(remaining) == 0 {
+		return appServiceIDs, nil
+	}
+
+	aliases, members, err := s.roomAliasesAndMembers(ctx, ev.RoomID())
+	if err != nil {
+		return nil, err
+	}
+	for _, registration := range remaining {
+		if isInterestedInRoom(registration, aliases, members) {
+			appServiceIDs = append(appServiceIDs, registration.ID)
+		}
+	}
+	return appServiceIDs, nil
+}
+
+// isInterestedInEvent returns whether the sender of the event, the user
+// targeted by it or its room are in the namespaces of the application service.
+func isInterestedInEvent(registration *config.ApplicationService, ev *gomatrixserverlib.Event) bool {
+	if registration.IsInterestedInUserID(ev.Sender()) || registration.IsInterestedInRoomID(ev.RoomID()) {
+		return true
+	}
+	return ev.Type() == "m.room.member" && ev.StateKey() != nil &&
+		registration.IsInterestedInUserID(*ev.StateKey())
+}
+
+// isInterestedInRoom returns whether one of the aliases or joined members of
+// a room are in the namespaces of the application service.
+func isInterestedInRoom(registration *config.ApplicationService, aliases, members []string) bool {
+	for _, alias := range aliases {
+		if registration.IsInterestedInRoomAlias(alias) {
+			return true
+		}
+	}
+	for _, member := range members {
+		if registration.IsInterestedInUserID(member) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomAliasesAndMembers returns the aliases and the user IDs of the joined
+// members of the room, from its current state.
+// Returns an error if there was a problem talking to the room server.
+func (s *OutputRoomEvent) roomAliasesAndMembers(
+	ctx context.Context, roomID string,
+) (aliases, members []string, err error) {
+	stateReq := api.QueryCurrentStateRequest{
+		RoomID:     roomID,
+		EventTypes: []string{"m.room.member", "m.room.aliases", "m.room.canonical_alias"},
+	}
+	var stateRes api.QueryCurrentStateResponse
+	if err = s.query.QueryCurrentState(ctx, &stateReq, &stateRes); err != nil {
+		return
+	}
+	if len(stateRes.StateEventIDs) == 0 {
+		return
+	}
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: stateRes.StateEventIDs}
+	var eventsRes api.QueryEventsByIDResponse
+	if err = s.query.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return
+	}
+
+	for _, event := range eventsRes.Events {
+		switch event.Type() {
+		case "m.room.member":
+			membership, membershipErr := event.Membership()
+			if membershipErr == nil && membership == "join" && event.StateKey() != nil {
+				members = append(members, *event.StateKey())
+			}
+		case "m.room.aliases":
+			var content common.AliasesContent
+			if json.Unmarshal(event.Content(), &content) == nil {
+				aliases = append(aliases, content.Aliases...)
+			}
+		case "m.room.canonical_alias":
+			var content common.CanonicalAliasContent
+			if json.Unmarshal(event.Content(), &content) == nil && content.Alias != "" {
+				aliases = append(aliases, content.Alias)
+			}
+		}
+	}
+	return
+}
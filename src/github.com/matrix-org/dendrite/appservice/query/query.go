@@ -0,0 +1,137 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package query implements the requests the server makes to application
+// services to ask them about the users, room aliases and third party
+// networks they manage.
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// RoomAliasExists asks the application services with the room alias in one of
+// their namespaces whether it exists, giving them a chance to create it.
+// Returns true as soon as one of them says it does, after which the alias can
+// be looked up again. Application services which fail to answer are skipped.
+func RoomAliasExists(
+	ctx context.Context, httpClient *http.Client,
+	registrations []config.ApplicationService, alias string,
+) bool {
+	for i := range registrations {
+		registration := &registrations[i]
+		if !registration.IsInterestedInRoomAlias(alias) {
+			continue
+		}
+		found, err := exists(ctx, httpClient, registration, "/_matrix/app/v1/rooms/"+url.PathEscape(alias))
+		if err != nil {
+			common.GetLogger(ctx).WithError(err).WithField("appservice", registration.ID).
+				Warn("Failed to query room alias")
+			continue
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// UserIDExists asks the application services with the user ID in one of their
+// namespaces whether the user exists, giving them a chance to create it.
+// Returns true as soon as one of them says it does, after which the user can
+// be looked up again. Application services which fail to answer are skipped.
+func UserIDExists(
+	ctx context.Context, httpClient *http.Client,
+	registrations []config.ApplicationService, userID string,
+) bool {
+	for i := range registrations {
+		registration := &registrations[i]
+		if !registration.IsInterestedInUserID(userID) || userID == registration.SenderUserID {
+			continue
+		}
+		found, err := exists(ctx, httpClient, registration, "/_matrix/app/v1/users/"+url.PathEscape(userID))
+		if err != nil {
+			common.GetLogger(ctx).WithError(err).WithField("appservice", registration.ID).
+				Warn("Failed to query user ID")
+			continue
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Get sends a GET request to the application service, authenticated with its
+// hs_token, and decodes the JSON response into res.
+// Returns an error if the request failed or the response wasn't a 200.
+func Get(
+	ctx context.Context, httpClient *http.Client,
+	registration *config.ApplicationService, path string, query url.Values,
+	res interface{},
+) error {
+	httpRes, err := get(ctx, httpClient, registration, path, query)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+	if httpRes.StatusCode != 200 {
+		return fmt.Errorf("application service responded with HTTP %d", httpRes.StatusCode)
+	}
+	return json.NewDecoder(httpRes.Body).Decode(res)
+}
+
+// exists sends a GET request to the application service and returns whether
+// it responded with a 200 rather than a 404.
+func exists(
+	ctx context.Context, httpClient *http.Client,
+	registration *config.ApplicationService, path string,
+) (bool, error) {
+	httpRes, err := get(ctx, httpClient, registration, path, url.Values{})
+	if err != nil {
+		return false, err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+	switch httpRes.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, fmt.Errorf("application service responded with HTTP %d", httpRes.StatusCode)
+	}
+}
+
+func get(
+	ctx context.Context, httpClient *http.Client,
+	registration *config.ApplicationService, path string, query url.Values,
+) (*http.Response, error) {
+	values := url.Values{}
+	for key, value := range query {
+		values[key] = value
+	}
+	values.Set("access_token", registration.HSToken)
+	httpReq, err := http.NewRequest("GET", registration.URL+path+"?"+values.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(httpReq.WithContext(ctx))
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sendFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "appservice",
+		Name:      "send_failures_total",
+		Help:      "The number of failed attempts to send a transaction, by application service",
+	},
+	[]string{"appservice"},
+)
+
+func init() {
+	prometheus.MustRegister(sendFailures)
+}
+
+// The maximum number of events sent to an application service in a single
+// transaction.
+const maxEventsPerTransaction = 100
+
+// A pendingEvent is an event waiting in an application service queue.
+type pendingEvent struct {
+	queueNID      int64
+	transactionID string
+	event         *gomatrixserverlib.Event
+}
+
+// appServiceQueue is a queue of events for a single application service.
+// It is responsible for sending the events to the application service and
+// ensures that only one request is in flight to it at a time.
+type appServiceQueue struct {
+	db         Database
+	client     *http.Client
+	appService *config.ApplicationService
+	// The running mutex protects running, sentCounter and pendingEvents.
+	runningMutex  sync.Mutex
+	running       bool
+	sentCounter   int
+	pendingEvents []pendingEvent
+}
+
+// sendEvent adds the event to the pending queue for the application service.
+// If the queue is empty then it starts a background goroutine to start
+// sending events to the application service.
+func (aq *appServiceQueue) sendEvent(queueNID int64, ev *gomatrixserverlib.Event) {
+	aq.runningMutex.Lock()
+	defer aq.runningMutex.Unlock()
+	aq.pendingEvents = append(aq.pendingEvents, pendingEvent{queueNID: queueNID, event: ev})
+	aq.start()
+}
+
+// start starts the background goroutine sending to the application service
+// if it isn't already running. The running mutex must be held.
+func (aq *appServiceQueue) start() {
+	if !aq.running {
+		aq.running = true
+		go aq.backgroundSend()
+	}
+}
+
+// The retry delays are variables so that the tests don't have to wait.
+var (
+	// The delay before retrying a transaction the first time it fails.
+	initialRetryDelay = 5 * time.Second
+	// The maximum delay between two attempts at sending a transaction.
+	maxRetryDelay = 5 * time.Minute
+)
+
+func (aq *appServiceQueue) backgroundSend() {
+	for {
+		transactionID, events, queueNIDs := aq.next()
+		if events == nil {
+			// If the queue is empty then stop processing for this application
+			// service.
+			return
+		}
+		aq.sendWithRetries(transactionID, events, queueNIDs)
+	}
+}
+
+// sendWithRetries sends the transaction to the application service, retrying
+// with an exponential backoff until it succeeds. Application services are
+// configured by the server admin, so unlike other servers they are never
+// given up on. The same transaction ID is used for each attempt so the
+// application service can tell the retries apart from new transactions.
+// The events in the transaction are removed from the database once sent.
+func (aq *appServiceQueue) sendWithRetries(
+	transactionID string, events []gomatrixserverlib.ClientEvent, queueNIDs []int64,
+) {
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := aq.sendTransaction(transactionID, events)
+		if err == nil {
+			break
+		}
+		sendFailures.WithLabelValues(aq.appService.ID).Inc()
+		wait := jitter(delay)
+		log.WithFields(log.Fields{
+			"appservice":     aq.appService.ID,
+			"transaction_id": transactionID,
+			"attempt":        attempt,
+			"retry_in":       wait,
+			log.ErrorKey:     err,
+		}).Info("problem sending transaction to application service")
+		time.Sleep(wait)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+
+	if err := aq.db.DeleteQueueItems(queueNIDs); err != nil {
+		// The events will be sent again with the same transaction ID after a
+		// restart, which the application service will ignore.
+		log.WithFields(log.Fields{
+			"appservice":     aq.appService.ID,
+			"transaction_id": transactionID,
+			log.ErrorKey:     err,
+		}).Error("failed to remove sent events from the queue")
+	}
+}
+
+// sendTransaction pushes the events to the application service with
+// PUT /_matrix/app/v1/transactions/{txnId}, authenticated with its hs_token.
+func (aq *appServiceQueue) sendTransaction(
+	transactionID string, events []gomatrixserverlib.ClientEvent,
+) error {
+	body, err := json.Marshal(struct {
+		Events []gomatrixserverlib.ClientEvent `json:"events"`
+	}{events})
+	if err != nil {
+		return err
+	}
+	txnURL := aq.appService.URL + "/_matrix/app/v1/transactions/" + url.PathEscape(transactionID) +
+		"?access_token=" + url.QueryEscape(aq.appService.HSToken)
+	req, err := http.NewRequest("PUT", txnURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := aq.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("application service responded with HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// jitter returns a random duration between half and one and a half times d,
+// so that retries to many application services don't all happen at the same
+// time.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// next takes the events of the next transaction from the pending queue. The
+// transaction holds at most maxEventsPerTransaction events. Events that were
+// already assigned a transaction before a restart are sent together again in
+// that transaction, regardless of the limit.
+// Returns the transaction ID, the events in the client format and their queue
+// NIDs, or nil events if the queue was empty.
+func (aq *appServiceQueue) next() (string, []gomatrixserverlib.ClientEvent, []int64) {
+	aq.runningMutex.Lock()
+	defer aq.runningMutex.Unlock()
+	if len(aq.pendingEvents) == 0 {
+		aq.running = false
+		return "", nil, nil
+	}
+
+	// Events restored from the database are at the front of the queue.
+	transactionID := aq.pendingEvents[0].transactionID
+	restored := transactionID != ""
+	if !restored {
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		transactionID = fmt.Sprintf("%d-%d", now, aq.sentCounter)
+	}
+
+	var events []gomatrixserverlib.Event
+	var queueNIDs []int64
+	n := 0
+	for n < len(aq.pendingEvents) && (restored || n < maxEventsPerTransaction) &&
+		aq.pendingEvents[n].transactionID == aq.pendingEvents[0].transactionID {
+		events = append(events, *aq.pendingEvents[n].event)
+		queueNIDs = append(queueNIDs, aq.pendingEvents[n].queueNID)
+		n++
+	}
+	aq.pendingEvents = aq.pendingEvents[n:]
+	aq.sentCounter += len(events)
+
+	if !restored {
+		// Remember the transaction ID so that the events are sent in the same
+		// transaction if we restart before the application service receives
+		// them.
+		if err := aq.db.SetQueueItemsTransactionID(queueNIDs, transactionID); err != nil {
+			log.WithFields(log.Fields{
+				"appservice":     aq.appService.ID,
+				"transaction_id": transactionID,
+				log.ErrorKey:     err,
+			}).Error("failed to store the transaction ID of queued events")
+		}
+	}
+	return transactionID, gomatrixserverlib.ToClientEvents(events, gomatrixserverlib.FormatAll), queueNIDs
+}
@@ -0,0 +1,243 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeDatabase records the changes made to the queued events. It is shared
+// with the background sending goroutines.
+type fakeDatabase struct {
+	mutex          sync.Mutex
+	items          []types.QueueItem
+	transactionIDs map[int64]string
+	deletedNIDs    []int64
+}
+
+func (d *fakeDatabase) QueueEvent(string, *gomatrixserverlib.Event) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeDatabase) SetQueueItemsTransactionID(queueNIDs []int64, transactionID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, queueNID := range queueNIDs {
+		d.transactionIDs[queueNID] = transactionID
+	}
+	return nil
+}
+
+func (d *fakeDatabase) DeleteQueueItems(queueNIDs []int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deletedNIDs = append(d.deletedNIDs, queueNIDs...)
+	return nil
+}
+
+func (d *fakeDatabase) QueueItems() ([]types.QueueItem, error) {
+	return d.items, nil
+}
+
+func (d *fakeDatabase) deleted() []int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]int64(nil), d.deletedNIDs...)
+}
+
+// fakeAppService records the IDs of the transactions it receives, and fails
+// the first few of them, as many as failures, with a 500.
+type fakeAppService struct {
+	mutex          sync.Mutex
+	failures       int
+	transactionIDs []string
+	accessTokens   []string
+}
+
+func (s *fakeAppService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transactionIDs = append(s.transactionIDs, req.URL.Path[len("/_matrix/app/v1/transactions/"):])
+	s.accessTokens = append(s.accessTokens, req.URL.Query().Get("access_token"))
+	if len(s.transactionIDs) <= s.failures {
+		w.WriteHeader(500)
+		return
+	}
+	w.Write([]byte("{}")) // nolint: errcheck
+}
+
+func (s *fakeAppService) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.transactionIDs...)
+}
+
+// shortenRetryDelays makes the retries immediate until the returned function
+// is called.
+func shortenRetryDelays() func() {
+	initial, max := initialRetryDelay, maxRetryDelay
+	initialRetryDelay, maxRetryDelay = time.Millisecond, 2*time.Millisecond
+	return func() {
+		initialRetryDelay, maxRetryDelay = initial, max
+	}
+}
+
+func testEvent(t *testing.T) gomatrixserverlib.Event {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$event:localhost", "room_id": "!room:localhost", "type": "m.room.message",
+		"sender": "@irc_alice:localhost", "content": {"body": "hello"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// waitFor polls until done returns true, failing the test after a second.
+func waitFor(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNextLimitsTransactionSize(t *testing.T) {
+	db := &fakeDatabase{transactionIDs: map[int64]string{}}
+	aq := &appServiceQueue{db: db, appService: &config.ApplicationService{ID: "irc"}}
+	for i := int64(1); i <= maxEventsPerTransaction+1; i++ {
+		aq.pendingEvents = append(aq.pendingEvents, pendingEvent{queueNID: i, event: &gomatrixserverlib.Event{}})
+	}
+
+	transactionID, events, queueNIDs := aq.next()
+	if len(events) != maxEventsPerTransaction || len(queueNIDs) != maxEventsPerTransaction {
+		t.Fatalf("wanted %d events, got %d", maxEventsPerTransaction, len(events))
+	}
+	for _, queueNID := range queueNIDs {
+		if db.transactionIDs[queueNID] != transactionID {
+			t.Errorf("wanted item %d to be stored with transaction ID %q, got %q", queueNID, transactionID, db.transactionIDs[queueNID])
+		}
+	}
+	if len(aq.pendingEvents) != 1 {
+		t.Errorf("wanted 1 event left, got %d", len(aq.pendingEvents))
+	}
+
+	nextTransactionID, _, _ := aq.next()
+	if nextTransactionID == transactionID {
+		t.Errorf("wanted a new transaction ID for the next transaction, got %q again", transactionID)
+	}
+}
+
+func TestNextResendsRestoredTransaction(t *testing.T) {
+	db := &fakeDatabase{transactionIDs: map[int64]string{}}
+	aq := &appServiceQueue{db: db, appService: &config.ApplicationService{ID: "irc"}}
+	aq.pendingEvents = []pendingEvent{
+		{queueNID: 1, transactionID: "txn1", event: &gomatrixserverlib.Event{}},
+		{queueNID: 2, transactionID: "txn1", event: &gomatrixserverlib.Event{}},
+		{queueNID: 3, event: &gomatrixserverlib.Event{}},
+	}
+
+	transactionID, events, _ := aq.next()
+	if transactionID != "txn1" || len(events) != 2 {
+		t.Errorf("wanted the 2 events of transaction %q, got %d events in %q", "txn1", len(events), transactionID)
+	}
+	if len(db.transactionIDs) != 0 {
+		t.Errorf("wanted no transaction IDs to be stored, got %v", db.transactionIDs)
+	}
+}
+
+func TestSendWithRetries(t *testing.T) {
+	defer shortenRetryDelays()()
+	appService := &fakeAppService{failures: 2}
+	server := httptest.NewServer(appService)
+	defer server.Close()
+
+	db := &fakeDatabase{transactionIDs: map[int64]string{}}
+	aq := &appServiceQueue{
+		db: db, client: http.DefaultClient,
+		appService: &config.ApplicationService{ID: "irc", URL: server.URL, HSToken: "hs_secret"},
+	}
+	events := gomatrixserverlib.ToClientEvents([]gomatrixserverlib.Event{testEvent(t)}, gomatrixserverlib.FormatAll)
+	aq.sendWithRetries("txn1", events, []int64{1, 2})
+
+	// Failed transactions are sent again with the same ID until they succeed.
+	ids := appService.received()
+	if len(ids) != 3 || ids[0] != "txn1" || ids[1] != "txn1" || ids[2] != "txn1" {
+		t.Errorf("wanted transaction %q to be sent 3 times, got %v", "txn1", ids)
+	}
+	for _, token := range appService.accessTokens {
+		if token != "hs_secret" {
+			t.Errorf("wanted the transactions to be sent with the hs_token, got %q", token)
+		}
+	}
+	if deleted := db.deleted(); len(deleted) != 2 {
+		t.Errorf("wanted the 2 sent events to be removed from the queue, got %v", deleted)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	defer shortenRetryDelays()()
+	appService := &fakeAppService{failures: 1}
+	server := httptest.NewServer(appService)
+	defer server.Close()
+
+	event := testEvent(t)
+	db := &fakeDatabase{
+		items: []types.QueueItem{
+			{QueueNID: 1, AppServiceID: "irc", TransactionID: "txn1", Event: event},
+			{QueueNID: 2, AppServiceID: "irc", TransactionID: "txn1", Event: event},
+			{QueueNID: 3, AppServiceID: "irc", Event: event},
+			// Application services which aren't registered anymore.
+			{QueueNID: 4, AppServiceID: "gone", TransactionID: "txn2", Event: event},
+		},
+		transactionIDs: map[int64]string{},
+	}
+	cfg := &config.Dendrite{}
+	cfg.ApplicationServices.Registrations = []config.ApplicationService{
+		{ID: "irc", URL: server.URL, HSToken: "hs_secret"},
+	}
+	aqs := NewAppServiceQueues(cfg, http.DefaultClient, db)
+	if err := aqs.Restore(); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := false
+	for _, queueNID := range db.deleted() {
+		dropped = dropped || queueNID == 4
+	}
+	if !dropped {
+		t.Errorf("wanted the events of unknown application services to be dropped, got %v", db.deleted())
+	}
+
+	waitFor(t, "the restored events to be sent", func() bool {
+		return len(db.deleted()) == 4
+	})
+	ids := appService.received()
+	if len(ids) != 3 || ids[0] != "txn1" || ids[1] != "txn1" || ids[2] == "txn1" {
+		t.Errorf("wanted the restored transaction to be sent again before a new one, got %v", ids)
+	}
+	if db.transactionIDs[3] != ids[2] {
+		t.Errorf("wanted the new transaction ID %q to be stored, got %q", ids[2], db.transactionIDs[3])
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database persists the events waiting in the queues so that they are still
+// sent if the server restarts.
+type Database interface {
+	// QueueEvent stores an event to send to the application service and
+	// returns its queue NID.
+	QueueEvent(appServiceID string, event *gomatrixserverlib.Event) (int64, error)
+	// SetQueueItemsTransactionID records the transaction the events are sent in.
+	SetQueueItemsTransactionID(queueNIDs []int64, transactionID string) error
+	// DeleteQueueItems removes events that have been sent from the database.
+	DeleteQueueItems(queueNIDs []int64) error
+	// QueueItems returns all the events that haven't been sent yet, in the
+	// order they were queued.
+	QueueItems() ([]types.QueueItem, error)
+}
+
+// AppServiceQueues is a collection of queues for sending transactions of
+// events to application services, one for each application service.
+type AppServiceQueues struct {
+	db     Database
+	queues map[string]*appServiceQueue
+}
+
+// NewAppServiceQueues makes a new AppServiceQueues for the application
+// services in the config.
+func NewAppServiceQueues(
+	cfg *config.Dendrite, client *http.Client, db Database,
+) *AppServiceQueues {
+	queues := map[string]*appServiceQueue{}
+	for i := range cfg.ApplicationServices.Registrations {
+		registration := &cfg.ApplicationServices.Registrations[i]
+		queues[registration.ID] = &appServiceQueue{
+			db:         db,
+			client:     client,
+			appService: registration,
+		}
+	}
+	return &AppServiceQueues{db: db, queues: queues}
+}
+
+// Restore loads the events that weren't sent before the server last stopped
+// from the database and starts sending them again. The events queued for
+// application services which aren't registered anymore are dropped.
+func (aqs *AppServiceQueues) Restore() error {
+	items, err := aqs.db.QueueItems()
+	if err != nil {
+		return err
+	}
+
+	var droppedNIDs []int64
+	for _, item := range items {
+		aq := aqs.queues[item.AppServiceID]
+		if aq == nil {
+			droppedNIDs = append(droppedNIDs, item.QueueNID)
+			continue
+		}
+		event := item.Event
+		aq.runningMutex.Lock()
+		aq.pendingEvents = append(aq.pendingEvents, pendingEvent{
+			queueNID: item.QueueNID, transactionID: item.TransactionID, event: &event,
+		})
+		aq.start()
+		aq.runningMutex.Unlock()
+	}
+	if len(droppedNIDs) > 0 {
+		if err = aqs.db.DeleteQueueItems(droppedNIDs); err != nil {
+			return err
+		}
+	}
+	if len(items) > 0 {
+		log.WithField("count", len(items)).Info("Restored application service queues")
+	}
+	return nil
+}
+
+// SendEvent sends the event to the application services with the given IDs.
+func (aqs *AppServiceQueues) SendEvent(ev *gomatrixserverlib.Event, appServiceIDs []string) error {
+	log.WithFields(log.Fields{
+		"appservices": appServiceIDs, "event": ev.EventID(),
+	}).Info("Sending event to application services")
+
+	for _, appServiceID := range appServiceIDs {
+		aq := aqs.queues[appServiceID]
+		if aq == nil {
+			continue
+		}
+		queueNID, err := aqs.db.QueueEvent(appServiceID, ev)
+		if err != nil {
+			return err
+		}
+		aq.sendEvent(queueNID, ev)
+	}
+	return nil
+}
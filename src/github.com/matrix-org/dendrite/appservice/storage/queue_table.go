@@ -0,0 +1,123 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/appservice/types"
+)
+
+const queueSchema = `
+-- The queue table stores the events waiting to be sent to each application
+-- service, so that they are still sent if the server restarts.
+CREATE TABLE IF NOT EXISTS appservice_queue (
+    -- The position of the event in the queues.
+    queue_nid BIGSERIAL PRIMARY KEY,
+    -- The ID of the application service the event is sent to.
+    appservice_id TEXT NOT NULL,
+    -- The JSON of the event.
+    event_json TEXT NOT NULL,
+    -- The ID of the transaction the event was sent in, or the empty string
+    -- if it hasn't been sent yet. Events are sent again with the same
+    -- transaction ID after a restart so that the application service can
+    -- tell they're retries.
+    transaction_id TEXT NOT NULL DEFAULT ''
+);
+`
+
+const insertQueueItemSQL = "" +
+	"INSERT INTO appservice_queue (appservice_id, event_json)" +
+	" VALUES ($1, $2) RETURNING queue_nid"
+
+const updateQueueItemsTransactionIDSQL = "" +
+	"UPDATE appservice_queue SET transaction_id = $2 WHERE queue_nid = ANY($1)"
+
+const deleteQueueItemsSQL = "" +
+	"DELETE FROM appservice_queue WHERE queue_nid = ANY($1)"
+
+const selectQueueItemsSQL = "" +
+	"SELECT queue_nid, appservice_id, event_json, transaction_id" +
+	" FROM appservice_queue ORDER BY queue_nid ASC"
+
+type queueStatements struct {
+	insertQueueItemStmt               *sql.Stmt
+	updateQueueItemsTransactionIDStmt *sql.Stmt
+	deleteQueueItemsStmt              *sql.Stmt
+	selectQueueItemsStmt              *sql.Stmt
+}
+
+func (s *queueStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueItemStmt, err = db.Prepare(insertQueueItemSQL); err != nil {
+		return
+	}
+	if s.updateQueueItemsTransactionIDStmt, err = db.Prepare(updateQueueItemsTransactionIDSQL); err != nil {
+		return
+	}
+	if s.deleteQueueItemsStmt, err = db.Prepare(deleteQueueItemsSQL); err != nil {
+		return
+	}
+	if s.selectQueueItemsStmt, err = db.Prepare(selectQueueItemsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueStatements) insertQueueItem(
+	appServiceID string, eventJSON []byte,
+) (queueNID int64, err error) {
+	err = s.insertQueueItemStmt.QueryRow(appServiceID, string(eventJSON)).Scan(&queueNID)
+	return
+}
+
+func (s *queueStatements) updateQueueItemsTransactionID(
+	queueNIDs []int64, transactionID string,
+) error {
+	_, err := s.updateQueueItemsTransactionIDStmt.Exec(pq.Int64Array(queueNIDs), transactionID)
+	return err
+}
+
+func (s *queueStatements) deleteQueueItems(queueNIDs []int64) error {
+	_, err := s.deleteQueueItemsStmt.Exec(pq.Int64Array(queueNIDs))
+	return err
+}
+
+func (s *queueStatements) selectQueueItems() ([]types.QueueItem, error) {
+	rows, err := s.selectQueueItemsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var result []types.QueueItem
+	for rows.Next() {
+		var item types.QueueItem
+		var eventJSON string
+		if err = rows.Scan(&item.QueueNID, &item.AppServiceID, &eventJSON, &item.TransactionID); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(eventJSON), &item.Event); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
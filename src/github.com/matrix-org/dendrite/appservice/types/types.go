@@ -0,0 +1,32 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A QueueItem is an event waiting to be sent to an application service.
+type QueueItem struct {
+	// The position of the item in the queues.
+	QueueNID int64
+	// The ID of the application service the event is sent to.
+	AppServiceID string
+	// The ID of the transaction the event was sent in, or the empty string if
+	// it hasn't been sent yet.
+	TransactionID string
+	// The event.
+	Event gomatrixserverlib.Event
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// The number of reports returned when the request doesn't say.
+const defaultReportsLimit = 100
+
+type reportsResponse struct {
+	Reports []report `json:"reports"`
+	// The "from" parameter to use to get the next page of reports, if any.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+type report struct {
+	ID         int64  `json:"id"`
+	UserID     string `json:"user_id"`
+	RoomID     string `json:"room_id"`
+	EventID    string `json:"event_id"`
+	Score      *int64 `json:"score,omitempty"`
+	Reason     string `json:"reason"`
+	ReceivedTS int64  `json:"received_ts"`
+}
+
+// GetReports implements GET /_dendrite/admin/v1/reports
+// The reports are ordered from the oldest to the newest. The optional "from"
+// parameter is the token returned by the previous page.
+func GetReports(req *http.Request, accountDB *accounts.Database) util.JSONResponse {
+	var from int64
+	if fromStr := req.URL.Query().Get("from"); fromStr != "" {
+		var err error
+		if from, err = strconv.ParseInt(fromStr, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("Invalid from token"),
+			}
+		}
+	}
+	limit := defaultReportsLimit
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+
+	reports, err := accountDB.GetReports(from, limit)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := reportsResponse{Reports: []report{}}
+	for _, r := range reports {
+		res.Reports = append(res.Reports, report{
+			ID:         r.ID,
+			UserID:     r.UserID,
+			RoomID:     r.RoomID,
+			EventID:    r.EventID,
+			Score:      r.Score,
+			Reason:     r.Reason,
+			ReceivedTS: int64(r.ReceivedTS),
+		})
+	}
+	// There may be more reports if the page is full.
+	if len(reports) == limit {
+		res.NextToken = strconv.FormatInt(reports[len(reports)-1].ID, 10)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// DismissReport implements DELETE /_dendrite/admin/v1/reports/{reportID}
+func DismissReport(req *http.Request, reportID string, accountDB *accounts.Database) util.JSONResponse {
+	id, err := strconv.ParseInt(reportID, 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid report ID"),
+		}
+	}
+
+	err = accountDB.DeleteReport(id)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Report does not exist"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/servernotices"
+	"github.com/matrix-org/util"
+)
+
+// https://github.com/matrix-org/synapse/blob/master/docs/admin_api/server_notices.md
+type sendServerNoticeRequest struct {
+	UserID  string          `json:"user_id"`
+	Content json.RawMessage `json:"content"`
+	// Defaults to m.room.message.
+	Type string `json:"type"`
+}
+
+type sendServerNoticeResponse struct {
+	EventID string `json:"event_id"`
+}
+
+// SendServerNotice implements POST /_synapse/admin/v1/send_server_notice
+func SendServerNotice(req *http.Request, sender *servernotices.Sender) util.JSONResponse {
+	var r sendServerNoticeRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.UserID == "" || len(r.Content) == 0 {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("user_id and content are required"),
+		}
+	}
+	if r.Type == "" {
+		r.Type = "m.room.message"
+	}
+
+	eventID, err := sender.SendNotice(req.Context(), r.UserID, r.Type, r.Content)
+	switch err {
+	case nil:
+	case servernotices.ErrNotEnabled, servernotices.ErrNotLocalUser:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	case servernotices.ErrUnknownUser:
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound(err.Error()),
+		}
+	default:
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: sendServerNoticeResponse{EventID: eventID},
+	}
+}
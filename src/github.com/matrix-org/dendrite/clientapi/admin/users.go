@@ -0,0 +1,191 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/writers"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of users returned when the request doesn't say.
+const defaultUsersLimit = 100
+
+type usersResponse struct {
+	Users []user `json:"users"`
+	// The "from" parameter to use to get the next page of users, if any.
+	NextToken string `json:"next_token,omitempty"`
+}
+
+type user struct {
+	UserID      string `json:"user_id"`
+	CreatedTS   int64  `json:"created_ts"`
+	Deactivated bool   `json:"deactivated"`
+	IsGuest     bool   `json:"is_guest"`
+	Admin       bool   `json:"admin"`
+}
+
+// GetUsers implements GET /_dendrite/admin/v1/users
+// The users are ordered by localpart. The optional "from" parameter is the
+// token returned by the previous page.
+func GetUsers(req *http.Request, accountDB *accounts.Database) util.JSONResponse {
+	from := req.URL.Query().Get("from")
+	limit := defaultUsersLimit
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+
+	accs, err := accountDB.GetAccounts(from, limit)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := usersResponse{Users: []user{}}
+	for _, acc := range accs {
+		res.Users = append(res.Users, user{
+			UserID:      acc.UserID,
+			CreatedTS:   acc.CreatedTS,
+			Deactivated: acc.IsDeactivated,
+			IsGuest:     acc.IsGuest,
+			Admin:       acc.IsAdmin,
+		})
+	}
+	// There may be more users if the page is full.
+	if len(accs) == limit {
+		res.NextToken = accs[len(accs)-1].Localpart
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// DeactivateUser implements POST /_dendrite/admin/v1/deactivate/{userID}
+// Unlike /account/deactivate, the user doesn't need to authenticate.
+func DeactivateUser(
+	req *http.Request, userID string,
+	accountDB *accounts.Database, deviceDB *devices.Database, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) util.JSONResponse {
+	if _, resErr := getLocalAccount(req, userID, accountDB, cfg); resErr != nil {
+		return *resErr
+	}
+
+	err := writers.DeactivateUser(req.Context(), userID, accountDB, deviceDB, cfg, queryAPI, producer)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+type whoisResponse struct {
+	UserID      string                 `json:"user_id"`
+	Deactivated bool                   `json:"deactivated"`
+	Devices     map[string]whoisDevice `json:"devices"`
+}
+
+type whoisDevice struct {
+	DisplayName string `json:"display_name,omitempty"`
+	// When the device logged in.
+	LoginTS int64 `json:"login_ts"`
+}
+
+// GetWhois implements GET /_dendrite/admin/v1/whois/{userID}
+// It returns the devices the user is logged in with, and when they logged in.
+func GetWhois(
+	req *http.Request, userID string,
+	accountDB *accounts.Database, deviceDB *devices.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	account, resErr := getLocalAccount(req, userID, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+
+	devs, err := deviceDB.GetDevicesByLocalpart(account.Localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := whoisResponse{
+		UserID:      userID,
+		Deactivated: account.IsDeactivated,
+		Devices:     map[string]whoisDevice{},
+	}
+	for _, dev := range devs {
+		res.Devices[dev.ID] = whoisDevice{
+			DisplayName: dev.DisplayName,
+			LoginTS:     dev.CreatedTS,
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// getLocalAccount returns the account of the user with the given ID. Returns an
+// error response if the user isn't a local user with an account.
+func getLocalAccount(
+	req *http.Request, userID string, accountDB *accounts.Database, cfg config.Dendrite,
+) (*authtypes.Account, *util.JSONResponse) {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if serverName != cfg.Matrix.ServerName {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be managed"),
+		}
+	}
+	account, err := accountDB.GetAccountByLocalpart(localpart)
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("User does not exist"),
+		}
+	} else if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+	return account, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// appServiceDeviceDatabase is a DeviceDatabase which also accepts the as_token
+// of the application services, as the access token of their sender users.
+type appServiceDeviceDatabase struct {
+	DeviceDatabase
+	registrations []config.ApplicationService
+}
+
+// NewAppServiceDeviceDatabase returns a DeviceDatabase which looks up the
+// devices in deviceDB, unless the access token is the as_token of one of the
+// application services. The device is then one of the sender user of the
+// application service, which can act as the other users in its namespaces with
+// the user_id query parameter.
+func NewAppServiceDeviceDatabase(
+	deviceDB DeviceDatabase, registrations []config.ApplicationService,
+) DeviceDatabase {
+	if len(registrations) == 0 {
+		return deviceDB
+	}
+	return &appServiceDeviceDatabase{deviceDB, registrations}
+}
+
+// GetDeviceByAccessToken implements DeviceDatabase
+func (d *appServiceDeviceDatabase) GetDeviceByAccessToken(token string) (*authtypes.Device, error) {
+	if registration := appServiceForToken(d.registrations, token); registration != nil {
+		return &authtypes.Device{
+			ID:          registration.ID,
+			UserID:      registration.SenderUserID,
+			AccessToken: token,
+			AppService:  registration,
+		}, nil
+	}
+	return d.DeviceDatabase.GetDeviceByAccessToken(token)
+}
+
+// VerifyAppServiceToken verifies that the access token supplied in the given
+// HTTP request is the as_token of one of the application services, and
+// returns that application service. Returns an error response which can be
+// sent to the client if it isn't.
+func VerifyAppServiceToken(
+	req *http.Request, registrations []config.ApplicationService,
+) (*config.ApplicationService, *util.JSONResponse) {
+	token, err := extractAccessToken(req)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: 401,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+	registration := appServiceForToken(registrations, token)
+	if registration == nil {
+		return nil, &util.JSONResponse{
+			Code: 401,
+			JSON: jsonerror.UnknownToken("Unknown application service token"),
+		}
+	}
+	return registration, nil
+}
+
+// masqueradeAs returns a device acting as the user in the user_id query
+// parameter of the request, for a device authenticated with the as_token of
+// an application service. The user must be on the same server as the sender
+// of the application service and in its namespaces. Without user_id the
+// device itself is returned.
+func masqueradeAs(req *http.Request, device *authtypes.Device) (*authtypes.Device, *util.JSONResponse) {
+	userID := req.URL.Query().Get("user_id")
+	if userID == "" || userID == device.UserID {
+		return device, nil
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + userID),
+		}
+	}
+	_, senderServerName, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil || serverName != senderServerName || !device.AppService.IsInterestedInUserID(userID) {
+		return nil, &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Application service cannot masquerade as this user"),
+		}
+	}
+	masqueraded := *device
+	masqueraded.UserID = userID
+	return &masqueraded, nil
+}
+
+// AppServiceAccountDatabase represents an account database application
+// service users can be created in.
+type AppServiceAccountDatabase interface {
+	AccountDatabase
+	// Create a new account without a password.
+	CreatePasswordlessAccount(localpart string) (*authtypes.Account, error)
+}
+
+// CreateAppServiceSenders creates the passwordless accounts of the sender
+// users of the application services if they don't exist yet.
+func CreateAppServiceSenders(
+	accountDB AppServiceAccountDatabase, registrations []config.ApplicationService,
+) error {
+	for _, registration := range registrations {
+		_, err := accountDB.GetAccountByLocalpart(registration.SenderLocalpart)
+		if err == sql.ErrNoRows {
+			_, err = accountDB.CreatePasswordlessAccount(registration.SenderLocalpart)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appServiceForToken returns the application service with the as_token, or
+// nil if there isn't one.
+func appServiceForToken(registrations []config.ApplicationService, token string) *config.ApplicationService {
+	for i := range registrations {
+		if subtle.ConstantTimeCompare([]byte(registrations[i].ASToken), []byte(token)) == 1 {
+			return &registrations[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+const testAppServiceRegistration = `
+id: irc
+url: "http://localhost:9000"
+as_token: as_secret
+hs_token: hs_secret
+sender_localpart: ircbot
+namespaces:
+  users:
+    - exclusive: true
+      regex: "@irc_.*"
+`
+
+// fakeDeviceDatabase has the devices of the given access tokens.
+type fakeDeviceDatabase map[string]*authtypes.Device
+
+func (d fakeDeviceDatabase) GetDeviceByAccessToken(token string) (*authtypes.Device, error) {
+	device, ok := d[token]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+func TestVerifyAccessTokenAppService(t *testing.T) {
+	registration, err := config.LoadApplicationService("irc.yaml", []byte(testAppServiceRegistration), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deviceDB := NewAppServiceDeviceDatabase(fakeDeviceDatabase{
+		"alice_token": {ID: "ALICEDEVICE", UserID: "@alice:localhost"},
+	}, []config.ApplicationService{*registration})
+
+	tests := []struct {
+		query      string
+		wantCode   int
+		wantUserID string
+	}{
+		{"access_token=as_secret", 0, "@ircbot:localhost"},
+		{"access_token=as_secret&user_id=%40ircbot%3Alocalhost", 0, "@ircbot:localhost"},
+		{"access_token=as_secret&user_id=%40irc_bob%3Alocalhost", 0, "@irc_bob:localhost"},
+		// The user must be in the namespaces of the application service.
+		{"access_token=as_secret&user_id=%40bob%3Alocalhost", 403, ""},
+		// The user must be on the server of the application service.
+		{"access_token=as_secret&user_id=%40irc_bob%3Aremote", 403, ""},
+		{"access_token=as_secret&user_id=irc_bob", 400, ""},
+		// Other users can't act as someone else.
+		{"access_token=alice_token", 0, "@alice:localhost"},
+		{"access_token=alice_token&user_id=%40irc_bob%3Alocalhost", 0, "@alice:localhost"},
+		{"access_token=unknown", 401, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/_matrix/client/r0/account/whoami?"+tt.query, nil)
+		device, resErr := VerifyAccessToken(req, deviceDB)
+		if tt.wantCode != 0 {
+			if resErr == nil || resErr.Code != tt.wantCode {
+				t.Errorf("VerifyAccessToken(%s): want a %d, got %+v", tt.query, tt.wantCode, resErr)
+			}
+			continue
+		}
+		if resErr != nil {
+			t.Errorf("VerifyAccessToken(%s): want no error, got %+v", tt.query, resErr)
+			continue
+		}
+		if device.UserID != tt.wantUserID {
+			t.Errorf("VerifyAccessToken(%s): want user %s, got %s", tt.query, tt.wantUserID, device.UserID)
+		}
+	}
+}
+
+func TestVerifyAppServiceToken(t *testing.T) {
+	registration, err := config.LoadApplicationService("irc.yaml", []byte(testAppServiceRegistration), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrations := []config.ApplicationService{*registration}
+
+	req := httptest.NewRequest("GET", "/_matrix/client/r0/thirdparty/protocols", nil)
+	req.Header.Set("Authorization", "Bearer as_secret")
+	if got, resErr := VerifyAppServiceToken(req, registrations); resErr != nil || got.ID != "irc" {
+		t.Errorf("wanted the irc application service, got %+v, %+v", got, resErr)
+	}
+	for _, token := range []string{"", "hs_secret"} {
+		req = httptest.NewRequest("GET", "/_matrix/client/r0/thirdparty/protocols?access_token="+token, nil)
+		if _, resErr := VerifyAppServiceToken(req, registrations); resErr == nil || resErr.Code != 401 {
+			t.Errorf("VerifyAppServiceToken(%q): want a 401, got %+v", token, resErr)
+		}
+	}
+}
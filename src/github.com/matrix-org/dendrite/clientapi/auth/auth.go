@@ -25,6 +25,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -45,9 +46,104 @@ type DeviceDatabase interface {
 	GetDeviceByAccessToken(token string) (*authtypes.Device, error)
 }
 
+// AccountDatabase represents an account database.
+type AccountDatabase interface {
+	// Look up the account matching the given localpart.
+	GetAccountByLocalpart(localpart string) (*authtypes.Account, error)
+}
+
+// AdminAccountDatabase represents an account database server admins can be
+// promoted in.
+type AdminAccountDatabase interface {
+	// Set whether the account with the given localpart is a server admin.
+	SetAdmin(localpart string, isAdmin bool) error
+}
+
+// PromoteAdmins makes the accounts of the given local user IDs server admins.
+// Accounts which don't exist yet are promoted when they are registered.
+func PromoteAdmins(accountDB AdminAccountDatabase, admins []string) error {
+	for _, userID := range admins {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return err
+		}
+		if err = accountDB.SetAdmin(localpart, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyAdmin verifies that the given device belongs to a server admin, and
+// sets its IsAdmin field from the account.
+// Returns an error response which can be sent to the client if it doesn't, or
+// if there was a problem querying the database.
+func VerifyAdmin(device *authtypes.Device, accountDB AccountDatabase) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("Failed to check admin status"),
+		}
+	}
+	account, err := accountDB.GetAccountByLocalpart(localpart)
+	if err != nil && err != sql.ErrNoRows {
+		return &util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("Failed to check admin status"),
+		}
+	}
+	device.IsAdmin = err == nil && account.IsAdmin
+	if !device.IsAdmin {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	}
+	return nil
+}
+
+// SetGuest sets the IsGuest field of the given device from its account. The
+// users of application services may not have an account, and aren't guests.
+// Returns an error if there was a problem querying the database.
+func SetGuest(device *authtypes.Device, accountDB AccountDatabase) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return err
+	}
+	account, err := accountDB.GetAccountByLocalpart(localpart)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	device.IsGuest = err == nil && account.IsGuest
+	return nil
+}
+
+// VerifyNotGuest verifies that the given device doesn't belong to a guest
+// account, and sets its IsGuest field from the account.
+// Returns an error response which can be sent to the client if it does, or if
+// there was a problem querying the database.
+func VerifyNotGuest(device *authtypes.Device, accountDB AccountDatabase) *util.JSONResponse {
+	if err := SetGuest(device, accountDB); err != nil {
+		return &util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("Failed to check guest status"),
+		}
+	}
+	if device.IsGuest {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.GuestAccessForbidden("Guest users can't do this"),
+		}
+	}
+	return nil
+}
+
 // VerifyAccessToken verifies that an access token was supplied in the given HTTP request
 // and returns the device it corresponds to. Returns resErr (an error response which can be
 // sent to the client) if the token is invalid or there was a problem querying the database.
+// Application services can act as the users in their namespaces with the user_id query
+// parameter.
 func VerifyAccessToken(req *http.Request, deviceDB DeviceDatabase) (device *authtypes.Device, resErr *util.JSONResponse) {
 	token, err := extractAccessToken(req)
 	if err != nil {
@@ -60,9 +156,11 @@ func VerifyAccessToken(req *http.Request, deviceDB DeviceDatabase) (device *auth
 	device, err = deviceDB.GetDeviceByAccessToken(token)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// The token either never existed or belonged to a device
+			// which has since been logged out.
 			resErr = &util.JSONResponse{
-				Code: 403,
-				JSON: jsonerror.Forbidden("Invalid access token"),
+				Code: 401,
+				JSON: jsonerror.UnknownToken("Unknown access token"),
 			}
 		} else {
 			resErr = &util.JSONResponse{
@@ -70,6 +168,10 @@ func VerifyAccessToken(req *http.Request, deviceDB DeviceDatabase) (device *auth
 				JSON: jsonerror.Unknown("Failed to check access token"),
 			}
 		}
+		return
+	}
+	if device.AppService != nil {
+		device, resErr = masqueradeAs(req, device)
 	}
 	return
 }
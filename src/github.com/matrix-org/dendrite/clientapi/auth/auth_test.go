@@ -0,0 +1,62 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// fakeAccountDatabase has the accounts of the given localparts.
+type fakeAccountDatabase map[string]*authtypes.Account
+
+func (d fakeAccountDatabase) GetAccountByLocalpart(localpart string) (*authtypes.Account, error) {
+	account, ok := d[localpart]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return account, nil
+}
+
+func TestVerifyNotGuest(t *testing.T) {
+	accountDB := fakeAccountDatabase{
+		"alice": {Localpart: "alice"},
+		"guest": {Localpart: "guest", IsGuest: true},
+	}
+	tests := []struct {
+		userID    string
+		wantGuest bool
+	}{
+		{"@alice:localhost", false},
+		{"@guest:localhost", true},
+		// The users of application services may not have an account.
+		{"@_irc_bob:localhost", false},
+	}
+	for _, tt := range tests {
+		device := &authtypes.Device{UserID: tt.userID}
+		resErr := VerifyNotGuest(device, accountDB)
+		if device.IsGuest != tt.wantGuest {
+			t.Errorf("VerifyNotGuest(%s): want IsGuest %t, got %t", tt.userID, tt.wantGuest, device.IsGuest)
+		}
+		if tt.wantGuest && (resErr == nil || resErr.Code != 403) {
+			t.Errorf("VerifyNotGuest(%s): want a 403, got %+v", tt.userID, resErr)
+		}
+		if !tt.wantGuest && resErr != nil {
+			t.Errorf("VerifyNotGuest(%s): want no error, got %+v", tt.userID, resErr)
+		}
+	}
+}
@@ -24,7 +24,16 @@ type Account struct {
 	Localpart  string
 	ServerName gomatrixserverlib.ServerName
 	Profile    *Profile
-	// TODO: Other flags like IsAdmin, IsGuest
+	// Whether the account has been deactivated, in which case it can't be
+	// logged into anymore.
+	IsDeactivated bool
+	// Whether the account was registered by a guest.
+	IsGuest bool
+	// Whether the account belongs to a server admin, who can use the admin
+	// API.
+	IsAdmin bool
+	// When the account was registered, as a unix timestamp (ms resolution).
+	CreatedTS int64
 	// TODO: Devices
 	// TODO: Associations (e.g. with application services)
 }
@@ -14,6 +14,10 @@
 
 package authtypes
 
+import (
+	"github.com/matrix-org/dendrite/common/config"
+)
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -21,5 +25,18 @@ type Device struct {
 	// The access_token granted to this device.
 	// This uniquely identifies the device from all other devices and clients.
 	AccessToken string
-	// TODO: display name, last used timestamp, keys, etc
+	// The display name of the device, as given by the user. Can be empty.
+	DisplayName string
+	// When the device logged in, as a unix timestamp (ms resolution).
+	CreatedTS int64
+	// The application service whose as_token was used as the access token,
+	// or nil for the devices of normal users. These devices aren't stored.
+	AppService *config.ApplicationService
+	// Whether the device belongs to a server admin. Only set on devices which
+	// went through auth.VerifyAdmin.
+	IsAdmin bool
+	// Whether the device belongs to a guest account. Only set on devices
+	// which went through auth.SetGuest or auth.VerifyNotGuest.
+	IsGuest bool
+	// TODO: last used timestamp, keys, etc
 }
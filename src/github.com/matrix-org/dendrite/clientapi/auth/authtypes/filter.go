@@ -0,0 +1,125 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import (
+	"errors"
+	"strings"
+)
+
+// Filter is used by clients to specify how the server should filter responses
+// to e.g. /sync requests. See https://matrix.org/docs/spec/client_server/r0.2.0.html#filtering
+type Filter struct {
+	EventFields []string    `json:"event_fields"`
+	EventFormat string      `json:"event_format,omitempty"`
+	Presence    EventFilter `json:"presence"`
+	AccountData EventFilter `json:"account_data"`
+	Room        RoomFilter  `json:"room"`
+}
+
+// EventFilter is used to restrict which events are returned to the client.
+type EventFilter struct {
+	Limit      int      `json:"limit,omitempty"`
+	NotSenders []string `json:"not_senders"`
+	NotTypes   []string `json:"not_types"`
+	Senders    []string `json:"senders"`
+	Types      []string `json:"types"`
+}
+
+// RoomEventFilter is an EventFilter which also filters on the room an event
+// belongs to.
+type RoomEventFilter struct {
+	EventFilter
+	NotRooms []string `json:"not_rooms"`
+	Rooms    []string `json:"rooms"`
+}
+
+// RoomFilter describes how the server should filter events in rooms.
+type RoomFilter struct {
+	NotRooms     []string        `json:"not_rooms"`
+	Rooms        []string        `json:"rooms"`
+	Ephemeral    RoomEventFilter `json:"ephemeral"`
+	IncludeLeave bool            `json:"include_leave,omitempty"`
+	State        RoomEventFilter `json:"state"`
+	Timeline     RoomEventFilter `json:"timeline"`
+	AccountData  RoomEventFilter `json:"account_data"`
+}
+
+// Validate checks that the filter only uses values allowed by the spec.
+func (f *Filter) Validate() error {
+	if f.EventFormat != "" && f.EventFormat != "client" && f.EventFormat != "federation" {
+		return errors.New("event_format must be 'client' or 'federation'")
+	}
+	if f.Room.Timeline.Limit < 0 {
+		return errors.New("room.timeline.limit must not be negative")
+	}
+	return nil
+}
+
+// AllowsEvent returns true if an event with the given type and sender passes
+// the filter. Event types may contain a '*' wildcard, e.g. "m.room.*".
+func (f *EventFilter) AllowsEvent(eventType, sender string) bool {
+	if containsString(f.NotSenders, sender) {
+		return false
+	}
+	if f.Senders != nil && !containsString(f.Senders, sender) {
+		return false
+	}
+	if matchesAnyType(f.NotTypes, eventType) {
+		return false
+	}
+	if f.Types != nil && !matchesAnyType(f.Types, eventType) {
+		return false
+	}
+	return true
+}
+
+// AllowsRoom returns true if events from the given room pass the filter.
+func (f *RoomEventFilter) AllowsRoom(roomID string) bool {
+	if containsString(f.NotRooms, roomID) {
+		return false
+	}
+	return f.Rooms == nil || containsString(f.Rooms, roomID)
+}
+
+// AllowsRoom returns true if the given room should be included at all.
+func (f *RoomFilter) AllowsRoom(roomID string) bool {
+	if containsString(f.NotRooms, roomID) {
+		return false
+	}
+	return f.Rooms == nil || containsString(f.Rooms, roomID)
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyType(patterns []string, eventType string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(eventType, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if p == eventType {
+			return true
+		}
+	}
+	return false
+}
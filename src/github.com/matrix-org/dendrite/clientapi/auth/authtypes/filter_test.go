@@ -0,0 +1,54 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import (
+	"testing"
+)
+
+func TestEventFilterAllowsEvent(t *testing.T) {
+	filter := EventFilter{
+		Types:      []string{"m.room.*", "m.presence"},
+		NotTypes:   []string{"m.room.member"},
+		NotSenders: []string{"@spammer:localhost"},
+	}
+	tests := []struct {
+		eventType string
+		sender    string
+		want      bool
+	}{
+		{"m.room.message", "@alice:localhost", true},
+		{"m.presence", "@alice:localhost", true},
+		{"m.room.member", "@alice:localhost", false},
+		{"m.typing", "@alice:localhost", false},
+		{"m.room.message", "@spammer:localhost", false},
+	}
+	for _, tt := range tests {
+		if got := filter.AllowsEvent(tt.eventType, tt.sender); got != tt.want {
+			t.Errorf("AllowsEvent(%q, %q): want %t, got %t", tt.eventType, tt.sender, tt.want, got)
+		}
+	}
+}
+
+func TestEmptyEventFilterAllowsEverything(t *testing.T) {
+	var filter EventFilter
+	if !filter.AllowsEvent("m.room.message", "@alice:localhost") {
+		t.Error("empty filter should allow all events")
+	}
+	filter.Senders = []string{}
+	if filter.AllowsEvent("m.room.message", "@alice:localhost") {
+		t.Error("filter with an empty senders list should allow no events")
+	}
+}
@@ -5,5 +5,11 @@ type LoginType string
 
 // The relevant login types implemented in Dendrite
 const (
-	LoginTypeDummy = "m.login.dummy"
+	LoginTypeDummy     = "m.login.dummy"
+	LoginTypePassword  = "m.login.password"
+	LoginTypeRecaptcha = "m.login.recaptcha"
+	// https://github.com/matrix-org/matrix-doc/pull/3231
+	LoginTypeRegistrationToken = "m.login.registration_token"
+	// Used by application services to register the users in their namespaces.
+	LoginTypeApplicationService = "m.login.application_service"
 )
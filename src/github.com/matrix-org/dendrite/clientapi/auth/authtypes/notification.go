@@ -0,0 +1,39 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Notification is an event which matched a push rule of a user telling to
+// notify them, as kept in their notification history.
+type Notification struct {
+	// The position of the notification in the notification history
+	ID        int64
+	Localpart string
+	RoomID    string
+	EventID   string
+	// The event in the client format, as JSON
+	Event json.RawMessage
+	// The actions of the push rule the event matched, as JSON
+	Actions json.RawMessage
+	// Whether the push rule highlights the event
+	Highlight bool
+	// When the event was sent
+	Timestamp gomatrixserverlib.Timestamp
+}
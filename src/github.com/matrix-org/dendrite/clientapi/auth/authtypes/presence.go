@@ -0,0 +1,35 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// The presence states a user can be in.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// Presence represents the presence of a user
+type Presence struct {
+	UserID string
+	// One of PresenceOnline, PresenceUnavailable or PresenceOffline
+	Presence string
+	// An optional message set by the user, e.g. "Out for lunch"
+	StatusMsg string
+	// When the user was last active
+	LastActiveTS gomatrixserverlib.Timestamp
+}
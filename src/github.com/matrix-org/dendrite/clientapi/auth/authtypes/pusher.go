@@ -0,0 +1,36 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// Pusher represents a pusher registered by a user, which is sent
+// notifications when an event matches the user's push rules.
+type Pusher struct {
+	Localpart string `json:"-"`
+	// The kind of pusher, e.g. "http"
+	Kind              string `json:"kind"`
+	AppID             string `json:"app_id"`
+	PushKey           string `json:"pushkey"`
+	AppDisplayName    string `json:"app_display_name"`
+	DeviceDisplayName string `json:"device_display_name"`
+	ProfileTag        string `json:"profile_tag,omitempty"`
+	Lang              string `json:"lang"`
+	// Data for the pusher. For HTTP pushers it holds the URL of the push
+	// gateway, and the rest of it is sent along with the notifications.
+	Data map[string]interface{} `json:"data"`
+	// When the push key was last updated
+	PushKeyTS gomatrixserverlib.Timestamp `json:"-"`
+}
@@ -0,0 +1,33 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Report is a report of an event made by a user, e.g. of abusive content.
+type Report struct {
+	ID      int64
+	UserID  string
+	RoomID  string
+	EventID string
+	// The score given by the user, from -100 for the most offensive to 0, or
+	// nil if they didn't give one
+	Score  *int64
+	Reason string
+	// When the report was received
+	ReceivedTS gomatrixserverlib.Timestamp
+}
@@ -0,0 +1,27 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// RoomTags is the content of a m.tag room account data event, which maps the
+// tags a user gave to a room to their info.
+type RoomTags struct {
+	Tags map[string]TagInfo `json:"tags"`
+}
+
+// TagInfo is the info of a tag a user gave to a room.
+type TagInfo struct {
+	// The position of the room among the rooms with this tag, between 0 and 1.
+	Order *float64 `json:"order,omitempty"`
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+// ThreePIDInvite represents an invite to a room sent to a third-party
+// identifier (e.g. an email address) which isn't yet associated with a Matrix
+// user ID. It is kept until the invitee binds the identifier to an account on
+// this home server so the invite can then be completed.
+type ThreePIDInvite struct {
+	// The token issued by the identity server for this invite. This is also
+	// the state key of the m.room.third_party_invite event.
+	Token string
+	// The identity server the invite was stored on.
+	IDServer string
+	// The kind of third-party identifier (e.g. "email").
+	Medium string
+	// The third-party identifier itself.
+	Address string
+	// The room the invite is for.
+	RoomID string
+	// The Matrix user ID of the user who sent the invite.
+	Sender string
+	// The redacted display name the identity server returned for the invitee.
+	DisplayName string
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtypes
+
+import "encoding/json"
+
+// ToDeviceMessage represents a message sent by a user directly to a device of
+// a local user, rather than in a room.
+type ToDeviceMessage struct {
+	// The Matrix user ID of the user who sent the message
+	Sender string
+	// The Matrix user ID and the device ID of the device the message is for
+	UserID   string
+	DeviceID string
+	// The type of the message, e.g. m.room_key_request
+	Type    string
+	Content json.RawMessage
+}
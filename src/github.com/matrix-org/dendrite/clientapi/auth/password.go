@@ -0,0 +1,58 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"unicode"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// CheckPasswordPolicy checks that the given password follows the given policy.
+// The returned error is human-readable and can be sent back to the client.
+func CheckPasswordPolicy(password string, policy config.PasswordPolicy) error {
+	if len(password) < policy.MinLength {
+		return fmt.Errorf("password too weak: min %d chars", policy.MinLength)
+	}
+
+	var hasDigit, hasLower, hasUpper, hasSymbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsDigit(c):
+			hasDigit = true
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case !unicode.IsLetter(c):
+			hasSymbol = true
+		}
+	}
+
+	if policy.RequireDigit && !hasDigit {
+		return fmt.Errorf("password too weak: must contain a digit")
+	}
+	if policy.RequireLowercase && !hasLower {
+		return fmt.Errorf("password too weak: must contain a lowercase letter")
+	}
+	if policy.RequireUppercase && !hasUpper {
+		return fmt.Errorf("password too weak: must contain an uppercase letter")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return fmt.Errorf("password too weak: must contain a symbol")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	policy := config.PasswordPolicy{
+		MinLength:        8,
+		RequireDigit:     true,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireSymbol:    true,
+	}
+	tests := []struct {
+		password string
+		wantOK   bool
+	}{
+		{"aB3$", false},
+		{"abcdefg3$", false},
+		{"ABCDEFG3$", false},
+		{"abcDEFGH$", false},
+		{"abcDEFG34", false},
+		{"abcDEF3$", true},
+	}
+	for _, tt := range tests {
+		err := CheckPasswordPolicy(tt.password, policy)
+		if tt.wantOK && err != nil {
+			t.Errorf("CheckPasswordPolicy(%q): want no error, got %s", tt.password, err)
+		} else if !tt.wantOK && err == nil {
+			t.Errorf("CheckPasswordPolicy(%q): want an error, got none", tt.password)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package accounts
 import (
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -73,8 +74,10 @@ func (s *accountDataStatements) prepare(db *sql.DB) (err error) {
 	return
 }
 
-func (s *accountDataStatements) insertAccountData(localpart string, roomID string, dataType string, content string) (err error) {
-	_, err = s.insertAccountDataStmt.Exec(localpart, roomID, dataType, content)
+func (s *accountDataStatements) insertAccountData(
+	localpart string, roomID string, dataType string, content string, txn *sql.Tx,
+) (err error) {
+	_, err = common.TxStmt(txn, s.insertAccountDataStmt).Exec(localpart, roomID, dataType, content)
 	return
 }
 
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -31,27 +32,54 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- When this account was first created, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The password hash for this account. Can be NULL if this is a passwordless account.
-    password_hash TEXT
+    password_hash TEXT,
+    -- Whether the account has been deactivated. Deactivated accounts can't log in.
+    is_deactivated BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the account is a guest account.
+    is_guest BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the account belongs to a server admin.
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
-    -- is_guest, is_admin, appservice_id, upgraded_ts, devices, any email reset stuff?
+    -- appservice_id, upgraded_ts, devices, any email reset stuff?
 );
 `
 
 const insertAccountSQL = "" +
-	"INSERT INTO account_accounts(localpart, created_ts, password_hash) VALUES ($1, $2, $3)"
+	"INSERT INTO account_accounts(localpart, created_ts, password_hash, is_guest, is_admin) VALUES ($1, $2, $3, $4, $5)"
+
+// Guests and passwordless accounts, e.g. the users of application services,
+// don't count as users of the server.
+const selectUserAccountExistsSQL = "" +
+	"SELECT EXISTS (SELECT 1 FROM account_accounts WHERE is_guest = FALSE AND password_hash IS NOT NULL)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, created_ts, is_deactivated, is_guest, is_admin FROM account_accounts WHERE localpart = $1"
+
+const selectAccountsSQL = "" +
+	"SELECT localpart, created_ts, is_deactivated, is_guest, is_admin FROM account_accounts" +
+	" WHERE localpart > $1 ORDER BY localpart LIMIT $2"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
 
-// TODO: Update password
+const updatePasswordHashSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2"
+
+const deactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = TRUE WHERE localpart = $1"
+
+const updateIsAdminSQL = "" +
+	"UPDATE account_accounts SET is_admin = $1 WHERE localpart = $2"
 
 type accountsStatements struct {
 	insertAccountStmt            *sql.Stmt
 	selectAccountByLocalpartStmt *sql.Stmt
 	selectPasswordHashStmt       *sql.Stmt
+	updatePasswordHashStmt       *sql.Stmt
+	deactivateAccountStmt        *sql.Stmt
+	selectAccountsStmt           *sql.Stmt
+	updateIsAdminStmt            *sql.Stmt
+	selectUserAccountExistsStmt  *sql.Stmt
 	serverName                   gomatrixserverlib.ServerName
 }
 
@@ -60,6 +88,11 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if err != nil {
 		return
 	}
+	if accountsMigrations != "" {
+		if _, err = db.Exec(accountsMigrations); err != nil {
+			return
+		}
+	}
 	if s.insertAccountStmt, err = db.Prepare(insertAccountSQL); err != nil {
 		return
 	}
@@ -69,6 +102,21 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectPasswordHashStmt, err = db.Prepare(selectPasswordHashSQL); err != nil {
 		return
 	}
+	if s.updatePasswordHashStmt, err = db.Prepare(updatePasswordHashSQL); err != nil {
+		return
+	}
+	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
+		return
+	}
+	if s.selectAccountsStmt, err = db.Prepare(selectAccountsSQL); err != nil {
+		return
+	}
+	if s.updateIsAdminStmt, err = db.Prepare(updateIsAdminSQL); err != nil {
+		return
+	}
+	if s.selectUserAccountExistsStmt, err = db.Prepare(selectUserAccountExistsSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -76,33 +124,92 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 // insertAccount creates a new account. 'hash' should be the password hash for this account. If it is missing,
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
-func (s *accountsStatements) insertAccount(localpart, hash string) (acc *authtypes.Account, err error) {
+func (s *accountsStatements) insertAccount(
+	txn *sql.Tx, localpart, hash string, isGuest, isAdmin bool,
+) (acc *authtypes.Account, err error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
-	if _, err = s.insertAccountStmt.Exec(localpart, createdTimeMS, hash); err == nil {
+	nullableHash := sql.NullString{String: hash, Valid: hash != ""}
+	if _, err = common.TxStmt(txn, s.insertAccountStmt).Exec(
+		localpart, createdTimeMS, nullableHash, isGuest, isAdmin,
+	); err == nil {
 		acc = &authtypes.Account{
 			Localpart:  localpart,
 			UserID:     makeUserID(localpart, s.serverName),
 			ServerName: s.serverName,
+			IsGuest:    isGuest,
+			IsAdmin:    isAdmin,
+			CreatedTS:  createdTimeMS,
 		}
 	}
 	return
 }
 
-func (s *accountsStatements) selectPasswordHash(localpart string) (hash string, err error) {
-	err = s.selectPasswordHashStmt.QueryRow(localpart).Scan(&hash)
+// selectUserAccountExists returns whether there is an account with a
+// password which isn't a guest account.
+func (s *accountsStatements) selectUserAccountExists(txn *sql.Tx) (exists bool, err error) {
+	err = common.TxStmt(txn, s.selectUserAccountExistsStmt).QueryRow().Scan(&exists)
 	return
 }
 
+// selectPasswordHash returns the password hash of the account, which is empty
+// if the account is passwordless.
+func (s *accountsStatements) selectPasswordHash(localpart string) (string, error) {
+	var hash sql.NullString
+	err := s.selectPasswordHashStmt.QueryRow(localpart).Scan(&hash)
+	return hash.String, err
+}
+
+func (s *accountsStatements) updatePasswordHash(localpart, hash string) error {
+	_, err := s.updatePasswordHashStmt.Exec(hash, localpart)
+	return err
+}
+
+func (s *accountsStatements) deactivateAccount(localpart string) error {
+	_, err := s.deactivateAccountStmt.Exec(localpart)
+	return err
+}
+
+func (s *accountsStatements) updateIsAdmin(localpart string, isAdmin bool) error {
+	_, err := s.updateIsAdminStmt.Exec(isAdmin, localpart)
+	return err
+}
+
 func (s *accountsStatements) selectAccountByLocalpart(localpart string) (*authtypes.Account, error) {
 	var acc authtypes.Account
-	err := s.selectAccountByLocalpartStmt.QueryRow(localpart).Scan(&acc.Localpart)
-	if err != nil {
+	err := s.selectAccountByLocalpartStmt.QueryRow(localpart).Scan(
+		&acc.Localpart, &acc.CreatedTS, &acc.IsDeactivated, &acc.IsGuest, &acc.IsAdmin,
+	)
+	if err == nil {
 		acc.UserID = makeUserID(localpart, s.serverName)
 		acc.ServerName = s.serverName
 	}
 	return &acc, err
 }
 
+// selectAccounts returns at most limit accounts, ordered by localpart, whose
+// localparts come after the given one.
+func (s *accountsStatements) selectAccounts(afterLocalpart string, limit int) ([]authtypes.Account, error) {
+	rows, err := s.selectAccountsStmt.Query(afterLocalpart, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []authtypes.Account{}
+	for rows.Next() {
+		var acc authtypes.Account
+		if err = rows.Scan(
+			&acc.Localpart, &acc.CreatedTS, &acc.IsDeactivated, &acc.IsGuest, &acc.IsAdmin,
+		); err != nil {
+			return nil, err
+		}
+		acc.UserID = makeUserID(acc.Localpart, s.serverName)
+		acc.ServerName = s.serverName
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
 func makeUserID(localpart string, server gomatrixserverlib.ServerName) string {
 	return fmt.Sprintf("@%s:%s", localpart, string(server))
 }
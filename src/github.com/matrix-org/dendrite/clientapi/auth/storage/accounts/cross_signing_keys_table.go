@@ -0,0 +1,90 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const crossSigningKeysSchema = `
+-- Stores the public cross-signing keys of local users.
+CREATE TABLE IF NOT EXISTS account_cross_signing_keys (
+    -- The Matrix user ID localpart of the user the key belongs to
+    localpart TEXT NOT NULL,
+    -- The type of the key, i.e. master, self_signing or user_signing
+    key_type TEXT NOT NULL,
+    -- The key itself, as JSON
+    key_json TEXT NOT NULL,
+    PRIMARY KEY (localpart, key_type)
+);
+`
+
+const upsertCrossSigningKeySQL = "" +
+	"INSERT INTO account_cross_signing_keys(localpart, key_type, key_json) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart, key_type) DO UPDATE SET key_json = $3"
+
+const selectCrossSigningKeysSQL = "" +
+	"SELECT key_type, key_json FROM account_cross_signing_keys WHERE localpart = $1"
+
+type crossSigningKeysStatements struct {
+	upsertCrossSigningKeyStmt  *sql.Stmt
+	selectCrossSigningKeysStmt *sql.Stmt
+}
+
+func (s *crossSigningKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(crossSigningKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertCrossSigningKeyStmt, err = db.Prepare(upsertCrossSigningKeySQL); err != nil {
+		return
+	}
+	if s.selectCrossSigningKeysStmt, err = db.Prepare(selectCrossSigningKeysSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *crossSigningKeysStatements) upsertCrossSigningKey(
+	localpart, keyType string, keyJSON []byte, txn *sql.Tx,
+) (err error) {
+	stmt := common.TxStmt(txn, s.upsertCrossSigningKeyStmt)
+	_, err = stmt.Exec(localpart, keyType, string(keyJSON))
+	return
+}
+
+// selectCrossSigningKeys returns the cross-signing keys of the user, mapped by
+// key type.
+func (s *crossSigningKeysStatements) selectCrossSigningKeys(
+	localpart string,
+) (map[string][]byte, error) {
+	rows, err := s.selectCrossSigningKeysStmt.Query(localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string][]byte)
+	for rows.Next() {
+		var keyType, keyJSON string
+		if err = rows.Scan(&keyType, &keyJSON); err != nil {
+			return nil, err
+		}
+		keys[keyType] = []byte(keyJSON)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+)
+
+// The schema of the table and the statements which depend on the database
+// are in sql_postgres.go and sql_sqlite.go.
+
+const insertFilterSQL = "" +
+	"INSERT INTO account_filter(localpart, filter) VALUES ($1, $2)"
+
+const selectFilterSQL = "" +
+	"SELECT filter FROM account_filter WHERE localpart = $1 AND id = $2"
+
+const selectFilterIDByContentSQL = "" +
+	"SELECT id FROM account_filter WHERE localpart = $1 AND filter = $2"
+
+type filterStatements struct {
+	insertFilterStmt            *sql.Stmt
+	selectFilterStmt            *sql.Stmt
+	selectFilterIDByContentStmt *sql.Stmt
+}
+
+func (s *filterStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(filterSchema)
+	if err != nil {
+		return
+	}
+	if s.insertFilterStmt, err = db.Prepare(insertFilterSQL); err != nil {
+		return
+	}
+	if s.selectFilterStmt, err = db.Prepare(selectFilterSQL); err != nil {
+		return
+	}
+	if s.selectFilterIDByContentStmt, err = db.Prepare(selectFilterIDByContentSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *filterStatements) insertFilter(localpart string, filter []byte) (id int64, err error) {
+	if _, err = s.insertFilterStmt.Exec(localpart, string(filter)); err != nil {
+		return
+	}
+	return s.selectFilterIDByContent(localpart, filter)
+}
+
+// selectFilter returns sql.ErrNoRows if the user has no filter with this ID.
+func (s *filterStatements) selectFilter(localpart string, id int64) (filter []byte, err error) {
+	var content string
+	err = s.selectFilterStmt.QueryRow(localpart, id).Scan(&content)
+	return []byte(content), err
+}
+
+// selectFilterIDByContent returns sql.ErrNoRows if the user has no such filter.
+func (s *filterStatements) selectFilterIDByContent(localpart string, filter []byte) (id int64, err error) {
+	err = s.selectFilterIDByContentStmt.QueryRow(localpart, string(filter)).Scan(&id)
+	return
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+)
+
+const idServerKeysSchema = `
+-- Stores the public keys of the identity servers we checked signatures from.
+CREATE TABLE IF NOT EXISTS account_id_server_keys (
+    -- The domain name of the identity server
+    id_server TEXT NOT NULL,
+    -- The ID of the key (e.g. "ed25519:0")
+    key_id TEXT NOT NULL,
+    -- The raw public key bytes
+    public_key BYTEA NOT NULL,
+    -- When the key was fetched from the identity server, as a timestamp in milliseconds
+    fetched_at BIGINT NOT NULL,
+
+    PRIMARY KEY(id_server, key_id)
+);
+`
+
+const insertIDServerKeySQL = `
+	INSERT INTO account_id_server_keys(id_server, key_id, public_key, fetched_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (id_server, key_id) DO UPDATE SET public_key = EXCLUDED.public_key, fetched_at = EXCLUDED.fetched_at
+`
+
+const selectIDServerKeySQL = "" +
+	"SELECT public_key FROM account_id_server_keys WHERE id_server = $1 AND key_id = $2"
+
+const deleteIDServerKeySQL = "" +
+	"DELETE FROM account_id_server_keys WHERE id_server = $1 AND key_id = $2"
+
+type idServerKeysStatements struct {
+	insertIDServerKeyStmt *sql.Stmt
+	selectIDServerKeyStmt *sql.Stmt
+	deleteIDServerKeyStmt *sql.Stmt
+}
+
+func (s *idServerKeysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(idServerKeysSchema)
+	if err != nil {
+		return
+	}
+	if s.insertIDServerKeyStmt, err = db.Prepare(insertIDServerKeySQL); err != nil {
+		return
+	}
+	if s.selectIDServerKeyStmt, err = db.Prepare(selectIDServerKeySQL); err != nil {
+		return
+	}
+	if s.deleteIDServerKeyStmt, err = db.Prepare(deleteIDServerKeySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *idServerKeysStatements) insertIDServerKey(
+	idServer string, keyID string, publicKey []byte, fetchedAt int64,
+) (err error) {
+	_, err = s.insertIDServerKeyStmt.Exec(idServer, keyID, publicKey, fetchedAt)
+	return
+}
+
+// selectIDServerKey returns nil, with no error, if no key matches.
+func (s *idServerKeysStatements) selectIDServerKey(idServer string, keyID string) (publicKey []byte, err error) {
+	err = s.selectIDServerKeyStmt.QueryRow(idServer, keyID).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return
+}
+
+func (s *idServerKeysStatements) deleteIDServerKey(idServer string, keyID string) (err error) {
+	_, err = s.deleteIDServerKeyStmt.Exec(idServer, keyID)
+	return
+}
@@ -17,8 +17,8 @@ package accounts
 import (
 	"database/sql"
 
-	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
 )
 
 const membershipSchema = `
@@ -47,17 +47,18 @@ const insertMembershipSQL = `
 const selectMembershipsByLocalpartSQL = "" +
 	"SELECT room_id, event_id FROM account_memberships WHERE localpart = $1"
 
-const deleteMembershipsByEventIDsSQL = "" +
-	"DELETE FROM account_memberships WHERE event_id = ANY($1)"
+const selectLocalpartsByRoomIDSQL = "" +
+	"SELECT localpart FROM account_memberships WHERE room_id = $1"
 
 const updateMembershipByEventIDSQL = "" +
-	"UPDATE account_memberships SET event_id = $2 WHERE event_id = $1"
+	"UPDATE account_memberships SET event_id = $1 WHERE event_id = $2"
 
 type membershipStatements struct {
 	deleteMembershipsByEventIDsStmt  *sql.Stmt
 	insertMembershipStmt             *sql.Stmt
 	selectMembershipByEventIDStmt    *sql.Stmt
 	selectMembershipsByLocalpartStmt *sql.Stmt
+	selectLocalpartsByRoomIDStmt     *sql.Stmt
 	updateMembershipByEventIDStmt    *sql.Stmt
 }
 
@@ -75,6 +76,9 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 	if s.selectMembershipsByLocalpartStmt, err = db.Prepare(selectMembershipsByLocalpartSQL); err != nil {
 		return
 	}
+	if s.selectLocalpartsByRoomIDStmt, err = db.Prepare(selectLocalpartsByRoomIDSQL); err != nil {
+		return
+	}
 	if s.updateMembershipByEventIDStmt, err = db.Prepare(updateMembershipByEventIDSQL); err != nil {
 		return
 	}
@@ -87,7 +91,7 @@ func (s *membershipStatements) insertMembership(localpart string, roomID string,
 }
 
 func (s *membershipStatements) deleteMembershipsByEventIDs(eventIDs []string, txn *sql.Tx) (err error) {
-	_, err = txn.Stmt(s.deleteMembershipsByEventIDsStmt).Exec(pq.StringArray(eventIDs))
+	_, err = txn.Stmt(s.deleteMembershipsByEventIDsStmt).Exec(common.StringArray(eventIDs))
 	return
 }
 
@@ -112,7 +116,27 @@ func (s *membershipStatements) selectMembershipsByLocalpart(localpart string) (m
 	return
 }
 
+func (s *membershipStatements) selectLocalpartsByRoomID(roomID string) (localparts []string, err error) {
+	rows, err := s.selectLocalpartsByRoomIDStmt.Query(roomID)
+	if err != nil {
+		return
+	}
+
+	localparts = []string{}
+
+	defer rows.Close()
+	for rows.Next() {
+		var localpart string
+		if err := rows.Scan(&localpart); err != nil {
+			return nil, err
+		}
+		localparts = append(localparts, localpart)
+	}
+
+	return
+}
+
 func (s *membershipStatements) updateMembershipByEventID(oldEventID string, newEventID string) (err error) {
-	_, err = s.updateMembershipByEventIDStmt.Exec(oldEventID, newEventID)
+	_, err = s.updateMembershipByEventIDStmt.Exec(newEventID, oldEventID)
 	return
 }
@@ -0,0 +1,105 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The schema of the table is in sql_postgres.go and sql_sqlite.go.
+
+const insertNotificationSQL = "" +
+	"INSERT INTO account_notifications(localpart, room_id, event_id, event_json, actions, highlight, ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+// Notifications are returned newest first, before the given ID unless it is 0.
+const selectNotificationsSQL = "" +
+	"SELECT id, room_id, event_id, event_json, actions, highlight, ts FROM account_notifications" +
+	" WHERE localpart = $1 AND ($2 = 0 OR id < $2) AND (highlight OR NOT $3)" +
+	" ORDER BY id DESC LIMIT $4"
+
+const deleteNotificationsUpToSQL = "" +
+	"DELETE FROM account_notifications WHERE localpart = $1 AND room_id = $2 AND ts <= $3"
+
+type notificationsStatements struct {
+	insertNotificationStmt      *sql.Stmt
+	selectNotificationsStmt     *sql.Stmt
+	deleteNotificationsUpToStmt *sql.Stmt
+}
+
+func (s *notificationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(notificationsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertNotificationStmt, err = db.Prepare(insertNotificationSQL); err != nil {
+		return
+	}
+	if s.selectNotificationsStmt, err = db.Prepare(selectNotificationsSQL); err != nil {
+		return
+	}
+	if s.deleteNotificationsUpToStmt, err = db.Prepare(deleteNotificationsUpToSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *notificationsStatements) insertNotification(
+	n authtypes.Notification, txn *sql.Tx,
+) error {
+	_, err := common.TxStmt(txn, s.insertNotificationStmt).Exec(
+		n.Localpart, n.RoomID, n.EventID, string(n.Event), string(n.Actions), n.Highlight, int64(n.Timestamp),
+	)
+	return err
+}
+
+// selectNotifications returns at most limit notifications of the user before
+// the given ID, or the latest ones if it is 0, newest first. If onlyHighlight
+// is true, only the notifications of highlighted events are returned.
+func (s *notificationsStatements) selectNotifications(
+	localpart string, beforeID int64, limit int, onlyHighlight bool,
+) ([]authtypes.Notification, error) {
+	rows, err := s.selectNotificationsStmt.Query(localpart, beforeID, onlyHighlight, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []authtypes.Notification{}
+	for rows.Next() {
+		n := authtypes.Notification{Localpart: localpart}
+		var eventJSON, actions string
+		var ts int64
+		if err = rows.Scan(&n.ID, &n.RoomID, &n.EventID, &eventJSON, &actions, &n.Highlight, &ts); err != nil {
+			return nil, err
+		}
+		n.Event = []byte(eventJSON)
+		n.Actions = []byte(actions)
+		n.Timestamp = gomatrixserverlib.Timestamp(ts)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *notificationsStatements) deleteNotificationsUpTo(
+	localpart, roomID string, ts gomatrixserverlib.Timestamp,
+) error {
+	_, err := s.deleteNotificationsUpToStmt.Exec(localpart, roomID, int64(ts))
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The schema of the table and the statements which depend on the database
+// are in sql_postgres.go and sql_sqlite.go.
+
+const selectPresenceIDSQL = "" +
+	"SELECT id FROM account_presence WHERE user_id = $1"
+
+const selectPresenceSQL = "" +
+	"SELECT presence, status_msg, last_active_ts FROM account_presence WHERE user_id = $1"
+
+const selectIdlePresencesSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts FROM account_presence" +
+	" WHERE presence != 'offline' AND last_active_ts < $1"
+
+const updateLastActiveSQL = "" +
+	"UPDATE account_presence SET last_active_ts = $1 WHERE user_id = $2"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM account_presence"
+
+type presenceStatements struct {
+	upsertPresenceStmt          *sql.Stmt
+	selectPresenceIDStmt        *sql.Stmt
+	selectPresenceStmt          *sql.Stmt
+	selectPresencesForUsersStmt *sql.Stmt
+	selectIdlePresencesStmt     *sql.Stmt
+	updateLastActiveStmt        *sql.Stmt
+	selectMaxPresenceIDStmt     *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(presenceSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresenceIDStmt, err = db.Prepare(selectPresenceIDSQL); err != nil {
+		return
+	}
+	if s.selectPresenceStmt, err = db.Prepare(selectPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresencesForUsersStmt, err = db.Prepare(selectPresencesForUsersSQL); err != nil {
+		return
+	}
+	if s.selectIdlePresencesStmt, err = db.Prepare(selectIdlePresencesSQL); err != nil {
+		return
+	}
+	if s.updateLastActiveStmt, err = db.Prepare(updateLastActiveSQL); err != nil {
+		return
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertPresence stores the presence and returns its new position in the
+// presence stream.
+func (s *presenceStatements) upsertPresence(presence authtypes.Presence) (id int64, err error) {
+	if _, err = s.upsertPresenceStmt.Exec(
+		presence.UserID, presence.Presence, presence.StatusMsg, int64(presence.LastActiveTS),
+	); err != nil {
+		return
+	}
+	err = s.selectPresenceIDStmt.QueryRow(presence.UserID).Scan(&id)
+	return
+}
+
+func (s *presenceStatements) selectPresence(userID string) (*authtypes.Presence, error) {
+	var ts int64
+	p := authtypes.Presence{UserID: userID}
+	err := s.selectPresenceStmt.QueryRow(userID).Scan(&p.Presence, &p.StatusMsg, &ts)
+	p.LastActiveTS = gomatrixserverlib.Timestamp(ts)
+	return &p, err
+}
+
+// selectPresencesForUsers returns the presence of the given users, along with
+// the position in the presence stream of their latest update, which is after
+// afterID.
+func (s *presenceStatements) selectPresencesForUsers(
+	userIDs []string, afterID int64,
+) (presences []authtypes.Presence, maxID int64, err error) {
+	rows, err := s.selectPresencesForUsersStmt.Query(common.StringArray(userIDs), afterID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	maxID = afterID
+	for rows.Next() {
+		var id, ts int64
+		var p authtypes.Presence
+		if err = rows.Scan(&id, &p.UserID, &p.Presence, &p.StatusMsg, &ts); err != nil {
+			return
+		}
+		p.LastActiveTS = gomatrixserverlib.Timestamp(ts)
+		presences = append(presences, p)
+		if id > maxID {
+			maxID = id
+		}
+	}
+	return
+}
+
+// selectIdlePresences returns the presence of the users who aren't offline
+// and last set their presence before the given timestamp.
+func (s *presenceStatements) selectIdlePresences(
+	before gomatrixserverlib.Timestamp,
+) (presences []authtypes.Presence, err error) {
+	rows, err := s.selectIdlePresencesStmt.Query(int64(before))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ts int64
+		var p authtypes.Presence
+		if err = rows.Scan(&p.UserID, &p.Presence, &p.StatusMsg, &ts); err != nil {
+			return
+		}
+		p.LastActiveTS = gomatrixserverlib.Timestamp(ts)
+		presences = append(presences, p)
+	}
+	return
+}
+
+// updateLastActive changes when the user was last active without changing
+// the position of their presence in the presence stream.
+func (s *presenceStatements) updateLastActive(userID string, ts gomatrixserverlib.Timestamp) error {
+	_, err := s.updateLastActiveStmt.Exec(int64(ts), userID)
+	return err
+}
+
+func (s *presenceStatements) selectMaxPresenceID() (id int64, err error) {
+	var nullableID sql.NullInt64
+	err = s.selectMaxPresenceIDStmt.QueryRow().Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -16,8 +16,10 @@ package accounts
 
 import (
 	"database/sql"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
 )
 
 const profilesSchema = `
@@ -44,11 +46,21 @@ const setAvatarURLSQL = "" +
 const setDisplayNameSQL = "" +
 	"UPDATE account_profiles SET display_name = $1 WHERE localpart = $2"
 
+// Looks up the profiles of the accounts which aren't deactivated and whose
+// localpart or display name contain the pattern, case insensitively.
+const selectProfilesBySearchSQL = "" +
+	"SELECT p.localpart, p.display_name, p.avatar_url FROM account_profiles p" +
+	" JOIN account_accounts a ON a.localpart = p.localpart" +
+	" WHERE NOT a.is_deactivated" +
+	" AND (LOWER(p.localpart) LIKE $1 ESCAPE '\\' OR LOWER(p.display_name) LIKE $1 ESCAPE '\\')" +
+	" ORDER BY p.localpart ASC LIMIT $2"
+
 type profilesStatements struct {
 	insertProfileStmt            *sql.Stmt
 	selectProfileByLocalpartStmt *sql.Stmt
 	setAvatarURLStmt             *sql.Stmt
 	setDisplayNameStmt           *sql.Stmt
+	selectProfilesBySearchStmt   *sql.Stmt
 }
 
 func (s *profilesStatements) prepare(db *sql.DB) (err error) {
@@ -68,11 +80,14 @@ func (s *profilesStatements) prepare(db *sql.DB) (err error) {
 	if s.setDisplayNameStmt, err = db.Prepare(setDisplayNameSQL); err != nil {
 		return
 	}
+	if s.selectProfilesBySearchStmt, err = db.Prepare(selectProfilesBySearchSQL); err != nil {
+		return
+	}
 	return
 }
 
-func (s *profilesStatements) insertProfile(localpart string) (err error) {
-	_, err = s.insertProfileStmt.Exec(localpart, "", "")
+func (s *profilesStatements) insertProfile(txn *sql.Tx, localpart string) (err error) {
+	_, err = common.TxStmt(txn, s.insertProfileStmt).Exec(localpart, "", "")
 	return
 }
 
@@ -91,3 +106,25 @@ func (s *profilesStatements) setDisplayName(localpart string, displayName string
 	_, err = s.setDisplayNameStmt.Exec(displayName, localpart)
 	return
 }
+
+// selectProfilesBySearch returns at most limit profiles of the accounts which
+// aren't deactivated and whose localpart or display name contain the search
+// term, case insensitively, ordered by localpart.
+func (s *profilesStatements) selectProfilesBySearch(searchTerm string, limit int) ([]authtypes.Profile, error) {
+	// The wildcards of LIKE are matched literally in the search term.
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(searchTerm))
+	rows, err := s.selectProfilesBySearchStmt.Query("%"+escaped+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var profiles []authtypes.Profile
+	for rows.Next() {
+		var profile authtypes.Profile
+		if err = rows.Scan(&profile.Localpart, &profile.DisplayName, &profile.AvatarURL); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
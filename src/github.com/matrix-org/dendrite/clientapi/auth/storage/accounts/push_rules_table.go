@@ -0,0 +1,68 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+)
+
+const pushRulesSchema = `
+-- Stores the push rules of the users who changed them. Users without a row
+-- here use the server default rules.
+CREATE TABLE IF NOT EXISTS account_push_rules (
+    -- The Matrix user ID localpart of the user
+    localpart TEXT NOT NULL PRIMARY KEY,
+    -- The whole push ruleset of the user, as JSON
+    rules TEXT NOT NULL
+);
+`
+
+const upsertPushRulesSQL = "" +
+	"INSERT INTO account_push_rules(localpart, rules) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO UPDATE SET rules = $2"
+
+const selectPushRulesSQL = "" +
+	"SELECT rules FROM account_push_rules WHERE localpart = $1"
+
+type pushRulesStatements struct {
+	upsertPushRulesStmt *sql.Stmt
+	selectPushRulesStmt *sql.Stmt
+}
+
+func (s *pushRulesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushRulesSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPushRulesStmt, err = db.Prepare(upsertPushRulesSQL); err != nil {
+		return
+	}
+	if s.selectPushRulesStmt, err = db.Prepare(selectPushRulesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushRulesStatements) upsertPushRules(localpart string, rules []byte) (err error) {
+	_, err = s.upsertPushRulesStmt.Exec(localpart, string(rules))
+	return
+}
+
+// selectPushRules returns sql.ErrNoRows if the user never changed their rules.
+func (s *pushRulesStatements) selectPushRules(localpart string) (rules []byte, err error) {
+	var content string
+	err = s.selectPushRulesStmt.QueryRow(localpart).Scan(&content)
+	return []byte(content), err
+}
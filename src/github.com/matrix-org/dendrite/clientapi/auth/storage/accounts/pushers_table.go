@@ -0,0 +1,142 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pushersSchema = `
+-- Stores the pushers registered by users.
+CREATE TABLE IF NOT EXISTS account_pushers (
+    -- The Matrix user ID localpart of the user who registered the pusher
+    localpart TEXT NOT NULL,
+    -- The kind of pusher, e.g. "http"
+    kind TEXT NOT NULL,
+    -- The ID of the application the pusher sends notifications to
+    app_id TEXT NOT NULL,
+    -- The key identifying the device to the application
+    pushkey TEXT NOT NULL,
+    -- When the push key was last updated, as a millisecond posix timestamp
+    pushkey_ts BIGINT NOT NULL,
+    app_display_name TEXT NOT NULL,
+    device_display_name TEXT NOT NULL,
+    profile_tag TEXT NOT NULL DEFAULT '',
+    lang TEXT NOT NULL,
+    -- The pusher data, e.g. the URL of the push gateway, as JSON
+    data TEXT NOT NULL,
+
+    -- A user can only have one pusher per app and push key
+    PRIMARY KEY (app_id, pushkey, localpart)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_localpart ON account_pushers(localpart);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers(localpart, kind, app_id, pushkey, pushkey_ts," +
+	" app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (app_id, pushkey, localpart)" +
+	" DO UPDATE SET kind = $2, pushkey_ts = $5, app_display_name = $6," +
+	" device_display_name = $7, profile_tag = $8, lang = $9, data = $10"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
+
+const deleteOtherUsersPushersSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart != $3"
+
+type pushersStatements struct {
+	upsertPusherStmt              *sql.Stmt
+	selectPushersByLocalpartsStmt *sql.Stmt
+	deletePusherStmt              *sql.Stmt
+	deleteOtherUsersPushersStmt   *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersByLocalpartsStmt, err = db.Prepare(selectPushersByLocalpartsSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deleteOtherUsersPushersStmt, err = db.Prepare(deleteOtherUsersPushersSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(pusher authtypes.Pusher, txn *sql.Tx) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Stmt(s.upsertPusherStmt).Exec(
+		pusher.Localpart, pusher.Kind, pusher.AppID, pusher.PushKey, int64(pusher.PushKeyTS),
+		pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Lang,
+		string(data),
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushersByLocalparts(localparts []string) ([]authtypes.Pusher, error) {
+	rows, err := s.selectPushersByLocalpartsStmt.Query(common.StringArray(localparts))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pushers := []authtypes.Pusher{}
+	for rows.Next() {
+		var p authtypes.Pusher
+		var ts int64
+		var data string
+		if err = rows.Scan(
+			&p.Localpart, &p.Kind, &p.AppID, &p.PushKey, &ts, &p.AppDisplayName,
+			&p.DeviceDisplayName, &p.ProfileTag, &p.Lang, &data,
+		); err != nil {
+			return nil, err
+		}
+		p.PushKeyTS = gomatrixserverlib.Timestamp(ts)
+		if err = json.Unmarshal([]byte(data), &p.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(appID, pushKey, localpart string) (err error) {
+	_, err = s.deletePusherStmt.Exec(appID, pushKey, localpart)
+	return
+}
+
+func (s *pushersStatements) deleteOtherUsersPushers(appID, pushKey, localpart string, txn *sql.Tx) (err error) {
+	_, err = txn.Stmt(s.deleteOtherUsersPushersStmt).Exec(appID, pushKey, localpart)
+	return
+}
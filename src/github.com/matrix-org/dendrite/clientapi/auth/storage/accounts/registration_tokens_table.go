@@ -0,0 +1,99 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens users can register accounts with when registration
+-- requires a token.
+CREATE TABLE IF NOT EXISTS account_registration_tokens (
+    -- The token itself
+    token TEXT NOT NULL PRIMARY KEY,
+    -- How many accounts can be registered with this token. NULL means there's no limit.
+    uses_allowed BIGINT,
+    -- How many accounts were registered with this token
+    uses BIGINT NOT NULL DEFAULT 0
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO account_registration_tokens(token, uses_allowed) VALUES ($1, $2)"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT uses_allowed, uses FROM account_registration_tokens WHERE token = $1"
+
+const useRegistrationTokenSQL = "" +
+	"UPDATE account_registration_tokens SET uses = uses + 1" +
+	" WHERE token = $1 AND (uses_allowed IS NULL OR uses < uses_allowed)"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt *sql.Stmt
+	selectRegistrationTokenStmt *sql.Stmt
+	useRegistrationTokenStmt    *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *registrationTokensStatements) insertRegistrationToken(token string, usesAllowed *int64) error {
+	var allowed sql.NullInt64
+	if usesAllowed != nil {
+		allowed = sql.NullInt64{Int64: *usesAllowed, Valid: true}
+	}
+	_, err := s.insertRegistrationTokenStmt.Exec(token, allowed)
+	return err
+}
+
+// selectRegistrationToken returns whether the token can still be used.
+// Returns sql.ErrNoRows if the token doesn't exist.
+func (s *registrationTokensStatements) selectRegistrationToken(txn *sql.Tx, token string) (bool, error) {
+	var usesAllowed sql.NullInt64
+	var uses int64
+	err := common.TxStmt(txn, s.selectRegistrationTokenStmt).QueryRow(token).Scan(&usesAllowed, &uses)
+	if err != nil {
+		return false, err
+	}
+	return !usesAllowed.Valid || uses < usesAllowed.Int64, nil
+}
+
+// useRegistrationToken increments the use count of the token if it can still
+// be used. Returns whether the token was used.
+func (s *registrationTokensStatements) useRegistrationToken(txn *sql.Tx, token string) (bool, error) {
+	res, err := common.TxStmt(txn, s.useRegistrationTokenStmt).Exec(token)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const insertReportSQL = "" +
+	"INSERT INTO account_reports(user_id, room_id, event_id, score, reason, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectReportsSQL = "" +
+	"SELECT id, user_id, room_id, event_id, score, reason, received_ts FROM account_reports" +
+	" WHERE id > $1 ORDER BY id ASC LIMIT $2"
+
+const deleteReportSQL = "" +
+	"DELETE FROM account_reports WHERE id = $1"
+
+type reportsStatements struct {
+	insertReportStmt  *sql.Stmt
+	selectReportsStmt *sql.Stmt
+	deleteReportStmt  *sql.Stmt
+}
+
+func (s *reportsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(reportsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertReportStmt, err = db.Prepare(insertReportSQL); err != nil {
+		return
+	}
+	if s.selectReportsStmt, err = db.Prepare(selectReportsSQL); err != nil {
+		return
+	}
+	if s.deleteReportStmt, err = db.Prepare(deleteReportSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *reportsStatements) insertReport(report *authtypes.Report) error {
+	var score sql.NullInt64
+	if report.Score != nil {
+		score = sql.NullInt64{Int64: *report.Score, Valid: true}
+	}
+	_, err := s.insertReportStmt.Exec(
+		report.UserID, report.RoomID, report.EventID, score, report.Reason, int64(report.ReceivedTS),
+	)
+	return err
+}
+
+// selectReports returns at most limit reports with an ID higher than the
+// given one, from the oldest to the newest.
+func (s *reportsStatements) selectReports(afterID int64, limit int) ([]authtypes.Report, error) {
+	rows, err := s.selectReportsStmt.Query(afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reports []authtypes.Report
+	for rows.Next() {
+		var (
+			report     authtypes.Report
+			score      sql.NullInt64
+			receivedTS int64
+		)
+		if err = rows.Scan(
+			&report.ID, &report.UserID, &report.RoomID, &report.EventID,
+			&score, &report.Reason, &receivedTS,
+		); err != nil {
+			return nil, err
+		}
+		if score.Valid {
+			report.Score = &score.Int64
+		}
+		report.ReceivedTS = gomatrixserverlib.Timestamp(receivedTS)
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// deleteReport deletes the report with the given ID and returns whether it
+// existed.
+func (s *reportsStatements) deleteReport(id int64) (bool, error) {
+	res, err := s.deleteReportStmt.Exec(id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
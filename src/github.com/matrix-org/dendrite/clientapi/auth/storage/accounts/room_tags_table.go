@@ -0,0 +1,111 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+const roomTagsSchema = `
+-- Stores the tags local users gave to rooms.
+CREATE TABLE IF NOT EXISTS account_room_tags (
+    -- The Matrix user ID localpart of the user who tagged the room
+    localpart TEXT NOT NULL,
+    -- The ID of the tagged room
+    room_id TEXT NOT NULL,
+    -- The tag, e.g. m.favourite
+    tag TEXT NOT NULL,
+    -- The position of the room among the rooms with this tag, or NULL
+    tag_order DOUBLE PRECISION,
+    PRIMARY KEY (localpart, room_id, tag)
+);
+`
+
+const upsertRoomTagSQL = "" +
+	"INSERT INTO account_room_tags(localpart, room_id, tag, tag_order) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (localpart, room_id, tag) DO UPDATE SET tag_order = $4"
+
+const deleteRoomTagSQL = "" +
+	"DELETE FROM account_room_tags WHERE localpart = $1 AND room_id = $2 AND tag = $3"
+
+const selectRoomTagsSQL = "" +
+	"SELECT tag, tag_order FROM account_room_tags WHERE localpart = $1 AND room_id = $2"
+
+type roomTagsStatements struct {
+	upsertRoomTagStmt  *sql.Stmt
+	deleteRoomTagStmt  *sql.Stmt
+	selectRoomTagsStmt *sql.Stmt
+}
+
+func (s *roomTagsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(roomTagsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertRoomTagStmt, err = db.Prepare(upsertRoomTagSQL); err != nil {
+		return
+	}
+	if s.deleteRoomTagStmt, err = db.Prepare(deleteRoomTagSQL); err != nil {
+		return
+	}
+	if s.selectRoomTagsStmt, err = db.Prepare(selectRoomTagsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *roomTagsStatements) upsertRoomTag(
+	localpart, roomID, tag string, order *float64, txn *sql.Tx,
+) (err error) {
+	_, err = common.TxStmt(txn, s.upsertRoomTagStmt).Exec(localpart, roomID, tag, order)
+	return
+}
+
+func (s *roomTagsStatements) deleteRoomTag(
+	localpart, roomID, tag string, txn *sql.Tx,
+) (err error) {
+	_, err = common.TxStmt(txn, s.deleteRoomTagStmt).Exec(localpart, roomID, tag)
+	return
+}
+
+// selectRoomTags returns the tags the user gave to the room, mapped to their
+// info.
+func (s *roomTagsStatements) selectRoomTags(
+	localpart, roomID string, txn *sql.Tx,
+) (map[string]authtypes.TagInfo, error) {
+	rows, err := common.TxStmt(txn, s.selectRoomTagsStmt).Query(localpart, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]authtypes.TagInfo)
+	for rows.Next() {
+		var tag string
+		var order sql.NullFloat64
+		if err = rows.Scan(&tag, &order); err != nil {
+			return nil, err
+		}
+		var info authtypes.TagInfo
+		if order.Valid {
+			info.Order = &order.Float64
+		}
+		tags[tag] = info
+	}
+	return tags, rows.Err()
+}
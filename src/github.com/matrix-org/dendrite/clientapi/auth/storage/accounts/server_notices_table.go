@@ -0,0 +1,70 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+)
+
+const serverNoticesSchema = `
+-- Stores the rooms server notices are sent to local users in.
+CREATE TABLE IF NOT EXISTS account_server_notices_rooms (
+    -- The Matrix user ID localpart of the user the notices are sent to
+    localpart TEXT NOT NULL PRIMARY KEY,
+    -- The ID of the room the notices are sent in
+    room_id TEXT NOT NULL
+);
+`
+
+const insertServerNoticesRoomSQL = "" +
+	"INSERT INTO account_server_notices_rooms(localpart, room_id) VALUES ($1, $2)" +
+	" ON CONFLICT (localpart) DO UPDATE SET room_id = $2"
+
+const selectServerNoticesRoomSQL = "" +
+	"SELECT room_id FROM account_server_notices_rooms WHERE localpart = $1"
+
+type serverNoticesStatements struct {
+	insertServerNoticesRoomStmt *sql.Stmt
+	selectServerNoticesRoomStmt *sql.Stmt
+}
+
+func (s *serverNoticesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(serverNoticesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertServerNoticesRoomStmt, err = db.Prepare(insertServerNoticesRoomSQL); err != nil {
+		return
+	}
+	if s.selectServerNoticesRoomStmt, err = db.Prepare(selectServerNoticesRoomSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *serverNoticesStatements) insertServerNoticesRoom(localpart, roomID string) (err error) {
+	_, err = s.insertServerNoticesRoomStmt.Exec(localpart, roomID)
+	return
+}
+
+// selectServerNoticesRoom returns the ID of the server notices room of the
+// user, or an empty string if they don't have one.
+func (s *serverNoticesStatements) selectServerNoticesRoom(localpart string) (roomID string, err error) {
+	err = s.selectServerNoticesRoomStmt.QueryRow(localpart).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
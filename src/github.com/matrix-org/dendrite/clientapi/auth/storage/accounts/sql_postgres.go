@@ -0,0 +1,158 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !sqlite
+
+package accounts
+
+// The statements which differ between the postgres and SQLite databases.
+
+const filterSchema = `
+-- Stores the filters uploaded by users.
+CREATE TABLE IF NOT EXISTS account_filter (
+    -- The opaque ID of the filter, unique across all users
+    id BIGSERIAL PRIMARY KEY,
+    -- The Matrix user ID localpart of the user who uploaded the filter
+    localpart TEXT NOT NULL,
+    -- The filter itself, as canonical JSON
+    filter TEXT NOT NULL
+);
+
+-- Filters used to be indexed along with their content, which postgres can't
+-- index once it is larger than a few kilobytes. Looking up a filter by its
+-- content only needs to go through the filters of the user.
+DROP INDEX IF EXISTS account_filter_localpart;
+CREATE INDEX IF NOT EXISTS account_filter_localpart_idx ON account_filter(localpart);
+`
+
+const presenceSchema = `
+-- The stream of presence updates. The ID of a presence changes every time it is updated.
+CREATE SEQUENCE IF NOT EXISTS account_presence_id_seq;
+
+-- Stores the latest presence of local users, and of remote users sharing a room with them.
+CREATE TABLE IF NOT EXISTS account_presence (
+    -- The position of the latest update to this presence in the presence stream
+    id BIGINT NOT NULL DEFAULT nextval('account_presence_id_seq'),
+    -- The Matrix user ID of the user
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The presence of the user, i.e. online, unavailable or offline
+    presence TEXT NOT NULL,
+    -- The status message set by the user, if any
+    status_msg TEXT NOT NULL DEFAULT '',
+    -- When the user was last active, as a millisecond posix timestamp
+    last_active_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_presence_id_idx ON account_presence(id);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO account_presence(user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET presence = $2, status_msg = $3, last_active_ts = $4, id = nextval('account_presence_id_seq')"
+
+const selectPresencesForUsersSQL = "" +
+	"SELECT id, user_id, presence, status_msg, last_active_ts FROM account_presence" +
+	" WHERE user_id = ANY($1) AND id > $2"
+
+const deleteMembershipsByEventIDsSQL = "" +
+	"DELETE FROM account_memberships WHERE event_id = ANY($1)"
+
+const selectPushersByLocalpartsSQL = "" +
+	"SELECT localpart, kind, app_id, pushkey, pushkey_ts, app_display_name," +
+	" device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = ANY($1)"
+
+const toDeviceSchema = `
+-- The stream of to-device messages.
+CREATE SEQUENCE IF NOT EXISTS account_to_device_id_seq;
+
+-- Stores the to-device messages sent to the devices of local users until the
+-- devices acknowledge them.
+CREATE TABLE IF NOT EXISTS account_to_device_messages (
+    -- The position of the message in the to-device stream
+    id BIGINT PRIMARY KEY DEFAULT nextval('account_to_device_id_seq'),
+    -- The Matrix user ID of the user who sent the message
+    sender_user_id TEXT NOT NULL,
+    -- The Matrix user ID of the user the message is for
+    target_user_id TEXT NOT NULL,
+    -- The ID of the device the message is for
+    target_device_id TEXT NOT NULL,
+    -- The type of the message, e.g. m.room_key_request
+    event_type TEXT NOT NULL,
+    -- The content of the message, as JSON
+    content TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_to_device_messages_target_idx
+    ON account_to_device_messages(target_user_id, target_device_id, id);
+`
+
+const selectMaxToDeviceIDSQL = "" +
+	"SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM account_to_device_id_seq"
+
+const notificationsSchema = `
+-- Stores the notification history of local users, i.e. the events which
+-- matched one of their push rules telling to notify them, until they read
+-- them.
+CREATE TABLE IF NOT EXISTS account_notifications (
+    -- The position of the notification in the notification history
+    id BIGSERIAL PRIMARY KEY,
+    -- The Matrix user ID localpart of the user who was notified
+    localpart TEXT NOT NULL,
+    -- The ID of the room of the event
+    room_id TEXT NOT NULL,
+    -- The ID of the event
+    event_id TEXT NOT NULL,
+    -- The event in the client format, as JSON
+    event_json TEXT NOT NULL,
+    -- The actions of the push rule the event matched, as JSON
+    actions TEXT NOT NULL,
+    -- Whether the push rule highlights the event
+    highlight BOOLEAN NOT NULL,
+    -- The time the event was sent, in milliseconds since the epoch
+    ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_notifications_localpart_idx
+    ON account_notifications(localpart, id);
+CREATE INDEX IF NOT EXISTS account_notifications_room_idx
+    ON account_notifications(localpart, room_id, ts);
+`
+
+const reportsSchema = `
+-- Stores the reports of events made by users.
+CREATE TABLE IF NOT EXISTS account_reports (
+    -- The ID of the report
+    id BIGSERIAL PRIMARY KEY,
+    -- The Matrix user ID of the user who made the report
+    user_id TEXT NOT NULL,
+    -- The ID of the room the reported event is in
+    room_id TEXT NOT NULL,
+    -- The ID of the reported event
+    event_id TEXT NOT NULL,
+    -- The score given by the user, from -100 for the most offensive to 0
+    score BIGINT,
+    -- The reason given by the user
+    reason TEXT NOT NULL,
+    -- When the report was received, as a millisecond posix timestamp
+    received_ts BIGINT NOT NULL
+);
+`
+
+// Columns added to tables after they were first created, which the CREATE
+// TABLE statements don't add to the tables of existing databases.
+const accountsMigrations = `
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_deactivated BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_guest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE account_accounts ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+`
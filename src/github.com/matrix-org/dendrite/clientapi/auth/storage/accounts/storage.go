@@ -16,15 +16,24 @@ package accounts
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/gomatrixserverlib"
 	"golang.org/x/crypto/bcrypt"
-	// Import the postgres database driver.
-	_ "github.com/lib/pq"
 )
 
+// errPasswordlessAccount is returned when trying to log into an account which
+// doesn't have a password, e.g. guest accounts.
+var errPasswordlessAccount = errors.New("account has no password")
+
+// ErrRegistrationTokenExhausted is returned when trying to use a registration
+// token which was already used as many times as it allows.
+var ErrRegistrationTokenExhausted = errors.New("registration token was used too many times")
+
 // Database represents an account database
 type Database struct {
 	db           *sql.DB
@@ -33,6 +42,20 @@ type Database struct {
 	profiles     profilesStatements
 	memberships  membershipStatements
 	accountDatas accountDataStatements
+	threepids    threepidInvitesStatements
+	idServerKeys idServerKeysStatements
+	filters      filterStatements
+	regTokens    registrationTokensStatements
+	presence     presenceStatements
+	pushers      pushersStatements
+	pushRules    pushRulesStatements
+	toDevice     toDeviceStatements
+	crossSigning crossSigningKeysStatements
+	txns         transactionsStatements
+	roomTags     roomTagsStatements
+	notifs       notificationsStatements
+	notices      serverNoticesStatements
+	reports      reportsStatements
 	serverName   gomatrixserverlib.ServerName
 }
 
@@ -40,7 +63,7 @@ type Database struct {
 func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName) (*Database, error) {
 	var db *sql.DB
 	var err error
-	if db, err = sql.Open("postgres", dataSourceName); err != nil {
+	if db, err = common.OpenDatabase(dataSourceName); err != nil {
 		return nil, err
 	}
 	partitions := common.PartitionOffsetStatements{}
@@ -63,7 +86,63 @@ func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName)
 	if err = ac.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, m, ac, serverName}, nil
+	t := threepidInvitesStatements{}
+	if err = t.prepare(db); err != nil {
+		return nil, err
+	}
+	k := idServerKeysStatements{}
+	if err = k.prepare(db); err != nil {
+		return nil, err
+	}
+	f := filterStatements{}
+	if err = f.prepare(db); err != nil {
+		return nil, err
+	}
+	rt := registrationTokensStatements{}
+	if err = rt.prepare(db); err != nil {
+		return nil, err
+	}
+	pr := presenceStatements{}
+	if err = pr.prepare(db); err != nil {
+		return nil, err
+	}
+	pu := pushersStatements{}
+	if err = pu.prepare(db); err != nil {
+		return nil, err
+	}
+	ru := pushRulesStatements{}
+	if err = ru.prepare(db); err != nil {
+		return nil, err
+	}
+	td := toDeviceStatements{}
+	if err = td.prepare(db); err != nil {
+		return nil, err
+	}
+	cs := crossSigningKeysStatements{}
+	if err = cs.prepare(db); err != nil {
+		return nil, err
+	}
+	tx := transactionsStatements{}
+	if err = tx.prepare(db); err != nil {
+		return nil, err
+	}
+	rta := roomTagsStatements{}
+	if err = rta.prepare(db); err != nil {
+		return nil, err
+	}
+	n := notificationsStatements{}
+	if err = n.prepare(db); err != nil {
+		return nil, err
+	}
+	sn := serverNoticesStatements{}
+	if err = sn.prepare(db); err != nil {
+		return nil, err
+	}
+	rp := reportsStatements{}
+	if err = rp.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, a, p, m, ac, t, k, f, rt, pr, pu, ru, td, cs, tx, rta, n, sn, rp, serverName}, nil
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -73,6 +152,9 @@ func (d *Database) GetAccountByPassword(localpart, plaintextPassword string) (*a
 	if err != nil {
 		return nil, err
 	}
+	if hash == "" {
+		return nil, errPasswordlessAccount
+	}
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintextPassword)); err != nil {
 		return nil, err
 	}
@@ -97,17 +179,121 @@ func (d *Database) SetDisplayName(localpart string, displayName string) error {
 	return d.profiles.setDisplayName(localpart, displayName)
 }
 
+// SearchProfiles returns at most limit profiles of the accounts which aren't
+// deactivated and whose localpart or display name contain the search term,
+// case insensitively.
+func (d *Database) SearchProfiles(searchTerm string, limit int) ([]authtypes.Profile, error) {
+	return d.profiles.selectProfilesBySearch(searchTerm, limit)
+}
+
 // CreateAccount makes a new account with the given login name and password, and creates an empty profile
 // for this account. If no password is supplied, the account will be a passwordless account.
 func (d *Database) CreateAccount(localpart, plaintextPassword string) (*authtypes.Account, error) {
+	return d.CreateAccountWithRegistrationToken(localpart, plaintextPassword, "", false)
+}
+
+// CreateAccountWithRegistrationToken makes a new account like CreateAccount,
+// using the given registration token in the same transaction so the token is
+// only used up if the account is created. No token is used if it is empty.
+// If adminIfFirst is true, the account is made a server admin if it is the
+// first account with a password on the server.
+// Returns the same errors as CheckRegistrationToken if the token can't be used.
+func (d *Database) CreateAccountWithRegistrationToken(
+	localpart, plaintextPassword, token string, adminIfFirst bool,
+) (acc *authtypes.Account, err error) {
 	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return nil, err
 	}
-	if err := d.profiles.insertProfile(localpart); err != nil {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if token != "" {
+			if err = d.useRegistrationToken(txn, token); err != nil {
+				return err
+			}
+		}
+		acc, err = d.createAccount(txn, localpart, hash, false, adminIfFirst)
+		return err
+	})
+	return
+}
+
+// CreateGuestAccount makes a new passwordless guest account with the given
+// login name, and creates an empty profile for this account.
+func (d *Database) CreateGuestAccount(localpart string) (acc *authtypes.Account, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(txn, localpart, "", true, false)
+		return err
+	})
+	return
+}
+
+// CreatePasswordlessAccount makes a new account without a password with the
+// given login name, and creates an empty profile for this account. It can only
+// be used through access tokens created for it, e.g. by application services.
+func (d *Database) CreatePasswordlessAccount(localpart string) (acc *authtypes.Account, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		acc, err = d.createAccount(txn, localpart, "", false, false)
+		return err
+	})
+	return
+}
+
+// createAccount creates an account with the given password hash, which is
+// empty for passwordless accounts, along with its empty profile. If
+// adminIfFirst is true, the account is a server admin if no other account
+// with a password exists, which is checked in the same transaction so that
+// only the first account registered is.
+func (d *Database) createAccount(
+	txn *sql.Tx, localpart, hash string, isGuest, adminIfFirst bool,
+) (*authtypes.Account, error) {
+	isAdmin := false
+	if adminIfFirst {
+		exists, err := d.accounts.selectUserAccountExists(txn)
+		if err != nil {
+			return nil, err
+		}
+		isAdmin = !exists
+	}
+	if err := d.profiles.insertProfile(txn, localpart); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(localpart, hash)
+	return d.accounts.insertAccount(txn, localpart, hash, isGuest, isAdmin)
+}
+
+// GetAccountByLocalpart returns the account associated with the given localpart.
+// Returns sql.ErrNoRows if no account exists which matches the given localpart.
+func (d *Database) GetAccountByLocalpart(localpart string) (*authtypes.Account, error) {
+	return d.accounts.selectAccountByLocalpart(localpart)
+}
+
+// SetPassword replaces the password of the account with the given localpart.
+// Returns an error if something went wrong with the SQL query or the hashing
+func (d *Database) SetPassword(localpart, plaintextPassword string) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return d.accounts.updatePasswordHash(localpart, hash)
+}
+
+// DeactivateAccount marks the account with the given localpart as deactivated.
+// Returns an error if something went wrong with the SQL query
+func (d *Database) DeactivateAccount(localpart string) error {
+	return d.accounts.deactivateAccount(localpart)
+}
+
+// SetAdmin sets whether the account with the given localpart belongs to a
+// server admin.
+// Returns an error if something went wrong with the SQL query
+func (d *Database) SetAdmin(localpart string, isAdmin bool) error {
+	return d.accounts.updateIsAdmin(localpart, isAdmin)
+}
+
+// GetAccounts returns at most limit accounts, ordered by localpart, whose
+// localparts come after the given one. All accounts are returned from the
+// first one if the localpart is empty.
+func (d *Database) GetAccounts(afterLocalpart string, limit int) ([]authtypes.Account, error) {
+	return d.accounts.selectAccounts(afterLocalpart, limit)
 }
 
 // PartitionOffsets implements common.PartitionStorer
@@ -207,7 +393,7 @@ func (d *Database) newMembership(ev gomatrixserverlib.Event, txn *sql.Tx) error
 // update the corresponding row with the new content
 // Returns a SQL error if there was an issue with the insertion/update
 func (d *Database) SaveAccountData(localpart string, roomID string, dataType string, content string) error {
-	return d.accountDatas.insertAccountData(localpart, roomID, dataType, content)
+	return d.accountDatas.insertAccountData(localpart, roomID, dataType, content, nil)
 }
 
 // GetAccountData returns account data related to a given localpart
@@ -229,7 +415,443 @@ func (d *Database) GetAccountDataByType(localpart string, roomID string, dataTyp
 	return d.accountDatas.selectAccountDataByType(localpart, roomID, dataType)
 }
 
+// SaveThreePIDInvite stores a pending invite sent to a third-party identifier
+// which isn't associated with a Matrix user ID yet.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) SaveThreePIDInvite(invite *authtypes.ThreePIDInvite) error {
+	return d.threepids.insertThreePIDInvite(invite)
+}
+
+// GetThreePIDInvitesByAddress returns the pending invites sent to a given
+// third-party identifier.
+// If no invite could be found, returns an empty array
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetThreePIDInvitesByAddress(medium string, address string) ([]authtypes.ThreePIDInvite, error) {
+	return d.threepids.selectThreePIDInvitesByAddress(medium, address)
+}
+
+// GetIDServerPublicKey returns the public key with the given ID that was
+// previously fetched from the given identity server.
+// Returns nil if no such key has been stored
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetIDServerPublicKey(idServer string, keyID string) ([]byte, error) {
+	return d.idServerKeys.selectIDServerKey(idServer, keyID)
+}
+
+// SaveIDServerPublicKey stores a public key fetched from an identity server,
+// along with the time it was fetched at as a timestamp in milliseconds.
+// If a key with the same ID was already stored for this identity server,
+// it is replaced
+// Returns a SQL error if there was an issue with the insertion/update
+func (d *Database) SaveIDServerPublicKey(idServer string, keyID string, publicKey []byte, fetchedAt int64) error {
+	return d.idServerKeys.insertIDServerKey(idServer, keyID, publicKey, fetchedAt)
+}
+
+// RemoveIDServerPublicKey removes a stored identity server public key, e.g.
+// because the identity server revoked it.
+// Returns a SQL error if there was an issue with the deletion
+func (d *Database) RemoveIDServerPublicKey(idServer string, keyID string) error {
+	return d.idServerKeys.deleteIDServerKey(idServer, keyID)
+}
+
+// PutFilter stores a filter uploaded by the user with the given localpart and
+// returns the opaque ID the client should use to refer to it. If the user
+// already uploaded an identical filter, the ID of the existing one is returned.
+// Returns a SQL error if there was an issue with the insertion, or an error
+// if the filter isn't valid JSON
+func (d *Database) PutFilter(localpart string, filter *authtypes.Filter) (string, error) {
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	if filterJSON, err = gomatrixserverlib.CanonicalJSON(filterJSON); err != nil {
+		return "", err
+	}
+	id, err := d.filters.selectFilterIDByContent(localpart, filterJSON)
+	if err == sql.ErrNoRows {
+		id, err = d.filters.insertFilter(localpart, filterJSON)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// GetFilter returns the filter with the given ID uploaded by the user with the
+// given localpart.
+// Returns sql.ErrNoRows if no such filter exists, including when the ID isn't
+// one we could have issued
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetFilter(localpart string, filterID string) (*authtypes.Filter, error) {
+	id, err := strconv.ParseInt(filterID, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	filterJSON, err := d.filters.selectFilter(localpart, id)
+	if err != nil {
+		return nil, err
+	}
+	var filter authtypes.Filter
+	if err = json.Unmarshal(filterJSON, &filter); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
+
 func hashPassword(plaintext string) (hash string, err error) {
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
 	return string(hashBytes), err
 }
+
+// SetPresence stores the presence of a local user, replacing the previous one.
+// Returns the position of the update in the presence stream.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) SetPresence(presence authtypes.Presence) (int64, error) {
+	return d.presence.upsertPresence(presence)
+}
+
+// GetPresence returns the presence of a local user.
+// Returns sql.ErrNoRows if the user never set their presence.
+func (d *Database) GetPresence(userID string) (*authtypes.Presence, error) {
+	return d.presence.selectPresence(userID)
+}
+
+// GetPresencesForUsers returns the presence of the given users which were
+// updated after the given position in the presence stream, along with the
+// position of the latest one of them. If there are none, the given position
+// is returned.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetPresencesForUsers(
+	userIDs []string, afterPos int64,
+) ([]authtypes.Presence, int64, error) {
+	return d.presence.selectPresencesForUsers(userIDs, afterPos)
+}
+
+// SetLastActive records when a user was last active without changing their
+// presence, so the other users don't need to be told about it.
+func (d *Database) SetLastActive(userID string, ts gomatrixserverlib.Timestamp) error {
+	return d.presence.updateLastActive(userID, ts)
+}
+
+// GetIdlePresences returns the presence of the local users who aren't offline
+// and haven't been active since the given time. The presence of remote users
+// is kept up to date by their servers.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetIdlePresences(before gomatrixserverlib.Timestamp) ([]authtypes.Presence, error) {
+	presences, err := d.presence.selectIdlePresences(before)
+	if err != nil {
+		return nil, err
+	}
+	var local []authtypes.Presence
+	for _, p := range presences {
+		if _, domain, err := gomatrixserverlib.SplitID('@', p.UserID); err == nil && domain == d.serverName {
+			local = append(local, p)
+		}
+	}
+	return local, nil
+}
+
+// GetLatestPresencePosition returns the position of the latest update in the
+// presence stream, or 0 if there was none.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetLatestPresencePosition() (int64, error) {
+	return d.presence.selectMaxPresenceID()
+}
+
+// StoreToDeviceMessages stores to-device messages for devices of local users
+// until the devices acknowledge them. Returns a position in the to-device
+// stream which is at or after the positions of all of the messages.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) StoreToDeviceMessages(messages []authtypes.ToDeviceMessage) (pos int64, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for _, message := range messages {
+			if err := d.toDevice.insertToDeviceMessage(message, txn); err != nil {
+				return err
+			}
+		}
+		pos, err = d.toDevice.selectMaxToDeviceID(txn)
+		return err
+	})
+	return
+}
+
+// GetToDeviceMessages returns at most limit of the messages sent to the device
+// after the given position in the to-device stream, oldest first, along with
+// the position of the last one of them. If there are none, the given position
+// is returned.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetToDeviceMessages(
+	userID, deviceID string, afterPos int64, limit int,
+) ([]authtypes.ToDeviceMessage, int64, error) {
+	return d.toDevice.selectToDeviceMessages(userID, deviceID, afterPos, limit)
+}
+
+// DeleteToDeviceMessages deletes the messages sent to the device up to and
+// including the given position in the to-device stream, once the device has
+// acknowledged them.
+// Returns a SQL error if there was an issue with the deletion
+func (d *Database) DeleteToDeviceMessages(userID, deviceID string, upToPos int64) error {
+	return d.toDevice.deleteToDeviceMessages(userID, deviceID, upToPos)
+}
+
+// GetLatestToDevicePosition returns the position of the latest message in the
+// to-device stream, or 0 if there was none.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetLatestToDevicePosition() (int64, error) {
+	return d.toDevice.selectMaxToDeviceID(nil)
+}
+
+// StoreCrossSigningKeys stores the given cross-signing keys of a local user,
+// mapped by key type, replacing the previous keys of the same types.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) StoreCrossSigningKeys(localpart string, keys map[string][]byte) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for keyType, keyJSON := range keys {
+			if err := d.crossSigning.upsertCrossSigningKey(localpart, keyType, keyJSON, txn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetCrossSigningKeys returns the cross-signing keys of a local user, mapped
+// by key type.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetCrossSigningKeys(localpart string) (map[string][]byte, error) {
+	return d.crossSigning.selectCrossSigningKeys(localpart)
+}
+
+// ReserveTransaction reserves the transaction ID of a request sent by a device
+// to the given path, so that retries of the request aren't processed while it
+// is being processed. Returns false if the device already sent a request with
+// this transaction ID to this path.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) ReserveTransaction(userID, deviceID, path, txnID string) (bool, error) {
+	return d.txns.insertTransaction(userID, deviceID, path, txnID)
+}
+
+// StoreTransactionResponse stores the body of the response to a request sent
+// by a device with a transaction ID it reserved.
+// Returns a SQL error if there was an issue with the update
+func (d *Database) StoreTransactionResponse(userID, deviceID, path, txnID string, responseJSON []byte) error {
+	return d.txns.updateTransactionResponse(userID, deviceID, path, txnID, responseJSON)
+}
+
+// CancelTransaction removes the reservation of a transaction ID whose request
+// failed, so that the request can be retried. Does nothing once the response
+// to the request is stored.
+// Returns a SQL error if there was an issue with the deletion
+func (d *Database) CancelTransaction(userID, deviceID, path, txnID string) error {
+	return d.txns.deletePendingTransaction(userID, deviceID, path, txnID)
+}
+
+// GetTransactionResponse returns the body of the response to the request sent
+// by a device with the given transaction ID to the given path, or nil if the
+// device didn't send a request with this transaction ID or the request is
+// still being processed.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetTransactionResponse(userID, deviceID, path, txnID string) ([]byte, error) {
+	responseJSON, err := d.txns.selectTransaction(userID, deviceID, path, txnID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil || !responseJSON.Valid {
+		return nil, err
+	}
+	return []byte(responseJSON.String), nil
+}
+
+// SaveRoomTag tags the room for a local user, with the given order or none if
+// nil, replacing the previous order of the tag if the room already had it.
+// The m.tag account data of the room is updated to match.
+// Returns a SQL error if there was an issue with the update
+func (d *Database) SaveRoomTag(localpart, roomID, tag string, order *float64) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.roomTags.upsertRoomTag(localpart, roomID, tag, order, txn); err != nil {
+			return err
+		}
+		return d.updateRoomTagsAccountData(localpart, roomID, txn)
+	})
+}
+
+// RemoveRoomTag removes a tag a local user gave to a room, if any.
+// The m.tag account data of the room is updated to match.
+// Returns a SQL error if there was an issue with the update
+func (d *Database) RemoveRoomTag(localpart, roomID, tag string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.roomTags.deleteRoomTag(localpart, roomID, tag, txn); err != nil {
+			return err
+		}
+		return d.updateRoomTagsAccountData(localpart, roomID, txn)
+	})
+}
+
+// GetRoomTags returns the tags a local user gave to a room.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetRoomTags(localpart, roomID string) (authtypes.RoomTags, error) {
+	tags, err := d.roomTags.selectRoomTags(localpart, roomID, nil)
+	return authtypes.RoomTags{Tags: tags}, err
+}
+
+// updateRoomTagsAccountData sets the m.tag account data of the room to the
+// tags the user gave it, so that they are sent to clients with the rest of the
+// account data.
+func (d *Database) updateRoomTagsAccountData(localpart, roomID string, txn *sql.Tx) error {
+	tags, err := d.roomTags.selectRoomTags(localpart, roomID, txn)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(authtypes.RoomTags{Tags: tags})
+	if err != nil {
+		return err
+	}
+	return d.accountDatas.insertAccountData(localpart, roomID, "m.tag", string(content), txn)
+}
+
+// AddNotification adds a notification to the notification history of a local
+// user.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) AddNotification(notification authtypes.Notification) error {
+	return d.notifs.insertNotification(notification, nil)
+}
+
+// GetNotifications returns at most limit notifications from the notification
+// history of a local user, newest first, starting before the notification with
+// the given ID or from the latest one if it is 0. If onlyHighlight is true, only
+// the notifications of highlighted events are returned.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetNotifications(
+	localpart string, beforeID int64, limit int, onlyHighlight bool,
+) ([]authtypes.Notification, error) {
+	return d.notifs.selectNotifications(localpart, beforeID, limit, onlyHighlight)
+}
+
+// ClearNotifications removes the notifications of a local user for the events
+// of a room sent up to the given time, once the user read them.
+// Returns a SQL error if there was an issue with the deletion
+func (d *Database) ClearNotifications(localpart, roomID string, upTo gomatrixserverlib.Timestamp) error {
+	return d.notifs.deleteNotificationsUpTo(localpart, roomID, upTo)
+}
+
+// GetLocalpartsInRoom returns the localparts of the local users who are joined
+// to the given room.
+// If there was an issue during the retrieval, returns the SQL error
+func (d *Database) GetLocalpartsInRoom(roomID string) ([]string, error) {
+	return d.memberships.selectLocalpartsByRoomID(roomID)
+}
+
+// SetPusher stores a pusher, replacing the pusher of the same user with the
+// same app ID and push key if there is one. If removeOthers is true, the
+// pushers of other users with the same app ID and push key are removed.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) SetPusher(pusher authtypes.Pusher, removeOthers bool) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if removeOthers {
+			if err := d.pushers.deleteOtherUsersPushers(
+				pusher.AppID, pusher.PushKey, pusher.Localpart, txn,
+			); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(pusher, txn)
+	})
+}
+
+// RemovePusher removes the pusher of a user with the given app ID and push key.
+// Returns a SQL error if there was an issue with the deletion
+func (d *Database) RemovePusher(appID, pushKey, localpart string) error {
+	return d.pushers.deletePusher(appID, pushKey, localpart)
+}
+
+// GetPushersByLocalparts returns the pushers of the users with the given
+// localparts.
+// Returns a SQL error if there was an issue with the retrieval
+func (d *Database) GetPushersByLocalparts(localparts []string) ([]authtypes.Pusher, error) {
+	return d.pushers.selectPushersByLocalparts(localparts)
+}
+
+// SavePushRules stores the whole push ruleset of a user, as JSON.
+// Returns a SQL error if there was an issue with the insertion
+func (d *Database) SavePushRules(localpart string, rules []byte) error {
+	return d.pushRules.upsertPushRules(localpart, rules)
+}
+
+// GetPushRules returns the push ruleset of a user, as JSON.
+// Returns sql.ErrNoRows if the user never changed their push rules.
+func (d *Database) GetPushRules(localpart string) ([]byte, error) {
+	return d.pushRules.selectPushRules(localpart)
+}
+
+// CreateRegistrationToken adds a token users can register accounts with. If
+// usesAllowed is nil the token can be used any number of times.
+func (d *Database) CreateRegistrationToken(token string, usesAllowed *int64) error {
+	return d.regTokens.insertRegistrationToken(token, usesAllowed)
+}
+
+// CheckRegistrationToken checks that the given registration token exists and
+// can still be used, without using it.
+// Returns sql.ErrNoRows if the token doesn't exist, and
+// ErrRegistrationTokenExhausted if it can't be used anymore.
+func (d *Database) CheckRegistrationToken(token string) error {
+	return d.checkRegistrationToken(nil, token)
+}
+
+func (d *Database) checkRegistrationToken(txn *sql.Tx, token string) error {
+	ok, err := d.regTokens.selectRegistrationToken(txn, token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrRegistrationTokenExhausted
+	}
+	return nil
+}
+
+// useRegistrationToken records that an account was registered with the given
+// token. Returns the same errors as CheckRegistrationToken.
+func (d *Database) useRegistrationToken(txn *sql.Tx, token string) error {
+	used, err := d.regTokens.useRegistrationToken(txn, token)
+	if err != nil {
+		return err
+	}
+	if !used {
+		// Find out whether the token doesn't exist or is exhausted.
+		return d.checkRegistrationToken(txn, token)
+	}
+	return nil
+}
+
+// SaveServerNoticesRoom records the room server notices are sent to the user
+// with the given localpart in.
+func (d *Database) SaveServerNoticesRoom(localpart, roomID string) error {
+	return d.notices.insertServerNoticesRoom(localpart, roomID)
+}
+
+// GetServerNoticesRoom returns the ID of the room server notices are sent to
+// the user with the given localpart in, or an empty string if there isn't one.
+func (d *Database) GetServerNoticesRoom(localpart string) (string, error) {
+	return d.notices.selectServerNoticesRoom(localpart)
+}
+
+// SaveReport stores a report of an event made by a user. The ID of the report
+// is ignored.
+func (d *Database) SaveReport(report *authtypes.Report) error {
+	return d.reports.insertReport(report)
+}
+
+// GetReports returns at most limit reports with an ID higher than the given
+// one, from the oldest to the newest.
+func (d *Database) GetReports(afterID int64, limit int) ([]authtypes.Report, error) {
+	return d.reports.selectReports(afterID, limit)
+}
+
+// DeleteReport deletes the report with the given ID. Returns sql.ErrNoRows if
+// there is no such report.
+func (d *Database) DeleteReport(id int64) error {
+	deleted, err := d.reports.deleteReport(id)
+	if err == nil && !deleted {
+		err = sql.ErrNoRows
+	}
+	return err
+}
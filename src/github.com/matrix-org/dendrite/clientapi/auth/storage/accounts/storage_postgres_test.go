@@ -0,0 +1,75 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !sqlite
+
+package accounts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// testDatabaseEnv names the environment variable holding the data source name
+// of a postgres database to run the tests against, e.g.
+// "dbname=accounts_test sslmode=disable". The tests are skipped if it isn't
+// set.
+const testDatabaseEnv = "ACCOUNTS_TEST_DATABASE"
+
+// newTestDatabase opens the account database named by testDatabaseEnv.
+func newTestDatabase(t *testing.T) *Database {
+	dataSourceName := os.Getenv(testDatabaseEnv)
+	if dataSourceName == "" {
+		t.Skipf("%s isn't set", testDatabaseEnv)
+	}
+	db, err := NewDatabase(dataSourceName, "localhost")
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	return db
+}
+
+func TestPostgresLargeFilter(t *testing.T) {
+	db := newTestDatabase(t)
+
+	// Postgres can't index values larger than a third of a page, i.e. about
+	// 2.7kB once compressed, so the filter is made of random event types that
+	// don't compress.
+	filter := &authtypes.Filter{}
+	for i := 0; i < 100; i++ {
+		eventType := make([]byte, 32)
+		if _, err := rand.Read(eventType); err != nil {
+			t.Fatal(err)
+		}
+		filter.Room.Timeline.Types = append(filter.Room.Timeline.Types, "org.example."+hex.EncodeToString(eventType))
+	}
+	id, err := db.PutFilter("alice", filter)
+	if err != nil {
+		t.Fatalf("PutFilter: %v", err)
+	}
+	if sameID, err := db.PutFilter("alice", filter); err != nil || sameID != id {
+		t.Errorf("PutFilter: got (%q, %v) for an identical filter, want (%q, nil)", sameID, err, id)
+	}
+	got, err := db.GetFilter("alice", id)
+	if err != nil {
+		t.Fatalf("GetFilter: %v", err)
+	}
+	if len(got.Room.Timeline.Types) != len(filter.Room.Timeline.Types) {
+		t.Errorf("GetFilter: got %d event types, want %d", len(got.Room.Timeline.Types), len(filter.Room.Timeline.Types))
+	}
+}
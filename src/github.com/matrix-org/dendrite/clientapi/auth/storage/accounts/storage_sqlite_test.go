@@ -0,0 +1,292 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package accounts
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// newTestDatabase opens an account database in a new SQLite file. The returned
+// function removes the file.
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("file:"+filepath.Join(dir, "account.db"), "localhost")
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	return db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func TestSQLiteAccounts(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	if _, err := db.CreateAccount("alice", "password"); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+	if _, err := db.CreateAccount("alice", "password"); err == nil {
+		t.Fatalf("CreateAccount: expected an error creating the same account twice")
+	}
+	acc, err := db.GetAccountByPassword("alice", "password")
+	if err != nil {
+		t.Fatalf("GetAccountByPassword: %v", err)
+	}
+	if acc.UserID != "@alice:localhost" {
+		t.Errorf("GetAccountByPassword: got user ID %q, want @alice:localhost", acc.UserID)
+	}
+	if _, err = db.GetAccountByPassword("alice", "wrong"); err == nil {
+		t.Errorf("GetAccountByPassword: expected an error for the wrong password")
+	}
+
+	if err = db.SetDisplayName("alice", "Alice"); err != nil {
+		t.Fatalf("SetDisplayName: %v", err)
+	}
+	profile, err := db.GetProfileByLocalpart("alice")
+	if err != nil {
+		t.Fatalf("GetProfileByLocalpart: %v", err)
+	}
+	if profile.DisplayName != "Alice" {
+		t.Errorf("GetProfileByLocalpart: got display name %q, want Alice", profile.DisplayName)
+	}
+}
+
+func TestSQLiteFirstAccountIsAdmin(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	// Guests and passwordless accounts don't stop the first user with a
+	// password from being an admin.
+	if _, err := db.CreateGuestAccount("guest"); err != nil {
+		t.Fatalf("CreateGuestAccount: %v", err)
+	}
+	if _, err := db.CreatePasswordlessAccount("ircbot"); err != nil {
+		t.Fatalf("CreatePasswordlessAccount: %v", err)
+	}
+	for _, tt := range []struct {
+		localpart    string
+		adminIfFirst bool
+		wantAdmin    bool
+	}{
+		{"alice", true, true},
+		{"bob", true, false},
+	} {
+		acc, err := db.CreateAccountWithRegistrationToken(tt.localpart, "password", "", tt.adminIfFirst)
+		if err != nil {
+			t.Fatalf("CreateAccountWithRegistrationToken: %v", err)
+		}
+		if acc.IsAdmin != tt.wantAdmin {
+			t.Errorf("CreateAccountWithRegistrationToken(%s): got IsAdmin %t, want %t", tt.localpart, acc.IsAdmin, tt.wantAdmin)
+		}
+		stored, err := db.GetAccountByLocalpart(tt.localpart)
+		if err != nil {
+			t.Fatalf("GetAccountByLocalpart: %v", err)
+		}
+		if stored.IsAdmin != tt.wantAdmin {
+			t.Errorf("GetAccountByLocalpart(%s): got IsAdmin %t, want %t", tt.localpart, stored.IsAdmin, tt.wantAdmin)
+		}
+	}
+
+	// The first account isn't an admin unless asked for.
+	other, removeOther := newTestDatabase(t)
+	defer removeOther()
+	acc, err := other.CreateAccountWithRegistrationToken("alice", "password", "", false)
+	if err != nil {
+		t.Fatalf("CreateAccountWithRegistrationToken: %v", err)
+	}
+	if acc.IsAdmin {
+		t.Errorf("CreateAccountWithRegistrationToken: got an admin, want a regular account")
+	}
+}
+
+func TestSQLiteRegistrationTokens(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	uses := int64(1)
+	if err := db.CreateRegistrationToken("token", &uses); err != nil {
+		t.Fatalf("CreateRegistrationToken: %v", err)
+	}
+	if _, err := db.CreateAccount("alice", "password"); err != nil {
+		t.Fatalf("CreateAccount: %v", err)
+	}
+
+	// The token mustn't be used up if the account can't be created.
+	if _, err := db.CreateAccountWithRegistrationToken("alice", "password", "token", false); err == nil {
+		t.Fatalf("CreateAccountWithRegistrationToken: expected an error for an existing account")
+	}
+	if err := db.CheckRegistrationToken("token"); err != nil {
+		t.Fatalf("CheckRegistrationToken: got %v after a failed registration, want nil", err)
+	}
+
+	if _, err := db.CreateAccountWithRegistrationToken("bob", "password", "token", false); err != nil {
+		t.Fatalf("CreateAccountWithRegistrationToken: %v", err)
+	}
+	_, err := db.CreateAccountWithRegistrationToken("charlie", "password", "token", false)
+	if err != ErrRegistrationTokenExhausted {
+		t.Fatalf("CreateAccountWithRegistrationToken: got %v, want ErrRegistrationTokenExhausted", err)
+	}
+	if _, err = db.GetAccountByLocalpart("charlie"); err != sql.ErrNoRows {
+		t.Errorf("GetAccountByLocalpart: got %v for an exhausted token, want sql.ErrNoRows", err)
+	}
+	if _, err = db.CreateAccountWithRegistrationToken("charlie", "password", "unknown", false); err != sql.ErrNoRows {
+		t.Errorf("CreateAccountWithRegistrationToken: got %v for an unknown token, want sql.ErrNoRows", err)
+	}
+}
+
+func TestSQLiteFilters(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	filter := &authtypes.Filter{EventFields: []string{"content.body"}}
+	id, err := db.PutFilter("alice", filter)
+	if err != nil {
+		t.Fatalf("PutFilter: %v", err)
+	}
+	sameID, err := db.PutFilter("alice", filter)
+	if err != nil {
+		t.Fatalf("PutFilter: %v", err)
+	}
+	if sameID != id {
+		t.Errorf("PutFilter: got ID %q for an identical filter, want %q", sameID, id)
+	}
+	got, err := db.GetFilter("alice", id)
+	if err != nil {
+		t.Fatalf("GetFilter: %v", err)
+	}
+	if len(got.EventFields) != 1 || got.EventFields[0] != "content.body" {
+		t.Errorf("GetFilter: got event fields %v, want [content.body]", got.EventFields)
+	}
+	if _, err = db.GetFilter("bob", id); err != sql.ErrNoRows {
+		t.Errorf("GetFilter: got %v for another user's filter, want sql.ErrNoRows", err)
+	}
+}
+
+func TestSQLitePresence(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	if _, err := db.SetPresence(authtypes.Presence{UserID: "@alice:localhost", Presence: "online"}); err != nil {
+		t.Fatalf("SetPresence: %v", err)
+	}
+	presences, _, err := db.GetPresencesForUsers([]string{"@alice:localhost"}, 0)
+	if err != nil {
+		t.Fatalf("GetPresencesForUsers: %v", err)
+	}
+	if len(presences) != 1 || presences[0].Presence != "online" {
+		t.Errorf("GetPresencesForUsers: got %+v, want alice online", presences)
+	}
+
+	// Only local users are marked as idle.
+	if _, err = db.SetPresence(authtypes.Presence{UserID: "@bob:remote", Presence: "online"}); err != nil {
+		t.Fatalf("SetPresence: %v", err)
+	}
+	idle, err := db.GetIdlePresences(1)
+	if err != nil {
+		t.Fatalf("GetIdlePresences: %v", err)
+	}
+	if len(idle) != 1 || idle[0].UserID != "@alice:localhost" {
+		t.Errorf("GetIdlePresences: got %+v, want alice only", idle)
+	}
+	if err = db.SetLastActive("@alice:localhost", 2); err != nil {
+		t.Fatalf("SetLastActive: %v", err)
+	}
+	if idle, err = db.GetIdlePresences(2); err != nil || len(idle) != 0 {
+		t.Errorf("GetIdlePresences: got (%+v, %v) after alice was active, want none", idle, err)
+	}
+}
+
+func TestSQLiteToDeviceMessages(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	pos, err := db.StoreToDeviceMessages([]authtypes.ToDeviceMessage{
+		{Sender: "@bob:localhost", UserID: "@alice:localhost", DeviceID: "PHONE", Type: "m.test", Content: []byte(`{"a":1}`)},
+		{Sender: "@bob:localhost", UserID: "@alice:localhost", DeviceID: "PHONE", Type: "m.test", Content: []byte(`{"a":2}`)},
+	})
+	if err != nil {
+		t.Fatalf("StoreToDeviceMessages: %v", err)
+	}
+	messages, lastPos, err := db.GetToDeviceMessages("@alice:localhost", "PHONE", 0, 10)
+	if err != nil {
+		t.Fatalf("GetToDeviceMessages: %v", err)
+	}
+	if len(messages) != 2 || lastPos != pos {
+		t.Fatalf("GetToDeviceMessages: got %d messages up to %d, want 2 up to %d", len(messages), lastPos, pos)
+	}
+	if err = db.DeleteToDeviceMessages("@alice:localhost", "PHONE", pos); err != nil {
+		t.Fatalf("DeleteToDeviceMessages: %v", err)
+	}
+	if messages, _, err = db.GetToDeviceMessages("@alice:localhost", "PHONE", 0, 10); err != nil || len(messages) != 0 {
+		t.Errorf("GetToDeviceMessages: got (%d messages, %v) after deleting them, want none", len(messages), err)
+	}
+}
+
+func TestSQLiteTransactions(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	const path = "/_matrix/client/r0/rooms/!r:localhost/send/m.room.message/1"
+	reserved, err := db.ReserveTransaction("@alice:localhost", "PHONE", path, "1")
+	if err != nil || !reserved {
+		t.Fatalf("ReserveTransaction: got (%t, %v), want the transaction to be reserved", reserved, err)
+	}
+	// Retries can't reserve the transaction again, and have no response to
+	// send back while the first request is being processed.
+	if reserved, err = db.ReserveTransaction("@alice:localhost", "PHONE", path, "1"); err != nil || reserved {
+		t.Fatalf("ReserveTransaction: got (%t, %v) for a retry, want the transaction to be taken", reserved, err)
+	}
+	if res, err := db.GetTransactionResponse("@alice:localhost", "PHONE", path, "1"); err != nil || res != nil {
+		t.Fatalf("GetTransactionResponse: got (%s, %v) while processing, want none", res, err)
+	}
+	// The same transaction ID can be used for another path or device.
+	if reserved, err = db.ReserveTransaction("@alice:localhost", "PHONE", "/other/1", "1"); err != nil || !reserved {
+		t.Errorf("ReserveTransaction: got (%t, %v) for another path, want the transaction to be reserved", reserved, err)
+	}
+	if reserved, err = db.ReserveTransaction("@alice:localhost", "LAPTOP", path, "1"); err != nil || !reserved {
+		t.Errorf("ReserveTransaction: got (%t, %v) for another device, want the transaction to be reserved", reserved, err)
+	}
+
+	if err = db.StoreTransactionResponse("@alice:localhost", "PHONE", path, "1", []byte(`{"event_id":"$a"}`)); err != nil {
+		t.Fatalf("StoreTransactionResponse: %v", err)
+	}
+	if res, err := db.GetTransactionResponse("@alice:localhost", "PHONE", path, "1"); err != nil || string(res) != `{"event_id":"$a"}` {
+		t.Errorf("GetTransactionResponse: got (%s, %v), want the stored response", res, err)
+	}
+	// Cancelling only removes transactions without a response.
+	if err = db.CancelTransaction("@alice:localhost", "PHONE", path, "1"); err != nil {
+		t.Fatalf("CancelTransaction: %v", err)
+	}
+	if reserved, err = db.ReserveTransaction("@alice:localhost", "PHONE", path, "1"); err != nil || reserved {
+		t.Errorf("ReserveTransaction: got (%t, %v) after a response, want the transaction to be taken", reserved, err)
+	}
+	if err = db.CancelTransaction("@alice:localhost", "LAPTOP", path, "1"); err != nil {
+		t.Fatalf("CancelTransaction: %v", err)
+	}
+	if reserved, err = db.ReserveTransaction("@alice:localhost", "LAPTOP", path, "1"); err != nil || !reserved {
+		t.Errorf("ReserveTransaction: got (%t, %v) after cancelling, want the transaction to be reserved", reserved, err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+const threepidInvitesSchema = `
+-- Stores data about pending invites sent to third-party identifiers.
+CREATE TABLE IF NOT EXISTS account_threepid_invites (
+    -- The token the identity server issued for this invite
+    token TEXT NOT NULL PRIMARY KEY,
+    -- The identity server the invite was stored on
+    id_server TEXT NOT NULL,
+    -- The medium of the third-party identifier (e.g. "email")
+    medium TEXT NOT NULL,
+    -- The third-party identifier
+    address TEXT NOT NULL,
+    -- The room the invite is for
+    room_id TEXT NOT NULL,
+    -- The Matrix user ID of the user who sent the invite
+    sender TEXT NOT NULL,
+    -- The display name the identity server returned for the invitee
+    display_name TEXT NOT NULL
+);
+
+-- Used to look up pending invites when a third-party identifier gets bound
+CREATE INDEX IF NOT EXISTS account_threepid_invites_address ON account_threepid_invites(medium, address);
+`
+
+const insertThreePIDInviteSQL = "" +
+	"INSERT INTO account_threepid_invites(token, id_server, medium, address, room_id, sender, display_name)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7)"
+
+const selectThreePIDInvitesByAddressSQL = "" +
+	"SELECT token, id_server, room_id, sender, display_name FROM account_threepid_invites" +
+	" WHERE medium = $1 AND address = $2"
+
+type threepidInvitesStatements struct {
+	insertThreePIDInviteStmt           *sql.Stmt
+	selectThreePIDInvitesByAddressStmt *sql.Stmt
+}
+
+func (s *threepidInvitesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(threepidInvitesSchema)
+	if err != nil {
+		return
+	}
+	if s.insertThreePIDInviteStmt, err = db.Prepare(insertThreePIDInviteSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDInvitesByAddressStmt, err = db.Prepare(selectThreePIDInvitesByAddressSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *threepidInvitesStatements) insertThreePIDInvite(invite *authtypes.ThreePIDInvite) (err error) {
+	_, err = s.insertThreePIDInviteStmt.Exec(
+		invite.Token, invite.IDServer, invite.Medium, invite.Address,
+		invite.RoomID, invite.Sender, invite.DisplayName,
+	)
+	return
+}
+
+func (s *threepidInvitesStatements) selectThreePIDInvitesByAddress(
+	medium string, address string,
+) (invites []authtypes.ThreePIDInvite, err error) {
+	rows, err := s.selectThreePIDInvitesByAddressStmt.Query(medium, address)
+	if err != nil {
+		return
+	}
+
+	invites = []authtypes.ThreePIDInvite{}
+
+	defer rows.Close()
+	for rows.Next() {
+		invite := authtypes.ThreePIDInvite{Medium: medium, Address: address}
+		if err = rows.Scan(
+			&invite.Token, &invite.IDServer, &invite.RoomID, &invite.Sender, &invite.DisplayName,
+		); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+)
+
+// The schema of the table and the statements which depend on the database
+// are in sql_postgres.go and sql_sqlite.go.
+
+const insertToDeviceMessageSQL = "" +
+	"INSERT INTO account_to_device_messages(sender_user_id, target_user_id, target_device_id, event_type, content)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const selectToDeviceMessagesSQL = "" +
+	"SELECT id, sender_user_id, event_type, content FROM account_to_device_messages" +
+	" WHERE target_user_id = $1 AND target_device_id = $2 AND id > $3" +
+	" ORDER BY id ASC LIMIT $4"
+
+const deleteToDeviceMessagesSQL = "" +
+	"DELETE FROM account_to_device_messages" +
+	" WHERE target_user_id = $1 AND target_device_id = $2 AND id <= $3"
+
+type toDeviceStatements struct {
+	insertToDeviceMessageStmt  *sql.Stmt
+	selectToDeviceMessagesStmt *sql.Stmt
+	deleteToDeviceMessagesStmt *sql.Stmt
+	selectMaxToDeviceIDStmt    *sql.Stmt
+}
+
+func (s *toDeviceStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(toDeviceSchema)
+	if err != nil {
+		return
+	}
+	if s.insertToDeviceMessageStmt, err = db.Prepare(insertToDeviceMessageSQL); err != nil {
+		return
+	}
+	if s.selectToDeviceMessagesStmt, err = db.Prepare(selectToDeviceMessagesSQL); err != nil {
+		return
+	}
+	if s.deleteToDeviceMessagesStmt, err = db.Prepare(deleteToDeviceMessagesSQL); err != nil {
+		return
+	}
+	if s.selectMaxToDeviceIDStmt, err = db.Prepare(selectMaxToDeviceIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *toDeviceStatements) insertToDeviceMessage(
+	message authtypes.ToDeviceMessage, txn *sql.Tx,
+) error {
+	stmt := common.TxStmt(txn, s.insertToDeviceMessageStmt)
+	_, err := stmt.Exec(
+		message.Sender, message.UserID, message.DeviceID, message.Type, string(message.Content),
+	)
+	return err
+}
+
+// selectToDeviceMessages returns at most limit messages for the device after
+// afterID in the to-device stream, oldest first, along with the position of
+// the last one of them. If there are none, afterID is returned.
+func (s *toDeviceStatements) selectToDeviceMessages(
+	userID, deviceID string, afterID int64, limit int,
+) (messages []authtypes.ToDeviceMessage, maxID int64, err error) {
+	rows, err := s.selectToDeviceMessagesStmt.Query(userID, deviceID, afterID, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close() // nolint: errcheck
+
+	maxID = afterID
+	for rows.Next() {
+		var id int64
+		var content string
+		m := authtypes.ToDeviceMessage{UserID: userID, DeviceID: deviceID}
+		if err = rows.Scan(&id, &m.Sender, &m.Type, &content); err != nil {
+			return
+		}
+		m.Content = json.RawMessage(content)
+		messages = append(messages, m)
+		maxID = id
+	}
+	return
+}
+
+func (s *toDeviceStatements) deleteToDeviceMessages(
+	userID, deviceID string, upToID int64,
+) error {
+	_, err := s.deleteToDeviceMessagesStmt.Exec(userID, deviceID, upToID)
+	return err
+}
+
+// selectMaxToDeviceID returns the position of the latest message in the
+// to-device stream, even if it was deleted since, or 0 if there was none.
+func (s *toDeviceStatements) selectMaxToDeviceID(txn *sql.Tx) (id int64, err error) {
+	stmt := common.TxStmt(txn, s.selectMaxToDeviceIDStmt)
+	err = stmt.QueryRow().Scan(&id)
+	return
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package accounts
+
+import (
+	"database/sql"
+)
+
+const transactionsSchema = `
+-- The transactions used to be kept without the path of their request. Their
+-- responses are only needed for retries, so they are dropped rather than
+-- migrated.
+DROP TABLE IF EXISTS account_transactions;
+
+-- Stores the transaction IDs of the requests sent by devices with one, along
+-- with the responses to the requests, so that retries of the same request
+-- aren't processed twice.
+CREATE TABLE IF NOT EXISTS account_request_transactions (
+    -- The Matrix user ID of the user who sent the request
+    user_id TEXT NOT NULL,
+    -- The ID of the device that sent the request
+    device_id TEXT NOT NULL,
+    -- The path of the request, which includes the transaction ID
+    path TEXT NOT NULL,
+    -- The transaction ID of the request
+    txn_id TEXT NOT NULL,
+    -- The body of the response to the request, as JSON, or NULL while the
+    -- request is being processed
+    response_json TEXT,
+    PRIMARY KEY (user_id, device_id, path, txn_id)
+);
+`
+
+const insertTransactionSQL = "" +
+	"INSERT INTO account_request_transactions(user_id, device_id, path, txn_id) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const updateTransactionResponseSQL = "" +
+	"UPDATE account_request_transactions SET response_json = $1" +
+	" WHERE user_id = $2 AND device_id = $3 AND path = $4 AND txn_id = $5"
+
+const deletePendingTransactionSQL = "" +
+	"DELETE FROM account_request_transactions" +
+	" WHERE user_id = $1 AND device_id = $2 AND path = $3 AND txn_id = $4 AND response_json IS NULL"
+
+const selectTransactionSQL = "" +
+	"SELECT response_json FROM account_request_transactions" +
+	" WHERE user_id = $1 AND device_id = $2 AND path = $3 AND txn_id = $4"
+
+type transactionsStatements struct {
+	insertTransactionStmt         *sql.Stmt
+	updateTransactionResponseStmt *sql.Stmt
+	deletePendingTransactionStmt  *sql.Stmt
+	selectTransactionStmt         *sql.Stmt
+}
+
+func (s *transactionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(transactionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertTransactionStmt, err = db.Prepare(insertTransactionSQL); err != nil {
+		return
+	}
+	if s.updateTransactionResponseStmt, err = db.Prepare(updateTransactionResponseSQL); err != nil {
+		return
+	}
+	if s.deletePendingTransactionStmt, err = db.Prepare(deletePendingTransactionSQL); err != nil {
+		return
+	}
+	if s.selectTransactionStmt, err = db.Prepare(selectTransactionSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertTransaction inserts the transaction without a response, and returns
+// whether it was inserted, i.e. whether the transaction wasn't already there.
+func (s *transactionsStatements) insertTransaction(
+	userID, deviceID, path, txnID string,
+) (bool, error) {
+	res, err := s.insertTransactionStmt.Exec(userID, deviceID, path, txnID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count == 1, err
+}
+
+func (s *transactionsStatements) updateTransactionResponse(
+	userID, deviceID, path, txnID string, responseJSON []byte,
+) (err error) {
+	_, err = s.updateTransactionResponseStmt.Exec(string(responseJSON), userID, deviceID, path, txnID)
+	return
+}
+
+func (s *transactionsStatements) deletePendingTransaction(
+	userID, deviceID, path, txnID string,
+) (err error) {
+	_, err = s.deletePendingTransactionStmt.Exec(userID, deviceID, path, txnID)
+	return
+}
+
+// selectTransaction returns the response to the transaction, which is invalid
+// while the request is being processed.
+func (s *transactionsStatements) selectTransaction(
+	userID, deviceID, path, txnID string,
+) (responseJSON sql.NullString, err error) {
+	err = s.selectTransactionStmt.QueryRow(userID, deviceID, path, txnID).Scan(&responseJSON)
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package devices
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+const deviceListStreamsSchema = `
+-- Stores the stream ID of the latest update to the device list of each user,
+-- i.e. of the latest m.device_list_update EDU sent about their devices.
+CREATE TABLE IF NOT EXISTS device_list_streams (
+    -- The Matrix user ID localpart of the user.
+    localpart TEXT NOT NULL PRIMARY KEY,
+    -- The stream ID of the latest update.
+    stream_id BIGINT NOT NULL
+);
+`
+
+// The stream ID of the first update of a user is 1, and the ID of each of the
+// next ones is the ID of the previous one plus one, so that the servers
+// receiving the updates can tell whether they missed one.
+const upsertDeviceListStreamIDSQL = "" +
+	"INSERT INTO device_list_streams(localpart, stream_id) VALUES ($1, 1)" +
+	" ON CONFLICT (localpart) DO UPDATE SET stream_id = device_list_streams.stream_id + 1"
+
+const selectDeviceListStreamIDSQL = "" +
+	"SELECT stream_id FROM device_list_streams WHERE localpart = $1"
+
+type deviceListStreamsStatements struct {
+	upsertDeviceListStreamIDStmt *sql.Stmt
+	selectDeviceListStreamIDStmt *sql.Stmt
+}
+
+func (s *deviceListStreamsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(deviceListStreamsSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertDeviceListStreamIDStmt, err = db.Prepare(upsertDeviceListStreamIDSQL); err != nil {
+		return
+	}
+	if s.selectDeviceListStreamIDStmt, err = db.Prepare(selectDeviceListStreamIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertDeviceListStreamID sets the stream ID of the latest update to the
+// device list of the user to the one after the previous update, or to 1 if
+// there was none.
+func (s *deviceListStreamsStatements) upsertDeviceListStreamID(txn *sql.Tx, localpart string) error {
+	_, err := txn.Stmt(s.upsertDeviceListStreamIDStmt).Exec(localpart)
+	return err
+}
+
+// selectDeviceListStreamID returns sql.ErrNoRows if the device list of the
+// user was never updated.
+func (s *deviceListStreamsStatements) selectDeviceListStreamID(txn *sql.Tx, localpart string) (streamID int64, err error) {
+	err = common.TxStmt(txn, s.selectDeviceListStreamIDStmt).QueryRow(localpart).Scan(&streamID)
+	return
+}
@@ -37,8 +37,10 @@ CREATE TABLE IF NOT EXISTS device_devices (
     -- migration to different domain names easier.
     localpart TEXT NOT NULL,
     -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
-    created_ts BIGINT NOT NULL
-    -- TODO: device keys, device display names, last used ts and IP address?, token restrictions (if 3rd-party OAuth app)
+    created_ts BIGINT NOT NULL,
+    -- The display name of the device, as given by the user. NULL if none was given.
+    display_name TEXT
+    -- TODO: device keys, last used ts and IP address?, token restrictions (if 3rd-party OAuth app)
 );
 
 -- Device IDs must be unique for a given user.
@@ -46,21 +48,40 @@ CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(loca
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name)" +
+	" VALUES ($1, $2, $3, $4, $5)"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT device_id, localpart, display_name, created_ts FROM device_devices WHERE access_token = $1"
+
+const selectDeviceByIDSQL = "" +
+	"SELECT display_name, created_ts FROM device_devices WHERE localpart = $1 AND device_id = $2"
+
+const selectDevicesByLocalpartSQL = "" +
+	"SELECT device_id, display_name, created_ts FROM device_devices WHERE localpart = $1 ORDER BY device_id"
+
+const updateDeviceNameSQL = "" +
+	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
-// TODO: List devices?
+const deleteDevicesByLocalpartSQL = "" +
+	"DELETE FROM device_devices WHERE localpart = $1"
+
+const deleteDevicesExceptSQL = "" +
+	"DELETE FROM device_devices WHERE localpart = $1 AND device_id != $2"
 
 type devicesStatements struct {
-	insertDeviceStmt        *sql.Stmt
-	selectDeviceByTokenStmt *sql.Stmt
-	deleteDeviceStmt        *sql.Stmt
-	serverName              gomatrixserverlib.ServerName
+	insertDeviceStmt             *sql.Stmt
+	selectDeviceByTokenStmt      *sql.Stmt
+	selectDeviceByIDStmt         *sql.Stmt
+	selectDevicesByLocalpartStmt *sql.Stmt
+	updateDeviceNameStmt         *sql.Stmt
+	deleteDeviceStmt             *sql.Stmt
+	deleteDevicesByLocalpartStmt *sql.Stmt
+	deleteDevicesExceptStmt      *sql.Stmt
+	serverName                   gomatrixserverlib.ServerName
 }
 
 func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerName) (err error) {
@@ -68,15 +89,35 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if err != nil {
 		return
 	}
+	if devicesMigrations != "" {
+		if _, err = db.Exec(devicesMigrations); err != nil {
+			return
+		}
+	}
 	if s.insertDeviceStmt, err = db.Prepare(insertDeviceSQL); err != nil {
 		return
 	}
 	if s.selectDeviceByTokenStmt, err = db.Prepare(selectDeviceByTokenSQL); err != nil {
 		return
 	}
+	if s.selectDeviceByIDStmt, err = db.Prepare(selectDeviceByIDSQL); err != nil {
+		return
+	}
+	if s.selectDevicesByLocalpartStmt, err = db.Prepare(selectDevicesByLocalpartSQL); err != nil {
+		return
+	}
+	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
+	if s.deleteDevicesByLocalpartStmt, err = db.Prepare(deleteDevicesByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deleteDevicesExceptStmt, err = db.Prepare(deleteDevicesExceptSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -84,34 +125,99 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 // insertDevice creates a new device. Returns an error if any device with the same access token already exists.
 // Returns an error if the user already has a device with the given device ID.
 // Returns the device on success.
-func (s *devicesStatements) insertDevice(txn *sql.Tx, id, localpart, accessToken string) (dev *authtypes.Device, err error) {
+func (s *devicesStatements) insertDevice(
+	txn *sql.Tx, id, localpart, accessToken string, displayName *string,
+) (dev *authtypes.Device, err error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
-	if _, err = txn.Stmt(s.insertDeviceStmt).Exec(id, localpart, accessToken, createdTimeMS); err == nil {
+	if _, err = txn.Stmt(s.insertDeviceStmt).Exec(id, localpart, accessToken, createdTimeMS, displayName); err == nil {
 		dev = &authtypes.Device{
 			ID:          id,
 			UserID:      makeUserID(localpart, s.serverName),
 			AccessToken: accessToken,
+			CreatedTS:   createdTimeMS,
+		}
+		if displayName != nil {
+			dev.DisplayName = *displayName
 		}
 	}
 	return
 }
 
+func (s *devicesStatements) updateDeviceName(txn *sql.Tx, localpart, id string, displayName *string) error {
+	_, err := txn.Stmt(s.updateDeviceNameStmt).Exec(displayName, localpart, id)
+	return err
+}
+
 func (s *devicesStatements) deleteDevice(txn *sql.Tx, id, localpart string) error {
 	_, err := txn.Stmt(s.deleteDeviceStmt).Exec(id, localpart)
 	return err
 }
 
+func (s *devicesStatements) deleteDevicesByLocalpart(txn *sql.Tx, localpart string) error {
+	_, err := txn.Stmt(s.deleteDevicesByLocalpartStmt).Exec(localpart)
+	return err
+}
+
+// deleteDevicesExcept deletes all the devices of the user except the one with
+// the given ID.
+func (s *devicesStatements) deleteDevicesExcept(txn *sql.Tx, localpart, exceptID string) error {
+	_, err := txn.Stmt(s.deleteDevicesExceptStmt).Exec(localpart, exceptID)
+	return err
+}
+
 func (s *devicesStatements) selectDeviceByToken(accessToken string) (*authtypes.Device, error) {
 	var dev authtypes.Device
 	var localpart string
-	err := s.selectDeviceByTokenStmt.QueryRow(accessToken).Scan(&dev.ID, &localpart)
+	var displayName sql.NullString
+	err := s.selectDeviceByTokenStmt.QueryRow(accessToken).Scan(&dev.ID, &localpart, &displayName, &dev.CreatedTS)
 	if err == nil {
 		dev.UserID = makeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
+		dev.DisplayName = displayName.String
 	}
 	return &dev, err
 }
 
+// selectDeviceByID returns sql.ErrNoRows if the user has no device with this ID.
+// The access token of the returned device is left empty.
+func (s *devicesStatements) selectDeviceByID(localpart, id string) (*authtypes.Device, error) {
+	var displayName sql.NullString
+	var createdTS int64
+	err := s.selectDeviceByIDStmt.QueryRow(localpart, id).Scan(&displayName, &createdTS)
+	if err != nil {
+		return nil, err
+	}
+	return &authtypes.Device{
+		ID:          id,
+		UserID:      makeUserID(localpart, s.serverName),
+		DisplayName: displayName.String,
+		CreatedTS:   createdTS,
+	}, nil
+}
+
+// selectDevicesByLocalpart returns the devices of the user. The access tokens
+// of the returned devices are left empty.
+func (s *devicesStatements) selectDevicesByLocalpart(localpart string) ([]authtypes.Device, error) {
+	rows, err := s.selectDevicesByLocalpartStmt.Query(localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []authtypes.Device{}
+	for rows.Next() {
+		var dev authtypes.Device
+		var displayName sql.NullString
+		if err = rows.Scan(&dev.ID, &displayName, &dev.CreatedTS); err != nil {
+			return nil, err
+		}
+		dev.UserID = makeUserID(localpart, s.serverName)
+		dev.DisplayName = displayName.String
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
 func makeUserID(localpart string, server gomatrixserverlib.ServerName) string {
 	return fmt.Sprintf("@%s:%s", localpart, string(server))
 }
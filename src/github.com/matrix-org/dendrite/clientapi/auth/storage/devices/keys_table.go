@@ -0,0 +1,199 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package devices
+
+import (
+	"database/sql"
+)
+
+const keysSchema = `
+-- Stores the end-to-end encryption keys uploaded by devices: the identity
+-- keys of each device and the one-time keys other devices claim to start
+-- encrypted sessions with it.
+CREATE TABLE IF NOT EXISTS device_e2e_keys (
+    -- The Matrix user ID localpart of the owner of the device.
+    localpart TEXT NOT NULL,
+    -- The ID of the device.
+    device_id TEXT NOT NULL,
+    -- The algorithm of a one-time key, or the empty string for the device keys.
+    algorithm TEXT NOT NULL,
+    -- The "<algorithm>:<key_id>" of a one-time key, or the empty string for
+    -- the device keys.
+    key_id TEXT NOT NULL,
+    -- The signed JSON of the keys.
+    key_json TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_e2e_keys_idx ON device_e2e_keys(localpart, device_id, key_id);
+`
+
+const insertKeySQL = "" +
+	"INSERT INTO device_e2e_keys(localpart, device_id, algorithm, key_id, key_json)" +
+	" VALUES ($1, $2, $3, $4, $5)"
+
+const deleteKeySQL = "" +
+	"DELETE FROM device_e2e_keys WHERE localpart = $1 AND device_id = $2 AND key_id = $3"
+
+const selectDeviceKeysSQL = "" +
+	"SELECT device_id, key_json FROM device_e2e_keys WHERE localpart = $1 AND key_id = ''"
+
+const countOneTimeKeysSQL = "" +
+	"SELECT algorithm, COUNT(*) FROM device_e2e_keys" +
+	" WHERE localpart = $1 AND device_id = $2 AND key_id != '' GROUP BY algorithm"
+
+const selectOneTimeKeySQL = "" +
+	"SELECT key_id, key_json FROM device_e2e_keys" +
+	" WHERE localpart = $1 AND device_id = $2 AND algorithm = $3 AND key_id != ''" +
+	" ORDER BY key_id LIMIT 1"
+
+const deleteKeysByDeviceSQL = "" +
+	"DELETE FROM device_e2e_keys WHERE localpart = $1 AND device_id = $2"
+
+const deleteKeysByLocalpartSQL = "" +
+	"DELETE FROM device_e2e_keys WHERE localpart = $1"
+
+const deleteKeysExceptSQL = "" +
+	"DELETE FROM device_e2e_keys WHERE localpart = $1 AND device_id != $2"
+
+type keysStatements struct {
+	insertKeyStmt             *sql.Stmt
+	deleteKeyStmt             *sql.Stmt
+	selectDeviceKeysStmt      *sql.Stmt
+	countOneTimeKeysStmt      *sql.Stmt
+	selectOneTimeKeyStmt      *sql.Stmt
+	deleteKeysByDeviceStmt    *sql.Stmt
+	deleteKeysByLocalpartStmt *sql.Stmt
+	deleteKeysExceptStmt      *sql.Stmt
+}
+
+func (s *keysStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(keysSchema)
+	if err != nil {
+		return
+	}
+	if s.insertKeyStmt, err = db.Prepare(insertKeySQL); err != nil {
+		return
+	}
+	if s.deleteKeyStmt, err = db.Prepare(deleteKeySQL); err != nil {
+		return
+	}
+	if s.selectDeviceKeysStmt, err = db.Prepare(selectDeviceKeysSQL); err != nil {
+		return
+	}
+	if s.countOneTimeKeysStmt, err = db.Prepare(countOneTimeKeysSQL); err != nil {
+		return
+	}
+	if s.selectOneTimeKeyStmt, err = db.Prepare(selectOneTimeKeySQL); err != nil {
+		return
+	}
+	if s.deleteKeysByDeviceStmt, err = db.Prepare(deleteKeysByDeviceSQL); err != nil {
+		return
+	}
+	if s.deleteKeysByLocalpartStmt, err = db.Prepare(deleteKeysByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deleteKeysExceptStmt, err = db.Prepare(deleteKeysExceptSQL); err != nil {
+		return
+	}
+	return
+}
+
+// upsertKey stores a key, replacing any key of the device with the same ID.
+func (s *keysStatements) upsertKey(
+	txn *sql.Tx, localpart, deviceID, algorithm, keyID string, keyJSON []byte,
+) error {
+	if _, err := txn.Stmt(s.deleteKeyStmt).Exec(localpart, deviceID, keyID); err != nil {
+		return err
+	}
+	_, err := txn.Stmt(s.insertKeyStmt).Exec(localpart, deviceID, algorithm, keyID, string(keyJSON))
+	return err
+}
+
+// deleteKey returns whether a key was deleted.
+func (s *keysStatements) deleteKey(txn *sql.Tx, localpart, deviceID, keyID string) (bool, error) {
+	res, err := txn.Stmt(s.deleteKeyStmt).Exec(localpart, deviceID, keyID)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// selectDeviceKeys returns the device keys of each device of the user which
+// uploaded some.
+func (s *keysStatements) selectDeviceKeys(localpart string) (map[string][]byte, error) {
+	rows, err := s.selectDeviceKeysStmt.Query(localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	result := make(map[string][]byte)
+	for rows.Next() {
+		var deviceID, keyJSON string
+		if err = rows.Scan(&deviceID, &keyJSON); err != nil {
+			return nil, err
+		}
+		result[deviceID] = []byte(keyJSON)
+	}
+	return result, rows.Err()
+}
+
+func (s *keysStatements) countOneTimeKeys(localpart, deviceID string) (map[string]int, error) {
+	rows, err := s.countOneTimeKeysStmt.Query(localpart, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	result := make(map[string]int)
+	for rows.Next() {
+		var algorithm string
+		var count int
+		if err = rows.Scan(&algorithm, &count); err != nil {
+			return nil, err
+		}
+		result[algorithm] = count
+	}
+	return result, rows.Err()
+}
+
+// selectOneTimeKey returns sql.ErrNoRows if the device has no one-time key
+// for the algorithm.
+func (s *keysStatements) selectOneTimeKey(
+	txn *sql.Tx, localpart, deviceID, algorithm string,
+) (keyID string, keyJSON []byte, err error) {
+	var keyJSONString string
+	err = txn.Stmt(s.selectOneTimeKeyStmt).QueryRow(localpart, deviceID, algorithm).Scan(&keyID, &keyJSONString)
+	keyJSON = []byte(keyJSONString)
+	return
+}
+
+func (s *keysStatements) deleteKeysByDevice(txn *sql.Tx, localpart, deviceID string) error {
+	_, err := txn.Stmt(s.deleteKeysByDeviceStmt).Exec(localpart, deviceID)
+	return err
+}
+
+func (s *keysStatements) deleteKeysByLocalpart(txn *sql.Tx, localpart string) error {
+	_, err := txn.Stmt(s.deleteKeysByLocalpartStmt).Exec(localpart)
+	return err
+}
+
+// deleteKeysExcept deletes the keys of all the devices of the user except the
+// one with the given ID.
+func (s *keysStatements) deleteKeysExcept(txn *sql.Tx, localpart, exceptID string) error {
+	_, err := txn.Stmt(s.deleteKeysExceptStmt).Exec(localpart, exceptID)
+	return err
+}
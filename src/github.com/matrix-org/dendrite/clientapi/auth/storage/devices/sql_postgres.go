@@ -0,0 +1,25 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !sqlite
+
+package devices
+
+// The statements which differ between the postgres and SQLite databases.
+
+// Columns added to tables after they were first created, which the CREATE
+// TABLE statements don't add to the tables of existing databases.
+const devicesMigrations = `
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS display_name TEXT;
+`
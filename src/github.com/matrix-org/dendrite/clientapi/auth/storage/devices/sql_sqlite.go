@@ -0,0 +1,24 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package devices
+
+// The statements which differ between the postgres and SQLite databases.
+
+// SQLite databases were only supported after the columns added to tables
+// since they were first created, so they don't need migrating. SQLite can't
+// add a column only if it doesn't exist anyway.
+const devicesMigrations = ""
@@ -16,6 +16,7 @@ package devices
 
 import (
 	"database/sql"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/common"
@@ -24,22 +25,32 @@ import (
 
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	devices devicesStatements
+	db                *sql.DB
+	devices           devicesStatements
+	keys              keysStatements
+	deviceListStreams deviceListStreamsStatements
 }
 
 // NewDatabase creates a new device database
 func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName) (*Database, error) {
 	var db *sql.DB
 	var err error
-	if db, err = sql.Open("postgres", dataSourceName); err != nil {
+	if db, err = common.OpenDatabase(dataSourceName); err != nil {
 		return nil, err
 	}
 	d := devicesStatements{}
 	if err = d.prepare(db, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, d}, nil
+	k := keysStatements{}
+	if err = k.prepare(db); err != nil {
+		return nil, err
+	}
+	l := deviceListStreamsStatements{}
+	if err = l.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, d, k, l}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -48,12 +59,29 @@ func (d *Database) GetDeviceByAccessToken(token string) (*authtypes.Device, erro
 	return d.devices.selectDeviceByToken(token)
 }
 
+// GetDeviceByID returns the device with the given ID belonging to the user
+// with the given localpart. The access token of the device isn't returned.
+// Returns sql.ErrNoRows if no matching device was found.
+func (d *Database) GetDeviceByID(localpart, deviceID string) (*authtypes.Device, error) {
+	return d.devices.selectDeviceByID(localpart, deviceID)
+}
+
+// GetDevicesByLocalpart returns the devices belonging to the user with the
+// given localpart. The access tokens of the devices aren't returned.
+// If the user has no device, returns an empty array
+func (d *Database) GetDevicesByLocalpart(localpart string) ([]authtypes.Device, error) {
+	return d.devices.selectDevicesByLocalpart(localpart)
+}
+
 // CreateDevice makes a new device associated with the given user ID localpart.
 // If there is already a device with the same device ID for this user, that access token will be revoked
 // and replaced with the given accessToken. If the given accessToken is already in use for another device,
 // an error will be returned.
+// displayName can be nil if the user didn't give the device a name.
 // Returns the device on success.
-func (d *Database) CreateDevice(localpart, deviceID, accessToken string) (dev *authtypes.Device, returnErr error) {
+func (d *Database) CreateDevice(
+	localpart, deviceID, accessToken string, displayName *string,
+) (dev *authtypes.Device, returnErr error) {
 	returnErr = common.WithTransaction(d.db, func(txn *sql.Tx) error {
 		var err error
 		// Revoke existing token for this device
@@ -61,7 +89,7 @@ func (d *Database) CreateDevice(localpart, deviceID, accessToken string) (dev *a
 			return err
 		}
 
-		dev, err = d.devices.insertDevice(txn, deviceID, localpart, accessToken)
+		dev, err = d.devices.insertDevice(txn, deviceID, localpart, accessToken, displayName)
 		if err != nil {
 			return err
 		}
@@ -76,9 +104,132 @@ func (d *Database) CreateDevice(localpart, deviceID, accessToken string) (dev *a
 // If something went wrong during the deletion, it will return the SQL error
 func (d *Database) RemoveDevice(deviceID string, localpart string) error {
 	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevice(txn, deviceID, localpart); err != sql.ErrNoRows {
+		if err := d.devices.deleteDevice(txn, deviceID, localpart); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return d.keys.deleteKeysByDevice(txn, localpart, deviceID)
+	})
+}
+
+// UpdateDevice updates the display name of the device with the given ID
+// belonging to the user with the given localpart. displayName can be nil to
+// remove the display name of the device.
+// If the device doesn't exist, it will not return an error
+// If something went wrong during the update, it will return the SQL error
+func (d *Database) UpdateDevice(localpart, deviceID string, displayName *string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.updateDeviceName(txn, localpart, deviceID, displayName)
+	})
+}
+
+// RemoveAllDevices revokes all the devices of the user with the given localpart
+// If something went wrong during the deletion, it will return the SQL error
+func (d *Database) RemoveAllDevices(localpart string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.devices.deleteDevicesByLocalpart(txn, localpart); err != nil {
+			return err
+		}
+		return d.keys.deleteKeysByLocalpart(txn, localpart)
+	})
+}
+
+// RemoveAllDevicesExcept revokes all the devices of the user with the given
+// localpart except the one with the given device ID
+// If something went wrong during the deletion, it will return the SQL error
+func (d *Database) RemoveAllDevicesExcept(localpart, exceptDeviceID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.devices.deleteDevicesExcept(txn, localpart, exceptDeviceID); err != nil {
 			return err
 		}
+		return d.keys.deleteKeysExcept(txn, localpart, exceptDeviceID)
+	})
+}
+
+// StoreDeviceKeys stores the signed JSON of the identity keys of the device
+// with the given ID belonging to the user with the given localpart, replacing
+// the previous ones.
+func (d *Database) StoreDeviceKeys(localpart, deviceID string, keyJSON []byte) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.keys.upsertKey(txn, localpart, deviceID, "", "", keyJSON)
+	})
+}
+
+// StoreOneTimeKeys stores one-time keys of the device with the given ID
+// belonging to the user with the given localpart. The keys are mapped from
+// their "<algorithm>:<key_id>" to their JSON.
+func (d *Database) StoreOneTimeKeys(localpart, deviceID string, keys map[string][]byte) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for keyID, keyJSON := range keys {
+			algorithm := strings.SplitN(keyID, ":", 2)[0]
+			if err := d.keys.upsertKey(txn, localpart, deviceID, algorithm, keyID, keyJSON); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
+
+// CountOneTimeKeys returns the number of one-time keys left for the device
+// with the given ID belonging to the user with the given localpart, by
+// algorithm.
+func (d *Database) CountOneTimeKeys(localpart, deviceID string) (map[string]int, error) {
+	return d.keys.countOneTimeKeys(localpart, deviceID)
+}
+
+// GetDeviceKeys returns the JSON of the identity keys of the devices of the
+// user with the given localpart, mapped by device ID. Devices which haven't
+// uploaded keys are missing from the result.
+func (d *Database) GetDeviceKeys(localpart string) (map[string][]byte, error) {
+	return d.keys.selectDeviceKeys(localpart)
+}
+
+// ClaimOneTimeKey removes a one-time key for the algorithm from the keys of
+// the device with the given ID belonging to the user with the given localpart
+// and returns its "<algorithm>:<key_id>" and JSON. Each key is only ever
+// returned once, even when claimed concurrently.
+// Returns sql.ErrNoRows if the device has no key left for the algorithm.
+func (d *Database) ClaimOneTimeKey(
+	localpart, deviceID, algorithm string,
+) (keyID string, keyJSON []byte, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		for {
+			var claimErr error
+			keyID, keyJSON, claimErr = d.keys.selectOneTimeKey(txn, localpart, deviceID, algorithm)
+			if claimErr != nil {
+				return claimErr
+			}
+			// If the key was claimed by a concurrent request then it is
+			// gone by the time we delete it, so try the next one.
+			deleted, claimErr := d.keys.deleteKey(txn, localpart, deviceID, keyID)
+			if claimErr != nil || deleted {
+				return claimErr
+			}
+		}
+	})
+	return
+}
+
+// NewDeviceListStreamID returns the stream ID of a new update to the device
+// list of the user with the given localpart, which is the ID of the previous
+// update plus one, or 1 for the first update.
+func (d *Database) NewDeviceListStreamID(localpart string) (streamID int64, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deviceListStreams.upsertDeviceListStreamID(txn, localpart); err != nil {
+			return err
+		}
+		var selectErr error
+		streamID, selectErr = d.deviceListStreams.selectDeviceListStreamID(txn, localpart)
+		return selectErr
+	})
+	return
+}
+
+// GetDeviceListStreamID returns the stream ID of the latest update to the
+// device list of the user with the given localpart, or 0 if there was none.
+func (d *Database) GetDeviceListStreamID(localpart string) (int64, error) {
+	streamID, err := d.deviceListStreams.selectDeviceListStreamID(nil, localpart)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return streamID, err
+}
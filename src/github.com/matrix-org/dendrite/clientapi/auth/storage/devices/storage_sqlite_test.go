@@ -0,0 +1,197 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package devices
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTestDatabase opens a device database in a new SQLite file. The returned
+// function removes the file.
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDatabase("file:"+filepath.Join(dir, "device.db"), "localhost")
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	return db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func TestSQLiteDevices(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	for _, deviceID := range []string{"PHONE", "LAPTOP"} {
+		if _, err := db.CreateDevice("alice", deviceID, "token_"+deviceID, nil); err != nil {
+			t.Fatalf("CreateDevice: %v", err)
+		}
+	}
+	dev, err := db.GetDeviceByAccessToken("token_PHONE")
+	if err != nil {
+		t.Fatalf("GetDeviceByAccessToken: %v", err)
+	}
+	if dev.ID != "PHONE" || dev.UserID != "@alice:localhost" {
+		t.Errorf("GetDeviceByAccessToken: got device %q of %q, want PHONE of @alice:localhost", dev.ID, dev.UserID)
+	}
+
+	// Logging in again on the same device replaces its access token.
+	if _, err = db.CreateDevice("alice", "PHONE", "new_token", nil); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	if _, err = db.GetDeviceByAccessToken("token_PHONE"); err != sql.ErrNoRows {
+		t.Errorf("GetDeviceByAccessToken: got %v for a replaced token, want sql.ErrNoRows", err)
+	}
+
+	if err = db.RemoveAllDevices("alice"); err != nil {
+		t.Fatalf("RemoveAllDevices: %v", err)
+	}
+	devs, err := db.GetDevicesByLocalpart("alice")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart: %v", err)
+	}
+	if len(devs) != 0 {
+		t.Errorf("GetDevicesByLocalpart: got %d devices after removing all of them, want 0", len(devs))
+	}
+}
+
+func TestSQLiteOneTimeKeys(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	if _, err := db.CreateDevice("alice", "PHONE", "token", nil); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	err := db.StoreOneTimeKeys("alice", "PHONE", map[string][]byte{
+		"signed_curve25519:AAAA": []byte(`{"key":"a"}`),
+		"signed_curve25519:BBBB": []byte(`{"key":"b"}`),
+	})
+	if err != nil {
+		t.Fatalf("StoreOneTimeKeys: %v", err)
+	}
+	counts, err := db.CountOneTimeKeys("alice", "PHONE")
+	if err != nil {
+		t.Fatalf("CountOneTimeKeys: %v", err)
+	}
+	if counts["signed_curve25519"] != 2 {
+		t.Errorf("CountOneTimeKeys: got %v, want 2 signed_curve25519 keys", counts)
+	}
+
+	claimed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		keyID, _, claimErr := db.ClaimOneTimeKey("alice", "PHONE", "signed_curve25519")
+		if claimErr != nil {
+			t.Fatalf("ClaimOneTimeKey: %v", claimErr)
+		}
+		if claimed[keyID] {
+			t.Errorf("ClaimOneTimeKey: key %q was claimed twice", keyID)
+		}
+		claimed[keyID] = true
+	}
+	if _, _, err = db.ClaimOneTimeKey("alice", "PHONE", "signed_curve25519"); err != sql.ErrNoRows {
+		t.Errorf("ClaimOneTimeKey: got %v once all keys were claimed, want sql.ErrNoRows", err)
+	}
+}
+
+func TestSQLiteClaimOneTimeKeyConcurrently(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	if _, err := db.CreateDevice("alice", "PHONE", "token", nil); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	const keyCount = 10
+	keys := map[string][]byte{}
+	for i := 0; i < keyCount; i++ {
+		keys[fmt.Sprintf("signed_curve25519:KEY%d", i)] = []byte(fmt.Sprintf(`{"key":"%d"}`, i))
+	}
+	if err := db.StoreOneTimeKeys("alice", "PHONE", keys); err != nil {
+		t.Fatalf("StoreOneTimeKeys: %v", err)
+	}
+
+	// Twice as many requests as there are keys claim them at the same time.
+	// Each key must be given to exactly one of them, and the others must find
+	// no key left.
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	claimed := map[string]int{}
+	var noKeyLeft int
+	for i := 0; i < 2*keyCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keyID, _, err := db.ClaimOneTimeKey("alice", "PHONE", "signed_curve25519")
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch err {
+			case nil:
+				claimed[keyID]++
+			case sql.ErrNoRows:
+				noKeyLeft++
+			default:
+				t.Errorf("ClaimOneTimeKey: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != keyCount || noKeyLeft != keyCount {
+		t.Errorf("ClaimOneTimeKey: claimed %d distinct keys with %d requests finding none, want %d and %d", len(claimed), noKeyLeft, keyCount, keyCount)
+	}
+	for keyID, count := range claimed {
+		if count != 1 {
+			t.Errorf("ClaimOneTimeKey: key %q was claimed %d times", keyID, count)
+		}
+	}
+}
+
+func TestSQLiteDeviceListStreamIDs(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	streamID, err := db.GetDeviceListStreamID("alice")
+	if err != nil || streamID != 0 {
+		t.Fatalf("GetDeviceListStreamID: got (%d, %v) before any update, want (0, nil)", streamID, err)
+	}
+
+	// The IDs of the updates of a user follow each other, starting at 1.
+	var previous int64
+	for i := 0; i < 3; i++ {
+		if streamID, err = db.NewDeviceListStreamID("alice"); err != nil {
+			t.Fatalf("NewDeviceListStreamID: %v", err)
+		}
+		if streamID != previous+1 {
+			t.Errorf("NewDeviceListStreamID: got %d after %d, want %d", streamID, previous, previous+1)
+		}
+		previous = streamID
+	}
+	if streamID, err = db.NewDeviceListStreamID("bob"); err != nil || streamID != 1 {
+		t.Errorf("NewDeviceListStreamID: got (%d, %v) for the first update of another user, want (1, nil)", streamID, err)
+	}
+	if streamID, err = db.GetDeviceListStreamID("alice"); err != nil || streamID != previous {
+		t.Errorf("GetDeviceListStreamID: got (%d, %v), want (%d, nil)", streamID, err, previous)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uia implements user-interactive authentication, which endpoints
+// performing sensitive operations use to make the user confirm their identity.
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#user-interactive-authentication-api
+package uia
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// AuthDict is the auth dictionary clients put in the body of their requests
+// to endpoints requiring user-interactive authentication.
+type AuthDict struct {
+	Type    authtypes.LoginType `json:"type"`
+	Session string              `json:"session"`
+	// Parameters of the m.login.password stage.
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Flow is a list of stages the client can complete to authenticate.
+type Flow struct {
+	Stages []authtypes.LoginType `json:"stages"`
+}
+
+// Response is the body of the 401 responses telling the client which stages
+// it can complete and which ones it already completed.
+type Response struct {
+	Flows     []Flow                 `json:"flows"`
+	Completed []authtypes.LoginType  `json:"completed"`
+	Params    map[string]interface{} `json:"params"`
+	Session   string                 `json:"session"`
+	// Set if the client failed to complete a stage.
+	ErrCode string `json:"errcode,omitempty"`
+	Err     string `json:"error,omitempty"`
+}
+
+// The flows clients can complete to authenticate.
+var flows = []Flow{
+	{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}},
+}
+
+// Sessions keeps track of the ongoing user-interactive authentication
+// sessions, for the given amount of time after they started.
+// It is safe to use from multiple goroutines.
+type Sessions struct {
+	accountDB *accounts.Database
+	timeout   time.Duration
+
+	mutex       sync.Mutex
+	sessions    map[string]*session
+	lastCleanup time.Time
+}
+
+type session struct {
+	// The ID of the user authenticating.
+	userID    string
+	completed []authtypes.LoginType
+	expires   time.Time
+}
+
+// NewSessions creates a new session store which checks passwords against the
+// given account database and forgets sessions after the given timeout.
+func NewSessions(accountDB *accounts.Database, timeout time.Duration) *Sessions {
+	return &Sessions{
+		accountDB: accountDB,
+		timeout:   timeout,
+		sessions:  make(map[string]*session),
+	}
+}
+
+// Verify runs the stage of user-interactive authentication given in the auth
+// dictionary of the request for the user with the given ID. authDict can be
+// nil if the request didn't include one.
+// Returns nil if the user completed one of the flows, in which case the
+// request can go ahead. Otherwise returns the response to send to the client,
+// which is a 401 telling them what to do next unless something went wrong.
+func (s *Sessions) Verify(req *http.Request, authDict *AuthDict, userID string) *util.JSONResponse {
+	now := time.Now()
+
+	if authDict == nil {
+		authDict = &AuthDict{}
+	}
+
+	s.mutex.Lock()
+	if now.Sub(s.lastCleanup) > s.timeout {
+		s.cleanup(now)
+	}
+	sessionID := authDict.Session
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.userID != userID || !now.Before(sess.expires) {
+		// Start a new session if the client didn't give a valid one.
+		var err error
+		if sessionID, err = auth.GenerateAccessToken(); err != nil {
+			s.mutex.Unlock()
+			resErr := httputil.LogThenError(req, err)
+			return &resErr
+		}
+		sess = &session{userID: userID, expires: now.Add(s.timeout)}
+		s.sessions[sessionID] = sess
+	}
+	s.mutex.Unlock()
+
+	switch authDict.Type {
+	case "":
+		// The client is asking which flows it can complete.
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.challenge(sessionID, sess, nil)
+	case authtypes.LoginTypePassword:
+		if err := s.checkPassword(authDict, userID); err != nil {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return s.challenge(sessionID, sess, err)
+		}
+	default:
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.Unknown("Unknown or unsupported auth type"),
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess.completed = append(sess.completed, authDict.Type)
+	if !hasCompletedFlow(sess.completed) {
+		return s.challenge(sessionID, sess, nil)
+	}
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+// checkPassword checks the password in the auth dictionary is the one of
+// the user with the given ID.
+func (s *Sessions) checkPassword(authDict *AuthDict, userID string) *jsonerror.MatrixError {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return jsonerror.Forbidden("Invalid user ID")
+	}
+	// The user can be given as a localpart or a full user ID, and must be the
+	// one authenticating.
+	if authDict.User != "" && authDict.User != localpart && authDict.User != userID {
+		return jsonerror.Forbidden("Cannot authenticate as another user")
+	}
+	acc, err := s.accountDB.GetAccountByPassword(localpart, authDict.Password)
+	if err != nil {
+		return jsonerror.Forbidden("Invalid password")
+	}
+	if acc.IsDeactivated {
+		return jsonerror.Deactivated("This account has been deactivated")
+	}
+	return nil
+}
+
+// challenge returns the 401 response telling the client which flows it can
+// complete, along with the error it hit if there was one.
+// The caller must hold the mutex.
+func (s *Sessions) challenge(sessionID string, sess *session, matrixErr *jsonerror.MatrixError) *util.JSONResponse {
+	res := Response{
+		Flows:     flows,
+		Completed: append([]authtypes.LoginType{}, sess.completed...),
+		Params:    make(map[string]interface{}),
+		Session:   sessionID,
+	}
+	if matrixErr != nil {
+		res.ErrCode = matrixErr.ErrCode
+		res.Err = matrixErr.Err
+	}
+	return &util.JSONResponse{
+		Code: 401,
+		JSON: res,
+	}
+}
+
+// hasCompletedFlow returns true if all the stages of one of the flows were
+// completed.
+func hasCompletedFlow(completed []authtypes.LoginType) bool {
+	done := make(map[authtypes.LoginType]bool)
+	for _, stage := range completed {
+		done[stage] = true
+	}
+	for _, flow := range flows {
+		complete := true
+		for _, stage := range flow.Stages {
+			if !done[stage] {
+				complete = false
+			}
+		}
+		if complete {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup removes the expired sessions.
+// The caller must hold the mutex.
+func (s *Sessions) cleanup(now time.Time) {
+	for id, sess := range s.sessions {
+		if !now.Before(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.lastCleanup = now
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uia
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+const testUserID = "@alice:localhost"
+
+func TestVerifyWithoutAuthStartsSession(t *testing.T) {
+	s := NewSessions(nil, time.Minute)
+	req := httptest.NewRequest("DELETE", "/devices/ABC", nil)
+
+	res := s.Verify(req, nil, testUserID)
+	if res == nil || res.Code != 401 {
+		t.Fatalf("want a 401 response, got %+v", res)
+	}
+	body := res.JSON.(Response)
+	if body.Session == "" {
+		t.Fatal("want a session ID in the response")
+	}
+	if len(body.Flows) == 0 || body.Flows[0].Stages[0] != authtypes.LoginTypePassword {
+		t.Fatalf("want an m.login.password flow, got %+v", body.Flows)
+	}
+
+	// Asking again with the same session keeps it.
+	res = s.Verify(req, &AuthDict{Session: body.Session}, testUserID)
+	if res == nil || res.JSON.(Response).Session != body.Session {
+		t.Fatalf("want session %q to be kept, got %+v", body.Session, res)
+	}
+
+	// Another user can't use the session.
+	res = s.Verify(req, &AuthDict{Session: body.Session}, "@bob:localhost")
+	if res == nil || res.JSON.(Response).Session == body.Session {
+		t.Fatalf("want a new session for another user, got %+v", res)
+	}
+}
+
+func TestVerifyRejectsOtherUser(t *testing.T) {
+	s := NewSessions(nil, time.Minute)
+	req := httptest.NewRequest("DELETE", "/devices/ABC", nil)
+
+	res := s.Verify(req, &AuthDict{
+		Type:     authtypes.LoginTypePassword,
+		User:     "bob",
+		Password: "hunter2",
+	}, testUserID)
+	if res == nil || res.Code != 401 {
+		t.Fatalf("want a 401 response, got %+v", res)
+	}
+	if errCode := res.JSON.(Response).ErrCode; errCode != "M_FORBIDDEN" {
+		t.Fatalf("want M_FORBIDDEN, got %q", errCode)
+	}
+}
+
+func TestVerifyRejectsUnknownAuthType(t *testing.T) {
+	s := NewSessions(nil, time.Minute)
+	req := httptest.NewRequest("DELETE", "/devices/ABC", nil)
+
+	res := s.Verify(req, &AuthDict{Type: "m.login.unknown"}, testUserID)
+	if res == nil || res.Code != 400 {
+		t.Fatalf("want a 400 response, got %+v", res)
+	}
+}
@@ -15,9 +15,11 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/push"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -32,6 +34,7 @@ type OutputRoomEvent struct {
 	roomServerConsumer *common.ContinualConsumer
 	db                 *accounts.Database
 	query              api.RoomserverQueryAPI
+	pushNotifier       *push.Notifier
 	serverName         string
 }
 
@@ -52,6 +55,7 @@ func NewOutputRoomEvent(
 		roomServerConsumer: &consumer,
 		db:                 store,
 		query:              queryAPI,
+		pushNotifier:       push.NewNotifier(store, queryAPI, cfg.Matrix.ServerName),
 		serverName:         string(cfg.Matrix.ServerName),
 	}
 	consumer.ProcessMessage = s.onMessage
@@ -99,6 +103,14 @@ func (s *OutputRoomEvent) onMessage(msg *sarama.ConsumerMessage) error {
 		return err
 	}
 
+	// Failing to send push notifications shouldn't stop us from processing
+	// the next events.
+	if err := s.pushNotifier.OnNewEvent(context.Background(), ev); err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Error(
+			"roomserver output log: failed to evaluate push rules",
+		)
+	}
+
 	return nil
 }
 
@@ -137,7 +149,7 @@ func (s *OutputRoomEvent) lookupStateEvents(
 	// Request the missing events from the roomserver
 	eventReq := api.QueryEventsByIDRequest{EventIDs: missing}
 	var eventResp api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(&eventReq, &eventResp); err != nil {
+	if err := s.query.QueryEventsByID(context.Background(), &eventReq, &eventResp); err != nil {
 		return nil, err
 	}
 
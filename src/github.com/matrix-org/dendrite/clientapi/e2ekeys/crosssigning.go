@@ -0,0 +1,171 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2ekeys
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The types of cross-signing keys.
+const (
+	// MasterKey signs the other cross-signing keys of the user.
+	MasterKey = "master"
+	// SelfSigningKey signs the devices of the user.
+	SelfSigningKey = "self_signing"
+	// UserSigningKey signs the master keys of other users. Only the user who
+	// owns it can see it.
+	UserSigningKey = "user_signing"
+)
+
+// crossSigningKey is the part of a cross-signing key checked on upload.
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-keys-device-signing-upload
+type crossSigningKey struct {
+	UserID string            `json:"user_id"`
+	Usage  []string          `json:"usage"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// InvalidCrossSigningKeyError is returned when a cross-signing key is
+// malformed or doesn't belong to the user uploading it.
+type InvalidCrossSigningKeyError struct {
+	msg string
+}
+
+func (e InvalidCrossSigningKeyError) Error() string { return e.msg }
+
+// InvalidCrossSigningSignatureError is returned when a self-signing or
+// user-signing key isn't signed by the master key of the user.
+type InvalidCrossSigningSignatureError struct {
+	keyType string
+}
+
+func (e InvalidCrossSigningSignatureError) Error() string {
+	return fmt.Sprintf("the %s key isn't signed by the master key", e.keyType)
+}
+
+// CheckCrossSigningKeys checks that the cross-signing keys uploaded by a user,
+// mapped by key type, are consistent: each key must belong to the user, be
+// usable for its type and hold a single ed25519 public key, and the
+// self-signing and user-signing keys must be signed by the master key. The
+// master key is the uploaded one, or the current master key of the user if
+// none was uploaded, which may be nil.
+// Returns an InvalidCrossSigningKeyError or an
+// InvalidCrossSigningSignatureError if the keys are not consistent.
+func CheckCrossSigningKeys(
+	userID string, keys map[string]json.RawMessage, currentMasterKey json.RawMessage,
+) error {
+	publicKeys := make(map[string]ed25519.PublicKey, len(keys))
+	keyIDs := make(map[string]gomatrixserverlib.KeyID, len(keys))
+	for keyType, keyJSON := range keys {
+		switch keyType {
+		case MasterKey, SelfSigningKey, UserSigningKey:
+		default:
+			return InvalidCrossSigningKeyError{fmt.Sprintf("unknown key type %q", keyType)}
+		}
+		keyID, publicKey, err := parseCrossSigningKey(userID, keyType, keyJSON)
+		if err != nil {
+			return err
+		}
+		keyIDs[keyType], publicKeys[keyType] = keyID, publicKey
+	}
+
+	masterKeyID, masterPublicKey := keyIDs[MasterKey], publicKeys[MasterKey]
+	if _, ok := keys[MasterKey]; !ok && currentMasterKey != nil {
+		var err error
+		masterKeyID, masterPublicKey, err = parseCrossSigningKey(userID, MasterKey, currentMasterKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, keyType := range []string{SelfSigningKey, UserSigningKey} {
+		keyJSON, ok := keys[keyType]
+		if !ok {
+			continue
+		}
+		if masterPublicKey == nil {
+			return InvalidCrossSigningKeyError{"a master key must be uploaded first"}
+		}
+		if err := gomatrixserverlib.VerifyJSON(userID, masterKeyID, masterPublicKey, keyJSON); err != nil {
+			return InvalidCrossSigningSignatureError{keyType}
+		}
+	}
+	return nil
+}
+
+// parseCrossSigningKey checks that a cross-signing key of the given type
+// belongs to the user and returns its ID and public key.
+func parseCrossSigningKey(
+	userID, keyType string, keyJSON json.RawMessage,
+) (gomatrixserverlib.KeyID, ed25519.PublicKey, error) {
+	var key crossSigningKey
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return "", nil, InvalidCrossSigningKeyError{fmt.Sprintf("the %s key is malformed: %s", keyType, err)}
+	}
+	if key.UserID != userID {
+		return "", nil, InvalidCrossSigningKeyError{fmt.Sprintf("the %s key belongs to another user", keyType)}
+	}
+	usable := false
+	for _, usage := range key.Usage {
+		if usage == keyType {
+			usable = true
+		}
+	}
+	if !usable {
+		return "", nil, InvalidCrossSigningKeyError{fmt.Sprintf("the %s key can't be used as such", keyType)}
+	}
+	if len(key.Keys) != 1 {
+		return "", nil, InvalidCrossSigningKeyError{fmt.Sprintf("the %s key must hold exactly one key", keyType)}
+	}
+	for keyID, encoded := range key.Keys {
+		publicKey, err := base64.RawStdEncoding.DecodeString(encoded)
+		if !strings.HasPrefix(keyID, "ed25519:") || err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return "", nil, InvalidCrossSigningKeyError{fmt.Sprintf("the %s key must be an ed25519 key", keyType)}
+		}
+		return gomatrixserverlib.KeyID(keyID), ed25519.PublicKey(publicKey), nil
+	}
+	return "", nil, nil
+}
+
+// QueryCrossSigningKeys returns the cross-signing keys of the local user with
+// the given ID, mapped by key type. The user-signing key is only included if
+// includeUserSigning is true, i.e. if the user is the one asking for it.
+func QueryCrossSigningKeys(
+	accountDB *accounts.Database, userID string, includeUserSigning bool,
+) (map[string]json.RawMessage, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := accountDB.GetCrossSigningKeys(localpart)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]json.RawMessage, len(keys))
+	for keyType, keyJSON := range keys {
+		if keyType == UserSigningKey && !includeUserSigning {
+			continue
+		}
+		result[keyType] = keyJSON
+	}
+	return result, nil
+}
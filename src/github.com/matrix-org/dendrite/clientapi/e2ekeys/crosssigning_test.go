@@ -0,0 +1,126 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2ekeys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testUserID = "@alice:localhost"
+
+type testKey struct {
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+}
+
+func newTestKey(t *testing.T) testKey {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawStdEncoding.EncodeToString(publicKey)
+	return testKey{gomatrixserverlib.KeyID("ed25519:" + encoded), privateKey}
+}
+
+// keyJSON returns the cross-signing key of the given type holding the public
+// part of k, signed by signer if it isn't nil.
+func (k testKey) keyJSON(t *testing.T, userID, keyType string, signer *testKey) json.RawMessage {
+	encoded := string(k.keyID[len("ed25519:"):])
+	keyJSON, err := json.Marshal(crossSigningKey{
+		UserID: userID,
+		Usage:  []string{keyType},
+		Keys:   map[string]string{string(k.keyID): encoded},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != nil {
+		keyJSON, err = gomatrixserverlib.SignJSON(userID, signer.keyID, signer.privateKey, keyJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyJSON
+}
+
+func TestCheckCrossSigningKeys(t *testing.T) {
+	master, selfSigning, other := newTestKey(t), newTestKey(t), newTestKey(t)
+	currentMaster := master.keyJSON(t, testUserID, MasterKey, nil)
+
+	tests := []struct {
+		name          string
+		keys          map[string]json.RawMessage
+		currentMaster json.RawMessage
+		wantErr       error
+	}{{
+		name: "master and self-signing keys",
+		keys: map[string]json.RawMessage{
+			MasterKey:      master.keyJSON(t, testUserID, MasterKey, nil),
+			SelfSigningKey: selfSigning.keyJSON(t, testUserID, SelfSigningKey, &master),
+		},
+	}, {
+		name: "self-signing key signed by the current master key",
+		keys: map[string]json.RawMessage{
+			SelfSigningKey: selfSigning.keyJSON(t, testUserID, SelfSigningKey, &master),
+		},
+		currentMaster: currentMaster,
+	}, {
+		name: "self-signing key signed by another key",
+		keys: map[string]json.RawMessage{
+			MasterKey:      master.keyJSON(t, testUserID, MasterKey, nil),
+			SelfSigningKey: selfSigning.keyJSON(t, testUserID, SelfSigningKey, &other),
+		},
+		wantErr: InvalidCrossSigningSignatureError{SelfSigningKey},
+	}, {
+		name: "user-signing key signed by a replaced master key",
+		keys: map[string]json.RawMessage{
+			MasterKey:      other.keyJSON(t, testUserID, MasterKey, nil),
+			UserSigningKey: selfSigning.keyJSON(t, testUserID, UserSigningKey, &master),
+		},
+		currentMaster: currentMaster,
+		wantErr:       InvalidCrossSigningSignatureError{UserSigningKey},
+	}, {
+		name: "self-signing key without a master key",
+		keys: map[string]json.RawMessage{
+			SelfSigningKey: selfSigning.keyJSON(t, testUserID, SelfSigningKey, &master),
+		},
+		wantErr: InvalidCrossSigningKeyError{"a master key must be uploaded first"},
+	}, {
+		name: "master key of another user",
+		keys: map[string]json.RawMessage{
+			MasterKey: master.keyJSON(t, "@bob:localhost", MasterKey, nil),
+		},
+		wantErr: InvalidCrossSigningKeyError{"the master key belongs to another user"},
+	}, {
+		name: "key used for another type",
+		keys: map[string]json.RawMessage{
+			MasterKey: master.keyJSON(t, testUserID, SelfSigningKey, nil),
+		},
+		wantErr: InvalidCrossSigningKeyError{"the master key can't be used as such"},
+	}}
+
+	for _, tt := range tests {
+		err := CheckCrossSigningKeys(testUserID, tt.keys, tt.currentMaster)
+		if err != tt.wantErr {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package e2ekeys looks up and claims the end-to-end encryption keys of the
+// devices of local users, for both local clients and remote servers.
+package e2ekeys
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// QueryDeviceKeys returns the identity keys of the devices with the given IDs
+// belonging to the local user with the given ID, or of all their devices if
+// no ID is given, mapped by device ID. The display name of each device is
+// added to the unsigned section of its keys. Devices which haven't uploaded
+// keys are missing from the result.
+func QueryDeviceKeys(
+	deviceDB *devices.Database, userID string, deviceIDs []string,
+) (map[string]json.RawMessage, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := deviceDB.GetDeviceKeys(localpart)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(localpart)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		wanted[deviceID] = true
+	}
+	result := make(map[string]json.RawMessage)
+	for _, dev := range devs {
+		keyJSON, ok := keys[dev.ID]
+		if !ok || (len(wanted) > 0 && !wanted[dev.ID]) {
+			continue
+		}
+		var deviceKeys map[string]json.RawMessage
+		if err = json.Unmarshal(keyJSON, &deviceKeys); err != nil {
+			return nil, err
+		}
+		if dev.DisplayName != "" {
+			unsigned, err := json.Marshal(map[string]string{"device_display_name": dev.DisplayName})
+			if err != nil {
+				return nil, err
+			}
+			deviceKeys["unsigned"] = unsigned
+		}
+		if result[dev.ID], err = json.Marshal(deviceKeys); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ClaimOneTimeKeys claims a one-time key of the given algorithm for each of
+// the given devices of the local user with the given ID. The keys are mapped
+// by device ID then "<algorithm>:<key_id>". Devices without keys left for the
+// algorithm are missing from the result.
+func ClaimOneTimeKeys(
+	deviceDB *devices.Database, userID string, algorithms map[string]string,
+) (map[string]map[string]json.RawMessage, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]json.RawMessage)
+	for deviceID, algorithm := range algorithms {
+		keyID, keyJSON, err := deviceDB.ClaimOneTimeKey(localpart, deviceID, algorithm)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[deviceID] = map[string]json.RawMessage{keyID: keyJSON}
+	}
+	return result, nil
+}
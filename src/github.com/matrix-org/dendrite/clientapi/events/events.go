@@ -15,15 +15,15 @@
 package events
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 
 	"github.com/matrix-org/gomatrixserverlib"
-	"github.com/matrix-org/util"
 )
 
 // ErrRoomNoExists is returned when trying to lookup the state of a room that
@@ -31,19 +31,58 @@ import (
 var ErrRoomNoExists = errors.New("Room does not exist")
 
 // BuildEvent builds a Matrix event using the event builder and roomserver query
-// API client provided. If also fills roomserver query API response (if provided)
-// in case the function calling FillBuilder needs to use it.
+// API client provided, in the format given by the version of the room. If also
+// fills roomserver query API response (if provided) in case the function calling
+// FillBuilder needs to use it.
 // Returns ErrRoomNoExists if the state of the room could not be retrieved because
 // the room doesn't exist
+// Returns a common.UnsupportedRoomVersionError if this server doesn't support
+// the version of the room.
+// Returns a common.EventTooLargeError if the event is larger than the server
+// allows.
 // Returns an error if something else went wrong
 func BuildEvent(
+	ctx context.Context,
 	builder *gomatrixserverlib.EventBuilder, cfg config.Dendrite,
 	queryAPI api.RoomserverQueryAPI, queryRes *api.QueryLatestEventsAndStateResponse,
 ) (*gomatrixserverlib.Event, error) {
-	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if queryRes == nil {
+		queryRes = &api.QueryLatestEventsAndStateResponse{}
+	}
+	if err := FillBuilder(ctx, builder, queryAPI, queryRes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	event, err := common.BuildEvent(
+		builder, queryRes.RoomVersion, now, cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+	)
 	if err != nil {
 		return nil, err
 	}
+	if err = common.CheckEventSize(event, cfg.Matrix.MaxEventSizeBytes); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// FillBuilder fills the depth, prev_events and auth_events of the event
+// builder using the roomserver query API client provided. It also fills the
+// roomserver query API response (if provided) in case the caller needs to use
+// it.
+// Returns ErrRoomNoExists if the state of the room could not be retrieved because
+// the room doesn't exist
+// Returns an error if something else went wrong
+func FillBuilder(
+	ctx context.Context,
+	builder *gomatrixserverlib.EventBuilder,
+	queryAPI api.RoomserverQueryAPI, queryRes *api.QueryLatestEventsAndStateResponse,
+) error {
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil {
+		return err
+	}
 
 	// Ask the roomserver for information about this room
 	queryReq := api.QueryLatestEventsAndStateRequest{
@@ -53,12 +92,12 @@ func BuildEvent(
 	if queryRes == nil {
 		queryRes = &api.QueryLatestEventsAndStateResponse{}
 	}
-	if queryErr := queryAPI.QueryLatestEventsAndState(&queryReq, queryRes); queryErr != nil {
-		return nil, err
+	if queryErr := queryAPI.QueryLatestEventsAndState(ctx, &queryReq, queryRes); queryErr != nil {
+		return queryErr
 	}
 
 	if !queryRes.RoomExists {
-		return nil, ErrRoomNoExists
+		return ErrRoomNoExists
 	}
 
 	builder.Depth = queryRes.Depth
@@ -72,16 +111,9 @@ func BuildEvent(
 
 	refs, err := eventsNeeded.AuthEventReferences(&authEvents)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	builder.AuthEvents = refs
 
-	eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	now := time.Now()
-	event, err := builder.Build(eventID, now, cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey)
-	if err != nil {
-		return nil, err
-	}
-
-	return &event, nil
+	return nil
 }
@@ -0,0 +1,78 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// fakeQueryAPI answers QueryLatestEventsAndState as if the room existed and
+// was empty. Calling any other method panics.
+type fakeQueryAPI struct {
+	api.RoomserverQueryAPI
+}
+
+func (fakeQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	request *api.QueryLatestEventsAndStateRequest,
+	response *api.QueryLatestEventsAndStateResponse,
+) error {
+	response.RoomExists = true
+	response.RoomVersion = "1"
+	return nil
+}
+
+func TestBuildEventTooLarge(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg config.Dendrite
+	cfg.Matrix.ServerName = "localhost"
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = privateKey
+	cfg.Matrix.MaxEventSizeBytes = 1000
+
+	build := func(body string) error {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:localhost",
+			RoomID: "!test:localhost",
+			Type:   "m.room.message",
+		}
+		if err := builder.SetContent(map[string]string{"msgtype": "m.text", "body": body}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := BuildEvent(context.Background(), &builder, cfg, fakeQueryAPI{}, nil)
+		return err
+	}
+
+	if err := build("hello"); err != nil {
+		t.Errorf("building a small event: wanted no error, got %v", err)
+	}
+	if err := build(strings.Repeat("a", 1000)); err == nil {
+		t.Error("building a large event: wanted an error, got none")
+	} else if _, ok := err.(common.EventTooLargeError); !ok {
+		t.Errorf("building a large event: wanted an EventTooLargeError, got %v", err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/util"
 )
 
@@ -42,6 +43,6 @@ func UnmarshalJSONRequest(req *http.Request, iface interface{}) *util.JSONRespon
 // This should be used to log fatal errors which require investigation. It should not be used
 // to log client validation errors, etc.
 func LogThenError(req *http.Request, err error) util.JSONResponse {
-	util.GetLogger(req.Context()).WithError(err).Error("request failed")
+	common.GetLogger(req.Context()).WithError(err).Error("request failed")
 	return jsonerror.InternalServerError()
 }
@@ -85,12 +85,91 @@ func WeakPassword(msg string) *MatrixError {
 	return &MatrixError{"M_WEAK_PASSWORD", msg}
 }
 
+// Deactivated is an error which is returned when the client tries to
+// authenticate as a user whose account has been deactivated.
+func Deactivated(msg string) *MatrixError {
+	return &MatrixError{"M_DEACTIVATED", msg}
+}
+
+// UserInUse is an error which is returned when the client tries to register
+// a username which is already taken.
+func UserInUse(msg string) *MatrixError {
+	return &MatrixError{"M_USER_IN_USE", msg}
+}
+
+// Exclusive is an error returned when a user or room alias is in the
+// exclusive namespace of an application service.
+func Exclusive(msg string) *MatrixError {
+	return &MatrixError{"M_EXCLUSIVE", msg}
+}
+
+// InvalidUsername is an error which is returned when the client tries to
+// register a username containing characters which aren't allowed.
+func InvalidUsername(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_USERNAME", msg}
+}
+
 // GuestAccessForbidden is an error which is returned when the client is
 // forbidden from accessing a resource as a guest.
 func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// RoomInUse is an error which is returned when the client tries to create a
+// room alias that is already in use.
+func RoomInUse(msg string) *MatrixError {
+	return &MatrixError{"M_ROOM_IN_USE", msg}
+}
+
+// InvalidArgumentValue is an error which is returned when the client tries to
+// send an invalid value for a parameter.
+func InvalidArgumentValue(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
+}
+
+// MissingArgument is an error which is returned when the client doesn't send
+// a parameter that is required.
+func MissingArgument(msg string) *MatrixError {
+	return &MatrixError{"M_MISSING_PARAM", msg}
+}
+
+// UnsupportedRoomVersion is an error which is returned when the client tries to
+// create a room with a version the server doesn't support.
+func UnsupportedRoomVersion(msg string) *MatrixError {
+	return &MatrixError{"M_UNSUPPORTED_ROOM_VERSION", msg}
+}
+
+// TooLarge is an error which is returned when the client sends an event or
+// a request body which is larger than the server allows.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
+// InvalidSignature is an error which is returned when the client uploads keys
+// whose signatures don't match the keys that should have signed them.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
+// IncompatibleRoomVersionError is an error which is returned when a remote
+// server tries to join a room with a version it doesn't support.
+type IncompatibleRoomVersionError struct {
+	MatrixError
+	RoomVersion string `json:"room_version"`
+}
+
+// IncompatibleRoomVersion is an error when a remote server tries to join a
+// room with a version it doesn't support.
+func IncompatibleRoomVersion(roomVersion string) *IncompatibleRoomVersionError {
+	return &IncompatibleRoomVersionError{
+		MatrixError: MatrixError{
+			"M_INCOMPATIBLE_ROOM_VERSION",
+			"Your server doesn't support version " + roomVersion + " of this room",
+		},
+		RoomVersion: roomVersion,
+	}
+}
+
 // LimitExceededError is a rate-limiting error.
 type LimitExceededError struct {
 	MatrixError
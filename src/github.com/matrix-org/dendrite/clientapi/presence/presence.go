@@ -0,0 +1,145 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package presence stores the presence of local users and tells the other
+// components about it, marking users as offline once they have been idle for
+// too long.
+package presence
+
+import (
+	"database/sql"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SetPresence stores the presence of a local user and sends it to the sync
+// API and federation sender servers.
+func SetPresence(
+	accountDB *accounts.Database, presenceProducer *producers.PresenceProducer,
+	presence authtypes.Presence,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', presence.UserID)
+	if err != nil {
+		return err
+	}
+	streamPos, err := accountDB.SetPresence(presence)
+	if err != nil {
+		return err
+	}
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return err
+	}
+	roomIDs := make([]string, len(memberships))
+	for i, m := range memberships {
+		roomIDs[i] = m.RoomID
+	}
+	return presenceProducer.SendPresence(presence, streamPos, roomIDs)
+}
+
+// SetRemotePresence stores the presence of a remote user received over
+// federation and sends it to the sync API server. The presence isn't sent to
+// any other server, since the server of the user already did.
+func SetRemotePresence(
+	accountDB *accounts.Database, presenceProducer *producers.PresenceProducer,
+	presence authtypes.Presence,
+) error {
+	streamPos, err := accountDB.SetPresence(presence)
+	if err != nil {
+		return err
+	}
+	return presenceProducer.SendPresence(presence, streamPos, nil)
+}
+
+// SetPresenceFromSync records that a local user synced with the given
+// set_presence parameter, which is one of PresenceOnline, PresenceUnavailable
+// or PresenceOffline. Syncing makes the user active. Their presence is only
+// sent to the other components if it changed, so that syncing again doesn't
+// wake up the other users. Syncing with PresenceOffline leaves the user as
+// they were.
+func SetPresenceFromSync(
+	accountDB *accounts.Database, presenceProducer *producers.PresenceProducer,
+	userID, setPresence string, now time.Time,
+) error {
+	if setPresence == authtypes.PresenceOffline {
+		return nil
+	}
+	presence := authtypes.Presence{
+		UserID:       userID,
+		Presence:     setPresence,
+		LastActiveTS: gomatrixserverlib.AsTimestamp(now),
+	}
+	current, err := accountDB.GetPresence(userID)
+	if err == nil {
+		if current.Presence == setPresence {
+			return accountDB.SetLastActive(userID, presence.LastActiveTS)
+		}
+		presence.StatusMsg = current.StatusMsg
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	return SetPresence(accountDB, presenceProducer, presence)
+}
+
+// An IdleTimer periodically marks the local users who haven't been active for
+// a given amount of time as offline.
+type IdleTimer struct {
+	accountDB        *accounts.Database
+	presenceProducer *producers.PresenceProducer
+	timeout          time.Duration
+}
+
+// NewIdleTimer creates a new IdleTimer marking users as offline after the
+// given timeout. Call Start() to start checking for idle users.
+func NewIdleTimer(
+	accountDB *accounts.Database, presenceProducer *producers.PresenceProducer,
+	timeout time.Duration,
+) *IdleTimer {
+	return &IdleTimer{accountDB, presenceProducer, timeout}
+}
+
+// Start checking for idle users in a new goroutine. Users are checked about
+// ten times per timeout, so they go offline soon after it expires.
+func (t *IdleTimer) Start() {
+	go func() {
+		ticker := time.NewTicker(t.timeout / 10)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := t.markIdleUsersOffline(time.Now()); err != nil {
+				log.WithError(err).Warn("Failed to mark idle users as offline")
+			}
+		}
+	}()
+}
+
+func (t *IdleTimer) markIdleUsersOffline(now time.Time) error {
+	idle, err := t.accountDB.GetIdlePresences(gomatrixserverlib.AsTimestamp(now.Add(-t.timeout)))
+	if err != nil {
+		return err
+	}
+	for _, presence := range idle {
+		// Keep the time the user was last active so that other users can see
+		// how long they have been gone for.
+		presence.Presence = authtypes.PresenceOffline
+		if err := SetPresence(t.accountDB, t.presenceProducer, presence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
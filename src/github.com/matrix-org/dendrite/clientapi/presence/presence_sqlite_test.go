@@ -0,0 +1,93 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package presence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// countingProducer counts the messages sent through it.
+type countingProducer struct {
+	sarama.SyncProducer
+	sent int
+}
+
+func (p *countingProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent++
+	return 0, int64(p.sent), nil
+}
+
+func TestSetPresenceFromSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), "localhost")
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	kafka := &countingProducer{}
+	producer := &producers.PresenceProducer{Producer: kafka}
+
+	start := time.Now().Add(-time.Minute)
+	for i, test := range []struct {
+		setPresence  string
+		wantPresence string
+		wantSent     int
+	}{
+		// The first sync makes the user online.
+		{authtypes.PresenceOnline, authtypes.PresenceOnline, 1},
+		// Syncing again only makes them active.
+		{authtypes.PresenceOnline, authtypes.PresenceOnline, 1},
+		// Syncing as offline leaves them as they were.
+		{authtypes.PresenceOffline, authtypes.PresenceOnline, 1},
+		{authtypes.PresenceUnavailable, authtypes.PresenceUnavailable, 2},
+	} {
+		now := start.Add(time.Duration(i) * time.Second)
+		if err = SetPresenceFromSync(accountDB, producer, "@alice:localhost", test.setPresence, now); err != nil {
+			t.Fatalf("SetPresenceFromSync: %v", err)
+		}
+		presence, err := accountDB.GetPresence("@alice:localhost")
+		if err != nil {
+			t.Fatalf("GetPresence: %v", err)
+		}
+		if presence.Presence != test.wantPresence {
+			t.Errorf("sync %d: got presence %q, want %q", i, presence.Presence, test.wantPresence)
+		}
+		if kafka.sent != test.wantSent {
+			t.Errorf("sync %d: got %d presence updates sent, want %d", i, kafka.sent, test.wantSent)
+		}
+		wantActive := now
+		if test.setPresence == authtypes.PresenceOffline {
+			wantActive = now.Add(-time.Second)
+		}
+		if got := presence.LastActiveTS.Time(); got.Unix() != wantActive.Unix() {
+			t.Errorf("sync %d: got last active %v, want %v", i, got, wantActive)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// DeviceListProducer produces device list updates for the federation sender server to consume
+type DeviceListProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendDeviceListUpdate sends a change to the device of a user joined to the
+// given rooms. If deleted is true, the device was deleted. keys is the new
+// identity keys of the device, or nil if they didn't change. streamID is the
+// ID of the update in the device list stream of the user.
+func (p *DeviceListProducer) SendDeviceListUpdate(
+	device authtypes.Device, deleted bool, keys json.RawMessage, streamID int64, roomIDs []string,
+) error {
+	var m sarama.ProducerMessage
+
+	data := common.DeviceListUpdate{
+		UserID:            device.UserID,
+		DeviceID:          device.ID,
+		DeviceDisplayName: device.DisplayName,
+		Deleted:           deleted,
+		Keys:              keys,
+		StreamID:          streamID,
+		RoomIDs:           roomIDs,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(device.UserID)
+	m.Value = sarama.ByteEncoder(value)
+
+	if _, _, err := p.Producer.SendMessage(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendSigningKeyUpdate sends a change to the cross-signing keys of a user
+// joined to the given rooms. masterKey and selfSigningKey are the new keys, or
+// nil if they didn't change.
+func (p *DeviceListProducer) SendSigningKeyUpdate(
+	userID string, masterKey, selfSigningKey json.RawMessage, roomIDs []string,
+) error {
+	var m sarama.ProducerMessage
+
+	data := common.DeviceListUpdate{
+		UserID:         userID,
+		MasterKey:      masterKey,
+		SelfSigningKey: selfSigningKey,
+		RoomIDs:        roomIDs,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(userID)
+	m.Value = sarama.ByteEncoder(value)
+
+	if _, _, err := p.Producer.SendMessage(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
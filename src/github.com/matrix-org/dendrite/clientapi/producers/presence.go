@@ -0,0 +1,61 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// PresenceProducer produces presence updates for the sync API and federation sender servers to consume
+type PresenceProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendPresence sends a presence stored at the given position in the presence
+// stream of the account database, for a user joined to the given rooms.
+func (p *PresenceProducer) SendPresence(
+	presence authtypes.Presence, streamPos int64, roomIDs []string,
+) error {
+	var m sarama.ProducerMessage
+
+	data := common.PresenceEvent{
+		UserID:         presence.UserID,
+		Presence:       presence.Presence,
+		StatusMsg:      presence.StatusMsg,
+		LastActiveTS:   int64(presence.LastActiveTS),
+		StreamPosition: streamPos,
+		RoomIDs:        roomIDs,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(presence.UserID)
+	m.Value = sarama.ByteEncoder(value)
+
+	if _, _, err := p.Producer.SendMessage(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// ReceiptProducer produces receipts for the sync API and federation sender servers to consume
+type ReceiptProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendReceipt sends a receipt stored at the given position in the receipts
+// stream of the room server
+func (p *ReceiptProducer) SendReceipt(receipt api.Receipt, streamPos int64) error {
+	var m sarama.ProducerMessage
+
+	data := common.ReceiptEvent{
+		RoomID:         receipt.RoomID,
+		UserID:         receipt.UserID,
+		Type:           receipt.Type,
+		EventID:        receipt.EventID,
+		Timestamp:      int64(receipt.Timestamp),
+		StreamPosition: streamPos,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(receipt.RoomID)
+	m.Value = sarama.ByteEncoder(value)
+
+	if _, _, err := p.Producer.SendMessage(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producers
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// TypingProducer produces typing notifications for the sync API server to consume
+type TypingProducer struct {
+	Topic    string
+	Producer sarama.SyncProducer
+}
+
+// SendTyping sends a change in whether the user is typing in the room to the
+// sync API server. timeoutMS is only used if typing is true.
+func (p *TypingProducer) SendTyping(userID, roomID string, typing bool, timeoutMS int64) error {
+	var m sarama.ProducerMessage
+
+	data := common.TypingEvent{
+		RoomID:  roomID,
+		UserID:  userID,
+		Typing:  typing,
+		Timeout: timeoutMS,
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	m.Topic = string(p.Topic)
+	m.Key = sarama.StringEncoder(roomID)
+	m.Value = sarama.ByteEncoder(value)
+
+	if _, _, err := p.Producer.SendMessage(&m); err != nil {
+		return err
+	}
+
+	return nil
+}
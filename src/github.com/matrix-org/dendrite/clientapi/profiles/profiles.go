@@ -0,0 +1,100 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiles provides a cache for the profiles of users on remote servers.
+package profiles
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Cache looks up the profiles of users on remote servers over federation
+// and keeps them for a given amount of time, so that repeated lookups for
+// the same user don't result in a request to the remote server every time.
+// It is safe to use from multiple goroutines.
+type Cache struct {
+	federation *federationclient.Client
+	ttl        time.Duration
+
+	mutex       sync.Mutex
+	profiles    map[string]cachedProfile
+	lastCleanup time.Time
+}
+
+type cachedProfile struct {
+	profile authtypes.Profile
+	expires time.Time
+}
+
+// NewCache creates a new remote profile cache which uses the given federation
+// client to query remote servers and keeps the profiles for the given TTL.
+func NewCache(federation *federationclient.Client, ttl time.Duration) *Cache {
+	return &Cache{
+		federation: federation,
+		ttl:        ttl,
+		profiles:   make(map[string]cachedProfile),
+	}
+}
+
+// GetProfile returns the profile of the user with the given ID, who must be on
+// the given remote server. The profile is taken from the cache if it's there
+// and hasn't expired, otherwise it is requested from the remote server.
+// If the remote server doesn't know about the user, returns the
+// gomatrix.HTTPError the remote server responded with.
+func (c *Cache) GetProfile(userID string, serverName gomatrixserverlib.ServerName) (*authtypes.Profile, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	cached, ok := c.profiles[userID]
+	c.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		profile := cached.profile
+		return &profile, nil
+	}
+
+	res, err := c.federation.LookupProfile(serverName, userID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	profile := authtypes.Profile{
+		DisplayName: res.DisplayName,
+		AvatarURL:   res.AvatarURL,
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.Sub(c.lastCleanup) > c.ttl {
+		c.cleanup(now)
+	}
+	c.profiles[userID] = cachedProfile{profile: profile, expires: now.Add(c.ttl)}
+
+	return &profile, nil
+}
+
+// cleanup removes the expired profiles from the cache.
+// The caller must hold the mutex.
+func (c *Cache) cleanup(now time.Time) {
+	for userID, cached := range c.profiles {
+		if !now.Before(cached.expires) {
+			delete(c.profiles, userID)
+		}
+	}
+	c.lastCleanup = now
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+// DefaultRuleset returns the server default push rules of the user with the
+// given ID and localpart, as specified in
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#predefined-rules
+func DefaultRuleset(userID, localpart string) Ruleset {
+	return Ruleset{
+		Override: []Rule{
+			{
+				RuleID:     ".m.rule.master",
+				Default:    true,
+				Enabled:    false,
+				Conditions: []Condition{},
+				Actions:    []interface{}{ActionDontNotify},
+			},
+			{
+				RuleID:  ".m.rule.suppress_notices",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "content.msgtype", Pattern: "m.notice"},
+				},
+				Actions: []interface{}{ActionDontNotify},
+			},
+			{
+				RuleID:  ".m.rule.invite_for_me",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.member"},
+					{Kind: ConditionEventMatch, Key: "content.membership", Pattern: "invite"},
+					{Kind: ConditionEventMatch, Key: "state_key", Pattern: userID},
+				},
+				Actions: []interface{}{ActionNotify, soundTweak("default"), highlightTweak(false)},
+			},
+			{
+				RuleID:  ".m.rule.member_event",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.member"},
+				},
+				Actions: []interface{}{ActionDontNotify},
+			},
+			{
+				RuleID:  ".m.rule.contains_display_name",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionContainsDisplayName},
+				},
+				Actions: []interface{}{ActionNotify, soundTweak("default"), highlightTweak(true)},
+			},
+			{
+				RuleID:  ".m.rule.roomnotif",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "content.body", Pattern: "@room"},
+					{Kind: ConditionSenderNotificationPermission, Key: "room"},
+				},
+				Actions: []interface{}{ActionNotify, highlightTweak(true)},
+			},
+		},
+		Content: []Rule{
+			{
+				RuleID:  ".m.rule.contains_user_name",
+				Default: true,
+				Enabled: true,
+				Pattern: localpart,
+				Actions: []interface{}{ActionNotify, soundTweak("default"), highlightTweak(true)},
+			},
+		},
+		Room:   []Rule{},
+		Sender: []Rule{},
+		Underride: []Rule{
+			{
+				RuleID:  ".m.rule.call",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.call.invite"},
+				},
+				Actions: []interface{}{ActionNotify, soundTweak("ring"), highlightTweak(false)},
+			},
+			{
+				RuleID:  ".m.rule.encrypted_room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionRoomMemberCount, Is: "2"},
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.encrypted"},
+				},
+				Actions: []interface{}{ActionNotify, soundTweak("default"), highlightTweak(false)},
+			},
+			{
+				RuleID:  ".m.rule.room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionRoomMemberCount, Is: "2"},
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.message"},
+				},
+				Actions: []interface{}{ActionNotify, soundTweak("default"), highlightTweak(false)},
+			},
+			{
+				RuleID:  ".m.rule.message",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.message"},
+				},
+				Actions: []interface{}{ActionNotify, highlightTweak(false)},
+			},
+			{
+				RuleID:  ".m.rule.encrypted",
+				Default: true,
+				Enabled: true,
+				Conditions: []Condition{
+					{Kind: ConditionEventMatch, Key: "type", Pattern: "m.room.encrypted"},
+				},
+				Actions: []interface{}{ActionNotify, highlightTweak(false)},
+			},
+		},
+	}
+}
+
+func soundTweak(sound string) map[string]interface{} {
+	return map[string]interface{}{"set_tweak": "sound", "value": sound}
+}
+
+func highlightTweak(highlight bool) map[string]interface{} {
+	return map[string]interface{}{"set_tweak": "highlight", "value": highlight}
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// defaultNotificationPowerLevel is the power level needed to send a kind of
+// notification if the room's power levels don't say otherwise.
+const defaultNotificationPowerLevel = 50
+
+// EvaluationContext holds what the rules need to know about the user and the
+// room in addition to the event itself.
+type EvaluationContext struct {
+	// The display name of the user in the room, if any.
+	DisplayName string
+	// The number of users joined to the room.
+	MemberCount int
+	// The power level of the sender of the event.
+	SenderPowerLevel int
+	// The power levels needed to send each kind of notification, e.g. "room",
+	// taken from the "notifications" key of the room's power levels.
+	NotificationPowerLevels map[string]int
+}
+
+// Evaluate returns the first enabled rule of the ruleset matching the event,
+// or nil if there is none.
+func (r *Ruleset) Evaluate(event gomatrixserverlib.Event, ctx EvaluationContext) (*Rule, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, err
+	}
+	for _, kind := range Kinds {
+		rules := *r.Rules(kind)
+		for i := range rules {
+			if rules[i].Enabled && rules[i].matches(kind, event, fields, ctx) {
+				return &rules[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (rule *Rule) matches(
+	kind string, event gomatrixserverlib.Event, fields map[string]interface{}, ctx EvaluationContext,
+) bool {
+	switch kind {
+	case KindContent:
+		body, ok := valueAt(fields, "content.body")
+		return ok && globMatch(rule.Pattern, body, true)
+	case KindRoom:
+		return rule.RuleID == event.RoomID()
+	case KindSender:
+		return rule.RuleID == event.Sender()
+	}
+	for _, cond := range rule.Conditions {
+		if !cond.matches(fields, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cond *Condition) matches(fields map[string]interface{}, ctx EvaluationContext) bool {
+	switch cond.Kind {
+	case ConditionEventMatch:
+		value, ok := valueAt(fields, cond.Key)
+		return ok && globMatch(cond.Pattern, value, cond.Key == "content.body")
+	case ConditionContainsDisplayName:
+		body, ok := valueAt(fields, "content.body")
+		if !ok || ctx.DisplayName == "" {
+			return false
+		}
+		return wordRegexp(regexp.QuoteMeta(ctx.DisplayName)).MatchString(body)
+	case ConditionRoomMemberCount:
+		return memberCountMatches(cond.Is, ctx.MemberCount)
+	case ConditionSenderNotificationPermission:
+		level, ok := ctx.NotificationPowerLevels[cond.Key]
+		if !ok {
+			level = defaultNotificationPowerLevel
+		}
+		return ctx.SenderPowerLevel >= level
+	}
+	// Rules with conditions we don't know never match.
+	return false
+}
+
+// valueAt returns the string at the given dot-separated path in the event,
+// e.g. "content.body". Returns false if there is no string at that path.
+func valueAt(fields map[string]interface{}, key string) (string, bool) {
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		var ok bool
+		if fields, ok = fields[part].(map[string]interface{}); !ok {
+			return "", false
+		}
+	}
+	value, ok := fields[parts[len(parts)-1]].(string)
+	return value, ok
+}
+
+// globMatch checks whether the value matches the glob pattern, ignoring case.
+// If words is true the pattern may match any sequence of whole words of the
+// value, otherwise it must match the whole value.
+func globMatch(pattern, value string, words bool) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+	if words {
+		return wordRegexp(expr).MatchString(value)
+	}
+	return regexp.MustCompile("(?is)^" + expr + "$").MatchString(value)
+}
+
+// wordRegexp compiles a case insensitive regular expression only matching
+// the given expression at word boundaries.
+func wordRegexp(expr string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)(^|\W)` + expr + `(\W|$)`)
+}
+
+// memberCountMatches checks the member count against a room_member_count
+// condition, e.g. "2" or ">=10".
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == n
+	case "<":
+		return count < n
+	case ">":
+		return count > n
+	case "<=":
+		return count <= n
+	case ">=":
+		return count >= n
+	}
+	return false
+}
+
+// ShouldNotify returns true if the actions tell to notify the user.
+func ShouldNotify(actions []interface{}) bool {
+	for _, action := range actions {
+		if action == ActionNotify {
+			return true
+		}
+	}
+	return false
+}
+
+// Tweaks returns the tweaks set by the actions, e.g. {"sound": "default"}.
+func Tweaks(actions []interface{}) map[string]interface{} {
+	tweaks := map[string]interface{}{}
+	for _, action := range actions {
+		tweak, ok := action.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, ok := tweak["set_tweak"].(string)
+		if !ok {
+			continue
+		}
+		value, ok := tweak["value"]
+		if !ok && name == "highlight" {
+			// A highlight tweak without a value highlights the event.
+			value = true
+		}
+		tweaks[name] = value
+	}
+	return tweaks
+}
+
+// ValidActions checks that each action is either a known action or a tweak.
+func ValidActions(actions []interface{}) bool {
+	for _, action := range actions {
+		switch a := action.(type) {
+		case string:
+			if a != ActionNotify && a != ActionDontNotify && a != ActionCoalesce {
+				return false
+			}
+		case map[string]interface{}:
+			if _, ok := a["set_tweak"].(string); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
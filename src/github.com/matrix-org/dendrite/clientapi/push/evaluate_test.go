@@ -0,0 +1,188 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	alice = "@alice:localhost"
+	bob   = "@bob:localhost"
+)
+
+func mustEvent(t *testing.T, eventJSON string) gomatrixserverlib.Event {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestEvaluateDefaultRuleset(t *testing.T) {
+	ruleset := DefaultRuleset(bob, "bob")
+	tests := []struct {
+		name          string
+		event         string
+		ctx           EvaluationContext
+		wantRuleID    string
+		wantNotify    bool
+		wantHighlight bool
+	}{
+		{
+			name:       "message in a one to one room",
+			event:      `{"type":"m.room.message","content":{"body":"hello","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$1:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 2},
+			wantRuleID: ".m.rule.room_one_to_one",
+			wantNotify: true,
+		},
+		{
+			name:       "message in a group room",
+			event:      `{"type":"m.room.message","content":{"body":"hello","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$2:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 5},
+			wantRuleID: ".m.rule.message",
+			wantNotify: true,
+		},
+		{
+			name:          "message containing the user name",
+			event:         `{"type":"m.room.message","content":{"body":"Hi Bob!","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$3:localhost"}`,
+			ctx:           EvaluationContext{MemberCount: 5},
+			wantRuleID:    ".m.rule.contains_user_name",
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:          "message containing the display name",
+			event:         `{"type":"m.room.message","content":{"body":"ping Robert Smith.","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$4:localhost"}`,
+			ctx:           EvaluationContext{DisplayName: "Robert Smith", MemberCount: 5},
+			wantRuleID:    ".m.rule.contains_display_name",
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "notice",
+			event:      `{"type":"m.room.message","content":{"body":"Bob","msgtype":"m.notice"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$5:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 2},
+			wantRuleID: ".m.rule.suppress_notices",
+		},
+		{
+			name:       "invite for the user",
+			event:      `{"type":"m.room.member","state_key":"` + bob + `","content":{"membership":"invite"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$6:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 1},
+			wantRuleID: ".m.rule.invite_for_me",
+			wantNotify: true,
+		},
+		{
+			name:       "other member event",
+			event:      `{"type":"m.room.member","state_key":"` + alice + `","content":{"membership":"join"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$7:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 2},
+			wantRuleID: ".m.rule.member_event",
+		},
+		{
+			name:          "room notification from a moderator",
+			event:         `{"type":"m.room.message","content":{"body":"@room hello","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$8:localhost"}`,
+			ctx:           EvaluationContext{MemberCount: 5, SenderPowerLevel: 50},
+			wantRuleID:    ".m.rule.roomnotif",
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "room notification from a regular user",
+			event:      `{"type":"m.room.message","content":{"body":"@room hello","msgtype":"m.text"},"sender":"` + alice + `","room_id":"!r:localhost","event_id":"$9:localhost"}`,
+			ctx:        EvaluationContext{MemberCount: 5, SenderPowerLevel: 0},
+			wantRuleID: ".m.rule.message",
+			wantNotify: true,
+		},
+	}
+	for _, tt := range tests {
+		rule, err := ruleset.Evaluate(mustEvent(t, tt.event), tt.ctx)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if rule == nil {
+			t.Errorf("%s: want rule %q, got none", tt.name, tt.wantRuleID)
+			continue
+		}
+		if rule.RuleID != tt.wantRuleID {
+			t.Errorf("%s: want rule %q, got %q", tt.name, tt.wantRuleID, rule.RuleID)
+		}
+		if got := ShouldNotify(rule.Actions); got != tt.wantNotify {
+			t.Errorf("%s: want notify %t, got %t", tt.name, tt.wantNotify, got)
+		}
+		if got := Tweaks(rule.Actions)["highlight"] == true; got != tt.wantHighlight {
+			t.Errorf("%s: want highlight %t, got %t", tt.name, tt.wantHighlight, got)
+		}
+	}
+}
+
+func TestEvaluateUserRules(t *testing.T) {
+	ruleset := DefaultRuleset(bob, "bob")
+	mute := Rule{RuleID: "!r:localhost", Enabled: true, Actions: []interface{}{ActionDontNotify}}
+	if !ruleset.Insert(KindRoom, mute, "", "") {
+		t.Fatal("failed to insert room rule")
+	}
+	keyword := Rule{RuleID: "cake", Enabled: true, Pattern: "cak?", Actions: []interface{}{ActionNotify}}
+	if !ruleset.Insert(KindContent, keyword, "", "") {
+		t.Fatal("failed to insert content rule")
+	}
+	if ruleset.Content[0].RuleID != "cake" {
+		t.Errorf("want user rule before the default ones, got %q first", ruleset.Content[0].RuleID)
+	}
+
+	event := mustEvent(t, `{"type":"m.room.message","content":{"body":"hello","msgtype":"m.text"},"sender":"`+alice+`","room_id":"!r:localhost","event_id":"$1:localhost"}`)
+	rule, err := ruleset.Evaluate(event, EvaluationContext{MemberCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule == nil || rule.RuleID != mute.RuleID {
+		t.Errorf("want the room rule to match, got %+v", rule)
+	}
+
+	event = mustEvent(t, `{"type":"m.room.message","content":{"body":"I want CAKE","msgtype":"m.text"},"sender":"`+alice+`","room_id":"!r:localhost","event_id":"$2:localhost"}`)
+	rule, err = ruleset.Evaluate(event, EvaluationContext{MemberCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule == nil || rule.RuleID != keyword.RuleID {
+		t.Errorf("want the content rule to match, got %+v", rule)
+	}
+
+	if ruleset.Insert(KindContent, Rule{RuleID: "pie"}, "missing", "") {
+		t.Error("want inserting before a missing rule to fail")
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	tests := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"==2", 3, false},
+		{"<10", 9, true},
+		{">10", 10, false},
+		{">=10", 10, true},
+		{"<=1", 2, false},
+		{"!2", 2, false},
+	}
+	for _, tt := range tests {
+		if got := memberCountMatches(tt.is, tt.count); got != tt.want {
+			t.Errorf("memberCountMatches(%q, %d): want %t, got %t", tt.is, tt.count, tt.want, got)
+		}
+	}
+}
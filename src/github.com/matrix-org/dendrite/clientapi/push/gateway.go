@@ -0,0 +1,118 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// formatEventIDOnly is the pusher data format telling to only send the IDs of
+// the event and the room to the push gateway.
+const formatEventIDOnly = "event_id_only"
+
+// notifyRequest is the body of the requests sent to push gateways.
+// https://matrix.org/docs/spec/push_gateway/unstable.html#post-matrix-push-r0-notify
+type notifyRequest struct {
+	Notification notification `json:"notification"`
+}
+
+type notification struct {
+	EventID           string          `json:"event_id"`
+	RoomID            string          `json:"room_id"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Prio              string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Devices           []device        `json:"devices"`
+}
+
+type device struct {
+	AppID     string                      `json:"app_id"`
+	PushKey   string                      `json:"pushkey"`
+	PushKeyTS gomatrixserverlib.Timestamp `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{}      `json:"data,omitempty"`
+	Tweaks    map[string]interface{}      `json:"tweaks,omitempty"`
+}
+
+// notifyGateway sends a notification about the event to the push gateway of
+// an HTTP pusher of the given user.
+func notifyGateway(
+	client *http.Client, pusher authtypes.Pusher, userID string,
+	event gomatrixserverlib.Event, tweaks map[string]interface{}, room *roomInfo,
+) error {
+	url, ok := pusher.Data["url"].(string)
+	if !ok || url == "" {
+		return fmt.Errorf("push: pusher %q of %q has no URL", pusher.PushKey, pusher.Localpart)
+	}
+	// Everything but the URL is passed on to the gateway.
+	data := map[string]interface{}{}
+	for k, v := range pusher.Data {
+		if k != "url" {
+			data[k] = v
+		}
+	}
+
+	n := notification{
+		EventID: event.EventID(),
+		RoomID:  event.RoomID(),
+		Devices: []device{{
+			AppID:     pusher.AppID,
+			PushKey:   pusher.PushKey,
+			PushKeyTS: pusher.PushKeyTS,
+			Data:      data,
+			Tweaks:    tweaks,
+		}},
+	}
+	if format, _ := pusher.Data["format"].(string); format != formatEventIDOnly {
+		n.Type = event.Type()
+		n.Sender = event.Sender()
+		n.SenderDisplayName = room.displayNames[event.Sender()]
+		n.RoomName = room.name
+		n.RoomAlias = room.alias
+		n.Content = json.RawMessage(event.Content())
+		if stateKey := event.StateKey(); stateKey != nil {
+			n.UserIsTarget = *stateKey == userID
+		}
+	}
+	if highlight, _ := tweaks["highlight"].(bool); highlight {
+		n.Prio = "high"
+	} else {
+		n.Prio = "low"
+	}
+
+	body, err := json.Marshal(notifyRequest{n})
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != 200 {
+		return fmt.Errorf("push: gateway %q responded with HTTP %d", url, res.StatusCode)
+	}
+	return nil
+}
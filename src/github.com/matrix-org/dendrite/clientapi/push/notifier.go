@@ -0,0 +1,268 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// pusherKindHTTP is the kind of the pushers sending notifications to an HTTP
+// push gateway, the only kind supported.
+const pusherKindHTTP = "http"
+
+// A Notifier evaluates new events against the push rules of the local users
+// in the room, and notifies their pushers when the rules tell it to.
+type Notifier struct {
+	accountDB  *accounts.Database
+	queryAPI   api.RoomserverQueryAPI
+	httpClient *http.Client
+	serverName gomatrixserverlib.ServerName
+}
+
+// roomInfo holds what the notifier needs to know about the room of an event.
+type roomInfo struct {
+	memberCount  int
+	displayNames map[string]string
+	name         string
+	alias        string
+	powerLevels  common.PowerLevelContent
+}
+
+// NewNotifier creates a new Notifier.
+func NewNotifier(
+	accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+	serverName gomatrixserverlib.ServerName,
+) *Notifier {
+	return &Notifier{
+		accountDB:  accountDB,
+		queryAPI:   queryAPI,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		serverName: serverName,
+	}
+}
+
+// OnNewEvent evaluates a new event against the push rules of the local users
+// in the room. The event is added to the notification history of those the
+// rules tell to notify, and notifications are sent to the push gateways of
+// their pushers. The notifications are sent in the background.
+func (n *Notifier) OnNewEvent(ctx context.Context, event gomatrixserverlib.Event) error {
+	localparts, err := n.recipients(event)
+	if err != nil || len(localparts) == 0 {
+		return err
+	}
+	pushers, err := n.accountDB.GetPushersByLocalparts(localparts)
+	if err != nil {
+		return err
+	}
+	pushersByLocalpart := map[string][]authtypes.Pusher{}
+	for _, p := range pushers {
+		pushersByLocalpart[p.Localpart] = append(pushersByLocalpart[p.Localpart], p)
+	}
+
+	room, err := n.roomInfo(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	eventJSON, err := json.Marshal(gomatrixserverlib.ToClientEvent(event, gomatrixserverlib.FormatAll))
+	if err != nil {
+		return err
+	}
+
+	for _, localpart := range localparts {
+		userID := fmt.Sprintf("@%s:%s", localpart, n.serverName)
+		ruleset, err := GetRuleset(n.accountDB, localpart, n.serverName)
+		if err != nil {
+			return err
+		}
+		rule, err := ruleset.Evaluate(event, EvaluationContext{
+			DisplayName:             room.displayNames[userID],
+			MemberCount:             room.memberCount,
+			SenderPowerLevel:        room.powerLevels.UserLevel(event.Sender()),
+			NotificationPowerLevels: room.powerLevels.Notifications,
+		})
+		if err != nil {
+			return err
+		}
+		if rule == nil || !ShouldNotify(rule.Actions) {
+			continue
+		}
+		tweaks := Tweaks(rule.Actions)
+		if err = n.addNotification(localpart, event, eventJSON, rule.Actions, tweaks); err != nil {
+			return err
+		}
+		for _, p := range pushersByLocalpart[localpart] {
+			if p.Kind != pusherKindHTTP {
+				continue
+			}
+			go func(p authtypes.Pusher) {
+				if err := notifyGateway(n.httpClient, p, userID, event, tweaks, room); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"event_id": event.EventID(),
+						"user_id":  userID,
+						"app_id":   p.AppID,
+					}).Warn("Failed to notify push gateway")
+				}
+			}(p)
+		}
+	}
+	return nil
+}
+
+// addNotification adds the event to the notification history of the user.
+func (n *Notifier) addNotification(
+	localpart string, event gomatrixserverlib.Event, eventJSON []byte,
+	actions []interface{}, tweaks map[string]interface{},
+) error {
+	actionsJSON, err := json.Marshal(actions)
+	if err != nil {
+		return err
+	}
+	highlight, _ := tweaks["highlight"].(bool)
+	return n.accountDB.AddNotification(authtypes.Notification{
+		Localpart: localpart,
+		RoomID:    event.RoomID(),
+		EventID:   event.EventID(),
+		Event:     eventJSON,
+		Actions:   actionsJSON,
+		Highlight: highlight,
+		Timestamp: event.OriginServerTS(),
+	})
+}
+
+// recipients returns the localparts of the local users who may be notified
+// about the event, i.e. the ones joined to the room and the one it invites,
+// except for its sender.
+func (n *Notifier) recipients(event gomatrixserverlib.Event) ([]string, error) {
+	localparts, err := n.accountDB.GetLocalpartsInRoom(event.RoomID())
+	if err != nil {
+		return nil, err
+	}
+	if event.Type() == "m.room.member" && event.StateKey() != nil {
+		membership, err := event.Membership()
+		if err != nil {
+			return nil, err
+		}
+		localpart, domain, err := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if err != nil {
+			return nil, err
+		}
+		if membership == "invite" && domain == n.serverName {
+			localparts = append(localparts, localpart)
+		}
+	}
+
+	senderLocalpart, senderDomain, err := gomatrixserverlib.SplitID('@', event.Sender())
+	if err != nil {
+		return nil, err
+	}
+	recipients := []string{}
+	seen := map[string]bool{}
+	for _, localpart := range localparts {
+		if seen[localpart] || (senderDomain == n.serverName && localpart == senderLocalpart) {
+			continue
+		}
+		seen[localpart] = true
+		recipients = append(recipients, localpart)
+	}
+	return recipients, nil
+}
+
+// roomInfo looks up the members, name, alias and power levels of the event's
+// room.
+func (n *Notifier) roomInfo(ctx context.Context, event gomatrixserverlib.Event) (*roomInfo, error) {
+	info := roomInfo{
+		displayNames: map[string]string{},
+		powerLevels:  common.DefaultPowerLevelContent(),
+	}
+
+	membersReq := api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     event.RoomID(),
+		Sender:     event.Sender(),
+	}
+	var membersRes api.QueryMembershipsForRoomResponse
+	if err := n.queryAPI.QueryMembershipsForRoom(ctx, &membersReq, &membersRes); err != nil {
+		return nil, err
+	}
+	info.memberCount = len(membersRes.JoinEvents)
+	for _, ev := range membersRes.JoinEvents {
+		var content common.MemberContent
+		if err := json.Unmarshal([]byte(ev.Content), &content); err != nil {
+			return nil, err
+		}
+		if ev.StateKey != nil {
+			info.displayNames[*ev.StateKey] = content.DisplayName
+		}
+	}
+
+	stateReq := api.QueryCurrentStateRequest{
+		RoomID: event.RoomID(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.create", StateKey: ""},
+			{EventType: "m.room.power_levels", StateKey: ""},
+			{EventType: "m.room.name", StateKey: ""},
+			{EventType: "m.room.canonical_alias", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryCurrentStateResponse
+	if err := n.queryAPI.QueryCurrentState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: stateRes.StateEventIDs}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := n.queryAPI.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return nil, err
+	}
+
+	var creator string
+	hasPowerLevels := false
+	for _, ev := range eventsRes.Events {
+		var err error
+		switch ev.Type() {
+		case "m.room.create":
+			creator = ev.Sender()
+		case "m.room.power_levels":
+			hasPowerLevels = true
+			err = json.Unmarshal(ev.Content(), &info.powerLevels)
+		case "m.room.name":
+			var content common.NameContent
+			err = json.Unmarshal(ev.Content(), &content)
+			info.name = content.Name
+		case "m.room.canonical_alias":
+			var content common.CanonicalAliasContent
+			err = json.Unmarshal(ev.Content(), &content)
+			info.alias = content.Alias
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !hasPowerLevels && creator != "" {
+		info.powerLevels.Users[creator] = 100
+	}
+	return &info, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package push evaluates new events against the push rules of local users and
+// sends notifications to the push gateways of their pushers when the rules
+// tell it to.
+package push
+
+import "strings"
+
+// The kinds of push rules, in the order in which they are evaluated.
+const (
+	KindOverride  = "override"
+	KindContent   = "content"
+	KindRoom      = "room"
+	KindSender    = "sender"
+	KindUnderride = "underride"
+)
+
+// Kinds lists the kinds of push rules in the order in which they are evaluated.
+var Kinds = []string{KindOverride, KindContent, KindRoom, KindSender, KindUnderride}
+
+// The actions a push rule can take, besides setting tweaks.
+const (
+	ActionNotify     = "notify"
+	ActionDontNotify = "dont_notify"
+	ActionCoalesce   = "coalesce"
+)
+
+// The kinds of conditions a push rule can have.
+const (
+	ConditionEventMatch                   = "event_match"
+	ConditionContainsDisplayName          = "contains_display_name"
+	ConditionRoomMemberCount              = "room_member_count"
+	ConditionSenderNotificationPermission = "sender_notification_permission"
+)
+
+// GlobalRuleset is the response to GET /pushrules/, which only has the
+// "global" scope.
+type GlobalRuleset struct {
+	Global Ruleset `json:"global"`
+}
+
+// Ruleset is the set of push rules of a user in a given scope.
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#push-rules
+type Ruleset struct {
+	Override  []Rule `json:"override"`
+	Content   []Rule `json:"content"`
+	Room      []Rule `json:"room"`
+	Sender    []Rule `json:"sender"`
+	Underride []Rule `json:"underride"`
+}
+
+// Rule is a single push rule.
+type Rule struct {
+	RuleID  string `json:"rule_id"`
+	Default bool   `json:"default"`
+	Enabled bool   `json:"enabled"`
+	// Conditions are only used by override and underride rules.
+	Conditions []Condition `json:"conditions,omitempty"`
+	// Actions are either strings, e.g. "notify", or tweaks, e.g.
+	// {"set_tweak": "sound", "value": "default"}.
+	Actions []interface{} `json:"actions"`
+	// Pattern is only used by content rules.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Condition is a condition an event must fulfill for a rule to match it.
+type Condition struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Is      string `json:"is,omitempty"`
+}
+
+// Rules returns a pointer to the rules of the given kind, or nil if the kind
+// isn't known.
+func (r *Ruleset) Rules(kind string) *[]Rule {
+	switch kind {
+	case KindOverride:
+		return &r.Override
+	case KindContent:
+		return &r.Content
+	case KindRoom:
+		return &r.Room
+	case KindSender:
+		return &r.Sender
+	case KindUnderride:
+		return &r.Underride
+	}
+	return nil
+}
+
+// Find returns the rule of the given kind with the given ID, or nil if there
+// is none.
+func (r *Ruleset) Find(kind, ruleID string) *Rule {
+	rules := r.Rules(kind)
+	if rules == nil {
+		return nil
+	}
+	for i := range *rules {
+		if (*rules)[i].RuleID == ruleID {
+			return &(*rules)[i]
+		}
+	}
+	return nil
+}
+
+// Remove removes the rule of the given kind with the given ID. Returns false
+// if there was no such rule.
+func (r *Ruleset) Remove(kind, ruleID string) bool {
+	rules := r.Rules(kind)
+	if rules == nil {
+		return false
+	}
+	for i := range *rules {
+		if (*rules)[i].RuleID == ruleID {
+			*rules = append((*rules)[:i], (*rules)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Insert adds the rule to the rules of the given kind, replacing the rule with
+// the same ID if there is one. If before or after is given, the rule is placed
+// right before or right after the rule with that ID, otherwise it is placed
+// before the server default rules of the same kind, so it has priority over
+// them. Returns false if the rule to place it relative to doesn't exist.
+func (r *Ruleset) Insert(kind string, rule Rule, before, after string) bool {
+	rules := r.Rules(kind)
+	if rules == nil {
+		return false
+	}
+	existing := r.Find(kind, rule.RuleID)
+	if existing != nil && before == "" && after == "" {
+		*existing = rule
+		return true
+	}
+	if existing != nil {
+		r.Remove(kind, rule.RuleID)
+	}
+
+	pos := -1
+	for i, other := range *rules {
+		switch {
+		case before != "" && other.RuleID == before:
+			pos = i
+		case after != "" && other.RuleID == after:
+			pos = i + 1
+		case before == "" && after == "" && other.Default && pos == -1:
+			pos = i
+		}
+	}
+	if pos == -1 {
+		if before != "" || after != "" {
+			return false
+		}
+		pos = len(*rules)
+	}
+
+	*rules = append(*rules, Rule{})
+	copy((*rules)[pos+1:], (*rules)[pos:])
+	(*rules)[pos] = rule
+	return true
+}
+
+// IsDefaultRuleID returns true if the rule ID is reserved for server default
+// rules, which users can't add or remove.
+func IsDefaultRuleID(ruleID string) bool {
+	return strings.HasPrefix(ruleID, ".")
+}
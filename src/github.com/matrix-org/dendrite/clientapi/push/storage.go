@@ -0,0 +1,53 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// GetRuleset returns the push ruleset of a local user, which is the server
+// default one if they never changed it.
+func GetRuleset(
+	accountDB *accounts.Database, localpart string, serverName gomatrixserverlib.ServerName,
+) (*Ruleset, error) {
+	data, err := accountDB.GetPushRules(localpart)
+	if err == sql.ErrNoRows {
+		userID := fmt.Sprintf("@%s:%s", localpart, serverName)
+		ruleset := DefaultRuleset(userID, localpart)
+		return &ruleset, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ruleset Ruleset
+	if err = json.Unmarshal(data, &ruleset); err != nil {
+		return nil, err
+	}
+	return &ruleset, nil
+}
+
+// SaveRuleset stores the push ruleset of a local user.
+func SaveRuleset(accountDB *accounts.Database, localpart string, ruleset *Ruleset) error {
+	data, err := json.Marshal(ruleset)
+	if err != nil {
+		return err
+	}
+	return accountDB.SavePushRules(localpart, data)
+}
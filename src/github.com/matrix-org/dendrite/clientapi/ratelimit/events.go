@@ -0,0 +1,59 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// An EventLimiter limits the rate at which events are sent, both per user and
+// per room, with separate limits for message events and state events.
+// It is safe to use from multiple goroutines.
+type EventLimiter struct {
+	messagesPerUser *Limiter
+	messagesPerRoom *Limiter
+	statePerUser    *Limiter
+	statePerRoom    *Limiter
+}
+
+// NewEventLimiter creates a new EventLimiter using the given limits for
+// message events and state events.
+func NewEventLimiter(messages, state config.EventRateLimit) *EventLimiter {
+	return &EventLimiter{
+		messagesPerUser: NewLimiter(messages.PerUser),
+		messagesPerRoom: NewLimiter(messages.PerRoom),
+		statePerUser:    NewLimiter(state.PerUser),
+		statePerRoom:    NewLimiter(state.PerRoom),
+	}
+}
+
+// Allow takes a token from the buckets of the user and of the room for the
+// given kind of event.
+// Returns true if the event is allowed. Otherwise returns false along with
+// how long the caller needs to wait before an event will be allowed again.
+// An event refused because of the limit of the room still counts towards the
+// limit of the user.
+func (l *EventLimiter) Allow(userID, roomID string, isState bool) (allowed bool, retryAfter time.Duration) {
+	perUser, perRoom := l.messagesPerUser, l.messagesPerRoom
+	if isState {
+		perUser, perRoom = l.statePerUser, l.statePerRoom
+	}
+	if allowed, retryAfter = perUser.Allow(userID); !allowed {
+		return
+	}
+	return perRoom.Allow(roomID)
+}
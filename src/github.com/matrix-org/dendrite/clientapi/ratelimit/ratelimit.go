@@ -0,0 +1,113 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit implements rate limiting of client requests.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+// How often buckets that have refilled completely are removed, so that
+// the limiter doesn't use memory for users who no longer send requests.
+const cleanupPeriod = time.Minute
+
+// A Limiter limits the rate of requests for each key (e.g. a user ID) using
+// a token bucket: every key has a bucket that holds up to "burst" tokens and
+// refills at "perSecond" tokens per second. Each request takes a token from
+// the bucket, and is refused if the bucket is empty.
+// It is safe to use from multiple goroutines.
+type Limiter struct {
+	perSecond float64
+	burst     float64
+	// Returns the current time, can be mocked in the tests
+	now func() time.Time
+
+	mutex       sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	// The number of tokens in the bucket at the last update
+	tokens float64
+	// When the bucket was last updated
+	updated time.Time
+}
+
+// NewLimiter creates a new Limiter using the given configuration.
+func NewLimiter(cfg config.RateLimit) *Limiter {
+	return &Limiter{
+		perSecond: cfg.PerSecond,
+		burst:     float64(cfg.Burst),
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket for the given key.
+// Returns true if the request is allowed. Otherwise returns false along with
+// how long the caller needs to wait before a request will be allowed again.
+func (l *Limiter) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastCleanup) > cleanupPeriod {
+		l.cleanup(now)
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	} else {
+		b.refill(now, l.perSecond, l.burst)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	missing := 1 - b.tokens
+	retryAfter = time.Duration(math.Ceil(missing / l.perSecond * float64(time.Second)))
+	return false, retryAfter
+}
+
+// cleanup removes the buckets that have completely refilled, since they are
+// equivalent to having no bucket at all.
+// The caller must hold the mutex.
+func (l *Limiter) cleanup(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now, l.perSecond, l.burst)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// refill adds the tokens accumulated since the last update to the bucket.
+func (b *bucket) refill(now time.Time, perSecond, burst float64) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*perSecond)
+		b.updated = now
+	}
+}
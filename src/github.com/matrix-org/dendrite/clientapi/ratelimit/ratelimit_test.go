@@ -0,0 +1,130 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/common/config"
+)
+
+func newTestLimiter(perSecond float64, burst int) (*Limiter, *time.Time) {
+	now := time.Unix(1500000000, 0)
+	l := NewLimiter(config.RateLimit{PerSecond: perSecond, Burst: burst})
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiterAllowsBurst(t *testing.T) {
+	l, _ := newTestLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.Allow("@alice:localhost"); !allowed {
+			t.Fatalf("request %d: wanted allowed, got refused", i)
+		}
+	}
+	allowed, retryAfter := l.Allow("@alice:localhost")
+	if allowed {
+		t.Fatal("wanted request after burst to be refused, got allowed")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("wanted retryAfter %v, got %v", time.Second, retryAfter)
+	}
+}
+
+func TestLimiterRefills(t *testing.T) {
+	l, now := newTestLimiter(0.5, 1)
+	if allowed, _ := l.Allow("@alice:localhost"); !allowed {
+		t.Fatal("wanted first request allowed, got refused")
+	}
+	*now = now.Add(time.Second)
+	allowed, retryAfter := l.Allow("@alice:localhost")
+	if allowed {
+		t.Fatal("wanted request before refill to be refused, got allowed")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("wanted retryAfter %v, got %v", time.Second, retryAfter)
+	}
+	*now = now.Add(time.Second)
+	if allowed, _ = l.Allow("@alice:localhost"); !allowed {
+		t.Fatal("wanted request after refill allowed, got refused")
+	}
+}
+
+func TestLimiterKeysAreIndependent(t *testing.T) {
+	l, _ := newTestLimiter(1, 1)
+	if allowed, _ := l.Allow("@alice:localhost"); !allowed {
+		t.Fatal("wanted alice's request allowed, got refused")
+	}
+	if allowed, _ := l.Allow("@bob:localhost"); !allowed {
+		t.Fatal("wanted bob's request allowed, got refused")
+	}
+	if allowed, _ := l.Allow("@alice:localhost"); allowed {
+		t.Fatal("wanted alice's second request refused, got allowed")
+	}
+}
+
+func TestLimiterCleanup(t *testing.T) {
+	l, now := newTestLimiter(1, 2)
+	l.Allow("@alice:localhost")
+	*now = now.Add(2 * cleanupPeriod)
+	l.Allow("@bob:localhost")
+	if _, ok := l.buckets["@alice:localhost"]; ok {
+		t.Error("wanted alice's refilled bucket to be removed")
+	}
+	if _, ok := l.buckets["@bob:localhost"]; !ok {
+		t.Error("wanted bob's bucket to be kept")
+	}
+}
+
+func TestEventLimiterSeparatesStateEvents(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	l := NewEventLimiter(
+		config.EventRateLimit{
+			PerUser: config.RateLimit{PerSecond: 1, Burst: 2},
+			PerRoom: config.RateLimit{PerSecond: 1, Burst: 3},
+		},
+		config.EventRateLimit{
+			PerUser: config.RateLimit{PerSecond: 1, Burst: 1},
+			PerRoom: config.RateLimit{PerSecond: 1, Burst: 1},
+		},
+	)
+	for _, limiter := range []*Limiter{l.messagesPerUser, l.messagesPerRoom, l.statePerUser, l.statePerRoom} {
+		limiter.now = func() time.Time { return now }
+	}
+
+	if allowed, _ := l.Allow("@alice:localhost", "!room:localhost", true); !allowed {
+		t.Fatal("wanted first state event allowed, got refused")
+	}
+	if allowed, _ := l.Allow("@alice:localhost", "!room:localhost", true); allowed {
+		t.Fatal("wanted second state event refused, got allowed")
+	}
+	// State events don't count towards the limits of message events.
+	for i := 0; i < 2; i++ {
+		if allowed, _ := l.Allow("@alice:localhost", "!room:localhost", false); !allowed {
+			t.Fatalf("message %d: wanted allowed, got refused", i)
+		}
+	}
+	if allowed, _ := l.Allow("@alice:localhost", "!room:localhost", false); allowed {
+		t.Fatal("wanted message after the burst of the user refused, got allowed")
+	}
+	// Other users can still send messages until the room runs out.
+	if allowed, _ := l.Allow("@bob:localhost", "!room:localhost", false); !allowed {
+		t.Fatal("wanted message of another user allowed, got refused")
+	}
+	if allowed, _ := l.Allow("@charlie:localhost", "!room:localhost", false); allowed {
+		t.Fatal("wanted message after the burst of the room refused, got allowed")
+	}
+}
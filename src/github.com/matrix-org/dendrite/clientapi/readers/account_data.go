@@ -15,6 +15,7 @@
 package readers
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 
@@ -59,6 +60,14 @@ func SaveAccountData(
 		return httputil.LogThenError(req, err)
 	}
 
+	var content map[string]interface{}
+	if err = json.Unmarshal(body, &content); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Content must be a JSON object"),
+		}
+	}
+
 	if err := accountDB.SaveAccountData(localpart, roomID, dataType, string(body)); err != nil {
 		return httputil.LogThenError(req, err)
 	}
@@ -72,3 +81,38 @@ func SaveAccountData(
 		JSON: struct{}{},
 	}
 }
+
+// GetAccountData implements GET /user/{userId}/[rooms/{roomId}/]account_data/{type}
+func GetAccountData(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	userID string, roomID string, dataType string,
+) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	data, err := accountDB.GetAccountDataByType(localpart, roomID, dataType)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if len(data) == 0 {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Account data not found"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: data[0].Content,
+	}
+}
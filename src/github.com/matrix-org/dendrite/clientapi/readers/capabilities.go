@@ -0,0 +1,56 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+type capabilitiesResponse struct {
+	Capabilities capabilities `json:"capabilities"`
+}
+
+type capabilities struct {
+	ChangePassword boolCapability         `json:"m.change_password"`
+	RoomVersions   roomVersionsCapability `json:"m.room_versions"`
+}
+
+type boolCapability struct {
+	Enabled bool `json:"enabled"`
+}
+
+type roomVersionsCapability struct {
+	Default   string                                 `json:"default"`
+	Available map[string]config.RoomVersionStability `json:"available"`
+}
+
+// GetCapabilities implements GET /capabilities
+func GetCapabilities(req *http.Request, cfg config.Dendrite) util.JSONResponse {
+	return util.JSONResponse{
+		Code: 200,
+		JSON: capabilitiesResponse{
+			Capabilities: capabilities{
+				ChangePassword: boolCapability{Enabled: true},
+				RoomVersions: roomVersionsCapability{
+					Default:   cfg.Matrix.DefaultRoomVersion,
+					Available: config.SupportedRoomVersions,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type contextResponse struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+}
+
+// GetContext implements GET /rooms/{roomID}/context/{eventID}
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-context-eventid
+// The pagination tokens can be used with GET /rooms/{roomID}/messages.
+func GetContext(
+	req *http.Request, device *authtypes.Device, roomID, eventID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+
+	limit := defaultMessagesLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+	}
+
+	var filter authtypes.RoomEventFilter
+	if s := query.Get("filter"); s != "" {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The filter is not valid JSON: " + err.Error()),
+			}
+		}
+	}
+
+	eventReq := api.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}
+	var eventRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &eventReq, &eventRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(eventRes.Events) != 1 || eventRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
+
+	before, start, err := queryContextEvents(req.Context(), device.UserID, roomID, eventID, true, limit/2, filter, queryAPI)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	after, end, err := queryContextEvents(req.Context(), device.UserID, roomID, eventID, false, limit-limit/2, filter, queryAPI)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: contextResponse{
+			Start:        strconv.FormatInt(start, 10),
+			End:          strconv.FormatInt(end, 10),
+			EventsBefore: before,
+			Event:        gomatrixserverlib.ToClientEvent(eventRes.Events[0], gomatrixserverlib.FormatAll),
+			EventsAfter:  after,
+		},
+	}
+}
+
+// queryContextEvents returns the events the user can see right before or after
+// the given event and matching the filter, along with the position to carry on
+// paginating from.
+func queryContextEvents(
+	ctx context.Context, userID, roomID, eventID string, backwards bool, limit int,
+	filter authtypes.RoomEventFilter, queryAPI api.RoomserverQueryAPI,
+) ([]gomatrixserverlib.ClientEvent, int64, error) {
+	queryReq := api.QueryEventsByRangeRequest{
+		RoomID:      roomID,
+		UserID:      userID,
+		FromEventID: eventID,
+		Backwards:   backwards,
+		Limit:       limit,
+	}
+	var queryRes api.QueryEventsByRangeResponse
+	if err := queryAPI.QueryEventsByRange(ctx, &queryReq, &queryRes); err != nil {
+		return nil, 0, err
+	}
+	events := []gomatrixserverlib.ClientEvent{}
+	for _, event := range queryRes.Events {
+		if filter.AllowsEvent(event.Type(), event.Sender()) {
+			events = append(events, gomatrixserverlib.ToClientEvent(event, gomatrixserverlib.FormatAll))
+		}
+	}
+	return events, queryRes.End, nil
+}
@@ -15,12 +15,17 @@
 package readers
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/appservice/query"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -32,9 +37,10 @@ func DirectoryRoom(
 	req *http.Request,
 	device *authtypes.Device,
 	roomAlias string,
-	federation *gomatrixserverlib.FederationClient,
+	federation *federationclient.Client,
 	cfg *config.Dendrite,
 	aliasAPI api.RoomserverAliasAPI,
+	httpClient *http.Client,
 ) util.JSONResponse {
 	_, domain, err := gomatrixserverlib.SplitID('#', roomAlias)
 	if err != nil {
@@ -52,6 +58,15 @@ func DirectoryRoom(
 		if err = aliasAPI.GetAliasRoomID(&queryReq, &queryRes); err != nil {
 			return httputil.LogThenError(req, err)
 		}
+		// Give the application services managing the alias a chance to
+		// create it before giving up.
+		if len(queryRes.RoomID) == 0 && query.RoomAliasExists(
+			req.Context(), httpClient, cfg.ApplicationServices.Registrations, roomAlias,
+		) {
+			if err = aliasAPI.GetAliasRoomID(&queryReq, &queryRes); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		}
 
 		if len(queryRes.RoomID) > 0 {
 			// TODO: List servers that are aware of this room alias
@@ -114,6 +129,16 @@ func SetLocalAlias(
 		}
 	}
 
+	for i := range cfg.ApplicationServices.Registrations {
+		registration := &cfg.ApplicationServices.Registrations[i]
+		if registration.OwnsRoomAlias(alias) && device.AppService != registration {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.Exclusive("Alias is reserved by an application service"),
+			}
+		}
+	}
+
 	var r struct {
 		RoomID string `json:"room_id"`
 	}
@@ -145,14 +170,64 @@ func SetLocalAlias(
 }
 
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
-// TODO: Check if the user has the power level to remove an alias
+// Only the user who created the alias, or a user with admin power level in the
+// room the alias refers to, can remove it.
 func RemoveLocalAlias(
 	req *http.Request,
 	device *authtypes.Device,
 	alias string,
 	cfg *config.Dendrite,
 	aliasAPI api.RoomserverAliasAPI,
+	queryAPI api.RoomserverQueryAPI,
 ) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('#', alias)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Room alias must be in the form '#localpart:domain'"),
+		}
+	}
+
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Alias must be on local homeserver"),
+		}
+	}
+
+	aliasReq := api.GetAliasRoomIDRequest{Alias: alias}
+	var aliasRes api.GetAliasRoomIDResponse
+	if err = aliasAPI.GetAliasRoomID(&aliasReq, &aliasRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if aliasRes.RoomID == "" {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room alias " + alias + " not found."),
+		}
+	}
+
+	creatorReq := api.GetCreatorIDForAliasRequest{Alias: alias}
+	var creatorRes api.GetCreatorIDForAliasResponse
+	if err = aliasAPI.GetCreatorIDForAlias(&creatorReq, &creatorRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Only room admins can remove the aliases whose creator isn't known.
+	if creatorRes.UserID == "" || creatorRes.UserID != device.UserID {
+		isAdmin, err := isRoomAdmin(req.Context(), aliasRes.RoomID, device.UserID, queryAPI)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if !isAdmin {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("You do not have permission to remove this alias."),
+			}
+		}
+	}
+
 	queryReq := api.RemoveRoomAliasRequest{
 		Alias:  alias,
 		UserID: device.UserID,
@@ -167,3 +242,34 @@ func RemoveLocalAlias(
 		JSON: struct{}{},
 	}
 }
+
+// isRoomAdmin checks whether the given user has admin power level in the
+// given room, i.e. whether they can change its power levels, according to the
+// current state of the room. Returns an error if there was a problem talking
+// to the room server.
+func isRoomAdmin(
+	ctx context.Context, roomID string, userID string, queryAPI api.RoomserverQueryAPI,
+) (bool, error) {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.power_levels", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
+		return false, err
+	}
+
+	for _, event := range stateRes.StateEvents {
+		content := common.DefaultPowerLevelContent()
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			return false, err
+		}
+		return content.UserLevel(userID) >= content.EventLevel("m.room.power_levels", true), nil
+	}
+
+	// If there's no m.room.power_levels event in the room, nobody can
+	// have admin power level
+	return false, nil
+}
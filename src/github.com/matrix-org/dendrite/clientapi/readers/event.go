@@ -0,0 +1,79 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetEvent implements GET /rooms/{roomID}/event/{eventID}
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-event-eventid
+func GetEvent(
+	req *http.Request, device *authtypes.Device, roomID, eventID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	queryReq := api.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}
+	var queryRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Events the user isn't allowed to see are reported as missing so that we
+	// don't leak their existence.
+	if len(queryRes.Events) != 1 || queryRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
+
+	event := gomatrixserverlib.ToClientEvent(queryRes.Events[0], gomatrixserverlib.FormatAll)
+
+	relationsReq := api.QueryRelationsRequest{EventIDs: []string{eventID}, UserID: device.UserID}
+	var relationsRes api.QueryRelationsResponse
+	if err := queryAPI.QueryRelations(req.Context(), &relationsReq, &relationsRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if relations, ok := relationsRes.Relations[eventID]; ok {
+		if err := common.BundleRelations(&event, relations, gomatrixserverlib.FormatAll); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		// The event is served with the content of its latest edit.
+		if relations.Replace != nil {
+			var content common.NewContent
+			err := json.Unmarshal(relations.Replace.Content(), &content)
+			if err == nil && len(content.NewContent) > 0 {
+				event.Content = []byte(content.NewContent)
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: event,
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/e2ekeys"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// queryKeysRequest represents the body of a POST /keys/query request.
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#post-matrix-client-r0-keys-query
+type queryKeysRequest struct {
+	DeviceKeys map[string][]string `json:"device_keys"`
+}
+
+type queryKeysResponse struct {
+	Failures        map[string]interface{}                `json:"failures"`
+	DeviceKeys      map[string]map[string]json.RawMessage `json:"device_keys"`
+	MasterKeys      map[string]json.RawMessage            `json:"master_keys"`
+	SelfSigningKeys map[string]json.RawMessage            `json:"self_signing_keys"`
+	UserSigningKeys map[string]json.RawMessage            `json:"user_signing_keys"`
+}
+
+// claimKeysRequest represents the body of a POST /keys/claim request.
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#post-matrix-client-r0-keys-claim
+type claimKeysRequest struct {
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+type claimKeysResponse struct {
+	Failures    map[string]interface{}                           `json:"failures"`
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// QueryKeys implements POST /keys/query
+func QueryKeys(
+	req *http.Request, device *authtypes.Device, cfg config.Dendrite,
+	accountDB *accounts.Database, deviceDB *devices.Database,
+	federation *federationclient.Client,
+) util.JSONResponse {
+	var r queryKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := queryKeysResponse{
+		Failures:        map[string]interface{}{},
+		DeviceKeys:      map[string]map[string]json.RawMessage{},
+		MasterKeys:      map[string]json.RawMessage{},
+		SelfSigningKeys: map[string]json.RawMessage{},
+		UserSigningKeys: map[string]json.RawMessage{},
+	}
+	remote := map[gomatrixserverlib.ServerName]map[string][]string{}
+	for userID, deviceIDs := range r.DeviceKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		if domain != cfg.Matrix.ServerName {
+			if remote[domain] == nil {
+				remote[domain] = map[string][]string{}
+			}
+			remote[domain][userID] = deviceIDs
+			continue
+		}
+		keys, err := e2ekeys.QueryDeviceKeys(deviceDB, userID, deviceIDs)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		res.DeviceKeys[userID] = keys
+		signingKeys, err := e2ekeys.QueryCrossSigningKeys(accountDB, userID, userID == device.UserID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		addCrossSigningKeys(&res, userID, signingKeys)
+	}
+
+	// TODO: Query the remote servers in parallel.
+	for serverName, deviceKeys := range remote {
+		remoteRes, err := federation.QueryKeys(serverName, deviceKeys)
+		if err != nil {
+			res.Failures[string(serverName)] = remoteFailure(err)
+			continue
+		}
+		for userID, keys := range remoteRes.DeviceKeys {
+			if _, ok := deviceKeys[userID]; ok {
+				res.DeviceKeys[userID] = keys
+			}
+		}
+		for userID, key := range remoteRes.MasterKeys {
+			if _, ok := deviceKeys[userID]; ok {
+				res.MasterKeys[userID] = key
+			}
+		}
+		for userID, key := range remoteRes.SelfSigningKeys {
+			if _, ok := deviceKeys[userID]; ok {
+				res.SelfSigningKeys[userID] = key
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// ClaimKeys implements POST /keys/claim
+func ClaimKeys(
+	req *http.Request, cfg config.Dendrite, deviceDB *devices.Database,
+	federation *federationclient.Client,
+) util.JSONResponse {
+	var r claimKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	res := claimKeysResponse{
+		Failures:    map[string]interface{}{},
+		OneTimeKeys: map[string]map[string]map[string]json.RawMessage{},
+	}
+	remote := map[gomatrixserverlib.ServerName]map[string]map[string]string{}
+	for userID, algorithms := range r.OneTimeKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		if domain != cfg.Matrix.ServerName {
+			if remote[domain] == nil {
+				remote[domain] = map[string]map[string]string{}
+			}
+			remote[domain][userID] = algorithms
+			continue
+		}
+		keys, err := e2ekeys.ClaimOneTimeKeys(deviceDB, userID, algorithms)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if len(keys) > 0 {
+			res.OneTimeKeys[userID] = keys
+		}
+	}
+
+	for serverName, oneTimeKeys := range remote {
+		remoteRes, err := federation.ClaimKeys(serverName, oneTimeKeys)
+		if err != nil {
+			res.Failures[string(serverName)] = remoteFailure(err)
+			continue
+		}
+		for userID, keys := range remoteRes.OneTimeKeys {
+			if _, ok := oneTimeKeys[userID]; ok {
+				res.OneTimeKeys[userID] = keys
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// remoteFailure describes why a remote server couldn't be reached in the
+// failures of /keys/query and /keys/claim responses.
+func remoteFailure(err error) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  503,
+		"message": err.Error(),
+	}
+}
+
+// addCrossSigningKeys adds the cross-signing keys of a user, mapped by key
+// type, to a /keys/query response.
+func addCrossSigningKeys(res *queryKeysResponse, userID string, keys map[string]json.RawMessage) {
+	if key, ok := keys[e2ekeys.MasterKey]; ok {
+		res.MasterKeys[userID] = key
+	}
+	if key, ok := keys[e2ekeys.SelfSigningKey]; ok {
+		res.SelfSigningKeys[userID] = key
+	}
+	if key, ok := keys[e2ekeys.UserSigningKey]; ok {
+		res.UserSigningKeys[userID] = key
+	}
+}
@@ -15,14 +15,16 @@
 package readers
 
 import (
-	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -33,95 +35,143 @@ type loginFlows struct {
 }
 
 type flow struct {
-	Type   string   `json:"type"`
-	Stages []string `json:"stages"`
+	Type authtypes.LoginType `json:"type"`
+}
+
+type loginIdentifier struct {
+	Type string `json:"type"`
+	User string `json:"user"`
 }
 
 type passwordRequest struct {
-	User     string `json:"user"`
-	Password string `json:"password"`
+	Type authtypes.LoginType `json:"type"`
+	// The user can either be given directly or through an identifier.
+	User       string           `json:"user"`
+	Identifier *loginIdentifier `json:"identifier"`
+	Password   string           `json:"password"`
+	DeviceID   string           `json:"device_id"`
+	// The display name to give the device if a new one is created.
+	InitialDisplayName *string `json:"initial_device_display_name"`
 }
 
 type loginResponse struct {
 	UserID      string                       `json:"user_id"`
 	AccessToken string                       `json:"access_token"`
 	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID    string                       `json:"device_id"`
 }
 
-func passwordLogin() loginFlows {
-	f := loginFlows{}
-	s := flow{"m.login.password", []string{"m.login.password"}}
-	f.Flows = append(f.Flows, s)
-	return f
+// GetLoginFlows implements GET /login
+func GetLoginFlows(req *http.Request) util.JSONResponse {
+	// TODO: support other forms of login other than password, depending on config options
+	return util.JSONResponse{
+		Code: 200,
+		JSON: loginFlows{
+			Flows: []flow{{Type: authtypes.LoginTypePassword}},
+		},
+	}
 }
 
-// Login implements GET and POST /login
-func Login(
+// PostLogin implements POST /login
+func PostLogin(
 	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
 	cfg config.Dendrite,
 ) util.JSONResponse {
-	if req.Method == "GET" { // TODO: support other forms of login other than password, depending on config options
+	var r passwordRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	if r.Type != "" && r.Type != authtypes.LoginTypePassword {
 		return util.JSONResponse{
-			Code: 200,
-			JSON: passwordLogin(),
+			Code: 400,
+			JSON: jsonerror.Unknown("Unknown login type " + string(r.Type)),
 		}
-	} else if req.Method == "POST" {
-		var r passwordRequest
-		resErr := httputil.UnmarshalJSONRequest(req, &r)
-		if resErr != nil {
-			return *resErr
-		}
-		if r.User == "" {
+	}
+
+	user := r.User
+	if r.Identifier != nil {
+		if r.Identifier.Type != "m.id.user" {
 			return util.JSONResponse{
 				Code: 400,
-				JSON: jsonerror.BadJSON("'user' must be supplied."),
+				JSON: jsonerror.BadJSON("Only m.id.user identifiers are supported"),
 			}
 		}
+		user = r.Identifier.User
+	}
+	if user == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("'user' must be supplied."),
+		}
+	}
 
-		util.GetLogger(req.Context()).WithField("user", r.User).Info("Processing login request")
+	common.GetLogger(req.Context()).WithField("user", user).Info("Processing login request")
 
-		acc, err := accountDB.GetAccountByPassword(r.User, r.Password)
+	// The user can be given either as a localpart or as a full user ID.
+	localpart := user
+	if strings.HasPrefix(user, "@") {
+		var domain gomatrixserverlib.ServerName
+		var err error
+		localpart, domain, err = gomatrixserverlib.SplitID('@', user)
 		if err != nil {
-			// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
-			// but that would leak the existence of the user.
 			return util.JSONResponse{
-				Code: 403,
-				JSON: jsonerror.BadJSON("username or password was incorrect, or the account does not exist"),
+				Code: 400,
+				JSON: jsonerror.BadJSON("Invalid user ID"),
 			}
 		}
-
-		token, err := auth.GenerateAccessToken()
-		if err != nil {
+		if domain != cfg.Matrix.ServerName {
 			return util.JSONResponse{
-				Code: 500,
-				JSON: jsonerror.Unknown("Failed to generate access token"),
+				Code: 403,
+				JSON: jsonerror.Forbidden("User ID not ours"),
 			}
 		}
+	}
 
-		// TODO: Use the device ID in the request
-		dev, err := deviceDB.CreateDevice(acc.Localpart, auth.UnknownDeviceID, token)
-		if err != nil {
-			return util.JSONResponse{
-				Code: 500,
-				JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
-			}
+	acc, err := accountDB.GetAccountByPassword(localpart, r.Password)
+	if err != nil {
+		// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
+		// but that would leak the existence of the user.
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("username or password was incorrect, or the account does not exist"),
 		}
+	}
 
+	if acc.IsDeactivated {
 		return util.JSONResponse{
-			Code: 200,
-			JSON: loginResponse{
-				UserID:      dev.UserID,
-				AccessToken: dev.AccessToken,
-				HomeServer:  cfg.Matrix.ServerName,
-			},
+			Code: 403,
+			JSON: jsonerror.Deactivated("This account has been deactivated"),
 		}
 	}
-	return util.JSONResponse{
-		Code: 405,
-		JSON: jsonerror.NotFound("Bad method"),
+
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("Failed to generate access token"),
+		}
+	}
+
+	deviceID := r.DeviceID
+	if deviceID == "" {
+		deviceID = auth.UnknownDeviceID
+	}
+	dev, err := deviceDB.CreateDevice(acc.Localpart, deviceID, token, r.InitialDisplayName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("failed to create device: " + err.Error()),
+		}
 	}
-}
 
-func makeUserID(localpart string, domain gomatrixserverlib.ServerName) string {
-	return fmt.Sprintf("@%s:%s", localpart, domain)
+	return util.JSONResponse{
+		Code: 200,
+		JSON: loginResponse{
+			UserID:      dev.UserID,
+			AccessToken: dev.AccessToken,
+			HomeServer:  cfg.Matrix.ServerName,
+			DeviceID:    dev.ID,
+		},
+	}
 }
@@ -20,7 +20,6 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
-	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -29,19 +28,38 @@ import (
 func Logout(
 	req *http.Request, deviceDB *devices.Database, device *authtypes.Device,
 ) util.JSONResponse {
-	if req.Method != "POST" {
-		return util.JSONResponse{
-			Code: 405,
-			JSON: jsonerror.NotFound("Bad method"),
-		}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
 	}
 
+	if err := deviceDB.RemoveDevice(device.ID, localpart); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// AllDevicesRemover represents a device database which can revoke every
+// device of a user.
+type AllDevicesRemover interface {
+	// Revoke all the devices of the user with the given localpart.
+	RemoveAllDevices(localpart string) error
+}
+
+// LogoutAll handles POST /logout/all
+func LogoutAll(
+	req *http.Request, deviceDB AllDevicesRemover, device *authtypes.Device,
+) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		return httputil.LogThenError(req, err)
 	}
 
-	if err := deviceDB.RemoveDevice(device.ID, localpart); err != nil {
+	if err := deviceDB.RemoveAllDevices(localpart); err != nil {
 		return httputil.LogThenError(req, err)
 	}
 
@@ -0,0 +1,94 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeDeviceDatabase is an in-memory device database mapping access tokens
+// to devices.
+type fakeDeviceDatabase map[string]*authtypes.Device
+
+func (db fakeDeviceDatabase) GetDeviceByAccessToken(token string) (*authtypes.Device, error) {
+	dev, ok := db[token]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return dev, nil
+}
+
+func (db fakeDeviceDatabase) RemoveAllDevices(localpart string) error {
+	for token, dev := range db {
+		devLocalpart, _, err := gomatrixserverlib.SplitID('@', dev.UserID)
+		if err != nil {
+			return err
+		}
+		if devLocalpart == localpart {
+			delete(db, token)
+		}
+	}
+	return nil
+}
+
+func TestLogoutAllRevokesEveryAccessToken(t *testing.T) {
+	alice := &authtypes.Device{ID: "device1", UserID: "@alice:localhost", AccessToken: "token1"}
+	bob := &authtypes.Device{ID: "device3", UserID: "@bob:localhost", AccessToken: "token3"}
+	db := fakeDeviceDatabase{
+		"token1": alice,
+		"token2": {ID: "device2", UserID: "@alice:localhost", AccessToken: "token2"},
+		"token3": bob,
+	}
+
+	for token := range db {
+		req := httptest.NewRequest("GET", "/sync?access_token="+token, nil)
+		if _, resErr := auth.VerifyAccessToken(req, db); resErr != nil {
+			t.Fatalf("VerifyAccessToken(%s) before logout: want no error, got %+v", token, resErr)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/logout/all?access_token=token1", nil)
+	if res := LogoutAll(req, db, alice); res.Code != 200 {
+		t.Fatalf("LogoutAll: want code 200, got %d: %+v", res.Code, res.JSON)
+	}
+
+	for _, token := range []string{"token1", "token2"} {
+		req = httptest.NewRequest("GET", "/sync?access_token="+token, nil)
+		_, resErr := auth.VerifyAccessToken(req, db)
+		if resErr == nil {
+			t.Fatalf("VerifyAccessToken(%s) after logout: want an error, got none", token)
+		}
+		if resErr.Code != 401 {
+			t.Errorf("VerifyAccessToken(%s) after logout: want code 401, got %d", token, resErr.Code)
+		}
+		matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError)
+		if !ok || matrixErr.ErrCode != "M_UNKNOWN_TOKEN" {
+			t.Errorf("VerifyAccessToken(%s) after logout: want M_UNKNOWN_TOKEN, got %+v", token, resErr.JSON)
+		}
+	}
+
+	// Other users stay logged in.
+	req = httptest.NewRequest("GET", "/sync?access_token=token3", nil)
+	if _, resErr := auth.VerifyAccessToken(req, db); resErr != nil {
+		t.Errorf("VerifyAccessToken(token3) after another user logged out: want no error, got %+v", resErr)
+	}
+}
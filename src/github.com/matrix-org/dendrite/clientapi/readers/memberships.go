@@ -15,13 +15,14 @@
 package readers
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
-	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -31,19 +32,30 @@ type response struct {
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
 }
 
-// GetMemberships implements GET /rooms/{roomId}/members
-func GetMemberships(
-	req *http.Request, device *authtypes.Device, roomID string, joinedOnly bool,
-	accountDB *accounts.Database, cfg config.Dendrite,
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#get-matrix-client-r0-rooms-roomid-joined-members
+type joinedMembersResponse struct {
+	Joined map[string]joinedMember `json:"joined"`
+}
+
+type joinedMember struct {
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// GetJoinedMembers implements GET /rooms/{roomId}/joined_members
+// The profiles returned are the ones in the m.room.member events of the
+// members, not their current profiles.
+func GetJoinedMembers(
+	req *http.Request, device *authtypes.Device, roomID string,
 	queryAPI api.RoomserverQueryAPI,
 ) util.JSONResponse {
 	queryReq := api.QueryMembershipsForRoomRequest{
-		JoinedOnly: joinedOnly,
+		JoinedOnly: true,
 		RoomID:     roomID,
 		Sender:     device.UserID,
 	}
 	var queryRes api.QueryMembershipsForRoomResponse
-	if err := queryAPI.QueryMembershipsForRoom(&queryReq, &queryRes); err != nil {
+	if err := queryAPI.QueryMembershipsForRoom(req.Context(), &queryReq, &queryRes); err != nil {
 		return httputil.LogThenError(req, err)
 	}
 
@@ -54,8 +66,101 @@ func GetMemberships(
 		}
 	}
 
+	res := joinedMembersResponse{Joined: map[string]joinedMember{}}
+	for _, ev := range queryRes.JoinEvents {
+		if ev.StateKey == nil {
+			continue
+		}
+		var content common.MemberContent
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		res.Joined[*ev.StateKey] = joinedMember{
+			DisplayName: content.DisplayName,
+			AvatarURL:   content.AvatarURL,
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// GetMembers implements GET /rooms/{roomId}/members
+// The optional "membership" query parameter restricts the returned events to
+// the members with that membership.
+func GetMembers(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	membership := req.URL.Query().Get("membership")
+	switch membership {
+	case "", "join", "leave", "ban", "invite":
+	default:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Unknown membership " + membership),
+		}
+	}
+
+	if resErr := checkCanReadState(req, device, roomID, queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	memberEvents, err := getCurrentState(req.Context(), api.QueryCurrentStateRequest{
+		RoomID:     roomID,
+		EventTypes: []string{"m.room.member"},
+	}, queryAPI)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	chunk := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range memberEvents {
+		if membership != "" {
+			evMembership, err := ev.Membership()
+			if err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			if evMembership != membership {
+				continue
+			}
+		}
+		chunk = append(chunk, gomatrixserverlib.ToClientEvent(ev, gomatrixserverlib.FormatAll))
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: response{chunk},
+	}
+}
+
+type joinedRoomsResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+}
+
+// GetJoinedRooms implements GET /joined_rooms
+func GetJoinedRooms(
+	req *http.Request, device *authtypes.Device, accountDB *accounts.Database,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := joinedRoomsResponse{JoinedRooms: make([]string, len(memberships))}
+	for i, membership := range memberships {
+		res.JoinedRooms[i] = membership.RoomID
+	}
+
 	return util.JSONResponse{
 		Code: 200,
-		JSON: response{queryRes.JoinEvents},
+		JSON: res,
 	}
 }
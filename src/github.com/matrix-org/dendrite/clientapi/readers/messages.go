@@ -0,0 +1,159 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultMessagesLimit = 10
+	maxMessagesLimit     = 100
+	// How many times we ask the room server for more events when the filter
+	// or the history visibility hide the ones it returned.
+	maxMessagesQueries = 10
+)
+
+type messagesResponse struct {
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+// GetMessages implements GET /rooms/{roomID}/messages
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-rooms-roomid-messages
+// The pagination tokens are positions in the room server's event stream.
+func GetMessages(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+
+	var backwards bool
+	switch query.Get("dir") {
+	case "b":
+		backwards = true
+	case "f":
+	default:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("dir must be either 'b' or 'f'"),
+		}
+	}
+
+	from, resErr := parseMessagesToken(query.Get("from"), "from")
+	if resErr != nil {
+		return *resErr
+	}
+	to, resErr := parseMessagesToken(query.Get("to"), "to")
+	if resErr != nil {
+		return *resErr
+	}
+
+	limit := defaultMessagesLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+	}
+
+	var filter authtypes.RoomEventFilter
+	if s := query.Get("filter"); s != "" {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The filter is not valid JSON: " + err.Error()),
+			}
+		}
+	}
+
+	res := messagesResponse{Chunk: []gomatrixserverlib.ClientEvent{}}
+	pos := from
+	for i := 0; i < maxMessagesQueries && len(res.Chunk) < limit; i++ {
+		queryReq := api.QueryEventsByRangeRequest{
+			RoomID:    roomID,
+			UserID:    device.UserID,
+			From:      pos,
+			To:        to,
+			Backwards: backwards,
+			Limit:     limit - len(res.Chunk),
+		}
+		var queryRes api.QueryEventsByRangeResponse
+		if err := queryAPI.QueryEventsByRange(req.Context(), &queryReq, &queryRes); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if !queryRes.RoomExists {
+			return util.JSONResponse{
+				Code: 404,
+				JSON: jsonerror.NotFound("Room not found"),
+			}
+		}
+		if i == 0 {
+			res.Start = strconv.FormatInt(queryRes.Start, 10)
+		}
+		for _, event := range queryRes.Events {
+			if filter.AllowsEvent(event.Type(), event.Sender()) {
+				res.Chunk = append(res.Chunk, gomatrixserverlib.ToClientEvent(event, gomatrixserverlib.FormatAll))
+			}
+		}
+		if queryRes.End == pos {
+			// There are no more events in that direction.
+			break
+		}
+		pos = queryRes.End
+	}
+	res.End = strconv.FormatInt(pos, 10)
+	if err := common.AddRelations(req.Context(), queryAPI, device.UserID, res.Chunk, gomatrixserverlib.FormatAll); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// parseMessagesToken parses a pagination token given in the query parameter
+// with the given name. An empty token is parsed as 0.
+func parseMessagesToken(token, param string) (int64, *util.JSONResponse) {
+	if token == "" {
+		return 0, nil
+	}
+	pos, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || pos < 0 {
+		return 0, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid " + param + " token"),
+		}
+	}
+	return pos, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of notifications returned when the request doesn't say.
+const defaultNotificationsLimit = 20
+
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#get-matrix-client-r0-notifications
+type notificationsResponse struct {
+	NextToken     string         `json:"next_token,omitempty"`
+	Notifications []notification `json:"notifications"`
+}
+
+type notification struct {
+	Actions json.RawMessage             `json:"actions"`
+	Event   json.RawMessage             `json:"event"`
+	Read    bool                        `json:"read"`
+	RoomID  string                      `json:"room_id"`
+	TS      gomatrixserverlib.Timestamp `json:"ts"`
+}
+
+// GetNotifications implements GET /notifications
+// Notifications are removed from the history once the user sends a read
+// receipt for a later event of the room, so the notifications returned are
+// never read.
+func GetNotifications(
+	req *http.Request, device *authtypes.Device, accountDB *accounts.Database,
+) util.JSONResponse {
+	var from int64
+	if fromStr := req.URL.Query().Get("from"); fromStr != "" {
+		var err error
+		if from, err = strconv.ParseInt(fromStr, 10, 64); err != nil || from <= 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("from must be a token returned in next_token"),
+			}
+		}
+	}
+	limit := defaultNotificationsLimit
+	if limitStr := req.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	onlyHighlight := req.URL.Query().Get("only") == "highlight"
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	notifications, err := accountDB.GetNotifications(localpart, from, limit, onlyHighlight)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := notificationsResponse{Notifications: []notification{}}
+	for _, n := range notifications {
+		res.Notifications = append(res.Notifications, notification{
+			Actions: n.Actions,
+			Event:   n.Event,
+			RoomID:  n.RoomID,
+			TS:      n.Timestamp,
+		})
+	}
+	// There may be more notifications if the page is full.
+	if len(notifications) == limit {
+		res.NextToken = strconv.FormatInt(notifications[len(notifications)-1].ID, 10)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
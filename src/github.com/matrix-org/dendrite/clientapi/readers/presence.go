@@ -0,0 +1,111 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type presenceResponse struct {
+	Presence        string `json:"presence"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	CurrentlyActive bool   `json:"currently_active"`
+}
+
+// GetPresence implements GET /presence/{userID}/status
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-presence-userid-status
+// Users can only see the presence of the users they share a room with. Users
+// whose presence isn't known are offline.
+func GetPresence(
+	req *http.Request, device *authtypes.Device, userID string,
+	accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if userID != device.UserID {
+		shared, err := shareRoom(req, device, userID, accountDB, queryAPI)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if !shared {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("You don't share a room with this user"),
+			}
+		}
+	}
+
+	presence, err := accountDB.GetPresence(userID)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: 200,
+			JSON: presenceResponse{Presence: authtypes.PresenceOffline},
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: presenceResponse{
+			Presence:        presence.Presence,
+			LastActiveAgo:   int64(time.Since(presence.LastActiveTS.Time()) / time.Millisecond),
+			StatusMsg:       presence.StatusMsg,
+			CurrentlyActive: presence.Presence == authtypes.PresenceOnline,
+		},
+	}
+}
+
+// shareRoom returns whether the user with the given ID is joined to one of the
+// rooms the user of the device is joined to.
+func shareRoom(
+	req *http.Request, device *authtypes.Device, userID string,
+	accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+) (bool, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return false, err
+	}
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range memberships {
+		queryReq := api.QueryMembershipRequest{RoomID: m.RoomID, UserID: userID}
+		var queryRes api.QueryMembershipResponse
+		if err = queryAPI.QueryMembership(req.Context(), &queryReq, &queryRes); err != nil {
+			return false, err
+		}
+		if queryRes.Membership == "join" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -15,17 +15,22 @@
 package readers
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/appservice/query"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/events"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/profiles"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
@@ -46,7 +51,8 @@ type displayName struct {
 
 // GetProfile implements GET /profile/{userID}
 func GetProfile(
-	req *http.Request, accountDB *accounts.Database, userID string,
+	req *http.Request, accountDB *accounts.Database, cfg *config.Dendrite,
+	profileCache *profiles.Cache, httpClient *http.Client, userID string,
 ) util.JSONResponse {
 	if req.Method != "GET" {
 		return util.JSONResponse{
@@ -54,14 +60,9 @@ func GetProfile(
 			JSON: jsonerror.NotFound("Bad method"),
 		}
 	}
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	profile, err := accountDB.GetProfileByLocalpart(localpart)
-	if err != nil {
-		return httputil.LogThenError(req, err)
+	profile, resErr := getProfile(req, accountDB, cfg, profileCache, httpClient, userID)
+	if resErr != nil {
+		return *resErr
 	}
 	res := profileResponse{
 		AvatarURL:   profile.AvatarURL,
@@ -75,16 +76,12 @@ func GetProfile(
 
 // GetAvatarURL implements GET /profile/{userID}/avatar_url
 func GetAvatarURL(
-	req *http.Request, accountDB *accounts.Database, userID string,
+	req *http.Request, accountDB *accounts.Database, cfg *config.Dendrite,
+	profileCache *profiles.Cache, httpClient *http.Client, userID string,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	profile, err := accountDB.GetProfileByLocalpart(localpart)
-	if err != nil {
-		return httputil.LogThenError(req, err)
+	profile, resErr := getProfile(req, accountDB, cfg, profileCache, httpClient, userID)
+	if resErr != nil {
+		return *resErr
 	}
 	res := avatarURL{
 		AvatarURL: profile.AvatarURL,
@@ -135,23 +132,13 @@ func SetAvatarURL(
 		return httputil.LogThenError(req, err)
 	}
 
-	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
 	newProfile := authtypes.Profile{
 		Localpart:   localpart,
 		DisplayName: oldProfile.DisplayName,
 		AvatarURL:   r.AvatarURL,
 	}
 
-	events, err := buildMembershipEvents(memberships, accountDB, newProfile, userID, cfg, queryAPI)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	if err := rsProducer.SendEvents(events, cfg.Matrix.ServerName); err != nil {
+	if err = propagateProfileUpdate(req.Context(), accountDB, newProfile, userID, cfg, rsProducer, queryAPI); err != nil {
 		return httputil.LogThenError(req, err)
 	}
 
@@ -167,16 +154,12 @@ func SetAvatarURL(
 
 // GetDisplayName implements GET /profile/{userID}/displayname
 func GetDisplayName(
-	req *http.Request, accountDB *accounts.Database, userID string,
+	req *http.Request, accountDB *accounts.Database, cfg *config.Dendrite,
+	profileCache *profiles.Cache, httpClient *http.Client, userID string,
 ) util.JSONResponse {
-	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	profile, err := accountDB.GetProfileByLocalpart(localpart)
-	if err != nil {
-		return httputil.LogThenError(req, err)
+	profile, resErr := getProfile(req, accountDB, cfg, profileCache, httpClient, userID)
+	if resErr != nil {
+		return *resErr
 	}
 	res := displayName{
 		DisplayName: profile.DisplayName,
@@ -227,23 +210,13 @@ func SetDisplayName(
 		return httputil.LogThenError(req, err)
 	}
 
-	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
 	newProfile := authtypes.Profile{
 		Localpart:   localpart,
 		DisplayName: r.DisplayName,
 		AvatarURL:   oldProfile.AvatarURL,
 	}
 
-	events, err := buildMembershipEvents(memberships, accountDB, newProfile, userID, cfg, queryAPI)
-	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	if err := rsProducer.SendEvents(events, cfg.Matrix.ServerName); err != nil {
+	if err = propagateProfileUpdate(req.Context(), accountDB, newProfile, userID, cfg, rsProducer, queryAPI); err != nil {
 		return httputil.LogThenError(req, err)
 	}
 
@@ -257,8 +230,85 @@ func SetDisplayName(
 	}
 }
 
+// getProfile returns the profile of the user with the given ID. If the user is
+// local, the profile is retrieved from the accounts database, after asking the
+// application services managing the user to create it if needed. Otherwise it is
+// requested from the user's server, through the remote profile cache.
+// Returns a JSONResponse with a corresponding error code and message if the
+// user ID is invalid, if the user doesn't exist or if something went wrong.
+func getProfile(
+	req *http.Request, accountDB *accounts.Database, cfg *config.Dendrite,
+	profileCache *profiles.Cache, httpClient *http.Client, userID string,
+) (*authtypes.Profile, *util.JSONResponse) {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid user ID " + userID),
+		}
+	}
+
+	var profile *authtypes.Profile
+	if serverName == cfg.Matrix.ServerName {
+		profile, err = accountDB.GetProfileByLocalpart(localpart)
+		// Give the application services managing the user a chance to
+		// create it before giving up.
+		if err == sql.ErrNoRows && query.UserIDExists(
+			req.Context(), httpClient, cfg.ApplicationServices.Registrations, userID,
+		) {
+			profile, err = accountDB.GetProfileByLocalpart(localpart)
+		}
+	} else {
+		profile, err = profileCache.GetProfile(userID, serverName)
+		if httpErr, ok := err.(gomatrix.HTTPError); ok && httpErr.Code == 404 {
+			err = sql.ErrNoRows
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The user does not exist or does not have a profile"),
+		}
+	} else if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+
+	return profile, nil
+}
+
+// propagateProfileUpdate sends an updated m.room.member event containing the
+// given profile to every room the user is currently joined to, so that the other
+// members of these rooms see the new profile.
+// Returns an error if something went wrong while building or sending the events.
+func propagateProfileUpdate(
+	ctx context.Context, accountDB *accounts.Database, newProfile authtypes.Profile, userID string,
+	cfg *config.Dendrite, rsProducer *producers.RoomserverProducer,
+	queryAPI api.RoomserverQueryAPI,
+) error {
+	memberships, err := accountDB.GetMembershipsByLocalpart(newProfile.Localpart)
+	if err != nil {
+		return err
+	}
+
+	events, err := buildMembershipEvents(ctx, memberships, newProfile, userID, cfg, queryAPI)
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	return rsProducer.SendEvents(events, cfg.Matrix.ServerName)
+}
+
+// buildMembershipEvents builds a "join" m.room.member event containing the given
+// profile for each of the given memberships. Memberships in rooms the room
+// server doesn't know about anymore are skipped.
 func buildMembershipEvents(
-	memberships []authtypes.Membership, db *accounts.Database,
+	ctx context.Context, memberships []authtypes.Membership,
 	newProfile authtypes.Profile, userID string, cfg *config.Dendrite,
 	queryAPI api.RoomserverQueryAPI,
 ) ([]gomatrixserverlib.Event, error) {
@@ -283,8 +333,10 @@ func buildMembershipEvents(
 			return nil, err
 		}
 
-		event, err := events.BuildEvent(&builder, *cfg, queryAPI, nil)
-		if err != nil {
+		event, err := events.BuildEvent(ctx, &builder, *cfg, queryAPI, nil)
+		if err == events.ErrRoomNoExists {
+			continue
+		} else if err != nil {
 			return nil, err
 		}
 
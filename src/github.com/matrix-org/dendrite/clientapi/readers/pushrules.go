@@ -0,0 +1,128 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/push"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// pushRulesScopeGlobal is the only scope of push rules.
+const pushRulesScopeGlobal = "global"
+
+type pushRuleEnabledResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+type pushRuleActionsResponse struct {
+	Actions []interface{} `json:"actions"`
+}
+
+// GetPushRules implements GET /pushrules/
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#get-matrix-client-r0-pushrules
+func GetPushRules(
+	req *http.Request, device *authtypes.Device, accountDB *accounts.Database,
+	cfg config.Dendrite,
+) util.JSONResponse {
+	ruleset, resErr := getPushRuleset(req, device, pushRulesScopeGlobal, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: push.GlobalRuleset{Global: *ruleset},
+	}
+}
+
+// GetPushRulesForScope implements GET /pushrules/{scope}/
+func GetPushRulesForScope(
+	req *http.Request, device *authtypes.Device, scope string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	ruleset, resErr := getPushRuleset(req, device, scope, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ruleset,
+	}
+}
+
+// GetPushRule implements GET /pushrules/{scope}/{kind}/{ruleID}, as well as
+// GET /pushrules/{scope}/{kind}/{ruleID}/enabled and
+// GET /pushrules/{scope}/{kind}/{ruleID}/actions if attr is "enabled" or
+// "actions".
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#get-matrix-client-r0-pushrules-scope-kind-ruleid
+func GetPushRule(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID, attr string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	ruleset, resErr := getPushRuleset(req, device, scope, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := ruleset.Find(kind, ruleID)
+	if rule == nil {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Push rule not found"),
+		}
+	}
+
+	var res interface{} = rule
+	switch attr {
+	case "enabled":
+		res = pushRuleEnabledResponse{rule.Enabled}
+	case "actions":
+		res = pushRuleActionsResponse{rule.Actions}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// getPushRuleset returns the push rules of the user in the given scope.
+func getPushRuleset(
+	req *http.Request, device *authtypes.Device, scope string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) (*push.Ruleset, *util.JSONResponse) {
+	if scope != pushRulesScopeGlobal {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown push rules scope"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+	ruleset, err := push.GetRuleset(accountDB, localpart, cfg.Matrix.ServerName)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+	return ruleset, nil
+}
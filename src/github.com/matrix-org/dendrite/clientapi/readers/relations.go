@@ -0,0 +1,99 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type relationsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// GetRelations implements GET /rooms/{roomID}/relations/{eventID}/{relType}
+// https://spec.matrix.org/v1.3/client-server-api/#get_matrixclientv1roomsroomidrelationseventidreltype
+// The events are returned from the newest to the oldest, and the pagination
+// tokens are positions in the room server's event stream.
+func GetRelations(
+	req *http.Request, device *authtypes.Device, roomID, eventID, relType string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+
+	from, resErr := parseMessagesToken(query.Get("from"), "from")
+	if resErr != nil {
+		return *resErr
+	}
+
+	limit := defaultMessagesLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxMessagesLimit {
+			limit = maxMessagesLimit
+		}
+	}
+
+	queryReq := api.QueryRelationEventsRequest{
+		RoomID:  roomID,
+		EventID: eventID,
+		RelType: relType,
+		UserID:  device.UserID,
+		From:    from,
+		Limit:   limit,
+	}
+	var queryRes api.QueryRelationEventsResponse
+	if err := queryAPI.QueryRelationEvents(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	// Events the user isn't allowed to see are reported as missing so that we
+	// don't leak their existence.
+	if !queryRes.EventExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
+
+	res := relationsResponse{
+		Chunk: gomatrixserverlib.ToClientEvents(queryRes.Events, gomatrixserverlib.FormatAll),
+	}
+	if queryRes.Next != 0 {
+		res.NextBatch = strconv.FormatInt(queryRes.Next, 10)
+	}
+	if err := common.AddRelations(req.Context(), queryAPI, device.UserID, res.Chunk, gomatrixserverlib.FormatAll); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
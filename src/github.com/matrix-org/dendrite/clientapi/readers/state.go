@@ -0,0 +1,159 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// OnIncomingStateRequest implements GET /rooms/{roomID}/state
+func OnIncomingStateRequest(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	if resErr := checkCanReadState(req, device, roomID, queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	stateEvents, err := getCurrentState(req.Context(), api.QueryCurrentStateRequest{RoomID: roomID}, queryAPI)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: gomatrixserverlib.ToClientEvents(stateEvents, gomatrixserverlib.FormatAll),
+	}
+}
+
+// OnIncomingStateTypeRequest implements GET /rooms/{roomID}/state/{eventType}/{stateKey}
+// and GET /rooms/{roomID}/state/{eventType}, in which case stateKey is empty.
+func OnIncomingStateTypeRequest(
+	req *http.Request, device *authtypes.Device, roomID string,
+	eventType string, stateKey string, queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	if resErr := checkCanReadState(req, device, roomID, queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	stateEvents, err := getCurrentState(req.Context(), api.QueryCurrentStateRequest{
+		RoomID:       roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: eventType, StateKey: stateKey}},
+	}, queryAPI)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if len(stateEvents) == 0 {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Cannot find state"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: json.RawMessage(stateEvents[0].Content()),
+	}
+}
+
+// getCurrentState retrieves the events in the current state of a room which
+// match the given request.
+// Returns an error if the roomserver couldn't be queried.
+func getCurrentState(
+	ctx context.Context, stateReq api.QueryCurrentStateRequest, queryAPI api.RoomserverQueryAPI,
+) ([]gomatrixserverlib.Event, error) {
+	var stateRes api.QueryCurrentStateResponse
+	if err := queryAPI.QueryCurrentState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+	if len(stateRes.StateEventIDs) == 0 {
+		return []gomatrixserverlib.Event{}, nil
+	}
+
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: stateRes.StateEventIDs}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+		return nil, err
+	}
+	return eventsRes.Events, nil
+}
+
+// checkCanReadState checks that the user is allowed to read the current state
+// of the room, i.e. that they are joined to it or that its history is world
+// readable.
+// Returns an error response if they aren't, or if the check itself failed.
+func checkCanReadState(
+	req *http.Request, device *authtypes.Device, roomID string,
+	queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.member", StateKey: device.UserID},
+			{EventType: "m.room.history_visibility", StateKey: ""},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &queryReq, &queryRes); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+
+	if !queryRes.RoomExists {
+		return &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+
+	for _, ev := range queryRes.StateEvents {
+		switch ev.Type() {
+		case "m.room.member":
+			membership, err := ev.Membership()
+			if err != nil {
+				resErr := httputil.LogThenError(req, err)
+				return &resErr
+			}
+			if membership == "join" {
+				return nil
+			}
+		case "m.room.history_visibility":
+			var content common.HistoryVisibilityContent
+			if err := json.Unmarshal(ev.Content(), &content); err != nil {
+				resErr := httputil.LogThenError(req, err)
+				return &resErr
+			}
+			if content.HistoryVisibility == "world_readable" {
+				return nil
+			}
+		}
+	}
+
+	return &util.JSONResponse{
+		Code: 403,
+		JSON: jsonerror.Forbidden("You aren't a member of the room"),
+	}
+}
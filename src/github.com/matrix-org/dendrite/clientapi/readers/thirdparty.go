@@ -0,0 +1,164 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/appservice/query"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+// thirdPartyProtocol is the description of a third party protocol returned
+// by the application services bridging it.
+type thirdPartyProtocol struct {
+	UserFields     []string                   `json:"user_fields"`
+	LocationFields []string                   `json:"location_fields"`
+	Icon           string                     `json:"icon"`
+	FieldTypes     map[string]json.RawMessage `json:"field_types"`
+	Instances      []json.RawMessage          `json:"instances"`
+}
+
+// GetThirdPartyProtocols implements GET /thirdparty/protocols
+// It returns the protocols bridged by the application services, with the
+// instances of every application service bridging each of them.
+func GetThirdPartyProtocols(
+	req *http.Request, cfg config.Dendrite, httpClient *http.Client,
+) util.JSONResponse {
+	protocols := map[string]*thirdPartyProtocol{}
+	for i := range cfg.ApplicationServices.Registrations {
+		registration := &cfg.ApplicationServices.Registrations[i]
+		for _, protocol := range registration.Protocols {
+			queryThirdPartyProtocol(req.Context(), httpClient, registration, protocol, protocols)
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: protocols,
+	}
+}
+
+// GetThirdPartyProtocol implements GET /thirdparty/protocol/{protocol}
+func GetThirdPartyProtocol(
+	req *http.Request, protocol string, cfg config.Dendrite, httpClient *http.Client,
+) util.JSONResponse {
+	protocols := map[string]*thirdPartyProtocol{}
+	for i := range cfg.ApplicationServices.Registrations {
+		registration := &cfg.ApplicationServices.Registrations[i]
+		if bridgesProtocol(registration, protocol) {
+			queryThirdPartyProtocol(req.Context(), httpClient, registration, protocol, protocols)
+		}
+	}
+	if protocols[protocol] == nil {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown protocol"),
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: protocols[protocol],
+	}
+}
+
+// GetThirdPartyUsers implements GET /thirdparty/user/{protocol}
+// It returns the users of the third party network matching the fields in the
+// query string, according to the application services bridging it.
+func GetThirdPartyUsers(
+	req *http.Request, protocol string, cfg config.Dendrite, httpClient *http.Client,
+) util.JSONResponse {
+	return lookupThirdParty(req, "user", protocol, cfg, httpClient)
+}
+
+// GetThirdPartyLocations implements GET /thirdparty/location/{protocol}
+// It returns the portal rooms to the locations of the third party network
+// matching the fields in the query string, according to the application
+// services bridging it.
+func GetThirdPartyLocations(
+	req *http.Request, protocol string, cfg config.Dendrite, httpClient *http.Client,
+) util.JSONResponse {
+	return lookupThirdParty(req, "location", protocol, cfg, httpClient)
+}
+
+// lookupThirdParty asks every application service bridging the protocol for
+// the users or locations matching the query string, and concatenates their
+// answers. Application services which fail to answer are skipped.
+func lookupThirdParty(
+	req *http.Request, kind, protocol string, cfg config.Dendrite, httpClient *http.Client,
+) util.JSONResponse {
+	fields := req.URL.Query()
+	fields.Del("access_token")
+
+	results := []json.RawMessage{}
+	for i := range cfg.ApplicationServices.Registrations {
+		registration := &cfg.ApplicationServices.Registrations[i]
+		if !bridgesProtocol(registration, protocol) {
+			continue
+		}
+		var asResults []json.RawMessage
+		path := "/_matrix/app/v1/thirdparty/" + kind + "/" + url.PathEscape(protocol)
+		if err := query.Get(req.Context(), httpClient, registration, path, fields, &asResults); err != nil {
+			common.GetLogger(req.Context()).WithError(err).WithField("appservice", registration.ID).
+				Warnf("Failed to look up third party %s", kind)
+			continue
+		}
+		results = append(results, asResults...)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: results,
+	}
+}
+
+// queryThirdPartyProtocol asks the application service for its description of
+// the protocol and adds it to the protocols. The instances of application
+// services bridging the same protocol are merged.
+func queryThirdPartyProtocol(
+	ctx context.Context, httpClient *http.Client,
+	registration *config.ApplicationService, protocol string,
+	protocols map[string]*thirdPartyProtocol,
+) {
+	var res thirdPartyProtocol
+	path := "/_matrix/app/v1/thirdparty/protocol/" + url.PathEscape(protocol)
+	if err := query.Get(ctx, httpClient, registration, path, url.Values{}, &res); err != nil {
+		common.GetLogger(ctx).WithError(err).WithField("appservice", registration.ID).
+			Warnf("Failed to query third party protocol %q", protocol)
+		return
+	}
+	if res.Instances == nil {
+		res.Instances = []json.RawMessage{}
+	}
+	if existing, ok := protocols[protocol]; ok {
+		existing.Instances = append(existing.Instances, res.Instances...)
+		return
+	}
+	protocols[protocol] = &res
+}
+
+// bridgesProtocol returns whether the application service bridges the protocol.
+func bridgesProtocol(registration *config.ApplicationService, protocol string) bool {
+	for _, p := range registration.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/util"
+)
+
+// supportedVersions are the versions of the client-server spec this server
+// implements, as advertised to clients.
+var supportedVersions = []string{
+	"r0.0.1",
+	"r0.1.0",
+	"r0.2.0",
+}
+
+// unstableFeatures are the unstable features this server implements, mapped
+// to whether they are enabled.
+var unstableFeatures = map[string]bool{}
+
+type versionsResponse struct {
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features"`
+}
+
+// GetVersions implements GET /versions
+func GetVersions(req *http.Request) util.JSONResponse {
+	return util.JSONResponse{
+		Code: 200,
+		JSON: versionsResponse{
+			Versions:         supportedVersions,
+			UnstableFeatures: unstableFeatures,
+		},
+	}
+}
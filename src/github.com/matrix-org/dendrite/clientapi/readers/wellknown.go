@@ -0,0 +1,52 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+type wellKnownBaseURL struct {
+	BaseURL string `json:"base_url"`
+}
+
+type wellKnownClientResponse struct {
+	Homeserver     wellKnownBaseURL  `json:"m.homeserver"`
+	IdentityServer *wellKnownBaseURL `json:"m.identity_server,omitempty"`
+}
+
+// GetWellKnownClient implements GET /.well-known/matrix/client
+// Browsers can fetch it from other origins, since the CORS headers are set on
+// every JSON response.
+func GetWellKnownClient(req *http.Request, cfg config.Dendrite) util.JSONResponse {
+	wellKnown := cfg.Matrix.WellKnownClient
+	if wellKnown.HomeserverBaseURL == "" {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("No .well-known file for this server"),
+		}
+	}
+	res := wellKnownClientResponse{
+		Homeserver: wellKnownBaseURL{BaseURL: wellKnown.HomeserverBaseURL},
+	}
+	if wellKnown.IdentityServerBaseURL != "" {
+		res.IdentityServer = &wellKnownBaseURL{BaseURL: wellKnown.IdentityServerBaseURL}
+	}
+	return util.JSONResponse{Code: 200, JSON: res}
+}
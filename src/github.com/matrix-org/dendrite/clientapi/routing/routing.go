@@ -20,22 +20,32 @@ import (
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/admin"
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/profiles"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
 	"github.com/matrix-org/dendrite/clientapi/readers"
+	"github.com/matrix-org/dendrite/clientapi/servernotices"
 	"github.com/matrix-org/dendrite/clientapi/writers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 const pathPrefixR0 = "/_matrix/client/r0"
+const pathPrefixV1 = "/_matrix/client/v1"
 const pathPrefixUnstable = "/_matrix/client/unstable"
+const pathPrefixSynapseAdminV1 = "/_synapse/admin/v1"
+const pathPrefixAdminV1 = "/_dendrite/admin/v1"
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
 // to clients which need to make outbound HTTP requests.
@@ -43,39 +53,56 @@ func Setup(
 	apiMux *mux.Router, httpClient *http.Client, cfg config.Dendrite,
 	producer *producers.RoomserverProducer, queryAPI api.RoomserverQueryAPI,
 	aliasAPI api.RoomserverAliasAPI,
+	receiptAPI api.RoomserverReceiptAPI,
 	accountDB *accounts.Database,
 	deviceDB *devices.Database,
-	federation *gomatrixserverlib.FederationClient,
+	federation *federationclient.Client,
 	keyRing gomatrixserverlib.KeyRing,
 	userUpdateProducer *producers.UserUpdateProducer,
 	syncProducer *producers.SyncAPIProducer,
+	typingProducer *producers.TypingProducer,
+	receiptProducer *producers.ReceiptProducer,
+	deviceListProducer *producers.DeviceListProducer,
+	presenceProducer *producers.PresenceProducer,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
 ) {
 
 	apiMux.Handle("/_matrix/client/versions",
 		common.MakeAPI("versions", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{
-				Code: 200,
-				JSON: struct {
-					Versions []string `json:"versions"`
-				}{[]string{
-					"r0.0.1",
-					"r0.1.0",
-					"r0.2.0",
-				}},
-			}
+			return readers.GetVersions(req)
 		}),
-	)
+	).Methods("GET", "OPTIONS")
+
+	apiMux.Handle("/.well-known/matrix/client",
+		common.MakeAPI("wellknown_client", func(req *http.Request) util.JSONResponse {
+			return readers.GetWellKnownClient(req, cfg)
+		}),
+	).Methods("GET", "OPTIONS")
 
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
+	v1mux := apiMux.PathPrefix(pathPrefixV1).Subrouter()
 	unstableMux := apiMux.PathPrefix(pathPrefixUnstable).Subrouter()
+	// The admin API has the same paths as Synapse's, for compatibility
+	// with existing tools.
+	adminMux := apiMux.PathPrefix(pathPrefixSynapseAdminV1).Subrouter()
+	dendriteAdminMux := apiMux.PathPrefix(pathPrefixAdminV1).Subrouter()
+
+	// Application services can use their as_token as an access token.
+	authDeviceDB := auth.NewAppServiceDeviceDatabase(deviceDB, cfg.ApplicationServices.Registrations)
+	membershipLimiter := ratelimit.NewLimiter(cfg.RateLimiting.Membership)
+	eventLimiter := ratelimit.NewEventLimiter(cfg.RateLimiting.Messages, cfg.RateLimiting.StateEvents)
+	profileCache := profiles.NewCache(federation, cfg.Matrix.RemoteProfileCacheTTL)
+	uiaSessions := uia.NewSessions(accountDB, cfg.Matrix.UserInteractiveAuthTimeout)
+	registrationSessions := writers.NewRegistrationSessions(cfg.Matrix.UserInteractiveAuthTimeout)
+	serverNotices := servernotices.NewSender(cfg, accountDB, producer, queryAPI, syncProducer)
 
 	r0mux.Handle("/createRoom",
-		common.MakeAuthAPI("createRoom", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
-			return writers.CreateRoom(req, device, cfg, producer, accountDB)
+		common.MakeAuthAPI("createRoom", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.CreateRoom(req, device, cfg, producer, accountDB, aliasAPI)
 		}),
 	)
 	r0mux.Handle("/join/{roomIDOrAlias}",
-		common.MakeAuthAPI("join", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("join", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return writers.JoinRoomByIDOrAlias(
 				req, device, vars["roomIDOrAlias"], cfg, federation, producer, queryAPI, aliasAPI, keyRing, accountDB,
@@ -83,133 +110,261 @@ func Setup(
 		}),
 	)
 	r0mux.Handle("/rooms/{roomID}/{membership:(?:join|kick|ban|unban|leave|invite)}",
-		common.MakeAuthAPI("membership", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("membership", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			if vars["membership"] == "join" {
+				// Joins may need to go over federation if we aren't in the
+				// room yet, which is handled the same way as for /join.
+				return writers.JoinRoomByIDOrAlias(
+					req, device, vars["roomID"], cfg, federation, producer, queryAPI, aliasAPI, keyRing, accountDB,
+				)
+			}
+			return writers.SendMembership(
+				req, accountDB, device, vars["roomID"], vars["membership"], cfg, queryAPI, producer,
+				membershipLimiter,
+			)
+		}),
+	).Methods("POST", "OPTIONS")
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		common.MakeAuthAPI("upgrade_room", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return writers.SendMembership(req, accountDB, device, vars["roomID"], vars["membership"], cfg, queryAPI, producer)
+			return writers.UpgradeRoom(req, device, vars["roomID"], cfg, queryAPI, producer, accountDB)
 		}),
 	).Methods("POST", "OPTIONS")
+	r0mux.Handle("/rooms/{roomID}/redact/{eventID}/{txnID}",
+		common.MakeAuthAPI("redact", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SendRedaction(req, device, vars["roomID"], vars["eventID"], vars["txnID"], cfg, queryAPI, producer, accountDB, eventLimiter)
+		}),
+	).Methods("PUT", "POST", "OPTIONS")
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
-		common.MakeAuthAPI("send_message", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("send_message", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return writers.SendEvent(req, device, vars["roomID"], vars["eventType"], vars["txnID"], nil, cfg, queryAPI, producer)
+			return writers.SendEvent(req, device, vars["roomID"], vars["eventType"], vars["txnID"], nil, cfg, queryAPI, producer, accountDB, eventLimiter)
 		}),
 	)
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
-		common.MakeAuthAPI("send_message", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("send_message", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			emptyString := ""
 			eventType := vars["eventType"]
 			// If there's a trailing slash, remove it
 			if strings.HasSuffix(eventType, "/") {
 				eventType = eventType[:len(eventType)-1]
 			}
-			return writers.SendEvent(req, device, vars["roomID"], eventType, "", &emptyString, cfg, queryAPI, producer)
+			return writers.SendStateEvent(req, device, vars["roomID"], eventType, "", cfg, queryAPI, producer, accountDB, eventLimiter)
 		}),
-	)
+	).Methods("PUT", "OPTIONS")
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
-		common.MakeAuthAPI("send_message", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("send_message", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			stateKey := vars["stateKey"]
-			return writers.SendEvent(req, device, vars["roomID"], vars["eventType"], "", &stateKey, cfg, queryAPI, producer)
+			return writers.SendStateEvent(req, device, vars["roomID"], vars["eventType"], vars["stateKey"], cfg, queryAPI, producer, accountDB, eventLimiter)
 		}),
-	)
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/rooms/{roomID}/messages",
+		common.MakeAuthAPI("room_messages", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetMessages(req, device, vars["roomID"], queryAPI)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
+		common.MakeAuthAPI("room_event", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetEvent(req, device, vars["roomID"], vars["eventID"], queryAPI)
+		}),
+	).Methods("GET")
+
+	v1mux.Handle("/rooms/{roomID}/relations/{eventID}/{relType}",
+		common.MakeAuthAPI("room_relations", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetRelations(req, device, vars["roomID"], vars["eventID"], vars["relType"], queryAPI)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}",
+		common.MakeAuthAPI("room_context", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetContext(req, device, vars["roomID"], vars["eventID"], queryAPI)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/rooms/{roomID}/state",
+		common.MakeAuthAPI("room_state", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.OnIncomingStateRequest(req, device, vars["roomID"], queryAPI)
+		}),
+	).Methods("GET")
+	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
+		common.MakeAuthAPI("room_state", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			eventType := strings.TrimSuffix(vars["eventType"], "/")
+			return readers.OnIncomingStateTypeRequest(req, device, vars["roomID"], eventType, "", queryAPI)
+		}),
+	).Methods("GET")
+	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
+		common.MakeAuthAPI("room_state", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.OnIncomingStateTypeRequest(req, device, vars["roomID"], vars["eventType"], vars["stateKey"], queryAPI)
+		}),
+	).Methods("GET")
 
 	r0mux.Handle("/register", common.MakeAPI("register", func(req *http.Request) util.JSONResponse {
-		return writers.Register(req, accountDB, deviceDB)
-	}))
+		return writers.Register(req, accountDB, deviceDB, cfg, registrationSessions)
+	})).Methods("POST", "OPTIONS")
 
 	r0mux.Handle("/directory/room/{roomAlias}",
-		common.MakeAuthAPI("directory_room", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("directory_room", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.DirectoryRoom(req, device, vars["roomAlias"], federation, &cfg, aliasAPI)
+			return readers.DirectoryRoom(req, device, vars["roomAlias"], federation, &cfg, aliasAPI, httpClient)
 		}),
 	).Methods("GET")
 
 	r0mux.Handle("/directory/room/{roomAlias}",
-		common.MakeAuthAPI("directory_room", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("directory_room", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return readers.SetLocalAlias(req, device, vars["roomAlias"], &cfg, aliasAPI)
 		}),
 	).Methods("PUT", "OPTIONS")
 
 	r0mux.Handle("/directory/room/{roomAlias}",
-		common.MakeAuthAPI("directory_room", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("directory_room", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.RemoveLocalAlias(req, device, vars["roomAlias"], &cfg, aliasAPI)
+			return readers.RemoveLocalAlias(req, device, vars["roomAlias"], &cfg, aliasAPI, queryAPI)
 		}),
 	).Methods("DELETE")
 
 	r0mux.Handle("/logout",
-		common.MakeAuthAPI("logout", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("logout", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			return readers.Logout(req, deviceDB, device)
 		}),
-	)
+	).Methods("POST", "OPTIONS")
 
-	// Stub endpoints required by Riot
+	r0mux.Handle("/logout/all",
+		common.MakeAuthAPI("logout_all", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.LogoutAll(req, deviceDB, device)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/devices",
+		common.MakeAuthAPI("get_devices", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetDevicesByLocalpart(req, deviceDB, device)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/devices/{deviceID}",
+		common.MakeAuthAPI("get_device", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetDeviceByID(req, deviceDB, device, vars["deviceID"])
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/devices/{deviceID}",
+		common.MakeAuthAPI("device_data", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.UpdateDeviceByID(req, deviceDB, accountDB, device, vars["deviceID"], deviceListProducer)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/devices/{deviceID}",
+		common.MakeAuthAPI("delete_device", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.DeleteDeviceByID(
+				req, deviceDB, accountDB, device, vars["deviceID"], uiaSessions, deviceListProducer,
+			)
+		}),
+	).Methods("DELETE")
+
+	r0mux.Handle("/keys/upload",
+		common.MakeAuthAPI("upload_keys", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.UploadKeys(req, deviceDB, accountDB, device, deviceListProducer)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/keys/query",
+		common.MakeAuthAPI("query_keys", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.QueryKeys(req, device, cfg, accountDB, deviceDB, federation)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/keys/device_signing/upload",
+		common.MakeAuthAPI("upload_signing_keys", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.UploadSigningKeys(req, accountDB, device, uiaSessions, deviceListProducer)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/keys/claim",
+		common.MakeAuthAPI("claim_keys", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.ClaimKeys(req, cfg, deviceDB, federation)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/capabilities",
+		common.MakeAuthAPI("capabilities", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetCapabilities(req, cfg)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/account/password",
+		common.MakeAuthAPI("change_password", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.ChangePassword(req, accountDB, deviceDB, device, uiaSessions, cfg)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/account/deactivate",
+		common.MakeAuthAPI("deactivate_account", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.DeactivateAccount(
+				req, accountDB, deviceDB, device, uiaSessions, cfg, queryAPI, producer,
+			)
+		}),
+	).Methods("POST", "OPTIONS")
 
 	r0mux.Handle("/login",
-		common.MakeAPI("login", func(req *http.Request) util.JSONResponse {
-			return readers.Login(req, accountDB, deviceDB, cfg)
+		common.MakeAPI("login_flows", func(req *http.Request) util.JSONResponse {
+			return readers.GetLoginFlows(req)
 		}),
-	)
+	).Methods("GET", "OPTIONS")
 
-	r0mux.Handle("/pushrules/",
-		common.MakeAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: 200,
-				JSON: &res,
-			}
+	r0mux.Handle("/login",
+		common.MakeAPI("login", func(req *http.Request) util.JSONResponse {
+			return readers.PostLogin(req, accountDB, deviceDB, cfg)
 		}),
-	)
+	).Methods("POST")
+
+	// Stub endpoints required by Riot
 
 	r0mux.Handle("/user/{userID}/filter",
-		common.MakeAPI("make_filter", func(req *http.Request) util.JSONResponse {
-			// TODO: Persist filter and return filter ID
-			return util.JSONResponse{
-				Code: 200,
-				JSON: struct{}{},
-			}
+		common.MakeAuthAPI("put_filter", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.CreateFilter(req, accountDB, device, vars["userID"])
 		}),
-	)
+	).Methods("POST", "OPTIONS")
 
 	r0mux.Handle("/user/{userID}/filter/{filterID}",
-		common.MakeAPI("filter", func(req *http.Request) util.JSONResponse {
-			// TODO: Retrieve filter based on ID
-			return util.JSONResponse{
-				Code: 200,
-				JSON: struct{}{},
-			}
+		common.MakeAuthAPI("get_filter", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.GetFilter(req, accountDB, device, vars["userID"], vars["filterID"])
 		}),
-	)
+	).Methods("GET")
 
 	// Riot user settings
 
 	r0mux.Handle("/profile/{userID}",
 		common.MakeAPI("profile", func(req *http.Request) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.GetProfile(req, accountDB, vars["userID"])
+			return readers.GetProfile(req, accountDB, &cfg, profileCache, httpClient, vars["userID"])
 		}),
 	)
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
 		common.MakeAPI("profile_avatar_url", func(req *http.Request) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.GetAvatarURL(req, accountDB, vars["userID"])
+			return readers.GetAvatarURL(req, accountDB, &cfg, profileCache, httpClient, vars["userID"])
 		}),
 	).Methods("GET")
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
-		common.MakeAuthAPI("profile_avatar_url", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("profile_avatar_url", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return readers.SetAvatarURL(req, accountDB, device, vars["userID"], userUpdateProducer, &cfg, producer, queryAPI)
 		}),
@@ -220,12 +375,12 @@ func Setup(
 	r0mux.Handle("/profile/{userID}/displayname",
 		common.MakeAPI("profile_displayname", func(req *http.Request) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.GetDisplayName(req, accountDB, vars["userID"])
+			return readers.GetDisplayName(req, accountDB, &cfg, profileCache, httpClient, vars["userID"])
 		}),
 	).Methods("GET")
 
 	r0mux.Handle("/profile/{userID}/displayname",
-		common.MakeAuthAPI("profile_displayname", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("profile_displayname", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return readers.SetDisplayName(req, accountDB, device, vars["userID"], userUpdateProducer, &cfg, producer, queryAPI)
 		}),
@@ -244,16 +399,102 @@ func Setup(
 		}),
 	)
 
-	// Riot logs get flooded unless this is handled
 	r0mux.Handle("/presence/{userID}/status",
-		common.MakeAPI("presence", func(req *http.Request) util.JSONResponse {
-			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
-			return util.JSONResponse{
-				Code: 200,
-				JSON: struct{}{},
-			}
+		common.MakeAuthAPI("get_presence", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetPresence(req, device, vars["userID"], accountDB, queryAPI)
 		}),
-	)
+	).Methods("GET")
+
+	r0mux.Handle("/presence/{userID}/status",
+		common.MakeAuthAPI("set_presence", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SetPresence(req, device, vars["userID"], accountDB, presenceProducer)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/sendToDevice/{eventType}/{txnID}",
+		common.MakeAuthAPI("send_to_device", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SendToDevice(
+				req, device, vars["eventType"], vars["txnID"],
+				cfg, accountDB, deviceDB, sendToDeviceProducer,
+			)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/notifications",
+		common.MakeAuthAPI("notifications", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetNotifications(req, device, accountDB)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushrules/",
+		common.MakeAuthAPI("push_rules", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetPushRules(req, device, accountDB, cfg)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushrules/{scope}/",
+		common.MakeAuthAPI("push_rules_scope", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetPushRulesForScope(req, device, vars["scope"], accountDB, cfg)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("get_push_rule", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetPushRule(req, device, vars["scope"], vars["kind"], vars["ruleID"], "", accountDB, cfg)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("put_push_rule", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.PutPushRule(req, device, vars["scope"], vars["kind"], vars["ruleID"], accountDB, cfg)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		common.MakeAuthAPI("delete_push_rule", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.DeletePushRule(req, device, vars["scope"], vars["kind"], vars["ruleID"], accountDB, cfg)
+		}),
+	).Methods("DELETE")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr:enabled|actions}",
+		common.MakeAuthAPI("get_push_rule_attr", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetPushRule(req, device, vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], accountDB, cfg)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/enabled",
+		common.MakeAuthAPI("put_push_rule_enabled", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.PutPushRuleEnabled(req, device, vars["scope"], vars["kind"], vars["ruleID"], accountDB, cfg)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/actions",
+		common.MakeAuthAPI("put_push_rule_actions", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.PutPushRuleActions(req, device, vars["scope"], vars["kind"], vars["ruleID"], accountDB, cfg)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/pushers",
+		common.MakeAuthAPI("get_pushers", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetPushers(req, device, accountDB)
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/pushers/set",
+		common.MakeAuthAPI("set_pusher", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.SetPusher(req, device, accountDB)
+		}),
+	).Methods("POST", "OPTIONS")
 
 	r0mux.Handle("/voip/turnServer",
 		common.MakeAPI("turn_server", func(req *http.Request) util.JSONResponse {
@@ -265,15 +506,38 @@ func Setup(
 		}),
 	)
 
+	r0mux.Handle("/thirdparty/protocols",
+		common.MakeAuthAPI("thirdparty_protocols", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetThirdPartyProtocols(req, cfg, httpClient)
+		}),
+	).Methods("GET", "OPTIONS")
+
 	unstableMux.Handle("/thirdparty/protocols",
-		common.MakeAPI("thirdparty_protocols", func(req *http.Request) util.JSONResponse {
-			// TODO: Return the third party protcols
-			return util.JSONResponse{
-				Code: 200,
-				JSON: struct{}{},
-			}
+		common.MakeAuthAPI("thirdparty_protocols", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetThirdPartyProtocols(req, cfg, httpClient)
 		}),
-	)
+	).Methods("GET", "OPTIONS")
+
+	r0mux.Handle("/thirdparty/protocol/{protocol}",
+		common.MakeAuthAPI("thirdparty_protocol", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetThirdPartyProtocol(req, vars["protocol"], cfg, httpClient)
+		}),
+	).Methods("GET", "OPTIONS")
+
+	r0mux.Handle("/thirdparty/user/{protocol}",
+		common.MakeAuthAPI("thirdparty_user", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetThirdPartyUsers(req, vars["protocol"], cfg, httpClient)
+		}),
+	).Methods("GET", "OPTIONS")
+
+	r0mux.Handle("/thirdparty/location/{protocol}",
+		common.MakeAuthAPI("thirdparty_location", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetThirdPartyLocations(req, vars["protocol"], cfg, httpClient)
+		}),
+	).Methods("GET", "OPTIONS")
 
 	r0mux.Handle("/rooms/{roomID}/initialSync",
 		common.MakeAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
@@ -286,32 +550,73 @@ func Setup(
 	)
 
 	r0mux.Handle("/user/{userID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("user_account_data", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return readers.SaveAccountData(req, accountDB, device, vars["userID"], "", vars["type"], syncProducer)
 		}),
-	)
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/user/{userID}/account_data/{type}",
+		common.MakeAuthAPI("user_account_data", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetAccountData(req, accountDB, device, vars["userID"], "", vars["type"])
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/user/{userID}/rooms/{roomID}/tags",
+		common.MakeAuthAPI("get_tags", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.GetTags(req, accountDB, device, vars["userID"], vars["roomID"])
+		}),
+	).Methods("GET")
+
+	r0mux.Handle("/user/{userID}/rooms/{roomID}/tags/{tag}",
+		common.MakeAuthAPI("put_tag", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.PutTag(req, accountDB, device, vars["userID"], vars["roomID"], vars["tag"], syncProducer)
+		}),
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/user/{userID}/rooms/{roomID}/tags/{tag}",
+		common.MakeAuthAPI("delete_tag", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.DeleteTag(req, accountDB, device, vars["userID"], vars["roomID"], vars["tag"], syncProducer)
+		}),
+	).Methods("DELETE")
 
 	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
-		common.MakeAuthAPI("user_account_data", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("user_account_data", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
 			return readers.SaveAccountData(req, accountDB, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
 		}),
-	)
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/user/{userID}/rooms/{roomID}/account_data/{type}",
+		common.MakeAuthAPI("user_account_data", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetAccountData(req, accountDB, device, vars["userID"], vars["roomID"], vars["type"])
+		}),
+	).Methods("GET")
 
 	r0mux.Handle("/rooms/{roomID}/members",
-		common.MakeAuthAPI("rooms_members", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("rooms_members", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.GetMemberships(req, device, vars["roomID"], false, accountDB, cfg, queryAPI)
+			return readers.GetMembers(req, device, vars["roomID"], queryAPI)
 		}),
 	)
 
+	r0mux.Handle("/joined_rooms",
+		common.MakeAuthAPI("joined_rooms", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return readers.GetJoinedRooms(req, device, accountDB)
+		}),
+	).Methods("GET")
+
 	r0mux.Handle("/rooms/{roomID}/joined_members",
-		common.MakeAuthAPI("rooms_members", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		common.MakeAuthAPI("rooms_joined_members", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return readers.GetMemberships(req, device, vars["roomID"], true, accountDB, cfg, queryAPI)
+			return readers.GetJoinedMembers(req, device, vars["roomID"], queryAPI)
 		}),
-	)
+	).Methods("GET")
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		common.MakeAPI("rooms_read_markers", func(req *http.Request) util.JSONResponse {
@@ -321,9 +626,73 @@ func Setup(
 	)
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
-		common.MakeAPI("rooms_typing", func(req *http.Request) util.JSONResponse {
-			// TODO: handling typing
-			return util.JSONResponse{Code: 200, JSON: struct{}{}}
+		common.MakeAuthAPI("rooms_typing", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SendTyping(req, device, vars["roomID"], vars["userID"], queryAPI, typingProducer)
 		}),
-	)
+	).Methods("PUT", "OPTIONS")
+
+	r0mux.Handle("/user_directory/search",
+		common.MakeAuthAPI("userdirectory_search", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return writers.SearchUserDirectory(req, device, cfg, accountDB, queryAPI)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		common.MakeAuthAPI("rooms_report", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.ReportEvent(
+				req, device, vars["roomID"], vars["eventID"], cfg, accountDB, queryAPI, httpClient,
+			)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	r0mux.Handle("/rooms/{roomID}/receipt/{receiptType}/{eventID}",
+		common.MakeAuthAPI("rooms_receipt", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SendReceipt(
+				req, device, vars["roomID"], vars["receiptType"], vars["eventID"],
+				accountDB, queryAPI, receiptAPI, receiptProducer,
+			)
+		}),
+	).Methods("POST", "OPTIONS")
+
+	adminMux.Handle("/send_server_notice",
+		common.MakeAuthAdminAPI("admin_send_server_notice", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return admin.SendServerNotice(req, serverNotices)
+		}),
+	).Methods("POST")
+
+	dendriteAdminMux.Handle("/users",
+		common.MakeAuthAdminAPI("admin_users", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return admin.GetUsers(req, accountDB)
+		}),
+	).Methods("GET")
+
+	dendriteAdminMux.Handle("/deactivate/{userID}",
+		common.MakeAuthAdminAPI("admin_deactivate", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.DeactivateUser(req, vars["userID"], accountDB, deviceDB, cfg, queryAPI, producer)
+		}),
+	).Methods("POST")
+
+	dendriteAdminMux.Handle("/reports",
+		common.MakeAuthAdminAPI("admin_reports", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return admin.GetReports(req, accountDB)
+		}),
+	).Methods("GET")
+
+	dendriteAdminMux.Handle("/reports/{reportID}",
+		common.MakeAuthAdminAPI("admin_dismiss_report", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.DismissReport(req, vars["reportID"], accountDB)
+		}),
+	).Methods("DELETE")
+
+	dendriteAdminMux.Handle("/whois/{userID}",
+		common.MakeAuthAdminAPI("admin_whois", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.GetWhois(req, vars["userID"], accountDB, deviceDB, cfg)
+		}),
+	).Methods("GET")
 }
@@ -0,0 +1,292 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servernotices
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/events"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The type of the server notices rooms, in the content of their m.room.create
+// event, and the tag the rooms are given for their users.
+const serverNoticeType = "m.server_notice"
+
+// ErrNotEnabled is returned when sending a notice while server notices aren't
+// configured.
+var ErrNotEnabled = errors.New("Server notices are not enabled on this server")
+
+// ErrNotLocalUser is returned when sending a notice to a user of another server.
+var ErrNotLocalUser = errors.New("Server notices can only be sent to local users")
+
+// ErrUnknownUser is returned when sending a notice to a user who doesn't exist.
+var ErrUnknownUser = errors.New("User does not exist")
+
+// Sender sends server notices to local users. The notices are sent in a room
+// per user, which is created the first time a notice is sent to them, by the
+// user configured in the server_notices section of the config.
+type Sender struct {
+	cfg          config.Dendrite
+	accountDB    *accounts.Database
+	producer     *producers.RoomserverProducer
+	queryAPI     api.RoomserverQueryAPI
+	syncProducer *producers.SyncAPIProducer
+	// Notices are sent one at a time so that only one room is created per
+	// user.
+	mutex sync.Mutex
+}
+
+// NewSender creates a new server notices sender.
+func NewSender(
+	cfg config.Dendrite, accountDB *accounts.Database,
+	producer *producers.RoomserverProducer, queryAPI api.RoomserverQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) *Sender {
+	return &Sender{
+		cfg:          cfg,
+		accountDB:    accountDB,
+		producer:     producer,
+		queryAPI:     queryAPI,
+		syncProducer: syncProducer,
+	}
+}
+
+// senderID returns the user ID of the user who sends the notices.
+func (s *Sender) senderID() string {
+	return fmt.Sprintf("@%s:%s", s.cfg.Matrix.ServerNotices.LocalPart, s.cfg.Matrix.ServerName)
+}
+
+// SendNotice sends an event with the given type and content to the server
+// notices room of the user, creating the room if they don't have one yet, and
+// inviting them to it again if they left it.
+// Returns the ID of the event.
+// Returns ErrNotEnabled, ErrNotLocalUser or ErrUnknownUser if the notice can't
+// be sent to the user.
+func (s *Sender) SendNotice(
+	ctx context.Context, userID, eventType string, content interface{},
+) (string, error) {
+	if s.cfg.Matrix.ServerNotices.LocalPart == "" {
+		return "", ErrNotEnabled
+	}
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return "", err
+	}
+	if serverName != s.cfg.Matrix.ServerName {
+		return "", ErrNotLocalUser
+	}
+	if _, err = s.accountDB.GetAccountByLocalpart(localpart); err == sql.ErrNoRows {
+		return "", ErrUnknownUser
+	} else if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err = s.ensureSenderAccount(); err != nil {
+		return "", err
+	}
+
+	roomID, err := s.accountDB.GetServerNoticesRoom(localpart)
+	if err != nil {
+		return "", err
+	}
+	if roomID == "" {
+		if roomID, err = s.createRoom(userID); err != nil {
+			return "", err
+		}
+		if err = s.accountDB.SaveServerNoticesRoom(localpart, roomID); err != nil {
+			return "", err
+		}
+		if err = s.accountDB.SaveRoomTag(localpart, roomID, serverNoticeType, nil); err != nil {
+			return "", err
+		}
+		if err = s.syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+			return "", err
+		}
+	} else if err = s.ensureInvited(ctx, roomID, userID); err != nil {
+		return "", err
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: s.senderID(),
+		RoomID: roomID,
+		Type:   eventType,
+	}
+	if err = builder.SetContent(content); err != nil {
+		return "", err
+	}
+	event, err := events.BuildEvent(ctx, &builder, s.cfg, s.queryAPI, nil)
+	if err != nil {
+		return "", err
+	}
+	if err = s.producer.SendEvents([]gomatrixserverlib.Event{*event}, s.cfg.Matrix.ServerName); err != nil {
+		return "", err
+	}
+	return event.EventID(), nil
+}
+
+// ensureSenderAccount creates the passwordless account of the user who sends
+// the notices if it doesn't exist yet.
+func (s *Sender) ensureSenderAccount() error {
+	localpart := s.cfg.Matrix.ServerNotices.LocalPart
+	_, err := s.accountDB.GetAccountByLocalpart(localpart)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if _, err = s.accountDB.CreateAccount(localpart, ""); err != nil {
+		return err
+	}
+	if err = s.accountDB.SetDisplayName(localpart, s.cfg.Matrix.ServerNotices.DisplayName); err != nil {
+		return err
+	}
+	return s.accountDB.SetAvatarURL(localpart, s.cfg.Matrix.ServerNotices.AvatarURL)
+}
+
+// createRoom creates a new server notices room, and invites the user to it.
+// Returns the ID of the room.
+func (s *Sender) createRoom(userID string) (string, error) {
+	senderID := s.senderID()
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), s.cfg.Matrix.ServerName)
+	roomVersion := s.cfg.Matrix.DefaultRoomVersion
+
+	eventsToMake := []struct {
+		Type     string
+		StateKey string
+		Content  interface{}
+	}{
+		{"m.room.create", "", map[string]interface{}{
+			"creator":      senderID,
+			"room_version": roomVersion,
+			"type":         serverNoticeType,
+		}},
+		{"m.room.member", senderID, common.MemberContent{
+			Membership:  "join",
+			DisplayName: s.cfg.Matrix.ServerNotices.DisplayName,
+			AvatarURL:   s.cfg.Matrix.ServerNotices.AvatarURL,
+		}},
+		{"m.room.power_levels", "", common.InitialPowerLevelsContent(senderID)},
+		{"m.room.join_rules", "", common.JoinRulesContent{JoinRule: "invite"}},
+		{"m.room.history_visibility", "", common.HistoryVisibilityContent{HistoryVisibility: "shared"}},
+		{"m.room.name", "", common.NameContent{Name: s.cfg.Matrix.ServerNotices.RoomName}},
+		{"m.room.member", userID, common.MemberContent{Membership: "invite"}},
+	}
+
+	var builtEvents []gomatrixserverlib.Event
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i, e := range eventsToMake {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   senderID,
+			RoomID:   roomID,
+			Type:     e.Type,
+			StateKey: &e.StateKey,
+			Depth:    int64(i + 1),
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return "", err
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		ev, err := s.buildEvent(&builder, &authEvents, roomVersion)
+		if err != nil {
+			return "", err
+		}
+		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
+			return "", err
+		}
+		builtEvents = append(builtEvents, *ev)
+		authEvents.AddEvent(ev)
+	}
+
+	if err := s.producer.SendEvents(builtEvents, s.cfg.Matrix.ServerName); err != nil {
+		return "", err
+	}
+	return roomID, nil
+}
+
+// buildEvent fills out auth_events for the builder of an event of a room which
+// doesn't exist yet, then builds the event in the format of the room version.
+func (s *Sender) buildEvent(
+	builder *gomatrixserverlib.EventBuilder,
+	provider gomatrixserverlib.AuthEventProvider, roomVersion string,
+) (*gomatrixserverlib.Event, error) {
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil {
+		return nil, err
+	}
+	if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(provider); err != nil {
+		return nil, err
+	}
+	event, err := common.BuildEvent(
+		builder, roomVersion, time.Now(), s.cfg.Matrix.ServerName, s.cfg.Matrix.KeyID, s.cfg.Matrix.PrivateKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// ensureInvited invites the user to the server notices room again if they
+// are neither joined to it nor invited to it.
+func (s *Sender) ensureInvited(ctx context.Context, roomID, userID string) error {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.member", StateKey: userID},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := s.queryAPI.QueryLatestEventsAndState(ctx, &queryReq, &queryRes); err != nil {
+		return err
+	}
+	for _, event := range queryRes.StateEvents {
+		membership, err := event.Membership()
+		if err != nil {
+			return err
+		}
+		if membership == "join" || membership == "invite" {
+			return nil
+		}
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   s.senderID(),
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &userID,
+	}
+	if err := builder.SetContent(common.MemberContent{Membership: "invite"}); err != nil {
+		return err
+	}
+	event, err := events.BuildEvent(ctx, &builder, s.cfg, s.queryAPI, nil)
+	if err != nil {
+		return err
+	}
+	return s.producer.SendEvents([]gomatrixserverlib.Event{*event}, s.cfg.Matrix.ServerName)
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package todevice delivers to-device messages to the devices of local users,
+// whether they were sent by a local user or received over federation.
+package todevice
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Send stores the messages of the event for the devices of local users and
+// sends the event to the sync API and federation sender servers.
+// localMessages maps the ID of each local user to their device IDs, or "*"
+// for all of their devices, to the content of the message. Messages for
+// devices the user doesn't have are dropped. The event isn't sent if it has
+// no message left for local users and no remote messages.
+func Send(
+	accountDB *accounts.Database, deviceDB *devices.Database,
+	producer *producers.SendToDeviceProducer, event common.SendToDeviceEvent,
+	localMessages map[string]map[string]json.RawMessage,
+) error {
+	var messages []authtypes.ToDeviceMessage
+	for userID, contents := range localMessages {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return err
+		}
+		devs, err := deviceDB.GetDevicesByLocalpart(localpart)
+		if err != nil {
+			return err
+		}
+		sent := len(messages)
+		for _, dev := range devs {
+			content, ok := contents[dev.ID]
+			if !ok {
+				if content, ok = contents["*"]; !ok {
+					continue
+				}
+			}
+			messages = append(messages, authtypes.ToDeviceMessage{
+				Sender:   event.Sender,
+				UserID:   userID,
+				DeviceID: dev.ID,
+				Type:     event.Type,
+				Content:  content,
+			})
+		}
+		if len(messages) > sent {
+			event.LocalUserIDs = append(event.LocalUserIDs, userID)
+		}
+	}
+
+	if len(messages) > 0 {
+		pos, err := accountDB.StoreToDeviceMessages(messages)
+		if err != nil {
+			return err
+		}
+		event.StreamPosition = pos
+	}
+	if len(messages) == 0 && len(event.RemoteMessages) == 0 {
+		return nil
+	}
+	return producer.SendToDevice(event)
+}
@@ -15,13 +15,13 @@
 package writers
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
@@ -29,6 +29,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -41,10 +42,17 @@ type createRoomRequest struct {
 	Topic           string                 `json:"topic"`
 	Preset          string                 `json:"preset"`
 	CreationContent map[string]interface{} `json:"creation_content"`
-	InitialState    json.RawMessage        `json:"initial_state"` // TODO
+	InitialState    []fledglingEvent       `json:"initial_state"`
 	RoomAliasName   string                 `json:"room_alias_name"`
+	RoomVersion     string                 `json:"room_version"`
 }
 
+const (
+	presetPrivateChat        = "private_chat"
+	presetTrustedPrivateChat = "trusted_private_chat"
+	presetPublicChat         = "public_chat"
+)
+
 func (r createRoomRequest) Validate() *util.JSONResponse {
 	whitespace := "\t\n\x0b\x0c\r " // https://docs.python.org/2/library/string.html#string.whitespace
 	// https://github.com/matrix-org/synapse/blob/v0.19.2/synapse/handlers/room.py#L81
@@ -68,6 +76,36 @@ func (r createRoomRequest) Validate() *util.JSONResponse {
 			}
 		}
 	}
+	switch r.Preset {
+	case "", presetPrivateChat, presetTrustedPrivateChat, presetPublicChat:
+	default:
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("preset must be any of 'private_chat', 'trusted_private_chat', 'public_chat'"),
+		}
+	}
+	if r.RoomVersion != "" && !config.IsSupportedRoomVersion(r.RoomVersion) {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion("room version " + r.RoomVersion + " is not supported"),
+		}
+	}
+	for _, e := range r.InitialState {
+		if e.Type == "" {
+			return &util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("initial_state events must have a type"),
+			}
+		}
+		// The creation event and the creator's membership are always built by
+		// the server, and must be customised with creation_content and invite.
+		if e.Type == "m.room.create" || e.Type == "m.room.member" {
+			return &util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("initial_state cannot contain " + e.Type + " events"),
+			}
+		}
+	}
 	return nil
 }
 
@@ -78,29 +116,34 @@ type createRoomResponse struct {
 }
 
 // fledglingEvent is a helper representation of an event used when creating many events in succession.
+// It is also the format of the events in the "initial_state" of a /createRoom request.
 type fledglingEvent struct {
-	Type     string
-	StateKey string
-	Content  interface{}
+	Type     string      `json:"type"`
+	StateKey string      `json:"state_key"`
+	Content  interface{} `json:"content"`
 }
 
 // CreateRoom implements /createRoom
 func CreateRoom(req *http.Request, device *authtypes.Device,
 	cfg config.Dendrite, producer *producers.RoomserverProducer,
-	accountDB *accounts.Database,
+	accountDB *accounts.Database, aliasAPI api.RoomserverAliasAPI,
 ) util.JSONResponse {
+	if resErr := auth.VerifyNotGuest(device, accountDB); resErr != nil {
+		return *resErr
+	}
 	// TODO: Check room ID doesn't clash with an existing one, and we
 	//       probably shouldn't be using pseudo-random strings, maybe GUIDs?
 	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
-	return createRoom(req, device, cfg, roomID, producer, accountDB)
+	return createRoom(req, device, cfg, roomID, producer, accountDB, aliasAPI)
 }
 
 // createRoom implements /createRoom
+// nolint: gocyclo
 func createRoom(req *http.Request, device *authtypes.Device,
 	cfg config.Dendrite, roomID string, producer *producers.RoomserverProducer,
-	accountDB *accounts.Database,
+	accountDB *accounts.Database, aliasAPI api.RoomserverAliasAPI,
 ) util.JSONResponse {
-	logger := util.GetLogger(req.Context())
+	logger := common.GetLogger(req.Context())
 	userID := device.UserID
 	var r createRoomRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
@@ -113,9 +156,24 @@ func createRoom(req *http.Request, device *authtypes.Device,
 		return *resErr
 	}
 
-	// TODO: visibility/presets/raw initial state/creation content
+	// If the client asked for an alias, check it isn't taken before creating
+	// the room, so we don't end up with a room the client didn't want.
+	var roomAlias string
+	if r.RoomAliasName != "" {
+		roomAlias = fmt.Sprintf("#%s:%s", r.RoomAliasName, cfg.Matrix.ServerName)
 
-	// TODO: Create room alias association
+		aliasReq := api.GetAliasRoomIDRequest{Alias: roomAlias}
+		var aliasRes api.GetAliasRoomIDResponse
+		if err := aliasAPI.GetAliasRoomID(&aliasReq, &aliasRes); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if aliasRes.RoomID != "" {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.RoomInUse("Room alias already exists."),
+			}
+		}
+	}
 
 	logger.WithFields(log.Fields{
 		"userID": userID,
@@ -132,47 +190,121 @@ func createRoom(req *http.Request, device *authtypes.Device,
 		return httputil.LogThenError(req, err)
 	}
 
+	createContent := map[string]interface{}{}
+	for k, v := range r.CreationContent {
+		createContent[k] = v
+	}
+	createContent["creator"] = userID
+
+	// Use the same default room version as the one advertised in /capabilities
+	roomVersion := r.RoomVersion
+	if roomVersion == "" {
+		roomVersion = cfg.Matrix.DefaultRoomVersion
+	}
+	createContent["room_version"] = roomVersion
+
 	membershipContent := common.MemberContent{
 		Membership:  "join",
 		DisplayName: profile.DisplayName,
 		AvatarURL:   profile.AvatarURL,
 	}
 
+	// If no preset is given, the visibility of the room decides which one to use
+	preset := r.Preset
+	if preset == "" {
+		if r.Visibility == "public" {
+			preset = presetPublicChat
+		} else {
+			preset = presetPrivateChat
+		}
+	}
+
+	// https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-createroom
+	powerLevelContent := common.InitialPowerLevelsContent(userID)
+	joinRuleContent := common.JoinRulesContent{JoinRule: "invite"}
+	historyVisibilityContent := common.HistoryVisibilityContent{HistoryVisibility: "shared"}
+	guestAccessContent := common.GuestAccessContent{GuestAccess: "can_join"}
+	switch preset {
+	case presetTrustedPrivateChat:
+		// All invitees are given the same power level as the room creator
+		for _, invitee := range r.Invite {
+			powerLevelContent.Users[invitee] = powerLevelContent.Users[userID]
+		}
+	case presetPublicChat:
+		joinRuleContent.JoinRule = "public"
+		guestAccessContent.GuestAccess = "forbidden"
+	}
+
 	var builtEvents []gomatrixserverlib.Event
 
 	// send events into the room in order of:
 	//  1- m.room.create
 	//  2- room creator join member
 	//  3- m.room.power_levels
-	//  4- m.room.canonical_alias (opt) TODO
+	//  4- m.room.canonical_alias (opt)
 	//  5- m.room.join_rules
 	//  6- m.room.history_visibility
 	//  7- m.room.guest_access (opt)
-	//  8- other initial state items TODO
+	//  8- other initial state items
 	//  9- m.room.name (opt)
 	//  10- m.room.topic (opt)
 	//  11- invite events (opt) - with is_direct flag if applicable TODO
 	//  12- 3pid invite events (opt) TODO
-	//  13- m.room.aliases event for HS (if alias specified) TODO
+	//  13- m.room.aliases event for HS (if alias specified)
 	// This differs from Synapse slightly. Synapse would vary the ordering of 3-7
 	// depending on if those events were in "initial_state" or not. This made it
 	// harder to reason about, hence sticking to a strict static ordering.
 	// TODO: Synapse has txn/token ID on each event. Do we need to do this here?
 	eventsToMake := []fledglingEvent{
-		{"m.room.create", "", common.CreateContent{Creator: userID}},
+		{"m.room.create", "", createContent},
 		{"m.room.member", userID, membershipContent},
-		{"m.room.power_levels", "", common.InitialPowerLevelsContent(userID)},
-		// TODO: m.room.canonical_alias
-		{"m.room.join_rules", "", common.JoinRulesContent{"public"}},                 // FIXME: Allow this to be changed
-		{"m.room.history_visibility", "", common.HistoryVisibilityContent{"joined"}}, // FIXME: Allow this to be changed
-		{"m.room.guest_access", "", common.GuestAccessContent{"can_join"}},           // FIXME: Allow this to be changed
-		// TODO: Other initial state items
-		{"m.room.name", "", common.NameContent{r.Name}}, // FIXME: Only send the name event if a name is supplied, to avoid sending a false room name removal event
-		{"m.room.topic", "", common.TopicContent{r.Topic}},
-		// TODO: invite events
-		// TODO: 3pid invite events
-		// TODO: m.room.aliases
+		{"m.room.power_levels", "", powerLevelContent},
+	}
+	if roomAlias != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{
+			"m.room.canonical_alias", "", common.CanonicalAliasContent{Alias: roomAlias},
+		})
+	}
+	presetEvents := []fledglingEvent{
+		{"m.room.join_rules", "", joinRuleContent},
+		{"m.room.history_visibility", "", historyVisibilityContent},
+		{"m.room.guest_access", "", guestAccessContent},
+	}
+
+	// Events in the initial state take precedence over the ones set by the
+	// preset, and are otherwise sent after them.
+	var extraEvents []fledglingEvent
+	for _, e := range r.InitialState {
+		overridden := false
+		for i := range presetEvents {
+			if presetEvents[i].Type == e.Type && presetEvents[i].StateKey == e.StateKey {
+				presetEvents[i] = e
+				overridden = true
+			}
+		}
+		for i := range eventsToMake {
+			if eventsToMake[i].Type == e.Type && eventsToMake[i].StateKey == e.StateKey {
+				eventsToMake[i] = e
+				overridden = true
+			}
+		}
+		if !overridden {
+			extraEvents = append(extraEvents, e)
+		}
+	}
+	eventsToMake = append(eventsToMake, presetEvents...)
+	eventsToMake = append(eventsToMake, extraEvents...)
+
+	// Only send the name and topic events if they are supplied, to avoid
+	// sending false removal events
+	if r.Name != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.name", "", common.NameContent{Name: r.Name}})
+	}
+	if r.Topic != "" {
+		eventsToMake = append(eventsToMake, fledglingEvent{"m.room.topic", "", common.TopicContent{Topic: r.Topic}})
 	}
+	// TODO: invite events
+	// TODO: 3pid invite events
 
 	authEvents := gomatrixserverlib.NewAuthEvents(nil)
 	for i, e := range eventsToMake {
@@ -185,16 +317,32 @@ func createRoom(req *http.Request, device *authtypes.Device,
 			StateKey: &e.StateKey,
 			Depth:    int64(depth),
 		}
-		builder.SetContent(e.Content)
+		if err = builder.SetContent(e.Content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
 		if i > 0 {
 			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
 		}
-		ev, err := buildEvent(&builder, &authEvents, cfg)
-		if err != nil {
+		ev, err := buildEvent(&builder, &authEvents, roomVersion, cfg)
+		if tooLargeErr, ok := err.(common.EventTooLargeError); ok {
+			return util.JSONResponse{
+				Code: 413,
+				JSON: jsonerror.TooLarge(tooLargeErr.Error()),
+			}
+		} else if err != nil {
 			return httputil.LogThenError(req, err)
 		}
 
 		if err := gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
+			if len(r.InitialState) > 0 {
+				// The events the server builds are always allowed on their
+				// own, so the initial state supplied by the client must have
+				// made this one invalid
+				return util.JSONResponse{
+					Code: 400,
+					JSON: jsonerror.BadJSON("Invalid initial_state event: " + err.Error()),
+				}
+			}
 			return httputil.LogThenError(req, err)
 		}
 
@@ -208,8 +356,30 @@ func createRoom(req *http.Request, device *authtypes.Device,
 		return httputil.LogThenError(req, err)
 	}
 
+	// The room server sends the m.room.aliases event when setting the alias,
+	// which it can only do once the room exists.
+	if roomAlias != "" {
+		aliasReq := api.SetRoomAliasRequest{
+			UserID: userID,
+			RoomID: roomID,
+			Alias:  roomAlias,
+		}
+		var aliasRes api.SetRoomAliasResponse
+		if err := aliasAPI.SetRoomAlias(&aliasReq, &aliasRes); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if aliasRes.AliasExists {
+			// Someone took the alias while the room was being created
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.RoomInUse("Room alias already exists."),
+			}
+		}
+	}
+
 	response := createRoomResponse{
-		RoomID: roomID,
+		RoomID:    roomID,
+		RoomAlias: roomAlias,
 	}
 
 	return util.JSONResponse{
@@ -218,9 +388,10 @@ func createRoom(req *http.Request, device *authtypes.Device,
 	}
 }
 
-// buildEvent fills out auth_events for the builder then builds the event
+// buildEvent fills out auth_events for the builder then builds the event in
+// the format of the room version
 func buildEvent(builder *gomatrixserverlib.EventBuilder,
-	provider gomatrixserverlib.AuthEventProvider,
+	provider gomatrixserverlib.AuthEventProvider, roomVersion string,
 	cfg config.Dendrite) (*gomatrixserverlib.Event, error) {
 
 	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
@@ -232,11 +403,15 @@ func buildEvent(builder *gomatrixserverlib.EventBuilder,
 		return nil, err
 	}
 	builder.AuthEvents = refs
-	eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
 	now := time.Now()
-	event, err := builder.Build(eventID, now, cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey)
-	if err != nil {
+	event, err := common.BuildEvent(builder, roomVersion, now, cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey)
+	if _, ok := err.(common.UnsupportedRoomVersionError); ok {
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("cannot build event %s : Builder failed to build. %s", builder.Type, err)
 	}
+	if err = common.CheckEventSize(event, cfg.Matrix.MaxEventSizeBytes); err != nil {
+		return nil, err
+	}
 	return &event, nil
 }
@@ -0,0 +1,143 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
+	"github.com/matrix-org/dendrite/clientapi/events"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateAccountRequest struct {
+	Auth *uia.AuthDict `json:"auth"`
+}
+
+// DeactivateAccount implements POST /account/deactivate
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-deactivate
+func DeactivateAccount(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	device *authtypes.Device, uiaSessions *uia.Sessions, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) util.JSONResponse {
+	// The body is optional until the client needs to authenticate.
+	var r deactivateAccountRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+
+	if resErr := uiaSessions.Verify(req, r.Auth, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	err := DeactivateUser(req.Context(), device.UserID, accountDB, deviceDB, cfg, queryAPI, producer)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// DeactivateUser deactivates the account of the local user with the given ID,
+// logs out all of their devices, and makes them leave all of their rooms.
+func DeactivateUser(
+	ctx context.Context, userID string,
+	accountDB *accounts.Database, deviceDB *devices.Database, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) error {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return err
+	}
+
+	leaveEvents, err := buildLeaveEvents(ctx, memberships, userID, cfg, queryAPI)
+	if err != nil {
+		return err
+	}
+
+	// Mark the account as deactivated before doing anything else so that it
+	// can't be logged into again while we're removing its devices.
+	if err = accountDB.DeactivateAccount(localpart); err != nil {
+		return err
+	}
+
+	if err = deviceDB.RemoveAllDevices(localpart); err != nil {
+		return err
+	}
+
+	if len(leaveEvents) > 0 {
+		return producer.SendEvents(leaveEvents, cfg.Matrix.ServerName)
+	}
+	return nil
+}
+
+// buildLeaveEvents builds the m.room.member events making the user with the
+// given ID leave every room in the given list of memberships.
+// Rooms that don't exist anymore are skipped.
+func buildLeaveEvents(
+	ctx context.Context, memberships []authtypes.Membership, userID string, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+) ([]gomatrixserverlib.Event, error) {
+	evs := []gomatrixserverlib.Event{}
+
+	for _, membership := range memberships {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   membership.RoomID,
+			Type:     "m.room.member",
+			StateKey: &userID,
+		}
+
+		content := common.MemberContent{
+			Membership: "leave",
+		}
+
+		if err := builder.SetContent(content); err != nil {
+			return nil, err
+		}
+
+		event, err := events.BuildEvent(ctx, &builder, cfg, queryAPI, nil)
+		if err == events.ErrRoomNoExists {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		evs = append(evs, *event)
+	}
+
+	return evs, nil
+}
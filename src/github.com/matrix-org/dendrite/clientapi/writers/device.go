@@ -0,0 +1,170 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// deviceUpdateRequest represents the body of a PUT /devices/{deviceID} request.
+type deviceUpdateRequest struct {
+	DisplayName *string `json:"display_name"`
+}
+
+// deviceDeleteRequest represents the body of a DELETE /devices/{deviceID} request.
+type deviceDeleteRequest struct {
+	Auth *uia.AuthDict `json:"auth"`
+}
+
+// UpdateDeviceByID implements PUT /devices/{deviceID}
+func UpdateDeviceByID(
+	req *http.Request, deviceDB *devices.Database, accountDB *accounts.Database,
+	device *authtypes.Device, deviceID string,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	dev, err := deviceDB.GetDeviceByID(localpart, deviceID)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown device"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	var r deviceUpdateRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if err := deviceDB.UpdateDevice(localpart, deviceID, r.DisplayName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	dev.DisplayName = ""
+	if r.DisplayName != nil {
+		dev.DisplayName = *r.DisplayName
+	}
+	if resErr := sendDeviceListUpdate(req, deviceDB, accountDB, localpart, *dev, false, nil, deviceListProducer); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// DeleteDeviceByID implements DELETE /devices/{deviceID}. The user must
+// confirm their password through user-interactive authentication.
+func DeleteDeviceByID(
+	req *http.Request, deviceDB *devices.Database, accountDB *accounts.Database,
+	device *authtypes.Device, deviceID string, uiaSessions *uia.Sessions,
+	deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	dev, err := deviceDB.GetDeviceByID(localpart, deviceID)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown device"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// The body is optional until the client needs to authenticate.
+	var r deviceDeleteRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+
+	if resErr := uiaSessions.Verify(req, r.Auth, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	if err := deviceDB.RemoveDevice(deviceID, localpart); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if resErr := sendDeviceListUpdate(req, deviceDB, accountDB, localpart, *dev, true, nil, deviceListProducer); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// sendDeviceListUpdate tells the servers in the rooms the user is joined to
+// about the change to one of their devices.
+func sendDeviceListUpdate(
+	req *http.Request, deviceDB *devices.Database, accountDB *accounts.Database, localpart string,
+	dev authtypes.Device, deleted bool, keys json.RawMessage,
+	deviceListProducer *producers.DeviceListProducer,
+) *util.JSONResponse {
+	roomIDs, err := joinedRoomIDs(accountDB, localpart)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+	streamID, err := deviceDB.NewDeviceListStreamID(localpart)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+	if err := deviceListProducer.SendDeviceListUpdate(dev, deleted, keys, streamID, roomIDs); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+	return nil
+}
+
+// joinedRoomIDs returns the IDs of the rooms the local user is joined to.
+func joinedRoomIDs(accountDB *accounts.Database, localpart string) ([]string, error) {
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return nil, err
+	}
+	roomIDs := make([]string, len(memberships))
+	for i, m := range memberships {
+		roomIDs[i] = m.RoomID
+	}
+	return roomIDs, nil
+}
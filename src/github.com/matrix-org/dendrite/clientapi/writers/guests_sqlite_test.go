@@ -0,0 +1,98 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package writers
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+func TestSQLiteWritersRejectGuests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-writers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accounts.NewDatabase("file:"+filepath.Join(dir, "account.db"), "localhost")
+	if err != nil {
+		t.Fatalf("NewDatabase: %v", err)
+	}
+	if _, err = accountDB.CreateGuestAccount("guest"); err != nil {
+		t.Fatalf("CreateGuestAccount: %v", err)
+	}
+
+	// The checks must reject the guest before the room server is queried or
+	// sent events, which would panic as there is none.
+	var cfg config.Dendrite
+	limit := config.RateLimit{PerSecond: 1, Burst: 10}
+	limiter := ratelimit.NewLimiter(limit)
+	eventLimiter := ratelimit.NewEventLimiter(
+		config.EventRateLimit{PerUser: limit, PerRoom: limit},
+		config.EventRateLimit{PerUser: limit, PerRoom: limit},
+	)
+	emptyStateKey := ""
+	device := &authtypes.Device{ID: "device1", UserID: "@guest:localhost"}
+	for name, send := range map[string]func() util.JSONResponse{
+		"createRoom": func() util.JSONResponse {
+			req := httptest.NewRequest("POST", "/createRoom", strings.NewReader(`{}`))
+			return CreateRoom(req, device, cfg, nil, accountDB, nil)
+		},
+		"state event": func() util.JSONResponse {
+			req := httptest.NewRequest("PUT", "/rooms/!r:localhost/state/m.room.topic/", strings.NewReader(`{"topic":"hi"}`))
+			return SendEvent(req, device, "!r:localhost", "m.room.topic", "", &emptyStateKey, cfg, nil, nil, accountDB, eventLimiter)
+		},
+		"other than a message": func() util.JSONResponse {
+			req := httptest.NewRequest("PUT", "/rooms/!r:localhost/send/m.reaction/1", strings.NewReader(`{}`))
+			return SendEvent(req, device, "!r:localhost", "m.reaction", "1", nil, cfg, nil, nil, accountDB, eventLimiter)
+		},
+		"redaction": func() util.JSONResponse {
+			req := httptest.NewRequest("PUT", "/rooms/!r:localhost/redact/$e:localhost/2", strings.NewReader(`{}`))
+			return SendRedaction(req, device, "!r:localhost", "$e:localhost", "2", cfg, nil, nil, accountDB, eventLimiter)
+		},
+		"invite": func() util.JSONResponse {
+			req := httptest.NewRequest("POST", "/rooms/!r:localhost/invite", strings.NewReader(`{"user_id":"@bob:localhost"}`))
+			return SendMembership(req, accountDB, device, "!r:localhost", "invite", cfg, nil, nil, limiter)
+		},
+		"upgrade": func() util.JSONResponse {
+			req := httptest.NewRequest("POST", "/rooms/!r:localhost/upgrade", strings.NewReader(`{"new_version":"6"}`))
+			return UpgradeRoom(req, device, "!r:localhost", cfg, nil, nil, accountDB)
+		},
+	} {
+		res := send()
+		if res.Code != 403 {
+			t.Errorf("%s: want code 403, got %d: %+v", name, res.Code, res.JSON)
+			continue
+		}
+		if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_GUEST_ACCESS_FORBIDDEN" {
+			t.Errorf("%s: want M_GUEST_ACCESS_FORBIDDEN, got %+v", name, res.JSON)
+		}
+	}
+	if !device.IsGuest {
+		t.Error("want the device to be marked as a guest")
+	}
+}
@@ -15,18 +15,21 @@
 package writers
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/events"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -40,7 +43,7 @@ func JoinRoomByIDOrAlias(
 	device *authtypes.Device,
 	roomIDOrAlias string,
 	cfg config.Dendrite,
-	federation *gomatrixserverlib.FederationClient,
+	federation *federationclient.Client,
 	producer *producers.RoomserverProducer,
 	queryAPI api.RoomserverQueryAPI,
 	aliasAPI api.RoomserverAliasAPI,
@@ -61,15 +64,19 @@ func JoinRoomByIDOrAlias(
 	if err != nil {
 		return httputil.LogThenError(req, err)
 	}
+	// Guests can only join rooms with guest access.
+	if err = auth.SetGuest(device, accountDB); err != nil {
+		return httputil.LogThenError(req, err)
+	}
 
 	content["membership"] = "join"
 	content["displayname"] = profile.DisplayName
 	content["avatar_url"] = profile.AvatarURL
 
-	r := joinRoomReq{req, content, device.UserID, cfg, federation, producer, queryAPI, aliasAPI, keyRing}
+	r := joinRoomReq{req, content, device.UserID, device.IsGuest, cfg, federation, producer, queryAPI, aliasAPI, keyRing}
 
 	if strings.HasPrefix(roomIDOrAlias, "!") {
-		return r.joinRoomByID()
+		return r.joinRoomByID(roomIDOrAlias)
 	}
 	if strings.HasPrefix(roomIDOrAlias, "#") {
 		return r.joinRoomByAlias(roomIDOrAlias)
@@ -84,8 +91,9 @@ type joinRoomReq struct {
 	req        *http.Request
 	content    map[string]interface{}
 	userID     string
+	isGuest    bool
 	cfg        config.Dendrite
-	federation *gomatrixserverlib.FederationClient
+	federation *federationclient.Client
 	producer   *producers.RoomserverProducer
 	queryAPI   api.RoomserverQueryAPI
 	aliasAPI   api.RoomserverAliasAPI
@@ -93,15 +101,47 @@ type joinRoomReq struct {
 }
 
 // joinRoomByID joins a room by room ID
-func (r joinRoomReq) joinRoomByID() util.JSONResponse {
-	// TODO: Implement joining rooms by ID.
+func (r joinRoomReq) joinRoomByID(roomID string) util.JSONResponse {
 	// A client should only join a room by room ID when it has an invite
 	// to the room. If the server is already in the room then we can
-	// lookup the invite and process the request as a normal state event.
-	// If the server is not in the room the we will need to look up the
-	// remote server the invite came from in order to request a join event
-	// from that server.
-	panic(fmt.Errorf("Joining rooms by ID is not implemented"))
+	// process the request as a normal state event. If the server is not
+	// in the room then we request a join event from the servers we know
+	// of for this room: the servers the invites came from, and the server
+	// which created the room.
+	_, domain, err := gomatrixserverlib.SplitID('!', roomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid room ID"),
+		}
+	}
+
+	queryReq := api.QueryInvitesForUserRequest{
+		RoomID:       roomID,
+		TargetUserID: r.userID,
+	}
+	var queryRes api.QueryInvitesForUserResponse
+	if err := r.queryAPI.QueryInvitesForUser(r.req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(r.req, err)
+	}
+
+	var servers []gomatrixserverlib.ServerName
+	seenServers := map[gomatrixserverlib.ServerName]bool{}
+	for _, userID := range queryRes.InviteSenderUserIDs {
+		_, server, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		if !seenServers[server] && server != r.cfg.Matrix.ServerName {
+			seenServers[server] = true
+			servers = append(servers, server)
+		}
+	}
+	if !seenServers[domain] && domain != r.cfg.Matrix.ServerName {
+		servers = append(servers, domain)
+	}
+
+	return r.joinRoomUsingServers(roomID, servers)
 }
 
 // joinRoomByAlias joins a room using a room alias.
@@ -163,15 +203,48 @@ func (r joinRoomReq) writeToBuilder(eb *gomatrixserverlib.EventBuilder, roomID s
 	eb.Redacts = ""
 }
 
+// checkGuestAccess returns an error response unless guests can join the
+// room, i.e. its m.room.guest_access is "can_join". Guests can only join
+// rooms the server is already in, since the state of other rooms isn't known.
+func (r joinRoomReq) checkGuestAccess(roomID string) *util.JSONResponse {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.guest_access", StateKey: ""},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := r.queryAPI.QueryLatestEventsAndState(r.req.Context(), &queryReq, &queryRes); err != nil {
+		resErr := httputil.LogThenError(r.req, err)
+		return &resErr
+	}
+	for _, event := range queryRes.StateEvents {
+		var content common.GuestAccessContent
+		if err := json.Unmarshal(event.Content(), &content); err == nil && content.GuestAccess == "can_join" {
+			return nil
+		}
+	}
+	return &util.JSONResponse{
+		Code: 403,
+		JSON: jsonerror.GuestAccessForbidden("Guest access is not allowed in this room"),
+	}
+}
+
 func (r joinRoomReq) joinRoomUsingServers(
 	roomID string, servers []gomatrixserverlib.ServerName,
 ) util.JSONResponse {
+	if r.isGuest {
+		if resErr := r.checkGuestAccess(roomID); resErr != nil {
+			return *resErr
+		}
+	}
+
 	var eb gomatrixserverlib.EventBuilder
 	r.writeToBuilder(&eb, roomID)
 
 	var queryRes api.QueryLatestEventsAndStateResponse
-	if event, err := events.BuildEvent(&eb, r.cfg, r.queryAPI, &queryRes); err == nil {
-		if sendErr := r.producer.SendEvents([]gomatrixserverlib.Event{*event}, r.cfg.Matrix.ServerName); err != nil {
+	if event, err := events.BuildEvent(r.req.Context(), &eb, r.cfg, r.queryAPI, &queryRes); err == nil {
+		if sendErr := r.producer.SendEvents([]gomatrixserverlib.Event{*event}, r.cfg.Matrix.ServerName); sendErr != nil {
 			return httputil.LogThenError(r.req, sendErr)
 		}
 
@@ -198,7 +271,7 @@ func (r joinRoomReq) joinRoomUsingServers(
 		response, lastErr = r.joinRoomUsingServer(roomID, server)
 		if lastErr != nil {
 			// There was a problem talking to one of the servers.
-			util.GetLogger(r.req.Context()).WithError(lastErr).WithField("server", server).Warn("Failed to join room using server")
+			common.GetLogger(r.req.Context()).WithError(lastErr).WithField("server", server).Warn("Failed to join room using server")
 			// Try the next server.
 			continue
 		}
@@ -236,17 +309,20 @@ func (r joinRoomReq) joinRoomUsingServer(roomID string, server gomatrixserverlib
 	// but it's possible that the remote server returned us something "odd"
 	r.writeToBuilder(&respMakeJoin.JoinEvent, roomID)
 
+	// The join event is in the format of the events of the room, which is
+	// given by its version.
 	now := time.Now()
-	eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), r.cfg.Matrix.ServerName)
-	event, err := respMakeJoin.JoinEvent.Build(
-		eventID, now, r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey,
+	event, err := common.BuildEvent(
+		&respMakeJoin.JoinEvent, respMakeJoin.RoomVersion, now,
+		r.cfg.Matrix.ServerName, r.cfg.Matrix.KeyID, r.cfg.Matrix.PrivateKey,
 	)
 	if err != nil {
-		res := httputil.LogThenError(r.req, err)
-		return &res, nil
+		// The server may support a version of the room that this server
+		// doesn't, so another server can be tried.
+		return nil, err
 	}
 
-	respSendJoin, err := r.federation.SendJoin(server, event)
+	respSendJoin, err := r.federation.SendJoin(server, event, respMakeJoin.RoomVersion)
 	if err != nil {
 		return nil, err
 	}
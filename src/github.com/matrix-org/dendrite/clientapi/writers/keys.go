@@ -0,0 +1,215 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
+	"github.com/matrix-org/dendrite/clientapi/e2ekeys"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// uploadKeysRequest represents the body of a POST /keys/upload request.
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#post-matrix-client-r0-keys-upload
+type uploadKeysRequest struct {
+	DeviceKeys  json.RawMessage            `json:"device_keys"`
+	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+type uploadKeysResponse struct {
+	OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+}
+
+// deviceKeysOwner is the part of the device keys identifying the device they
+// belong to.
+type deviceKeysOwner struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// uploadSigningKeysRequest represents the body of a
+// POST /keys/device_signing/upload request.
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-keys-device-signing-upload
+type uploadSigningKeysRequest struct {
+	MasterKey      json.RawMessage `json:"master_key"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key"`
+	UserSigningKey json.RawMessage `json:"user_signing_key"`
+	Auth           *uia.AuthDict   `json:"auth"`
+}
+
+// UploadKeys implements POST /keys/upload
+func UploadKeys(
+	req *http.Request, deviceDB *devices.Database, accountDB *accounts.Database,
+	device *authtypes.Device, deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r uploadKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if r.DeviceKeys != nil {
+		var owner deviceKeysOwner
+		if err = json.Unmarshal(r.DeviceKeys, &owner); err != nil {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The device keys could not be decoded. " + err.Error()),
+			}
+		}
+		if owner.UserID != device.UserID || owner.DeviceID != device.ID {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The device keys must belong to the device uploading them"),
+			}
+		}
+	}
+
+	oneTimeKeys := make(map[string][]byte, len(r.OneTimeKeys))
+	for keyID, keyJSON := range r.OneTimeKeys {
+		if !strings.Contains(keyID, ":") {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("The IDs of one-time keys must be of the form <algorithm>:<key_id>"),
+			}
+		}
+		oneTimeKeys[keyID] = keyJSON
+	}
+
+	if r.DeviceKeys != nil {
+		if err = deviceDB.StoreDeviceKeys(localpart, device.ID, r.DeviceKeys); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		// Tell the other servers about the new keys so they don't have to
+		// query them.
+		dev, err := deviceDB.GetDeviceByID(localpart, device.ID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if resErr := sendDeviceListUpdate(req, deviceDB, accountDB, localpart, *dev, false, r.DeviceKeys, deviceListProducer); resErr != nil {
+			return *resErr
+		}
+	}
+	if len(oneTimeKeys) > 0 {
+		if err = deviceDB.StoreOneTimeKeys(localpart, device.ID, oneTimeKeys); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+
+	counts, err := deviceDB.CountOneTimeKeys(localpart, device.ID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: uploadKeysResponse{OneTimeKeyCounts: counts},
+	}
+}
+
+// UploadSigningKeys implements POST /keys/device_signing/upload
+func UploadSigningKeys(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	uiaSessions *uia.Sessions, deviceListProducer *producers.DeviceListProducer,
+) util.JSONResponse {
+	var r uploadSigningKeysRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := uiaSessions.Verify(req, r.Auth, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	keys := map[string]json.RawMessage{}
+	for keyType, keyJSON := range map[string]json.RawMessage{
+		e2ekeys.MasterKey:      r.MasterKey,
+		e2ekeys.SelfSigningKey: r.SelfSigningKey,
+		e2ekeys.UserSigningKey: r.UserSigningKey,
+	} {
+		if keyJSON != nil {
+			keys[keyType] = keyJSON
+		}
+	}
+	if len(keys) == 0 {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.MissingArgument("At least one cross-signing key must be uploaded"),
+		}
+	}
+
+	current, err := accountDB.GetCrossSigningKeys(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	err = e2ekeys.CheckCrossSigningKeys(device.UserID, keys, current[e2ekeys.MasterKey])
+	switch err.(type) {
+	case nil:
+	case e2ekeys.InvalidCrossSigningKeyError:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	case e2ekeys.InvalidCrossSigningSignatureError:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidSignature(err.Error()),
+		}
+	default:
+		return httputil.LogThenError(req, err)
+	}
+
+	toStore := make(map[string][]byte, len(keys))
+	for keyType, keyJSON := range keys {
+		toStore[keyType] = keyJSON
+	}
+	if err = accountDB.StoreCrossSigningKeys(localpart, toStore); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// The user-signing key is private to the user, so the other servers are
+	// only told about the other keys.
+	if r.MasterKey != nil || r.SelfSigningKey != nil {
+		roomIDs, err := joinedRoomIDs(accountDB, localpart)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if err = deviceListProducer.SendSigningKeyUpdate(
+			device.UserID, r.MasterKey, r.SelfSigningKey, roomIDs,
+		); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -15,30 +15,153 @@
 package writers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/events"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
 )
 
-// SendMembership implements PUT /rooms/{roomID}/(join|kick|ban|unban|leave|invite)
-// by building a m.room.member event then sending it to the room server
+// membershipRequest represents the body of a request to one of the
+// /rooms/{roomID}/(kick|ban|unban|invite) endpoints.
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-invite-1
+type membershipRequest struct {
+	UserID   string `json:"user_id"`
+	Reason   string `json:"reason"`
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+}
+
+// idServerLookupResponse represents the response described at https://matrix.org/docs/spec/client_server/r0.2.0.html#invitation-storage
+type idServerLookupResponse struct {
+	TS         int64                        `json:"ts"`
+	NotBefore  int64                        `json:"not_before"`
+	NotAfter   int64                        `json:"not_after"`
+	Medium     string                       `json:"medium"`
+	Address    string                       `json:"address"`
+	MXID       string                       `json:"mxid"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// idServerStoreInviteResponse represents the response described at https://matrix.org/docs/spec/identity_service/unstable.html#invitation-storage
+type idServerStoreInviteResponse struct {
+	PublicKey   string             `json:"public_key"`
+	Token       string             `json:"token"`
+	DisplayName string             `json:"display_name"`
+	PublicKeys  []common.PublicKey `json:"public_keys"`
+}
+
+// idServerError is returned when an identity server responds to a request
+// with a HTTP error status code. It holds the standard Matrix error the
+// identity server returned.
+type idServerError struct {
+	// The name of the identity server
+	IDServer string
+	// The HTTP status code of the identity server's response
+	StatusCode int
+	// The error the identity server put in the response's body
+	jsonerror.MatrixError
+}
+
+func (e *idServerError) Error() string {
+	return fmt.Sprintf(
+		"identity server %q responded with HTTP status %d: %s",
+		e.IDServer, e.StatusCode, e.MatrixError.Error(),
+	)
+}
+
+// newIDServerError builds an idServerError from a non-200 response from an
+// identity server. If the response's body isn't a standard Matrix error, the
+// error code is set to M_UNKNOWN.
+func newIDServerError(idServer string, resp *http.Response) *idServerError {
+	e := idServerError{IDServer: idServer, StatusCode: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(&e.MatrixError); err != nil || e.ErrCode == "" {
+		e.MatrixError = *jsonerror.Unknown(http.StatusText(resp.StatusCode))
+	}
+	return &e
+}
+
+// SendMembership implements PUT /rooms/{roomID}/(kick|ban|unban|leave|invite)
+// by building a m.room.member event then sending it to the room server.
+// Membership changes are rate limited per user using the given limiter.
 func SendMembership(
 	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
 	roomID string, membership string, cfg config.Dendrite,
 	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+	limiter *ratelimit.Limiter,
 ) util.JSONResponse {
-	stateKey, reason, reqErr := getMembershipStateKey(req, device, membership)
+	if allowed, retryAfter := limiter.Allow(device.UserID); !allowed {
+		return util.JSONResponse{
+			Code: 429,
+			JSON: jsonerror.LimitExceeded(
+				"Too many membership changes, please try again later.",
+				int64(retryAfter/time.Millisecond),
+			),
+		}
+	}
+
+	// Guests can only join and leave rooms.
+	if membership != "leave" {
+		if resErr := auth.VerifyNotGuest(device, accountDB); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var body membershipRequest
+	if membership == "ban" || membership == "unban" || membership == "kick" || membership == "invite" {
+		// If we're in this case, the target of the membership change is contained
+		// in the request body, possibly along with a reason (for "kick" and "ban")
+		// so we need to parse it
+		if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+			return *reqErr
+		}
+	}
+
+	if resErr := checkSenderMembership(req, device, roomID, membership, queryAPI); resErr != nil {
+		return *resErr
+	}
+	if resErr := checkMembershipPermissions(req, device, roomID, membership, body.UserID, queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	if membership == "invite" && body.UserID == "" && body.Address != "" {
+		// The invitee is identified by a third-party identifier, which we need to
+		// resolve to a Matrix user ID through an identity server.
+		mxid, resErr := checkAndProcessThreePIDInvite(req, accountDB, device, &body, roomID, cfg, queryAPI, producer)
+		if resErr != nil {
+			return *resErr
+		}
+		if mxid == "" {
+			// A m.room.third_party_invite event has been sent instead of the
+			// m.room.member one, so there's nothing more to do.
+			return util.JSONResponse{
+				Code: 200,
+				JSON: struct{}{},
+			}
+		}
+		body.UserID = mxid
+	}
+
+	stateKey, reason, reqErr := getMembershipStateKey(body, device, membership)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -81,12 +204,17 @@ func SendMembership(
 		return httputil.LogThenError(req, err)
 	}
 
-	event, err := events.BuildEvent(&builder, cfg, queryAPI, nil)
+	event, err := events.BuildEvent(req.Context(), &builder, cfg, queryAPI, nil)
 	if err == events.ErrRoomNoExists {
 		return util.JSONResponse{
 			Code: 404,
 			JSON: jsonerror.NotFound(err.Error()),
 		}
+	} else if tooLargeErr, ok := err.(common.EventTooLargeError); ok {
+		return util.JSONResponse{
+			Code: 413,
+			JSON: jsonerror.TooLarge(tooLargeErr.Error()),
+		}
 	} else if err != nil {
 		return httputil.LogThenError(req, err)
 	}
@@ -101,28 +229,143 @@ func SendMembership(
 	}
 }
 
+// checkSenderMembership checks that the user sending a membership change is
+// in a position to make it: leaving requires them to be joined to or invited
+// to the room, and any other change requires them to be joined to it.
+// This lets us reject most invalid changes before building the event.
+// Returns a JSONResponse with a corresponding error code and message if the
+// check failed or couldn't be done.
+func checkSenderMembership(
+	req *http.Request, device *authtypes.Device, roomID string, membership string,
+	queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	queryReq := api.QueryMembershipRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}
+	var queryRes api.QueryMembershipResponse
+	if err := queryAPI.QueryMembership(req.Context(), &queryReq, &queryRes); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+
+	if !queryRes.RoomExists {
+		return &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound(events.ErrRoomNoExists.Error()),
+		}
+	}
+
+	switch {
+	case queryRes.Membership == "join":
+		return nil
+	case membership == "leave" && queryRes.Membership == "invite":
+		return nil
+	}
+
+	return &util.JSONResponse{
+		Code: 403,
+		JSON: jsonerror.Forbidden("You aren't a member of the room"),
+	}
+}
+
+// checkMembershipPermissions checks that the power level of the user sending
+// a membership change is high enough to make it, according to the current
+// m.room.power_levels event of the room. Kicking and banning also require the
+// sender to have a higher power level than the target.
+// If the room has no m.room.power_levels event, only its creator has a power
+// level above the default.
+// Returns a JSONResponse with a corresponding error code and message if the
+// check failed or couldn't be done.
+func checkMembershipPermissions(
+	req *http.Request, device *authtypes.Device, roomID string, membership string,
+	targetUserID string, queryAPI api.RoomserverQueryAPI,
+) *util.JSONResponse {
+	if membership == "leave" {
+		// Anyone can leave a room.
+		return nil
+	}
+
+	stateReq := api.QueryCurrentStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.create", StateKey: ""},
+			{EventType: "m.room.power_levels", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryCurrentStateResponse
+	if err := queryAPI.QueryCurrentState(req.Context(), &stateReq, &stateRes); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: stateRes.StateEventIDs}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return &resErr
+	}
+
+	powerLevels := common.DefaultPowerLevelContent()
+	var creator string
+	hasPowerLevels := false
+	for _, ev := range eventsRes.Events {
+		switch ev.Type() {
+		case "m.room.create":
+			creator = ev.Sender()
+		case "m.room.power_levels":
+			hasPowerLevels = true
+			if err := json.Unmarshal(ev.Content(), &powerLevels); err != nil {
+				resErr := httputil.LogThenError(req, err)
+				return &resErr
+			}
+		}
+	}
+	if !hasPowerLevels && creator != "" {
+		powerLevels.Users[creator] = 100
+	}
+
+	senderLevel := powerLevels.UserLevel(device.UserID)
+	var required int
+	switch membership {
+	case "invite":
+		required = powerLevels.Invite
+	case "kick":
+		required = powerLevels.Kick
+	case "ban", "unban":
+		required = powerLevels.Ban
+	}
+	if senderLevel < required {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(fmt.Sprintf(
+				"You need a power level of at least %d to %s users", required, membership,
+			)),
+		}
+	}
+
+	if (membership == "kick" || membership == "ban") && targetUserID != device.UserID &&
+		senderLevel <= powerLevels.UserLevel(targetUserID) {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(fmt.Sprintf(
+				"You can only %s users with a lower power level than yours", membership,
+			)),
+		}
+	}
+
+	return nil
+}
+
 // getMembershipStateKey extracts the target user ID of a membership change.
-// For "join" and "leave" this will be the ID of the user making the change.
+// For "leave" this will be the ID of the user making the change.
 // For "ban", "unban", "kick" and "invite" the target user ID will be in the JSON request body.
-// In the latter case, if there was an issue retrieving the user ID from the request body,
-// returns a JSONResponse with a corresponding error code and message.
+// In the latter case, if there was no user ID in the request body, returns a
+// JSONResponse with a corresponding error code and message.
 func getMembershipStateKey(
-	req *http.Request, device *authtypes.Device, membership string,
+	body membershipRequest, device *authtypes.Device, membership string,
 ) (stateKey string, reason string, response *util.JSONResponse) {
 	if membership == "ban" || membership == "unban" || membership == "kick" || membership == "invite" {
-		// If we're in this case, the state key is contained in the request body,
-		// possibly along with a reason (for "kick" and "ban") so we need to parse
-		// it
-		var requestBody struct {
-			UserID string `json:"user_id"`
-			Reason string `json:"reason"`
-		}
-
-		if reqErr := httputil.UnmarshalJSONRequest(req, &requestBody); reqErr != nil {
-			response = reqErr
-			return
-		}
-		if requestBody.UserID == "" {
+		if body.UserID == "" {
 			response = &util.JSONResponse{
 				Code: 400,
 				JSON: jsonerror.BadJSON("'user_id' must be supplied."),
@@ -130,11 +373,371 @@ func getMembershipStateKey(
 			return
 		}
 
-		stateKey = requestBody.UserID
-		reason = requestBody.Reason
+		stateKey = body.UserID
+		reason = body.Reason
 	} else {
 		stateKey = device.UserID
 	}
 
 	return
 }
+
+// checkAndProcessThreePIDInvite handles an invite sent to a third-party
+// identifier. It asks the identity server given in the request body for the
+// Matrix user ID bound to that identifier. If there is one, it is returned so
+// the invite can be processed as a normal m.room.member invite.
+// If there isn't, stores the invite on the identity server and in the accounts
+// database, then sends a m.room.third_party_invite event to the room server,
+// and returns an empty string.
+// Returns a JSONResponse with a corresponding error code and message if
+// something went wrong.
+func checkAndProcessThreePIDInvite(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	body *membershipRequest, roomID string, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) (mxid string, resErr *util.JSONResponse) {
+	if body.IDServer == "" || body.Medium == "" {
+		return "", &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("'id_server', 'medium' and 'address' must all be supplied."),
+		}
+	}
+
+	lookupRes, storeInviteRes, err := queryIDServer(accountDB, cfg, device, body, roomID)
+	if idErr, ok := err.(*idServerError); ok {
+		common.GetLogger(req.Context()).WithError(idErr).Warn("identity server request failed")
+		if idErr.StatusCode >= 400 && idErr.StatusCode < 500 {
+			// The identity server rejected the 3PID, pass the error on
+			return "", &util.JSONResponse{
+				Code: 400,
+				JSON: &idErr.MatrixError,
+			}
+		}
+		return "", &util.JSONResponse{
+			Code: 502,
+			JSON: jsonerror.Unknown("The identity server failed to process the request"),
+		}
+	} else if err != nil {
+		resErr = new(util.JSONResponse)
+		*resErr = httputil.LogThenError(req, err)
+		return
+	}
+
+	if lookupRes.MXID != "" {
+		return lookupRes.MXID, nil
+	}
+
+	invite := authtypes.ThreePIDInvite{
+		Token:       storeInviteRes.Token,
+		IDServer:    body.IDServer,
+		Medium:      body.Medium,
+		Address:     body.Address,
+		RoomID:      roomID,
+		Sender:      device.UserID,
+		DisplayName: storeInviteRes.DisplayName,
+	}
+	if err = accountDB.SaveThreePIDInvite(&invite); err != nil {
+		resErr = new(util.JSONResponse)
+		*resErr = httputil.LogThenError(req, err)
+		return
+	}
+
+	err = emit3PIDInviteEvent(req.Context(), body, storeInviteRes, device, roomID, cfg, queryAPI, producer)
+	if err == events.ErrRoomNoExists {
+		return "", &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound(err.Error()),
+		}
+	} else if err != nil {
+		resErr = new(util.JSONResponse)
+		*resErr = httputil.LogThenError(req, err)
+		return
+	}
+
+	return "", nil
+}
+
+// queryIDServer handles all the requests to the identity server needed to
+// process a 3PID invite: it looks up the Matrix user ID bound to the
+// third-party identifier, and if there isn't one, asks the identity server to
+// store the invite.
+// Returns the response to the lookup, the response to the invite storage
+// request (nil if the third-party identifier is bound to a Matrix user ID), or
+// an error if something went wrong while talking to the identity server or if
+// the lookup response couldn't be verified.
+func queryIDServer(
+	accountDB *accounts.Database, cfg config.Dendrite, device *authtypes.Device,
+	body *membershipRequest, roomID string,
+) (lookupRes *idServerLookupResponse, storeInviteRes *idServerStoreInviteResponse, err error) {
+	// Lookup the 3PID
+	lookupRes, err = queryIDServerLookup(body)
+	if err != nil {
+		return
+	}
+
+	if lookupRes.MXID == "" {
+		// No Matrix ID matches with the given 3PID, ask the server to store the
+		// invite and return a token
+		storeInviteRes, err = queryIDServerStoreInvite(accountDB, cfg, device, body, roomID)
+		return
+	}
+
+	// A Matrix ID matches with the given 3PID, check that the association is
+	// currently valid and is signed by the identity server
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if lookupRes.NotBefore > now || now > lookupRes.NotAfter {
+		err = fmt.Errorf(
+			"identity server %q returned an association for %q that isn't valid at %d",
+			body.IDServer, body.Address, now,
+		)
+		return
+	}
+
+	err = checkIDServerSignatures(accountDB, body, lookupRes)
+	return
+}
+
+// queryIDServerLookup sends a response to the identity server on /_matrix/identity/api/v1/lookup
+// and returns the response as a structure.
+// Returns an *idServerError if the identity server responded with an error status code.
+// Returns an error if the request failed to send or if the response couldn't be parsed.
+func queryIDServerLookup(body *membershipRequest) (*idServerLookupResponse, error) {
+	address := url.QueryEscape(body.Address)
+	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/lookup?medium=%s&address=%s", body.IDServer, body.Medium, address)
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newIDServerError(body.IDServer, resp)
+	}
+
+	var res idServerLookupResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return &res, err
+}
+
+// queryIDServerStoreInvite sends a request to the identity server on /_matrix/identity/api/v1/store-invite
+// and returns the response as a structure.
+// Returns an *idServerError if the identity server responded with an error status code.
+// Returns an error if the request failed to send or if the response couldn't be parsed.
+func queryIDServerStoreInvite(
+	accountDB *accounts.Database, cfg config.Dendrite, device *authtypes.Device,
+	body *membershipRequest, roomID string,
+) (*idServerStoreInviteResponse, error) {
+	// Retrieve the sender's profile to get their display name
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var profile *authtypes.Profile
+	if serverName == cfg.Matrix.ServerName {
+		profile, err = accountDB.GetProfileByLocalpart(localpart)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		profile = &authtypes.Profile{}
+	}
+
+	// Refers to https://matrix.org/docs/spec/identity_service/unstable.html#invitation-storage
+	// TODO: Send the room's name, alias, avatar and join rules too
+	data := url.Values{}
+	data.Add("medium", body.Medium)
+	data.Add("address", body.Address)
+	data.Add("room_id", roomID)
+	data.Add("sender", device.UserID)
+	data.Add("sender_display_name", profile.DisplayName)
+
+	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/store-invite", body.IDServer)
+	resp, err := http.PostForm(requestURL, data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newIDServerError(body.IDServer, resp)
+	}
+
+	var res idServerStoreInviteResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Token == "" {
+		return nil, fmt.Errorf("identity server %q didn't return a token for the invite", body.IDServer)
+	}
+	return &res, nil
+}
+
+// getOrFetchIDServerPublicKey returns the base64-decoded public key identified
+// with a given ID on a given identity server. If the key has already been
+// fetched and stored in the accounts database, asks the identity server whether
+// it's still valid before returning it, and removes it from the database if it
+// isn't. If the key isn't in the database, fetches it from the identity server
+// and stores it.
+// Returns an error if the key has been revoked or if something went wrong while
+// talking to the database or the identity server.
+func getOrFetchIDServerPublicKey(
+	accountDB *accounts.Database, idServerName string, keyID string,
+) ([]byte, error) {
+	pubKey, err := accountDB.GetIDServerPublicKey(idServerName, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKey != nil {
+		valid, err := queryIDServerPubKeyIsValid(idServerName, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		if valid {
+			return pubKey, nil
+		}
+		if err = accountDB.RemoveIDServerPublicKey(idServerName, keyID); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("key %q of identity server %q has been revoked", keyID, idServerName)
+	}
+
+	if pubKey, err = queryIDServerPubKey(idServerName, keyID); err != nil {
+		return nil, err
+	}
+
+	fetchedAt := time.Now().UnixNano() / int64(time.Millisecond)
+	if err = accountDB.SaveIDServerPublicKey(idServerName, keyID, pubKey, fetchedAt); err != nil {
+		return nil, err
+	}
+
+	return pubKey, nil
+}
+
+// queryIDServerPubKey requests a public key identified with a given ID to the
+// a given identity server and returns the matching base64-decoded public key.
+// Returns an error if the request couldn't be sent, if its body couldn't be parsed
+// or if the key couldn't be decoded from base64.
+func queryIDServerPubKey(idServerName string, keyID string) ([]byte, error) {
+	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/pubkey/%s", idServerName, keyID)
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	var pubKeyRes struct {
+		PublicKey gomatrixserverlib.Base64String `json:"public_key"`
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("identity server %q responded with HTTP status %d when fetching key %q", idServerName, resp.StatusCode, keyID)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&pubKeyRes)
+	return pubKeyRes.PublicKey, err
+}
+
+// queryIDServerPubKeyIsValid asks a given identity server on
+// /_matrix/identity/api/v1/pubkey/isvalid whether a given public key is still
+// valid, i.e. hasn't been revoked.
+// Returns an error if the request couldn't be sent or if its body couldn't be parsed.
+func queryIDServerPubKeyIsValid(idServerName string, pubKey []byte) (bool, error) {
+	encodedKey, err := json.Marshal(gomatrixserverlib.Base64String(pubKey))
+	if err != nil {
+		return false, err
+	}
+	// Strip the quotes around the marshalled base64 string
+	encodedKey = encodedKey[1 : len(encodedKey)-1]
+
+	requestURL := fmt.Sprintf(
+		"https://%s/_matrix/identity/api/v1/pubkey/isvalid?public_key=%s",
+		idServerName, url.QueryEscape(string(encodedKey)),
+	)
+	resp, err := http.Get(requestURL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("identity server %q responded with HTTP status %d when checking a key's validity", idServerName, resp.StatusCode)
+	}
+
+	var isValidRes struct {
+		Valid bool `json:"valid"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&isValidRes)
+	return isValidRes.Valid, err
+}
+
+// checkIDServerSignatures iterates over the signatures of a requests.
+// If no signature can be found for the ID server's domain, returns an error, else
+// iterates over the signature for the said domain, retrieves the matching public
+// key (from the accounts database if it has already been fetched), and verify it.
+// Returns nil if all the verifications succeeded.
+// Returns an error if something failed in the process.
+func checkIDServerSignatures(
+	accountDB *accounts.Database, body *membershipRequest, res *idServerLookupResponse,
+) error {
+	// Mashall the body so we can give it to VerifyJSON
+	marshalledBody, err := json.Marshal(*res)
+	if err != nil {
+		return err
+	}
+
+	signatures, ok := res.Signatures[body.IDServer]
+	if !ok || len(signatures) == 0 {
+		return errors.New("No signature for domain " + body.IDServer)
+	}
+
+	for keyID := range signatures {
+		pubKey, err := getOrFetchIDServerPublicKey(accountDB, body.IDServer, keyID)
+		if err != nil {
+			return err
+		}
+		if err = gomatrixserverlib.VerifyJSON(body.IDServer, gomatrixserverlib.KeyID(keyID), ed25519.PublicKey(pubKey), marshalledBody); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emit3PIDInviteEvent builds and sends a m.room.third_party_invite event to the
+// room server, using the token and public keys the identity server returned
+// when storing the invite.
+// Returns events.ErrRoomNoExists if the room doesn't exist.
+// Returns an error if something else went wrong.
+func emit3PIDInviteEvent(
+	ctx context.Context, body *membershipRequest, res *idServerStoreInviteResponse,
+	device *authtypes.Device, roomID string, cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI, producer *producers.RoomserverProducer,
+) error {
+	builder := &gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     "m.room.third_party_invite",
+		StateKey: &res.Token,
+	}
+
+	validityURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/pubkey/isvalid", body.IDServer)
+	content := common.ThirdPartyInviteContent{
+		DisplayName:    res.DisplayName,
+		KeyValidityURL: validityURL,
+		PublicKey:      res.PublicKey,
+		PublicKeys:     res.PublicKeys,
+	}
+
+	if err := builder.SetContent(content); err != nil {
+		return err
+	}
+
+	event, err := events.BuildEvent(ctx, builder, cfg, queryAPI, nil)
+	if err != nil {
+		return err
+	}
+
+	return producer.SendEvents([]gomatrixserverlib.Event{*event}, cfg.Matrix.ServerName)
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type changePasswordRequest struct {
+	NewPassword string        `json:"new_password"`
+	Auth        *uia.AuthDict `json:"auth"`
+}
+
+// ChangePassword implements POST /account/password
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-password
+func ChangePassword(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	device *authtypes.Device, uiaSessions *uia.Sessions, cfg config.Dendrite,
+) util.JSONResponse {
+	var r changePasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	if resErr := uiaSessions.Verify(req, r.Auth, device.UserID); resErr != nil {
+		return *resErr
+	}
+
+	if len(r.NewPassword) > maxPasswordLength {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON(fmt.Sprintf("'new_password' >%d characters", maxPasswordLength)),
+		}
+	}
+	if err := auth.CheckPasswordPolicy(r.NewPassword, cfg.Matrix.PasswordPolicy); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.WeakPassword(err.Error()),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if err := accountDB.SetPassword(localpart, r.NewPassword); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Log out every other session so that whoever knew the old password can't
+	// keep using the account.
+	if err := deviceDB.RemoveAllDevicesExcept(localpart, device.ID); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type setPusherRequest struct {
+	// Kind is nil when removing the pusher.
+	Kind              *string                `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	PushKey           string                 `json:"pushkey"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag"`
+	Lang              string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+	Append            bool                   `json:"append"`
+}
+
+// SetPusher implements POST /pushers/set
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-pushers-set
+// Only HTTP pushers are supported.
+func SetPusher(
+	req *http.Request, device *authtypes.Device, accountDB *accounts.Database,
+) util.JSONResponse {
+	var r setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.AppID == "" || r.PushKey == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("app_id and pushkey are required"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if r.Kind == nil {
+		if err = accountDB.RemovePusher(r.AppID, r.PushKey, localpart); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		return util.JSONResponse{
+			Code: 200,
+			JSON: struct{}{},
+		}
+	}
+
+	if *r.Kind != "http" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Only http pushers are supported"),
+		}
+	}
+	if url, ok := r.Data["url"].(string); !ok || url == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("HTTP pushers need a URL in their data"),
+		}
+	}
+
+	pusher := authtypes.Pusher{
+		Localpart:         localpart,
+		Kind:              *r.Kind,
+		AppID:             r.AppID,
+		PushKey:           r.PushKey,
+		AppDisplayName:    r.AppDisplayName,
+		DeviceDisplayName: r.DeviceDisplayName,
+		ProfileTag:        r.ProfileTag,
+		Lang:              r.Lang,
+		Data:              r.Data,
+		PushKeyTS:         gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err = accountDB.SetPusher(pusher, !r.Append); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
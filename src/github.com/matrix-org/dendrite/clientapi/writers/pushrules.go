@@ -0,0 +1,240 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/push"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// pushRulesScopeGlobal is the only scope of push rules.
+const pushRulesScopeGlobal = "global"
+
+type pushRuleRequest struct {
+	Actions    []interface{}    `json:"actions"`
+	Conditions []push.Condition `json:"conditions"`
+	Pattern    string           `json:"pattern"`
+}
+
+type pushRuleEnabledRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type pushRuleActionsRequest struct {
+	Actions []interface{} `json:"actions"`
+}
+
+// PutPushRule implements PUT /pushrules/{scope}/{kind}/{ruleID}
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-pushrules-scope-kind-ruleid
+func PutPushRule(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	localpart, ruleset, resErr := getPushRuleset(req, device, scope, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	if ruleset.Rules(kind) == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule kind"),
+		}
+	}
+	if push.IsDefaultRuleID(ruleID) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Push rule IDs starting with '.' are reserved for server default rules"),
+		}
+	}
+
+	var r pushRuleRequest
+	if resErr = httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !push.ValidActions(r.Actions) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid push rule actions"),
+		}
+	}
+
+	rule := push.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: r.Actions,
+	}
+	switch kind {
+	case push.KindOverride, push.KindUnderride:
+		rule.Conditions = r.Conditions
+		if rule.Conditions == nil {
+			rule.Conditions = []push.Condition{}
+		}
+	case push.KindContent:
+		if r.Pattern == "" {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("Content push rules need a pattern"),
+			}
+		}
+		rule.Pattern = r.Pattern
+	}
+	if existing := ruleset.Find(kind, ruleID); existing != nil {
+		rule.Enabled = existing.Enabled
+	}
+
+	query := req.URL.Query()
+	if !ruleset.Insert(kind, rule, query.Get("before"), query.Get("after")) {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The push rule to place this one relative to was not found"),
+		}
+	}
+	return savePushRuleset(req, localpart, ruleset, accountDB)
+}
+
+// DeletePushRule implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#delete-matrix-client-r0-pushrules-scope-kind-ruleid
+func DeletePushRule(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	localpart, ruleset, resErr := getPushRuleset(req, device, scope, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := ruleset.Find(kind, ruleID)
+	if rule == nil {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Push rule not found"),
+		}
+	}
+	if rule.Default {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Server default push rules cannot be deleted"),
+		}
+	}
+	ruleset.Remove(kind, ruleID)
+	return savePushRuleset(req, localpart, ruleset, accountDB)
+}
+
+// PutPushRuleEnabled implements PUT /pushrules/{scope}/{kind}/{ruleID}/enabled
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-pushrules-scope-kind-ruleid-enabled
+func PutPushRuleEnabled(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	var r pushRuleEnabledRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Enabled == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Missing enabled"),
+		}
+	}
+	return updatePushRule(req, device, scope, kind, ruleID, accountDB, cfg, func(rule *push.Rule) {
+		rule.Enabled = *r.Enabled
+	})
+}
+
+// PutPushRuleActions implements PUT /pushrules/{scope}/{kind}/{ruleID}/actions
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#put-matrix-client-r0-pushrules-scope-kind-ruleid-actions
+func PutPushRuleActions(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) util.JSONResponse {
+	var r pushRuleActionsRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Actions == nil || !push.ValidActions(r.Actions) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid push rule actions"),
+		}
+	}
+	return updatePushRule(req, device, scope, kind, ruleID, accountDB, cfg, func(rule *push.Rule) {
+		rule.Actions = r.Actions
+	})
+}
+
+// updatePushRule applies the update to an existing push rule of the user and
+// stores the updated ruleset.
+func updatePushRule(
+	req *http.Request, device *authtypes.Device, scope, kind, ruleID string,
+	accountDB *accounts.Database, cfg config.Dendrite, update func(*push.Rule),
+) util.JSONResponse {
+	localpart, ruleset, resErr := getPushRuleset(req, device, scope, accountDB, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	rule := ruleset.Find(kind, ruleID)
+	if rule == nil {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Push rule not found"),
+		}
+	}
+	update(rule)
+	return savePushRuleset(req, localpart, ruleset, accountDB)
+}
+
+// getPushRuleset returns the localpart of the user and their push rules in
+// the given scope.
+func getPushRuleset(
+	req *http.Request, device *authtypes.Device, scope string,
+	accountDB *accounts.Database, cfg config.Dendrite,
+) (string, *push.Ruleset, *util.JSONResponse) {
+	if scope != pushRulesScopeGlobal {
+		return "", nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown push rules scope"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return "", nil, &resErr
+	}
+	ruleset, err := push.GetRuleset(accountDB, localpart, cfg.Matrix.ServerName)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return "", nil, &resErr
+	}
+	return localpart, ruleset, nil
+}
+
+func savePushRuleset(
+	req *http.Request, localpart string, ruleset *push.Ruleset, accountDB *accounts.Database,
+) util.JSONResponse {
+	if err := push.SaveRuleset(accountDB, localpart, ruleset); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
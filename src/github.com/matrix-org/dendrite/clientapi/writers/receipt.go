@@ -0,0 +1,99 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// SendReceipt implements POST /rooms/{roomID}/receipt/{receiptType}/{eventID}
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-rooms-roomid-receipt-receipttype-eventid
+func SendReceipt(
+	req *http.Request, device *authtypes.Device,
+	roomID string, receiptType string, eventID string,
+	accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+	receiptAPI api.RoomserverReceiptAPI, receiptProducer *producers.ReceiptProducer,
+) util.JSONResponse {
+	if receiptType != "m.read" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Receipt type must be m.read"),
+		}
+	}
+
+	// Only users joined to the room can send receipts in it.
+	if resErr := checkSenderMembership(req, device, roomID, "", queryAPI); resErr != nil {
+		return *resErr
+	}
+
+	// The receipt must be for an event of the room the user can see.
+	eventsReq := api.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown event"),
+		}
+	}
+	event := eventsRes.Events[0]
+
+	receipt := api.Receipt{
+		RoomID:    roomID,
+		UserID:    device.UserID,
+		Type:      receiptType,
+		EventID:   eventID,
+		Timestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	receiptReq := api.SetReceiptRequest{Receipt: receipt}
+	var receiptRes api.SetReceiptResponse
+	if err := receiptAPI.SetReceipt(&receiptReq, &receiptRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if err := receiptProducer.SendReceipt(receipt, receiptRes.StreamPosition); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// The user read the events of the room up to this one, so their
+	// notifications aren't needed anymore.
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if err = accountDB.ClearNotifications(localpart, roomID, event.OriginServerTS()); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeQueryAPI is a room server where the user is joined to every room and
+// which knows about the given events.
+type fakeQueryAPI struct {
+	api.RoomserverQueryAPI
+	events map[string]gomatrixserverlib.Event
+}
+
+func (q *fakeQueryAPI) QueryMembership(
+	ctx context.Context, request *api.QueryMembershipRequest, response *api.QueryMembershipResponse,
+) error {
+	response.RoomExists = true
+	response.Membership = "join"
+	return nil
+}
+
+func (q *fakeQueryAPI) QueryEventsByID(
+	ctx context.Context, request *api.QueryEventsByIDRequest, response *api.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range request.EventIDs {
+		if event, ok := q.events[eventID]; ok {
+			response.Events = append(response.Events, event)
+		}
+	}
+	return nil
+}
+
+// fakeReceiptAPI records the receipts it is asked to store.
+type fakeReceiptAPI struct {
+	api.RoomserverReceiptAPI
+	receipts []api.Receipt
+}
+
+func (r *fakeReceiptAPI) SetReceipt(request *api.SetReceiptRequest, response *api.SetReceiptResponse) error {
+	r.receipts = append(r.receipts, request.Receipt)
+	return nil
+}
+
+func TestSendReceiptRejectsUnknownEvents(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$other:localhost",
+		"room_id": "!other:localhost",
+		"type": "m.room.message",
+		"sender": "@bob:localhost",
+		"content": {"body": "hello"}
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryAPI := &fakeQueryAPI{events: map[string]gomatrixserverlib.Event{"$other:localhost": event}}
+	device := &authtypes.Device{ID: "device1", UserID: "@alice:localhost"}
+
+	for _, eventID := range []string{
+		// An event the room server doesn't have.
+		"$unknown:localhost",
+		// An event of another room.
+		"$other:localhost",
+	} {
+		receiptAPI := &fakeReceiptAPI{}
+		req := httptest.NewRequest("POST", "/rooms/!room:localhost/receipt/m.read/"+eventID, nil)
+		res := SendReceipt(req, device, "!room:localhost", "m.read", eventID, nil, queryAPI, receiptAPI, nil)
+		if res.Code != 404 {
+			t.Errorf("SendReceipt(%s): want code 404, got %d: %+v", eventID, res.Code, res.JSON)
+			continue
+		}
+		if matrixErr, ok := res.JSON.(*jsonerror.MatrixError); !ok || matrixErr.ErrCode != "M_NOT_FOUND" {
+			t.Errorf("SendReceipt(%s): want M_NOT_FOUND, got %+v", eventID, res.JSON)
+		}
+		if len(receiptAPI.receipts) != 0 {
+			t.Errorf("SendReceipt(%s): want no receipt to be stored, got %+v", eventID, receiptAPI.receipts)
+		}
+	}
+}
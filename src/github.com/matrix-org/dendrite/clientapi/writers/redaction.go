@@ -0,0 +1,167 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/events"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#put-matrix-client-r0-rooms-roomid-redact-eventid-txnid
+type redactionRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// SendRedaction implements PUT /rooms/{roomID}/redact/{eventID}/{txnID}
+// Users can redact their own events, and other users' events if their power
+// level is at least the redact level of the room.
+func SendRedaction(
+	req *http.Request, device *authtypes.Device,
+	roomID, eventID, txnID string,
+	cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	limiter *ratelimit.EventLimiter,
+) util.JSONResponse {
+	return processTransaction(req, accountDB, device, txnID, func() util.JSONResponse {
+		return sendRedaction(req, device, roomID, eventID, cfg, queryAPI, producer, accountDB, limiter)
+	})
+}
+
+func sendRedaction(
+	req *http.Request, device *authtypes.Device,
+	roomID, eventID string,
+	cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	limiter *ratelimit.EventLimiter,
+) util.JSONResponse {
+	if resErr := checkEventRateLimit(device, roomID, false, limiter); resErr != nil {
+		return *resErr
+	}
+	if resErr := auth.VerifyNotGuest(device, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	var r redactionRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	// Only let the user redact events they can see.
+	eventsReq := api.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	target := eventsRes.Events[0]
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:  device.UserID,
+		RoomID:  roomID,
+		Type:    "m.room.redaction",
+		Redacts: eventID,
+	}
+	if err := builder.SetContent(r); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	e, err := events.BuildEvent(req.Context(), &builder, cfg, queryAPI, &queryRes)
+	if err == events.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if versionErr, ok := err.(common.UnsupportedRoomVersionError); ok {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion(versionErr.Error()),
+		}
+	} else if tooLargeErr, ok := err.(common.EventTooLargeError); ok {
+		return util.JSONResponse{
+			Code: 413,
+			JSON: jsonerror.TooLarge(tooLargeErr.Error()),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i]
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*e, &provider); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	// The auth rules only check the redaction against the domain of the
+	// redacted event, so the power level of the user is checked here.
+	if target.Sender() != device.UserID {
+		powerLevels := common.DefaultPowerLevelContent()
+		for _, event := range queryRes.StateEvents {
+			if event.Type() != "m.room.power_levels" {
+				continue
+			}
+			if err = json.Unmarshal(event.Content(), &powerLevels); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		}
+		if powerLevels.UserLevel(device.UserID) < powerLevels.Redact {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("You don't have permission to redact this event"),
+			}
+		}
+	}
+
+	if err = producer.SendEvents([]gomatrixserverlib.Event{*e}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: sendEventResponse{e.EventID()},
+	}
+}
@@ -1,16 +1,28 @@
 package writers
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/auth/uia"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -21,6 +33,13 @@ const (
 	maxUsernameLength = 254 // http://matrix.org/speculator/spec/HEAD/intro.html#user-identifiers TODO account for domain
 )
 
+// validUsernameRegex matches the characters allowed in the localpart of user IDs.
+// http://matrix.org/speculator/spec/HEAD/appendices.html#user-identifiers
+var validUsernameRegex = regexp.MustCompile(`^[0-9a-z_\-./=]+$`)
+
+// recaptchaClient is used to check reCAPTCHA responses.
+var recaptchaClient = &http.Client{Timeout: 30 * time.Second}
+
 // registerRequest represents the submitted registration request.
 // It can be broken down into 2 sections: the auth dictionary and registration parameters.
 // Registration parameters vary depending on the request, and will need to remembered across
@@ -31,6 +50,12 @@ type registerRequest struct {
 	// registration parameters.
 	Password string `json:"password"`
 	Username string `json:"username"`
+	DeviceID string `json:"device_id"`
+	// The display name to give the device created for the new user.
+	InitialDisplayName *string `json:"initial_device_display_name"`
+	// m.login.application_service when an application service registers a
+	// user in its namespaces.
+	Type authtypes.LoginType `json:"type"`
 	// user-interactive auth params
 	Auth authDict `json:"auth"`
 }
@@ -38,27 +63,10 @@ type registerRequest struct {
 type authDict struct {
 	Type    authtypes.LoginType `json:"type"`
 	Session string              `json:"session"`
-	// TODO: Lots of custom keys depending on the type
-}
-
-// http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#user-interactive-authentication-api
-type userInteractiveResponse struct {
-	Flows     []authFlow             `json:"flows"`
-	Completed []authtypes.LoginType  `json:"completed"`
-	Params    map[string]interface{} `json:"params"`
-	Session   string                 `json:"session"`
-}
-
-// authFlow represents one possible way that the client can authenticate a request.
-// http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#user-interactive-authentication-api
-type authFlow struct {
-	Stages []authtypes.LoginType `json:"stages"`
-}
-
-func newUserInteractiveResponse(sessionID string, fs []authFlow) userInteractiveResponse {
-	return userInteractiveResponse{
-		fs, []authtypes.LoginType{}, make(map[string]interface{}), sessionID,
-	}
+	// The response of the m.login.recaptcha stage.
+	Response string `json:"response"`
+	// The token of the m.login.registration_token stage.
+	Token string `json:"token"`
 }
 
 // http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
@@ -69,6 +77,12 @@ type registerResponse struct {
 	DeviceID    string                       `json:"device_id"`
 }
 
+// recaptchaResponse is the response of the reCAPTCHA API when checking a
+// client's response.
+type recaptchaResponse struct {
+	Success bool `json:"success"`
+}
+
 // Validate returns an error response if the request fails to validate.
 func (r *registerRequest) Validate() *util.JSONResponse {
 	// https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/rest/client/v2_alpha/register.py#L161
@@ -82,6 +96,11 @@ func (r *registerRequest) Validate() *util.JSONResponse {
 			Code: 400,
 			JSON: jsonerror.BadJSON(fmt.Sprintf("'username' >%d characters", maxUsernameLength)),
 		}
+	} else if len(r.Username) > 0 && !validUsernameRegex.MatchString(r.Username) {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidUsername("User ID can only contain characters a-z, 0-9, or '_-./='"),
+		}
 	} else if len(r.Password) > 0 && len(r.Password) < minPasswordLength {
 		return &util.JSONResponse{
 			Code: 400,
@@ -92,7 +111,21 @@ func (r *registerRequest) Validate() *util.JSONResponse {
 }
 
 // Register processes a /register request. http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
-func Register(req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database) util.JSONResponse {
+func Register(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	cfg config.Dendrite, sessions *RegistrationSessions,
+) util.JSONResponse {
+	switch kind := req.URL.Query().Get("kind"); kind {
+	case "", "user":
+	case "guest":
+		return registerGuest(req, accountDB, deviceDB, cfg)
+	default:
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Unknown kind " + kind),
+		}
+	}
+
 	var r registerRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
@@ -102,47 +135,325 @@ func Register(req *http.Request, accountDB *accounts.Database, deviceDB *devices
 		return *resErr
 	}
 
-	logger := util.GetLogger(req.Context())
+	logger := common.GetLogger(req.Context())
 	logger.WithFields(log.Fields{
 		"username":   r.Username,
 		"auth.type":  r.Auth.Type,
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	// TODO: Shared secret registration (create new user scripts)
-	// TODO: AS API registration
+	// Application services register the users in their namespaces with their
+	// as_token, without a password or user-interactive auth.
+	if r.Type == authtypes.LoginTypeApplicationService || r.Auth.Type == authtypes.LoginTypeApplicationService {
+		return registerAppServiceUser(req, accountDB, deviceDB, cfg, r)
+	}
+
 	// TODO: Enable registration config flag
 	// TODO: Guest account upgrading
 
 	// All registration requests must specify what auth they are using to perform this request
-	if r.Auth.Type == "" {
-		return util.JSONResponse{
-			Code: 401,
-			// TODO: Hard-coded 'dummy' auth for now with a bogus session ID.
-			//       Server admins should be able to change things around (eg enable captcha)
-			JSON: newUserInteractiveResponse("totallyuniquesessionid", []authFlow{
-				{[]authtypes.LoginType{authtypes.LoginTypeDummy}},
-			}),
+	sessionID := r.Auth.Session
+	if sessionID == "" {
+		var err error
+		if sessionID, err = auth.GenerateAccessToken(); err != nil {
+			return httputil.LogThenError(req, err)
 		}
 	}
+	completed, token := sessions.get(sessionID)
+	if r.Auth.Type == "" {
+		return registrationChallenge(sessionID, cfg, completed, nil)
+	}
 
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn / recaptcha auth types.
+	// TODO: email / msisdn auth types.
 	switch r.Auth.Type {
-	case authtypes.LoginTypeDummy:
-		// there is nothing to do
-		return completeRegistration(accountDB, deviceDB, r.Username, r.Password)
+	case authtypes.LoginTypeDummy, authtypes.LoginTypeRecaptcha, authtypes.LoginTypeRegistrationToken:
 	default:
 		return util.JSONResponse{
 			Code: 501,
 			JSON: jsonerror.Unknown("unknown/unimplemented auth type"),
 		}
 	}
+	if !isRegistrationStage(cfg, r.Auth.Type) {
+		return registrationChallenge(
+			sessionID, cfg, completed, jsonerror.Forbidden("auth type not allowed: "+string(r.Auth.Type)),
+		)
+	}
+
+	switch r.Auth.Type {
+	case authtypes.LoginTypeRecaptcha:
+		ok, err := checkRecaptcha(req, cfg, r.Auth.Response)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if !ok {
+			return registrationChallenge(
+				sessionID, cfg, completed, jsonerror.Forbidden("Captcha validation failed"),
+			)
+		}
+	case authtypes.LoginTypeRegistrationToken:
+		token = r.Auth.Token
+		matrixErr, err := checkRegistrationToken(accountDB, cfg, token)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if matrixErr != nil {
+			return registrationChallenge(sessionID, cfg, completed, matrixErr)
+		}
+	}
+
+	completed = sessions.addCompleted(sessionID, r.Auth.Type, token)
+	if !hasCompletedRegistrationStages(cfg, completed) {
+		return registrationChallenge(sessionID, cfg, completed, nil)
+	}
+
+	res := completeRegistration(
+		req, accountDB, deviceDB, cfg, r.Username, r.Password, r.DeviceID, r.InitialDisplayName, token,
+	)
+	if res.Code == 200 {
+		sessions.remove(sessionID)
+	}
+	return res
+}
+
+// registrationStages returns the stages clients have to complete to register
+// an account, which depend on whether reCAPTCHA and registration tokens are
+// enabled. There is only one flow.
+func registrationStages(cfg config.Dendrite) []authtypes.LoginType {
+	var stages []authtypes.LoginType
+	if cfg.Matrix.Registration.RecaptchaEnabled {
+		stages = append(stages, authtypes.LoginTypeRecaptcha)
+	}
+	if cfg.Matrix.RegistrationRequiresToken {
+		stages = append(stages, authtypes.LoginTypeRegistrationToken)
+	}
+	if len(stages) == 0 {
+		stages = append(stages, authtypes.LoginTypeDummy)
+	}
+	return stages
+}
+
+// isRegistrationStage returns whether the given stage is one of the stages
+// clients have to complete to register an account.
+func isRegistrationStage(cfg config.Dendrite, stage authtypes.LoginType) bool {
+	for _, s := range registrationStages(cfg) {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCompletedRegistrationStages returns whether all the stages clients have
+// to complete to register an account were completed.
+func hasCompletedRegistrationStages(cfg config.Dendrite, completed []authtypes.LoginType) bool {
+	done := make(map[authtypes.LoginType]bool)
+	for _, stage := range completed {
+		done[stage] = true
+	}
+	for _, stage := range registrationStages(cfg) {
+		if !done[stage] {
+			return false
+		}
+	}
+	return true
+}
+
+// registrationChallenge returns the 401 response telling the client which
+// stages it must complete to register, along with the error it hit if there
+// was one.
+func registrationChallenge(
+	sessionID string, cfg config.Dendrite, completed []authtypes.LoginType,
+	matrixErr *jsonerror.MatrixError,
+) util.JSONResponse {
+	res := uia.Response{
+		Flows:     []uia.Flow{{Stages: registrationStages(cfg)}},
+		Completed: append([]authtypes.LoginType{}, completed...),
+		Params:    make(map[string]interface{}),
+		Session:   sessionID,
+	}
+	if cfg.Matrix.Registration.RecaptchaEnabled {
+		res.Params[authtypes.LoginTypeRecaptcha] = map[string]string{
+			"public_key": cfg.Matrix.Registration.RecaptchaPublicKey,
+		}
+	}
+	if matrixErr != nil {
+		res.ErrCode = matrixErr.ErrCode
+		res.Err = matrixErr.Err
+	}
+	return util.JSONResponse{
+		Code: 401,
+		JSON: res,
+	}
+}
+
+// checkRecaptcha asks the reCAPTCHA API whether the response given by the
+// client is valid.
+func checkRecaptcha(req *http.Request, cfg config.Dendrite, response string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+	form := url.Values{
+		"secret":   {cfg.Matrix.Registration.RecaptchaPrivateKey},
+		"response": {response},
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		form.Set("remoteip", host)
+	}
+
+	resp, err := recaptchaClient.PostForm(cfg.Matrix.Registration.RecaptchaSiteVerifyAPI, form)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	var r recaptchaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return false, err
+	}
+	return r.Success, nil
+}
+
+// checkRegistrationToken checks that the given registration token can be
+// used to register an account. Returns the error to send back to the client
+// if it can't, or an error if something went wrong.
+func checkRegistrationToken(
+	accountDB *accounts.Database, cfg config.Dendrite, token string,
+) (*jsonerror.MatrixError, error) {
+	if token == "" {
+		return jsonerror.MissingToken("Missing registration token"), nil
+	}
+	if isConfiguredRegistrationToken(cfg, token) {
+		return nil, nil
+	}
+	err := accountDB.CheckRegistrationToken(token)
+	return registrationTokenError(err)
+}
+
+// isConfiguredRegistrationToken returns whether the token is the shared
+// secret or one of the tokens listed in the config, which never run out.
+func isConfiguredRegistrationToken(cfg config.Dendrite, token string) bool {
+	secret := cfg.Matrix.RegistrationSharedSecret
+	if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+		return true
+	}
+	for _, t := range cfg.Matrix.RegistrationTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// registrationTokenError turns an error returned by the account database
+// when checking or using a registration token into the error to send back
+// to the client.
+func registrationTokenError(err error) (*jsonerror.MatrixError, error) {
+	switch err {
+	case nil:
+		return nil, nil
+	case sql.ErrNoRows:
+		return jsonerror.MissingToken("Invalid registration token"), nil
+	case accounts.ErrRegistrationTokenExhausted:
+		return &jsonerror.LimitExceeded("Registration token was used too many times", 0).MatrixError, nil
+	default:
+		return nil, err
+	}
+}
+
+// registerGuest creates a new guest account along with a device for it.
+func registerGuest(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	cfg config.Dendrite,
+) util.JSONResponse {
+	if !cfg.Matrix.Registration.GuestsEnabled {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.GuestAccessForbidden("Guest registration is disabled"),
+		}
+	}
+
+	// Guests don't have to send a body, but can use it to name their device.
+	var r registerRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+
+	localpart, err := generateGuestLocalpart()
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	acc, err := accountDB.CreateGuestAccount(localpart)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 500,
+			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
+		}
+	}
+
+	return createInitialDevice(deviceDB, acc, r.DeviceID, r.InitialDisplayName)
+}
+
+// generateGuestLocalpart returns a random localpart for a guest account.
+func generateGuestLocalpart() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "guest-" + hex.EncodeToString(b), nil
+}
+
+// registerAppServiceUser creates a passwordless account for a user in the
+// namespaces of the application service whose as_token is the access token of
+// the request, and its first device.
+func registerAppServiceUser(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	cfg config.Dendrite, r registerRequest,
+) util.JSONResponse {
+	registration, resErr := auth.VerifyAppServiceToken(req, cfg.ApplicationServices.Registrations)
+	if resErr != nil {
+		return *resErr
+	}
+	if r.Username == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("missing username"),
+		}
+	}
+	userID := fmt.Sprintf("@%s:%s", r.Username, cfg.Matrix.ServerName)
+	if !registration.IsInterestedInUserID(userID) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.Exclusive("User ID is not in the namespaces of the application service."),
+		}
+	}
+
+	if _, err := accountDB.GetAccountByLocalpart(r.Username); err == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UserInUse("Desired user ID is already taken."),
+		}
+	} else if err != sql.ErrNoRows {
+		return httputil.LogThenError(req, err)
+	}
+
+	acc, err := accountDB.CreatePasswordlessAccount(r.Username)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return createInitialDevice(deviceDB, acc, r.DeviceID, r.InitialDisplayName)
 }
 
-func completeRegistration(accountDB *accounts.Database, deviceDB *devices.Database, username, password string) util.JSONResponse {
+func completeRegistration(
+	req *http.Request, accountDB *accounts.Database, deviceDB *devices.Database,
+	cfg config.Dendrite, username, password, deviceID string, displayName *string,
+	registrationToken string,
+) util.JSONResponse {
 	if username == "" {
 		return util.JSONResponse{
 			Code: 400,
@@ -155,15 +466,70 @@ func completeRegistration(accountDB *accounts.Database, deviceDB *devices.Databa
 			JSON: jsonerror.BadJSON("missing password"),
 		}
 	}
+	userID := fmt.Sprintf("@%s:%s", username, cfg.Matrix.ServerName)
+	for i := range cfg.ApplicationServices.Registrations {
+		if cfg.ApplicationServices.Registrations[i].OwnsUserID(userID) {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.Exclusive("Desired user ID is reserved by an application service."),
+			}
+		}
+	}
 
-	acc, err := accountDB.CreateAccount(username, password)
-	if err != nil {
+	if _, err := accountDB.GetAccountByLocalpart(username); err == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UserInUse("Desired user ID is already taken."),
+		}
+	} else if err != sql.ErrNoRows {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Tokens stored in the account database are used up as the account is
+	// created, so they aren't if creating it fails.
+	if !cfg.Matrix.RegistrationRequiresToken || isConfiguredRegistrationToken(cfg, registrationToken) {
+		registrationToken = ""
+	}
+	// The first user registered is a server admin if no admins are configured.
+	acc, err := accountDB.CreateAccountWithRegistrationToken(
+		username, password, registrationToken, len(cfg.Matrix.Admins) == 0,
+	)
+	if matrixErr, tokenErr := registrationTokenError(err); tokenErr == nil && matrixErr != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: matrixErr,
+		}
+	} else if err != nil {
 		return util.JSONResponse{
 			Code: 500,
 			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
 		}
 	}
+	if err = promoteAdmin(accountDB, cfg, acc); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return createInitialDevice(deviceDB, acc, deviceID, displayName)
+}
 
+// promoteAdmin makes the newly registered account a server admin if it is one
+// of the configured admins.
+func promoteAdmin(accountDB *accounts.Database, cfg config.Dendrite, acc *authtypes.Account) error {
+	for _, userID := range cfg.Matrix.Admins {
+		if userID == acc.UserID {
+			acc.IsAdmin = true
+			return accountDB.SetAdmin(acc.Localpart, true)
+		}
+	}
+	return nil
+}
+
+// createInitialDevice creates the first device of a newly registered account
+// and returns the registration response for it.
+func createInitialDevice(
+	deviceDB *devices.Database, acc *authtypes.Account,
+	deviceID string, displayName *string,
+) util.JSONResponse {
 	token, err := auth.GenerateAccessToken()
 	if err != nil {
 		return util.JSONResponse{
@@ -172,8 +538,10 @@ func completeRegistration(accountDB *accounts.Database, deviceDB *devices.Databa
 		}
 	}
 
-	// // TODO: Use the device ID in the request.
-	dev, err := deviceDB.CreateDevice(username, auth.UnknownDeviceID, token)
+	if deviceID == "" {
+		deviceID = auth.UnknownDeviceID
+	}
+	dev, err := deviceDB.CreateDevice(acc.Localpart, deviceID, token, displayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: 500,
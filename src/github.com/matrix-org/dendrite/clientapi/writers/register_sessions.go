@@ -0,0 +1,106 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+// RegistrationSessions remembers which stages of user-interactive auth the
+// clients registering accounts have completed, for the given amount of time
+// after they started.
+// It is safe to use from multiple goroutines.
+type RegistrationSessions struct {
+	timeout time.Duration
+
+	mutex       sync.Mutex
+	sessions    map[string]*registrationSession
+	lastCleanup time.Time
+}
+
+type registrationSession struct {
+	completed []authtypes.LoginType
+	// The registration token given by the client, if it completed the
+	// m.login.registration_token stage.
+	token   string
+	expires time.Time
+}
+
+// NewRegistrationSessions creates a new session store which forgets sessions
+// after the given timeout.
+func NewRegistrationSessions(timeout time.Duration) *RegistrationSessions {
+	return &RegistrationSessions{
+		timeout:  timeout,
+		sessions: make(map[string]*registrationSession),
+	}
+}
+
+// get returns the stages completed in the session with the given ID, and the
+// registration token used in it if there is one.
+func (s *RegistrationSessions) get(sessionID string) ([]authtypes.LoginType, string) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastCleanup) > s.timeout {
+		s.cleanup(now)
+	}
+	sess, ok := s.sessions[sessionID]
+	if !ok || !now.Before(sess.expires) {
+		return nil, ""
+	}
+	return append([]authtypes.LoginType{}, sess.completed...), sess.token
+}
+
+// addCompleted records that the given stage was completed in the session with
+// the given ID, starting the session if needed. token is only stored if it
+// isn't empty. Returns the stages completed in the session.
+func (s *RegistrationSessions) addCompleted(
+	sessionID string, stage authtypes.LoginType, token string,
+) []authtypes.LoginType {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok || !now.Before(sess.expires) {
+		sess = &registrationSession{expires: now.Add(s.timeout)}
+		s.sessions[sessionID] = sess
+	}
+	sess.completed = append(sess.completed, stage)
+	if token != "" {
+		sess.token = token
+	}
+	return append([]authtypes.LoginType{}, sess.completed...)
+}
+
+// remove forgets the session with the given ID.
+func (s *RegistrationSessions) remove(sessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, sessionID)
+}
+
+// cleanup removes the expired sessions.
+// The caller must hold the mutex.
+func (s *RegistrationSessions) cleanup(now time.Time) {
+	for id, sess := range s.sessions {
+		if !now.Before(sess.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.lastCleanup = now
+}
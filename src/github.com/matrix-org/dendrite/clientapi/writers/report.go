@@ -0,0 +1,133 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type reportRequest struct {
+	Score  *int64 `json:"score"`
+	Reason string `json:"reason"`
+}
+
+// reportWebhookRequest is the body of the requests sent to the report
+// webhook.
+type reportWebhookRequest struct {
+	UserID     string `json:"user_id"`
+	RoomID     string `json:"room_id"`
+	EventID    string `json:"event_id"`
+	Score      *int64 `json:"score,omitempty"`
+	Reason     string `json:"reason"`
+	ReceivedTS int64  `json:"received_ts"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#post-matrix-client-r0-rooms-roomid-report-eventid
+func ReportEvent(
+	req *http.Request, device *authtypes.Device, roomID, eventID string,
+	cfg config.Dendrite, accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+	httpClient *http.Client,
+) util.JSONResponse {
+	var r reportRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("score must be between -100 and 0"),
+		}
+	}
+
+	// Users can only report events they are allowed to see.
+	queryReq := api.QueryEventsByIDRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}
+	var queryRes api.QueryEventsByIDResponse
+	if err := queryAPI.QueryEventsByID(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if len(queryRes.Events) != 1 || queryRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+		}
+	}
+
+	report := authtypes.Report{
+		UserID:     device.UserID,
+		RoomID:     roomID,
+		EventID:    eventID,
+		Score:      r.Score,
+		Reason:     r.Reason,
+		ReceivedTS: gomatrixserverlib.AsTimestamp(time.Now()),
+	}
+	if err := accountDB.SaveReport(&report); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if cfg.Matrix.ReportWebhookURL != "" {
+		go func() {
+			if err := notifyReportWebhook(httpClient, cfg.Matrix.ReportWebhookURL, report); err != nil {
+				log.WithError(err).WithField("event_id", eventID).Error("Failed to send report to the webhook")
+			}
+		}()
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// notifyReportWebhook POSTs the report to the webhook URL.
+func notifyReportWebhook(client *http.Client, url string, report authtypes.Report) error {
+	body, err := json.Marshal(reportWebhookRequest{
+		UserID:     report.UserID,
+		RoomID:     report.RoomID,
+		EventID:    report.EventID,
+		Score:      report.Score,
+		Reason:     report.Reason,
+		ReceivedTS: int64(report.ReceivedTS),
+	})
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("report webhook %q responded with HTTP %d", url, res.StatusCode)
+	}
+	return nil
+}
@@ -15,13 +15,19 @@
 package writers
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/events"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/ratelimit"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -34,9 +40,30 @@ type sendEventResponse struct {
 	EventID string `json:"event_id"`
 }
 
-// SendEvent implements:
-//   /rooms/{roomID}/send/{eventType}/{txnID}
-//   /rooms/{roomID}/state/{eventType}/{stateKey}
+// stateEventTypes are the event types of the spec which are only meaningful
+// as state events, and so can't be sent with /rooms/{roomID}/send.
+var stateEventTypes = map[string]bool{
+	"m.room.create":             true,
+	"m.room.member":             true,
+	"m.room.power_levels":       true,
+	"m.room.join_rules":         true,
+	"m.room.history_visibility": true,
+	"m.room.guest_access":       true,
+	"m.room.canonical_alias":    true,
+	"m.room.aliases":            true,
+	"m.room.name":               true,
+	"m.room.topic":              true,
+	"m.room.avatar":             true,
+	"m.room.encryption":         true,
+	"m.room.server_acl":         true,
+	"m.room.tombstone":          true,
+	"m.room.third_party_invite": true,
+}
+
+// SendEvent implements /rooms/{roomID}/send/{eventType}/{txnID}, and sends
+// the state events of SendStateEvent.
+// Requests with a transaction ID the device already used get the response to
+// the first request instead of sending the event again.
 func SendEvent(
 	req *http.Request,
 	device *authtypes.Device,
@@ -44,7 +71,45 @@ func SendEvent(
 	cfg config.Dendrite,
 	queryAPI api.RoomserverQueryAPI,
 	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	limiter *ratelimit.EventLimiter,
+) util.JSONResponse {
+	if txnID != "" {
+		return processTransaction(req, accountDB, device, txnID, func() util.JSONResponse {
+			return sendEvent(req, device, roomID, eventType, stateKey, cfg, queryAPI, producer, accountDB, limiter)
+		})
+	}
+	return sendEvent(req, device, roomID, eventType, stateKey, cfg, queryAPI, producer, accountDB, limiter)
+}
+
+func sendEvent(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, eventType string, stateKey *string,
+	cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	limiter *ratelimit.EventLimiter,
 ) util.JSONResponse {
+	if resErr := checkEventRateLimit(device, roomID, stateKey != nil, limiter); resErr != nil {
+		return *resErr
+	}
+
+	// Guests can only send messages.
+	if stateKey != nil || eventType != "m.room.message" {
+		if resErr := auth.VerifyNotGuest(device, accountDB); resErr != nil {
+			return *resErr
+		}
+	}
+
+	if stateKey == nil && stateEventTypes[eventType] {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON(eventType + " events must be sent as state events"),
+		}
+	}
+
 	// parse the incoming http request
 	userID := device.UserID
 	var r map[string]interface{} // must be a JSON object
@@ -63,12 +128,22 @@ func SendEvent(
 	builder.SetContent(r)
 
 	var queryRes api.QueryLatestEventsAndStateResponse
-	e, err := events.BuildEvent(&builder, cfg, queryAPI, &queryRes)
+	e, err := events.BuildEvent(req.Context(), &builder, cfg, queryAPI, &queryRes)
 	if err == events.ErrRoomNoExists {
 		return util.JSONResponse{
 			Code: 404,
 			JSON: jsonerror.NotFound("Room does not exist"),
 		}
+	} else if versionErr, ok := err.(common.UnsupportedRoomVersionError); ok {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion(versionErr.Error()),
+		}
+	} else if tooLargeErr, ok := err.(common.EventTooLargeError); ok {
+		return util.JSONResponse{
+			Code: 413,
+			JSON: jsonerror.TooLarge(tooLargeErr.Error()),
+		}
 	} else if err != nil {
 		return httputil.LogThenError(req, err)
 	}
@@ -96,3 +171,75 @@ func SendEvent(
 		JSON: sendEventResponse{e.EventID()},
 	}
 }
+
+// SendStateEvent implements:
+//   /rooms/{roomID}/state/{eventType}
+//   /rooms/{roomID}/state/{eventType}/{stateKey}
+// The user must have at least the power level the room requires to send state
+// events of this type.
+func SendStateEvent(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, eventType, stateKey string,
+	cfg config.Dendrite,
+	queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	accountDB *accounts.Database,
+	limiter *ratelimit.EventLimiter,
+) util.JSONResponse {
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.power_levels", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+
+	// Rooms without power levels are left to the auth rules, which let their
+	// creator send any event.
+	for _, event := range stateRes.StateEvents {
+		content := common.DefaultPowerLevelContent()
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if content.UserLevel(device.UserID) < content.EventLevel(eventType, true) {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden("You don't have permission to send " + eventType + " events in this room"),
+			}
+		}
+	}
+
+	return SendEvent(req, device, roomID, eventType, "", &stateKey, cfg, queryAPI, producer, accountDB, limiter)
+}
+
+// checkEventRateLimit returns a 429 response if the user sent too many events
+// of this kind recently, either themselves or in the room, or nil if they can
+// send the event. Application services are exempt unless their registration
+// asks for them to be rate limited.
+func checkEventRateLimit(
+	device *authtypes.Device, roomID string, isState bool, limiter *ratelimit.EventLimiter,
+) *util.JSONResponse {
+	if device.AppService != nil && !device.AppService.RateLimited {
+		return nil
+	}
+	if allowed, retryAfter := limiter.Allow(device.UserID, roomID, isState); !allowed {
+		return &util.JSONResponse{
+			Code: 429,
+			JSON: jsonerror.LimitExceeded(
+				"Too many events, please try again later.",
+				int64(retryAfter/time.Millisecond),
+			),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetTags implements GET /user/{userID}/rooms/{roomID}/tags
+func GetTags(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	userID, roomID string,
+) util.JSONResponse {
+	localpart, resErr := tagsLocalpart(req, device, userID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	tags, err := accountDB.GetRoomTags(localpart, roomID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: tags,
+	}
+}
+
+// PutTag implements PUT /user/{userID}/rooms/{roomID}/tags/{tag}
+func PutTag(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	userID, roomID, tag string, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	localpart, resErr := tagsLocalpart(req, device, userID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	var info authtypes.TagInfo
+	if resErr = httputil.UnmarshalJSONRequest(req, &info); resErr != nil {
+		return *resErr
+	}
+
+	if err := accountDB.SaveRoomTag(localpart, roomID, tag, info.Order); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if err := syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// DeleteTag implements DELETE /user/{userID}/rooms/{roomID}/tags/{tag}
+func DeleteTag(
+	req *http.Request, accountDB *accounts.Database, device *authtypes.Device,
+	userID, roomID, tag string, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	localpart, resErr := tagsLocalpart(req, device, userID)
+	if resErr != nil {
+		return *resErr
+	}
+
+	if err := accountDB.RemoveRoomTag(localpart, roomID, tag); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	if err := syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// tagsLocalpart returns the localpart of the user whose tags are requested,
+// who must be the user making the request.
+func tagsLocalpart(
+	req *http.Request, device *authtypes.Device, userID string,
+) (string, *util.JSONResponse) {
+	if userID != device.UserID {
+		return "", &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Cannot access another user's tags"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return "", &resErr
+	}
+	return localpart, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/todevice"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// sendToDeviceRequest represents the body of a request to
+// PUT /sendToDevice/{eventType}/{txnID}
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#put-matrix-client-r0-sendtodevice-eventtype-txnid
+type sendToDeviceRequest struct {
+	// Map of user ID => device ID, or "*" for all of the user's devices => content
+	Messages map[string]map[string]json.RawMessage `json:"messages"`
+}
+
+// SendToDevice implements PUT /sendToDevice/{eventType}/{txnID}
+func SendToDevice(
+	req *http.Request, device *authtypes.Device, eventType, txnID string,
+	cfg config.Dendrite, accountDB *accounts.Database, deviceDB *devices.Database,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
+) util.JSONResponse {
+	return processTransaction(req, accountDB, device, txnID, func() util.JSONResponse {
+		return sendToDevice(req, device, eventType, txnID, cfg, accountDB, deviceDB, sendToDeviceProducer)
+	})
+}
+
+func sendToDevice(
+	req *http.Request, device *authtypes.Device, eventType, txnID string,
+	cfg config.Dendrite, accountDB *accounts.Database, deviceDB *devices.Database,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
+) util.JSONResponse {
+	var r sendToDeviceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	event := common.SendToDeviceEvent{
+		Sender:         device.UserID,
+		Type:           eventType,
+		MessageID:      device.ID + ":" + txnID,
+		RemoteMessages: map[string]map[string]json.RawMessage{},
+	}
+	localMessages := map[string]map[string]json.RawMessage{}
+	for userID, contents := range r.Messages {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.BadJSON("Invalid user ID " + userID),
+			}
+		}
+		if domain != cfg.Matrix.ServerName {
+			event.RemoteMessages[userID] = contents
+		} else {
+			localMessages[userID] = contents
+		}
+	}
+
+	if err := todevice.Send(accountDB, deviceDB, sendToDeviceProducer, event, localMessages); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/util"
+)
+
+// pendingTransactionRetryAfterMS is how long clients are told to wait before
+// retrying a request whose transaction ID is used by a request still being
+// processed.
+const pendingTransactionRetryAfterMS = 1000
+
+// processTransaction processes a request sent by the device with a transaction
+// ID by calling process, unless the device already sent a request with the
+// same transaction ID to the same path. The transaction ID is reserved before
+// the request is processed, so that concurrent retries don't process it again.
+// Retries get the successful response to the first request, or a 429 while
+// it is still being processed. The reservation is removed if the request
+// fails so that it can be retried.
+func processTransaction(
+	req *http.Request, accountDB *accounts.Database,
+	device *authtypes.Device, txnID string, process func() util.JSONResponse,
+) util.JSONResponse {
+	path := req.URL.Path
+	reserved, err := accountDB.ReserveTransaction(device.UserID, device.ID, path, txnID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !reserved {
+		responseJSON, err := accountDB.GetTransactionResponse(device.UserID, device.ID, path, txnID)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if responseJSON == nil {
+			return util.JSONResponse{
+				Code: 429,
+				JSON: jsonerror.LimitExceeded(
+					"A request with this transaction ID is still being processed.",
+					pendingTransactionRetryAfterMS,
+				),
+			}
+		}
+		return util.JSONResponse{
+			Code: 200,
+			JSON: json.RawMessage(responseJSON),
+		}
+	}
+
+	res := process()
+	// Errors are logged rather than returned, as the request was already
+	// processed.
+	if res.Code == 200 {
+		var responseJSON []byte
+		responseJSON, err = json.Marshal(res.JSON)
+		if err == nil {
+			err = accountDB.StoreTransactionResponse(device.UserID, device.ID, path, txnID, responseJSON)
+		}
+	} else {
+		err = accountDB.CancelTransaction(device.UserID, device.ID, path, txnID)
+	}
+	if err != nil {
+		common.GetLogger(req.Context()).WithError(err).Error("Failed to store transaction response")
+	}
+	return res
+}
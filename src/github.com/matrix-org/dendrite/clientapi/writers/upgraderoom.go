@@ -0,0 +1,289 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/events"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-rooms-roomid-upgrade
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.0.html#post-matrix-client-r0-rooms-roomid-upgrade
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// upgradedStateTypes are the types of the state events copied from a room to
+// the room replacing it, on top of its power levels.
+var upgradedStateTypes = []string{
+	"m.room.join_rules",
+	"m.room.history_visibility",
+	"m.room.guest_access",
+	"m.room.name",
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+// It creates a room of the requested version with the state of the old room,
+// invites the members of the old room to it, then sends a m.room.tombstone
+// event in the old room pointing to the new one.
+// nolint: gocyclo
+func UpgradeRoom(
+	req *http.Request, device *authtypes.Device, roomID string,
+	cfg config.Dendrite, queryAPI api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer, accountDB *accounts.Database,
+) util.JSONResponse {
+	if resErr := auth.VerifyNotGuest(device, accountDB); resErr != nil {
+		return *resErr
+	}
+
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.NewVersion == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.MissingArgument("new_version is required"),
+		}
+	}
+	if err := common.CheckRoomVersion(roomID, r.NewVersion); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion("room version " + r.NewVersion + " is not supported"),
+		}
+	}
+
+	userID := device.UserID
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+
+	// The tombstone is built first, as it tells whether the user is allowed to
+	// upgrade the room, and the creation event of the new room refers to it.
+	tombstone, resErr := buildTombstone(req, userID, roomID, newRoomID, cfg, queryAPI)
+	if resErr != nil {
+		return *resErr
+	}
+
+	stateToFetch := []gomatrixserverlib.StateKeyTuple{
+		{EventType: "m.room.create", StateKey: ""},
+		{EventType: "m.room.power_levels", StateKey: ""},
+	}
+	for _, eventType := range upgradedStateTypes {
+		stateToFetch = append(stateToFetch, gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""})
+	}
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: stateToFetch,
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	membersReq := api.QueryMembershipsForRoomRequest{
+		JoinedOnly: true,
+		RoomID:     roomID,
+		Sender:     userID,
+	}
+	var membersRes api.QueryMembershipsForRoomResponse
+	if err := queryAPI.QueryMembershipsForRoom(req.Context(), &membersReq, &membersRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	profile, err := accountDB.GetProfileByLocalpart(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	createContent := map[string]interface{}{
+		"creator":      userID,
+		"room_version": r.NewVersion,
+		"predecessor": map[string]string{
+			"room_id":  roomID,
+			"event_id": tombstone.EventID(),
+		},
+	}
+	powerLevelContent := common.InitialPowerLevelsContent(userID)
+	var copiedEvents []fledglingEvent
+	for _, event := range stateRes.StateEvents {
+		switch event.Type() {
+		case "m.room.create":
+			var oldCreateContent common.CreateContent
+			if err = json.Unmarshal(event.Content(), &oldCreateContent); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+			if oldCreateContent.Federate != nil {
+				createContent["m.federate"] = *oldCreateContent.Federate
+			}
+		case "m.room.power_levels":
+			powerLevelContent = common.DefaultPowerLevelContent()
+			if err = json.Unmarshal(event.Content(), &powerLevelContent); err != nil {
+				return httputil.LogThenError(req, err)
+			}
+		default:
+			copiedEvents = append(copiedEvents, fledglingEvent{
+				Type: event.Type(), StateKey: "", Content: json.RawMessage(event.Content()),
+			})
+		}
+	}
+
+	// The state of the old room is copied before its power levels, as the
+	// creator of a room can send any event until it has power levels, which
+	// the user may not be allowed to do in the old room.
+	eventsToMake := []fledglingEvent{
+		{"m.room.create", "", createContent},
+		{"m.room.member", userID, common.MemberContent{
+			Membership:  "join",
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		}},
+	}
+	eventsToMake = append(eventsToMake, copiedEvents...)
+	eventsToMake = append(eventsToMake, fledglingEvent{"m.room.power_levels", "", powerLevelContent})
+	if powerLevelContent.UserLevel(userID) >= powerLevelContent.Invite {
+		for _, member := range membersRes.JoinEvents {
+			if member.StateKey == nil || *member.StateKey == userID {
+				continue
+			}
+			eventsToMake = append(eventsToMake, fledglingEvent{
+				"m.room.member", *member.StateKey, common.MemberContent{Membership: "invite"},
+			})
+		}
+	}
+
+	var builtEvents []gomatrixserverlib.Event
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i, e := range eventsToMake {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &e.StateKey,
+			Depth:    int64(i + 1),
+		}
+		if err = builder.SetContent(e.Content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		ev, err := buildEvent(&builder, &authEvents, r.NewVersion, cfg)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if err = gomatrixserverlib.Allowed(*ev, &authEvents); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		builtEvents = append(builtEvents, *ev)
+		authEvents.AddEvent(ev)
+	}
+
+	// The new room must exist before the old one points to it.
+	if err = producer.SendEvents(builtEvents, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if err = producer.SendEvents([]gomatrixserverlib.Event{*tombstone}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: upgradeRoomResponse{newRoomID},
+	}
+}
+
+// buildTombstone builds the m.room.tombstone event replacing the room with the
+// new room, and checks the user is allowed to send it.
+func buildTombstone(
+	req *http.Request, userID, roomID, newRoomID string,
+	cfg config.Dendrite, queryAPI api.RoomserverQueryAPI,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.tombstone",
+		StateKey: &stateKey,
+	}
+	content := common.TombstoneContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: newRoomID,
+	}
+	if err := builder.SetContent(content); err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	e, err := events.BuildEvent(req.Context(), &builder, cfg, queryAPI, &queryRes)
+	if err == events.ErrRoomNoExists {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if versionErr, ok := err.(common.UnsupportedRoomVersionError); ok {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion(versionErr.Error()),
+		}
+	} else if tooLargeErr, ok := err.(common.EventTooLargeError); ok {
+		return nil, &util.JSONResponse{
+			Code: 413,
+			JSON: jsonerror.TooLarge(tooLargeErr.Error()),
+		}
+	} else if err != nil {
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
+	}
+
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i]
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*e, &provider); err != nil {
+		return nil, &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("You are not allowed to upgrade this room: " + err.Error()),
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of results returned when the request doesn't say.
+const defaultUserDirectoryLimit = 10
+
+type userDirectorySearchRequest struct {
+	SearchTerm string `json:"search_term"`
+	Limit      *int   `json:"limit"`
+}
+
+type userDirectorySearchResponse struct {
+	Results []userDirectoryResult `json:"results"`
+	Limited bool                  `json:"limited"`
+}
+
+type userDirectoryResult struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// SearchUserDirectory implements POST /user_directory/search
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#post-matrix-client-r0-user-directory-search
+// The results are the local users whose user ID or display name contain the
+// search term, followed by the matching users of other servers the user
+// shares a room with.
+func SearchUserDirectory(
+	req *http.Request, device *authtypes.Device, cfg config.Dendrite,
+	accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+) util.JSONResponse {
+	var r userDirectorySearchRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	limit := defaultUserDirectoryLimit
+	if r.Limit != nil {
+		if *r.Limit < 0 {
+			return util.JSONResponse{
+				Code: 400,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		limit = *r.Limit
+	}
+
+	res := userDirectorySearchResponse{Results: []userDirectoryResult{}}
+	// Look up one more result than needed to tell whether there are more.
+	profiles, err := accountDB.SearchProfiles(r.SearchTerm, limit+1)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	for _, profile := range profiles {
+		res.Results = append(res.Results, userDirectoryResult{
+			UserID:      fmt.Sprintf("@%s:%s", profile.Localpart, cfg.Matrix.ServerName),
+			DisplayName: profile.DisplayName,
+			AvatarURL:   profile.AvatarURL,
+		})
+	}
+	if len(res.Results) <= limit {
+		remoteResults, err := searchSharedRooms(req, device, r.SearchTerm, cfg, accountDB, queryAPI)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		res.Results = append(res.Results, remoteResults...)
+	}
+	if len(res.Results) > limit {
+		res.Results = res.Results[:limit]
+		res.Limited = true
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// searchSharedRooms returns the users of other servers joined to the rooms
+// the user is joined to, whose user ID or display name in the room contain
+// the search term, case insensitively.
+func searchSharedRooms(
+	req *http.Request, device *authtypes.Device, searchTerm string,
+	cfg config.Dendrite, accountDB *accounts.Database, queryAPI api.RoomserverQueryAPI,
+) ([]userDirectoryResult, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return nil, err
+	}
+	memberships, err := accountDB.GetMembershipsByLocalpart(localpart)
+	if err != nil {
+		return nil, err
+	}
+
+	searchTerm = strings.ToLower(searchTerm)
+	var results []userDirectoryResult
+	seen := map[string]bool{}
+	for _, membership := range memberships {
+		queryReq := api.QueryMembershipsForRoomRequest{
+			JoinedOnly: true,
+			RoomID:     membership.RoomID,
+			Sender:     device.UserID,
+		}
+		var queryRes api.QueryMembershipsForRoomResponse
+		if err = queryAPI.QueryMembershipsForRoom(req.Context(), &queryReq, &queryRes); err != nil {
+			return nil, err
+		}
+		for _, event := range queryRes.JoinEvents {
+			if event.StateKey == nil || seen[*event.StateKey] {
+				continue
+			}
+			_, serverName, err := gomatrixserverlib.SplitID('@', *event.StateKey)
+			if err != nil || serverName == cfg.Matrix.ServerName {
+				// Local users were already looked up in the account database.
+				continue
+			}
+			var content common.MemberContent
+			if err := json.Unmarshal(event.Content, &content); err != nil {
+				continue
+			}
+			if !strings.Contains(strings.ToLower(*event.StateKey), searchTerm) &&
+				!strings.Contains(strings.ToLower(content.DisplayName), searchTerm) {
+				continue
+			}
+			seen[*event.StateKey] = true
+			results = append(results, userDirectoryResult{
+				UserID:      *event.StateKey,
+				DisplayName: content.DisplayName,
+				AvatarURL:   content.AvatarURL,
+			})
+		}
+	}
+	return results, nil
+}
@@ -149,6 +149,7 @@ func main() {
 	http.Handle("/_matrix/client/r0/sync", syncProxy)
 	http.Handle("/_matrix/client/r0/directory/list/", publicRoomsProxy)
 	http.Handle("/_matrix/client/r0/publicRooms", publicRoomsProxy)
+	http.Handle("/_matrix/media/r0/", mediaProxy)
 	http.Handle("/_matrix/media/v1/", mediaProxy)
 	http.Handle("/", clientProxy)
 
@@ -162,6 +163,7 @@ func main() {
 	fmt.Println("  /_matrix/client/r0/sync            => ", *syncServerURL+"/api/_matrix/client/r0/sync")
 	fmt.Println("  /_matrix/client/r0/directory/list  => ", *publicRoomsAPIURL+"/_matrix/client/r0/directory/list")
 	fmt.Println("  /_matrix/client/r0/publicRooms     => ", *publicRoomsAPIURL+"/_matrix/media/client/r0/publicRooms")
+	fmt.Println("  /_matrix/media/r0                  => ", *mediaAPIURL+"/api/_matrix/media/r0")
 	fmt.Println("  /_matrix/media/v1                  => ", *mediaAPIURL+"/api/_matrix/media/v1")
 	fmt.Println("  /*                                 => ", *clientAPIURL+"/api/*")
 	fmt.Println("Listening on ", *bindAddress)
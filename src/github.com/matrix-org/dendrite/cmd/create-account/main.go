@@ -38,6 +38,7 @@ var (
 	password      = flag.String("password", "", "Optional. The password to register with. If not specified, this account will be password-less.")
 	serverNameStr = flag.String("servername", "localhost", "The Matrix server domain which will form the domain part of the user ID.")
 	accessToken   = flag.String("token", "", "Optional. The desired access_token to have. If not specified, a random access_token will be made.")
+	admin         = flag.Bool("admin", false, "Optional. Whether the account belongs to a server admin, who can use the admin API.")
 )
 
 func main() {
@@ -74,6 +75,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *admin {
+		if err = accountDB.SetAdmin(*username, true); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	deviceDB, err := devices.NewDatabase(*database, serverName)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -85,7 +93,7 @@ func main() {
 		accessToken = &t
 	}
 
-	device, err := deviceDB.CreateDevice(*username, "create-account-script", *accessToken)
+	device, err := deviceDB.CreateDevice(*username, "create-account-script", *accessToken, nil)
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -20,13 +20,16 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/consumers"
+	"github.com/matrix-org/dendrite/clientapi/presence"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/clientapi/routing"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/roomserver/api"
 
@@ -50,9 +53,13 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	queryAPI := api.NewRoomserverQueryAPIHTTP(cfg.RoomServerURL(), nil)
 	aliasAPI := api.NewRoomserverAliasAPIHTTP(cfg.RoomServerURL(), nil)
+	receiptAPI := api.NewRoomserverReceiptAPIHTTP(cfg.RoomServerURL(), nil)
 	inputAPI := api.NewRoomserverInputAPIHTTP(cfg.RoomServerURL(), nil)
 
 	roomserverProducer := producers.NewRoomserverProducer(inputAPI)
@@ -75,14 +82,43 @@ func main() {
 		Topic:    string(cfg.Kafka.Topics.OutputClientData),
 	}
 
-	federation := gomatrixserverlib.NewFederationClient(
-		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
-	)
+	typingProducer := &producers.TypingProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputTypingEvent),
+	}
+
+	receiptProducer := &producers.ReceiptProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputReceiptEvent),
+	}
+
+	deviceListProducer := &producers.DeviceListProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputDeviceListUpdate),
+	}
+
+	presenceProducer := &producers.PresenceProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputPresenceEvent),
+	}
+
+	sendToDeviceProducer := &producers.SendToDeviceProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+	}
+
+	federation := federationclient.New(cfg)
 
 	accountDB, err := accounts.NewDatabase(string(cfg.Database.Account), cfg.Matrix.ServerName)
 	if err != nil {
 		log.Panicf("Failed to setup account database(%q): %s", cfg.Database.Account, err.Error())
 	}
+	if err = auth.CreateAppServiceSenders(accountDB, cfg.ApplicationServices.Registrations); err != nil {
+		log.Panicf("Failed to create the application service sender accounts: %s", err)
+	}
+	if err = auth.PromoteAdmins(accountDB, cfg.Matrix.Admins); err != nil {
+		log.Panicf("Failed to promote the server admins: %s", err)
+	}
 	deviceDB, err := devices.NewDatabase(string(cfg.Database.Device), cfg.Matrix.ServerName)
 	if err != nil {
 		log.Panicf("Failed to setup device database(%q): %s", cfg.Database.Device, err.Error())
@@ -95,7 +131,7 @@ func main() {
 	keyRing := gomatrixserverlib.KeyRing{
 		KeyFetchers: []gomatrixserverlib.KeyFetcher{
 			// TODO: Use perspective key fetchers for production.
-			&gomatrixserverlib.DirectKeyFetcher{Client: federation.Client},
+			&federationclient.DirectKeyFetcher{Client: federation},
 		},
 		KeyDatabase: keyDB,
 	}
@@ -113,15 +149,20 @@ func main() {
 		log.Panicf("startup: failed to start room server consumer")
 	}
 
+	presence.NewIdleTimer(accountDB, presenceProducer, cfg.Matrix.PresenceIdleTimeout).Start()
+
 	log.Info("Starting client API server on ", cfg.Listen.ClientAPI)
 
 	api := mux.NewRouter()
 	routing.Setup(
 		api, http.DefaultClient, *cfg, roomserverProducer,
-		queryAPI, aliasAPI, accountDB, deviceDB, federation, keyRing,
-		userUpdateProducer, syncProducer,
+		queryAPI, aliasAPI, receiptAPI, accountDB, deviceDB, federation, keyRing,
+		userUpdateProducer, syncProducer, typingProducer, receiptProducer, deviceListProducer,
+		presenceProducer, sendToDeviceProducer,
 	)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	log.Fatal(http.ListenAndServe(string(cfg.Listen.ClientAPI), nil))
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.ClientAPI), nil)
+	srv.WaitForShutdown(kafkaProducer.Close)
 }
@@ -20,15 +20,19 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/federationapi/routing"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	log "github.com/Sirupsen/logrus"
+	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
 var (
@@ -48,10 +52,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
-	federation := gomatrixserverlib.NewFederationClient(
-		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
-	)
+	federation := federationclient.New(cfg)
 
 	keyDB, err := keydb.NewDatabase(string(cfg.Database.ServerKey))
 	if err != nil {
@@ -61,25 +66,49 @@ func main() {
 	keyRing := gomatrixserverlib.KeyRing{
 		KeyFetchers: []gomatrixserverlib.KeyFetcher{
 			// TODO: Use perspective key fetchers for production.
-			&gomatrixserverlib.DirectKeyFetcher{federation.Client},
+			&federationclient.DirectKeyFetcher{Client: federation},
 		},
 		KeyDatabase: keyDB,
 	}
 
+	deviceDB, err := devices.NewDatabase(string(cfg.Database.Device), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create device database with data source %s : %s", cfg.Database.Device, err)
+	}
+
+	accountDB, err := accounts.NewDatabase(string(cfg.Database.Account), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create account database with data source %s : %s", cfg.Database.Account, err)
+	}
+
 	queryAPI := api.NewRoomserverQueryAPIHTTP(cfg.RoomServerURL(), nil)
 	inputAPI := api.NewRoomserverInputAPIHTTP(cfg.RoomServerURL(), nil)
 
 	roomserverProducer := producers.NewRoomserverProducer(inputAPI)
 
+	kafkaProducer, err := sarama.NewSyncProducer(cfg.Kafka.Addresses, nil)
 	if err != nil {
 		log.Panicf("Failed to setup kafka producers(%s): %s", cfg.Kafka.Addresses, err)
 	}
+	presenceProducer := &producers.PresenceProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputPresenceEvent),
+	}
+	sendToDeviceProducer := &producers.SendToDeviceProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+	}
 
 	log.Info("Starting federation API server on ", cfg.Listen.FederationAPI)
 
 	api := mux.NewRouter()
-	routing.Setup(api, *cfg, queryAPI, roomserverProducer, keyRing, federation)
+	routing.Setup(
+		api, *cfg, queryAPI, roomserverProducer, keyRing, federation, deviceDB, accountDB,
+		presenceProducer, sendToDeviceProducer,
+	)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	log.Fatal(http.ListenAndServe(string(cfg.Listen.FederationAPI), nil))
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.FederationAPI), nil)
+	srv.WaitForShutdown()
 }
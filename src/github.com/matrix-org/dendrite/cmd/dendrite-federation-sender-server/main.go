@@ -20,13 +20,16 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/federationsender/consumers"
 	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/routing"
 	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/roomserver/api"
-	"github.com/matrix-org/gomatrixserverlib"
 
 	log "github.com/Sirupsen/logrus"
 	sarama "gopkg.in/Shopify/sarama.v1"
@@ -46,6 +49,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	kafkaConsumer, err := sarama.NewConsumer(cfg.Kafka.Addresses, nil)
 	if err != nil {
@@ -62,21 +68,51 @@ func main() {
 		log.Panicf("startup: failed to create federation sender database with data source %s : %s", cfg.Database.FederationSender, err)
 	}
 
-	federation := gomatrixserverlib.NewFederationClient(
-		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
-	)
+	federation := federationclient.New(cfg)
 
-	queues := queue.NewOutgoingQueues(cfg.Matrix.ServerName, federation)
+	queues := queue.NewOutgoingQueues(cfg, federation, db)
+	if err = queues.Restore(); err != nil {
+		log.WithError(err).Panicf("startup: failed to restore federation sender queues")
+	}
 
 	consumer := consumers.NewOutputRoomEvent(cfg, kafkaConsumer, queues, db, queryAPI)
 	if err = consumer.Start(); err != nil {
 		log.WithError(err).Panicf("startup: failed to start room server consumer")
 	}
 
+	receiptConsumer := consumers.NewOutputReceiptEvent(cfg, kafkaConsumer, queues, db)
+	if err = receiptConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start receipt consumer")
+	}
+	presenceConsumer := consumers.NewOutputPresenceEvent(cfg, kafkaConsumer, queues, db)
+	if err = presenceConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start presence consumer")
+	}
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEvent(cfg, kafkaConsumer, queues, db)
+	if err = sendToDeviceConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start send to device consumer")
+	}
+
+	deviceListConsumer := consumers.NewOutputDeviceListUpdate(cfg, kafkaConsumer, queues, db)
+	if err = deviceListConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start device list consumer")
+	}
+
+	deviceDB, err := devices.NewDatabase(string(cfg.Database.Device), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create device database with data source %s : %s", cfg.Database.Device, err)
+	}
+
+	accountDB, err := accounts.NewDatabase(string(cfg.Database.Account), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create account database with data source %s : %s", cfg.Database.Account, err)
+	}
+
 	api := mux.NewRouter()
+	routing.Setup(api, queues, deviceDB, accountDB)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	if err := http.ListenAndServe(string(cfg.Listen.FederationSender), nil); err != nil {
-		panic(err)
-	}
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.FederationSender), nil)
+	srv.WaitForShutdown()
 }
@@ -20,6 +20,8 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
@@ -45,17 +47,32 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	db, err := storage.Open(string(cfg.Database.MediaAPI))
 	if err != nil {
 		log.WithError(err).Panic("Failed to open database")
 	}
 
+	deviceDB, err := devices.NewDatabase(string(cfg.Database.Device), cfg.Matrix.ServerName)
+	if err != nil {
+		log.WithError(err).Panic("Failed to open device database")
+	}
+
+	accountDB, err := accounts.NewDatabase(string(cfg.Database.Account), cfg.Matrix.ServerName)
+	if err != nil {
+		log.WithError(err).Panic("Failed to open account database")
+	}
+
 	log.Info("Starting media API server on ", cfg.Listen.MediaAPI)
 
 	api := mux.NewRouter()
-	routing.Setup(api, http.DefaultClient, cfg, db)
+	routing.Setup(api, http.DefaultClient, cfg, db, deviceDB, accountDB)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	log.Fatal(http.ListenAndServe(string(cfg.Listen.MediaAPI), nil))
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.MediaAPI), nil)
+	srv.WaitForShutdown()
 }
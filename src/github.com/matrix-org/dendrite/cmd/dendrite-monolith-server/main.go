@@ -20,11 +20,13 @@ import (
 	"os"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/naffka"
@@ -32,12 +34,19 @@ import (
 	mediaapi_routing "github.com/matrix-org/dendrite/mediaapi/routing"
 	mediaapi_storage "github.com/matrix-org/dendrite/mediaapi/storage"
 
+	roomserver_admin "github.com/matrix-org/dendrite/roomserver/admin"
 	roomserver_alias "github.com/matrix-org/dendrite/roomserver/alias"
+	roomserver_api "github.com/matrix-org/dendrite/roomserver/api"
+	roomserver_extremities "github.com/matrix-org/dendrite/roomserver/extremities"
 	roomserver_input "github.com/matrix-org/dendrite/roomserver/input"
 	roomserver_query "github.com/matrix-org/dendrite/roomserver/query"
+	roomserver_receipt "github.com/matrix-org/dendrite/roomserver/receipt"
+	roomserver_retention "github.com/matrix-org/dendrite/roomserver/retention"
+	roomserver_routing "github.com/matrix-org/dendrite/roomserver/routing"
 	roomserver_storage "github.com/matrix-org/dendrite/roomserver/storage"
 
 	clientapi_consumers "github.com/matrix-org/dendrite/clientapi/consumers"
+	clientapi_presence "github.com/matrix-org/dendrite/clientapi/presence"
 	clientapi_routing "github.com/matrix-org/dendrite/clientapi/routing"
 
 	syncapi_consumers "github.com/matrix-org/dendrite/syncapi/consumers"
@@ -45,11 +54,17 @@ import (
 	syncapi_storage "github.com/matrix-org/dendrite/syncapi/storage"
 	syncapi_sync "github.com/matrix-org/dendrite/syncapi/sync"
 	syncapi_types "github.com/matrix-org/dendrite/syncapi/types"
+	syncapi_typing "github.com/matrix-org/dendrite/syncapi/typing"
 
 	federationapi_routing "github.com/matrix-org/dendrite/federationapi/routing"
 
+	appservice_consumers "github.com/matrix-org/dendrite/appservice/consumers"
+	appservice_queue "github.com/matrix-org/dendrite/appservice/queue"
+	appservice_storage "github.com/matrix-org/dendrite/appservice/storage"
+
 	federationsender_consumers "github.com/matrix-org/dendrite/federationsender/consumers"
 	"github.com/matrix-org/dendrite/federationsender/queue"
+	federationsender_routing "github.com/matrix-org/dendrite/federationsender/routing"
 	federationsender_storage "github.com/matrix-org/dendrite/federationsender/storage"
 
 	publicroomsapi_consumers "github.com/matrix-org/dendrite/publicroomsapi/consumers"
@@ -57,6 +72,7 @@ import (
 	publicroomsapi_storage "github.com/matrix-org/dendrite/publicroomsapi/storage"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
@@ -81,6 +97,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	m := newMonolith(cfg)
 	m.setupDatabases()
@@ -92,21 +111,23 @@ func main() {
 	m.setupConsumers()
 	m.setupAPIs()
 
+	srv := common.NewHTTPServer(m.cfg.Listen.ShutdownTimeout)
 	// Expose the matrix APIs directly rather than putting them under a /api path.
-	go func() {
-		log.Info("Listening on ", *httpBindAddr)
-		log.Fatal(http.ListenAndServe(*httpBindAddr, m.api))
-	}()
+	srv.ListenAndServe(*httpBindAddr, m.api)
+	// Expose the metrics on a separate address so they aren't public.
+	if m.cfg.Listen.Metrics != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", prometheus.Handler())
+		srv.ListenAndServe(string(m.cfg.Listen.Metrics), metricsMux)
+	}
 	// Handle HTTPS if certificate and key are provided
-	go func() {
-		if *certFile != "" && *keyFile != "" {
-			log.Info("Listening on ", *httpsBindAddr)
-			log.Fatal(http.ListenAndServeTLS(*httpsBindAddr, *certFile, *keyFile, m.api))
-		}
-	}()
+	if *certFile != "" && *keyFile != "" {
+		srv.ListenAndServeTLS(*httpsBindAddr, *certFile, *keyFile, m.api)
+	}
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	// Serve the APIs until we are told to stop, then flush the events produced
+	// by the requests in flight.
+	srv.WaitForShutdown(m.kafkaProducer.Close)
 }
 
 // A monolith contains all the dendrite components.
@@ -124,22 +145,34 @@ type monolith struct {
 	syncAPIDB          *syncapi_storage.SyncServerDatabase
 	federationSenderDB *federationsender_storage.Database
 	publicRoomsAPIDB   *publicroomsapi_storage.PublicRoomsServerDatabase
+	// Only set if application services are registered.
+	appServiceDB *appservice_storage.Database
 
-	federation *gomatrixserverlib.FederationClient
+	federation *federationclient.Client
 	keyRing    gomatrixserverlib.KeyRing
 
-	inputAPI *roomserver_input.RoomserverInputAPI
-	queryAPI *roomserver_query.RoomserverQueryAPI
-	aliasAPI *roomserver_alias.RoomserverAliasAPI
+	inputAPI   *roomserver_input.RoomserverInputAPI
+	queryAPI   *roomserver_query.RoomserverQueryAPI
+	aliasAPI   *roomserver_alias.RoomserverAliasAPI
+	receiptAPI *roomserver_receipt.RoomserverReceiptAPI
 
-	naffka        *naffka.Naffka
+	naffka        common.Naffka
 	kafkaProducer sarama.SyncProducer
 
 	roomServerProducer *producers.RoomserverProducer
 	userUpdateProducer *producers.UserUpdateProducer
 	syncProducer       *producers.SyncAPIProducer
+	typingProducer     *producers.TypingProducer
+	receiptProducer    *producers.ReceiptProducer
+	deviceListProducer *producers.DeviceListProducer
+	presenceProducer   *producers.PresenceProducer
 
-	syncAPINotifier *syncapi_sync.Notifier
+	sendToDeviceProducer *producers.SendToDeviceProducer
+
+	syncAPINotifier    *syncapi_sync.Notifier
+	syncAPITypingCache *syncapi_typing.Cache
+
+	federationSenderQueues *queue.OutgoingQueues
 }
 
 func newMonolith(cfg *config.Dendrite) *monolith {
@@ -156,6 +189,12 @@ func (m *monolith) setupDatabases() {
 	if err != nil {
 		log.Panicf("Failed to setup account database(%q): %s", m.cfg.Database.Account, err.Error())
 	}
+	if err = auth.CreateAppServiceSenders(m.accountDB, m.cfg.ApplicationServices.Registrations); err != nil {
+		log.Panicf("Failed to create the application service sender accounts: %s", err)
+	}
+	if err = auth.PromoteAdmins(m.accountDB, m.cfg.Matrix.Admins); err != nil {
+		log.Panicf("Failed to promote the server admins: %s", err)
+	}
 	m.deviceDB, err = devices.NewDatabase(string(m.cfg.Database.Device), m.cfg.Matrix.ServerName)
 	if err != nil {
 		log.Panicf("Failed to setup device database(%q): %s", m.cfg.Database.Device, err.Error())
@@ -180,17 +219,21 @@ func (m *monolith) setupDatabases() {
 	if err != nil {
 		log.Panicf("startup: failed to setup public rooms api database with data source %s : %s", m.cfg.Database.PublicRoomsAPI, err)
 	}
+	if len(m.cfg.ApplicationServices.Registrations) > 0 {
+		m.appServiceDB, err = appservice_storage.NewDatabase(string(m.cfg.Database.AppService))
+		if err != nil {
+			log.Panicf("startup: failed to create app service database with data source %s : %s", m.cfg.Database.AppService, err)
+		}
+	}
 }
 
 func (m *monolith) setupFederation() {
-	m.federation = gomatrixserverlib.NewFederationClient(
-		m.cfg.Matrix.ServerName, m.cfg.Matrix.KeyID, m.cfg.Matrix.PrivateKey,
-	)
+	m.federation = federationclient.New(m.cfg)
 
 	m.keyRing = gomatrixserverlib.KeyRing{
 		KeyFetchers: []gomatrixserverlib.KeyFetcher{
 			// TODO: Use perspective key fetchers for production.
-			&gomatrixserverlib.DirectKeyFetcher{Client: m.federation.Client},
+			&federationclient.DirectKeyFetcher{Client: m.federation},
 		},
 		KeyDatabase: m.keyDB,
 	}
@@ -205,7 +248,7 @@ func (m *monolith) setupKafka() {
 				log.ErrorKey: err,
 			}).Panic("Failed to setup naffka")
 		}
-		m.naffka = naff
+		m.naffka = common.Naffka{Naffka: naff}
 		m.kafkaProducer = naff
 	} else {
 		m.kafkaProducer, err = sarama.NewSyncProducer(m.cfg.Kafka.Addresses, nil)
@@ -238,6 +281,7 @@ func (m *monolith) setupRoomServer() {
 		Producer:             m.kafkaProducer,
 		OutputRoomEventTopic: string(m.cfg.Kafka.Topics.OutputRoomEvent),
 	}
+	m.inputAPI.SetupMetrics()
 
 	m.queryAPI = &roomserver_query.RoomserverQueryAPI{
 		DB: m.roomServerDB,
@@ -249,6 +293,10 @@ func (m *monolith) setupRoomServer() {
 		InputAPI: m.inputAPI,
 		QueryAPI: m.queryAPI,
 	}
+
+	m.receiptAPI = &roomserver_receipt.RoomserverReceiptAPI{
+		DB: m.roomServerDB,
+	}
 }
 
 func (m *monolith) setupProducers() {
@@ -261,6 +309,26 @@ func (m *monolith) setupProducers() {
 		Producer: m.kafkaProducer,
 		Topic:    string(m.cfg.Kafka.Topics.OutputClientData),
 	}
+	m.typingProducer = &producers.TypingProducer{
+		Producer: m.kafkaProducer,
+		Topic:    string(m.cfg.Kafka.Topics.OutputTypingEvent),
+	}
+	m.receiptProducer = &producers.ReceiptProducer{
+		Producer: m.kafkaProducer,
+		Topic:    string(m.cfg.Kafka.Topics.OutputReceiptEvent),
+	}
+	m.deviceListProducer = &producers.DeviceListProducer{
+		Producer: m.kafkaProducer,
+		Topic:    string(m.cfg.Kafka.Topics.OutputDeviceListUpdate),
+	}
+	m.presenceProducer = &producers.PresenceProducer{
+		Producer: m.kafkaProducer,
+		Topic:    string(m.cfg.Kafka.Topics.OutputPresenceEvent),
+	}
+	m.sendToDeviceProducer = &producers.SendToDeviceProducer{
+		Producer: m.kafkaProducer,
+		Topic:    string(m.cfg.Kafka.Topics.OutputSendToDeviceEvent),
+	}
 }
 
 func (m *monolith) setupNotifiers() {
@@ -269,10 +337,31 @@ func (m *monolith) setupNotifiers() {
 		log.Panicf("startup: failed to get latest sync stream position : %s", err)
 	}
 
-	m.syncAPINotifier = syncapi_sync.NewNotifier(syncapi_types.StreamPosition(pos))
+	var receiptRes roomserver_api.QueryReceiptsResponse
+	if err = m.receiptAPI.QueryReceipts(&roomserver_api.QueryReceiptsRequest{}, &receiptRes); err != nil {
+		log.Panicf("startup: failed to get latest receipt stream position : %s", err)
+	}
+
+	presencePos, err := m.accountDB.GetLatestPresencePosition()
+	if err != nil {
+		log.Panicf("startup: failed to get latest presence stream position : %s", err)
+	}
+
+	toDevicePos, err := m.accountDB.GetLatestToDevicePosition()
+	if err != nil {
+		log.Panicf("startup: failed to get latest to-device stream position : %s", err)
+	}
+
+	m.syncAPINotifier = syncapi_sync.NewNotifier(syncapi_types.SyncPosition{
+		PDUPosition:      syncapi_types.StreamPosition(pos),
+		ReceiptPosition:  receiptRes.StreamPosition,
+		PresencePosition: presencePos,
+		ToDevicePosition: toDevicePos,
+	})
 	if err = m.syncAPINotifier.Load(m.syncAPIDB); err != nil {
 		log.Panicf("startup: failed to set up notifier: %s", err)
 	}
+	m.syncAPITypingCache = syncapi_typing.NewCache(m.syncAPINotifier.OnNewTyping)
 }
 
 func (m *monolith) setupConsumers() {
@@ -299,6 +388,34 @@ func (m *monolith) setupConsumers() {
 		log.Panicf("startup: failed to start client API server consumer: %s", err)
 	}
 
+	syncAPITypingConsumer := syncapi_consumers.NewOutputTypingEvent(
+		m.cfg, m.kafkaConsumer(), m.syncAPITypingCache, m.syncAPIDB,
+	)
+	if err = syncAPITypingConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start typing consumer: %s", err)
+	}
+
+	syncAPIReceiptConsumer := syncapi_consumers.NewOutputReceiptEvent(
+		m.cfg, m.kafkaConsumer(), m.syncAPINotifier, m.syncAPIDB,
+	)
+	if err = syncAPIReceiptConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start receipt consumer: %s", err)
+	}
+
+	syncAPIPresenceConsumer := syncapi_consumers.NewOutputPresenceEvent(
+		m.cfg, m.kafkaConsumer(), m.syncAPINotifier, m.syncAPIDB,
+	)
+	if err = syncAPIPresenceConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start presence consumer: %s", err)
+	}
+
+	syncAPISendToDeviceConsumer := syncapi_consumers.NewOutputSendToDeviceEvent(
+		m.cfg, m.kafkaConsumer(), m.syncAPINotifier, m.syncAPIDB,
+	)
+	if err = syncAPISendToDeviceConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start send to device consumer: %s", err)
+	}
+
 	publicRoomsAPIConsumer := publicroomsapi_consumers.NewOutputRoomEvent(
 		m.cfg, m.kafkaConsumer(), m.publicRoomsAPIDB, m.queryAPI,
 	)
@@ -306,34 +423,110 @@ func (m *monolith) setupConsumers() {
 		log.Panicf("startup: failed to start room server consumer: %s", err)
 	}
 
-	federationSenderQueues := queue.NewOutgoingQueues(m.cfg.Matrix.ServerName, m.federation)
+	m.federationSenderQueues = queue.NewOutgoingQueues(m.cfg, m.federation, m.federationSenderDB)
+	if err = m.federationSenderQueues.Restore(); err != nil {
+		log.WithError(err).Panicf("startup: failed to restore federation sender queues")
+	}
 
 	federationSenderRoomConsumer := federationsender_consumers.NewOutputRoomEvent(
-		m.cfg, m.kafkaConsumer(), federationSenderQueues, m.federationSenderDB, m.queryAPI,
+		m.cfg, m.kafkaConsumer(), m.federationSenderQueues, m.federationSenderDB, m.queryAPI,
 	)
 	if err = federationSenderRoomConsumer.Start(); err != nil {
 		log.WithError(err).Panicf("startup: failed to start room server consumer")
 	}
+
+	federationSenderReceiptConsumer := federationsender_consumers.NewOutputReceiptEvent(
+		m.cfg, m.kafkaConsumer(), m.federationSenderQueues, m.federationSenderDB,
+	)
+	if err = federationSenderReceiptConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start receipt consumer")
+	}
+
+	federationSenderDeviceListConsumer := federationsender_consumers.NewOutputDeviceListUpdate(
+		m.cfg, m.kafkaConsumer(), m.federationSenderQueues, m.federationSenderDB,
+	)
+	if err = federationSenderDeviceListConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start device list consumer")
+	}
+
+	federationSenderPresenceConsumer := federationsender_consumers.NewOutputPresenceEvent(
+		m.cfg, m.kafkaConsumer(), m.federationSenderQueues, m.federationSenderDB,
+	)
+	if err = federationSenderPresenceConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start presence consumer")
+	}
+
+	federationSenderSendToDeviceConsumer := federationsender_consumers.NewOutputSendToDeviceEvent(
+		m.cfg, m.kafkaConsumer(), m.federationSenderQueues, m.federationSenderDB,
+	)
+	if err = federationSenderSendToDeviceConsumer.Start(); err != nil {
+		log.WithError(err).Panicf("startup: failed to start send to device consumer")
+	}
+
+	if m.appServiceDB != nil {
+		appServiceQueues := appservice_queue.NewAppServiceQueues(m.cfg, http.DefaultClient, m.appServiceDB)
+		if err = appServiceQueues.Restore(); err != nil {
+			log.WithError(err).Panicf("startup: failed to restore app service queues")
+		}
+
+		appServiceRoomConsumer := appservice_consumers.NewOutputRoomEvent(
+			m.cfg, m.kafkaConsumer(), appServiceQueues, m.appServiceDB, m.queryAPI,
+		)
+		if err = appServiceRoomConsumer.Start(); err != nil {
+			log.WithError(err).Panicf("startup: failed to start room server consumer")
+		}
+	}
+
+	clientapi_presence.NewIdleTimer(
+		m.accountDB, m.presenceProducer, m.cfg.Matrix.PresenceIdleTimeout,
+	).Start()
+
+	extremitiesCleaner := &roomserver_extremities.Cleaner{
+		DB:       m.roomServerDB,
+		Cfg:      m.cfg,
+		InputAPI: m.inputAPI,
+		QueryAPI: m.queryAPI,
+	}
+	extremitiesCleaner.Start()
+
+	retentionExpirer := &roomserver_retention.Expirer{
+		DB:           m.roomServerDB,
+		Cfg:          m.cfg,
+		QueryAPI:     m.queryAPI,
+		OutputWriter: m.inputAPI,
+	}
+	retentionExpirer.Start()
 }
 
 func (m *monolith) setupAPIs() {
 	clientapi_routing.Setup(
 		m.api, http.DefaultClient, *m.cfg, m.roomServerProducer,
-		m.queryAPI, m.aliasAPI, m.accountDB, m.deviceDB, m.federation, m.keyRing,
-		m.userUpdateProducer, m.syncProducer,
+		m.queryAPI, m.aliasAPI, m.receiptAPI, m.accountDB, m.deviceDB, m.federation, m.keyRing,
+		m.userUpdateProducer, m.syncProducer, m.typingProducer, m.receiptProducer, m.deviceListProducer,
+		m.presenceProducer, m.sendToDeviceProducer,
 	)
 
 	mediaapi_routing.Setup(
-		m.api, http.DefaultClient, m.cfg, m.mediaAPIDB,
+		m.api, http.DefaultClient, m.cfg, m.mediaAPIDB, m.deviceDB, m.accountDB,
 	)
 
 	syncapi_routing.Setup(m.api, syncapi_sync.NewRequestPool(
-		m.syncAPIDB, m.syncAPINotifier, m.accountDB,
+		m.syncAPIDB, m.syncAPINotifier, m.accountDB, m.syncAPITypingCache, m.queryAPI, m.receiptAPI,
+		m.presenceProducer, m.cfg,
 	), m.deviceDB)
 
 	federationapi_routing.Setup(
-		m.api, *m.cfg, m.queryAPI, m.roomServerProducer, m.keyRing, m.federation,
+		m.api, *m.cfg, m.queryAPI, m.roomServerProducer, m.keyRing, m.federation, m.deviceDB, m.accountDB,
+		m.presenceProducer, m.sendToDeviceProducer,
 	)
 
-	publicroomsapi_routing.Setup(m.api, m.deviceDB, m.publicRoomsAPIDB)
+	publicroomsapi_routing.Setup(m.api, *m.cfg, m.deviceDB, m.publicRoomsAPIDB, m.queryAPI, m.federation)
+
+	federationsender_routing.Setup(m.api, m.federationSenderQueues, m.deviceDB, m.accountDB)
+
+	purger, err := roomserver_admin.NewPurger(m.roomServerDB, m.inputAPI)
+	if err != nil {
+		log.WithError(err).Panicf("startup: failed to set up the purger")
+	}
+	roomserver_routing.Setup(m.api, purger, m.deviceDB, m.accountDB)
 }
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/publicroomsapi/consumers"
 	"github.com/matrix-org/dendrite/publicroomsapi/routing"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
@@ -46,6 +47,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	queryAPI := api.NewRoomserverQueryAPIHTTP(cfg.RoomServerURL(), nil)
 
@@ -78,8 +82,12 @@ func main() {
 	log.Info("Starting public rooms server on ", cfg.Listen.PublicRoomsAPI)
 
 	api := mux.NewRouter()
-	routing.Setup(api, deviceDB, db)
+	federation := federationclient.New(cfg)
+
+	routing.Setup(api, *cfg, deviceDB, db, queryAPI, federation)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	log.Fatal(http.ListenAndServe(string(cfg.Listen.PublicRoomsAPI), nil))
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.PublicRoomsAPI), nil)
+	srv.WaitForShutdown()
 }
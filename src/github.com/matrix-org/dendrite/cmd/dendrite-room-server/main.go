@@ -21,13 +21,20 @@ import (
 	"os"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/admin"
 	"github.com/matrix-org/dendrite/roomserver/alias"
+	"github.com/matrix-org/dendrite/roomserver/extremities"
 	"github.com/matrix-org/dendrite/roomserver/input"
 	"github.com/matrix-org/dendrite/roomserver/query"
+	"github.com/matrix-org/dendrite/roomserver/receipt"
+	"github.com/matrix-org/dendrite/roomserver/retention"
+	"github.com/matrix-org/dendrite/roomserver/routing"
 	"github.com/matrix-org/dendrite/roomserver/storage"
-	"github.com/prometheus/client_golang/prometheus"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
@@ -48,6 +55,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	db, err := storage.Open(string(cfg.Database.RoomServer))
 	if err != nil {
@@ -66,6 +76,7 @@ func main() {
 	}
 
 	inputAPI.SetupHTTP(http.DefaultServeMux)
+	inputAPI.SetupMetrics()
 
 	queryAPI := query.RoomserverQueryAPI{DB: db}
 
@@ -80,12 +91,46 @@ func main() {
 
 	aliasAPI.SetupHTTP(http.DefaultServeMux)
 
-	http.DefaultServeMux.Handle("/metrics", prometheus.Handler())
+	receiptAPI := receipt.RoomserverReceiptAPI{DB: db}
 
-	log.Info("Started room server on ", cfg.Listen.RoomServer)
+	receiptAPI.SetupHTTP(http.DefaultServeMux)
 
-	// TODO: Implement clean shutdown.
-	if err := http.ListenAndServe(string(cfg.Listen.RoomServer), nil); err != nil {
-		panic(err)
+	extremitiesCleaner := extremities.Cleaner{
+		DB:       db,
+		Cfg:      cfg,
+		InputAPI: &inputAPI,
+		QueryAPI: &queryAPI,
+	}
+	extremitiesCleaner.Start()
+
+	retentionExpirer := retention.Expirer{
+		DB:           db,
+		Cfg:          cfg,
+		QueryAPI:     &queryAPI,
+		OutputWriter: &inputAPI,
 	}
+	retentionExpirer.Start()
+
+	purger, err := admin.NewPurger(db, &inputAPI)
+	if err != nil {
+		log.WithError(err).Panicf("startup: failed to set up the purger")
+	}
+
+	deviceDB, err := devices.NewDatabase(string(cfg.Database.Device), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create device database with data source %s : %s", cfg.Database.Device, err)
+	}
+
+	accountDB, err := accounts.NewDatabase(string(cfg.Database.Account), cfg.Matrix.ServerName)
+	if err != nil {
+		log.Panicf("startup: failed to create account database with data source %s : %s", cfg.Database.Account, err)
+	}
+
+	api := mux.NewRouter()
+	routing.Setup(api, purger, deviceDB, accountDB)
+	common.SetupHTTPAPI(http.DefaultServeMux, api)
+
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.RoomServer), nil)
+	srv.WaitForShutdown(kafkaProducer.Close)
 }
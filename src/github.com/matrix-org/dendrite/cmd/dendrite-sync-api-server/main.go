@@ -22,6 +22,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -30,6 +31,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/syncapi/typing"
 
 	log "github.com/Sirupsen/logrus"
 	sarama "gopkg.in/Shopify/sarama.v1"
@@ -49,8 +51,12 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid config file: %s", err)
 	}
+	if err = common.SetupLogLevel(cfg, *configPath); err != nil {
+		log.Fatalf("Invalid log level: %s", err)
+	}
 
 	queryAPI := api.NewRoomserverQueryAPIHTTP(cfg.RoomServerURL(), nil)
+	receiptAPI := api.NewRoomserverReceiptAPIHTTP(cfg.RoomServerURL(), nil)
 
 	db, err := storage.NewSyncServerDatabase(string(cfg.Database.SyncAPI))
 	if err != nil {
@@ -72,10 +78,31 @@ func main() {
 		log.Panicf("startup: failed to get latest sync stream position : %s", err)
 	}
 
-	n := sync.NewNotifier(types.StreamPosition(pos))
+	var receiptRes api.QueryReceiptsResponse
+	if err = receiptAPI.QueryReceipts(&api.QueryReceiptsRequest{}, &receiptRes); err != nil {
+		log.Panicf("startup: failed to get latest receipt stream position : %s", err)
+	}
+
+	presencePos, err := adb.GetLatestPresencePosition()
+	if err != nil {
+		log.Panicf("startup: failed to get latest presence stream position : %s", err)
+	}
+
+	toDevicePos, err := adb.GetLatestToDevicePosition()
+	if err != nil {
+		log.Panicf("startup: failed to get latest to-device stream position : %s", err)
+	}
+
+	n := sync.NewNotifier(types.SyncPosition{
+		PDUPosition:      types.StreamPosition(pos),
+		ReceiptPosition:  receiptRes.StreamPosition,
+		PresencePosition: presencePos,
+		ToDevicePosition: toDevicePos,
+	})
 	if err = n.Load(db); err != nil {
 		log.Panicf("startup: failed to set up notifier: %s", err)
 	}
+	typingCache := typing.NewCache(n.OnNewTyping)
 
 	kafkaConsumer, err := sarama.NewConsumer(cfg.Kafka.Addresses, nil)
 	if err != nil {
@@ -85,6 +112,18 @@ func main() {
 		}).Panic("Failed to setup kafka consumers")
 	}
 
+	kafkaProducer, err := sarama.NewSyncProducer(cfg.Kafka.Addresses, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"addresses":  cfg.Kafka.Addresses,
+		}).Panic("Failed to setup kafka producers")
+	}
+	presenceProducer := &producers.PresenceProducer{
+		Producer: kafkaProducer,
+		Topic:    string(cfg.Kafka.Topics.OutputPresenceEvent),
+	}
+
 	roomConsumer := consumers.NewOutputRoomEvent(cfg, kafkaConsumer, n, db, queryAPI)
 	if err = roomConsumer.Start(); err != nil {
 		log.Panicf("startup: failed to start room server consumer: %s", err)
@@ -93,12 +132,30 @@ func main() {
 	if err = clientConsumer.Start(); err != nil {
 		log.Panicf("startup: failed to start client API server consumer: %s", err)
 	}
+	typingConsumer := consumers.NewOutputTypingEvent(cfg, kafkaConsumer, typingCache, db)
+	if err = typingConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start typing consumer: %s", err)
+	}
+	receiptConsumer := consumers.NewOutputReceiptEvent(cfg, kafkaConsumer, n, db)
+	if err = receiptConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start receipt consumer: %s", err)
+	}
+	presenceConsumer := consumers.NewOutputPresenceEvent(cfg, kafkaConsumer, n, db)
+	if err = presenceConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start presence consumer: %s", err)
+	}
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEvent(cfg, kafkaConsumer, n, db)
+	if err = sendToDeviceConsumer.Start(); err != nil {
+		log.Panicf("startup: failed to start send to device consumer: %s", err)
+	}
 
 	log.Info("Starting sync server on ", cfg.Listen.SyncAPI)
 
 	api := mux.NewRouter()
-	routing.Setup(api, sync.NewRequestPool(db, n, adb), deviceDB)
+	routing.Setup(api, sync.NewRequestPool(db, n, adb, typingCache, queryAPI, receiptAPI, presenceProducer, cfg), deviceDB)
 	common.SetupHTTPAPI(http.DefaultServeMux, api)
 
-	log.Fatal(http.ListenAndServe(string(cfg.Listen.SyncAPI), nil))
+	srv := common.NewHTTPServer(cfg.Listen.ShutdownTimeout)
+	srv.ListenAndServe(string(cfg.Listen.SyncAPI), nil)
+	srv.WaitForShutdown()
 }
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common/test"
 	"github.com/matrix-org/gomatrixserverlib"
 	"gopkg.in/yaml.v2"
@@ -144,8 +145,11 @@ func main() {
 	defer server1ProxyCmd.Process.Kill()
 	testDownload(server1ProxyAddr, server1ProxyAddr, "doesnotexist", "", 404, server1CmdChan)
 
+	// uploads must be authenticated
+	accessToken := createTestDevice("1", server1ProxyAddr)
+
 	// upload a JPEG file
-	testUpload(server1ProxyAddr, testJPEG, "image/jpeg", `{
+	testUpload(server1ProxyAddr, accessToken, testJPEG, "image/jpeg", `{
 		"content_uri": "mxc://localhost:18001/1VuVy8u_hmDllD8BrcY0deM34Bl7SPJeY9J6BkMmpx0"
 	}`, 200, server1CmdChan)
 
@@ -181,7 +185,22 @@ func getMediaURI(scheme, host, endpoint, query string, components []string) stri
 	return scheme + path.Join(pathComponents...) + query
 }
 
-func testUpload(host, filePath, contentType, wantedBody string, wantedStatusCode int, serverCmdChan chan error) {
+// createTestDevice creates a device in the database of the server with the
+// given suffix and returns its access token.
+func createTestDevice(suffix, serverName string) string {
+	database := fmt.Sprintf(testDatabaseTemplate, testDatabaseName+suffix)
+	deviceDB, err := devices.NewDatabase(database, gomatrixserverlib.ServerName(serverName))
+	if err != nil {
+		panic(err)
+	}
+	accessToken := "media_api_test_token"
+	if _, err = deviceDB.CreateDevice("media_api_test", "MEDIAAPITEST", accessToken, nil); err != nil {
+		panic(err)
+	}
+	return accessToken
+}
+
+func testUpload(host, accessToken, filePath, contentType, wantedBody string, wantedStatusCode int, serverCmdChan chan error) {
 	fmt.Printf("==TESTING== upload %v to %v\n", filePath, host)
 	file, err := os.Open(filePath)
 	defer file.Close()
@@ -205,6 +224,7 @@ func testUpload(host, filePath, contentType, wantedBody string, wantedStatusCode
 	}
 	req.ContentLength = fileSize
 	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	testReq := &test.Request{
 		Req:              req,
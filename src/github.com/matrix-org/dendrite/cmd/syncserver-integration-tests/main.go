@@ -242,7 +242,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "9",
+		"next_batch": "9_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -276,6 +276,9 @@ func main() {
 				}
 			},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 	// Make sure alice's rooms don't leak to bob
@@ -283,7 +286,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "9",
+		"next_batch": "9_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -291,6 +294,9 @@ func main() {
 			"invite": {},
 			"join": {},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 	// Make sure polling with an up-to-date token returns nothing new
@@ -298,7 +304,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "9",
+		"next_batch": "9_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -306,6 +312,9 @@ func main() {
 			"invite": {},
 			"join": {},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -317,7 +326,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "10",
+		"next_batch": "10_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -342,6 +351,9 @@ func main() {
 				}
 			},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -350,7 +362,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "10",
+		"next_batch": "10_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -382,6 +394,9 @@ func main() {
 				}
 			},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -393,7 +408,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "11",
+		"next_batch": "11_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -422,6 +437,9 @@ func main() {
 				}
 			},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -436,7 +454,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "14",
+		"next_batch": "14_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -450,6 +468,9 @@ func main() {
 			},
 			"join": {},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`
 	testSyncServer(syncServerCmdChan, "@charlie:localhost", "7", charlieInviteData)
@@ -466,7 +487,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "18",
+		"next_batch": "18_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -487,6 +508,9 @@ func main() {
 					}
 				}
 			}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -498,7 +522,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "18",
+		"next_batch": "18_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -520,6 +544,9 @@ func main() {
 					}
 				}
 			}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
@@ -531,7 +558,7 @@ func main() {
 		"account_data": {
 			"events": []
 		},
-		"next_batch": "19",
+		"next_batch": "19_0_0_0_0",
 		"presence": {
 			"events": []
 		},
@@ -539,6 +566,9 @@ func main() {
 			"invite": {},
 			"join": {},
 			"leave": {}
+		},
+		"to_device": {
+			"events": []
 		}
 	}`)
 
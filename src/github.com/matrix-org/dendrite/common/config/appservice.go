@@ -0,0 +1,186 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"gopkg.in/yaml.v2"
+)
+
+// ApplicationService is the registration of an application service, loaded
+// from one of the files in application_services.config_files.
+type ApplicationService struct {
+	// A unique identifier for the application service.
+	ID string `yaml:"id"`
+	// The URL the application service is listening on, which requests to it
+	// are sent to, e.g. "http://localhost:9000".
+	URL string `yaml:"url"`
+	// The access token the application service uses to talk to the server.
+	ASToken string `yaml:"as_token"`
+	// The access token the server uses to talk to the application service.
+	HSToken string `yaml:"hs_token"`
+	// The localpart of the user the application service acts as by default.
+	SenderLocalpart string `yaml:"sender_localpart"`
+	// The users, room aliases and room IDs the application service is
+	// interested in, under the "users", "aliases" and "rooms" keys.
+	Namespaces map[string][]ApplicationServiceNamespace `yaml:"namespaces"`
+	// Whether requests from the application service are rate limited.
+	RateLimited bool `yaml:"rate_limited"`
+	// The third party protocols the application service bridges, e.g. "irc".
+	Protocols []string `yaml:"protocols"`
+	// The user ID of the user with SenderLocalpart on this server.
+	SenderUserID string `yaml:"-"`
+	// The compiled regular expressions of the namespaces, by namespace key.
+	namespaceRegexps map[string][]namespaceRegexp
+}
+
+// ApplicationServiceNamespace is a set of users, room aliases or room IDs an
+// application service is interested in.
+type ApplicationServiceNamespace struct {
+	// Whether only the application service can use the IDs in the namespace.
+	Exclusive bool `yaml:"exclusive"`
+	// A regular expression matching the IDs in the namespace.
+	Regex string `yaml:"regex"`
+}
+
+// The keys of the namespaces in the registration of an application service.
+const (
+	usersNamespace   = "users"
+	aliasesNamespace = "aliases"
+	roomsNamespace   = "rooms"
+)
+
+type namespaceRegexp struct {
+	exclusive bool
+	regexp    *regexp.Regexp
+}
+
+// IsInterestedInUserID returns whether the user is the sender of the
+// application service or in one of its user namespaces.
+func (a *ApplicationService) IsInterestedInUserID(userID string) bool {
+	return userID == a.SenderUserID || a.matchNamespace(usersNamespace, userID, false)
+}
+
+// IsInterestedInRoomAlias returns whether the room alias is in one of the
+// alias namespaces of the application service.
+func (a *ApplicationService) IsInterestedInRoomAlias(alias string) bool {
+	return a.matchNamespace(aliasesNamespace, alias, false)
+}
+
+// IsInterestedInRoomID returns whether the room ID is in one of the room
+// namespaces of the application service.
+func (a *ApplicationService) IsInterestedInRoomID(roomID string) bool {
+	return a.matchNamespace(roomsNamespace, roomID, false)
+}
+
+// OwnsUserID returns whether the user is the sender of the application service
+// or in one of its exclusive user namespaces, which other users can't
+// register in.
+func (a *ApplicationService) OwnsUserID(userID string) bool {
+	return userID == a.SenderUserID || a.matchNamespace(usersNamespace, userID, true)
+}
+
+// OwnsRoomAlias returns whether the room alias is in one of the exclusive
+// alias namespaces of the application service, which other users can't
+// create aliases in.
+func (a *ApplicationService) OwnsRoomAlias(alias string) bool {
+	return a.matchNamespace(aliasesNamespace, alias, true)
+}
+
+// HasNamespace returns whether the application service has namespaces of the
+// given key, i.e. "users", "aliases" or "rooms".
+func (a *ApplicationService) HasNamespace(key string) bool {
+	return len(a.namespaceRegexps[key]) > 0
+}
+
+// matchNamespace returns whether the ID matches one of the namespaces of the
+// given key, only looking at the exclusive ones if exclusiveOnly is true.
+func (a *ApplicationService) matchNamespace(key, id string, exclusiveOnly bool) bool {
+	for _, namespace := range a.namespaceRegexps[key] {
+		if exclusiveOnly && !namespace.exclusive {
+			continue
+		}
+		if namespace.regexp.MatchString(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadApplicationService parses the registration file of an application
+// service and compiles the regular expressions of its namespaces. Like the
+// other implementations, the regular expressions only have to match the
+// start of the IDs. The path is only used in the error messages.
+func LoadApplicationService(
+	path string, data []byte, serverName gomatrixserverlib.ServerName,
+) (*ApplicationService, error) {
+	var registration ApplicationService
+	if err := yaml.Unmarshal(data, &registration); err != nil {
+		return nil, fmt.Errorf("invalid application service registration %q: %s", path, err)
+	}
+	registration.SenderUserID = fmt.Sprintf("@%s:%s", registration.SenderLocalpart, serverName)
+	registration.namespaceRegexps = map[string][]namespaceRegexp{}
+	for key, namespaces := range registration.Namespaces {
+		switch key {
+		case usersNamespace, aliasesNamespace, roomsNamespace:
+		default:
+			return nil, fmt.Errorf("invalid application service registration %q: unknown namespace %q", path, key)
+		}
+		for _, namespace := range namespaces {
+			re, err := regexp.Compile("^(?:" + namespace.Regex + ")")
+			if err != nil {
+				return nil, fmt.Errorf("invalid application service registration %q: %s", path, err)
+			}
+			registration.namespaceRegexps[key] = append(
+				registration.namespaceRegexps[key], namespaceRegexp{namespace.Exclusive, re},
+			)
+		}
+	}
+	return &registration, nil
+}
+
+// checkApplicationServices checks that the registrations have the keys the
+// server needs to talk to the application services, and that their IDs and
+// tokens are unique.
+func checkApplicationServices(registrations []ApplicationService) error {
+	var problems []string
+	ids := map[string]bool{}
+	asTokens := map[string]bool{}
+	for _, registration := range registrations {
+		if registration.ID == "" || registration.URL == "" ||
+			registration.ASToken == "" || registration.HSToken == "" ||
+			registration.SenderLocalpart == "" {
+			problems = append(problems, fmt.Sprintf(
+				"application service %q must have an id, url, as_token, hs_token and sender_localpart",
+				registration.ID,
+			))
+		}
+		if ids[registration.ID] {
+			problems = append(problems, fmt.Sprintf("duplicate application service id %q", registration.ID))
+		}
+		if asTokens[registration.ASToken] {
+			problems = append(problems, fmt.Sprintf("application service %q has the as_token of another one", registration.ID))
+		}
+		ids[registration.ID] = true
+		asTokens[registration.ASToken] = true
+	}
+	if problems != nil {
+		return Error{problems}
+	}
+	return nil
+}
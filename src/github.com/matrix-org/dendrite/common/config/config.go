@@ -17,6 +17,8 @@ package config
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -55,6 +57,12 @@ type Dendrite struct {
 		// An arbitrary string used to uniquely identify the PrivateKey. Must start with the
 		// prefix "ed25519:".
 		KeyID gomatrixserverlib.KeyID `yaml:"-"`
+		// The private keys the server signed requests and events with before
+		// the current one, along with when it stopped using them. Other servers
+		// can still use them to check the signatures of old events.
+		OldPrivateKeys []OldPrivateKey `yaml:"old_private_keys"`
+		// The public keys for the OldPrivateKeys, by key ID.
+		OldVerifyKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey `yaml:"-"`
 		// List of paths to X509 certificates used by the external federation listeners.
 		// These are used to calculate the TLS fingerprints to publish for this server.
 		// Other matrix servers talking to this server will expect the x509 certificate
@@ -70,6 +78,48 @@ type Dendrite struct {
 		// by remote servers.
 		// Defaults to 24 hours.
 		KeyValidityPeriod time.Duration `yaml:"key_validity_period"`
+		// How long the profiles of users on remote servers are cached for before
+		// being requested again from their server.
+		// Defaults to 5 minutes.
+		RemoteProfileCacheTTL time.Duration `yaml:"remote_profile_cache_ttl"`
+		// How long users have to complete user-interactive authentication
+		// after starting it, before they have to start again.
+		// Defaults to 10 minutes.
+		UserInteractiveAuthTimeout time.Duration `yaml:"user_interactive_auth_timeout"`
+		// How long users stay online or unavailable without setting their
+		// presence again before they are marked as offline.
+		// Defaults to 30 minutes.
+		PresenceIdleTimeout time.Duration `yaml:"presence_idle_timeout"`
+		// The rules users must follow when changing their password.
+		PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+		// How new accounts can be registered.
+		Registration Registration `yaml:"registration"`
+		// Whether registering an account requires a registration token, either
+		// one of RegistrationTokens, one stored in the account database, or
+		// the shared secret.
+		RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+		// Registration tokens which can be used any number of times.
+		RegistrationTokens []string `yaml:"registration_tokens"`
+		// A secret which server admins can use as a registration token, which
+		// never runs out.
+		RegistrationSharedSecret string `yaml:"registration_shared_secret"`
+		// The user IDs of the server admins, which are promoted when the client
+		// API starts and when they register. If it is empty, the first user to
+		// register becomes a server admin.
+		Admins []string `yaml:"admins"`
+		// How server notices are sent to users.
+		ServerNotices ServerNotices `yaml:"server_notices"`
+		// The servers clients discover in /.well-known/matrix/client.
+		WellKnownClient WellKnownClient `yaml:"well_known_client"`
+		// The room version used for new rooms when the client doesn't ask for
+		// a specific one. Defaults to "1".
+		DefaultRoomVersion string `yaml:"default_room_version"`
+		// A URL the reports of events made by users are POSTed to as JSON
+		// when they are received. Optional.
+		ReportWebhookURL string `yaml:"report_webhook_url"`
+		// The maximum size of events in bytes, once serialised as JSON.
+		// Defaults to 65535, as recommended by the spec.
+		MaxEventSizeBytes int `yaml:"max_event_size_bytes"`
 	} `yaml:"matrix"`
 
 	// The configuration specific to the media repostitory.
@@ -82,6 +132,10 @@ type Dendrite struct {
 		// Note: if max_file_size_bytes is set to 0, the size is unlimited.
 		// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 		MaxFileSizeBytes *FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
+		// The maximum total size in bytes of the files each user can upload.
+		// Admins can override it for individual users. Defaults to 0, which
+		// means unlimited.
+		MaxUploadSizePerUserBytes FileSizeBytes `yaml:"max_upload_size_per_user_bytes"`
 		// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 		DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 		// The maximum number of simultaneous thumbnail generators. default: 10
@@ -90,6 +144,94 @@ type Dendrite struct {
 		ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
 	} `yaml:"media"`
 
+	// The configuration for rate limiting requests from clients.
+	RateLimiting struct {
+		// Limits for membership changes (join, leave, invite, kick, ban and
+		// unban), per user.
+		Membership RateLimit `yaml:"membership"`
+		// Limits for sending message events, including redactions.
+		Messages EventRateLimit `yaml:"messages"`
+		// Limits for sending state events, which are more expensive for the
+		// room server than message events.
+		StateEvents EventRateLimit `yaml:"state_events"`
+	} `yaml:"rate_limiting"`
+
+	// The configuration for the room server.
+	RoomServer struct {
+		// Rooms with more forward extremities than this get an event merging
+		// them sent to them, since resolving the state of many extremities is
+		// slow. Defaults to 10. Set to a negative value to disable it.
+		MaxForwardExtremities int `yaml:"max_forward_extremities"`
+		// How often rooms are checked for too many forward extremities.
+		// Defaults to 5 minutes.
+		ForwardExtremitiesCheckInterval time.Duration `yaml:"forward_extremities_check_interval"`
+		// How often the events of rooms with a m.room.retention policy are
+		// checked for events older than the policy allows, which are then
+		// redacted. Defaults to 1 hour.
+		RetentionCheckInterval time.Duration `yaml:"retention_check_interval"`
+	} `yaml:"room_server"`
+
+	// The configuration for the federation sender.
+	FederationSender struct {
+		// The maximum number of PDUs and EDUs sent to a server in a single
+		// transaction. Default to 50 and 100, the limits of the specification.
+		MaxPDUsPerTransaction int `yaml:"max_pdus_per_transaction"`
+		MaxEDUsPerTransaction int `yaml:"max_edus_per_transaction"`
+		// How long to wait for more PDUs and EDUs to send to a server along
+		// with the first one before sending a transaction. Defaults to none.
+		TransactionDelay time.Duration `yaml:"transaction_delay"`
+		// The number of consecutive failed attempts at sending a transaction
+		// to a server after which nothing is sent to it anymore, until it is
+		// removed from the blacklist with the admin API. Defaults to 20.
+		BlacklistAfterFailures int `yaml:"blacklist_after_failures"`
+	} `yaml:"federation_sender"`
+
+	// The configuration for the application services bridging other
+	// networks to this server.
+	ApplicationServices struct {
+		// Paths to the registration files of the application services.
+		ConfigFiles []Path `yaml:"config_files"`
+		// The registrations loaded from ConfigFiles.
+		Registrations []ApplicationService `yaml:"-"`
+	} `yaml:"application_services"`
+
+	// The configuration for federating with other servers.
+	Federation struct {
+		// The server, as "host:port", which handles the federation requests
+		// for this server name, advertised to other servers in
+		// /.well-known/matrix/server. Nothing is advertised if it is empty.
+		WellKnownServer string `yaml:"well_known_server"`
+		// How long the addresses of other servers found in DNS are cached
+		// for. The resolver doesn't tell us the TTL of the SRV records, so
+		// this should be about the TTL they usually have. Defaults to 5
+		// minutes.
+		DNSCacheTTL time.Duration `yaml:"dns_cache_ttl"`
+		// The servers whose TLS certificates aren't verified when we send
+		// them requests, e.g. development servers with self-signed
+		// certificates. Don't use it in production.
+		TLSSkipVerifyServers []gomatrixserverlib.ServerName `yaml:"tls_skip_verify_servers"`
+		// Path to a PEM file of CA certificates trusted to issue the TLS
+		// certificates of other servers, in addition to the system ones.
+		TrustedCAFile Path `yaml:"trusted_ca_file"`
+		// The system CA certificates and the ones in TrustedCAFile, or nil
+		// to use the system ones.
+		TrustedCAs *x509.CertPool `yaml:"-"`
+		// Paths to the PEM encoded certificate and private key presented to
+		// other servers when we send them requests, for servers which require
+		// mutual TLS. Either both or neither must be set.
+		ClientCertPath Path `yaml:"client_cert"`
+		ClientKeyPath  Path `yaml:"client_key"`
+		// The certificate loaded from ClientCertPath and ClientKeyPath, or
+		// nil if they aren't set.
+		ClientCertificate *tls.Certificate `yaml:"-"`
+		// The maximum number of idle connections kept open to each server,
+		// to be reused by the next requests. Defaults to 10.
+		MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+		// How long idle connections to other servers are kept open for.
+		// Defaults to 90 seconds.
+		IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	} `yaml:"federation"`
+
 	// The configuration for talking to kafka.
 	Kafka struct {
 		// A list of kafka addresses to connect to.
@@ -107,6 +249,16 @@ type Dendrite struct {
 			OutputClientData Topic `yaml:"output_client_data"`
 			// Topic for user updates (profile, presence)
 			UserUpdates Topic `yaml:"user_updates"`
+			// Topic for sending typing notifications from client API to sync API
+			OutputTypingEvent Topic `yaml:"output_typing_event"`
+			// Topic for sending receipts from client API to sync API and federation sender
+			OutputReceiptEvent Topic `yaml:"output_receipt_event"`
+			// Topic for sending device list updates from client API to federation sender
+			OutputDeviceListUpdate Topic `yaml:"output_device_list_update"`
+			// Topic for sending presence updates from client API to sync API and federation sender
+			OutputPresenceEvent Topic `yaml:"output_presence_event"`
+			// Topic for sending to-device messages from client API to sync API and federation sender
+			OutputSendToDeviceEvent Topic `yaml:"output_send_to_device_event"`
 		}
 	} `yaml:"kafka"`
 
@@ -136,6 +288,9 @@ type Dendrite struct {
 		// The PublicRoomsAPI database stores information used to compute the public
 		// room directory. It is only accessed by the PublicRoomsAPI server.
 		PublicRoomsAPI DataSource `yaml:"public_rooms_api"`
+		// The AppService database stores the events waiting to be sent to the
+		// application services. It is only accessed by the AppService server.
+		AppService DataSource `yaml:"app_service"`
 	} `yaml:"database"`
 
 	// The internal addresses the components will listen on.
@@ -148,13 +303,31 @@ type Dendrite struct {
 		RoomServer       Address `yaml:"room_server"`
 		FederationSender Address `yaml:"federation_sender"`
 		PublicRoomsAPI   Address `yaml:"public_rooms_api"`
+		AppService       Address `yaml:"app_service"`
+		// The address the monolith server exposes its metrics on, separately
+		// from the APIs. The other servers expose their metrics under /metrics
+		// on their own address. Optional.
+		Metrics Address `yaml:"metrics"`
+		// How long the servers wait for the requests in flight to finish when
+		// they receive a SIGTERM before stopping anyway. Defaults to 30s.
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
 	} `yaml:"listen"`
+
+	// The configuration for the logs.
+	Logging struct {
+		// The minimum level of the logs to output, one of "debug", "info",
+		// "warn" or "error". Defaults to "info". It is reloaded when the
+		// servers receive a SIGHUP, and can be overridden with the LOG_LEVEL
+		// environment variable.
+		Level string `yaml:"level"`
+	} `yaml:"logging"`
 }
 
 // A Path on the filesystem.
 type Path string
 
-// A DataSource for opening a postgresql database using lib/pq.
+// A DataSource for opening a postgresql database using lib/pq, or for the
+// databases which support it a SQLite database when built with the sqlite tag.
 type DataSource string
 
 // A Topic in kafka.
@@ -163,9 +336,88 @@ type Topic string
 // An Address to listen on.
 type Address string
 
+// An OldPrivateKey is a private key the server no longer signs with.
+type OldPrivateKey struct {
+	// Path to the private key.
+	PrivateKeyPath Path `yaml:"private_key"`
+	// When the server stopped signing with the key as a millisecond timestamp.
+	ExpiredTS int64 `yaml:"expired_ts"`
+}
+
 // FileSizeBytes is a file size in bytes
 type FileSizeBytes int64
 
+// PasswordPolicy contains the rules new passwords must follow
+type PasswordPolicy struct {
+	// The minimum number of characters in a password. default: 8
+	MinLength int `yaml:"min_length"`
+	// Whether passwords must contain at least one digit.
+	RequireDigit bool `yaml:"require_digit"`
+	// Whether passwords must contain at least one lowercase letter.
+	RequireLowercase bool `yaml:"require_lowercase"`
+	// Whether passwords must contain at least one uppercase letter.
+	RequireUppercase bool `yaml:"require_uppercase"`
+	// Whether passwords must contain at least one character which is neither
+	// a letter nor a digit.
+	RequireSymbol bool `yaml:"require_symbol"`
+}
+
+// Registration contains the configuration for registering new accounts
+type Registration struct {
+	// Whether guests can register accounts.
+	GuestsEnabled bool `yaml:"guests_enabled"`
+	// Whether registering an account requires completing a reCAPTCHA instead
+	// of no check at all.
+	RecaptchaEnabled bool `yaml:"recaptcha_enabled"`
+	// The reCAPTCHA site key, given to clients.
+	RecaptchaPublicKey string `yaml:"recaptcha_public_key"`
+	// The reCAPTCHA secret key, used to check the responses of clients.
+	RecaptchaPrivateKey string `yaml:"recaptcha_private_key"`
+	// The URL to check reCAPTCHA responses against.
+	// default: https://www.google.com/recaptcha/api/siteverify
+	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
+}
+
+// ServerNotices is the configuration of the notices the server sends to users
+// in a dedicated room. Server notices are disabled if LocalPart is empty.
+type ServerNotices struct {
+	// The localpart of the user who sends the notices, e.g. "notices".
+	LocalPart string `yaml:"system_mxid_localpart"`
+	// The display name of the user who sends the notices.
+	DisplayName string `yaml:"system_mxid_display_name"`
+	// The avatar of the user who sends the notices.
+	AvatarURL string `yaml:"system_mxid_avatar_url"`
+	// The name of the rooms the notices are sent in. Defaults to
+	// "Server Notices".
+	RoomName string `yaml:"room_name"`
+}
+
+// WellKnownClient is the configuration of the servers clients discover when
+// they look up /.well-known/matrix/client for the server name. The file isn't
+// served if HomeserverBaseURL is empty.
+type WellKnownClient struct {
+	// The URL clients use to talk to this server, e.g.
+	// "https://matrix.example.com".
+	HomeserverBaseURL string `yaml:"homeserver_base_url"`
+	// The URL of the identity server clients should use. Optional.
+	IdentityServerBaseURL string `yaml:"identity_server_base_url"`
+}
+
+// RateLimit contains the configuration for a token-bucket rate limiter
+type RateLimit struct {
+	// The average number of requests allowed per second. default: 0.2
+	PerSecond float64 `yaml:"per_second"`
+	// The maximum number of requests allowed in a single burst. default: 10
+	Burst int `yaml:"burst"`
+}
+
+// EventRateLimit contains the rate limits for sending events, per user and
+// per room.
+type EventRateLimit struct {
+	PerUser RateLimit `yaml:"per_user"`
+	PerRoom RateLimit `yaml:"per_room"`
+}
+
 // ThumbnailSize contains a single thumbnail size configuration
 type ThumbnailSize struct {
 	// Maximum width of the thumbnail image
@@ -216,6 +468,21 @@ func LoadMonolithic(configPath string) (*Dendrite, error) {
 	return loadConfig(basePath, configData, ioutil.ReadFile, monolithic)
 }
 
+// LoadLogLevel reads the log level from a yaml config file, without loading
+// the rest of the config. Returns an empty string if the file doesn't set
+// one.
+func LoadLogLevel(configPath string) (string, error) {
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", err
+	}
+	var config Dendrite
+	if err = yaml.Unmarshal(configData, &config); err != nil {
+		return "", err
+	}
+	return config.Logging.Level, nil
+}
+
 // An Error indicates a problem parsing the config.
 type Error struct {
 	// List of problems encountered parsing the config.
@@ -250,6 +517,28 @@ func loadConfig(
 		return nil, err
 	}
 
+	config.Matrix.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	for _, oldKey := range config.Matrix.OldPrivateKeys {
+		oldKeyPath := absPath(basePath, oldKey.PrivateKeyPath)
+		oldKeyData, err := readFile(oldKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keyID, privateKey, err := readKeyPEM(oldKeyPath, oldKeyData)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := config.Matrix.OldVerifyKeys[keyID]; ok || keyID == config.Matrix.KeyID {
+			return nil, fmt.Errorf("key ID %q in %q is already used by another key", keyID, oldKeyPath)
+		}
+		config.Matrix.OldVerifyKeys[keyID] = gomatrixserverlib.OldVerifyKey{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64String(privateKey.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS: gomatrixserverlib.Timestamp(oldKey.ExpiredTS),
+		}
+	}
+
 	for _, certPath := range config.Matrix.FederationCertificatePaths {
 		absCertPath := absPath(basePath, certPath)
 		pemData, err := readFile(absCertPath)
@@ -263,6 +552,54 @@ func loadConfig(
 		config.Matrix.TLSFingerPrints = append(config.Matrix.TLSFingerPrints, *fingerprint)
 	}
 
+	if config.Federation.TrustedCAFile != "" {
+		caPath := absPath(basePath, config.Federation.TrustedCAFile)
+		pemData, err := readFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		if config.Federation.TrustedCAs, err = x509.SystemCertPool(); err != nil {
+			config.Federation.TrustedCAs = x509.NewCertPool()
+		}
+		if !config.Federation.TrustedCAs.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificate PEM data in %q", caPath)
+		}
+	}
+
+	if config.Federation.ClientCertPath != "" {
+		certPEM, err := readFile(absPath(basePath, config.Federation.ClientCertPath))
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := readFile(absPath(basePath, config.Federation.ClientKeyPath))
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		config.Federation.ClientCertificate = &cert
+	}
+
+	for _, registrationPath := range config.ApplicationServices.ConfigFiles {
+		absRegistrationPath := absPath(basePath, registrationPath)
+		registrationData, err := readFile(absRegistrationPath)
+		if err != nil {
+			return nil, err
+		}
+		registration, err := LoadApplicationService(
+			absRegistrationPath, registrationData, config.Matrix.ServerName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		config.ApplicationServices.Registrations = append(config.ApplicationServices.Registrations, *registration)
+	}
+	if err = checkApplicationServices(config.ApplicationServices.Registrations); err != nil {
+		return nil, err
+	}
+
 	config.Media.AbsBasePath = Path(absPath(basePath, config.Media.BasePath))
 
 	return &config, nil
@@ -273,6 +610,42 @@ func (config *Dendrite) setDefaults() {
 		config.Matrix.KeyValidityPeriod = 24 * time.Hour
 	}
 
+	if config.Matrix.RemoteProfileCacheTTL == 0 {
+		config.Matrix.RemoteProfileCacheTTL = 5 * time.Minute
+	}
+
+	if config.Matrix.UserInteractiveAuthTimeout == 0 {
+		config.Matrix.UserInteractiveAuthTimeout = 10 * time.Minute
+	}
+
+	if config.Matrix.PresenceIdleTimeout == 0 {
+		config.Matrix.PresenceIdleTimeout = 30 * time.Minute
+	}
+
+	if config.Listen.ShutdownTimeout == 0 {
+		config.Listen.ShutdownTimeout = 30 * time.Second
+	}
+
+	if config.Matrix.DefaultRoomVersion == "" {
+		config.Matrix.DefaultRoomVersion = "1"
+	}
+
+	if config.Matrix.MaxEventSizeBytes == 0 {
+		config.Matrix.MaxEventSizeBytes = 65535
+	}
+
+	if config.Matrix.ServerNotices.RoomName == "" {
+		config.Matrix.ServerNotices.RoomName = "Server Notices"
+	}
+
+	if config.Matrix.Registration.RecaptchaSiteVerifyAPI == "" {
+		config.Matrix.Registration.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
+	}
+
+	if config.Matrix.PasswordPolicy.MinLength == 0 {
+		config.Matrix.PasswordPolicy.MinLength = 8
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
@@ -281,6 +654,66 @@ func (config *Dendrite) setDefaults() {
 		defaultMaxFileSizeBytes := FileSizeBytes(10485760)
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
+
+	if config.RoomServer.MaxForwardExtremities == 0 {
+		config.RoomServer.MaxForwardExtremities = 10
+	}
+
+	if config.RoomServer.ForwardExtremitiesCheckInterval == 0 {
+		config.RoomServer.ForwardExtremitiesCheckInterval = 5 * time.Minute
+	}
+
+	if config.RoomServer.RetentionCheckInterval == 0 {
+		config.RoomServer.RetentionCheckInterval = time.Hour
+	}
+
+	if config.FederationSender.MaxPDUsPerTransaction == 0 {
+		config.FederationSender.MaxPDUsPerTransaction = 50
+	}
+
+	if config.FederationSender.MaxEDUsPerTransaction == 0 {
+		config.FederationSender.MaxEDUsPerTransaction = 100
+	}
+
+	if config.FederationSender.BlacklistAfterFailures == 0 {
+		config.FederationSender.BlacklistAfterFailures = 20
+	}
+
+	if config.Federation.DNSCacheTTL == 0 {
+		config.Federation.DNSCacheTTL = 5 * time.Minute
+	}
+
+	if config.Federation.MaxIdleConnsPerHost == 0 {
+		config.Federation.MaxIdleConnsPerHost = 10
+	}
+
+	if config.Federation.IdleConnTimeout == 0 {
+		config.Federation.IdleConnTimeout = 90 * time.Second
+	}
+
+	if config.RateLimiting.Membership.PerSecond == 0 {
+		config.RateLimiting.Membership.PerSecond = 0.2
+	}
+
+	if config.RateLimiting.Membership.Burst == 0 {
+		config.RateLimiting.Membership.Burst = 10
+	}
+
+	setRateLimitDefaults(&config.RateLimiting.Messages.PerUser, 5, 50)
+	setRateLimitDefaults(&config.RateLimiting.Messages.PerRoom, 20, 100)
+	setRateLimitDefaults(&config.RateLimiting.StateEvents.PerUser, 0.5, 10)
+	setRateLimitDefaults(&config.RateLimiting.StateEvents.PerRoom, 1, 20)
+}
+
+// setRateLimitDefaults sets the rate and burst of the limit to the given
+// defaults if they aren't set.
+func setRateLimitDefaults(limit *RateLimit, perSecond float64, burst int) {
+	if limit.PerSecond == 0 {
+		limit.PerSecond = perSecond
+	}
+	if limit.Burst == 0 {
+		limit.Burst = burst
+	}
 }
 
 func (e Error) Error() string {
@@ -297,7 +730,7 @@ func (config *Dendrite) check(monolithic bool) error {
 
 	if config.Version != Version {
 		return Error{[]string{fmt.Sprintf(
-			"unknown config version %q, expected %q", config.Version, Version,
+			"unknown config version %d, expected %d", config.Version, Version,
 		)}}
 	}
 
@@ -321,15 +754,65 @@ func (config *Dendrite) check(monolithic bool) error {
 
 	checkNotEmpty("matrix.server_name", string(config.Matrix.ServerName))
 	checkNotEmpty("matrix.private_key", string(config.Matrix.PrivateKeyPath))
+	for _, oldKey := range config.Matrix.OldPrivateKeys {
+		checkNotEmpty("matrix.old_private_keys.private_key", string(oldKey.PrivateKeyPath))
+		checkNotZero("matrix.old_private_keys.expired_ts", oldKey.ExpiredTS)
+	}
 	checkNotZero("matrix.federation_certificates", int64(len(config.Matrix.FederationCertificatePaths)))
+	for _, userID := range config.Matrix.Admins {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != config.Matrix.ServerName {
+			problems = append(problems, fmt.Sprintf("invalid value for config key %q: %q", "matrix.admins", userID))
+		}
+	}
+	if !IsSupportedRoomVersion(config.Matrix.DefaultRoomVersion) {
+		problems = append(problems, fmt.Sprintf(
+			"invalid value for config key %q: %q", "matrix.default_room_version", config.Matrix.DefaultRoomVersion,
+		))
+	}
+	if config.Matrix.Registration.RecaptchaEnabled {
+		checkNotEmpty("matrix.registration.recaptcha_public_key", config.Matrix.Registration.RecaptchaPublicKey)
+		checkNotEmpty("matrix.registration.recaptcha_private_key", config.Matrix.Registration.RecaptchaPrivateKey)
+	}
+
+	switch strings.ToLower(config.Logging.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("invalid value for config key %q: %q", "logging.level", config.Logging.Level))
+	}
 
 	checkNotEmpty("media.base_path", string(config.Media.BasePath))
 	checkPositive("media.max_file_size_bytes", int64(*config.Media.MaxFileSizeBytes))
+	checkPositive("media.max_upload_size_per_user_bytes", int64(config.Media.MaxUploadSizePerUserBytes))
 	checkPositive("media.max_thumbnail_generators", int64(config.Media.MaxThumbnailGenerators))
 	for i, size := range config.Media.ThumbnailSizes {
 		checkPositive(fmt.Sprintf("media.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(fmt.Sprintf("media.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+	checkRateLimit := func(key string, limit RateLimit) {
+		if limit.PerSecond < 0 {
+			problems = append(problems, fmt.Sprintf(
+				"invalid value for config key %q: %g", key+".per_second", limit.PerSecond,
+			))
+		}
+		checkPositive(key+".burst", int64(limit.Burst))
+	}
+	checkRateLimit("rate_limiting.membership", config.RateLimiting.Membership)
+	checkRateLimit("rate_limiting.messages.per_user", config.RateLimiting.Messages.PerUser)
+	checkRateLimit("rate_limiting.messages.per_room", config.RateLimiting.Messages.PerRoom)
+	checkRateLimit("rate_limiting.state_events.per_user", config.RateLimiting.StateEvents.PerUser)
+	checkRateLimit("rate_limiting.state_events.per_room", config.RateLimiting.StateEvents.PerRoom)
+	checkPositive("room_server.forward_extremities_check_interval", int64(config.RoomServer.ForwardExtremitiesCheckInterval))
+	checkPositive("room_server.retention_check_interval", int64(config.RoomServer.RetentionCheckInterval))
+	checkPositive("federation_sender.max_pdus_per_transaction", int64(config.FederationSender.MaxPDUsPerTransaction))
+	checkPositive("federation_sender.max_edus_per_transaction", int64(config.FederationSender.MaxEDUsPerTransaction))
+	checkPositive("federation_sender.transaction_delay", int64(config.FederationSender.TransactionDelay))
+	checkPositive("federation_sender.blacklist_after_failures", int64(config.FederationSender.BlacklistAfterFailures))
+	checkPositive("federation.max_idle_conns_per_host", int64(config.Federation.MaxIdleConnsPerHost))
+	checkPositive("federation.idle_conn_timeout", int64(config.Federation.IdleConnTimeout))
+	if config.Federation.ClientCertPath != "" || config.Federation.ClientKeyPath != "" {
+		checkNotEmpty("federation.client_cert", string(config.Federation.ClientCertPath))
+		checkNotEmpty("federation.client_key", string(config.Federation.ClientKeyPath))
+	}
 	if config.Kafka.UseNaffka {
 		if !monolithic {
 			problems = append(problems, fmt.Sprintf("naffka can only be used in a monolithic server"))
@@ -342,6 +825,11 @@ func (config *Dendrite) check(monolithic bool) error {
 	checkNotEmpty("kafka.topics.output_room_event", string(config.Kafka.Topics.OutputRoomEvent))
 	checkNotEmpty("kafka.topics.output_client_data", string(config.Kafka.Topics.OutputClientData))
 	checkNotEmpty("kafka.topics.user_updates", string(config.Kafka.Topics.UserUpdates))
+	checkNotEmpty("kafka.topics.output_typing_event", string(config.Kafka.Topics.OutputTypingEvent))
+	checkNotEmpty("kafka.topics.output_receipt_event", string(config.Kafka.Topics.OutputReceiptEvent))
+	checkNotEmpty("kafka.topics.output_device_list_update", string(config.Kafka.Topics.OutputDeviceListUpdate))
+	checkNotEmpty("kafka.topics.output_presence_event", string(config.Kafka.Topics.OutputPresenceEvent))
+	checkNotEmpty("kafka.topics.output_send_to_device_event", string(config.Kafka.Topics.OutputSendToDeviceEvent))
 	checkNotEmpty("database.account", string(config.Database.Account))
 	checkNotEmpty("database.device", string(config.Database.Device))
 	checkNotEmpty("database.server_key", string(config.Database.ServerKey))
@@ -410,6 +898,17 @@ func fingerprintPEM(data []byte) *gomatrixserverlib.TLSFingerprint {
 	}
 }
 
+// SystemUserID returns the user ID of the user the server attributes the
+// events it makes up on its own to: the server notices user, or
+// @system:<server name> if server notices are disabled.
+func (config *Dendrite) SystemUserID() string {
+	localpart := config.Matrix.ServerNotices.LocalPart
+	if localpart == "" {
+		localpart = "system"
+	}
+	return fmt.Sprintf("@%s:%s", localpart, config.Matrix.ServerName)
+}
+
 // RoomServerURL returns an HTTP URL for where the roomserver is listening.
 func (config *Dendrite) RoomServerURL() string {
 	// Hard code the roomserver to talk HTTP for now.
@@ -0,0 +1,43 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// RoomVersionStability is the stability of a room version as advertised to
+// clients, either "stable" or "unstable".
+type RoomVersionStability string
+
+// The stabilities a room version can have.
+const (
+	RoomVersionStable   RoomVersionStability = "stable"
+	RoomVersionUnstable RoomVersionStability = "unstable"
+)
+
+// SupportedRoomVersions maps the room versions this server can create and
+// join to their stability.
+var SupportedRoomVersions = map[string]RoomVersionStability{
+	"1": RoomVersionStable,
+	"2": RoomVersionStable,
+	"3": RoomVersionStable,
+	"4": RoomVersionStable,
+	"5": RoomVersionStable,
+	"6": RoomVersionStable,
+}
+
+// IsSupportedRoomVersion returns whether the given room version is one this
+// server supports.
+func IsSupportedRoomVersion(version string) bool {
+	_, ok := SupportedRoomVersions[version]
+	return ok
+}
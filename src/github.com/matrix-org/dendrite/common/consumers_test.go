@@ -0,0 +1,126 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/naffka"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// memoryPartitionStorer is a PartitionStorer which keeps its offsets in memory.
+type memoryPartitionStorer struct {
+	sync.Mutex
+	offsets map[string]map[int32]int64
+}
+
+func (s *memoryPartitionStorer) PartitionOffsets(topic string) ([]PartitionOffset, error) {
+	s.Lock()
+	defer s.Unlock()
+	var result []PartitionOffset
+	for partition, offset := range s.offsets[topic] {
+		result = append(result, PartitionOffset{Partition: partition, Offset: offset})
+	}
+	return result, nil
+}
+
+func (s *memoryPartitionStorer) SetPartitionOffset(topic string, partition int32, offset int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.offsets[topic] == nil {
+		s.offsets[topic] = map[int32]int64{}
+	}
+	s.offsets[topic][partition] = offset
+	return nil
+}
+
+// consumeUntilShutdown runs a ContinualConsumer on the topic until it reads
+// the "shutdown" message and returns the messages it read before it.
+func consumeUntilShutdown(t *testing.T, consumer sarama.Consumer, store PartitionStorer, topic string) []string {
+	var values []string
+	done := make(chan struct{})
+	c := ContinualConsumer{
+		Topic:          topic,
+		Consumer:       consumer,
+		PartitionStore: store,
+		ProcessMessage: func(msg *sarama.ConsumerMessage) error {
+			if string(msg.Value) == "shutdown" {
+				return ErrShutdown
+			}
+			values = append(values, string(msg.Value))
+			return nil
+		},
+		ShutdownCallback: func() { close(done) },
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the consumer to shut down")
+	}
+	return values
+}
+
+func TestContinualConsumerWithNaffka(t *testing.T) {
+	n, err := naffka.New(&naffka.MemoryDatabase{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	naff := Naffka{n}
+	const topic = "testTopic"
+	send := func(values ...string) {
+		for _, value := range values {
+			if _, _, err := naff.SendMessage(&sarama.ProducerMessage{
+				Topic: topic, Value: sarama.StringEncoder(value),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	store := &memoryPartitionStorer{offsets: map[string]map[int32]int64{}}
+
+	send("one", "two", "shutdown")
+	if got, want := consumeUntilShutdown(t, naff, store, topic), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want messages %v, got %v", want, got)
+	}
+
+	// A restarted consumer carries on from the offset it reached before.
+	send("three", "shutdown")
+	if got, want := consumeUntilShutdown(t, naff, store, topic), []string{"three"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want messages %v, got %v", want, got)
+	}
+
+	// Naffka keeps its messages in memory, so they are lost when the server
+	// restarts but the offsets the consumer reached are not. The consumer
+	// still receives the messages sent after the restart.
+	if n, err = naffka.New(&naffka.MemoryDatabase{}); err != nil {
+		t.Fatal(err)
+	}
+	naff = Naffka{n}
+	go func() {
+		// Give the consumer time to catch up before sending.
+		time.Sleep(100 * time.Millisecond)
+		send("four", "shutdown")
+	}()
+	if got, want := consumeUntilShutdown(t, naff, store, topic), []string{"four"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want messages %v, got %v", want, got)
+	}
+}
@@ -14,6 +14,8 @@
 
 package common
 
+import "encoding/json"
+
 // CreateContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-create
 type CreateContent struct {
 	Creator  string `json:"creator"`
@@ -29,6 +31,21 @@ type MemberContent struct {
 	// TODO: ThirdPartyInvite string `json:"third_party_invite,omitempty"`
 }
 
+// ThirdPartyInviteContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-third-party-invite
+type ThirdPartyInviteContent struct {
+	DisplayName    string      `json:"display_name"`
+	KeyValidityURL string      `json:"key_validity_url"`
+	PublicKey      string      `json:"public_key"`
+	PublicKeys     []PublicKey `json:"public_keys"`
+}
+
+// PublicKey is one of the public keys an identity server can use to sign a
+// third-party invite, as listed in m.room.third_party_invite events.
+type PublicKey struct {
+	PublicKey      string `json:"public_key"`
+	KeyValidityURL string `json:"key_validity_url"`
+}
+
 // NameContent is the event content for https://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-name
 type NameContent struct {
 	Name string `json:"name"`
@@ -54,6 +71,17 @@ type HistoryVisibilityContent struct {
 	HistoryVisibility string `json:"history_visibility"`
 }
 
+// RetentionContent is the event content for the m.room.retention state event
+// of MSC1763, the retention policy of a room.
+type RetentionContent struct {
+	// How long the server should keep the events of the room for, in
+	// milliseconds. Optional.
+	MaxLifetime *int64 `json:"max_lifetime,omitempty"`
+	// How long the server should keep the events of the room for at least,
+	// in milliseconds. Optional.
+	MinLifetime *int64 `json:"min_lifetime,omitempty"`
+}
+
 // PowerLevelContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-power-levels
 type PowerLevelContent struct {
 	EventsDefault int            `json:"events_default"`
@@ -65,6 +93,48 @@ type PowerLevelContent struct {
 	Events        map[string]int `json:"events"`
 	Kick          int            `json:"kick"`
 	Users         map[string]int `json:"users"`
+	// The power levels needed to send each kind of notification, e.g. "room"
+	Notifications map[string]int `json:"notifications,omitempty"`
+}
+
+// UserLevel returns the power level of the given user, as defined by the
+// power levels content.
+func (c *PowerLevelContent) UserLevel(userID string) int {
+	if level, ok := c.Users[userID]; ok {
+		return level
+	}
+	return c.UsersDefault
+}
+
+// EventLevel returns the power level needed to send an event of the given
+// type, as defined by the power levels content.
+func (c *PowerLevelContent) EventLevel(eventType string, isState bool) int {
+	if level, ok := c.Events[eventType]; ok {
+		return level
+	}
+	if isState {
+		return c.StateDefault
+	}
+	return c.EventsDefault
+}
+
+// DefaultPowerLevelContent returns the values the spec says to use for the
+// fields missing from a m.room.power_levels event. The content of the event
+// can be unmarshalled on top of it.
+// http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-power-levels
+func DefaultPowerLevelContent() PowerLevelContent {
+	return PowerLevelContent{
+		EventsDefault: 0,
+		Invite:        0,
+		StateDefault:  50,
+		Redact:        50,
+		Ban:           50,
+		UsersDefault:  0,
+		Events:        map[string]int{},
+		Kick:          50,
+		Users:         map[string]int{},
+		Notifications: map[string]int{"room": 50},
+	}
 }
 
 // InitialPowerLevelsContent returns the initial values for m.room.power_levels on room creation
@@ -91,6 +161,12 @@ func InitialPowerLevelsContent(roomCreator string) PowerLevelContent {
 	}
 }
 
+// TombstoneContent is the event content for https://matrix.org/docs/spec/client_server/r0.6.0.html#m-room-tombstone
+type TombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
 // AliasesContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-aliases
 type AliasesContent struct {
 	Aliases []string `json:"aliases"`
@@ -116,3 +192,23 @@ type ImageInfo struct {
 	Width    int64  `json:"w"`
 	Size     int64  `json:"size"`
 }
+
+// RelatesToContent is the part of the content of events which relate to
+// another event, e.g. edits: https://spec.matrix.org/v1.1/client-server-api/#forming-relationships-between-events
+type RelatesToContent struct {
+	RelatesTo *RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+// RelatesTo is the m.relates_to of the content of an event.
+type RelatesTo struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+	// The key of m.annotation relations, e.g. the emoji of a reaction.
+	Key string `json:"key,omitempty"`
+}
+
+// NewContent is the content of edits, whose m.new_content replaces the
+// content of the edited event.
+type NewContent struct {
+	NewContent json.RawMessage `json:"m.new_content"`
+}
@@ -0,0 +1,336 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The placeholder event ID given to events whose ID is their reference hash
+// while the hash is computed. gomatrixserverlib leaves event IDs without a
+// domain out of the hashes and signatures of the events.
+const placeholderEventID = "$placeholder"
+
+// BuildEvent builds an event sent by this server in a room of the given
+// version. The event has a random ID on this server in rooms whose events are
+// EventFormatV1, and its reference hash as ID in later formats.
+// Returns an UnsupportedRoomVersionError if this server doesn't support the
+// version of the room.
+func BuildEvent(
+	builder *gomatrixserverlib.EventBuilder, roomVersion string, now time.Time,
+	origin gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID, privateKey ed25519.PrivateKey,
+) (gomatrixserverlib.Event, error) {
+	if err := CheckRoomVersion(builder.RoomID, roomVersion); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	format := RoomVersionEventFormats[roomVersion]
+	if format == EventFormatV1 {
+		eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), origin)
+		return builder.Build(eventID, now, origin, keyID, privateKey)
+	}
+
+	builderJSON, err := EventBuilderJSON(builder, roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	var event map[string]json.RawMessage
+	if err = json.Unmarshal(builderJSON, &event); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if event["origin"], err = json.Marshal(origin); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if event["origin_server_ts"], err = json.Marshal(gomatrixserverlib.AsTimestamp(now)); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+
+	// The content hash covers everything but the unsigned data.
+	delete(event, "unsigned")
+	hashableJSON, err := json.Marshal(event)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if hashableJSON, err = gomatrixserverlib.CanonicalJSON(hashableJSON); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	contentHash := sha256.Sum256(hashableJSON)
+	if event["hashes"], err = json.Marshal(map[string]string{
+		"sha256": base64.RawStdEncoding.EncodeToString(contentHash[:]),
+	}); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if len(builder.Unsigned) > 0 {
+		event["unsigned"] = json.RawMessage(builder.Unsigned)
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	signed, err := withPlaceholderEventID(eventJSON)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	signed = signed.Sign(string(origin), keyID, privateKey)
+	eventJSON, err = withEventID(signed.JSON(), roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	return gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON)
+}
+
+// EventBuilderJSON returns the JSON of an event builder in the format of the
+// events of a room of the given version, e.g. for the response to /make_join.
+// Events in rooms whose events aren't EventFormatV1 refer to other events by
+// event ID alone.
+func EventBuilderJSON(builder *gomatrixserverlib.EventBuilder, roomVersion string) ([]byte, error) {
+	if RoomVersionEventFormats[roomVersion] == EventFormatV1 {
+		return json.Marshal(builder)
+	}
+	// The fields of the outer struct take precedence over the fields of the
+	// embedded builder with the same JSON keys.
+	return json.Marshal(struct {
+		*gomatrixserverlib.EventBuilder
+		PrevEvents []string `json:"prev_events"`
+		AuthEvents []string `json:"auth_events"`
+	}{
+		EventBuilder: builder,
+		PrevEvents:   referenceEventIDs(builder.PrevEvents),
+		AuthEvents:   referenceEventIDs(builder.AuthEvents),
+	})
+}
+
+func referenceEventIDs(refs []gomatrixserverlib.EventReference) []string {
+	eventIDs := make([]string, len(refs))
+	for i := range refs {
+		eventIDs[i] = refs[i].EventID
+	}
+	return eventIDs
+}
+
+// NewEventFromFederationJSON loads an event received over federation in a room
+// of the given version, checking that the event is in the format of the room.
+// EventFormatV1 events contain their event ID, which later formats leave out
+// since it is the reference hash of the event. Room version 6 also requires
+// the integers in the event to be in the range of canonical JSON.
+// Returns an UnsupportedRoomVersionError if this server doesn't support the
+// version of the room.
+func NewEventFromFederationJSON(eventJSON []byte, roomVersion string) (gomatrixserverlib.Event, error) {
+	var fields struct {
+		RoomID     string            `json:"room_id"`
+		EventID    *string           `json:"event_id"`
+		Content    json.RawMessage   `json:"content"`
+		PrevEvents []json.RawMessage `json:"prev_events"`
+		AuthEvents []json.RawMessage `json:"auth_events"`
+	}
+	if err := json.Unmarshal(eventJSON, &fields); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if err := CheckRoomVersion(fields.RoomID, roomVersion); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(fields.Content), []byte("{")) {
+		return gomatrixserverlib.Event{}, fmt.Errorf("event content must be an object")
+	}
+	if roomVersion == "6" {
+		if err := checkCanonicalJSONIntegers(eventJSON); err != nil {
+			return gomatrixserverlib.Event{}, err
+		}
+	}
+
+	hashFormat := RoomVersionEventFormats[roomVersion] != EventFormatV1
+	if hashFormat != (fields.EventID == nil) {
+		return gomatrixserverlib.Event{}, fmt.Errorf(
+			"event is not in the format of room version %q: event_id must only be given in version 1 and 2 rooms", roomVersion,
+		)
+	}
+	// EventFormatV1 events refer to other events by an event ID and hash pair
+	// and later formats by event ID alone.
+	for _, ref := range append(fields.PrevEvents, fields.AuthEvents...) {
+		if bytes.HasPrefix(bytes.TrimSpace(ref), []byte(`"`)) != hashFormat {
+			return gomatrixserverlib.Event{}, fmt.Errorf(
+				"event is not in the format of room version %q: invalid event reference %s", roomVersion, string(ref),
+			)
+		}
+	}
+
+	if !hashFormat {
+		// Event IDs without a domain are reference hashes, which would be
+		// trusted without being checked.
+		if !strings.Contains(*fields.EventID, ":") {
+			return gomatrixserverlib.Event{}, fmt.Errorf("invalid event ID %q", *fields.EventID)
+		}
+		return gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON)
+	}
+	eventJSON, err := withEventID(eventJSON, roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	return gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON)
+}
+
+// NewEventsFromFederationJSON loads a list of events received over federation
+// in a room of the given version using NewEventFromFederationJSON.
+func NewEventsFromFederationJSON(eventsJSON []json.RawMessage, roomVersion string) ([]gomatrixserverlib.Event, error) {
+	events := make([]gomatrixserverlib.Event, len(eventsJSON))
+	for i := range eventsJSON {
+		var err error
+		if events[i], err = NewEventFromFederationJSON(eventsJSON[i], roomVersion); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// FederationEventJSON returns the JSON of an event as it is sent over
+// federation, which leaves out the event ID of events whose ID is their
+// reference hash.
+func FederationEventJSON(event gomatrixserverlib.Event) (json.RawMessage, error) {
+	if strings.Contains(event.EventID(), ":") {
+		return event.JSON(), nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "event_id")
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return gomatrixserverlib.CanonicalJSON(eventJSON)
+}
+
+// FederationEventsJSON returns the JSON of a list of events as they are sent
+// over federation using FederationEventJSON.
+func FederationEventsJSON(events []gomatrixserverlib.Event) ([]json.RawMessage, error) {
+	eventsJSON := make([]json.RawMessage, len(events))
+	for i := range events {
+		var err error
+		if eventsJSON[i], err = FederationEventJSON(events[i]); err != nil {
+			return nil, err
+		}
+	}
+	return eventsJSON, nil
+}
+
+// withEventID adds the event ID to the JSON of an event in a room whose event
+// IDs are the reference hashes of the events.
+// See https://matrix.org/docs/spec/rooms/v3#event-ids and
+// https://matrix.org/docs/spec/rooms/v4#event-ids
+func withEventID(eventJSON []byte, roomVersion string) ([]byte, error) {
+	event, err := withPlaceholderEventID(eventJSON)
+	if err != nil {
+		return nil, err
+	}
+	// Room version 6 redacts all the content of m.room.aliases events, which
+	// gomatrixserverlib keeps when computing the reference hash.
+	// See https://matrix.org/docs/spec/rooms/v6#redactions
+	if roomVersion == "6" && event.Type() == gomatrixserverlib.MRoomAliases {
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(event.JSON(), &fields); err != nil {
+			return nil, err
+		}
+		fields["content"] = json.RawMessage("{}")
+		var redactedJSON []byte
+		if redactedJSON, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+		if event, err = gomatrixserverlib.NewEventFromTrustedJSON(redactedJSON, false); err != nil {
+			return nil, err
+		}
+	}
+	// Events are only loaded once their content is known to be an object, so
+	// that the redaction needed to compute the reference hash succeeds.
+	hash := event.EventReference().EventSHA256
+	encoding := base64.RawStdEncoding
+	if RoomVersionEventFormats[roomVersion] == EventFormatV3 {
+		encoding = base64.RawURLEncoding
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(eventJSON, &fields); err != nil {
+		return nil, err
+	}
+	if fields["event_id"], err = json.Marshal("$" + encoding.EncodeToString(hash)); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// withPlaceholderEventID loads an event without an event ID from trusted JSON
+// so that it can be signed and its reference hash computed.
+func withPlaceholderEventID(eventJSON []byte) (gomatrixserverlib.Event, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(eventJSON, &fields); err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	fields["event_id"] = json.RawMessage(strconv.Quote(placeholderEventID))
+	placeholderJSON, err := json.Marshal(fields)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	return gomatrixserverlib.NewEventFromTrustedJSON(placeholderJSON, false)
+}
+
+// The largest integer that canonical JSON allows, 2**53 - 1.
+const maxCanonicalJSONInteger = 1<<53 - 1
+
+// checkCanonicalJSONIntegers checks that the numbers in an event are integers
+// that canonical JSON allows, as room version 6 requires.
+// See https://matrix.org/docs/spec/rooms/v6#canonical-json
+func checkCanonicalJSONIntegers(eventJSON []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(eventJSON))
+	decoder.UseNumber()
+	var event interface{}
+	if err := decoder.Decode(&event); err != nil {
+		return err
+	}
+	return checkJSONIntegers(event)
+}
+
+func checkJSONIntegers(value interface{}) error {
+	switch value := value.(type) {
+	case json.Number:
+		n, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil || n > maxCanonicalJSONInteger || n < -maxCanonicalJSONInteger {
+			return fmt.Errorf("invalid number %s: numbers must be integers in the range [-(2**53)+1, (2**53)-1]", value)
+		}
+	case map[string]interface{}:
+		for _, v := range value {
+			if err := checkJSONIntegers(v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range value {
+			if err := checkJSONIntegers(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
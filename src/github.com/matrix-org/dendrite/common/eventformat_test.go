@@ -0,0 +1,146 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+var testPublicKey, testPrivateKey, _ = ed25519.GenerateKey(rand.Reader)
+
+func buildTestEvent(
+	t *testing.T, roomVersion, eventType string, prevEvents []gomatrixserverlib.EventReference,
+) gomatrixserverlib.Event {
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:localhost",
+		RoomID:     "!room:localhost",
+		Type:       eventType,
+		PrevEvents: prevEvents,
+		Depth:      int64(len(prevEvents) + 1),
+	}
+	if err := builder.SetContent(map[string]interface{}{"body": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := BuildEvent(&builder, roomVersion, time.Now(), "localhost", "ed25519:test", testPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestBuildEvent(t *testing.T) {
+	event := buildTestEvent(t, "1", "m.room.message", nil)
+	if !strings.HasPrefix(event.EventID(), "$") || !strings.HasSuffix(event.EventID(), ":localhost") {
+		t.Errorf("wanted a version 1 event ID for localhost, got %q", event.EventID())
+	}
+
+	// Events of later versions have their reference hash as ID, in standard
+	// base64 for room version 3 and URL-safe base64 after that.
+	for roomVersion, otherAlphabet := range map[string]string{"3": "-_", "5": "+/", "6": "+/"} {
+		first := buildTestEvent(t, roomVersion, "m.room.message", nil)
+		event = buildTestEvent(t, roomVersion, "m.room.message", []gomatrixserverlib.EventReference{first.EventReference()})
+		reference := event.EventReference()
+		if strings.Contains(event.EventID(), ":") || reference.EventID != event.EventID() {
+			t.Errorf("wanted a reference hash event ID in room version %q, got %q", roomVersion, event.EventID())
+		}
+		if strings.ContainsAny(event.EventID(), otherAlphabet) {
+			t.Errorf("wanted an event ID without %q in room version %q, got %q", otherAlphabet, roomVersion, event.EventID())
+		}
+
+		// The event ID is left out over federation and computed again when
+		// the event is received, while other events are referred to by ID.
+		eventJSON, err := FederationEventJSON(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(eventJSON, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["event_id"]; ok {
+			t.Errorf("wanted no event_id over federation in room version %q, got %s", roomVersion, string(eventJSON))
+		}
+		if want := `["` + first.EventID() + `"]`; string(fields["prev_events"]) != want {
+			t.Errorf("wanted prev_events %s in room version %q, got %s", want, roomVersion, string(fields["prev_events"]))
+		}
+		received, err := NewEventFromFederationJSON(eventJSON, roomVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.EventID() != event.EventID() || received.Redacted() {
+			t.Errorf("wanted event %q in room version %q, got %q (redacted: %t)", event.EventID(), roomVersion, received.EventID(), received.Redacted())
+		}
+		if err = received.Verify("localhost", "ed25519:test", testPublicKey); err != nil {
+			t.Errorf("wanted a valid signature in room version %q, got %v", roomVersion, err)
+		}
+	}
+
+	if _, err := BuildEvent(&gomatrixserverlib.EventBuilder{RoomID: "!room:localhost"}, "unknown", time.Now(), "localhost", "ed25519:test", nil); err == nil {
+		t.Error("wanted an error for an unknown room version")
+	} else if _, ok := err.(UnsupportedRoomVersionError); !ok {
+		t.Errorf("wanted an UnsupportedRoomVersionError for an unknown room version, got %v", err)
+	}
+}
+
+func TestNewEventFromFederationJSONChecksFormat(t *testing.T) {
+	v1EventJSON, err := FederationEventJSON(buildTestEvent(t, "1", "m.room.message", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v5EventJSON, err := FederationEventJSON(buildTestEvent(t, "5", "m.room.message", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewEventFromFederationJSON(v1EventJSON, "2"); err != nil {
+		t.Errorf("wanted a version 1 event to be valid in a version 2 room, got %v", err)
+	}
+	if _, err = NewEventFromFederationJSON(v1EventJSON, "5"); err == nil {
+		t.Error("wanted an error for a version 1 event in a version 5 room")
+	}
+	if _, err = NewEventFromFederationJSON(v5EventJSON, "1"); err == nil {
+		t.Error("wanted an error for a version 5 event in a version 1 room")
+	}
+
+	// The event ID is computed so the content of the event can't change.
+	tampered := strings.Replace(string(v5EventJSON), `"hello"`, `"goodbye"`, 1)
+	if event, err := NewEventFromFederationJSON([]byte(tampered), "5"); err == nil && !event.Redacted() {
+		t.Error("wanted a tampered event to be redacted")
+	}
+}
+
+func TestNewEventFromFederationJSONChecksIntegers(t *testing.T) {
+	eventJSON, err := FederationEventJSON(buildTestEvent(t, "5", "m.room.message", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{"1.5", "1e3", "9007199254740992"} {
+		withNumber := strings.Replace(string(eventJSON), `"body":"hello"`, `"body":"hello","n":`+number, 1)
+		// Room version 5 allows any number, while version 6 only allows the
+		// integers of canonical JSON.
+		if _, err = NewEventFromFederationJSON([]byte(withNumber), "5"); err != nil {
+			t.Errorf("wanted %s to be valid in a version 5 room, got %v", number, err)
+		}
+		if _, err = NewEventFromFederationJSON([]byte(withNumber), "6"); err == nil {
+			t.Errorf("wanted an error for %s in a version 6 room", number)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EventTooLargeError is returned when an event is larger than the server
+// allows.
+type EventTooLargeError struct {
+	EventID string
+	Size    int
+	MaxSize int
+}
+
+func (e EventTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"event %q is %d bytes, which is more than the maximum of %d bytes",
+		e.EventID, e.Size, e.MaxSize,
+	)
+}
+
+// CheckEventSize returns an EventTooLargeError if the event is larger than the
+// maximum size in bytes once serialised as JSON. Events of any size are
+// allowed if the maximum isn't positive.
+func CheckEventSize(event gomatrixserverlib.Event, maxSize int) error {
+	if size := len(event.JSON()); maxSize > 0 && size > maxSize {
+		return EventTooLargeError{event.EventID(), size, maxSize}
+	}
+	return nil
+}
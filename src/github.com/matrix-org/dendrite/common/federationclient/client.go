@@ -0,0 +1,163 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package federationclient creates the client used to make requests to the
+// federation APIs of other matrix servers.
+package federationclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// New creates a federation client which signs its requests with the key of
+// the server. The address of the destination servers is found by following
+// their .well-known delegation, then looking the delegated server up in DNS,
+// as described in https://matrix.org/docs/spec/server_server/r0.1.0.html#resolving-server-names
+func New(cfg *config.Dendrite) *Client {
+	return NewClient(
+		cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+		newFederationTransport(cfg),
+	)
+}
+
+// A federationTransport sends federation requests, whose URL host is the
+// destination server name, to the address the server is listening on.
+type federationTransport struct {
+	wellKnown *wellKnownResolver
+	dns       *dnsResolver
+	tlsConfig *tls.Config
+	// The idle connections kept open to each destination.
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	// The servers whose TLS certificates aren't verified.
+	skipVerify map[gomatrixserverlib.ServerName]bool
+	// Protects transports.
+	mutex sync.Mutex
+	// The transports used for each destination, whose TLS config checks
+	// the certificate against the name of the destination. Each keeps a pool
+	// of connections to the destination, reused across requests.
+	transports map[gomatrixserverlib.ServerName]*http.Transport
+}
+
+func newFederationTransport(cfg *config.Dendrite) *federationTransport {
+	tlsConfig := &tls.Config{
+		// Nil uses the system CAs.
+		RootCAs: cfg.Federation.TrustedCAs,
+	}
+	if cfg.Federation.ClientCertificate != nil {
+		// Present the certificate to servers which require mutual TLS.
+		tlsConfig.Certificates = []tls.Certificate{*cfg.Federation.ClientCertificate}
+	}
+	skipVerify := map[gomatrixserverlib.ServerName]bool{}
+	for _, serverName := range cfg.Federation.TLSSkipVerifyServers {
+		skipVerify[serverName] = true
+	}
+	return &federationTransport{
+		wellKnown:           newWellKnownResolver(tlsConfig),
+		dns:                 newDNSResolver(cfg.Federation.DNSCacheTTL),
+		tlsConfig:           tlsConfig,
+		maxIdleConnsPerHost: cfg.Federation.MaxIdleConnsPerHost,
+		idleConnTimeout:     cfg.Federation.IdleConnTimeout,
+		skipVerify:          skipVerify,
+		transports:          map[gomatrixserverlib.ServerName]*http.Transport{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *federationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(req.URL.Host)
+	destination := t.wellKnown.resolve(serverName)
+	addrs, err := t.dns.resolve(destination)
+	if err != nil {
+		return nil, err
+	}
+	transport := t.transportFor(serverName, destination)
+	for _, addr := range addrs {
+		u := *req.URL
+		u.Scheme = "https"
+		u.Host = addr
+		r := *req
+		r.URL = &u
+		// The Host header is the name of the server we are connecting to,
+		// which is the delegated one if there is a .well-known file.
+		r.Host = string(destination)
+		resp, err := transport.RoundTrip(&r)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+}
+
+// transportFor returns the transport for requests to the server, which are
+// sent to the destination it delegates to.
+func (t *federationTransport) transportFor(
+	serverName, destination gomatrixserverlib.ServerName,
+) *http.Transport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if transport, ok := t.transports[destination]; ok {
+		return transport
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	// The certificate must be valid for the host name of the destination,
+	// which is also sent as the SNI.
+	tlsConfig.ServerName = hostOf(destination)
+	if t.skipVerify[serverName] || t.skipVerify[destination] {
+		log.WithFields(log.Fields{
+			"server_name": serverName,
+			"destination": destination,
+		}).Warn("Not verifying the TLS certificate of server")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := dialer.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newCountedConn(conn, destination), nil
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: t.maxIdleConnsPerHost,
+		IdleConnTimeout:     t.idleConnTimeout,
+	}
+	t.transports[destination] = transport
+	return transport
+}
+
+// hostOf returns the host of the server name, without its port.
+func hostOf(serverName gomatrixserverlib.ServerName) string {
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestTransportForVerifiesDestination(t *testing.T) {
+	var cfg config.Dendrite
+	cfg.Federation.TLSSkipVerifyServers = []gomatrixserverlib.ServerName{"dev.example.org"}
+	ft := newFederationTransport(&cfg)
+
+	transport := ft.transportFor("example.org", "matrix.example.org:443")
+	if got := transport.TLSClientConfig.ServerName; got != "matrix.example.org" {
+		t.Errorf("wanted the TLS server name matrix.example.org, got %q", got)
+	}
+	if transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("wanted the certificate of matrix.example.org to be verified")
+	}
+	if ft.transportFor("example.org", "matrix.example.org:443") != transport {
+		t.Errorf("wanted the transport to be reused for the same destination")
+	}
+
+	transport = ft.transportFor("dev.example.org", "dev.example.org")
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("wanted the certificate of dev.example.org not to be verified")
+	}
+}
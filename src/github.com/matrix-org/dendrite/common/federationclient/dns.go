@@ -0,0 +1,70 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// A dnsResolver looks up the addresses of servers in DNS, and caches them.
+type dnsResolver struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	cache map[gomatrixserverlib.ServerName]dnsEntry
+	// Replaced in tests.
+	lookup func(gomatrixserverlib.ServerName) (*gomatrixserverlib.DNSResult, error)
+}
+
+func newDNSResolver(ttl time.Duration) *dnsResolver {
+	return &dnsResolver{
+		ttl:    ttl,
+		cache:  map[gomatrixserverlib.ServerName]dnsEntry{},
+		lookup: gomatrixserverlib.LookupServer,
+	}
+}
+
+// resolve returns the "<ip>:<port>" addresses the server listens on. They are
+// found with the _matrix._tcp SRV records of the server if its name doesn't
+// have an explicit port, falling back to port 8448 if it doesn't have any.
+// Returns an error if the server can't be looked up in DNS.
+func (r *dnsResolver) resolve(serverName gomatrixserverlib.ServerName) ([]string, error) {
+	now := time.Now()
+	r.mutex.Lock()
+	entry, ok := r.cache[serverName]
+	r.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	result, err := r.lookup(serverName)
+	if err != nil {
+		return nil, err
+	}
+	// Failed lookups aren't cached, since they are probably temporary.
+	if len(result.Addrs) > 0 {
+		r.mutex.Lock()
+		r.cache[serverName] = dnsEntry{addrs: result.Addrs, expires: now.Add(r.ttl)}
+		r.mutex.Unlock()
+	}
+	return result.Addrs, nil
+}
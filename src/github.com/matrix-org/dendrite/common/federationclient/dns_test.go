@@ -0,0 +1,62 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestDNSResolverCaches(t *testing.T) {
+	lookups := 0
+	addrs := []string{"1.2.3.4:8448"}
+	r := newDNSResolver(time.Minute)
+	r.lookup = func(serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.DNSResult, error) {
+		lookups++
+		return &gomatrixserverlib.DNSResult{Addrs: addrs}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := r.resolve("example.org")
+		if err != nil {
+			t.Fatalf("resolve(example.org): %s", err)
+		}
+		if len(got) != 1 || got[0] != "1.2.3.4:8448" {
+			t.Errorf("resolve(example.org): wanted [1.2.3.4:8448], got %v", got)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("wanted 1 lookup, got %d", lookups)
+	}
+
+	// Expired entries are looked up again.
+	r.cache["example.org"] = dnsEntry{addrs: addrs, expires: time.Now().Add(-time.Second)}
+	if _, err := r.resolve("example.org"); err != nil {
+		t.Fatalf("resolve(example.org): %s", err)
+	}
+	if lookups != 2 {
+		t.Errorf("wanted 2 lookups after the entry expired, got %d", lookups)
+	}
+
+	// Servers without addresses aren't cached.
+	addrs = nil
+	r.resolve("other.org") // nolint: errcheck
+	r.resolve("other.org") // nolint: errcheck
+	if lookups != 4 {
+		t.Errorf("wanted 4 lookups, got %d", lookups)
+	}
+}
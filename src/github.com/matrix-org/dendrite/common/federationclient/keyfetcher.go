@@ -0,0 +1,61 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A DirectKeyFetcher fetches the keys of servers directly from them, using
+// the federation client so that the servers are looked up the same way as for
+// other federation requests.
+type DirectKeyFetcher struct {
+	Client *Client
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (d *DirectKeyFetcher) FetchKeys(
+	requests map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys, error) {
+	byServer := map[gomatrixserverlib.ServerName]map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{}
+	for req, ts := range requests {
+		server := byServer[req.ServerName]
+		if server == nil {
+			server = map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{}
+			byServer[req.ServerName] = server
+		}
+		server[req] = ts
+	}
+
+	results := map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys{}
+	for server, reqs := range byServer {
+		serverResults, err := d.Client.LookupServerKeys(server, reqs)
+		if err != nil {
+			return nil, err
+		}
+		for req, keys := range serverResults {
+			// Check that the keys are valid for the server.
+			checks, _, _ := gomatrixserverlib.CheckKeys(req.ServerName, time.Unix(0, 0), keys, nil)
+			if !checks.AllChecksOK {
+				return nil, fmt.Errorf("federationclient: key response direct from %q failed checks", server)
+			}
+			results[req] = keys
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"net"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var openConnections = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationclient",
+		Name:      "open_connections",
+		Help:      "The number of connections open to each destination server, whether active or idle",
+	},
+	[]string{"destination"},
+)
+
+func init() {
+	prometheus.MustRegister(openConnections)
+}
+
+// A countedConn is a connection counted in the openConnections metric until
+// it is closed.
+type countedConn struct {
+	net.Conn
+	gauge     prometheus.Gauge
+	closeOnce sync.Once
+}
+
+func newCountedConn(conn net.Conn, destination gomatrixserverlib.ServerName) *countedConn {
+	gauge := openConnections.WithLabelValues(string(destination))
+	gauge.Inc()
+	return &countedConn{Conn: conn, gauge: gauge}
+}
+
+// Close implements net.Conn
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(c.gauge.Dec)
+	return c.Conn.Close()
+}
@@ -0,0 +1,428 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A Client makes requests to the federation APIs of other matrix servers,
+// adding "Authorization: X-Matrix" headers signed with the key of the server
+// to the requests that need them.
+type Client struct {
+	serverName gomatrixserverlib.ServerName
+	keyID      gomatrixserverlib.KeyID
+	privateKey ed25519.PrivateKey
+	client     http.Client
+}
+
+// NewClient makes a new Client which signs its requests with the given key
+// and sends them with the given transport. The transport is responsible for
+// finding the address of the destination server from the host of the request
+// URL, which is the server name.
+func NewClient(
+	serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID,
+	privateKey ed25519.PrivateKey, transport http.RoundTripper,
+) *Client {
+	return &Client{
+		serverName: serverName,
+		keyID:      keyID,
+		privateKey: privateKey,
+		client:     http.Client{Transport: transport},
+	}
+}
+
+func (ac *Client) doRequest(r gomatrixserverlib.FederationRequest, resBody interface{}) error {
+	if err := r.Sign(ac.serverName, ac.keyID, ac.privateKey); err != nil {
+		return err
+	}
+
+	req, err := r.HTTPRequest()
+	if err != nil {
+		return err
+	}
+
+	res, err := ac.client.Do(req)
+	if res != nil {
+		defer res.Body.Close() // nolint: errcheck
+	}
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 { // not 2xx
+		return httpError(res.StatusCode, "Failed to "+r.Method()+" JSON to "+r.RequestURI(), contents)
+	}
+	return json.Unmarshal(contents, resBody)
+}
+
+// httpError wraps the body of a failed response in a gomatrix.HTTPError,
+// using the matrix error in the body if there is one.
+func httpError(code int, msg string, contents []byte) error {
+	var wrap error
+	var respErr gomatrix.RespError
+	if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
+		wrap = respErr
+	}
+	// If we failed to decode as RespError, don't just drop the HTTP body,
+	// include it in the HTTP error instead (e.g proxy errors which return HTML).
+	if wrap == nil {
+		msg = msg + ": " + string(contents)
+	}
+	return gomatrix.HTTPError{
+		Code:         code,
+		Message:      msg,
+		WrappedError: wrap,
+	}
+}
+
+// SendTransaction sends a transaction
+// https://matrix.org/docs/spec/server_server/unstable.html#put-matrix-federation-v1-send-txnid
+func (ac *Client) SendTransaction(t Transaction) (res gomatrixserverlib.RespSend, err error) {
+	path := "/_matrix/federation/v1/send/" + string(t.TransactionID) + "/"
+	req := gomatrixserverlib.NewFederationRequest("PUT", t.Destination, path)
+	if err = req.SetContent(t); err != nil {
+		return
+	}
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// MakeJoin makes a join m.room.member event for a room on a remote matrix
+// server, with the "prev_events" filled out by the remote server. This is used
+// to join a room the local server isn't a member of. The remote server is told
+// which room versions the local server supports.
+// See https://matrix.org/docs/spec/server_server/unstable.html#joining-rooms
+func (ac *Client) MakeJoin(
+	s gomatrixserverlib.ServerName, roomID, userID string,
+) (res RespMakeJoin, err error) {
+	var versions []string
+	for version := range config.SupportedRoomVersions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	query := url.Values{"ver": versions}
+	path := "/_matrix/federation/v1/make_join/" +
+		url.PathEscape(roomID) + "/" +
+		url.PathEscape(userID) +
+		"?" + query.Encode()
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	if err = ac.doRequest(req, &res); err != nil {
+		return
+	}
+	if res.RoomVersion == "" {
+		res.RoomVersion = "1"
+	}
+	return
+}
+
+// SendJoin sends a join m.room.member event obtained using MakeJoin via a
+// remote matrix server. The events of the response are in the format of the
+// given room version.
+// See https://matrix.org/docs/spec/server_server/unstable.html#joining-rooms
+func (ac *Client) SendJoin(
+	s gomatrixserverlib.ServerName, event gomatrixserverlib.Event, roomVersion string,
+) (res gomatrixserverlib.RespSendJoin, err error) {
+	path := "/_matrix/federation/v1/send_join/" +
+		url.PathEscape(event.RoomID()) + "/" +
+		url.PathEscape(event.EventID())
+	req := gomatrixserverlib.NewFederationRequest("PUT", s, path)
+	eventJSON, err := common.FederationEventJSON(event)
+	if err != nil {
+		return
+	}
+	if err = req.SetContent(eventJSON); err != nil {
+		return
+	}
+	// The state is the second element of a list whose first element is 200.
+	var tuple []json.RawMessage
+	if err = ac.doRequest(req, &tuple); err != nil {
+		return
+	}
+	if len(tuple) != 2 {
+		err = fmt.Errorf("invalid send join response, invalid length: %d != 2", len(tuple))
+		return
+	}
+	var fields respStateFields
+	if err = json.Unmarshal(tuple[1], &fields); err != nil {
+		return
+	}
+	state, err := fields.respState(roomVersion)
+	res = gomatrixserverlib.RespSendJoin(state)
+	return
+}
+
+// LookupState retrieves the room state for a room at an event from a
+// remote matrix server as full matrix events, in the format of the given room
+// version.
+func (ac *Client) LookupState(
+	s gomatrixserverlib.ServerName, roomID, eventID, roomVersion string,
+) (res gomatrixserverlib.RespState, err error) {
+	path := "/_matrix/federation/v1/state/" +
+		url.PathEscape(roomID) +
+		"/?event_id=" +
+		url.QueryEscape(eventID)
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	var fields struct {
+		StateEvents []json.RawMessage `json:"pdus"`
+		AuthEvents  []json.RawMessage `json:"auth_chain"`
+	}
+	if err = ac.doRequest(req, &fields); err != nil {
+		return
+	}
+	return respStateFields{fields.StateEvents, fields.AuthEvents}.respState(roomVersion)
+}
+
+// LookupStateIDs retrieves the room state for a room at an event from a
+// remote matrix server as lists of matrix event IDs.
+func (ac *Client) LookupStateIDs(
+	s gomatrixserverlib.ServerName, roomID, eventID string,
+) (res gomatrixserverlib.RespStateIDs, err error) {
+	path := "/_matrix/federation/v1/state_ids/" +
+		url.PathEscape(roomID) +
+		"/?event_id=" +
+		url.QueryEscape(eventID)
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// GetEvent retrieves a single event from a remote matrix server, which is
+// returned as the only PDU of a transaction. The event is in the format of the
+// given room version.
+// https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-event-eventid
+func (ac *Client) GetEvent(
+	s gomatrixserverlib.ServerName, eventID, roomVersion string,
+) (res gomatrixserverlib.Transaction, err error) {
+	path := "/_matrix/federation/v1/event/" + url.PathEscape(eventID)
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doTransactionRequest(req, roomVersion, &res)
+	return
+}
+
+// Backfill asks a remote matrix server for at most limit events of a room
+// that come before the given events, which are included in the response. The
+// events are in the format of the given room version.
+// https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-backfill-roomid
+func (ac *Client) Backfill(
+	s gomatrixserverlib.ServerName, roomID string, limit int, eventIDs []string, roomVersion string,
+) (res gomatrixserverlib.Transaction, err error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	for _, eventID := range eventIDs {
+		query.Add("v", eventID)
+	}
+	path := "/_matrix/federation/v1/backfill/" +
+		url.PathEscape(roomID) +
+		"/?" + query.Encode()
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doTransactionRequest(req, roomVersion, &res)
+	return
+}
+
+// doTransactionRequest sends a request whose response is a transaction, whose
+// PDUs are in the format of the given room version.
+func (ac *Client) doTransactionRequest(
+	r gomatrixserverlib.FederationRequest, roomVersion string, res *gomatrixserverlib.Transaction,
+) error {
+	var txn struct {
+		gomatrixserverlib.Transaction
+		PDUs []json.RawMessage `json:"pdus"`
+	}
+	if err := ac.doRequest(r, &txn); err != nil {
+		return err
+	}
+	*res = txn.Transaction
+	var err error
+	res.PDUs, err = common.NewEventsFromFederationJSON(txn.PDUs, roomVersion)
+	return err
+}
+
+// respState loads the events of a response to /state or /send_join in the
+// format of the given room version.
+func (fields respStateFields) respState(roomVersion string) (res gomatrixserverlib.RespState, err error) {
+	if res.StateEvents, err = common.NewEventsFromFederationJSON(fields.StateEvents, roomVersion); err != nil {
+		return
+	}
+	res.AuthEvents, err = common.NewEventsFromFederationJSON(fields.AuthEvents, roomVersion)
+	return
+}
+
+// LookupRoomAlias looks up a room alias hosted on the remote server.
+// The domain part of the roomAlias must match the name of the server it is
+// being looked up on.
+// If the room alias doesn't exist on the remote server then a 404
+// gomatrix.HTTPError is returned.
+func (ac *Client) LookupRoomAlias(
+	s gomatrixserverlib.ServerName, roomAlias string,
+) (res gomatrixserverlib.RespDirectory, err error) {
+	path := "/_matrix/federation/v1/query/directory?room_alias=" +
+		url.QueryEscape(roomAlias)
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// LookupProfile queries the profile of a user.
+// If field is empty, the server returns the full profile of the user.
+// Otherwise, it must be one of: ["displayname", "avatar_url"], indicating
+// which field of the profile should be returned.
+// Spec: https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-query-profile
+func (ac *Client) LookupProfile(
+	s gomatrixserverlib.ServerName, userID string, field string,
+) (res RespProfile, err error) {
+	path := "/_matrix/federation/v1/query/profile?user_id=" +
+		url.QueryEscape(userID)
+	if field != "" {
+		path += "&field=" + url.QueryEscape(field)
+	}
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// GetPublicRooms gets a page of the public room directory of a remote matrix
+// server. If limit is 0, the server decides how many rooms to return. since is
+// the next_batch or prev_batch token of a previous page, or empty for the
+// first page.
+// Spec: https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-publicrooms
+func (ac *Client) GetPublicRooms(
+	s gomatrixserverlib.ServerName, limit int, since string,
+) (res RespPublicRooms, err error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	path := "/_matrix/federation/v1/publicRooms?" + query.Encode()
+	req := gomatrixserverlib.NewFederationRequest("GET", s, path)
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// QueryKeys asks a remote matrix server for the identity keys of the devices
+// of its users. The request maps user IDs to the IDs of the devices to query,
+// where an empty list means all the devices of the user.
+// Spec: https://matrix.org/docs/spec/server_server/unstable.html#post-matrix-federation-v1-user-keys-query
+func (ac *Client) QueryKeys(
+	s gomatrixserverlib.ServerName, deviceKeys map[string][]string,
+) (res RespQueryKeys, err error) {
+	path := "/_matrix/federation/v1/user/keys/query"
+	req := gomatrixserverlib.NewFederationRequest("POST", s, path)
+	if err = req.SetContent(map[string]interface{}{"device_keys": deviceKeys}); err != nil {
+		return
+	}
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// ClaimKeys claims one-time keys of the devices of the users of a remote
+// matrix server. The request maps user IDs to device IDs to the algorithm of
+// the key to claim.
+// Spec: https://matrix.org/docs/spec/server_server/unstable.html#post-matrix-federation-v1-user-keys-claim
+func (ac *Client) ClaimKeys(
+	s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string,
+) (res RespClaimKeys, err error) {
+	path := "/_matrix/federation/v1/user/keys/claim"
+	req := gomatrixserverlib.NewFederationRequest("POST", s, path)
+	if err = req.SetContent(map[string]interface{}{"one_time_keys": oneTimeKeys}); err != nil {
+		return
+	}
+	err = ac.doRequest(req, &res)
+	return
+}
+
+// LookupServerKeys looks up the keys of matrix servers from a matrix server.
+// Spec: https://matrix.org/docs/spec/server_server/unstable.html#post-key-v2-query
+func (ac *Client) LookupServerKeys(
+	s gomatrixserverlib.ServerName,
+	keyRequests map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys, error) {
+	// The request format is:
+	// { "server_keys": { "<server_name>": { "<key_id>": { "minimum_valid_until_ts": <ts> }}}
+	type keyreq struct {
+		MinimumValidUntilTS gomatrixserverlib.Timestamp `json:"minimum_valid_until_ts"`
+	}
+	request := struct {
+		ServerKeyMap map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]keyreq `json:"server_keys"`
+	}{map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]keyreq{}}
+	for k, ts := range keyRequests {
+		server := request.ServerKeyMap[k.ServerName]
+		if server == nil {
+			server = map[gomatrixserverlib.KeyID]keyreq{}
+			request.ServerKeyMap[k.ServerName] = server
+		}
+		server[k.KeyID] = keyreq{ts}
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{Scheme: "matrix", Host: string(s), Path: "/_matrix/key/v2/query"}
+	res, err := ac.client.Post(u.String(), "application/json", bytes.NewBuffer(requestBytes))
+	if res != nil {
+		defer res.Body.Close() // nolint: errcheck
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, httpError(res.StatusCode, "Failed to POST JSON to "+u.Path, contents)
+	}
+
+	var body struct {
+		ServerKeyList []gomatrixserverlib.ServerKeys `json:"server_keys"`
+	}
+	if err = json.Unmarshal(contents, &body); err != nil {
+		return nil, err
+	}
+	results := map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys{}
+	for _, keys := range body.ServerKeyList {
+		keys.FromServer = s
+		// TODO: What happens if the same key ID appears in multiple responses?
+		// We should probably take the response with the highest valid_until_ts.
+		for keyID := range keys.VerifyKeys {
+			results[gomatrixserverlib.PublicKeyRequest{ServerName: keys.ServerName, KeyID: keyID}] = keys
+		}
+		for keyID := range keys.OldVerifyKeys {
+			results[gomatrixserverlib.PublicKeyRequest{ServerName: keys.ServerName, KeyID: keyID}] = keys
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A testTransport sends the requests for every server to a test server.
+type testTransport struct {
+	server *httptest.Server
+}
+
+func (t testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	r := *req
+	r.URL = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	return http.DefaultTransport.RoundTrip(&r)
+}
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, func()) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	client := NewClient("localhost", "ed25519:test", privateKey, testTransport{server})
+	return client, server.Close
+}
+
+func TestSendTransactionIncludesEDUs(t *testing.T) {
+	var got map[string]json.RawMessage
+	client, closeServer := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || req.URL.Path != "/_matrix/federation/v1/send/txn1/" {
+			t.Errorf("wanted PUT /_matrix/federation/v1/send/txn1/, got %s %s", req.Method, req.URL.Path)
+		}
+		if req.Header.Get("Authorization") == "" {
+			t.Errorf("wanted the request to be signed")
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("failed to decode the transaction: %s", err)
+		}
+		w.Write([]byte("{}")) // nolint: errcheck
+	})
+	defer closeServer()
+
+	var txn Transaction
+	txn.TransactionID = "txn1"
+	txn.Origin = "localhost"
+	txn.Destination = "remote.example.org"
+	txn.PDUs = []gomatrixserverlib.Event{}
+	txn.EDUs = []EDU{{Type: "m.typing", Origin: "localhost", Content: json.RawMessage(`{"typing":true}`)}}
+	if _, err := client.SendTransaction(txn); err != nil {
+		t.Fatal(err)
+	}
+
+	var edus []EDU
+	if err := json.Unmarshal(got["edus"], &edus); err != nil {
+		t.Fatalf("failed to decode the EDUs: %s", err)
+	}
+	if len(edus) != 1 || edus[0].Type != "m.typing" || string(edus[0].Content) != `{"typing":true}` {
+		t.Errorf("wanted the m.typing EDU to be sent, got %+v", edus)
+	}
+	if _, ok := got["pdus"]; !ok {
+		t.Errorf("wanted the transaction to have PDUs")
+	}
+}
+
+func TestRequestErrorWrapsMatrixError(t *testing.T) {
+	client, closeServer := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Unknown user"}`)) // nolint: errcheck
+	})
+	defer closeServer()
+
+	_, err := client.LookupProfile("remote.example.org", "@alice:remote.example.org", "")
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok {
+		t.Fatalf("wanted a gomatrix.HTTPError, got %#v", err)
+	}
+	if httpErr.Code != http.StatusNotFound {
+		t.Errorf("wanted the status code 404, got %d", httpErr.Code)
+	}
+	if respErr, ok := httpErr.WrappedError.(gomatrix.RespError); !ok || respErr.ErrCode != "M_NOT_FOUND" {
+		t.Errorf("wanted the M_NOT_FOUND error to be wrapped, got %#v", httpErr.WrappedError)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EDU is an ephemeral data unit sent from one matrix server to another,
+// e.g. a typing notification or a read receipt. Unlike PDUs, EDUs aren't
+// persisted in the room's history.
+type EDU struct {
+	// The type of the EDU, e.g. "m.receipt".
+	Type string `json:"edu_type"`
+	// The server that sent the EDU.
+	Origin string `json:"origin"`
+	// The server that should receive the EDU.
+	Destination string `json:"destination"`
+	// The content of the EDU, whose format depends on its type.
+	Content json.RawMessage `json:"content"`
+}
+
+// A Transaction is a transaction sent from one matrix server to another,
+// which carries EDUs as well as the PDUs of a gomatrixserverlib.Transaction.
+type Transaction struct {
+	gomatrixserverlib.Transaction
+	// The ephemeral data pushed from the origin server to the destination
+	// server by this transaction.
+	EDUs []EDU `json:"edus,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaller, sending the PDUs in the format of
+// the rooms they are in.
+func (t Transaction) MarshalJSON() ([]byte, error) {
+	pdus, err := common.FederationEventsJSON(t.PDUs)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		gomatrixserverlib.Transaction
+		PDUs []json.RawMessage `json:"pdus"`
+		EDUs []EDU             `json:"edus,omitempty"`
+	}{t.Transaction, pdus, t.EDUs})
+}
+
+// RespMakeJoin is the content of a response to GET /_matrix/federation/v1/make_join/{roomID}/{userID}
+type RespMakeJoin struct {
+	// An incomplete m.room.member event for a user on the requesting server
+	// generated by the responding server.
+	JoinEvent gomatrixserverlib.EventBuilder `json:"event"`
+	// The version of the room, which is "1" if the responding server doesn't
+	// say.
+	RoomVersion string `json:"room_version"`
+}
+
+// RespState is a gomatrixserverlib.RespState whose events are sent in the
+// format of the room they are in.
+type RespState gomatrixserverlib.RespState
+
+// MarshalJSON implements json.Marshaller
+func (r RespState) MarshalJSON() ([]byte, error) {
+	fields, err := newRespStateFields(gomatrixserverlib.RespState(r))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		StateEvents []json.RawMessage `json:"pdus"`
+		AuthEvents  []json.RawMessage `json:"auth_chain"`
+	}{fields.StateEvents, fields.AuthEvents})
+}
+
+// RespSendJoin is a gomatrixserverlib.RespSendJoin whose events are sent in
+// the format of the room they are in.
+type RespSendJoin gomatrixserverlib.RespState
+
+// MarshalJSON implements json.Marshaller
+func (r RespSendJoin) MarshalJSON() ([]byte, error) {
+	fields, err := newRespStateFields(gomatrixserverlib.RespState(r))
+	if err != nil {
+		return nil, err
+	}
+	// The response is the state of a response to /state, but with "pdus"
+	// renamed to "state", as the second element of a list whose first element
+	// is 200.
+	return json.Marshal([]interface{}{200, fields})
+}
+
+// respStateFields are the events of a RespState or RespSendJoin as they are
+// sent over federation.
+type respStateFields struct {
+	StateEvents []json.RawMessage `json:"state"`
+	AuthEvents  []json.RawMessage `json:"auth_chain"`
+}
+
+func newRespStateFields(r gomatrixserverlib.RespState) (fields respStateFields, err error) {
+	if fields.StateEvents, err = common.FederationEventsJSON(r.StateEvents); err != nil {
+		return
+	}
+	fields.AuthEvents, err = common.FederationEventsJSON(r.AuthEvents)
+	return
+}
+
+// PublicRoom is a room listed in the public room directory of a server.
+type PublicRoom struct {
+	RoomID           string   `json:"room_id"`
+	Aliases          []string `json:"aliases,omitempty"`
+	CanonicalAlias   string   `json:"canonical_alias,omitempty"`
+	Name             string   `json:"name,omitempty"`
+	Topic            string   `json:"topic,omitempty"`
+	AvatarURL        string   `json:"avatar_url,omitempty"`
+	NumJoinedMembers int64    `json:"num_joined_members"`
+	WorldReadable    bool     `json:"world_readable"`
+	GuestCanJoin     bool     `json:"guest_can_join"`
+}
+
+// RespPublicRooms is the content of a response to GET /_matrix/federation/v1/publicRooms
+type RespPublicRooms struct {
+	// A page of the rooms in the public room directory of the server.
+	Chunk []PublicRoom `json:"chunk"`
+	// Tokens to get the next and previous pages, if any.
+	NextBatch string `json:"next_batch,omitempty"`
+	PrevBatch string `json:"prev_batch,omitempty"`
+	// An estimate of the number of rooms in the directory.
+	TotalRoomCountEstimate int64 `json:"total_room_count_estimate,omitempty"`
+}
+
+// RespProfile is the content of a response to GET /_matrix/federation/v1/query/profile
+type RespProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// RespUserDevices is the content of a response to GET /_matrix/federation/v1/user/devices/{userID}
+type RespUserDevices struct {
+	UserID string `json:"user_id"`
+	// The stream ID of the last m.device_list_update EDU sent for the user.
+	StreamID int64            `json:"stream_id"`
+	Devices  []RespUserDevice `json:"devices"`
+	// The cross-signing keys of the user.
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+}
+
+// RespUserDevice is a device in a RespUserDevices.
+type RespUserDevice struct {
+	DeviceID string `json:"device_id"`
+	// The signed identity keys of the device, if it uploaded them.
+	Keys        json.RawMessage `json:"keys,omitempty"`
+	DisplayName string          `json:"device_display_name,omitempty"`
+}
+
+// RespQueryKeys is the content of a response to POST /_matrix/federation/v1/user/keys/query
+type RespQueryKeys struct {
+	// The signed identity keys of the devices, by user ID and device ID.
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+	// The cross-signing master keys of the users, by user ID.
+	MasterKeys map[string]json.RawMessage `json:"master_keys,omitempty"`
+	// The cross-signing self-signing keys of the users, by user ID.
+	SelfSigningKeys map[string]json.RawMessage `json:"self_signing_keys,omitempty"`
+}
+
+// RespClaimKeys is the content of a response to POST /_matrix/federation/v1/user/keys/claim
+type RespClaimKeys struct {
+	// The claimed one-time keys, by user ID, device ID and "<algorithm>:<key_id>".
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	// How long .well-known files are cached for when the response doesn't
+	// have a max-age.
+	defaultWellKnownTTL = 24 * time.Hour
+	// The maximum time .well-known files are cached for, so that a server
+	// can't make us ignore changes to its delegation for too long.
+	maxWellKnownTTL = 48 * time.Hour
+	// How long we wait before looking up the .well-known file of a server
+	// again after failing to.
+	failedWellKnownTTL = time.Hour
+	// The maximum size of a .well-known file we read.
+	maxWellKnownSize = 50 * 1024
+)
+
+// wellKnownResponse is the content of /.well-known/matrix/server
+type wellKnownResponse struct {
+	Server gomatrixserverlib.ServerName `json:"m.server"`
+}
+
+type wellKnownEntry struct {
+	server  gomatrixserverlib.ServerName
+	expires time.Time
+}
+
+// A wellKnownResolver follows the .well-known delegation of servers, and
+// caches the results.
+type wellKnownResolver struct {
+	client *http.Client
+	mutex  sync.Mutex
+	cache  map[gomatrixserverlib.ServerName]wellKnownEntry
+}
+
+func newWellKnownResolver(tlsConfig *tls.Config) *wellKnownResolver {
+	return &wellKnownResolver{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		cache: map[gomatrixserverlib.ServerName]wellKnownEntry{},
+	}
+}
+
+// resolve returns the server name the server delegates federation to in its
+// .well-known file, or the server name itself if it doesn't have one.
+// Server names with a port or which are IP literals are never delegated.
+func (r *wellKnownResolver) resolve(serverName gomatrixserverlib.ServerName) gomatrixserverlib.ServerName {
+	if !canDelegate(serverName) {
+		return serverName
+	}
+
+	now := time.Now()
+	r.mutex.Lock()
+	entry, ok := r.cache[serverName]
+	r.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.server
+	}
+
+	server, ttl := r.lookup(serverName)
+	r.mutex.Lock()
+	r.cache[serverName] = wellKnownEntry{server: server, expires: now.Add(ttl)}
+	r.mutex.Unlock()
+	return server
+}
+
+// lookup fetches the .well-known file of the server, and returns the server
+// it delegates to along with how long the result can be cached for.
+func (r *wellKnownResolver) lookup(serverName gomatrixserverlib.ServerName) (gomatrixserverlib.ServerName, time.Duration) {
+	logger := log.WithField("server_name", serverName)
+	resp, err := r.client.Get("https://" + string(serverName) + "/.well-known/matrix/server")
+	if err != nil {
+		logger.WithError(err).Debug("Failed to fetch .well-known file")
+		return serverName, failedWellKnownTTL
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return serverName, failedWellKnownTTL
+	}
+	var content wellKnownResponse
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxWellKnownSize)).Decode(&content); err != nil {
+		logger.WithError(err).Debug("Invalid .well-known file")
+		return serverName, failedWellKnownTTL
+	}
+	if content.Server == "" {
+		return serverName, failedWellKnownTTL
+	}
+	return content.Server, cacheTTL(resp.Header.Get("Cache-Control"))
+}
+
+// canDelegate returns whether the server can delegate federation to another
+// server with a .well-known file, which isn't the case for server names with
+// an explicit port or which are IP literals.
+func canDelegate(serverName gomatrixserverlib.ServerName) bool {
+	if _, _, err := net.SplitHostPort(string(serverName)); err == nil {
+		return false
+	}
+	return net.ParseIP(hostOf(serverName)) == nil
+}
+
+// cacheTTL returns how long a response can be cached for according to the
+// max-age of its Cache-Control header, capped to maxWellKnownTTL.
+func cacheTTL(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			break
+		}
+		if ttl := time.Duration(seconds) * time.Second; ttl < maxWellKnownTTL {
+			return ttl
+		}
+		return maxWellKnownTTL
+	}
+	return defaultWellKnownTTL
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestCanDelegate(t *testing.T) {
+	tests := []struct {
+		serverName gomatrixserverlib.ServerName
+		delegate   bool
+	}{
+		{"example.org", true},
+		{"example.org:8448", false},
+		{"1.2.3.4", false},
+		{"1.2.3.4:8448", false},
+		{"[::1]", false},
+		{"[::1]:8448", false},
+	}
+	for _, test := range tests {
+		if got := canDelegate(test.serverName); got != test.delegate {
+			t.Errorf("canDelegate(%q): wanted %v, got %v", test.serverName, test.delegate, got)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		ttl          time.Duration
+	}{
+		{"", defaultWellKnownTTL},
+		{"max-age=3600", time.Hour},
+		{"public, Max-Age=60", time.Minute},
+		{"max-age=999999999", maxWellKnownTTL},
+		{"max-age=nope", defaultWellKnownTTL},
+		{"no-cache", defaultWellKnownTTL},
+	}
+	for _, test := range tests {
+		if got := cacheTTL(test.cacheControl); got != test.ttl {
+			t.Errorf("cacheTTL(%q): wanted %v, got %v", test.cacheControl, test.ttl, got)
+		}
+	}
+}
+
+func TestWellKnownResolve(t *testing.T) {
+	requests := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Host != "example.org" || req.URL.Path != "/.well-known/matrix/server" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(`{"m.server": "matrix.example.org:443"}`)) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	r := newWellKnownResolver(&tls.Config{})
+	// Send the requests for every server to the test server.
+	r.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, srv.Listener.Addr().String())
+		},
+	}}
+
+	if got := r.resolve("example.org"); got != "matrix.example.org:443" {
+		t.Errorf("resolve(example.org): wanted matrix.example.org:443, got %q", got)
+	}
+	if got := r.resolve("example.org"); got != "matrix.example.org:443" {
+		t.Errorf("resolve(example.org) from the cache: wanted matrix.example.org:443, got %q", got)
+	}
+	if got := r.resolve("other.org"); got != "other.org" {
+		t.Errorf("resolve(other.org): wanted other.org, got %q", got)
+	}
+	if got := r.resolve("other.org:8448"); got != "other.org:8448" {
+		t.Errorf("resolve(other.org:8448): wanted other.org:8448, got %q", got)
+	}
+	if requests != 2 {
+		t.Errorf("wanted 2 requests to the .well-known file, got %d", requests)
+	}
+}
@@ -1,11 +1,16 @@
 package common
 
 import (
+	"encoding/json"
 	"net/http"
+	"runtime/debug"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -17,15 +22,109 @@ func MakeAuthAPI(metricsName string, deviceDB auth.DeviceDatabase, f func(*http.
 		if resErr != nil {
 			return *resErr
 		}
+		req = RequestWithLogFields(req, logrus.Fields{"user_id": device.UserID})
 		return f(req, device)
 	})
-	return prometheus.InstrumentHandler(metricsName, util.MakeJSONAPI(h))
+	return prometheus.InstrumentHandler(metricsName, MakeJSONAPI(h))
+}
+
+// MakeAuthAdminAPI turns a util.JSONRequestHandler function into an http.Handler which checks
+// the access token in the request, and that it belongs to a server admin. The device passed
+// to f has IsAdmin set.
+func MakeAuthAdminAPI(
+	metricsName string, deviceDB auth.DeviceDatabase, accountDB auth.AccountDatabase,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	h := util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		device, resErr := auth.VerifyAccessToken(req, deviceDB)
+		if resErr != nil {
+			return *resErr
+		}
+		req = RequestWithLogFields(req, logrus.Fields{"user_id": device.UserID})
+		if resErr = auth.VerifyAdmin(device, accountDB); resErr != nil {
+			return *resErr
+		}
+		return f(req, device)
+	})
+	return prometheus.InstrumentHandler(metricsName, MakeJSONAPI(h))
+}
+
+// MakeFedAPI turns a util.JSONRequestHandler function into an http.Handler which
+// checks the "Authorization: X-Matrix ..." header and signature of the request
+// from another matrix server.
+func MakeFedAPI(
+	metricsName string,
+	serverName gomatrixserverlib.ServerName,
+	keyRing gomatrixserverlib.KeyRing,
+	f func(*http.Request, *gomatrixserverlib.FederationRequest) util.JSONResponse,
+) http.Handler {
+	h := util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
+		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(req, time.Now(), serverName, keyRing)
+		if fedReq == nil {
+			return errResp
+		}
+		req = RequestWithLogFields(req, logrus.Fields{"origin": fedReq.Origin()})
+		return f(req, fedReq)
+	})
+	return prometheus.InstrumentHandler(metricsName, MakeJSONAPI(h))
 }
 
 // MakeAPI turns a util.JSONRequestHandler function into an http.Handler.
 func MakeAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
 	h := util.NewJSONRequestHandler(f)
-	return prometheus.InstrumentHandler(metricsName, util.MakeJSONAPI(h))
+	return prometheus.InstrumentHandler(metricsName, MakeJSONAPI(h))
+}
+
+// MakeJSONAPI creates an HTTP handler which always responds to incoming
+// requests with JSON responses. The requests are given a logger logging their
+// request ID, method and path, which can be retrieved using GetLogger.
+// Panics are logged and turned into 500 responses.
+func MakeJSONAPI(handler util.JSONRequestHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		req = RequestWithLogging(req)
+		defer func() {
+			if r := recover(); r != nil {
+				GetLogger(req.Context()).WithField("panic", r).Errorf(
+					"Request panicked!\n%s", debug.Stack(),
+				)
+				respond(w, req, util.MessageResponse(500, "Internal Server Error"))
+			}
+		}()
+
+		if req.Method == "OPTIONS" {
+			util.SetCORSHeaders(w)
+			w.WriteHeader(200)
+			return
+		}
+		res := handler.OnIncomingRequest(req)
+
+		// Set common headers returned regardless of the outcome of the request
+		w.Header().Set("Content-Type", "application/json")
+		util.SetCORSHeaders(w)
+
+		respond(w, req, res)
+	}
+}
+
+func respond(w http.ResponseWriter, req *http.Request, res util.JSONResponse) {
+	logger := GetLogger(req.Context())
+
+	for h, val := range res.Headers {
+		w.Header().Set(h, val)
+	}
+
+	resBytes, err := json.Marshal(res.JSON)
+	if err != nil {
+		logger.WithError(err).Error("Failed to marshal JSONResponse")
+		res = util.MessageResponse(500, "Internal Server Error")
+		resBytes, _ = json.Marshal(res.JSON)
+	}
+
+	w.WriteHeader(res.Code)
+	logger.WithField("code", res.Code).Infof("Responding (%d bytes)", len(resBytes))
+	if _, err = w.Write(resBytes); err != nil {
+		logger.WithError(err).Warn("Failed to write the response")
+	}
 }
 
 // SetupHTTPAPI registers an HTTP API mux under /api and sets up a metrics
@@ -0,0 +1,136 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// An HTTPServer serves HTTP on one or more addresses until the process is told
+// to stop. It then stops accepting new connections and waits for the requests
+// in flight to finish, so that they aren't dropped when the process restarts.
+type HTTPServer struct {
+	drainTimeout time.Duration
+	servers      []*http.Server
+	// The number of requests being handled.
+	inFlight int64
+	// The number of requests which finished since the shutdown started.
+	drained int64
+	// Whether the shutdown has started.
+	shuttingDown int32
+}
+
+// NewHTTPServer creates a new HTTPServer which waits up to the drain timeout
+// for the requests in flight to finish when shutting down.
+func NewHTTPServer(drainTimeout time.Duration) *HTTPServer {
+	return &HTTPServer{drainTimeout: drainTimeout}
+}
+
+// ListenAndServe starts serving the handler on the address in a new goroutine.
+// If the handler is nil then http.DefaultServeMux is used.
+func (s *HTTPServer) ListenAndServe(addr string, handler http.Handler) {
+	srv := s.newServer(addr, handler)
+	go s.serve(addr, srv.ListenAndServe)
+}
+
+// ListenAndServeTLS starts serving the handler on the address using TLS in a
+// new goroutine. If the handler is nil then http.DefaultServeMux is used.
+func (s *HTTPServer) ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) {
+	srv := s.newServer(addr, handler)
+	go s.serve(addr, func() error { return srv.ListenAndServeTLS(certFile, keyFile) })
+}
+
+func (s *HTTPServer) newServer(addr string, handler http.Handler) *http.Server {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv := &http.Server{Addr: addr, Handler: s.countRequests(handler)}
+	s.servers = append(s.servers, srv)
+	return srv
+}
+
+func (s *HTTPServer) serve(addr string, listenAndServe func() error) {
+	logrus.Info("Listening on ", addr)
+	if err := listenAndServe(); err != http.ErrServerClosed {
+		logrus.WithError(err).WithField("address", addr).Fatal("Failed to serve HTTP")
+	}
+}
+
+// countRequests keeps track of the requests in flight and of the ones which
+// finish during the shutdown.
+func (s *HTTPServer) countRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&s.inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&s.inFlight, -1)
+			if atomic.LoadInt32(&s.shuttingDown) == 1 {
+				atomic.AddInt64(&s.drained, 1)
+			}
+		}()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// WaitForShutdown blocks until the process receives a SIGTERM or SIGINT, and
+// then shuts down the servers. Once the requests in flight have finished, or
+// the drain timeout has passed, the cleanup functions are called in order,
+// e.g. to flush the kafka producers.
+func (s *HTTPServer) WaitForShutdown(cleanups ...func() error) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	signal.Stop(stop)
+
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	logrus.WithFields(logrus.Fields{
+		"signal":    sig,
+		"in_flight": atomic.LoadInt64(&s.inFlight),
+		"timeout":   s.drainTimeout,
+	}).Info("Shutting down, waiting for requests in flight to finish")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range s.servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logrus.WithError(err).WithField("address", srv.Addr).Warn("Failed to shut down HTTP server cleanly")
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	logrus.WithFields(logrus.Fields{
+		"drained": atomic.LoadInt64(&s.drained),
+		"dropped": atomic.LoadInt64(&s.inFlight),
+	}).Info("Stopped serving HTTP")
+
+	for _, cleanup := range cleanups {
+		if err := cleanup(); err != nil {
+			logrus.WithError(err).Warn("Failed to clean up while shutting down")
+		}
+	}
+}
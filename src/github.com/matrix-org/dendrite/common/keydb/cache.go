@@ -0,0 +1,68 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A keyCache keeps the server keys in memory so that verifying requests and
+// events doesn't need a database query for every key.
+type keyCache struct {
+	sync.RWMutex
+	keys map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{
+		keys: map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys{},
+	}
+}
+
+// fetch returns the cached keys which are valid at the requested timestamps,
+// along with the requests which must be looked up elsewhere because their keys
+// aren't cached or have expired.
+func (c *keyCache) fetch(
+	requests map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp,
+) (
+	found map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys,
+	missing map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp,
+) {
+	found = map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys{}
+	missing = map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{}
+	c.RLock()
+	defer c.RUnlock()
+	for request, ts := range requests {
+		keys, ok := c.keys[request]
+		if ok && keys.PublicKey(request.KeyID, ts) != nil {
+			found[request] = keys
+		} else {
+			missing[request] = ts
+		}
+	}
+	return found, missing
+}
+
+// store adds the keys to the cache, replacing any older keys for the same
+// server name and key ID.
+func (c *keyCache) store(keys map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys) {
+	c.Lock()
+	defer c.Unlock()
+	for request, serverKeys := range keys {
+		c.keys[request] = serverKeys
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keydb
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestKeyCacheExpiry(t *testing.T) {
+	request := gomatrixserverlib.PublicKeyRequest{
+		ServerName: "remote.example.com", KeyID: "ed25519:auto",
+	}
+	keys := gomatrixserverlib.ServerKeys{}
+	keys.VerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+		request.KeyID: {Key: gomatrixserverlib.Base64String("key")},
+	}
+	keys.ValidUntilTS = 1000
+
+	c := newKeyCache()
+	c.store(map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys{request: keys})
+
+	found, missing := c.fetch(map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{request: 999})
+	if _, ok := found[request]; !ok || len(missing) != 0 {
+		t.Fatalf("want the key to be cached, got found %v missing %v", found, missing)
+	}
+
+	// Once the keys have expired they must be fetched again.
+	found, missing = c.fetch(map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{request: 1001})
+	if ts, ok := missing[request]; !ok || ts != 1001 || len(found) != 0 {
+		t.Fatalf("want the expired key to be missing, got found %v missing %v", found, missing)
+	}
+
+	// Unknown keys must be fetched too.
+	other := gomatrixserverlib.PublicKeyRequest{ServerName: "other.example.com", KeyID: "ed25519:auto"}
+	if _, missing = c.fetch(map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp{other: 1}); len(missing) != 1 {
+		t.Fatalf("want the unknown key to be missing, got missing %v", missing)
+	}
+}
@@ -23,6 +23,7 @@ import (
 // the public keys for other matrix servers.
 type Database struct {
 	statements serverKeyStatements
+	cache      *keyCache
 }
 
 // NewDatabase prepares a new key database.
@@ -34,16 +35,34 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	d := &Database{}
-	d.statements.prepare(db)
+	d := &Database{cache: newKeyCache()}
+	if err = d.statements.prepare(db); err != nil {
+		return nil, err
+	}
 	return d, nil
 }
 
 // FetchKeys implements gomatrixserverlib.KeyDatabase
+// Keys which aren't valid at the requested timestamps are looked up in the
+// database again in case another of the servers sharing it updated them. If
+// they still aren't valid then the gomatrixserverlib.KeyRing fetches them from
+// the remote server and stores the new ones.
 func (d *Database) FetchKeys(
 	requests map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.Timestamp,
 ) (map[gomatrixserverlib.PublicKeyRequest]gomatrixserverlib.ServerKeys, error) {
-	return d.statements.bulkSelectServerKeys(requests)
+	results, missing := d.cache.fetch(requests)
+	if len(missing) == 0 {
+		return results, nil
+	}
+	stored, err := d.statements.bulkSelectServerKeys(missing)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.store(stored)
+	for request, keys := range stored {
+		results[request] = keys
+	}
+	return results, nil
 }
 
 // StoreKeys implements gomatrixserverlib.KeyDatabase
@@ -53,6 +72,7 @@ func (d *Database) StoreKeys(
 	// TODO: Inserting all the keys within a single transaction may
 	// be more efficient since the transaction overhead can be quite
 	// high for a single insert statement.
+	d.cache.store(keyMap)
 	var lastErr error
 	for request, keys := range keyMap {
 		if err := d.statements.upsertServerKeys(request, keys); err != nil {
@@ -15,13 +15,33 @@
 package common
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dugong"
 )
 
+// logLevelEnvVar is the environment variable overriding the log level set in
+// the config file.
+const logLevelEnvVar = "LOG_LEVEL"
+
+// ctxKey namespaces the values stored in request contexts.
+type ctxKey string
+
+const (
+	ctxValueLogger    = ctxKey("logger")
+	ctxValueRequestID = ctxKey("requestid")
+)
+
 type utcFormatter struct {
 	logrus.Formatter
 }
@@ -60,3 +80,104 @@ func SetupLogging(logDir string) {
 		))
 	}
 }
+
+// SetupLogLevel sets the minimum level of the logs to the one given by the
+// LOG_LEVEL environment variable, or to the one in the config if it isn't set.
+// The level is then reloaded from the config file every time the process
+// receives a SIGHUP, so it can be changed without restarting.
+func SetupLogLevel(cfg *config.Dendrite, configPath string) error {
+	level := cfg.Logging.Level
+	if envLevel := os.Getenv(logLevelEnvVar); envLevel != "" {
+		level = envLevel
+	}
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			level, err := config.LoadLogLevel(configPath)
+			if err == nil {
+				err = setLogLevel(level)
+			}
+			if err != nil {
+				logrus.WithError(err).Error("Failed to reload the log level")
+				continue
+			}
+			logrus.WithField("level", logrus.GetLevel()).Info("Reloaded the log level")
+		}
+	}()
+	return nil
+}
+
+// setLogLevel sets the minimum level of the logs, which is "info" if the
+// level is empty.
+func setLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(parsed)
+	return nil
+}
+
+// RequestWithLogging gives the request a new request ID, and a logger which
+// logs it along with the method and path of the request and the room ID in
+// the path if there is one. The logger can be retrieved using GetLogger.
+func RequestWithLogging(req *http.Request) *http.Request {
+	reqID := newRequestID()
+	fields := logrus.Fields{
+		"req.id": reqID,
+		"method": req.Method,
+		"path":   req.URL.Path,
+	}
+	if roomID := mux.Vars(req)["roomID"]; roomID != "" {
+		fields["room_id"] = roomID
+	}
+	ctx := context.WithValue(req.Context(), ctxValueLogger, logrus.WithFields(fields))
+	ctx = context.WithValue(ctx, ctxValueRequestID, reqID)
+	req = req.WithContext(ctx)
+
+	GetLogger(req.Context()).Info("Incoming request")
+
+	return req
+}
+
+// RequestWithLogFields adds fields to the logger of the request, e.g. the ID
+// of the user once they have been authenticated.
+func RequestWithLogFields(req *http.Request, fields logrus.Fields) *http.Request {
+	logger := GetLogger(req.Context()).WithFields(fields)
+	return req.WithContext(context.WithValue(req.Context(), ctxValueLogger, logger))
+}
+
+// GetLogger returns the logger of the request the context belongs to. Always
+// returns a logger, even if the context doesn't have one.
+func GetLogger(ctx context.Context) *logrus.Entry {
+	if logger, ok := ctx.Value(ctxValueLogger).(*logrus.Entry); ok {
+		return logger
+	}
+	return logrus.WithField("context", "missing")
+}
+
+// GetRequestID returns the ID of the request the context belongs to, or an
+// empty string if there is none.
+func GetRequestID(ctx context.Context) string {
+	reqID, _ := ctx.Value(ctxValueRequestID).(string)
+	return reqID
+}
+
+// newRequestID generates a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
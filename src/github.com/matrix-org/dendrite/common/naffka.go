@@ -0,0 +1,49 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"github.com/matrix-org/naffka"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// Naffka wraps a naffka.Naffka so that consuming a partition starts at the
+// offset given, like kafka, rather than after it.
+type Naffka struct {
+	*naffka.Naffka
+}
+
+// ConsumePartition implements sarama.Consumer
+func (n Naffka) ConsumePartition(topic string, partition int32, offset int64) (sarama.PartitionConsumer, error) {
+	highwaterMark := n.HighWaterMarks()[topic][partition]
+	switch {
+	case offset == sarama.OffsetOldest:
+	case offset == 0:
+		offset = sarama.OffsetOldest
+	case offset == sarama.OffsetNewest || offset >= highwaterMark:
+		// Naffka keeps its messages in memory, so the offset a consumer
+		// reached before a restart can be past the end of the partition.
+		// The consumer carries on with the messages sent from now on.
+		if highwaterMark == 0 {
+			// Naffka would treat -1 as sarama.OffsetNewest.
+			offset = sarama.OffsetOldest
+		} else {
+			offset = highwaterMark - 1
+		}
+	default:
+		offset--
+	}
+	return n.Naffka.ConsumePartition(topic, partition, offset)
+}
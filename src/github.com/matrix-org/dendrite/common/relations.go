@@ -0,0 +1,94 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AddRelations looks up the relations of other events to the client events
+// from the roomserver, for the given user, and bundles them in the unsigned
+// m.relations of the events.
+func AddRelations(
+	ctx context.Context, queryAPI api.RoomserverQueryAPI, userID string,
+	events []gomatrixserverlib.ClientEvent, format gomatrixserverlib.EventFormat,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID
+	}
+	queryReq := api.QueryRelationsRequest{EventIDs: eventIDs, UserID: userID}
+	var queryRes api.QueryRelationsResponse
+	if err := queryAPI.QueryRelations(ctx, &queryReq, &queryRes); err != nil {
+		return err
+	}
+	for i := range events {
+		relations, ok := queryRes.Relations[events[i].EventID]
+		if !ok {
+			continue
+		}
+		if err := BundleRelations(&events[i], relations, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BundleRelations sets the unsigned m.relations of the client event to the
+// given relations, keeping the rest of its unsigned data.
+func BundleRelations(
+	event *gomatrixserverlib.ClientEvent, relations api.EventRelations,
+	format gomatrixserverlib.EventFormat,
+) error {
+	bundled := map[string]interface{}{}
+	if relations.Replace != nil {
+		bundled["m.replace"] = gomatrixserverlib.ToClientEvent(*relations.Replace, format)
+	}
+	if relations.Thread != nil {
+		bundled["m.thread"] = map[string]interface{}{
+			"latest_event":              gomatrixserverlib.ToClientEvent(relations.Thread.LatestEvent, format),
+			"count":                     relations.Thread.Count,
+			"current_user_participated": relations.Thread.CurrentUserParticipated,
+		}
+	}
+	if len(relations.Annotations) > 0 {
+		bundled["m.annotation"] = map[string]interface{}{
+			"chunk": relations.Annotations,
+		}
+	}
+	if len(bundled) == 0 {
+		return nil
+	}
+	unsigned := map[string]interface{}{}
+	if len(event.Unsigned) > 0 {
+		if err := json.Unmarshal(event.Unsigned, &unsigned); err != nil {
+			return err
+		}
+	}
+	unsigned["m.relations"] = bundled
+	unsignedJSON, err := json.Marshal(unsigned)
+	if err != nil {
+		return err
+	}
+	event.Unsigned = unsignedJSON
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EventFormat is the format of the events in a room, which is given by the
+// version of the room.
+// See https://matrix.org/docs/spec/rooms/v3#event-format
+type EventFormat int
+
+// The event formats used by the room versions.
+const (
+	// EventFormatV1 events contain their event ID, and refer to other events
+	// by their event ID and reference hash.
+	EventFormatV1 EventFormat = iota + 1
+	// EventFormatV2 events don't contain their event ID, which is their
+	// reference hash encoded with standard base64, and refer to other events
+	// by event ID alone.
+	EventFormatV2
+	// EventFormatV3 events are like EventFormatV2 events, but their event IDs
+	// are encoded with URL-safe base64.
+	EventFormatV3
+)
+
+// RoomVersionEventFormats maps the room versions in the specification to the
+// format of their events, whether this server supports them or not.
+var RoomVersionEventFormats = map[string]EventFormat{
+	"1": EventFormatV1,
+	"2": EventFormatV1,
+	"3": EventFormatV2,
+	"4": EventFormatV3,
+	"5": EventFormatV3,
+	"6": EventFormatV3,
+}
+
+// A StateResolutionVersion is the version of the state resolution algorithm
+// used in a room, which is given by the version of the room.
+type StateResolutionVersion int
+
+// The versions of the state resolution algorithm.
+const (
+	// StateResolutionV1 is the original state resolution algorithm.
+	// See https://matrix.org/docs/spec/rooms/v1#state-resolution
+	StateResolutionV1 StateResolutionVersion = iota + 1
+	// StateResolutionV2 orders the conflicted events by the power levels of
+	// their senders and by their position relative to the power levels of the
+	// room.
+	// See https://matrix.org/docs/spec/rooms/v2#state-resolution
+	StateResolutionV2
+)
+
+// RoomVersionStateResolutions maps the room versions in the specification to
+// the version of the state resolution algorithm they use.
+var RoomVersionStateResolutions = map[string]StateResolutionVersion{
+	"1": StateResolutionV1,
+	"2": StateResolutionV2,
+	"3": StateResolutionV2,
+	"4": StateResolutionV2,
+	"5": StateResolutionV2,
+	"6": StateResolutionV2,
+}
+
+// An UnsupportedRoomVersionError is returned when an event is in a room whose
+// version this server doesn't support.
+type UnsupportedRoomVersionError struct {
+	RoomID      string
+	RoomVersion string
+}
+
+func (e UnsupportedRoomVersionError) Error() string {
+	return fmt.Sprintf("room %q has unsupported room version %q", e.RoomID, e.RoomVersion)
+}
+
+// RoomVersionFromCreateEvent returns the room version given by the content of
+// a "m.room.create" event, which is "1" if the content doesn't have one.
+func RoomVersionFromCreateEvent(event gomatrixserverlib.Event) (string, error) {
+	var content struct {
+		RoomVersion *string `json:"room_version"`
+	}
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return "", err
+	}
+	if content.RoomVersion == nil {
+		return "1", nil
+	}
+	return *content.RoomVersion, nil
+}
+
+// CheckRoomVersion returns an UnsupportedRoomVersionError if this server can't
+// handle the events in a room of the given version.
+func CheckRoomVersion(roomID, roomVersion string) error {
+	if !config.IsSupportedRoomVersion(roomVersion) {
+		return UnsupportedRoomVersionError{roomID, roomVersion}
+	}
+	return nil
+}
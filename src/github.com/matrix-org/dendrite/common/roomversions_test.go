@@ -0,0 +1,42 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRoomVersionFromCreateEvent(t *testing.T) {
+	for content, want := range map[string]string{
+		`{"creator":"@alice:localhost"}`:                    "1",
+		`{"creator":"@alice:localhost","room_version":"5"}`: "5",
+	} {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(
+			`{"type":"m.room.create","state_key":"","content":`+content+`}`,
+		), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := RoomVersionFromCreateEvent(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("wanted room version %q for content %s, got %q", want, content, got)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !sqlite
+
+package common
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// OpenDatabase opens the postgres database at the given data source name,
+// e.g. a postgres:// URI.
+func OpenDatabase(dataSourceName string) (*sql.DB, error) {
+	return sql.Open("postgres", dataSourceName)
+}
+
+// StringArray converts a list of strings into a value which can be bound to
+// the statements matching a column against a list of values, i.e. "= ANY($1)".
+func StringArray(values []string) interface{} {
+	return pq.StringArray(values)
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package common
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	// Import the SQLite database driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteOptions puts the database in write-ahead logging mode, so that readers
+// don't wait for the writer, and makes transactions take the write lock when
+// they begin, so that only one of them writes to the database at a time
+// rather than failing when two of them try to upgrade their locks at once.
+// Writers wait for the lock for up to 10 seconds.
+const sqliteOptions = "_journal_mode=WAL&_txlock=immediate&_busy_timeout=10000"
+
+// OpenDatabase opens the SQLite database at the given data source name,
+// e.g. "file:/var/dendrite/account.db".
+func OpenDatabase(dataSourceName string) (*sql.DB, error) {
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
+	}
+	return sql.Open("sqlite3", dataSourceName+separator+sqliteOptions)
+}
+
+// StringArray converts a list of strings into a value which can be bound to
+// the statements matching a column against a list of values. SQLite doesn't
+// have arrays so the list is sent as JSON, which the statements expand with
+// "IN (SELECT value FROM json_each($1))".
+func StringArray(values []string) interface{} {
+	if values == nil {
+		values = []string{}
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		// Marshalling a list of strings can't fail.
+		panic(err)
+	}
+	return string(encoded)
+}
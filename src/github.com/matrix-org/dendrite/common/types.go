@@ -14,9 +14,90 @@
 
 package common
 
+import "encoding/json"
+
 // AccountData represents account data sent from the client API server to the
 // sync API server
 type AccountData struct {
 	RoomID string `json:"room_id"`
 	Type   string `json:"type"`
 }
+
+// TypingEvent represents a change in whether a user is typing in a room, sent
+// from the client API server to the sync API server
+type TypingEvent struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	Typing bool   `json:"typing"`
+	// How long the user should be considered typing for, in milliseconds.
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// ReceiptEvent represents a receipt sent by a user in a room, sent from the
+// client API server to the sync API and federation sender servers
+type ReceiptEvent struct {
+	RoomID  string `json:"room_id"`
+	UserID  string `json:"user_id"`
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	// When the receipt was sent, as a millisecond posix timestamp.
+	Timestamp int64 `json:"timestamp"`
+	// The position of the receipt in the receipts stream of the room server.
+	StreamPosition int64 `json:"stream_position"`
+}
+
+// DeviceListUpdate represents a change to the devices of a local user, sent
+// from the client API server to the federation sender server
+type DeviceListUpdate struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The new display name of the device, if it wasn't deleted.
+	DeviceDisplayName string `json:"device_display_name,omitempty"`
+	Deleted           bool   `json:"deleted,omitempty"`
+	// The new identity keys of the device, if they were changed.
+	Keys json.RawMessage `json:"keys,omitempty"`
+	// The new cross-signing keys of the user, if they were changed. The update
+	// isn't about a device if either is set.
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+	// An ID for the update, increasing with every change to the user's devices.
+	StreamID int64 `json:"stream_id"`
+	// The IDs of the rooms the user is joined to, whose servers must be told
+	// about the update.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// PresenceEvent represents a change to the presence of a user, sent from the
+// client API server to the sync API and federation sender servers for local
+// users, and from the federation API server to the sync API server for remote
+// users
+type PresenceEvent struct {
+	UserID    string `json:"user_id"`
+	Presence  string `json:"presence"`
+	StatusMsg string `json:"status_msg,omitempty"`
+	// When the user was last active, as a millisecond posix timestamp.
+	LastActiveTS int64 `json:"last_active_ts"`
+	// The position of the update in the presence stream of the account database.
+	StreamPosition int64 `json:"stream_position"`
+	// The IDs of the rooms the user is joined to, whose servers must be told
+	// about the update. Empty for remote users.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// SendToDeviceEvent represents to-device messages sent by a local user, sent
+// from the client API server to the sync API and federation sender servers
+type SendToDeviceEvent struct {
+	Sender string `json:"sender"`
+	Type   string `json:"type"`
+	// An ID for the messages, unique among the ones sent by the sender.
+	MessageID string `json:"message_id"`
+	// The local users who were sent messages. The messages are stored in the
+	// account database.
+	LocalUserIDs []string `json:"local_user_ids,omitempty"`
+	// The position of the messages in the to-device stream of the account
+	// database.
+	StreamPosition int64 `json:"stream_position"`
+	// The messages for users on other servers, as a map of user ID to device
+	// ID, or "*" for all of their devices, to content.
+	RemoteMessages map[string]map[string]json.RawMessage `json:"remote_messages,omitempty"`
+}
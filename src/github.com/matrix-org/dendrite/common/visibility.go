@@ -0,0 +1,62 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MembershipHistory is what is known about the membership of a user in a
+// room when deciding whether they can see an event of the room.
+type MembershipHistory struct {
+	// The user to check the visibility of the event for.
+	UserID string
+	// The membership of the user in the state before the event, or "" if
+	// they weren't in the room then.
+	AtEvent string
+	// Whether the user is currently joined to the room.
+	CurrentlyJoined bool
+}
+
+// HistoryVisibilityFilter returns whether the user can see the event, given
+// the history visibility of the room in the state before the event and the
+// membership history of the user. Users can always see their own membership
+// events.
+// https://matrix.org/docs/spec/client_server/r0.2.0.html#room-history-visibility
+func HistoryVisibilityFilter(
+	event *gomatrixserverlib.Event, visibility string, membership MembershipHistory,
+) bool {
+	if event.Type() == "m.room.member" && event.StateKeyEquals(membership.UserID) {
+		return true
+	}
+	return HistoryVisibilityAllows(visibility, membership)
+}
+
+// HistoryVisibilityAllows returns whether the user can see the events sent
+// while the room had the given history visibility, not taking their own
+// membership events into account.
+func HistoryVisibilityAllows(visibility string, membership MembershipHistory) bool {
+	switch visibility {
+	case "world_readable":
+		return true
+	case "shared":
+		return membership.AtEvent == "join" || membership.CurrentlyJoined
+	case "invited":
+		return membership.AtEvent == "join" || membership.AtEvent == "invite"
+	default:
+		// "joined", and the safest option for unknown values.
+		return membership.AtEvent == "join"
+	}
+}
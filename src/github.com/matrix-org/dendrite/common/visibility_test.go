@@ -0,0 +1,74 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestHistoryVisibilityAllows(t *testing.T) {
+	tests := []struct {
+		visibility  string
+		membership  string
+		stillInRoom bool
+		want        bool
+	}{
+		{"world_readable", "", false, true},
+		{"shared", "", true, true},
+		{"shared", "", false, false},
+		{"shared", "join", false, true},
+		{"invited", "invite", false, true},
+		{"invited", "leave", true, false},
+		{"joined", "invite", true, false},
+		{"joined", "join", false, true},
+		{"unknown", "invite", true, false},
+	}
+	for _, tt := range tests {
+		got := HistoryVisibilityAllows(tt.visibility, MembershipHistory{
+			UserID: "@alice:localhost", AtEvent: tt.membership, CurrentlyJoined: tt.stillInRoom,
+		})
+		if got != tt.want {
+			t.Errorf(
+				"HistoryVisibilityAllows(%q, %q, %t): want %t, got %t",
+				tt.visibility, tt.membership, tt.stillInRoom, tt.want, got,
+			)
+		}
+	}
+}
+
+func TestHistoryVisibilityFilterOwnMembership(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.member",
+		"state_key": "@bob:localhost",
+		"content": {
+			"membership": "invite"
+		},
+		"sender": "@alice:localhost",
+		"room_id": "!test:localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$aliceInviteBobEvent:localhost"
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HistoryVisibilityFilter(&event, "joined", MembershipHistory{UserID: "@bob:localhost"}) {
+		t.Error("users should always see their own membership events")
+	}
+	if HistoryVisibilityFilter(&event, "joined", MembershipHistory{UserID: "@charlie:localhost"}) {
+		t.Error("users shouldn't see membership events of others before joining")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum number of events returned by a single backfill request,
+// whatever the limit asked for is.
+const maxBackfillLimit = 100
+
+// Backfill implements /_matrix/federation/v1/backfill/{roomID}
+// It returns the events before the "v" events in the room, along with their
+// auth chains.
+// https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-backfill-roomid
+func Backfill(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	now time.Time,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+) util.JSONResponse {
+	eventIDs := req.URL.Query()["v"]
+	if len(eventIDs) == 0 {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.MissingArgument("At least one v parameter is required"),
+		}
+	}
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit < 0 {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+		}
+	}
+	if limit > maxBackfillLimit {
+		limit = maxBackfillLimit
+	}
+
+	queryReq := api.QueryBackfillRequest{
+		RoomID:           roomID,
+		EarliestEventIDs: eventIDs,
+		Limit:            limit,
+		ServerName:       request.Origin(),
+	}
+	var queryRes api.QueryBackfillResponse
+	if err = query.QueryBackfill(req.Context(), &queryReq, &queryRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: federationclient.Transaction{
+			Transaction: gomatrixserverlib.Transaction{
+				Origin:         cfg.Matrix.ServerName,
+				OriginServerTS: gomatrixserverlib.AsTimestamp(now),
+				PDUs:           append(queryRes.Events, queryRes.AuthChainEvents...),
+			},
+		},
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/e2ekeys"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// QueryDeviceKeys implements POST /_matrix/federation/v1/user/keys/query
+// It returns the identity keys of the devices of local users, along with their
+// public cross-signing keys. Users on other servers are ignored.
+// https://matrix.org/docs/spec/server_server/unstable.html#post-matrix-federation-v1-user-keys-query
+func QueryDeviceKeys(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg config.Dendrite,
+	accountDB *accounts.Database,
+	deviceDB *devices.Database,
+) util.JSONResponse {
+	var r struct {
+		DeviceKeys map[string][]string `json:"device_keys"`
+	}
+	if err := json.Unmarshal(request.Content(), &r); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	res := federationclient.RespQueryKeys{
+		DeviceKeys:      map[string]map[string]json.RawMessage{},
+		MasterKeys:      map[string]json.RawMessage{},
+		SelfSigningKeys: map[string]json.RawMessage{},
+	}
+	for userID, deviceIDs := range r.DeviceKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != cfg.Matrix.ServerName {
+			continue
+		}
+		keys, err := e2ekeys.QueryDeviceKeys(deviceDB, userID, deviceIDs)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		res.DeviceKeys[userID] = keys
+		signingKeys, err := e2ekeys.QueryCrossSigningKeys(accountDB, userID, false)
+		if err != nil {
+			return httputil.LogThenError(req, err)
+		}
+		if key, ok := signingKeys[e2ekeys.MasterKey]; ok {
+			res.MasterKeys[userID] = key
+		}
+		if key, ok := signingKeys[e2ekeys.SelfSigningKey]; ok {
+			res.SelfSigningKeys[userID] = key
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/e2ekeys"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetUserDevices implements GET /_matrix/federation/v1/user/devices/{userID}
+// It returns every device of a local user, with their identity keys, along
+// with the public cross-signing keys of the user, signed by the server.
+// https://matrix.org/docs/spec/server_server/r0.1.4.html#get-matrix-federation-v1-user-devices-userid
+func GetUserDevices(
+	req *http.Request, cfg config.Dendrite,
+	accountDB *accounts.Database, deviceDB *devices.Database, userID string,
+) util.JSONResponse {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The user isn't on this server"),
+		}
+	}
+
+	devs, err := deviceDB.GetDevicesByLocalpart(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	keys, err := deviceDB.GetDeviceKeys(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	signingKeys, err := e2ekeys.QueryCrossSigningKeys(accountDB, userID, false)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	streamID, err := deviceDB.GetDeviceListStreamID(localpart)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	res := federationclient.RespUserDevices{
+		UserID:         userID,
+		StreamID:       streamID,
+		Devices:        []federationclient.RespUserDevice{},
+		MasterKey:      signingKeys[e2ekeys.MasterKey],
+		SelfSigningKey: signingKeys[e2ekeys.SelfSigningKey],
+	}
+	for _, dev := range devs {
+		res.Devices = append(res.Devices, federationclient.RespUserDevice{
+			DeviceID:    dev.ID,
+			Keys:        keys[dev.ID],
+			DisplayName: dev.DisplayName,
+		})
+	}
+
+	// Sign the response so that remote servers can check that it came from
+	// us even once it has been passed on.
+	resJSON, err := json.Marshal(res)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	signed, err := gomatrixserverlib.SignJSON(
+		string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, resJSON,
+	)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{Code: 200, JSON: json.RawMessage(signed)}
+}
@@ -49,7 +49,10 @@ func localKeys(cfg config.Dendrite, validUntil time.Time) (*gomatrixserverlib.Se
 	}
 
 	keys.TLSFingerprints = cfg.Matrix.TLSFingerPrints
-	keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	keys.OldVerifyKeys = cfg.Matrix.OldVerifyKeys
+	if keys.OldVerifyKeys == nil {
+		keys.OldVerifyKeys = map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{}
+	}
 	keys.ValidUntilTS = gomatrixserverlib.AsTimestamp(validUntil)
 
 	toSign, err := json.Marshal(keys.ServerKeyFields)
@@ -0,0 +1,84 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetProfile implements GET /_matrix/federation/v1/query/profile
+// It returns the display name and avatar URL of a local user, or only one of
+// them if the field parameter is given.
+// https://matrix.org/docs/spec/server_server/r0.1.0.html#get-matrix-federation-v1-query-profile
+func GetProfile(
+	req *http.Request, cfg config.Dendrite, accountDB *accounts.Database,
+) util.JSONResponse {
+	userID := req.URL.Query().Get("user_id")
+	field := req.URL.Query().Get("field")
+	if userID == "" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.MissingArgument("The user_id parameter is required"),
+		}
+	}
+	if field != "" && field != "displayname" && field != "avatar_url" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("The field parameter must be displayname or avatar_url"),
+		}
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The user isn't on this server"),
+		}
+	}
+
+	profile, err := accountDB.GetProfileByLocalpart(localpart)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("The user doesn't exist"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	var res federationclient.RespProfile
+	if field == "" || field == "displayname" {
+		res.DisplayName = profile.DisplayName
+	}
+	if field == "" || field == "avatar_url" {
+		res.AvatarURL = profile.AvatarURL
+	}
+	return util.JSONResponse{Code: 200, JSON: res}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// State implements /_matrix/federation/v1/state/{roomID}
+// It returns the state of the room before the event_id event along with the
+// auth chain of that state.
+// https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-state-roomid
+func State(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	query api.RoomserverQueryAPI,
+) util.JSONResponse {
+	state, errRes := getState(req, request, roomID, query)
+	if errRes != nil {
+		return *errRes
+	}
+	return util.JSONResponse{Code: 200, JSON: federationclient.RespState(*state)}
+}
+
+// StateIDs implements /_matrix/federation/v1/state_ids/{roomID}
+// It is the same as State, except that only the event IDs are returned.
+// https://matrix.org/docs/spec/server_server/unstable.html#get-matrix-federation-v1-state-ids-roomid
+func StateIDs(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	query api.RoomserverQueryAPI,
+) util.JSONResponse {
+	state, errRes := getState(req, request, roomID, query)
+	if errRes != nil {
+		return *errRes
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: gomatrixserverlib.RespStateIDs{
+			StateEventIDs: eventIDsOf(state.StateEvents),
+			AuthEventIDs:  eventIDsOf(state.AuthEvents),
+		},
+	}
+}
+
+// getState looks up the state before the event_id event of a room, checking
+// that the requesting server is allowed to see it.
+func getState(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	query api.RoomserverQueryAPI,
+) (*gomatrixserverlib.RespState, *util.JSONResponse) {
+	eventID := req.URL.Query().Get("event_id")
+	if eventID == "" {
+		return nil, &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.MissingArgument("The event_id parameter is required"),
+		}
+	}
+
+	queryReq := api.QueryStateAndAuthChainRequest{
+		RoomID:  roomID,
+		EventID: eventID,
+	}
+	var queryRes api.QueryStateAndAuthChainResponse
+	if err := query.QueryStateAndAuthChain(req.Context(), &queryReq, &queryRes); err != nil {
+		errRes := httputil.LogThenError(req, err)
+		return nil, &errRes
+	}
+	if !queryRes.RoomExists {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+	if !queryRes.StateKnown {
+		return nil, &util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown event or state at event"),
+		}
+	}
+
+	// Only servers that had a user in the room at the event can see its state.
+	if !serverJoinedInState(request.Origin(), queryRes.StateEvents) {
+		return nil, &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The server isn't in the room at this event"),
+		}
+	}
+
+	return &gomatrixserverlib.RespState{
+		StateEvents: queryRes.StateEvents,
+		AuthEvents:  queryRes.AuthChainEvents,
+	}, nil
+}
+
+// serverJoinedInState returns whether a user of the server is joined to the
+// room in a state.
+func serverJoinedInState(serverName gomatrixserverlib.ServerName, stateEvents []gomatrixserverlib.Event) bool {
+	for _, event := range stateEvents {
+		if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if err != nil || domain != serverName {
+			continue
+		}
+		if membership, err := event.Membership(); err == nil && membership == "join" {
+			return true
+		}
+	}
+	return false
+}
+
+func eventIDsOf(events []gomatrixserverlib.Event) []string {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	return eventIDs
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package readers
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/util"
+)
+
+type wellKnownServerResponse struct {
+	Server string `json:"m.server"`
+}
+
+// WellKnownServer implements GET /.well-known/matrix/server
+// It tells other servers where to send federation requests for this server
+// name, if it is configured.
+func WellKnownServer(req *http.Request, cfg config.Dendrite) util.JSONResponse {
+	if cfg.Federation.WellKnownServer == "" {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("No .well-known file for this server"),
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: wellKnownServerResponse{Server: cfg.Federation.WellKnownServer},
+	}
+}
@@ -19,8 +19,12 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/federationapi/readers"
 	"github.com/matrix-org/dendrite/federationapi/writers"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -32,8 +36,12 @@ import (
 const (
 	pathPrefixV2Keys       = "/_matrix/key/v2"
 	pathPrefixV1Federation = "/_matrix/federation/v1"
+	pathPrefixV2Federation = "/_matrix/federation/v2"
 )
 
+// The number of transactions for which we remember the response we sent.
+const transactionCacheSize = 1000
+
 // Setup registers HTTP handlers with the given ServeMux.
 func Setup(
 	apiMux *mux.Router,
@@ -41,10 +49,15 @@ func Setup(
 	query api.RoomserverQueryAPI,
 	producer *producers.RoomserverProducer,
 	keys gomatrixserverlib.KeyRing,
-	federation *gomatrixserverlib.FederationClient,
+	federation *federationclient.Client,
+	deviceDB *devices.Database,
+	accountDB *accounts.Database,
+	presenceProducer *producers.PresenceProducer,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
 ) {
 	v2keysmux := apiMux.PathPrefix(pathPrefixV2Keys).Subrouter()
 	v1fedmux := apiMux.PathPrefix(pathPrefixV1Federation).Subrouter()
+	v2fedmux := apiMux.PathPrefix(pathPrefixV2Federation).Subrouter()
 
 	localKeys := makeAPI("localkeys", func(req *http.Request) util.JSONResponse {
 		return readers.LocalKeys(req, cfg)
@@ -57,30 +70,130 @@ func Setup(
 	v2keysmux.Handle("/server/{keyID}", localKeys)
 	v2keysmux.Handle("/server/", localKeys)
 
-	v1fedmux.Handle("/send/{txnID}/", makeAPI("federation_send",
-		func(req *http.Request) util.JSONResponse {
+	apiMux.Handle("/.well-known/matrix/server", makeAPI("wellknown_server", func(req *http.Request) util.JSONResponse {
+		return readers.WellKnownServer(req, cfg)
+	})).Methods("GET")
+
+	txnCache := writers.NewTransactionCache(transactionCacheSize)
+	send := common.MakeFedAPI("federation_send", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars := mux.Vars(req)
 			return writers.Send(
-				req, gomatrixserverlib.TransactionID(vars["txnID"]),
+				req, request, gomatrixserverlib.TransactionID(vars["txnID"]),
 				time.Now(),
-				cfg, query, producer, keys, federation,
+				cfg, query, producer, keys, federation, txnCache,
+				accountDB, deviceDB, presenceProducer, sendToDeviceProducer,
 			)
 		},
-	))
+	)
+	// Some servers send the transaction with a trailing slash and some don't.
+	v1fedmux.Handle("/send/{txnID}/", send)
+	v1fedmux.Handle("/send/{txnID}", send)
+
+	v1fedmux.Handle("/make_join/{roomID}/{userID}", common.MakeFedAPI("federation_make_join", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.MakeJoin(
+				req, request, vars["roomID"], vars["userID"],
+				time.Now(),
+				cfg, query,
+			)
+		},
+	)).Methods("GET")
+
+	v1fedmux.Handle("/send_join/{roomID}/{eventID}", common.MakeFedAPI("federation_send_join", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.SendJoin(
+				req, request, vars["roomID"], vars["eventID"],
+				time.Now(),
+				cfg, query, producer, keys,
+			)
+		},
+	)).Methods("PUT")
+
+	// Some servers send the request with a trailing slash and some don't.
+	backfill := common.MakeFedAPI("federation_backfill", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.Backfill(
+				req, request, vars["roomID"],
+				time.Now(),
+				cfg, query,
+			)
+		},
+	)
+	v1fedmux.Handle("/backfill/{roomID}/", backfill).Methods("GET")
+	v1fedmux.Handle("/backfill/{roomID}", backfill).Methods("GET")
 
-	v1fedmux.Handle("/invite/{roomID}/{eventID}", makeAPI("federation_invite",
-		func(req *http.Request) util.JSONResponse {
+	// Some servers send the requests with a trailing slash and some don't.
+	state := common.MakeFedAPI("federation_state", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.State(req, request, vars["roomID"], query)
+		},
+	)
+	v1fedmux.Handle("/state/{roomID}/", state).Methods("GET")
+	v1fedmux.Handle("/state/{roomID}", state).Methods("GET")
+
+	stateIDs := common.MakeFedAPI("federation_state_ids", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.StateIDs(req, request, vars["roomID"], query)
+		},
+	)
+	v1fedmux.Handle("/state_ids/{roomID}/", stateIDs).Methods("GET")
+	v1fedmux.Handle("/state_ids/{roomID}", stateIDs).Methods("GET")
+
+	v1fedmux.Handle("/query/profile", common.MakeFedAPI("federation_query_profile", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return readers.GetProfile(req, cfg, accountDB)
+		},
+	)).Methods("GET")
+
+	v1fedmux.Handle("/user/devices/{userID}", common.MakeFedAPI("federation_user_devices", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return readers.GetUserDevices(req, cfg, accountDB, deviceDB, vars["userID"])
+		},
+	)).Methods("GET")
+
+	v1fedmux.Handle("/user/keys/query", common.MakeFedAPI("federation_query_keys", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return readers.QueryDeviceKeys(req, request, cfg, accountDB, deviceDB)
+		},
+	)).Methods("POST")
+
+	v1fedmux.Handle("/user/keys/claim", common.MakeFedAPI("federation_claim_keys", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			return writers.ClaimOneTimeKeys(req, request, cfg, deviceDB)
+		},
+	)).Methods("POST")
+
+	v1fedmux.Handle("/invite/{roomID}/{eventID}", common.MakeFedAPI("federation_invite", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
 			vars := mux.Vars(req)
 			return writers.Invite(
-				req, vars["roomID"], vars["eventID"],
+				req, request, vars["roomID"], vars["eventID"],
 				time.Now(),
 				cfg, producer, keys,
 			)
 		},
 	))
+
+	v2fedmux.Handle("/invite/{roomID}/{eventID}", common.MakeFedAPI("federation_invite_v2", cfg.Matrix.ServerName, keys,
+		func(req *http.Request, request *gomatrixserverlib.FederationRequest) util.JSONResponse {
+			vars := mux.Vars(req)
+			return writers.InviteV2(
+				req, request, vars["roomID"], vars["eventID"],
+				time.Now(),
+				cfg, producer, keys,
+			)
+		},
+	)).Methods("PUT")
 }
 
 func makeAPI(metricsName string, f func(*http.Request) util.JSONResponse) http.Handler {
 	h := util.NewJSONRequestHandler(f)
-	return prometheus.InstrumentHandler(metricsName, util.MakeJSONAPI(h))
+	return prometheus.InstrumentHandler(metricsName, common.MakeJSONAPI(h))
 }
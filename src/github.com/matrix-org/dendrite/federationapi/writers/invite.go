@@ -10,13 +10,17 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // Invite implements /_matrix/federation/v1/invite/{roomID}/{eventID}
+// The request is only used for rooms whose events contain their event ID, as
+// in version 1 rooms.
 func Invite(
 	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
 	roomID string,
 	eventID string,
 	now time.Time,
@@ -24,23 +28,98 @@ func Invite(
 	producer *producers.RoomserverProducer,
 	keys gomatrixserverlib.KeyRing,
 ) util.JSONResponse {
-	request, errResp := gomatrixserverlib.VerifyHTTPRequest(req, now, cfg.Matrix.ServerName, keys)
-	if request == nil {
-		return errResp
+	// Decode the event JSON from the request.
+	event, err := common.NewEventFromFederationJSON(request.Content(), "1")
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into a valid event. " + err.Error()),
+		}
 	}
 
-	// Decode the event JSON from the request.
-	var event gomatrixserverlib.Event
-	if err := json.Unmarshal(request.Content(), &event); err != nil {
+	signedEvent, errRes := processInvite(req, request, roomID, eventID, event, cfg, producer, keys)
+	if errRes != nil {
+		return *errRes
+	}
+
+	// Return the signed event to the originating server, it should then tell
+	// the other servers in the room that we have been invited.
+	return util.JSONResponse{
+		Code: 200,
+		JSON: signedEvent,
+	}
+}
+
+// InviteV2 implements /_matrix/federation/v2/invite/{roomID}/{eventID}
+// The request gives the version of the room, and so the format of the event.
+// https://matrix.org/docs/spec/server_server/r0.1.4#put-matrix-federation-v2-invite-roomid-eventid
+func InviteV2(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	eventID string,
+	now time.Time,
+	cfg config.Dendrite,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) util.JSONResponse {
+	var body struct {
+		RoomVersion string          `json:"room_version"`
+		Event       json.RawMessage `json:"event"`
+	}
+	if err := json.Unmarshal(request.Content(), &body); err != nil {
 		return util.JSONResponse{
 			Code: 400,
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
+	if !config.IsSupportedRoomVersion(body.RoomVersion) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.IncompatibleRoomVersion(body.RoomVersion),
+		}
+	}
+	event, err := common.NewEventFromFederationJSON(body.Event, body.RoomVersion)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The invite event could not be decoded into a valid event. " + err.Error()),
+		}
+	}
+
+	signedEvent, errRes := processInvite(req, request, roomID, eventID, event, cfg, producer, keys)
+	if errRes != nil {
+		return *errRes
+	}
+
+	signedJSON, err := common.FederationEventJSON(*signedEvent)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct {
+			Event json.RawMessage `json:"event"`
+		}{signedJSON},
+	}
+}
 
+// processInvite checks an invite event sent by a remote server, signs it and
+// passes it to the roomserver. Returns the signed event, or an error response
+// if the invite isn't valid.
+func processInvite(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	eventID string,
+	event gomatrixserverlib.Event,
+	cfg config.Dendrite,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) (*gomatrixserverlib.Event, *util.JSONResponse) {
 	// Check that the room ID is correct.
 	if event.RoomID() != roomID {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: 400,
 			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the invite event JSON"),
 		}
@@ -48,7 +127,7 @@ func Invite(
 
 	// Check that the event ID is correct.
 	if event.EventID() != eventID {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: 400,
 			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the invite event JSON"),
 		}
@@ -56,24 +135,31 @@ func Invite(
 
 	// Check that the event is from the server sending the request.
 	if event.Origin() != request.Origin() {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: 403,
 			JSON: jsonerror.Forbidden("The invite must be sent by the server it originated on"),
 		}
 	}
 
-	// Check that the event is signed by the server sending the request.
+	// Check that the event is signed by the server sending the request. The
+	// signature covers the redacted event as it is sent over federation.
+	signedJSON, err := common.FederationEventJSON(event.Redact())
+	if err != nil {
+		errRes := httputil.LogThenError(req, err)
+		return nil, &errRes
+	}
 	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
 		ServerName: event.Origin(),
-		Message:    event.JSON(),
+		Message:    signedJSON,
 		AtTS:       event.OriginServerTS(),
 	}}
 	verifyResults, err := keys.VerifyJSONs(verifyRequests)
 	if err != nil {
-		return httputil.LogThenError(req, err)
+		errRes := httputil.LogThenError(req, err)
+		return nil, &errRes
 	}
 	if verifyResults[0].Error != nil {
-		return util.JSONResponse{
+		return nil, &util.JSONResponse{
 			Code: 403,
 			JSON: jsonerror.Forbidden("The invite must be signed by the server it originated on"),
 		}
@@ -86,13 +172,8 @@ func Invite(
 
 	// Add the invite event to the roomserver.
 	if err = producer.SendInvite(signedEvent); err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	// Return the signed event to the originating server, it should then tell
-	// the other servers in the room that we have been invited.
-	return util.JSONResponse{
-		Code: 200,
-		JSON: &signedEvent,
+		errRes := httputil.LogThenError(req, err)
+		return nil, &errRes
 	}
+	return &signedEvent, nil
 }
@@ -0,0 +1,345 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/events"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// MakeJoin implements the /make_join API
+func MakeJoin(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	userID string,
+	now time.Time,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+) util.JSONResponse {
+	// Check that the user is on the server asking for the join event.
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("Invalid UserID"),
+		}
+	}
+	if domain != request.Origin() {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The join must be sent by the server of the user"),
+		}
+	}
+
+	// Check that the server isn't denied by the server ACL of the room.
+	if err = checkServerACL(req.Context(), query, roomID, request.Origin()); err != nil {
+		if _, ok := err.(serverACLError); ok {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
+		return httputil.LogThenError(req, err)
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     "m.room.member",
+		StateKey: &userID,
+	}
+	if err = builder.SetContent(map[string]interface{}{"membership": "join"}); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	err = events.FillBuilder(req.Context(), &builder, query, &queryRes)
+	if err == events.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Check that the joining server supports the version of the room.
+	// Servers which don't list the versions they support only support
+	// version 1.
+	remoteVersions := req.URL.Query()["ver"]
+	if len(remoteVersions) == 0 {
+		remoteVersions = []string{"1"}
+	}
+	if !containsString(remoteVersions, queryRes.RoomVersion) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.IncompatibleRoomVersion(queryRes.RoomVersion),
+		}
+	}
+
+	// Check that the join would be allowed by the current state of the room
+	// before handing out the template, using a provisional event which is
+	// never sent anywhere.
+	provisional, err := common.BuildEvent(
+		&builder, queryRes.RoomVersion, now, cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+	)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if err = checkAllowedByState(provisional, queryRes.StateEvents); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	// The template is in the format of the events of the room.
+	builderJSON, err := common.EventBuilderJSON(&builder, queryRes.RoomVersion)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: respMakeJoin{
+			JoinEvent:   builderJSON,
+			RoomVersion: queryRes.RoomVersion,
+		},
+	}
+}
+
+// respMakeJoin is a federationclient.RespMakeJoin whose event is in the format
+// of the events of the room.
+type respMakeJoin struct {
+	JoinEvent   json.RawMessage `json:"event"`
+	RoomVersion string          `json:"room_version"`
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SendJoin implements the /send_join API
+func SendJoin(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	roomID string,
+	eventID string,
+	now time.Time,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+) util.JSONResponse {
+	// Look up the version of the room, which gives the format of the event.
+	versionReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var versionRes api.QueryLatestEventsAndStateResponse
+	if err := query.QueryLatestEventsAndState(req.Context(), &versionReq, &versionRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !versionRes.RoomExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	if err := common.CheckRoomVersion(roomID, versionRes.RoomVersion); err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+
+	// Decode the event JSON from the request.
+	event, err := common.NewEventFromFederationJSON(request.Content(), versionRes.RoomVersion)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into a valid event. " + err.Error()),
+		}
+	}
+
+	// Check that the room ID and event ID are correct.
+	if event.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the join event JSON"),
+		}
+	}
+	if event.EventID() != eventID {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the join event JSON"),
+		}
+	}
+	if err = common.CheckEventSize(event, cfg.Matrix.MaxEventSizeBytes); err != nil {
+		return util.JSONResponse{
+			Code: 413,
+			JSON: jsonerror.TooLarge(err.Error()),
+		}
+	}
+
+	// Check that this is a join for a user on the server sending the request.
+	membership, err := event.Membership()
+	if err != nil || event.Type() != "m.room.member" || membership != "join" {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The event must be a m.room.member event with a join membership"),
+		}
+	}
+	if event.StateKey() == nil || *event.StateKey() != event.Sender() {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The state key of the join event must be its sender"),
+		}
+	}
+	if event.Origin() != request.Origin() {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The join must be sent by the server it originated on"),
+		}
+	}
+
+	// Check that the event is signed by the server sending the request.
+	if err = gomatrixserverlib.VerifyEventSignatures([]gomatrixserverlib.Event{event}, keys); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("The join must be signed by the server it originated on"),
+		}
+	}
+
+	// Check that the server isn't denied by the server ACL of the room.
+	if err = checkServerACL(req.Context(), query, roomID, request.Origin()); err != nil {
+		if _, ok := err.(serverACLError); ok {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: jsonerror.Forbidden(err.Error()),
+			}
+		}
+		return httputil.LogThenError(req, err)
+	}
+
+	// Check that the join is allowed by the state before it.
+	stateReq := api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: event.PrevEventIDs(),
+		StateToFetch: gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event}).Tuples(),
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = query.QueryStateAfterEvents(req.Context(), &stateReq, &stateRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	}
+	if !stateRes.PrevEventsExist {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON("The prev_events of the join event are unknown"),
+		}
+	}
+	if err = checkAllowedByState(event, stateRes.StateEvents); err != nil {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	// Fetch the state of the room to send back before passing on the join,
+	// since the roomserver processes it asynchronously.
+	state, err := currentStateAndAuthChain(req.Context(), roomID, query)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	// Send the join to the roomserver, which will pass it on to the other
+	// servers in the room.
+	if err = producer.SendEvents([]gomatrixserverlib.Event{event}, cfg.Matrix.ServerName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: federationclient.RespSendJoin(*state),
+	}
+}
+
+// currentStateAndAuthChain returns the current state of the room along with
+// every event needed to authenticate it.
+// Returns an error if there was a problem talking to the roomserver.
+func currentStateAndAuthChain(
+	ctx context.Context, roomID string, query api.RoomserverQueryAPI,
+) (*gomatrixserverlib.RespState, error) {
+	stateReq := api.QueryCurrentStateRequest{RoomID: roomID}
+	var stateRes api.QueryCurrentStateResponse
+	if err := query.QueryCurrentState(ctx, &stateReq, &stateRes); err != nil {
+		return nil, err
+	}
+
+	var state gomatrixserverlib.RespState
+	seen := map[string]bool{}
+	eventIDs := stateRes.StateEventIDs
+	for i := 0; len(eventIDs) > 0; i++ {
+		eventsReq := api.QueryEventsByIDRequest{EventIDs: eventIDs}
+		var eventsRes api.QueryEventsByIDResponse
+		if err := query.QueryEventsByID(ctx, &eventsReq, &eventsRes); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			state.StateEvents = eventsRes.Events
+		} else {
+			state.AuthEvents = append(state.AuthEvents, eventsRes.Events...)
+		}
+
+		// Walk up the auth events of the events we just fetched.
+		eventIDs = nil
+		for _, ev := range eventsRes.Events {
+			for _, authEventID := range ev.AuthEventIDs() {
+				if !seen[authEventID] {
+					seen[authEventID] = true
+					eventIDs = append(eventIDs, authEventID)
+				}
+			}
+		}
+	}
+	if state.StateEvents == nil {
+		state.StateEvents = []gomatrixserverlib.Event{}
+	}
+	if state.AuthEvents == nil {
+		state.AuthEvents = []gomatrixserverlib.Event{}
+	}
+	return &state, nil
+}
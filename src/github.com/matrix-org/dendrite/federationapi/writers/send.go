@@ -1,15 +1,24 @@
 package writers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/presence"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/todevice"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -18,31 +27,96 @@ import (
 // Send implements /_matrix/federation/v1/send/{txnID}
 func Send(
 	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
 	txnID gomatrixserverlib.TransactionID,
 	now time.Time,
 	cfg config.Dendrite,
 	query api.RoomserverQueryAPI,
 	producer *producers.RoomserverProducer,
 	keys gomatrixserverlib.KeyRing,
-	federation *gomatrixserverlib.FederationClient,
+	federation *federationclient.Client,
+	txnCache *TransactionCache,
+	accountDB *accounts.Database,
+	deviceDB *devices.Database,
+	presenceProducer *producers.PresenceProducer,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
 ) util.JSONResponse {
-	request, errResp := gomatrixserverlib.VerifyHTTPRequest(req, now, cfg.Matrix.ServerName, keys)
-	if request == nil {
-		return errResp
+	// If we already processed this transaction, or are processing it for
+	// another request, then send back the same response without processing the
+	// events again.
+	entry, started := txnCache.start(request.Origin(), txnID)
+	if !started {
+		<-entry.done
+		if entry.resp == nil {
+			return util.JSONResponse{
+				Code: 500,
+				JSON: jsonerror.Unknown("Failed to process the transaction"),
+			}
+		}
+		return util.JSONResponse{
+			Code: 200,
+			JSON: entry.resp,
+		}
 	}
 
+	resp, resErr := processSend(
+		req, request, txnID, cfg, query, producer, keys, federation,
+		accountDB, deviceDB, presenceProducer, sendToDeviceProducer,
+	)
+	txnCache.finish(request.Origin(), txnID, resp)
+	if resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: resp,
+	}
+}
+
+// processSend processes the transaction sent in the request, returning the
+// response to send, or an error response if the transaction couldn't be
+// processed.
+func processSend(
+	req *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	txnID gomatrixserverlib.TransactionID,
+	cfg config.Dendrite,
+	query api.RoomserverQueryAPI,
+	producer *producers.RoomserverProducer,
+	keys gomatrixserverlib.KeyRing,
+	federation *federationclient.Client,
+	accountDB *accounts.Database,
+	deviceDB *devices.Database,
+	presenceProducer *producers.PresenceProducer,
+	sendToDeviceProducer *producers.SendToDeviceProducer,
+) (*gomatrixserverlib.RespSend, *util.JSONResponse) {
 	t := txnReq{
-		query:      query,
-		producer:   producer,
-		keys:       keys,
-		federation: federation,
+		ctx:                  req.Context(),
+		query:                query,
+		producer:             producer,
+		keys:                 keys,
+		federation:           federation,
+		accountDB:            accountDB,
+		deviceDB:             deviceDB,
+		presenceProducer:     presenceProducer,
+		sendToDeviceProducer: sendToDeviceProducer,
+		maxEventSize:         cfg.Matrix.MaxEventSizeBytes,
 	}
-	if err := json.Unmarshal(request.Content(), &t); err != nil {
-		return util.JSONResponse{
+	// The PDUs are loaded once the versions of their rooms are known, which
+	// give the format of the events.
+	var body struct {
+		PDUs []json.RawMessage      `json:"pdus"`
+		EDUs []federationclient.EDU `json:"edus"`
+	}
+	if err := json.Unmarshal(request.Content(), &body); err != nil {
+		return nil, &util.JSONResponse{
 			Code: 400,
 			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
 		}
 	}
+	t.rawPDUs = body.PDUs
+	t.EDUs = body.EDUs
 
 	t.Origin = request.Origin()
 	t.TransactionID = txnID
@@ -50,24 +124,40 @@ func Send(
 
 	resp, err := t.processTransaction()
 	if err != nil {
-		return httputil.LogThenError(req, err)
-	}
-
-	return util.JSONResponse{
-		Code: 200,
-		JSON: resp,
+		resErr := httputil.LogThenError(req, err)
+		return nil, &resErr
 	}
+	return resp, nil
 }
 
 type txnReq struct {
-	gomatrixserverlib.Transaction
-	query      api.RoomserverQueryAPI
-	producer   *producers.RoomserverProducer
-	keys       gomatrixserverlib.KeyRing
-	federation *gomatrixserverlib.FederationClient
+	federationclient.Transaction
+	ctx                  context.Context
+	query                api.RoomserverQueryAPI
+	producer             *producers.RoomserverProducer
+	keys                 gomatrixserverlib.KeyRing
+	federation           *federationclient.Client
+	accountDB            *accounts.Database
+	deviceDB             *devices.Database
+	presenceProducer     *producers.PresenceProducer
+	sendToDeviceProducer *producers.SendToDeviceProducer
+	// The maximum size of the events in bytes. Larger events are rejected.
+	maxEventSize int
+	// The JSON of the PDUs of the transaction, as sent by the origin server.
+	rawPDUs []json.RawMessage
+	// The versions of the rooms of the transaction by room ID, or "" for the
+	// rooms the server doesn't know.
+	roomVersions map[string]string
+	// The events whose fetching has already been attempted while processing
+	// the transaction.
+	fetchAttempts map[string]bool
 }
 
 func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
+	if err := t.loadPDUs(); err != nil {
+		return nil, err
+	}
+
 	// Check the event signatures
 	if err := gomatrixserverlib.VerifyEventSignatures(t.PDUs, t.keys); err != nil {
 		return nil, err
@@ -75,8 +165,18 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 
 	// Process the events.
 	results := map[string]gomatrixserverlib.PDUResult{}
+	// The result of checking the server ACL of each room, so that it is only
+	// checked once per transaction.
+	aclResults := map[string]error{}
 	for _, e := range t.PDUs {
-		err := t.processEvent(e)
+		err, checked := aclResults[e.RoomID()]
+		if !checked {
+			err = checkServerACL(t.ctx, t.query, e.RoomID(), t.Origin)
+			aclResults[e.RoomID()] = err
+		}
+		if err == nil {
+			err = t.processEvent(e, true)
+		}
 		if err != nil {
 			// If the error is due to the event itself being bad then we skip
 			// it and move onto the next event. We report an error so that the
@@ -95,6 +195,9 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 			// transactions from that server forever.
 			switch err.(type) {
 			case unknownRoomError:
+			case serverACLError:
+			case common.UnsupportedRoomVersionError:
+			case common.EventTooLargeError:
 			case *gomatrixserverlib.NotAllowed:
 			default:
 				// Any other error should be the result of a temporary error in
@@ -107,18 +210,174 @@ func (t *txnReq) processTransaction() (*gomatrixserverlib.RespSend, error) {
 		}
 	}
 
-	// TODO: Process the EDUs.
+	if err := t.processEDUs(); err != nil {
+		return nil, err
+	}
 
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
+// loadPDUs loads the PDUs of the transaction in the format of the versions of
+// their rooms. The sender isn't told about PDUs which can't be loaded, since
+// their event IDs may not be known, so they are logged and skipped.
+func (t *txnReq) loadPDUs() error {
+	logger := common.GetLogger(t.ctx)
+	for _, pduJSON := range t.rawPDUs {
+		var fields struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := json.Unmarshal(pduJSON, &fields); err != nil {
+			logger.WithError(err).Warn("Failed to decode PDU")
+			continue
+		}
+		roomVersion, err := t.roomVersion(fields.RoomID)
+		if err != nil {
+			return err
+		}
+		if roomVersion == "" {
+			// The format of events in unknown rooms can't be checked, but the
+			// sender is still told about the ones in the original format.
+			roomVersion = "1"
+		}
+		event, err := common.NewEventFromFederationJSON(pduJSON, roomVersion)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", fields.RoomID).Warn("Failed to load PDU")
+			continue
+		}
+		t.PDUs = append(t.PDUs, event)
+	}
+	return nil
+}
+
+// roomVersion returns the version of a room, or "" if the server doesn't know
+// the room. Each room is only looked up once per transaction.
+func (t *txnReq) roomVersion(roomID string) (string, error) {
+	if roomVersion, ok := t.roomVersions[roomID]; ok {
+		return roomVersion, nil
+	}
+	queryReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := t.query.QueryLatestEventsAndState(t.ctx, &queryReq, &queryRes); err != nil {
+		return "", err
+	}
+	if t.roomVersions == nil {
+		t.roomVersions = make(map[string]string)
+	}
+	if !queryRes.RoomExists {
+		queryRes.RoomVersion = ""
+	}
+	t.roomVersions[roomID] = queryRes.RoomVersion
+	return queryRes.RoomVersion, nil
+}
+
+// processEDUs processes the EDUs of the transaction. The sender isn't told
+// about EDUs which couldn't be processed, so bad EDUs are logged and skipped.
+func (t *txnReq) processEDUs() error {
+	for _, edu := range t.EDUs {
+		switch edu.Type {
+		case "m.presence":
+			if err := t.processPresenceEDU(edu); err != nil {
+				return err
+			}
+		case "m.direct_to_device":
+			if err := t.processToDeviceEDU(edu); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// processPresenceEDU stores the presence updates of an m.presence EDU and
+// sends them to the sync API server. Updates about users of other servers than
+// the origin are ignored.
+// https://matrix.org/docs/spec/server_server/unstable.html#presence
+func (t *txnReq) processPresenceEDU(edu federationclient.EDU) error {
+	var content struct {
+		Push []struct {
+			UserID        string `json:"user_id"`
+			Presence      string `json:"presence"`
+			StatusMsg     string `json:"status_msg"`
+			LastActiveAgo int64  `json:"last_active_ago"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		common.GetLogger(t.ctx).WithError(err).Warn("Failed to decode m.presence EDU")
+		return nil
+	}
+	for _, update := range content.Push {
+		_, domain, err := gomatrixserverlib.SplitID('@', update.UserID)
+		if err != nil || domain != t.Origin {
+			continue
+		}
+		switch update.Presence {
+		case authtypes.PresenceOnline, authtypes.PresenceUnavailable, authtypes.PresenceOffline:
+		default:
+			continue
+		}
+		lastActive := time.Now().Add(-time.Duration(update.LastActiveAgo) * time.Millisecond)
+		if err = presence.SetRemotePresence(t.accountDB, t.presenceProducer, authtypes.Presence{
+			UserID:       update.UserID,
+			Presence:     update.Presence,
+			StatusMsg:    update.StatusMsg,
+			LastActiveTS: gomatrixserverlib.AsTimestamp(lastActive),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processToDeviceEDU stores the messages of an m.direct_to_device EDU for the
+// devices of local users and sends them to the sync API server. Messages sent
+// by users of other servers than the origin, or for users of other servers
+// than this one, are ignored.
+// https://matrix.org/docs/spec/server_server/unstable.html#send-to-device-messaging
+func (t *txnReq) processToDeviceEDU(edu federationclient.EDU) error {
+	var content struct {
+		Sender    string                                `json:"sender"`
+		Type      string                                `json:"type"`
+		MessageID string                                `json:"message_id"`
+		Messages  map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(edu.Content, &content); err != nil {
+		common.GetLogger(t.ctx).WithError(err).Warn("Failed to decode m.direct_to_device EDU")
+		return nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', content.Sender)
+	if err != nil || domain != t.Origin {
+		return nil
+	}
+	localMessages := map[string]map[string]json.RawMessage{}
+	for userID, contents := range content.Messages {
+		_, domain, err = gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != t.Destination {
+			continue
+		}
+		localMessages[userID] = contents
+	}
+	return todevice.Send(t.accountDB, t.deviceDB, t.sendToDeviceProducer, common.SendToDeviceEvent{
+		Sender:    content.Sender,
+		Type:      content.Type,
+		MessageID: content.MessageID,
+	}, localMessages)
+}
+
 type unknownRoomError struct {
 	roomID string
 }
 
 func (e unknownRoomError) Error() string { return fmt.Sprintf("unknown room %q", e.roomID) }
 
-func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
+// processEvent checks an event and passes it to the roomserver. If fillGaps is
+// set and the server is missing the previous events of the event then it tries
+// to fetch them using /backfill or /event before requesting the state at the
+// event.
+func (t *txnReq) processEvent(e gomatrixserverlib.Event, fillGaps bool) error {
+	if err := common.CheckEventSize(e, t.maxEventSize); err != nil {
+		return err
+	}
+
 	prevEventIDs := e.PrevEventIDs()
 
 	// Fetch the state needed to authenticate the event.
@@ -129,7 +388,7 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 		StateToFetch: needed.Tuples(),
 	}
 	var stateResp api.QueryStateAfterEventsResponse
-	if err := t.query.QueryStateAfterEvents(&stateReq, &stateResp); err != nil {
+	if err := t.query.QueryStateAfterEvents(t.ctx, &stateReq, &stateResp); err != nil {
 		return err
 	}
 
@@ -143,8 +402,13 @@ func (t *txnReq) processEvent(e gomatrixserverlib.Event) error {
 		return unknownRoomError{e.RoomID()}
 	}
 
+	// Check that we can handle the events of the room.
+	if err := common.CheckRoomVersion(e.RoomID(), stateResp.RoomVersion); err != nil {
+		return err
+	}
+
 	if !stateResp.PrevEventsExist {
-		return t.processEventWithMissingState(e)
+		return t.processEventWithMissingState(e, fillGaps)
 	}
 
 	// Check that the event is allowed by the state at the event.
@@ -171,7 +435,7 @@ func checkAllowedByState(e gomatrixserverlib.Event, stateEvents []gomatrixserver
 	return gomatrixserverlib.Allowed(e, &authUsingState)
 }
 
-func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event) error {
+func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event, fillGaps bool) error {
 	// We are missing the previous events for this events.
 	// This means that there is a gap in our view of the history of the
 	// room. There two ways that we can handle such a gap:
@@ -186,9 +450,19 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event) error {
 	// event ids and then use /event to fetch the individual events.
 	// However not all version of synapse support /state_ids so you may
 	// need to fallback to /state.
+	// We attempt to fill in the gap using /backfill, and failing that by
+	// fetching the missing events one by one using /event, which works as
+	// long as the gap is small enough.
 	// TODO: Attempt to fill in the gap using /get_missing_events
 	// TODO: Attempt to fetch the state using /state_ids and /events
-	state, err := t.federation.LookupState(t.Origin, e.RoomID(), e.EventID())
+	if fillGaps && (t.fillGapWithBackfill(e) || t.fetchMissingPrevEvents(e)) {
+		return t.processEvent(e, false)
+	}
+	roomVersion, err := t.roomVersion(e.RoomID())
+	if err != nil {
+		return err
+	}
+	state, err := t.federation.LookupState(t.Origin, e.RoomID(), e.EventID(), roomVersion)
 	if err != nil {
 		return err
 	}
@@ -206,3 +480,175 @@ func (t *txnReq) processEventWithMissingState(e gomatrixserverlib.Event) error {
 	}
 	return nil
 }
+
+// The maximum number of events requested from the remote server to fill in a
+// gap in the history of a room.
+const maxBackfillGapEvents = 20
+
+// How far back from an event missing previous events are fetched one by one.
+const maxMissingEventsDepth = 10
+
+// fillGapWithBackfill fetches the events before an event from the server that
+// sent it and passes the ones this server is missing to the roomserver, oldest
+// first. Returns whether all the previous events of the event were filled in.
+// Failures are logged rather than returned, since the state at the event can
+// still be requested instead.
+func (t *txnReq) fillGapWithBackfill(e gomatrixserverlib.Event) bool {
+	logger := common.GetLogger(t.ctx).WithField("event_id", e.EventID())
+	roomVersion, err := t.roomVersion(e.RoomID())
+	if err != nil {
+		logger.WithError(err).Warn("Failed to look up the room version")
+		return false
+	}
+	txn, err := t.federation.Backfill(t.Origin, e.RoomID(), maxBackfillGapEvents, []string{e.EventID()}, roomVersion)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to backfill missing events")
+		return false
+	}
+	var events []gomatrixserverlib.Event
+	for _, event := range txn.PDUs {
+		if event.RoomID() == e.RoomID() && event.EventID() != e.EventID() {
+			events = append(events, event)
+		}
+	}
+	if err = gomatrixserverlib.VerifyEventSignatures(events, t.keys); err != nil {
+		logger.WithError(err).Warn("Failed to verify backfilled events")
+		return false
+	}
+	return t.processMissingEvents(e, events)
+}
+
+// fetchMissingPrevEvents fetches the previous events of an event that this
+// server doesn't have one by one from the server that sent it, then their own
+// missing previous events, going back at most maxMissingEventsDepth events.
+// The fetched events are passed to the roomserver, oldest first. Returns
+// whether all the previous events of the event were filled in.
+// Each event is only requested once per transaction, so that events that can't
+// be fetched don't get requested over and over.
+func (t *txnReq) fetchMissingPrevEvents(e gomatrixserverlib.Event) bool {
+	logger := common.GetLogger(t.ctx).WithField("event_id", e.EventID())
+	if t.fetchAttempts == nil {
+		t.fetchAttempts = make(map[string]bool)
+	}
+	var fetched []gomatrixserverlib.Event
+	fetchedIDs := make(map[string]bool)
+	missing := e.PrevEventIDs()
+	for depth := 0; len(missing) > 0; depth++ {
+		known, err := t.knownEventIDs(missing)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to look up missing events")
+			return false
+		}
+		var next []string
+		for _, eventID := range missing {
+			if known[eventID] || fetchedIDs[eventID] {
+				// Several events can have the same previous event.
+				continue
+			}
+			if depth == maxMissingEventsDepth || t.fetchAttempts[eventID] {
+				return false
+			}
+			t.fetchAttempts[eventID] = true
+			event, err := t.fetchEvent(e.RoomID(), eventID)
+			if err != nil {
+				logger.WithError(err).WithField("missing_event_id", eventID).Warn("Failed to fetch missing event")
+				return false
+			}
+			fetched = append(fetched, event)
+			fetchedIDs[eventID] = true
+			next = append(next, event.PrevEventIDs()...)
+		}
+		missing = next
+	}
+	return t.processMissingEvents(e, fetched)
+}
+
+// fetchEvent requests a single event of a room from the server that sent the
+// transaction and checks its signatures.
+func (t *txnReq) fetchEvent(roomID, eventID string) (gomatrixserverlib.Event, error) {
+	roomVersion, err := t.roomVersion(roomID)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	txn, err := t.federation.GetEvent(t.Origin, eventID, roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Event{}, err
+	}
+	for _, event := range txn.PDUs {
+		if event.EventID() != eventID {
+			continue
+		}
+		if event.RoomID() != roomID {
+			return gomatrixserverlib.Event{}, fmt.Errorf("event %q is in room %q, not %q", eventID, event.RoomID(), roomID)
+		}
+		if err = gomatrixserverlib.VerifyEventSignatures([]gomatrixserverlib.Event{event}, t.keys); err != nil {
+			return gomatrixserverlib.Event{}, err
+		}
+		return event, nil
+	}
+	return gomatrixserverlib.Event{}, fmt.Errorf("event %q wasn't returned", eventID)
+}
+
+// processMissingEvents passes the events that fill in the gap before an event
+// to the roomserver, skipping the ones it already has. Events are processed in
+// order of depth so that the previous events of an event are processed before
+// it. Returns whether all the previous events of the event are known after.
+func (t *txnReq) processMissingEvents(e gomatrixserverlib.Event, events []gomatrixserverlib.Event) bool {
+	logger := common.GetLogger(t.ctx).WithField("event_id", e.EventID())
+	sort.Sort(eventsByDepth(events))
+
+	known, err := t.knownEventIDs(append(e.PrevEventIDs(), eventIDsOf(events)...))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to look up missing events")
+		return false
+	}
+
+	for _, event := range events {
+		if known[event.EventID()] || !allKnown(event.PrevEventIDs(), known) {
+			continue
+		}
+		if err = t.processEvent(event, false); err != nil {
+			logger.WithError(err).WithField("missing_event_id", event.EventID()).Warn("Failed to process missing event")
+			return false
+		}
+		known[event.EventID()] = true
+	}
+	return allKnown(e.PrevEventIDs(), known)
+}
+
+// knownEventIDs returns which of the events the roomserver has.
+func (t *txnReq) knownEventIDs(eventIDs []string) (map[string]bool, error) {
+	queryReq := api.QueryEventsByIDRequest{EventIDs: eventIDs}
+	var queryRes api.QueryEventsByIDResponse
+	if err := t.query.QueryEventsByID(t.ctx, &queryReq, &queryRes); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(queryRes.Events))
+	for _, event := range queryRes.Events {
+		known[event.EventID()] = true
+	}
+	return known, nil
+}
+
+func allKnown(eventIDs []string, known map[string]bool) bool {
+	for _, eventID := range eventIDs {
+		if !known[eventID] {
+			return false
+		}
+	}
+	return true
+}
+
+func eventIDsOf(events []gomatrixserverlib.Event) []string {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	return eventIDs
+}
+
+type eventsByDepth []gomatrixserverlib.Event
+
+func (s eventsByDepth) Len() int           { return len(s) }
+func (s eventsByDepth) Less(i, j int) bool { return s[i].Depth() < s[j].Depth() }
+func (s eventsByDepth) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,92 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestProcessEventTooLarge(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.message",
+		"content": {
+			"body": "`+strings.Repeat("a", 1000)+`",
+			"msgtype": "m.text"
+		},
+		"sender": "@alice:remote",
+		"room_id": "!test:localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$large:remote"
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The event must be rejected before the roomserver is queried, which
+	// would panic as the txnReq has no query API.
+	txn := txnReq{maxEventSize: 1000}
+	if err = txn.processEvent(event, false); err == nil {
+		t.Fatal("wanted an error, got none")
+	}
+	if _, ok := err.(common.EventTooLargeError); !ok {
+		t.Errorf("wanted an EventTooLargeError, got %v", err)
+	}
+}
+
+func TestProcessPresenceEDUIgnoresOtherServers(t *testing.T) {
+	// The presence must be ignored before it is stored, which would panic as
+	// the txnReq has no account database.
+	txn := txnReq{}
+	txn.Origin = "remote"
+	err := txn.processPresenceEDU(federationclient.EDU{
+		Type:   "m.presence",
+		Origin: "remote",
+		Content: []byte(`{"push": [
+			{"user_id": "@alice:other", "presence": "online", "last_active_ago": 5000},
+			{"user_id": "@bob:remote", "presence": "away", "last_active_ago": 5000}
+		]}`),
+	})
+	if err != nil {
+		t.Fatalf("processPresenceEDU: %s", err)
+	}
+}
+
+func TestProcessToDeviceEDUIgnoresOtherServers(t *testing.T) {
+	// The messages must be ignored before they are stored, which would panic
+	// as the txnReq has no databases.
+	txn := txnReq{}
+	txn.Origin = "remote"
+	txn.Destination = "localhost"
+	for _, content := range []string{
+		`{"sender": "@alice:other", "type": "m.test", "message_id": "1",
+			"messages": {"@bob:localhost": {"*": {}}}}`,
+		`{"sender": "@alice:remote", "type": "m.test", "message_id": "2",
+			"messages": {"@bob:other": {"*": {}}}}`,
+	} {
+		err := txn.processToDeviceEDU(federationclient.EDU{
+			Type:    "m.direct_to_device",
+			Origin:  "remote",
+			Content: []byte(content),
+		})
+		if err != nil {
+			t.Fatalf("processToDeviceEDU: %s", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// serverACLContent is the content of a m.room.server_acl event.
+type serverACLContent struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Defaults to true when missing.
+	AllowIPLiterals *bool `json:"allow_ip_literals"`
+}
+
+// serverACLError is returned when a server is denied by the m.room.server_acl
+// event of a room.
+type serverACLError struct {
+	serverName gomatrixserverlib.ServerName
+	roomID     string
+}
+
+func (e serverACLError) Error() string {
+	return fmt.Sprintf("server %q is denied by the server ACL of room %q", e.serverName, e.roomID)
+}
+
+// checkServerACL returns a serverACLError if the server is denied by the
+// current m.room.server_acl event of the room. Servers are allowed in rooms
+// without one.
+// Returns an error if there was a problem talking to the roomserver.
+func checkServerACL(
+	ctx context.Context, query api.RoomserverQueryAPI,
+	roomID string, serverName gomatrixserverlib.ServerName,
+) error {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.server_acl", StateKey: ""},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := query.QueryLatestEventsAndState(ctx, &queryReq, &queryRes); err != nil {
+		return err
+	}
+	for _, event := range queryRes.StateEvents {
+		var content serverACLContent
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			// Ignore ACLs whose content can't be decoded.
+			continue
+		}
+		if !serverAllowedByACL(serverName, content) {
+			return serverACLError{serverName, roomID}
+		}
+	}
+	return nil
+}
+
+// serverAllowedByACL evaluates the server against the content of a
+// m.room.server_acl event. IP literals are denied if allow_ip_literals is
+// false, then the server is denied if it matches any of the deny globs, and
+// otherwise allowed only if it matches one of the allow globs. The port is
+// ignored.
+func serverAllowedByACL(serverName gomatrixserverlib.ServerName, content serverACLContent) bool {
+	host := string(serverName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if content.AllowIPLiterals != nil && !*content.AllowIPLiterals && net.ParseIP(host) != nil {
+		return false
+	}
+	for _, glob := range content.Deny {
+		if matchServerGlob(glob, host) {
+			return false
+		}
+	}
+	for _, glob := range content.Allow {
+		if matchServerGlob(glob, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerGlob returns whether the host matches the glob, where "*" matches
+// any sequence of characters and "?" any single character. Matching is case
+// insensitive.
+func matchServerGlob(glob, host string) bool {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	matched, err := regexp.MatchString("(?i)^"+pattern+"$", host)
+	return err == nil && matched
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestServerAllowedByACL(t *testing.T) {
+	no := false
+	content := serverACLContent{
+		Allow:           []string{"*"},
+		Deny:            []string{"evil.com", "*.evil.com", "bad?.org"},
+		AllowIPLiterals: &no,
+	}
+	tests := []struct {
+		serverName gomatrixserverlib.ServerName
+		allowed    bool
+	}{
+		{"good.org", true},
+		{"good.org:8448", true},
+		{"evil.com", false},
+		{"EVIL.com:8448", false},
+		{"sub.evil.com", false},
+		{"notevil.com", true},
+		{"bad1.org", false},
+		{"bad12.org", true},
+		{"1.2.3.4", false},
+		{"[::1]:8448", false},
+	}
+	for _, test := range tests {
+		if got := serverAllowedByACL(test.serverName, content); got != test.allowed {
+			t.Errorf("serverAllowedByACL(%q): wanted %v, got %v", test.serverName, test.allowed, got)
+		}
+	}
+}
+
+func TestServerAllowedByACLDefaults(t *testing.T) {
+	content := serverACLContent{Allow: []string{"*.example.org"}}
+	if !serverAllowedByACL("1.2.3.4", serverACLContent{Allow: []string{"*"}}) {
+		t.Error("wanted IP literals to be allowed when allow_ip_literals is missing")
+	}
+	if serverAllowedByACL("other.org", content) {
+		t.Error("wanted servers not matching any allow glob to be denied")
+	}
+	if !serverAllowedByACL("matrix.example.org", content) {
+		t.Error("wanted servers matching an allow glob to be allowed")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type txnCacheKey struct {
+	origin gomatrixserverlib.ServerName
+	txnID  gomatrixserverlib.TransactionID
+}
+
+// A txnCacheEntry is a transaction which is being processed or was processed.
+type txnCacheEntry struct {
+	// Closed once the transaction has been processed.
+	done chan struct{}
+	// The response sent for the transaction, set before done is closed. nil
+	// if processing the transaction failed.
+	resp *gomatrixserverlib.RespSend
+}
+
+// TransactionCache remembers the responses we sent for the most recent
+// transactions we processed, so that a transaction which is sent again, e.g.
+// because the remote server didn't get our response, isn't processed twice.
+// It also remembers the transactions being processed, so that a transaction
+// which is sent again before we respond isn't processed at the same time.
+// It is safe for concurrent use.
+type TransactionCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[txnCacheKey]*txnCacheEntry
+	// The keys of the processed transactions in the order they were
+	// processed, used to evict the oldest entries.
+	order []txnCacheKey
+}
+
+// NewTransactionCache creates a cache remembering the responses for the last
+// size transactions.
+func NewTransactionCache(size int) *TransactionCache {
+	return &TransactionCache{
+		size:    size,
+		entries: make(map[txnCacheKey]*txnCacheEntry, size),
+	}
+}
+
+// start marks the transaction with the given ID from the given origin as being
+// processed, unless it was already processed or is being processed, in which
+// case it returns the entry for it and false. The caller must call finish once
+// it processed the transaction if start returned true.
+func (c *TransactionCache) start(
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+) (*txnCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := txnCacheKey{origin, txnID}
+	if entry, ok := c.entries[key]; ok {
+		return entry, false
+	}
+	entry := &txnCacheEntry{done: make(chan struct{})}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// finish stores the response sent for a transaction marked as being processed
+// by start, evicting the oldest entry if the cache is full. If resp is nil
+// then processing the transaction failed, and it is forgotten so that it can
+// be sent again.
+func (c *TransactionCache) finish(
+	origin gomatrixserverlib.ServerName, txnID gomatrixserverlib.TransactionID,
+	resp *gomatrixserverlib.RespSend,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := txnCacheKey{origin, txnID}
+	entry := c.entries[key]
+	entry.resp = resp
+	close(entry.done)
+	if resp == nil {
+		delete(c.entries, key)
+		return
+	}
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.order = append(c.order, key)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package writers
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestTransactionCacheInFlight(t *testing.T) {
+	cache := NewTransactionCache(1)
+	if _, started := cache.start("remote", "txn1"); !started {
+		t.Fatal("wanted to start processing a new transaction")
+	}
+	entry, started := cache.start("remote", "txn1")
+	if started {
+		t.Fatal("wanted a transaction being processed not to be processed again")
+	}
+
+	resp := &gomatrixserverlib.RespSend{}
+	cache.finish("remote", "txn1", resp)
+	<-entry.done
+	if entry.resp != resp {
+		t.Errorf("wanted the duplicate to get the response of the transaction")
+	}
+	if entry, started = cache.start("remote", "txn1"); started || entry.resp != resp {
+		t.Errorf("wanted the response of a processed transaction to be remembered")
+	}
+}
+
+func TestTransactionCacheForgetsFailures(t *testing.T) {
+	cache := NewTransactionCache(1)
+	cache.start("remote", "txn1")
+	cache.finish("remote", "txn1", nil)
+	if _, started := cache.start("remote", "txn1"); !started {
+		t.Errorf("wanted a transaction which failed to be processed again")
+	}
+}
+
+func TestTransactionCacheEvictsOldest(t *testing.T) {
+	cache := NewTransactionCache(1)
+	cache.start("remote", "txn1")
+	cache.finish("remote", "txn1", &gomatrixserverlib.RespSend{})
+	cache.start("remote", "txn2")
+	cache.finish("remote", "txn2", &gomatrixserverlib.RespSend{})
+	if _, started := cache.start("remote", "txn1"); !started {
+		t.Errorf("wanted the oldest transaction to be forgotten")
+	}
+	if _, started := cache.start("remote", "txn2"); started {
+		t.Errorf("wanted the latest transaction to be remembered")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type blacklistResponse struct {
+	Destinations []types.BlacklistEntry `json:"destinations"`
+}
+
+// GetBlacklist implements GET /_dendrite/admin/v1/federation_blacklist
+func GetBlacklist(req *http.Request, queues *queue.OutgoingQueues) util.JSONResponse {
+	entries, err := queues.Blacklist()
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if entries == nil {
+		entries = []types.BlacklistEntry{}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: blacklistResponse{Destinations: entries},
+	}
+}
+
+// RemoveFromBlacklist implements DELETE /_dendrite/admin/v1/federation_blacklist/{serverName}
+func RemoveFromBlacklist(
+	req *http.Request, queues *queue.OutgoingQueues, serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if err := queues.RemoveFromBlacklist(serverName); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
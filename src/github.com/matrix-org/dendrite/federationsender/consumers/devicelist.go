@@ -0,0 +1,165 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputDeviceListUpdate consumes device list updates that originated in the client API server.
+type OutputDeviceListUpdate struct {
+	deviceListConsumer *common.ContinualConsumer
+	db                 *storage.Database
+	queues             *queue.OutgoingQueues
+	serverName         gomatrixserverlib.ServerName
+}
+
+// NewOutputDeviceListUpdate creates a new OutputDeviceListUpdate consumer. Call Start() to begin consuming from the client API server.
+func NewOutputDeviceListUpdate(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store *storage.Database,
+) *OutputDeviceListUpdate {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputDeviceListUpdate),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputDeviceListUpdate{
+		deviceListConsumer: &consumer,
+		db:                 store,
+		queues:             queues,
+		serverName:         cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputDeviceListUpdate) Start() error {
+	return s.deviceListConsumer.Start()
+}
+
+// onMessage is called when the federation server receives a new device list
+// update from the client API server output log. The update is sent as an
+// m.device_list_update EDU, or an m.signing_key_update EDU if it is about the
+// cross-signing keys of the user, to every server sharing a room with the user.
+func (s *OutputDeviceListUpdate) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.DeviceListUpdate
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server device list log: message parse failure")
+		return nil
+	}
+
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	var destinations []gomatrixserverlib.ServerName
+	for _, roomID := range output.RoomIDs {
+		joinedHosts, err := s.db.GetJoinedHosts(roomID)
+		if err != nil {
+			return err
+		}
+		for _, host := range joinedHosts {
+			if !seen[host.ServerName] {
+				seen[host.ServerName] = true
+				destinations = append(destinations, host.ServerName)
+			}
+		}
+	}
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	if output.MasterKey != nil || output.SelfSigningKey != nil {
+		return s.sendSigningKeyUpdate(output, destinations)
+	}
+
+	content, err := deviceListUpdateContent(output)
+	if err != nil {
+		return err
+	}
+
+	edu := &federationclient.EDU{
+		Type:    "m.device_list_update",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+	return s.queues.SendEDU(edu, s.serverName, destinations)
+}
+
+// deviceListUpdateContent returns the content of the m.device_list_update EDU
+// for a device list update.
+func deviceListUpdateContent(output common.DeviceListUpdate) (json.RawMessage, error) {
+	// The stream IDs of a user are consecutive, so the previous update is
+	// always the one before this one, if any.
+	prevIDs := []int64{}
+	if output.StreamID > 1 {
+		prevIDs = append(prevIDs, output.StreamID-1)
+	}
+
+	// https://matrix.org/docs/spec/server_server/unstable.html#m-device-list-update-schema
+	update := map[string]interface{}{
+		"user_id":             output.UserID,
+		"device_id":           output.DeviceID,
+		"device_display_name": output.DeviceDisplayName,
+		"stream_id":           output.StreamID,
+		"prev_id":             prevIDs,
+		"deleted":             output.Deleted,
+	}
+	if output.Keys != nil {
+		update["keys"] = output.Keys
+	}
+	content, err := json.Marshal(update)
+	return json.RawMessage(content), err
+}
+
+// sendSigningKeyUpdate sends an update to the cross-signing keys of a user as
+// an m.signing_key_update EDU to the given servers.
+func (s *OutputDeviceListUpdate) sendSigningKeyUpdate(
+	output common.DeviceListUpdate, destinations []gomatrixserverlib.ServerName,
+) error {
+	// https://matrix.org/docs/spec/server_server/r0.1.4.html#m-signing-key-update-schema
+	update := map[string]interface{}{
+		"user_id": output.UserID,
+	}
+	if output.MasterKey != nil {
+		update["master_key"] = output.MasterKey
+	}
+	if output.SelfSigningKey != nil {
+		update["self_signing_key"] = output.SelfSigningKey
+	}
+	content, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	edu := &federationclient.EDU{
+		Type:    "m.signing_key_update",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+	return s.queues.SendEDU(edu, s.serverName, destinations)
+}
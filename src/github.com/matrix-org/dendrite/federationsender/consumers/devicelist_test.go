@@ -0,0 +1,57 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common"
+)
+
+func TestDeviceListUpdateContentPrevID(t *testing.T) {
+	tests := []struct {
+		streamID int64
+		want     []int64
+	}{
+		{1, []int64{}},
+		{2, []int64{1}},
+		{7, []int64{6}},
+	}
+	for _, tt := range tests {
+		content, err := deviceListUpdateContent(common.DeviceListUpdate{
+			UserID:   "@alice:localhost",
+			DeviceID: "ALICEDEVICE",
+			StreamID: tt.streamID,
+		})
+		if err != nil {
+			t.Fatalf("deviceListUpdateContent: %s", err)
+		}
+		var got struct {
+			StreamID int64   `json:"stream_id"`
+			PrevID   []int64 `json:"prev_id"`
+		}
+		if err = json.Unmarshal(content, &got); err != nil {
+			t.Fatalf("json.Unmarshal: %s", err)
+		}
+		if got.StreamID != tt.streamID {
+			t.Errorf("wanted stream_id %d, got %d", tt.streamID, got.StreamID)
+		}
+		if got.PrevID == nil || !reflect.DeepEqual(got.PrevID, tt.want) {
+			t.Errorf("stream_id %d: wanted prev_id %v, got %v", tt.streamID, tt.want, got.PrevID)
+		}
+	}
+}
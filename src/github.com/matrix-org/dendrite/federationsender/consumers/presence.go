@@ -0,0 +1,124 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputPresenceEvent consumes presence updates that originated in the client API server.
+type OutputPresenceEvent struct {
+	presenceConsumer *common.ContinualConsumer
+	db               *storage.Database
+	queues           *queue.OutgoingQueues
+	serverName       gomatrixserverlib.ServerName
+}
+
+// NewOutputPresenceEvent creates a new OutputPresenceEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputPresenceEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store *storage.Database,
+) *OutputPresenceEvent {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputPresenceEvent{
+		presenceConsumer: &consumer,
+		db:               store,
+		queues:           queues,
+		serverName:       cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputPresenceEvent) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+// onMessage is called when the federation server receives a new presence
+// update from the client API server output log. The update is sent as an
+// m.presence EDU to every server sharing a room with the user.
+func (s *OutputPresenceEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.PresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server presence log: message parse failure")
+		return nil
+	}
+
+	seen := make(map[gomatrixserverlib.ServerName]bool)
+	var destinations []gomatrixserverlib.ServerName
+	for _, roomID := range output.RoomIDs {
+		joinedHosts, err := s.db.GetJoinedHosts(roomID)
+		if err != nil {
+			return err
+		}
+		for _, host := range joinedHosts {
+			if !seen[host.ServerName] {
+				seen[host.ServerName] = true
+				destinations = append(destinations, host.ServerName)
+			}
+		}
+	}
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	// https://matrix.org/docs/spec/server_server/unstable.html#presence
+	type presenceUpdate struct {
+		UserID          string `json:"user_id"`
+		Presence        string `json:"presence"`
+		StatusMsg       string `json:"status_msg,omitempty"`
+		LastActiveAgo   int64  `json:"last_active_ago"`
+		CurrentlyActive bool   `json:"currently_active"`
+	}
+	lastActive := gomatrixserverlib.Timestamp(output.LastActiveTS).Time()
+	content, err := json.Marshal(map[string][]presenceUpdate{
+		"push": {{
+			UserID:          output.UserID,
+			Presence:        output.Presence,
+			StatusMsg:       output.StatusMsg,
+			LastActiveAgo:   int64(time.Since(lastActive) / time.Millisecond),
+			CurrentlyActive: output.Presence == "online",
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	edu := &federationclient.EDU{
+		Type:    "m.presence",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+	return s.queues.SendEDU(edu, s.serverName, destinations)
+}
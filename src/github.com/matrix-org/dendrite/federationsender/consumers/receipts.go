@@ -0,0 +1,109 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputReceiptEvent consumes receipts that originated in the client API server.
+type OutputReceiptEvent struct {
+	receiptConsumer *common.ContinualConsumer
+	db              *storage.Database
+	queues          *queue.OutgoingQueues
+	serverName      gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEvent creates a new OutputReceiptEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputReceiptEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store *storage.Database,
+) *OutputReceiptEvent {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputReceiptEvent{
+		receiptConsumer: &consumer,
+		db:              store,
+		queues:          queues,
+		serverName:      cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputReceiptEvent) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+// onMessage is called when the federation server receives a new receipt from
+// the client API server output log. The receipt is sent as an m.receipt EDU to
+// the other servers joined to the room.
+func (s *OutputReceiptEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.ReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server receipt log: message parse failure")
+		return nil
+	}
+
+	joinedHosts, err := s.db.GetJoinedHosts(output.RoomID)
+	if err != nil {
+		return err
+	}
+	var destinations []gomatrixserverlib.ServerName
+	for _, host := range joinedHosts {
+		destinations = append(destinations, host.ServerName)
+	}
+
+	// The content of the EDU is a map of room ID => receipt type => user ID => receipt.
+	// https://matrix.org/docs/spec/server_server/unstable.html#receipts
+	type receipt struct {
+		EventIDs []string `json:"event_ids"`
+		Data     struct {
+			Timestamp int64 `json:"ts"`
+		} `json:"data"`
+	}
+	r := receipt{EventIDs: []string{output.EventID}}
+	r.Data.Timestamp = output.Timestamp
+	content, err := json.Marshal(map[string]map[string]map[string]receipt{
+		output.RoomID: {output.Type: {output.UserID: r}},
+	})
+	if err != nil {
+		return err
+	}
+
+	edu := &federationclient.EDU{
+		Type:    "m.receipt",
+		Origin:  string(s.serverName),
+		Content: content,
+	}
+	return s.queues.SendEDU(edu, s.serverName, destinations)
+}
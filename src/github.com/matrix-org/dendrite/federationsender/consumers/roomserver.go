@@ -15,6 +15,7 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -140,6 +141,10 @@ func (s *OutputRoomEvent) processMessage(ore api.OutputNewRoomEvent) error {
 		return err
 	}
 
+	// A m.room.member event also needs to reach the server of the user it
+	// targets, even when that server isn't in the room yet, e.g. for invites.
+	joinedHostsAtEvent = appendTargetServer(joinedHostsAtEvent, ore.Event)
+
 	// Send the event.
 	if err = s.queues.SendEvent(
 		&ore.Event, gomatrixserverlib.ServerName(ore.SendAsServer), joinedHostsAtEvent,
@@ -150,6 +155,26 @@ func (s *OutputRoomEvent) processMessage(ore api.OutputNewRoomEvent) error {
 	return nil
 }
 
+// appendTargetServer adds the server of the user targeted by a m.room.member
+// event to the list of destinations, if it isn't already in it.
+func appendTargetServer(
+	destinations []gomatrixserverlib.ServerName, ev gomatrixserverlib.Event,
+) []gomatrixserverlib.ServerName {
+	if ev.Type() != "m.room.member" || ev.StateKey() == nil {
+		return destinations
+	}
+	_, serverName, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+	if err != nil {
+		return destinations
+	}
+	for _, destination := range destinations {
+		if destination == serverName {
+			return destinations
+		}
+	}
+	return append(destinations, serverName)
+}
+
 // joinedHostsAtEvent works out a list of matrix servers that were joined to
 // the room at the event.
 // It is important to use the state at the event for sending messages because:
@@ -312,7 +337,7 @@ func (s *OutputRoomEvent) lookupStateEvents(
 	// from the roomserver using the query API.
 	eventReq := api.QueryEventsByIDRequest{EventIDs: missing}
 	var eventResp api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(&eventReq, &eventResp); err != nil {
+	if err := s.query.QueryEventsByID(context.Background(), &eventReq, &eventResp); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,117 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputSendToDeviceEvent consumes to-device messages that originated in the client API server.
+type OutputSendToDeviceEvent struct {
+	sendToDeviceConsumer *common.ContinualConsumer
+	queues               *queue.OutgoingQueues
+	serverName           gomatrixserverlib.ServerName
+}
+
+// NewOutputSendToDeviceEvent creates a new OutputSendToDeviceEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputSendToDeviceEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store *storage.Database,
+) *OutputSendToDeviceEvent {
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputSendToDeviceEvent{
+		sendToDeviceConsumer: &consumer,
+		queues:               queues,
+		serverName:           cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputSendToDeviceEvent) Start() error {
+	return s.sendToDeviceConsumer.Start()
+}
+
+// onMessage is called when the federation server receives new to-device
+// messages from the client API server output log. The messages for users on
+// other servers are sent to each of their servers as an m.direct_to_device
+// EDU.
+func (s *OutputSendToDeviceEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.SendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server send to device log: message parse failure")
+		return nil
+	}
+
+	// Map of server name => user ID => device ID => content
+	messages := map[gomatrixserverlib.ServerName]map[string]map[string]json.RawMessage{}
+	for userID, contents := range output.RemoteMessages {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Warn("Dropping to-device message for invalid user ID")
+			continue
+		}
+		if messages[domain] == nil {
+			messages[domain] = map[string]map[string]json.RawMessage{}
+		}
+		messages[domain][userID] = contents
+	}
+
+	// https://matrix.org/docs/spec/server_server/unstable.html#send-to-device-messaging
+	type directToDevice struct {
+		Sender    string                                `json:"sender"`
+		Type      string                                `json:"type"`
+		MessageID string                                `json:"message_id"`
+		Messages  map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	for destination, destMessages := range messages {
+		content, err := json.Marshal(directToDevice{
+			Sender:    output.Sender,
+			Type:      output.Type,
+			MessageID: output.MessageID,
+			Messages:  destMessages,
+		})
+		if err != nil {
+			return err
+		}
+		edu := &federationclient.EDU{
+			Type:    "m.direct_to_device",
+			Origin:  string(s.serverName),
+			Content: content,
+		}
+		if err = s.queues.SendEDU(edu, s.serverName, []gomatrixserverlib.ServerName{destination}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// blacklist mirrors the blacklist table of the database so that the queues
+// don't have to query it for every item they send.
+type blacklist struct {
+	// The mutex protects destinations.
+	mutex sync.Mutex
+	// The destinations with failures recorded in the database, mapped to
+	// whether they are blacklisted.
+	destinations map[gomatrixserverlib.ServerName]bool
+}
+
+func newBlacklist() *blacklist {
+	return &blacklist{destinations: map[gomatrixserverlib.ServerName]bool{}}
+}
+
+// isBlacklisted returns whether nothing should be sent to the destination.
+func (b *blacklist) isBlacklisted(destination gomatrixserverlib.ServerName) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.destinations[destination]
+}
+
+// hasFailures returns whether failures are recorded for the destination.
+func (b *blacklist) hasFailures(destination gomatrixserverlib.ServerName) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.destinations[destination]
+	return ok
+}
+
+// set records whether the destination is blacklisted.
+func (b *blacklist) set(destination gomatrixserverlib.ServerName, blacklisted bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.destinations[destination] = blacklisted
+}
+
+// remove forgets the failures recorded for the destination.
+func (b *blacklist) remove(destination gomatrixserverlib.ServerName) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.destinations, destination)
+}
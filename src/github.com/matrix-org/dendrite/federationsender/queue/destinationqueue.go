@@ -16,78 +16,354 @@ package queue
 
 import (
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var sendFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "send_failures_total",
+		Help:      "The number of failed attempts to send a transaction, by destination server",
+	},
+	[]string{"destination"},
+)
+
+var deadDestinations = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationsender",
+		Name:      "dead_destinations",
+		Help:      "The number of destination servers we are currently failing to send transactions to",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(sendFailures, deadDestinations)
+}
+
+// A pendingPDU is a PDU waiting in a destination queue.
+type pendingPDU struct {
+	queueNID      int64
+	transactionID gomatrixserverlib.TransactionID
+	pdu           *gomatrixserverlib.Event
+}
+
+// A pendingEDU is an EDU waiting in a destination queue.
+type pendingEDU struct {
+	queueNID      int64
+	transactionID gomatrixserverlib.TransactionID
+	edu           *federationclient.EDU
+}
+
+// A transactionSender sends transactions to other servers, e.g. a
+// federationclient.Client.
+type transactionSender interface {
+	SendTransaction(t federationclient.Transaction) (gomatrixserverlib.RespSend, error)
+}
+
+// A failedTransaction is a transaction waiting to be sent again after failing
+// to be sent.
+type failedTransaction struct {
+	transaction *federationclient.Transaction
+	queueNIDs   []int64
+	// The number of failed attempts at sending the transaction.
+	attempts int
+	// The delay before the next attempt, before jitter.
+	delay time.Duration
+}
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
 // at a time.
 type destinationQueue struct {
-	client      *gomatrixserverlib.FederationClient
+	db          Database
+	client      transactionSender
 	origin      gomatrixserverlib.ServerName
 	destination gomatrixserverlib.ServerName
-	// The running mutex protects running, sentCounter, lastTransactionIDs and
-	// pendingEvents.
+	// The maximum number of PDUs and EDUs to send in a single transaction.
+	maxPDUs int
+	maxEDUs int
+	// How long to wait for more items before sending a transaction.
+	transactionDelay time.Duration
+	// The number of consecutive failures after which the destination is
+	// blacklisted.
+	blacklistAfterFailures int64
+	blacklist              *blacklist
+	// The running mutex protects running, sentCounter, lastTransactionIDs,
+	// pendingEvents and pendingEDUs.
 	runningMutex       sync.Mutex
 	running            bool
 	sentCounter        int
 	lastTransactionIDs []gomatrixserverlib.TransactionID
-	pendingEvents      []*gomatrixserverlib.Event
+	pendingEvents      []pendingPDU
+	pendingEDUs        []pendingEDU
+	// Whether we gave up retrying the last transaction with the normal
+	// backoff. Only accessed by the background sending goroutine.
+	dead bool
+	// The transaction to send again once retryTimer fires, if the last
+	// attempt failed. The queue stays running while waiting, so items queued
+	// in the meantime are sent after it. Only accessed by the background
+	// sending goroutine, which is restarted by the timer.
+	retrying   *failedTransaction
+	retryTimer *time.Timer
 }
 
 // Send event adds the event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending events to that destination.
-func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.Event) {
+func (oq *destinationQueue) sendEvent(queueNID int64, ev *gomatrixserverlib.Event) {
+	oq.runningMutex.Lock()
+	defer oq.runningMutex.Unlock()
+	oq.pendingEvents = append(oq.pendingEvents, pendingPDU{queueNID: queueNID, pdu: ev})
+	oq.start()
+}
+
+// sendEDU adds the EDU to the pending queue for the destination.
+// If the queue is empty then it starts a background goroutine to
+// start sending events to that destination.
+func (oq *destinationQueue) sendEDU(queueNID int64, e *federationclient.EDU) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
-	oq.pendingEvents = append(oq.pendingEvents, ev)
+	oq.pendingEDUs = append(oq.pendingEDUs, pendingEDU{queueNID: queueNID, edu: e})
+	oq.start()
+}
+
+// start starts the background goroutine sending to the destination if it
+// isn't already running. The running mutex must be held.
+func (oq *destinationQueue) start() {
 	if !oq.running {
 		oq.running = true
 		go oq.backgroundSend()
 	}
 }
 
+const (
+	// The delay before retrying a transaction the first time it fails.
+	initialRetryDelay = 5 * time.Second
+	// The maximum delay between two attempts at sending a transaction.
+	maxRetryDelay = 30 * time.Minute
+	// The number of attempts at sending a transaction before the destination
+	// is considered dead.
+	maxSendAttempts = 10
+	// The delay between two attempts at sending a transaction to a dead
+	// destination.
+	deadRetryDelay = 6 * time.Hour
+)
+
+// backgroundSend sends the queued items to the destination until the queues
+// are empty. If a transaction fails to be sent then it schedules sending it
+// again and returns, rather than waiting for the retry.
 func (oq *destinationQueue) backgroundSend() {
 	for {
-		t := oq.next()
-		if t == nil {
-			// If the queue is empty then stop processing for this destination.
-			// TODO: Remove this destination from the queue map.
+		failed := oq.retrying
+		oq.retrying = nil
+		if failed == nil {
+			if oq.transactionDelay > 0 {
+				// Give more items a chance to join this transaction.
+				time.Sleep(oq.transactionDelay)
+			}
+
+			t, queueNIDs := oq.next()
+			if t == nil {
+				// If the queue is empty then stop processing for this destination.
+				// TODO: Remove this destination from the queue map.
+				return
+			}
+			failed = &failedTransaction{transaction: t, queueNIDs: queueNIDs}
+		}
+
+		sent, blacklisted := oq.send(failed)
+		if blacklisted {
+			oq.drop()
 			return
 		}
+		if !sent {
+			oq.retrying = failed
+			oq.retryTimer = time.AfterFunc(oq.nextRetryDelay(failed), oq.backgroundSend)
+			return
+		}
+	}
+}
 
-		// TODO: handle retries.
-		// TODO: blacklist uncooperative servers.
+// drop removes everything queued for the destination after it has been
+// blacklisted, and stops processing for it.
+func (oq *destinationQueue) drop() {
+	oq.runningMutex.Lock()
+	oq.pendingEvents = nil
+	oq.pendingEDUs = nil
+	oq.running = false
+	oq.runningMutex.Unlock()
+
+	if oq.dead {
+		oq.dead = false
+		deadDestinations.Dec()
+	}
 
-		_, err := oq.client.SendTransaction(*t)
-		if err != nil {
+	if err := oq.db.DeleteDestinationQueueItems(oq.destination); err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			log.ErrorKey:  err,
+		}).Error("failed to remove the items queued for a blacklisted destination")
+	}
+}
+
+// send attempts to send the transaction to the destination. The same
+// transaction ID is used for each attempt so the destination can tell the
+// retries apart from new transactions. After maxSendAttempts failed attempts
+// the destination is marked as dead. The items in the transaction are removed
+// from the database once sent.
+// Returns whether the transaction was sent, and whether the destination was
+// blacklisted after failing too many times.
+func (oq *destinationQueue) send(failed *failedTransaction) (sent bool, blacklisted bool) {
+	t := failed.transaction
+	if _, err := oq.client.SendTransaction(*t); err != nil {
+		failed.attempts++
+		sendFailures.WithLabelValues(string(oq.destination)).Inc()
+		logger := log.WithFields(log.Fields{
+			"destination":    oq.destination,
+			"transaction_id": t.TransactionID,
+			"attempt":        failed.attempts,
+			log.ErrorKey:     err,
+		})
+		if oq.recordFailure() {
+			logger.Warn("blacklisting destination")
+			return false, true
+		}
+		if !oq.dead && failed.attempts >= maxSendAttempts {
+			logger.Warn("marking destination as dead")
+			oq.dead = true
+			deadDestinations.Inc()
+		}
+		logger.Info("problem sending transaction")
+		return false, false
+	}
+
+	if oq.dead {
+		log.WithField("destination", oq.destination).Info("destination is reachable again")
+		oq.dead = false
+		deadDestinations.Dec()
+	}
+
+	if oq.blacklist.hasFailures(oq.destination) {
+		if err := oq.db.ClearDestinationFailures(oq.destination); err != nil {
 			log.WithFields(log.Fields{
 				"destination": oq.destination,
 				log.ErrorKey:  err,
-			}).Info("problem sending transaction")
+			}).Error("failed to clear the failures of a destination")
+		} else {
+			oq.blacklist.remove(oq.destination)
+		}
+	}
+
+	if err := oq.db.DeleteQueueItems(failed.queueNIDs); err != nil {
+		// The items will be sent again with the same transaction ID after a
+		// restart, which the destination will ignore.
+		log.WithFields(log.Fields{
+			"destination":    oq.destination,
+			"transaction_id": t.TransactionID,
+			log.ErrorKey:     err,
+		}).Error("failed to remove sent items from the queue")
+	}
+	return true, false
+}
+
+// nextRetryDelay returns how long to wait before sending a failed transaction
+// again. The delay grows exponentially with each failed attempt, up to
+// maxRetryDelay, and is deadRetryDelay once the destination is dead.
+func (oq *destinationQueue) nextRetryDelay(failed *failedTransaction) time.Duration {
+	if oq.dead {
+		failed.delay = deadRetryDelay
+	} else if failed.delay == 0 {
+		failed.delay = initialRetryDelay
+	}
+	wait := jitter(failed.delay)
+	log.WithFields(log.Fields{
+		"destination":    oq.destination,
+		"transaction_id": failed.transaction.TransactionID,
+		"retry_in":       wait,
+	}).Info("scheduled retry of transaction")
+	if !oq.dead {
+		failed.delay *= 2
+		if failed.delay > maxRetryDelay {
+			failed.delay = maxRetryDelay
 		}
 	}
+	return wait
 }
 
-// next creates a new transaction from the pending event queue
-// and flushes the queue.
-// Returns nil if the queue was empty.
-func (oq *destinationQueue) next() *gomatrixserverlib.Transaction {
+// recordFailure stores a failed attempt at sending a transaction to the
+// destination, and blacklists the destination if there were too many
+// consecutive failures. Returns whether the destination was blacklisted.
+func (oq *destinationQueue) recordFailure() bool {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	failureCount, err := oq.db.AddDestinationFailure(oq.destination, now)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			log.ErrorKey:  err,
+		}).Error("failed to record a failure to send to a destination")
+		return false
+	}
+	if failureCount < oq.blacklistAfterFailures {
+		oq.blacklist.set(oq.destination, false)
+		return false
+	}
+	if err = oq.db.BlacklistDestination(oq.destination); err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			log.ErrorKey:  err,
+		}).Error("failed to blacklist a destination")
+		return false
+	}
+	oq.blacklist.set(oq.destination, true)
+	return true
+}
+
+// jitter returns a random duration between half and one and a half times d,
+// so that retries to many destinations don't all happen at the same time.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// next creates a new transaction from the pending event and EDU queues
+// and removes the items it contains from the queues. The transaction holds
+// at most maxPDUs PDUs and maxEDUs EDUs. Items that were already assigned a
+// transaction before a restart are sent together again in that transaction,
+// regardless of the limits.
+// Returns the transaction and the queue NIDs of its items, or nil if the
+// queues were empty.
+func (oq *destinationQueue) next() (*federationclient.Transaction, []int64) {
 	oq.runningMutex.Lock()
 	defer oq.runningMutex.Unlock()
-	if len(oq.pendingEvents) == 0 {
+	if len(oq.pendingEvents) == 0 && len(oq.pendingEDUs) == 0 {
 		oq.running = false
-		return nil
+		return nil, nil
 	}
-	var t gomatrixserverlib.Transaction
+
+	// Items restored from the database are at the front of the queues.
+	var transactionID gomatrixserverlib.TransactionID
+	if len(oq.pendingEvents) > 0 {
+		transactionID = oq.pendingEvents[0].transactionID
+	}
+	if transactionID == "" && len(oq.pendingEDUs) > 0 {
+		transactionID = oq.pendingEDUs[0].transactionID
+	}
+
+	var t federationclient.Transaction
 	now := gomatrixserverlib.AsTimestamp(time.Now())
-	t.TransactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, oq.sentCounter))
+	t.TransactionID = transactionID
+	if t.TransactionID == "" {
+		t.TransactionID = gomatrixserverlib.TransactionID(fmt.Sprintf("%d-%d", now, oq.sentCounter))
+	}
 	t.Origin = oq.origin
 	t.Destination = oq.destination
 	t.OriginServerTS = now
@@ -96,10 +372,34 @@ func (oq *destinationQueue) next() *gomatrixserverlib.Transaction {
 		t.PreviousIDs = []gomatrixserverlib.TransactionID{}
 	}
 	oq.lastTransactionIDs = []gomatrixserverlib.TransactionID{t.TransactionID}
-	for _, pdu := range oq.pendingEvents {
-		t.PDUs = append(t.PDUs, *pdu)
+
+	var queueNIDs []int64
+	n := 0
+	for n < len(oq.pendingEvents) && (transactionID != "" || n < oq.maxPDUs) && oq.pendingEvents[n].transactionID == transactionID {
+		t.PDUs = append(t.PDUs, *oq.pendingEvents[n].pdu)
+		queueNIDs = append(queueNIDs, oq.pendingEvents[n].queueNID)
+		n++
 	}
-	oq.pendingEvents = nil
-	oq.sentCounter += len(t.PDUs)
-	return &t
+	oq.pendingEvents = oq.pendingEvents[n:]
+	n = 0
+	for n < len(oq.pendingEDUs) && (transactionID != "" || n < oq.maxEDUs) && oq.pendingEDUs[n].transactionID == transactionID {
+		t.EDUs = append(t.EDUs, *oq.pendingEDUs[n].edu)
+		queueNIDs = append(queueNIDs, oq.pendingEDUs[n].queueNID)
+		n++
+	}
+	oq.pendingEDUs = oq.pendingEDUs[n:]
+	oq.sentCounter += len(t.PDUs) + len(t.EDUs)
+
+	if transactionID == "" {
+		// Remember the transaction ID so that the items are sent in the same
+		// transaction if we restart before the destination receives them.
+		if err := oq.db.SetQueueItemsTransactionID(queueNIDs, t.TransactionID); err != nil {
+			log.WithFields(log.Fields{
+				"destination":    oq.destination,
+				"transaction_id": t.TransactionID,
+				log.ErrorKey:     err,
+			}).Error("failed to store the transaction ID of queued items")
+		}
+	}
+	return &t, queueNIDs
 }
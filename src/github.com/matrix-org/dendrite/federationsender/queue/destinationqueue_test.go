@@ -0,0 +1,168 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeDatabase struct {
+	transactionIDs map[int64]gomatrixserverlib.TransactionID
+}
+
+func (d *fakeDatabase) QueuePDU(gomatrixserverlib.ServerName, *gomatrixserverlib.Event) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeDatabase) QueueEDU(gomatrixserverlib.ServerName, *federationclient.EDU) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeDatabase) SetQueueItemsTransactionID(queueNIDs []int64, transactionID gomatrixserverlib.TransactionID) error {
+	for _, queueNID := range queueNIDs {
+		d.transactionIDs[queueNID] = transactionID
+	}
+	return nil
+}
+
+func (d *fakeDatabase) DeleteQueueItems([]int64) error {
+	return nil
+}
+
+func (d *fakeDatabase) DeleteDestinationQueueItems(gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *fakeDatabase) QueueItems() ([]types.QueueItem, error) {
+	return nil, nil
+}
+
+func (d *fakeDatabase) AddDestinationFailure(gomatrixserverlib.ServerName, gomatrixserverlib.Timestamp) (int64, error) {
+	return 0, nil
+}
+
+func (d *fakeDatabase) BlacklistDestination(gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *fakeDatabase) ClearDestinationFailures(gomatrixserverlib.ServerName) error {
+	return nil
+}
+
+func (d *fakeDatabase) Blacklist() ([]types.BlacklistEntry, error) {
+	return nil, nil
+}
+
+// fakeSender records the IDs of the transactions it is asked to send, and
+// fails to send them while failing is set.
+type fakeSender struct {
+	failing        bool
+	transactionIDs []gomatrixserverlib.TransactionID
+}
+
+func (s *fakeSender) SendTransaction(t federationclient.Transaction) (gomatrixserverlib.RespSend, error) {
+	s.transactionIDs = append(s.transactionIDs, t.TransactionID)
+	if s.failing {
+		return gomatrixserverlib.RespSend{}, errors.New("connection refused")
+	}
+	return gomatrixserverlib.RespSend{}, nil
+}
+
+func TestNextLimitsTransactionSize(t *testing.T) {
+	db := &fakeDatabase{transactionIDs: map[int64]gomatrixserverlib.TransactionID{}}
+	oq := &destinationQueue{db: db, destination: "remote", maxPDUs: 2, maxEDUs: 1}
+	for i := int64(1); i <= 3; i++ {
+		oq.pendingEvents = append(oq.pendingEvents, pendingPDU{queueNID: i, pdu: &gomatrixserverlib.Event{}})
+		oq.pendingEDUs = append(oq.pendingEDUs, pendingEDU{queueNID: 10 + i, edu: &federationclient.EDU{}})
+	}
+
+	txn, queueNIDs := oq.next()
+	if len(txn.PDUs) != 2 || len(txn.EDUs) != 1 {
+		t.Fatalf("wanted 2 PDUs and 1 EDU, got %d PDUs and %d EDUs", len(txn.PDUs), len(txn.EDUs))
+	}
+	if len(queueNIDs) != 3 {
+		t.Fatalf("wanted 3 queue NIDs, got %v", queueNIDs)
+	}
+	for _, queueNID := range queueNIDs {
+		if db.transactionIDs[queueNID] != txn.TransactionID {
+			t.Errorf("wanted item %d to be stored with transaction ID %q, got %q", queueNID, txn.TransactionID, db.transactionIDs[queueNID])
+		}
+	}
+	if len(oq.pendingEvents) != 1 || len(oq.pendingEDUs) != 2 {
+		t.Errorf("wanted 1 PDU and 2 EDUs left, got %d PDUs and %d EDUs", len(oq.pendingEvents), len(oq.pendingEDUs))
+	}
+}
+
+func TestNextResendsRestoredTransaction(t *testing.T) {
+	db := &fakeDatabase{transactionIDs: map[int64]gomatrixserverlib.TransactionID{}}
+	oq := &destinationQueue{db: db, destination: "remote", maxPDUs: 1, maxEDUs: 1}
+	oq.pendingEvents = []pendingPDU{
+		{queueNID: 1, transactionID: "txn1", pdu: &gomatrixserverlib.Event{}},
+		{queueNID: 2, transactionID: "txn1", pdu: &gomatrixserverlib.Event{}},
+		{queueNID: 3, pdu: &gomatrixserverlib.Event{}},
+	}
+
+	txn, queueNIDs := oq.next()
+	if txn.TransactionID != "txn1" {
+		t.Errorf("wanted transaction ID %q, got %q", "txn1", txn.TransactionID)
+	}
+	if len(txn.PDUs) != 2 || len(queueNIDs) != 2 {
+		t.Errorf("wanted the 2 PDUs of the restored transaction, got %v", queueNIDs)
+	}
+	if len(db.transactionIDs) != 0 {
+		t.Errorf("wanted no transaction IDs to be stored, got %v", db.transactionIDs)
+	}
+}
+
+func TestBackgroundSendSchedulesRetry(t *testing.T) {
+	db := &fakeDatabase{transactionIDs: map[int64]gomatrixserverlib.TransactionID{}}
+	sender := &fakeSender{failing: true}
+	oq := &destinationQueue{
+		db: db, client: sender, destination: "remote", maxPDUs: 1, maxEDUs: 1,
+		blacklistAfterFailures: 5, blacklist: newBlacklist(),
+	}
+	oq.running = true
+	oq.pendingEvents = []pendingPDU{{queueNID: 1, pdu: &gomatrixserverlib.Event{}}}
+	oq.backgroundSend()
+
+	// The goroutine stops rather than waiting to retry, but the queue stays
+	// running so items queued meanwhile wait for the retry.
+	if oq.retrying == nil || oq.retryTimer == nil {
+		t.Fatalf("wanted a retry to be scheduled after failing to send")
+	}
+	if !oq.retryTimer.Stop() {
+		t.Fatalf("wanted the retry to be pending")
+	}
+	oq.sendEvent(2, &gomatrixserverlib.Event{})
+	if len(sender.transactionIDs) != 1 {
+		t.Fatalf("wanted 1 attempt while waiting to retry, got %v", sender.transactionIDs)
+	}
+
+	// What the retry timer does once it fires.
+	sender.failing = false
+	oq.backgroundSend()
+	ids := sender.transactionIDs
+	if len(ids) != 3 || ids[1] != ids[0] || ids[2] == ids[0] {
+		t.Errorf("wanted the failed transaction to be sent again before a new one, got %v", ids)
+	}
+	if oq.running || oq.retrying != nil {
+		t.Errorf("wanted the queue to stop once everything was sent")
+	}
+}
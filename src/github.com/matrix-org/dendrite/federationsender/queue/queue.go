@@ -19,26 +19,112 @@ import (
 	"sync"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// Database persists the items waiting in the queues so that they are still
+// sent if the server restarts.
+type Database interface {
+	// QueuePDU stores a PDU to send to the destination and returns its
+	// queue NID.
+	QueuePDU(destination gomatrixserverlib.ServerName, event *gomatrixserverlib.Event) (int64, error)
+	// QueueEDU stores an EDU to send to the destination and returns its
+	// queue NID.
+	QueueEDU(destination gomatrixserverlib.ServerName, edu *federationclient.EDU) (int64, error)
+	// SetQueueItemsTransactionID records the transaction the items are sent in.
+	SetQueueItemsTransactionID(queueNIDs []int64, transactionID gomatrixserverlib.TransactionID) error
+	// DeleteQueueItems removes items that have been sent from the database.
+	DeleteQueueItems(queueNIDs []int64) error
+	// DeleteDestinationQueueItems removes all the items queued for the
+	// destination from the database.
+	DeleteDestinationQueueItems(destination gomatrixserverlib.ServerName) error
+	// QueueItems returns all the items that haven't been sent yet, in the
+	// order they were queued.
+	QueueItems() ([]types.QueueItem, error)
+	// AddDestinationFailure records a failed attempt at sending a transaction
+	// to the destination and returns the number of consecutive failures.
+	AddDestinationFailure(destination gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp) (int64, error)
+	// BlacklistDestination marks the destination as blacklisted.
+	BlacklistDestination(destination gomatrixserverlib.ServerName) error
+	// ClearDestinationFailures forgets the failures recorded for the
+	// destination, removing it from the blacklist.
+	ClearDestinationFailures(destination gomatrixserverlib.ServerName) error
+	// Blacklist returns the destinations with failures recorded.
+	Blacklist() ([]types.BlacklistEntry, error)
+}
+
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
+	cfg    *config.Dendrite
 	origin gomatrixserverlib.ServerName
-	client *gomatrixserverlib.FederationClient
+	client *federationclient.Client
+	db     Database
+	// The destinations with failures, shared with the queues.
+	blacklist *blacklist
 	// The queuesMutex protects queues
 	queuesMutex sync.Mutex
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
 // NewOutgoingQueues makes a new OutgoingQueues
-func NewOutgoingQueues(origin gomatrixserverlib.ServerName, client *gomatrixserverlib.FederationClient) *OutgoingQueues {
+func NewOutgoingQueues(
+	cfg *config.Dendrite, client *federationclient.Client, db Database,
+) *OutgoingQueues {
 	return &OutgoingQueues{
-		origin: origin,
-		client: client,
-		queues: map[gomatrixserverlib.ServerName]*destinationQueue{},
+		cfg:       cfg,
+		origin:    cfg.Matrix.ServerName,
+		client:    client,
+		db:        db,
+		blacklist: newBlacklist(),
+		queues:    map[gomatrixserverlib.ServerName]*destinationQueue{},
+	}
+}
+
+// Restore loads the items that weren't sent before the server last stopped
+// from the database and starts sending them again, along with the failures
+// of the destinations.
+func (oqs *OutgoingQueues) Restore() error {
+	entries, err := oqs.db.Blacklist()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		oqs.blacklist.set(entry.ServerName, entry.Blacklisted)
+	}
+
+	items, err := oqs.db.QueueItems()
+	if err != nil {
+		return err
+	}
+
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	for _, item := range items {
+		if oqs.blacklist.isBlacklisted(item.Destination) {
+			continue
+		}
+		oq := oqs.getQueue(item.Destination)
+		oq.runningMutex.Lock()
+		if item.PDU != nil {
+			oq.pendingEvents = append(oq.pendingEvents, pendingPDU{
+				queueNID: item.QueueNID, transactionID: item.TransactionID, pdu: item.PDU,
+			})
+		} else {
+			oq.pendingEDUs = append(oq.pendingEDUs, pendingEDU{
+				queueNID: item.QueueNID, transactionID: item.TransactionID, edu: item.EDU,
+			})
+		}
+		oq.start()
+		oq.runningMutex.Unlock()
+	}
+	if len(items) > 0 {
+		log.WithField("count", len(items)).Info("Restored federation sender queues")
 	}
+	return nil
 }
 
 // SendEvent sends an event to the destinations
@@ -67,20 +153,96 @@ func (oqs *OutgoingQueues) SendEvent(
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
 	for _, destination := range destinations {
-		oq := oqs.queues[destination]
-		if oq == nil {
-			oq = &destinationQueue{
-				origin:      oqs.origin,
-				destination: destination,
-				client:      oqs.client,
-			}
-			oqs.queues[destination] = oq
+		if oqs.blacklist.isBlacklisted(destination) {
+			continue
+		}
+		queueNID, err := oqs.db.QueuePDU(destination, ev)
+		if err != nil {
+			return err
+		}
+		oqs.getQueue(destination).sendEvent(queueNID, ev)
+	}
+	return nil
+}
+
+// SendEDU sends an EDU to the destinations
+func (oqs *OutgoingQueues) SendEDU(
+	e *federationclient.EDU, origin gomatrixserverlib.ServerName,
+	destinations []gomatrixserverlib.ServerName,
+) error {
+	if origin != oqs.origin {
+		// TODO: Support virtual hosting by allowing us to send events using
+		// different origin server names.
+		// For now assume we are always asked to send as the single server configured
+		// in the dendrite config.
+		return fmt.Errorf(
+			"sendedu: unexpected server to send as: got %q expected %q",
+			origin, oqs.origin,
+		)
+	}
+
+	// Remove our own server from the list of destinations.
+	destinations = filterDestinations(oqs.origin, destinations)
+
+	log.WithFields(log.Fields{
+		"destinations": destinations, "edu_type": e.Type,
+	}).Info("Sending EDU")
+
+	oqs.queuesMutex.Lock()
+	defer oqs.queuesMutex.Unlock()
+	for _, destination := range destinations {
+		if oqs.blacklist.isBlacklisted(destination) {
+			continue
+		}
+		oq := oqs.getQueue(destination)
+		edu := *e
+		edu.Destination = string(destination)
+		queueNID, err := oqs.db.QueueEDU(destination, &edu)
+		if err != nil {
+			return err
 		}
-		oq.sendEvent(ev)
+		oq.sendEDU(queueNID, &edu)
+	}
+	return nil
+}
+
+// Blacklist returns the destinations we failed to send transactions to, and
+// whether they are blacklisted.
+func (oqs *OutgoingQueues) Blacklist() ([]types.BlacklistEntry, error) {
+	return oqs.db.Blacklist()
+}
+
+// RemoveFromBlacklist forgets the failures of the destination so that events
+// are sent to it again.
+func (oqs *OutgoingQueues) RemoveFromBlacklist(destination gomatrixserverlib.ServerName) error {
+	if err := oqs.db.ClearDestinationFailures(destination); err != nil {
+		return err
 	}
+	oqs.blacklist.remove(destination)
 	return nil
 }
 
+// getQueue returns the queue for the destination, creating it if needed.
+// The queues mutex must be held.
+func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
+	oq := oqs.queues[destination]
+	if oq == nil {
+		oq = &destinationQueue{
+			db:                     oqs.db,
+			origin:                 oqs.origin,
+			destination:            destination,
+			client:                 oqs.client,
+			maxPDUs:                oqs.cfg.FederationSender.MaxPDUsPerTransaction,
+			maxEDUs:                oqs.cfg.FederationSender.MaxEDUsPerTransaction,
+			transactionDelay:       oqs.cfg.FederationSender.TransactionDelay,
+			blacklistAfterFailures: int64(oqs.cfg.FederationSender.BlacklistAfterFailures),
+			blacklist:              oqs.blacklist,
+		}
+		oqs.queues[destination] = oq
+	}
+	return oq
+}
+
 // filterDestinations removes our own server from the list of destinations.
 // Otherwise we could end up trying to talk to ourselves.
 func filterDestinations(origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName) []gomatrixserverlib.ServerName {
@@ -0,0 +1,51 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/federationsender/admin"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const pathPrefixAdminV1 = "/_dendrite/admin/v1"
+
+// Setup configures the given mux with federation sender server listeners
+func Setup(
+	apiMux *mux.Router, queues *queue.OutgoingQueues,
+	deviceDB *devices.Database, accountDB *accounts.Database,
+) {
+	adminmux := apiMux.PathPrefix(pathPrefixAdminV1).Subrouter()
+
+	adminmux.Handle("/federation_blacklist",
+		common.MakeAuthAdminAPI("admin_get_federation_blacklist", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			return admin.GetBlacklist(req, queues)
+		}),
+	).Methods("GET")
+	adminmux.Handle("/federation_blacklist/{serverName}",
+		common.MakeAuthAdminAPI("admin_remove_from_federation_blacklist", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.RemoveFromBlacklist(req, queues, gomatrixserverlib.ServerName(vars["serverName"]))
+		}),
+	).Methods("DELETE")
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const blacklistSchema = `
+-- The blacklist table tracks the destinations we are failing to send
+-- transactions to. Destinations are blacklisted after too many consecutive
+-- failures, and nothing is sent to them until they are removed from the table.
+CREATE TABLE IF NOT EXISTS federationsender_blacklist (
+    -- The destination server.
+    server_name TEXT PRIMARY KEY,
+    -- When the first of the consecutive failures happened, as a timestamp
+    -- in milliseconds.
+    unreachable_since BIGINT NOT NULL,
+    -- The number of consecutive failed attempts at sending a transaction.
+    failure_count BIGINT NOT NULL,
+    -- Whether the destination is blacklisted.
+    blacklisted BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+const upsertBlacklistFailureSQL = "" +
+	"INSERT INTO federationsender_blacklist (server_name, unreachable_since, failure_count)" +
+	" VALUES ($1, $2, 1)" +
+	" ON CONFLICT (server_name) DO UPDATE" +
+	" SET failure_count = federationsender_blacklist.failure_count + 1" +
+	" RETURNING failure_count"
+
+const updateBlacklistedSQL = "" +
+	"UPDATE federationsender_blacklist SET blacklisted = TRUE WHERE server_name = $1"
+
+const deleteBlacklistEntrySQL = "" +
+	"DELETE FROM federationsender_blacklist WHERE server_name = $1"
+
+const selectBlacklistSQL = "" +
+	"SELECT server_name, unreachable_since, failure_count, blacklisted" +
+	" FROM federationsender_blacklist ORDER BY server_name ASC"
+
+type blacklistStatements struct {
+	upsertBlacklistFailureStmt *sql.Stmt
+	updateBlacklistedStmt      *sql.Stmt
+	deleteBlacklistEntryStmt   *sql.Stmt
+	selectBlacklistStmt        *sql.Stmt
+}
+
+func (s *blacklistStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(blacklistSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertBlacklistFailureStmt, err = db.Prepare(upsertBlacklistFailureSQL); err != nil {
+		return
+	}
+	if s.updateBlacklistedStmt, err = db.Prepare(updateBlacklistedSQL); err != nil {
+		return
+	}
+	if s.deleteBlacklistEntryStmt, err = db.Prepare(deleteBlacklistEntrySQL); err != nil {
+		return
+	}
+	if s.selectBlacklistStmt, err = db.Prepare(selectBlacklistSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *blacklistStatements) upsertBlacklistFailure(
+	serverName gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp,
+) (failureCount int64, err error) {
+	err = s.upsertBlacklistFailureStmt.QueryRow(serverName, ts).Scan(&failureCount)
+	return
+}
+
+func (s *blacklistStatements) updateBlacklisted(serverName gomatrixserverlib.ServerName) error {
+	_, err := s.updateBlacklistedStmt.Exec(serverName)
+	return err
+}
+
+func (s *blacklistStatements) deleteBlacklistEntry(serverName gomatrixserverlib.ServerName) error {
+	_, err := s.deleteBlacklistEntryStmt.Exec(serverName)
+	return err
+}
+
+func (s *blacklistStatements) selectBlacklist() ([]types.BlacklistEntry, error) {
+	rows, err := s.selectBlacklistStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var result []types.BlacklistEntry
+	for rows.Next() {
+		var entry types.BlacklistEntry
+		var serverName string
+		var unreachableSince int64
+		if err = rows.Scan(&serverName, &unreachableSince, &entry.FailureCount, &entry.Blacklisted); err != nil {
+			return nil, err
+		}
+		entry.ServerName = gomatrixserverlib.ServerName(serverName)
+		entry.UnreachableSince = gomatrixserverlib.Timestamp(unreachableSince)
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common/federationclient"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueSchema = `
+-- The queue table stores the PDUs and EDUs waiting to be sent to each
+-- destination, so that they are still sent if the server restarts.
+CREATE TABLE IF NOT EXISTS federationsender_queue (
+    -- The position of the item in the queues.
+    queue_nid BIGSERIAL PRIMARY KEY,
+    -- The server the item is sent to.
+    destination TEXT NOT NULL,
+    -- Whether the item is an EDU rather than a PDU.
+    is_edu BOOLEAN NOT NULL,
+    -- The JSON of the PDU or EDU.
+    item_json TEXT NOT NULL,
+    -- The ID of the transaction the item was sent in, or the empty string if
+    -- it hasn't been sent yet. Items are sent again with the same transaction
+    -- ID after a restart so that the destination can tell they're retries.
+    transaction_id TEXT NOT NULL DEFAULT ''
+);
+`
+
+const insertQueueItemSQL = "" +
+	"INSERT INTO federationsender_queue (destination, is_edu, item_json)" +
+	" VALUES ($1, $2, $3) RETURNING queue_nid"
+
+const updateQueueItemsTransactionIDSQL = "" +
+	"UPDATE federationsender_queue SET transaction_id = $2 WHERE queue_nid = ANY($1)"
+
+const deleteQueueItemsSQL = "" +
+	"DELETE FROM federationsender_queue WHERE queue_nid = ANY($1)"
+
+const deleteDestinationQueueItemsSQL = "" +
+	"DELETE FROM federationsender_queue WHERE destination = $1"
+
+const selectQueueItemsSQL = "" +
+	"SELECT queue_nid, destination, is_edu, item_json, transaction_id" +
+	" FROM federationsender_queue ORDER BY queue_nid ASC"
+
+type queueStatements struct {
+	insertQueueItemStmt               *sql.Stmt
+	updateQueueItemsTransactionIDStmt *sql.Stmt
+	deleteQueueItemsStmt              *sql.Stmt
+	deleteDestinationQueueItemsStmt   *sql.Stmt
+	selectQueueItemsStmt              *sql.Stmt
+}
+
+func (s *queueStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueItemStmt, err = db.Prepare(insertQueueItemSQL); err != nil {
+		return
+	}
+	if s.updateQueueItemsTransactionIDStmt, err = db.Prepare(updateQueueItemsTransactionIDSQL); err != nil {
+		return
+	}
+	if s.deleteQueueItemsStmt, err = db.Prepare(deleteQueueItemsSQL); err != nil {
+		return
+	}
+	if s.deleteDestinationQueueItemsStmt, err = db.Prepare(deleteDestinationQueueItemsSQL); err != nil {
+		return
+	}
+	if s.selectQueueItemsStmt, err = db.Prepare(selectQueueItemsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueStatements) insertQueueItem(
+	destination gomatrixserverlib.ServerName, isEDU bool, itemJSON []byte,
+) (queueNID int64, err error) {
+	err = s.insertQueueItemStmt.QueryRow(destination, isEDU, string(itemJSON)).Scan(&queueNID)
+	return
+}
+
+func (s *queueStatements) updateQueueItemsTransactionID(
+	queueNIDs []int64, transactionID gomatrixserverlib.TransactionID,
+) error {
+	_, err := s.updateQueueItemsTransactionIDStmt.Exec(pq.Int64Array(queueNIDs), transactionID)
+	return err
+}
+
+func (s *queueStatements) deleteQueueItems(queueNIDs []int64) error {
+	_, err := s.deleteQueueItemsStmt.Exec(pq.Int64Array(queueNIDs))
+	return err
+}
+
+func (s *queueStatements) deleteDestinationQueueItems(destination gomatrixserverlib.ServerName) error {
+	_, err := s.deleteDestinationQueueItemsStmt.Exec(destination)
+	return err
+}
+
+func (s *queueStatements) selectQueueItems() ([]types.QueueItem, error) {
+	rows, err := s.selectQueueItemsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var result []types.QueueItem
+	for rows.Next() {
+		var item types.QueueItem
+		var isEDU bool
+		var itemJSON, destination, transactionID string
+		if err = rows.Scan(&item.QueueNID, &destination, &isEDU, &itemJSON, &transactionID); err != nil {
+			return nil, err
+		}
+		item.Destination = gomatrixserverlib.ServerName(destination)
+		item.TransactionID = gomatrixserverlib.TransactionID(transactionID)
+		if isEDU {
+			item.EDU = &federationclient.EDU{}
+			err = json.Unmarshal([]byte(itemJSON), item.EDU)
+		} else {
+			item.PDU = &gomatrixserverlib.Event{}
+			err = json.Unmarshal([]byte(itemJSON), item.PDU)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	return result, rows.Err()
+}
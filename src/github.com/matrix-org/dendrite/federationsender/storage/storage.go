@@ -16,15 +16,20 @@ package storage
 
 import (
 	"database/sql"
+	"encoding/json"
 
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // Database stores information needed by the federation sender
 type Database struct {
 	joinedHostsStatements
 	roomStatements
+	queueStatements
+	blacklistStatements
 	common.PartitionOffsetStatements
 	db *sql.DB
 }
@@ -53,6 +58,14 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.queueStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.blacklistStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	if err = d.PartitionOffsetStatements.Prepare(d.db, "federationsender"); err != nil {
 		return err
 	}
@@ -105,3 +118,68 @@ func (d *Database) UpdateRoom(
 	})
 	return
 }
+
+// GetJoinedHosts returns the currently joined hosts for the given room.
+func (d *Database) GetJoinedHosts(roomID string) ([]types.JoinedHost, error) {
+	return d.selectJoinedHosts(nil, roomID)
+}
+
+// QueuePDU implements queue.Database
+func (d *Database) QueuePDU(destination gomatrixserverlib.ServerName, event *gomatrixserverlib.Event) (int64, error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	return d.insertQueueItem(destination, false, eventJSON)
+}
+
+// QueueEDU implements queue.Database
+func (d *Database) QueueEDU(destination gomatrixserverlib.ServerName, edu *federationclient.EDU) (int64, error) {
+	eduJSON, err := json.Marshal(edu)
+	if err != nil {
+		return 0, err
+	}
+	return d.insertQueueItem(destination, true, eduJSON)
+}
+
+// SetQueueItemsTransactionID implements queue.Database
+func (d *Database) SetQueueItemsTransactionID(queueNIDs []int64, transactionID gomatrixserverlib.TransactionID) error {
+	return d.updateQueueItemsTransactionID(queueNIDs, transactionID)
+}
+
+// DeleteQueueItems implements queue.Database
+func (d *Database) DeleteQueueItems(queueNIDs []int64) error {
+	return d.deleteQueueItems(queueNIDs)
+}
+
+// QueueItems implements queue.Database
+func (d *Database) QueueItems() ([]types.QueueItem, error) {
+	return d.selectQueueItems()
+}
+
+// DeleteDestinationQueueItems implements queue.Database
+func (d *Database) DeleteDestinationQueueItems(destination gomatrixserverlib.ServerName) error {
+	return d.deleteDestinationQueueItems(destination)
+}
+
+// AddDestinationFailure implements queue.Database
+func (d *Database) AddDestinationFailure(
+	destination gomatrixserverlib.ServerName, ts gomatrixserverlib.Timestamp,
+) (int64, error) {
+	return d.upsertBlacklistFailure(destination, ts)
+}
+
+// BlacklistDestination implements queue.Database
+func (d *Database) BlacklistDestination(destination gomatrixserverlib.ServerName) error {
+	return d.updateBlacklisted(destination)
+}
+
+// ClearDestinationFailures implements queue.Database
+func (d *Database) ClearDestinationFailures(destination gomatrixserverlib.ServerName) error {
+	return d.deleteBlacklistEntry(destination)
+}
+
+// Blacklist implements queue.Database
+func (d *Database) Blacklist() ([]types.BlacklistEntry, error) {
+	return d.selectBlacklist()
+}
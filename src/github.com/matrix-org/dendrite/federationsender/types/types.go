@@ -17,6 +17,7 @@ package types
 import (
 	"fmt"
 
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -28,6 +29,34 @@ type JoinedHost struct {
 	ServerName gomatrixserverlib.ServerName
 }
 
+// A QueueItem is a PDU or an EDU waiting to be sent to a destination.
+type QueueItem struct {
+	// The position of the item in the queues.
+	QueueNID int64
+	// The server the item is sent to.
+	Destination gomatrixserverlib.ServerName
+	// The ID of the transaction the item was sent in, or the empty string if
+	// it hasn't been sent yet.
+	TransactionID gomatrixserverlib.TransactionID
+	// The PDU, if the item is a PDU.
+	PDU *gomatrixserverlib.Event
+	// The EDU, if the item is an EDU.
+	EDU *federationclient.EDU
+}
+
+// A BlacklistEntry records the consecutive failures at sending transactions
+// to a destination.
+type BlacklistEntry struct {
+	// The destination server.
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+	// When the first of the consecutive failures happened.
+	UnreachableSince gomatrixserverlib.Timestamp `json:"unreachable_since"`
+	// The number of consecutive failed attempts at sending a transaction.
+	FailureCount int64 `json:"failure_count"`
+	// Whether nothing is sent to the destination anymore.
+	Blacklisted bool `json:"blacklisted"`
+}
+
 // A EventIDMismatchError indicates that we have got out of sync with the
 // room server.
 type EventIDMismatchError struct {
@@ -0,0 +1,105 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin implements the admin API of the media API.
+package admin
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type quotaResponse struct {
+	UserID        types.MatrixUserID  `json:"user_id"`
+	UploadedBytes types.FileSizeBytes `json:"uploaded_bytes"`
+	// The quota which applies to the user. 0 means unlimited.
+	QuotaBytes types.FileSizeBytes `json:"quota_bytes"`
+	// Whether the quota was set for the user rather than configured.
+	Overridden bool `json:"overridden"`
+}
+
+type setQuotaRequest struct {
+	// The configured quota applies again if it is null.
+	QuotaBytes *types.FileSizeBytes `json:"quota_bytes"`
+}
+
+// GetUserQuota implements GET /_dendrite/admin/v1/media_quota/{userID}
+func GetUserQuota(req *http.Request, cfg *config.Dendrite, db *storage.Database, userID string) util.JSONResponse {
+	if resErr := validateLocalUserID(cfg, userID); resErr != nil {
+		return *resErr
+	}
+	stats, err := db.GetUserMediaStats(types.MatrixUserID(userID))
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: quotaResponse{
+			UserID:        stats.UserID,
+			UploadedBytes: stats.UploadedBytes,
+			QuotaBytes:    stats.Quota(types.FileSizeBytes(cfg.Media.MaxUploadSizePerUserBytes)),
+			Overridden:    stats.QuotaBytes != nil,
+		},
+	}
+}
+
+// SetUserQuota implements PUT /_dendrite/admin/v1/media_quota/{userID}
+func SetUserQuota(req *http.Request, cfg *config.Dendrite, db *storage.Database, userID string) util.JSONResponse {
+	if resErr := validateLocalUserID(cfg, userID); resErr != nil {
+		return *resErr
+	}
+	var r setQuotaRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.QuotaBytes != nil && *r.QuotaBytes < 0 {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("quota_bytes must not be negative"),
+		}
+	}
+	if err := db.SetUserQuota(types.MatrixUserID(userID), r.QuotaBytes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// validateLocalUserID returns an error response if the user ID isn't one of a
+// user of this server.
+func validateLocalUserID(cfg *config.Dendrite, userID string) *util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Invalid user ID"),
+		}
+	}
+	if domain != cfg.Matrix.ServerName {
+		return &util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.InvalidArgumentValue("Only local users can be managed"),
+		}
+	}
+	return nil
+}
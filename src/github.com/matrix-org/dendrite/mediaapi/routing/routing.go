@@ -18,8 +18,13 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/mediaapi/admin"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/mediaapi/writers"
@@ -28,35 +33,64 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-const pathPrefixR0 = "/_matrix/media/v1"
+const (
+	pathPrefixR0 = "/_matrix/media/r0"
+	// Some clients still use the v1 paths, which behave the same as the r0 ones.
+	pathPrefixV1      = "/_matrix/media/v1"
+	pathPrefixAdminV1 = "/_dendrite/admin/v1"
+)
 
 // Setup registers the media API HTTP handlers
-func Setup(apiMux *mux.Router, httpClient *http.Client, cfg *config.Dendrite, db *storage.Database) {
-	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
-
+func Setup(
+	apiMux *mux.Router, httpClient *http.Client, cfg *config.Dendrite, db *storage.Database,
+	deviceDB *devices.Database, accountDB *accounts.Database,
+) {
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
 	}
-
-	// FIXME: /upload should use common.MakeAuthAPI()
-	r0mux.Handle("/upload", common.MakeAPI("upload", func(req *http.Request) util.JSONResponse {
-		return writers.Upload(req, cfg, db, activeThumbnailGeneration)
-	}))
-
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
-	r0mux.Handle("/download/{serverName}/{mediaId}",
-		makeDownloadAPI("download", cfg, db, activeRemoteRequests, activeThumbnailGeneration),
-	)
-	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, activeRemoteRequests, activeThumbnailGeneration),
-	)
+
+	// Application services can use their as_token as an access token.
+	authDeviceDB := auth.NewAppServiceDeviceDatabase(deviceDB, cfg.ApplicationServices.Registrations)
+
+	for _, pathPrefix := range []string{pathPrefixR0, pathPrefixV1} {
+		r0mux := apiMux.PathPrefix(pathPrefix).Subrouter()
+
+		r0mux.Handle("/upload",
+			common.MakeAuthAPI("upload", authDeviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+				return writers.Upload(req, cfg, device, db, activeThumbnailGeneration)
+			}),
+		)
+
+		r0mux.Handle("/download/{serverName}/{mediaId}",
+			makeDownloadAPI("download", cfg, db, activeRemoteRequests, activeThumbnailGeneration),
+		)
+		r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
+			makeDownloadAPI("thumbnail", cfg, db, activeRemoteRequests, activeThumbnailGeneration),
+		)
+	}
+
+	adminmux := apiMux.PathPrefix(pathPrefixAdminV1).Subrouter()
+
+	adminmux.Handle("/media_quota/{userID}",
+		common.MakeAuthAdminAPI("admin_get_media_quota", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.GetUserQuota(req, cfg, db, vars["userID"])
+		}),
+	).Methods("GET")
+	adminmux.Handle("/media_quota/{userID}",
+		common.MakeAuthAdminAPI("admin_set_media_quota", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.SetUserQuota(req, cfg, db, vars["userID"])
+		}),
+	).Methods("PUT")
 }
 
 func makeDownloadAPI(name string, cfg *config.Dendrite, db *storage.Database, activeRemoteRequests *types.ActiveRemoteRequests, activeThumbnailGeneration *types.ActiveThumbnailGeneration) http.HandlerFunc {
 	return prometheus.InstrumentHandler(name, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		req = util.RequestWithLogging(req)
+		req = common.RequestWithLogging(req)
 
 		// Set common headers returned regardless of the outcome of the request
 		util.SetCORSHeaders(w)
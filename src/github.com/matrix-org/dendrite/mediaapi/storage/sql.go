@@ -21,6 +21,7 @@ import (
 type statements struct {
 	media     mediaStatements
 	thumbnail thumbnailStatements
+	userStats userMediaStatsStatements
 }
 
 func (s *statements) prepare(db *sql.DB) error {
@@ -32,6 +33,9 @@ func (s *statements) prepare(db *sql.DB) error {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return err
 	}
+	if err = s.userStats.prepare(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -17,8 +17,7 @@ package storage
 import (
 	"database/sql"
 
-	// Import the postgres database driver.
-	_ "github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -29,11 +28,11 @@ type Database struct {
 	db         *sql.DB
 }
 
-// Open opens a postgres database.
+// Open opens a postgres database, or a SQLite one when built with the sqlite tag.
 func Open(dataSourceName string) (*Database, error) {
 	var d Database
 	var err error
-	if d.db, err = sql.Open("postgres", dataSourceName); err != nil {
+	if d.db, err = common.OpenDatabase(dataSourceName); err != nil {
 		return nil, err
 	}
 	if err = d.statements.prepare(d.db); err != nil {
@@ -86,3 +85,33 @@ func (d *Database) GetThumbnails(mediaID types.MediaID, mediaOrigin gomatrixserv
 	}
 	return thumbnails, err
 }
+
+// GetUserMediaStats returns the storage used by the media files the user uploaded.
+// Returns empty stats if the user hasn't uploaded anything.
+func (d *Database) GetUserMediaStats(userID types.MatrixUserID) (*types.UserMediaStats, error) {
+	stats, err := d.statements.userStats.selectUserMediaStats(userID)
+	if err != nil && err == sql.ErrNoRows {
+		return &types.UserMediaStats{UserID: userID}, nil
+	}
+	return stats, err
+}
+
+// ReserveUserUploadedBytes adds the size of a newly uploaded file to the storage used by the user,
+// unless it would take them over their upload quota. defaultQuotaBytes is the configured quota, which
+// applies unless an admin set one for the user. 0 means unlimited.
+// Returns whether the size was added.
+func (d *Database) ReserveUserUploadedBytes(userID types.MatrixUserID, size, defaultQuotaBytes types.FileSizeBytes) (bool, error) {
+	return d.statements.userStats.reserveUploadedBytes(userID, size, defaultQuotaBytes)
+}
+
+// ReleaseUserUploadedBytes removes the size of a file from the storage used by the user, e.g. when it
+// was reserved but storing the file failed.
+func (d *Database) ReleaseUserUploadedBytes(userID types.MatrixUserID, size types.FileSizeBytes) error {
+	return d.statements.userStats.releaseUploadedBytes(userID, size)
+}
+
+// SetUserQuota overrides the configured upload quota for the user.
+// The configured quota applies again if quotaBytes is nil.
+func (d *Database) SetUserQuota(userID types.MatrixUserID, quotaBytes *types.FileSizeBytes) error {
+	return d.statements.userStats.upsertQuota(userID, quotaBytes)
+}
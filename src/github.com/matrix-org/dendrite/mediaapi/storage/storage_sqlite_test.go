@@ -0,0 +1,164 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+// newTestDatabase opens a media database in a new SQLite file. The returned
+// function removes the file.
+func newTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("file:" + filepath.Join(dir, "media.db"))
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatalf("Open: %v", err)
+	}
+	return db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+func TestSQLiteMediaMetadata(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	metadata := &types.MediaMetadata{
+		MediaID:       "abcdef",
+		Origin:        "localhost",
+		ContentType:   "image/png",
+		FileSizeBytes: 1024,
+		UploadName:    "cat.png",
+		Base64Hash:    "hash",
+		UserID:        "@alice:localhost",
+	}
+	if err := db.StoreMediaMetadata(metadata); err != nil {
+		t.Fatalf("StoreMediaMetadata: %v", err)
+	}
+	if err := db.StoreMediaMetadata(metadata); err == nil {
+		t.Errorf("StoreMediaMetadata: expected an error storing the same media twice")
+	}
+	got, err := db.GetMediaMetadata("abcdef", "localhost")
+	if err != nil {
+		t.Fatalf("GetMediaMetadata: %v", err)
+	}
+	if got == nil || *got != *metadata {
+		t.Errorf("GetMediaMetadata: got %+v, want %+v", got, metadata)
+	}
+	if got, err = db.GetMediaMetadata("missing", "localhost"); err != nil || got != nil {
+		t.Errorf("GetMediaMetadata: got (%+v, %v) for missing media, want (nil, nil)", got, err)
+	}
+
+	thumbnail := &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID:       "abcdef",
+			Origin:        "localhost",
+			ContentType:   "image/png",
+			FileSizeBytes: 128,
+		},
+		ThumbnailSize: types.ThumbnailSize{Width: 32, Height: 32, ResizeMethod: "crop"},
+	}
+	if err = db.StoreThumbnail(thumbnail); err != nil {
+		t.Fatalf("StoreThumbnail: %v", err)
+	}
+	thumbnails, err := db.GetThumbnails("abcdef", "localhost")
+	if err != nil {
+		t.Fatalf("GetThumbnails: %v", err)
+	}
+	if len(thumbnails) != 1 || thumbnails[0].ThumbnailSize != thumbnail.ThumbnailSize {
+		t.Errorf("GetThumbnails: got %+v, want the 32x32 crop thumbnail", thumbnails)
+	}
+}
+
+func TestSQLiteUserMediaStats(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	stats, err := db.GetUserMediaStats("@alice:localhost")
+	if err != nil {
+		t.Fatalf("GetUserMediaStats: %v", err)
+	}
+	if stats.UploadedBytes != 0 || stats.QuotaBytes != nil {
+		t.Errorf("GetUserMediaStats: got %+v before any upload, want empty stats", stats)
+	}
+
+	// New users are held to the configured quota.
+	if reserved, err := db.ReserveUserUploadedBytes("@alice:localhost", 3000, 2048); err != nil || reserved {
+		t.Fatalf("ReserveUserUploadedBytes: got (%v, %v) over the configured quota, want (false, nil)", reserved, err)
+	}
+
+	// Admins can give users a larger quota.
+	quota := types.FileSizeBytes(4096)
+	if err = db.SetUserQuota("@alice:localhost", &quota); err != nil {
+		t.Fatalf("SetUserQuota: %v", err)
+	}
+	for _, size := range []types.FileSizeBytes{3000, 1000} {
+		if reserved, err := db.ReserveUserUploadedBytes("@alice:localhost", size, 2048); err != nil || !reserved {
+			t.Fatalf("ReserveUserUploadedBytes(%d): got (%v, %v), want (true, nil)", size, reserved, err)
+		}
+	}
+	if reserved, err := db.ReserveUserUploadedBytes("@alice:localhost", 100, 2048); err != nil || reserved {
+		t.Fatalf("ReserveUserUploadedBytes: got (%v, %v) over the quota, want (false, nil)", reserved, err)
+	}
+	if err = db.ReleaseUserUploadedBytes("@alice:localhost", 1000); err != nil {
+		t.Fatalf("ReleaseUserUploadedBytes: %v", err)
+	}
+	if stats, err = db.GetUserMediaStats("@alice:localhost"); err != nil {
+		t.Fatalf("GetUserMediaStats: %v", err)
+	}
+	if stats.UploadedBytes != 3000 || stats.QuotaBytes == nil || *stats.QuotaBytes != quota {
+		t.Errorf("GetUserMediaStats: got %+v, want 3000 bytes uploaded with a quota of 4096", stats)
+	}
+
+	// A quota of 0 means unlimited.
+	if reserved, err := db.ReserveUserUploadedBytes("@bob:localhost", 1<<40, 0); err != nil || !reserved {
+		t.Errorf("ReserveUserUploadedBytes: got (%v, %v) without a quota, want (true, nil)", reserved, err)
+	}
+}
+
+func TestSQLiteConcurrentReservations(t *testing.T) {
+	db, removeDB := newTestDatabase(t)
+	defer removeDB()
+
+	// Only 10 of the 20 concurrent uploads fit in the quota.
+	results := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func() {
+			reserved, err := db.ReserveUserUploadedBytes("@alice:localhost", 100, 1000)
+			if err != nil {
+				t.Errorf("ReserveUserUploadedBytes: %v", err)
+			}
+			results <- reserved
+		}()
+	}
+	count := 0
+	for i := 0; i < 20; i++ {
+		if <-results {
+			count++
+		}
+	}
+	if count != 10 {
+		t.Errorf("ReserveUserUploadedBytes: %d concurrent uploads were reserved, want 10", count)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const userMediaStatsSchema = `
+-- The user_media_stats table tracks the storage used by the media files each user uploaded,
+-- which is checked against their upload quota.
+CREATE TABLE IF NOT EXISTS mediaapi_user_media_stats (
+    -- The user who uploaded the files. Should be a Matrix user ID.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The total size of the files uploaded by the user in bytes.
+    uploaded_bytes BIGINT NOT NULL DEFAULT 0,
+    -- The upload quota set for the user by an admin in bytes, 0 meaning unlimited.
+    -- The configured quota applies if it is NULL.
+    quota_bytes BIGINT
+);
+`
+
+// Adds the size of a file to the storage used by a user, unless it would take
+// them over their quota, which is $3 unless an admin set one for them. The
+// check and the update are done in a single statement so that concurrent
+// uploads can't take the user over their quota between them. A row is only
+// inserted for a new user if the file fits in the configured quota, and only
+// updated for an existing user if it fits in their quota.
+const reserveUploadedBytesSQL = `
+INSERT INTO mediaapi_user_media_stats (user_id, uploaded_bytes)
+    SELECT $1, CAST($2 AS BIGINT) WHERE CAST($3 AS BIGINT) = 0 OR $2 <= $3
+    OR EXISTS (SELECT 1 FROM mediaapi_user_media_stats WHERE user_id = $1)
+    ON CONFLICT (user_id) DO UPDATE SET uploaded_bytes = mediaapi_user_media_stats.uploaded_bytes + excluded.uploaded_bytes
+    WHERE COALESCE(mediaapi_user_media_stats.quota_bytes, $3) = 0
+    OR mediaapi_user_media_stats.uploaded_bytes + excluded.uploaded_bytes <= COALESCE(mediaapi_user_media_stats.quota_bytes, $3)
+`
+
+const releaseUploadedBytesSQL = `
+UPDATE mediaapi_user_media_stats SET uploaded_bytes = uploaded_bytes - $1 WHERE user_id = $2
+`
+
+const upsertQuotaSQL = `
+INSERT INTO mediaapi_user_media_stats (user_id, quota_bytes) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET quota_bytes = excluded.quota_bytes
+`
+
+const selectUserMediaStatsSQL = `
+SELECT uploaded_bytes, quota_bytes FROM mediaapi_user_media_stats WHERE user_id = $1
+`
+
+type userMediaStatsStatements struct {
+	reserveUploadedBytesStmt *sql.Stmt
+	releaseUploadedBytesStmt *sql.Stmt
+	upsertQuotaStmt          *sql.Stmt
+	selectUserMediaStatsStmt *sql.Stmt
+}
+
+func (s *userMediaStatsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(userMediaStatsSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.reserveUploadedBytesStmt, reserveUploadedBytesSQL},
+		{&s.releaseUploadedBytesStmt, releaseUploadedBytesSQL},
+		{&s.upsertQuotaStmt, upsertQuotaSQL},
+		{&s.selectUserMediaStatsStmt, selectUserMediaStatsSQL},
+	}.prepare(db)
+}
+
+// reserveUploadedBytes returns whether the size was added to the storage used
+// by the user.
+func (s *userMediaStatsStatements) reserveUploadedBytes(
+	userID types.MatrixUserID, size, defaultQuotaBytes types.FileSizeBytes,
+) (bool, error) {
+	res, err := s.reserveUploadedBytesStmt.Exec(userID, int64(size), int64(defaultQuotaBytes))
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *userMediaStatsStatements) releaseUploadedBytes(userID types.MatrixUserID, size types.FileSizeBytes) error {
+	_, err := s.releaseUploadedBytesStmt.Exec(int64(size), userID)
+	return err
+}
+
+func (s *userMediaStatsStatements) upsertQuota(userID types.MatrixUserID, quotaBytes *types.FileSizeBytes) error {
+	var quota sql.NullInt64
+	if quotaBytes != nil {
+		quota = sql.NullInt64{Int64: int64(*quotaBytes), Valid: true}
+	}
+	_, err := s.upsertQuotaStmt.Exec(userID, quota)
+	return err
+}
+
+func (s *userMediaStatsStatements) selectUserMediaStats(userID types.MatrixUserID) (*types.UserMediaStats, error) {
+	stats := types.UserMediaStats{UserID: userID}
+	var quota sql.NullInt64
+	err := s.selectUserMediaStatsStmt.QueryRow(userID).Scan(&stats.UploadedBytes, &quota)
+	if quota.Valid {
+		quotaBytes := types.FileSizeBytes(quota.Int64)
+		stats.QuotaBytes = &quotaBytes
+	}
+	return &stats, err
+}
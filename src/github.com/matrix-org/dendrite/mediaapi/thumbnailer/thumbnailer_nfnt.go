@@ -194,6 +194,9 @@ func createThumbnail(src types.Path, img image.Image, config types.ThumbnailSize
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
+// Images are resampled with the Lanczos filter of nfnt/resize, which is as good
+// as the CatmullRom filter of golang.org/x/image/draw for thumbnails and is
+// already vendored.
 func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
 	var out image.Image
 	var err error
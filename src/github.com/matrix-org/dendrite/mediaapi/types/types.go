@@ -61,6 +61,23 @@ type MediaMetadata struct {
 	UserID            MatrixUserID
 }
 
+// UserMediaStats is the storage used by the media files a user uploaded
+type UserMediaStats struct {
+	UserID MatrixUserID
+	// The total size of the files uploaded by the user
+	UploadedBytes FileSizeBytes
+	// The upload quota set for the user by an admin, or nil if the configured one applies. 0 means unlimited.
+	QuotaBytes *FileSizeBytes
+}
+
+// Quota returns the upload quota of the user, given the configured one. 0 means unlimited.
+func (s *UserMediaStats) Quota(defaultQuotaBytes FileSizeBytes) FileSizeBytes {
+	if s.QuotaBytes != nil {
+		return *s.QuotaBytes
+	}
+	return defaultQuotaBytes
+}
+
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
 type RemoteRequestResult struct {
 	// Condition used for the requester to signal the result to all other routines waiting on this condition
@@ -29,6 +29,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
@@ -43,6 +44,10 @@ const mediaIDCharacters = "A-Za-z0-9_=-"
 // Note: unfortunately regex.MustCompile() cannot be assigned to a const
 var mediaIDRegex = regexp.MustCompile("[" + mediaIDCharacters + "]+")
 
+// The content behind a media ID never changes, and neither do the thumbnails
+// generated from it, so clients and proxies can cache them for a long time.
+const mediaCacheControl = "public, max-age=86400, s-maxage=86400"
+
 // downloadRequest metadata included in or derivable from a download or thumbnail request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-download-servername-mediaid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-thumbnail-servername-mediaid
@@ -66,7 +71,7 @@ func Download(w http.ResponseWriter, req *http.Request, origin gomatrixserverlib
 			Origin:  origin,
 		},
 		IsThumbnailRequest: isThumbnailRequest,
-		Logger: util.GetLogger(req.Context()).WithFields(log.Fields{
+		Logger: common.GetLogger(req.Context()).WithFields(log.Fields{
 			"Origin":  origin,
 			"MediaID": mediaID,
 		}),
@@ -264,12 +269,18 @@ func (r *downloadRequest) respondFromLocalFile(w http.ResponseWriter, absBasePat
 
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+	if responseMetadata.UploadName != "" {
+		// The upload name is stored percent-encoded, which is the encoding
+		// RFC 6266 expects for the extended filename parameter.
+		w.Header().Set("Content-Disposition", "inline; filename*=utf-8''"+string(responseMetadata.UploadName))
+	}
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	w.Header().Set("Cache-Control", mediaCacheControl)
 
 	if bytesResponded, err := io.Copy(w, responseFile); err != nil {
 		r.Logger.WithError(err).Warn("Failed to copy from cache")
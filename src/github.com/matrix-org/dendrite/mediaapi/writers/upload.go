@@ -22,7 +22,9 @@ import (
 	"path"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/mediaapi/fileutils"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
@@ -49,14 +51,19 @@ type uploadResponse struct {
 // Upload implements /upload
 // This endpoint involves uploading potentially significant amounts of data to the homeserver.
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
+// Users also have a quota on the total size of the files they upload, which can be overridden per user by admins.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.Dendrite, db *storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
-	r, resErr := parseAndValidateRequest(req, cfg)
+func Upload(req *http.Request, cfg *config.Dendrite, device *authtypes.Device, db *storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+	r, resErr := parseAndValidateRequest(req, cfg, device)
 	if resErr != nil {
 		return *resErr
 	}
 
+	if resErr = r.checkQuota(cfg, db); resErr != nil {
+		return *resErr
+	}
+
 	if resErr = r.doUpload(req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
@@ -72,7 +79,7 @@ func Upload(req *http.Request, cfg *config.Dendrite, db *storage.Database, activ
 // parseAndValidateRequest parses the incoming upload request to validate and extract
 // all the metadata about the media being uploaded.
 // Returns either an uploadRequest or an error formatted as a util.JSONResponse
-func parseAndValidateRequest(req *http.Request, cfg *config.Dendrite) (*uploadRequest, *util.JSONResponse) {
+func parseAndValidateRequest(req *http.Request, cfg *config.Dendrite, device *authtypes.Device) (*uploadRequest, *util.JSONResponse) {
 	if req.Method != "POST" {
 		return nil, &util.JSONResponse{
 			Code: 405,
@@ -86,8 +93,9 @@ func parseAndValidateRequest(req *http.Request, cfg *config.Dendrite) (*uploadRe
 			FileSizeBytes: types.FileSizeBytes(req.ContentLength),
 			ContentType:   types.ContentType(req.Header.Get("Content-Type")),
 			UploadName:    types.Filename(url.PathEscape(req.FormValue("filename"))),
+			UserID:        types.MatrixUserID(device.UserID),
 		},
-		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
+		Logger: common.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
 	}
 
 	if resErr := r.Validate(*cfg.Media.MaxFileSizeBytes); resErr != nil {
@@ -152,7 +160,16 @@ func (r *uploadRequest) doUpload(reqReader io.Reader, cfg *config.Dendrite, db *
 		}
 	}
 
+	if resErr := r.reserveQuota(cfg, db); resErr != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return resErr
+	}
+
 	if resErr := r.storeFileAndMetadata(tmpDir, cfg.Media.AbsBasePath, db, cfg.Media.ThumbnailSizes, activeThumbnailGeneration, cfg.Media.MaxThumbnailGenerators); resErr != nil {
+		// The file wasn't stored so it doesn't count towards the quota of the user.
+		if err = db.ReleaseUserUploadedBytes(r.MediaMetadata.UserID, r.MediaMetadata.FileSizeBytes); err != nil {
+			r.Logger.WithError(err).Error("Failed to release the storage reserved for the file")
+		}
 		return resErr
 	}
 
@@ -203,6 +220,53 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
+// checkQuota checks that storing the file wouldn't take the user over their upload quota,
+// going by its Content-Length, so that we don't receive files we would reject anyway.
+// The quota is only enforced by reserveQuota once the file has been received.
+func (r *uploadRequest) checkQuota(cfg *config.Dendrite, db *storage.Database) *util.JSONResponse {
+	stats, err := db.GetUserMediaStats(r.MediaMetadata.UserID)
+	if err != nil {
+		r.Logger.WithError(err).Error("Error querying the database.")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	quota := stats.Quota(types.FileSizeBytes(cfg.Media.MaxUploadSizePerUserBytes))
+	if quota > 0 && stats.UploadedBytes+r.MediaMetadata.FileSizeBytes > quota {
+		return quotaExceeded(quota)
+	}
+	return nil
+}
+
+// reserveQuota adds the size of the file to the storage used by the user, unless it would take them
+// over their upload quota. The check and the update are atomic, so concurrent uploads can't exceed
+// the quota between them.
+func (r *uploadRequest) reserveQuota(cfg *config.Dendrite, db *storage.Database) *util.JSONResponse {
+	defaultQuota := types.FileSizeBytes(cfg.Media.MaxUploadSizePerUserBytes)
+	reserved, err := db.ReserveUserUploadedBytes(r.MediaMetadata.UserID, r.MediaMetadata.FileSizeBytes, defaultQuota)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to update the storage used by the user")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !reserved {
+		stats, err := db.GetUserMediaStats(r.MediaMetadata.UserID)
+		if err != nil {
+			r.Logger.WithError(err).Error("Error querying the database.")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		return quotaExceeded(stats.Quota(defaultQuota))
+	}
+	return nil
+}
+
+func quotaExceeded(quota types.FileSizeBytes) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: 413,
+		JSON: jsonerror.TooLarge(fmt.Sprintf("Upload would exceed your storage quota (%v).", quota)),
+	}
+}
+
 // storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
 // See getPathFromMediaMetadata in fileutils for details of the final path.
 // The order of operations is important as it avoids metadata entering the database before the file
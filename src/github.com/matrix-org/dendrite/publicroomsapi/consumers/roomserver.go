@@ -15,6 +15,7 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 
 	log "github.com/Sirupsen/logrus"
@@ -22,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
 
@@ -83,19 +85,28 @@ func (s *OutputRoomEvent) onMessage(msg *sarama.ConsumerMessage) error {
 		"type":     ev.Type(),
 	}).Info("received event from roomserver")
 
-	addQueryReq := api.QueryEventsByIDRequest{output.NewRoomEvent.AddsStateEventIDs}
-	var addQueryRes api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(&addQueryReq, &addQueryRes); err != nil {
+	// Fetch both the added and the removed state events in a single query.
+	addsStateEventIDs := output.NewRoomEvent.AddsStateEventIDs
+	eventIDs := append(addsStateEventIDs[:len(addsStateEventIDs):len(addsStateEventIDs)], output.NewRoomEvent.RemovesStateEventIDs...)
+	queryReq := api.QueryEventsByIDRequest{EventIDs: eventIDs}
+	var queryRes api.QueryEventsByIDResponse
+	if err := s.query.QueryEventsByID(context.Background(), &queryReq, &queryRes); err != nil {
 		log.Warn(err)
 		return err
 	}
 
-	remQueryReq := api.QueryEventsByIDRequest{output.NewRoomEvent.RemovesStateEventIDs}
-	var remQueryRes api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(&remQueryReq, &remQueryRes); err != nil {
-		log.Warn(err)
-		return err
+	added := make(map[string]bool, len(addsStateEventIDs))
+	for _, eventID := range addsStateEventIDs {
+		added[eventID] = true
+	}
+	var addedEvents, removedEvents []gomatrixserverlib.Event
+	for _, event := range queryRes.Events {
+		if added[event.EventID()] {
+			addedEvents = append(addedEvents, event)
+		} else {
+			removedEvents = append(removedEvents, event)
+		}
 	}
 
-	return s.db.UpdateRoomFromEvents(addQueryRes.Events, remQueryRes.Events)
+	return s.db.UpdateRoomFromEvents(addedEvents, removedEvents)
 }
@@ -15,10 +15,16 @@
 package directory
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -51,16 +57,48 @@ func GetVisibility(
 }
 
 // SetVisibility implements PUT /directory/list/room/{roomID}
-// TODO: Check if user has the power level to edit the room visibility
+// Only users allowed to send m.room.canonical_alias events in the room can
+// change its visibility in the directory.
 func SetVisibility(
-	req *http.Request, publicRoomsDatabase *storage.PublicRoomsServerDatabase,
-	roomID string,
+	req *http.Request, device *authtypes.Device,
+	publicRoomsDatabase *storage.PublicRoomsServerDatabase,
+	queryAPI api.RoomserverQueryAPI, roomID string,
 ) util.JSONResponse {
 	var v roomVisibility
 	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
 		return *reqErr
 	}
 
+	stateReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.power_levels", StateKey: ""},
+		},
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := queryAPI.QueryLatestEventsAndState(req.Context(), &stateReq, &stateRes); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !stateRes.RoomExists {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
+	content := common.DefaultPowerLevelContent()
+	for _, event := range stateRes.StateEvents {
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			return httputil.LogThenError(req, err)
+		}
+	}
+	if content.UserLevel(device.UserID) < content.EventLevel("m.room.canonical_alias", true) {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("You do not have permission to change the visibility of this room"),
+		}
+	}
+
 	isPublic := v.Visibility == "public"
 	if err := publicRoomsDatabase.SetRoomVisibility(isPublic, roomID); err != nil {
 		return httputil.LogThenError(req, err)
@@ -20,12 +20,16 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 type publicRoomReq struct {
+	Server string `json:"-"`
 	Since  string `json:"since,omitempty"`
 	Limit  int16  `json:"limit,omitempty"`
 	Filter filter `json:"filter,omitempty"`
@@ -42,20 +46,57 @@ type publicRoomRes struct {
 	Estimate  int64              `json:"total_room_count_estimate,omitempty"`
 }
 
-// GetPublicRooms implements GET /publicRooms
+// GetPublicRooms implements GET and POST /publicRooms
+// If the request names a remote server, the public rooms of that server are
+// fetched over federation instead of from the local directory.
 func GetPublicRooms(
-	req *http.Request, publicRoomDatabase *storage.PublicRoomsServerDatabase,
+	req *http.Request, cfg config.Dendrite,
+	publicRoomDatabase *storage.PublicRoomsServerDatabase,
+	federation *federationclient.Client,
 ) util.JSONResponse {
-	var limit int16
-	var offset int64
 	var request publicRoomReq
-	var response publicRoomRes
+	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+		return *fillErr
+	}
+
+	if request.Server != "" && gomatrixserverlib.ServerName(request.Server) != cfg.Matrix.ServerName {
+		return getRemotePublicRooms(req, federation, request)
+	}
 
+	return getLocalPublicRooms(req, publicRoomDatabase, request)
+}
+
+// GetPublicRoomsFederation implements GET /_matrix/federation/v1/publicRooms
+// which lets other servers show our public rooms in their directory.
+func GetPublicRoomsFederation(
+	req *http.Request, publicRoomDatabase *storage.PublicRoomsServerDatabase,
+) util.JSONResponse {
+	var request publicRoomReq
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
 
-	limit = request.Limit
+	// We don't have any rooms in third party networks, so asking only for
+	// the rooms of one of them gets an empty page.
+	query := req.URL.Query()
+	if query.Get("third_party_instance_id") != "" && query.Get("include_all_networks") != "true" {
+		return util.JSONResponse{
+			Code: 200,
+			JSON: publicRoomRes{Chunk: []types.PublicRoom{}},
+		}
+	}
+
+	return getLocalPublicRooms(req, publicRoomDatabase, request)
+}
+
+// getLocalPublicRooms returns a page of the public room directory of this
+// server.
+func getLocalPublicRooms(
+	req *http.Request, publicRoomDatabase *storage.PublicRoomsServerDatabase,
+	request publicRoomReq,
+) util.JSONResponse {
+	var response publicRoomRes
+	limit := request.Limit
 	offset, err := strconv.ParseInt(request.Since, 10, 64)
 	// ParseInt returns 0 and an error when trying to parse an empty string
 	// In that case, we want to assign 0 so we ignore the error
@@ -85,9 +126,35 @@ func GetPublicRooms(
 	}
 }
 
-// fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
+// getRemotePublicRooms fetches a page of the public room directory of the
+// server named in the request over federation.
+// The federation API doesn't support filtering, so the search terms are
+// ignored.
+func getRemotePublicRooms(
+	req *http.Request, federation *federationclient.Client,
+	request publicRoomReq,
+) util.JSONResponse {
+	res, err := federation.GetPublicRooms(
+		gomatrixserverlib.ServerName(request.Server), int(request.Limit), request.Since,
+	)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 502,
+			JSON: jsonerror.Unknown("Failed to get the public rooms of " + request.Server + ": " + err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
+
+// fillPublicRoomsReq fills the Server, Limit, Since and Filter attributes of a GET or POST request
 // on /publicRooms by parsing the incoming HTTP request
 func fillPublicRoomsReq(httpReq *http.Request, request *publicRoomReq) *util.JSONResponse {
+	// The server is always given as a query parameter, even on POST.
+	request.Server = httpReq.URL.Query().Get("server")
 	if httpReq.Method == "GET" {
 		limit, err := strconv.Atoi(httpReq.FormValue("limit"))
 		// Atoi returns 0 and an error when trying to parse an empty string
@@ -21,15 +21,28 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/common/federationclient"
 	"github.com/matrix-org/dendrite/publicroomsapi/directory"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/util"
 )
 
-const pathPrefixR0 = "/_matrix/client/r0"
+const (
+	pathPrefixR0           = "/_matrix/client/r0"
+	pathPrefixV1Federation = "/_matrix/federation/v1"
+)
 
 // Setup configures the given mux with publicroomsapi server listeners
-func Setup(apiMux *mux.Router, deviceDB *devices.Database, publicRoomsDB *storage.PublicRoomsServerDatabase) {
+func Setup(
+	apiMux *mux.Router,
+	cfg config.Dendrite,
+	deviceDB *devices.Database,
+	publicRoomsDB *storage.PublicRoomsServerDatabase,
+	queryAPI api.RoomserverQueryAPI,
+	federation *federationclient.Client,
+) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 	r0mux.Handle("/directory/list/room/{roomID}",
 		common.MakeAPI("directory_list", func(req *http.Request) util.JSONResponse {
@@ -40,12 +53,19 @@ func Setup(apiMux *mux.Router, deviceDB *devices.Database, publicRoomsDB *storag
 	r0mux.Handle("/directory/list/room/{roomID}",
 		common.MakeAuthAPI("directory_list", deviceDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars := mux.Vars(req)
-			return directory.SetVisibility(req, publicRoomsDB, vars["roomID"])
+			return directory.SetVisibility(req, device, publicRoomsDB, queryAPI, vars["roomID"])
 		}),
 	).Methods("PUT", "OPTIONS")
 	r0mux.Handle("/publicRooms",
 		common.MakeAPI("public_rooms", func(req *http.Request) util.JSONResponse {
-			return directory.GetPublicRooms(req, publicRoomsDB)
+			return directory.GetPublicRooms(req, cfg, publicRoomsDB, federation)
 		}),
 	).Methods("GET", "POST", "OPTIONS")
+
+	v1fedmux := apiMux.PathPrefix(pathPrefixV1Federation).Subrouter()
+	v1fedmux.Handle("/publicRooms",
+		common.MakeAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
+			return directory.GetPublicRoomsFederation(req, publicRoomsDB)
+		}),
+	).Methods("GET")
 }
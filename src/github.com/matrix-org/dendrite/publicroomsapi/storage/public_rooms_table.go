@@ -59,6 +59,9 @@ CREATE TABLE IF NOT EXISTS publicroomsapi_public_rooms(
 	-- means the room is private
 	visibility BOOLEAN NOT NULL DEFAULT false
 );
+-- The directory lists the public rooms with the most members first
+CREATE INDEX IF NOT EXISTS publicroomsapi_public_rooms_joined_members_idx
+	ON publicroomsapi_public_rooms(joined_members DESC) WHERE visibility = true;
 `
 
 const countPublicRoomsSQL = "" +
@@ -0,0 +1,70 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+type purgeHistoryResponse struct {
+	PurgeID string `json:"purge_id"`
+}
+
+type purgeStatusResponse struct {
+	Status string `json:"status"`
+}
+
+// PurgeHistory implements POST /_dendrite/admin/v1/purge_history/{roomID}/{eventID}
+// The purge runs in the background, and its status can be looked up with the
+// returned purge ID.
+func PurgeHistory(req *http.Request, purger *Purger, roomID, eventID string) util.JSONResponse {
+	purgeID, err := purger.StartPurge(req.Context(), roomID, eventID)
+	switch err {
+	case nil:
+	case ErrRoomNotFound, ErrEventNotFound:
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound(err.Error()),
+		}
+	default:
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: purgeHistoryResponse{PurgeID: purgeID},
+	}
+}
+
+// GetPurgeStatus implements GET /_dendrite/admin/v1/purge_history_status/{purgeID}
+func GetPurgeStatus(req *http.Request, purger *Purger, purgeID string) util.JSONResponse {
+	status, err := purger.Status(req.Context(), purgeID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if status == "" {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: jsonerror.NotFound("Unknown purge"),
+		}
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: purgeStatusResponse{Status: status},
+	}
+}
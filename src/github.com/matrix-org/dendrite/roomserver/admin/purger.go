@@ -0,0 +1,185 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin implements the admin API of the roomserver.
+package admin
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/util"
+)
+
+// The statuses of a purge.
+const (
+	PurgeStatusActive   = "active"
+	PurgeStatusComplete = "complete"
+	PurgeStatusFailed   = "failed"
+)
+
+// The maximum number of event IDs written in an OutputPurgedHistory, to keep
+// the messages of the output log small.
+const maxEventIDsPerOutput = 1000
+
+// ErrRoomNotFound is returned when purging the history of an unknown room.
+var ErrRoomNotFound = errors.New("Room does not exist")
+
+// ErrEventNotFound is returned when purging the history of a room before an
+// event which isn't in the room.
+var ErrEventNotFound = errors.New("Event is not in the room")
+
+// Database has the storage APIs needed to purge the history of rooms.
+type Database interface {
+	// Look up the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	// Returns an error if there was a problem talking to the database.
+	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
+	// Look up the numeric IDs for a list of events.
+	// Returns an error if there was a problem talking to the database.
+	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
+	// Look up the Events for a list of numeric event IDs.
+	// Returns a sorted list of events.
+	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Delete the events of the room which aren't state events and are less
+	// deep than the given event, and return their IDs.
+	// Returns an error if there was a problem talking to the database.
+	PurgeHistory(ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID) ([]string, error)
+	// Set the status of the purge of the history of the room.
+	// Returns an error if there was a problem talking to the database.
+	SetPurgeStatus(ctx context.Context, purgeID, roomID, status string) error
+	// Look up the status of the purge.
+	// Returns "" if there is no such purge.
+	// Returns an error if there was a problem talking to the database.
+	PurgeStatus(ctx context.Context, purgeID string) (string, error)
+	// Replace the status of every purge with the old status by the new one.
+	// Returns an error if there was a problem talking to the database.
+	UpdatePurgeStatuses(ctx context.Context, oldStatus, newStatus string) error
+}
+
+// A Purger purges the history of rooms in the background, and stores the
+// status of the purges in the database.
+type Purger struct {
+	db           Database
+	outputWriter input.OutputRoomEventWriter
+}
+
+// NewPurger creates a new purger, which writes the IDs of the purged events to
+// the output log with the given writer. Purges which were still active when
+// the roomserver stopped are marked as failed, since they were interrupted.
+func NewPurger(db Database, outputWriter input.OutputRoomEventWriter) (*Purger, error) {
+	if err := db.UpdatePurgeStatuses(context.Background(), PurgeStatusActive, PurgeStatusFailed); err != nil {
+		return nil, err
+	}
+	return &Purger{
+		db:           db,
+		outputWriter: outputWriter,
+	}, nil
+}
+
+// StartPurge starts purging the events of the room before the given event in
+// a new goroutine, and returns the ID of the purge, which can be used to look
+// its status up.
+// Returns ErrRoomNotFound or ErrEventNotFound if the room or the event don't
+// exist.
+func (p *Purger) StartPurge(ctx context.Context, roomID, eventID string) (string, error) {
+	roomNID, err := p.db.RoomNID(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if roomNID == 0 {
+		return "", ErrRoomNotFound
+	}
+	eventNIDs, err := p.db.EventNIDs(ctx, []string{eventID})
+	if err != nil {
+		return "", err
+	}
+	eventNID, ok := eventNIDs[eventID]
+	if !ok {
+		return "", ErrEventNotFound
+	}
+	events, err := p.db.Events(ctx, []types.EventNID{eventNID})
+	if err != nil {
+		return "", err
+	}
+	if len(events) != 1 || events[0].RoomID() != roomID {
+		return "", ErrEventNotFound
+	}
+
+	purgeID := util.RandomString(16)
+	if err = p.db.SetPurgeStatus(ctx, purgeID, roomID, PurgeStatusActive); err != nil {
+		return "", err
+	}
+	go p.purge(purgeID, roomID, roomNID, eventNID)
+	return purgeID, nil
+}
+
+// Status returns the status of the purge with the given ID, or "" if there is
+// no such purge.
+func (p *Purger) Status(ctx context.Context, purgeID string) (string, error) {
+	return p.db.PurgeStatus(ctx, purgeID)
+}
+
+// setStatus stores the status of the purge, logging the errors since the
+// purge runs in the background.
+func (p *Purger) setStatus(logger *log.Entry, purgeID, roomID, status string) {
+	if err := p.db.SetPurgeStatus(context.Background(), purgeID, roomID, status); err != nil {
+		logger.WithError(err).Error("Failed to store the status of purge")
+	}
+}
+
+func (p *Purger) purge(purgeID, roomID string, roomNID types.RoomNID, eventNID types.EventNID) {
+	logger := log.WithFields(log.Fields{
+		"purge_id": purgeID,
+		"room_id":  roomID,
+	})
+	eventIDs, err := p.db.PurgeHistory(context.Background(), roomNID, eventNID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to purge the history of room")
+		p.setStatus(logger, purgeID, roomID, PurgeStatusFailed)
+		return
+	}
+
+	var outputs []api.OutputEvent
+	for len(eventIDs) > 0 {
+		n := len(eventIDs)
+		if n > maxEventIDsPerOutput {
+			n = maxEventIDsPerOutput
+		}
+		outputs = append(outputs, api.OutputEvent{
+			Type: api.OutputTypePurgedHistory,
+			PurgedHistory: &api.OutputPurgedHistory{
+				RoomID:   roomID,
+				EventIDs: eventIDs[:n],
+			},
+		})
+		eventIDs = eventIDs[n:]
+	}
+	if len(outputs) > 0 {
+		if err = p.outputWriter.WriteOutputEvents(roomID, outputs); err != nil {
+			// The events are gone from the roomserver, but other components
+			// still have them.
+			logger.WithError(err).Error("Failed to write the purged events to the output log")
+			p.setStatus(logger, purgeID, roomID, PurgeStatusFailed)
+			return
+		}
+	}
+
+	logger.Info("Purged the history of room")
+	p.setStatus(logger, purgeID, roomID, PurgeStatusComplete)
+}
@@ -15,8 +15,8 @@
 package alias
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -29,18 +29,23 @@ import (
 
 // RoomserverAliasAPIDatabase has the storage APIs needed to implement the alias API.
 type RoomserverAliasAPIDatabase interface {
-	// Save a given room alias with the room ID it refers to.
+	// Save a given room alias with the room ID it refers to and the ID of the
+	// user who created it.
 	// Returns an error if there was a problem talking to the database.
-	SetRoomAlias(alias string, roomID string) error
+	SetRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) error
 	// Look up the room ID a given alias refers to.
 	// Returns an error if there was a problem talking to the database.
-	GetRoomIDFromAlias(alias string) (string, error)
+	GetRoomIDFromAlias(ctx context.Context, alias string) (string, error)
 	// Look up all aliases referring to a given room ID.
 	// Returns an error if there was a problem talking to the database.
-	GetAliasesFromRoomID(roomID string) ([]string, error)
+	GetAliasesFromRoomID(ctx context.Context, roomID string) ([]string, error)
+	// Look up the ID of the user who created a given alias.
+	// Returns an empty string if the alias doesn't exist.
+	// Returns an error if there was a problem talking to the database.
+	GetCreatorIDForAlias(ctx context.Context, alias string) (string, error)
 	// Remove a given room alias.
 	// Returns an error if there was a problem talking to the database.
-	RemoveRoomAlias(alias string) error
+	RemoveRoomAlias(ctx context.Context, alias string) error
 }
 
 // RoomserverAliasAPI is an implementation of api.RoomserverAliasAPI
@@ -57,7 +62,7 @@ func (r *RoomserverAliasAPI) SetRoomAlias(
 	response *api.SetRoomAliasResponse,
 ) error {
 	// Check if the alias isn't already referring to a room
-	roomID, err := r.DB.GetRoomIDFromAlias(request.Alias)
+	roomID, err := r.DB.GetRoomIDFromAlias(context.TODO(), request.Alias)
 	if err != nil {
 		return err
 	}
@@ -69,12 +74,12 @@ func (r *RoomserverAliasAPI) SetRoomAlias(
 	response.AliasExists = false
 
 	// Save the new alias
-	if err := r.DB.SetRoomAlias(request.Alias, request.RoomID); err != nil {
+	if err := r.DB.SetRoomAlias(context.TODO(), request.Alias, request.RoomID, request.UserID); err != nil {
 		return err
 	}
 
 	// Send a m.room.aliases event with the updated list of aliases for this room
-	if err := r.sendUpdatedAliasesEvent(request.UserID, request.RoomID); err != nil {
+	if err := r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, request.RoomID); err != nil {
 		return err
 	}
 
@@ -87,7 +92,7 @@ func (r *RoomserverAliasAPI) GetAliasRoomID(
 	response *api.GetAliasRoomIDResponse,
 ) error {
 	// Look up the room ID in the database
-	roomID, err := r.DB.GetRoomIDFromAlias(request.Alias)
+	roomID, err := r.DB.GetRoomIDFromAlias(context.TODO(), request.Alias)
 	if err != nil {
 		return err
 	}
@@ -96,24 +101,43 @@ func (r *RoomserverAliasAPI) GetAliasRoomID(
 	return nil
 }
 
+// GetCreatorIDForAlias implements api.RoomserverAliasAPI
+func (r *RoomserverAliasAPI) GetCreatorIDForAlias(
+	request *api.GetCreatorIDForAliasRequest,
+	response *api.GetCreatorIDForAliasResponse,
+) error {
+	// Look up the creator ID in the database
+	creatorID, err := r.DB.GetCreatorIDForAlias(context.TODO(), request.Alias)
+	if err != nil {
+		return err
+	}
+
+	response.UserID = creatorID
+	return nil
+}
+
 // RemoveRoomAlias implements api.RoomserverAliasAPI
 func (r *RoomserverAliasAPI) RemoveRoomAlias(
 	request *api.RemoveRoomAliasRequest,
 	response *api.RemoveRoomAliasResponse,
 ) error {
 	// Look up the room ID in the database
-	roomID, err := r.DB.GetRoomIDFromAlias(request.Alias)
+	roomID, err := r.DB.GetRoomIDFromAlias(context.TODO(), request.Alias)
 	if err != nil {
 		return err
 	}
+	if roomID == "" {
+		// The alias doesn't exist, so there's nothing to remove
+		return nil
+	}
 
-	// Remove the dalias from the database
-	if err := r.DB.RemoveRoomAlias(request.Alias); err != nil {
+	// Remove the alias from the database
+	if err := r.DB.RemoveRoomAlias(context.TODO(), request.Alias); err != nil {
 		return err
 	}
 
 	// Send an updated m.room.aliases event
-	if err := r.sendUpdatedAliasesEvent(request.UserID, roomID); err != nil {
+	if err := r.sendUpdatedAliasesEvent(context.TODO(), request.UserID, roomID); err != nil {
 		return err
 	}
 
@@ -126,7 +150,9 @@ type roomAliasesContent struct {
 
 // Build the updated m.room.aliases event to send to the room after addition or
 // removal of an alias
-func (r *RoomserverAliasAPI) sendUpdatedAliasesEvent(userID string, roomID string) error {
+func (r *RoomserverAliasAPI) sendUpdatedAliasesEvent(
+	ctx context.Context, userID string, roomID string,
+) error {
 	serverName := string(r.Cfg.Matrix.ServerName)
 
 	builder := gomatrixserverlib.EventBuilder{
@@ -138,7 +164,7 @@ func (r *RoomserverAliasAPI) sendUpdatedAliasesEvent(userID string, roomID strin
 
 	// Retrieve the updated list of aliases, marhal it and set it as the
 	// event's content
-	aliases, err := r.DB.GetAliasesFromRoomID(roomID)
+	aliases, err := r.DB.GetAliasesFromRoomID(ctx, roomID)
 	if err != nil {
 		return err
 	}
@@ -162,9 +188,15 @@ func (r *RoomserverAliasAPI) sendUpdatedAliasesEvent(userID string, roomID strin
 		StateToFetch: eventsNeeded.Tuples(),
 	}
 	var res api.QueryLatestEventsAndStateResponse
-	if err = r.QueryAPI.QueryLatestEventsAndState(&req, &res); err != nil {
+	if err = r.QueryAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
 		return err
 	}
+	// Room version 6 drops the special treatment of m.room.aliases events,
+	// whose aliases are left to the room directory.
+	// See https://matrix.org/docs/spec/rooms/v6#authorization-rules
+	if res.RoomVersion == "6" {
+		return nil
+	}
 	builder.Depth = res.Depth
 	builder.PrevEvents = res.LatestEvents
 
@@ -180,9 +212,10 @@ func (r *RoomserverAliasAPI) sendUpdatedAliasesEvent(userID string, roomID strin
 	builder.AuthEvents = refs
 
 	// Build the event
-	eventID := fmt.Sprintf("$%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
 	now := time.Now()
-	event, err := builder.Build(eventID, now, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID, r.Cfg.Matrix.PrivateKey)
+	event, err := common.BuildEvent(
+		&builder, res.RoomVersion, now, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID, r.Cfg.Matrix.PrivateKey,
+	)
 	if err != nil {
 		return err
 	}
@@ -237,6 +270,20 @@ func (r *RoomserverAliasAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: 200, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverGetCreatorIDForAliasPath,
+		common.MakeAPI("getCreatorIDForAlias", func(req *http.Request) util.JSONResponse {
+			var request api.GetCreatorIDForAliasRequest
+			var response api.GetCreatorIDForAliasResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.GetCreatorIDForAlias(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverRemoveRoomAliasPath,
 		common.MakeAPI("removeRoomAlias", func(req *http.Request) util.JSONResponse {
@@ -15,6 +15,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 )
 
@@ -46,6 +47,19 @@ type GetAliasRoomIDResponse struct {
 	RoomID string `json:"room_id"`
 }
 
+// GetCreatorIDForAliasRequest is a request to GetCreatorIDForAlias
+type GetCreatorIDForAliasRequest struct {
+	// The alias we want to find the creator of
+	Alias string `json:"alias"`
+}
+
+// GetCreatorIDForAliasResponse is a response to GetCreatorIDForAlias
+type GetCreatorIDForAliasResponse struct {
+	// The user ID of the alias creator, empty if the alias doesn't exist or if
+	// it was created before the creators of aliases were recorded
+	UserID string `json:"user_id"`
+}
+
 // RemoveRoomAliasRequest is a request to RemoveRoomAlias
 type RemoveRoomAliasRequest struct {
 	// ID of the user removing the alias
@@ -71,6 +85,12 @@ type RoomserverAliasAPI interface {
 		response *GetAliasRoomIDResponse,
 	) error
 
+	// Get the user ID of the creator of an alias
+	GetCreatorIDForAlias(
+		req *GetCreatorIDForAliasRequest,
+		response *GetCreatorIDForAliasResponse,
+	) error
+
 	// Remove a room alias
 	RemoveRoomAlias(
 		req *RemoveRoomAliasRequest,
@@ -84,6 +104,9 @@ const RoomserverSetRoomAliasPath = "/api/roomserver/setRoomAlias"
 // RoomserverGetAliasRoomIDPath is the HTTP path for the GetAliasRoomID API.
 const RoomserverGetAliasRoomIDPath = "/api/roomserver/getAliasRoomID"
 
+// RoomserverGetCreatorIDForAliasPath is the HTTP path for the GetCreatorIDForAlias API.
+const RoomserverGetCreatorIDForAliasPath = "/api/roomserver/getCreatorIDForAlias"
+
 // RoomserverRemoveRoomAliasPath is the HTTP path for the RemoveRoomAlias API.
 const RoomserverRemoveRoomAliasPath = "/api/roomserver/removeRoomAlias"
 
@@ -107,7 +130,7 @@ func (h *httpRoomserverAliasAPI) SetRoomAlias(
 	response *SetRoomAliasResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverSetRoomAliasPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
 }
 
 // GetAliasRoomID implements RoomserverAliasAPI
@@ -115,15 +138,24 @@ func (h *httpRoomserverAliasAPI) GetAliasRoomID(
 	request *GetAliasRoomIDRequest,
 	response *GetAliasRoomIDResponse,
 ) error {
-	// RemoveRoomAlias implements RoomserverAliasAPI
 	apiURL := h.roomserverURL + RoomserverGetAliasRoomIDPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
+}
+
+// GetCreatorIDForAlias implements RoomserverAliasAPI
+func (h *httpRoomserverAliasAPI) GetCreatorIDForAlias(
+	request *GetCreatorIDForAliasRequest,
+	response *GetCreatorIDForAliasResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverGetCreatorIDForAliasPath
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
 }
 
+// RemoveRoomAlias implements RoomserverAliasAPI
 func (h *httpRoomserverAliasAPI) RemoveRoomAlias(
 	request *RemoveRoomAliasRequest,
 	response *RemoveRoomAliasResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverRemoveRoomAliasPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
 }
@@ -16,6 +16,7 @@
 package api
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -115,5 +116,5 @@ func (h *httpRoomserverInputAPI) InputRoomEvents(
 	response *InputRoomEventsResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverInputRoomEventsPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
 }
@@ -28,6 +28,16 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRejectedEvent indicates that the event is an OutputRejectedEvent
+	OutputTypeRejectedEvent OutputType = "rejected_event"
+	// OutputTypeSoftFailedEvent indicates that the event is an OutputSoftFailedEvent
+	OutputTypeSoftFailedEvent OutputType = "soft_failed_event"
+	// OutputTypePurgedHistory indicates that the event is an OutputPurgedHistory
+	OutputTypePurgedHistory OutputType = "purged_history"
+	// OutputTypeExpiredEvents indicates that the event is an OutputExpiredEvents
+	OutputTypeExpiredEvents OutputType = "expired_events"
+	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
+	OutputTypeRedactedEvent OutputType = "redacted_event"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +51,16 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeRejectedEvent
+	RejectedEvent *OutputRejectedEvent `json:"rejected_event,omitempty"`
+	// The content of event with type OutputTypeSoftFailedEvent
+	SoftFailedEvent *OutputSoftFailedEvent `json:"soft_failed_event,omitempty"`
+	// The content of event with type OutputTypePurgedHistory
+	PurgedHistory *OutputPurgedHistory `json:"purged_history,omitempty"`
+	// The content of event with type OutputTypeExpiredEvents
+	ExpiredEvents *OutputExpiredEvents `json:"expired_events,omitempty"`
+	// The content of event with type OutputTypeRedactedEvent
+	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -131,3 +151,61 @@ type OutputRetireInviteEvent struct {
 	// "leave" or "ban".
 	Membership string
 }
+
+// An OutputRejectedEvent is written when the roomserver rejects an event
+// because it doesn't pass the authorization rules given its auth events.
+// Rejected events aren't stored.
+type OutputRejectedEvent struct {
+	// The rejected event.
+	Event gomatrixserverlib.Event `json:"event"`
+	// Why the event was rejected.
+	Reason string `json:"reason"`
+}
+
+// An OutputSoftFailedEvent is written when the roomserver soft fails an event,
+// that is when the event passes the authorization rules given its auth events
+// but not given the current state of the room.
+// Soft failed events are stored, and are returned when paginating through the
+// room, but they aren't written as new room events and never become one of the
+// latest events in the room.
+// https://matrix.org/docs/spec/server_server/unstable.html#soft-failure
+type OutputSoftFailedEvent struct {
+	// The soft failed event.
+	Event gomatrixserverlib.Event `json:"event"`
+	// Why the event was soft failed.
+	Reason string `json:"reason"`
+}
+
+// An OutputPurgedHistory is written when old events of a room are purged from
+// the roomserver by a server admin. Consumers storing the events should delete
+// them too. The events of a purge may be split across several
+// OutputPurgedHistory.
+type OutputPurgedHistory struct {
+	// The ID of the room the events were in.
+	RoomID string `json:"room_id"`
+	// The IDs of the purged events.
+	EventIDs []string `json:"event_ids"`
+}
+
+// An OutputExpiredEvents is written when events of a room are redacted by the
+// roomserver because they are older than the m.room.retention policy of the
+// room allows. Consumers storing the events should redact them too.
+type OutputExpiredEvents struct {
+	// The ID of the room the events are in.
+	RoomID string `json:"room_id"`
+	// The IDs of the redacted events.
+	EventIDs []string `json:"event_ids"`
+}
+
+// An OutputRedactedEvent is written when the roomserver applies an
+// m.room.redaction event to the event it redacts. It comes after the
+// OutputNewRoomEvent of the redaction. Consumers storing the event should
+// redact it too.
+type OutputRedactedEvent struct {
+	// The ID of the room the event is in.
+	RoomID string `json:"room_id"`
+	// The ID of the redacted event.
+	RedactedEventID string `json:"redacted_event_id"`
+	// The ID of the m.room.redaction event.
+	RedactionEventID string `json:"redaction_event_id"`
+}
@@ -16,6 +16,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -41,6 +42,8 @@ type QueryLatestEventsAndStateResponse struct {
 	// Does the room exist?
 	// If the room doesn't exist this will be false and LatestEvents will be empty.
 	RoomExists bool `json:"room_exists"`
+	// The version of the room, which decides the format of its events.
+	RoomVersion string `json:"room_version"`
 	// The latest events in the room.
 	// These are used to set the prev_events when sending an event.
 	LatestEvents []gomatrixserverlib.EventReference `json:"latest_events"`
@@ -72,6 +75,8 @@ type QueryStateAfterEventsResponse struct {
 	// Does the room exist on this roomserver?
 	// If the room doesn't exist this will be false and StateEvents will be empty.
 	RoomExists bool `json:"room_exists"`
+	// The version of the room, which decides the format of its events.
+	RoomVersion string `json:"room_version"`
 	// Do all the previous events exist on this roomserver?
 	// If some of previous events do not exist this will be false and StateEvents will be empty.
 	PrevEventsExist bool `json:"prev_events_exist"`
@@ -80,10 +85,40 @@ type QueryStateAfterEventsResponse struct {
 	StateEvents []gomatrixserverlib.Event `json:"state_events"`
 }
 
+// QueryStateAndAuthChainRequest is a request to QueryStateAndAuthChain
+type QueryStateAndAuthChainRequest struct {
+	// The room ID to query the state in.
+	RoomID string `json:"room_id"`
+	// The event to look up the state before.
+	EventID string `json:"event_id"`
+}
+
+// QueryStateAndAuthChainResponse is a response to QueryStateAndAuthChain
+type QueryStateAndAuthChainResponse struct {
+	// Copy of the request for debugging.
+	QueryStateAndAuthChainRequest
+	// Does the room exist on this roomserver?
+	// If the room doesn't exist this will be false and StateEvents will be empty.
+	RoomExists bool `json:"room_exists"`
+	// Does the roomserver know the state before the event?
+	// If the event doesn't exist, is in another room or is an outlier this
+	// will be false and StateEvents will be empty.
+	StateKnown bool `json:"state_known"`
+	// The state events before the event.
+	// This list will be in an arbitrary order.
+	StateEvents []gomatrixserverlib.Event `json:"state_events"`
+	// The events in the auth chains of the state events that aren't already
+	// part of StateEvents.
+	AuthChainEvents []gomatrixserverlib.Event `json:"auth_chain_events"`
+}
+
 // QueryEventsByIDRequest is a request to QueryEventsByID
 type QueryEventsByIDRequest struct {
 	// The event IDs to look up.
 	EventIDs []string `json:"event_ids"`
+	// If set, only the events this user is allowed to see according to the
+	// history visibility of their room are returned.
+	UserID string `json:"user_id,omitempty"`
 }
 
 // QueryEventsByIDResponse is a response to QueryEventsByID
@@ -136,54 +171,328 @@ type QueryInvitesForUserResponse struct {
 	InviteSenderUserIDs []string `json:"invite_sender_user_ids"`
 }
 
+// QueryCurrentStateRequest is a request to QueryCurrentState
+type QueryCurrentStateRequest struct {
+	// The room ID to query the current state for.
+	RoomID string `json:"room_id"`
+	// The state key tuples to fetch from the room current state.
+	// If this list is empty or nil then the IDs of every event in the current
+	// state are returned.
+	StateToFetch []gomatrixserverlib.StateKeyTuple `json:"state_to_fetch"`
+	// If this list isn't empty, only the IDs of the state events with one of
+	// these types are returned, whatever their state key.
+	EventTypes []string `json:"event_types"`
+}
+
+// QueryCurrentStateResponse is a response to QueryCurrentState
+type QueryCurrentStateResponse struct {
+	// Copy of the request for debugging.
+	QueryCurrentStateRequest
+	// Does the room exist?
+	// If the room doesn't exist this will be false and StateEventIDs will be empty.
+	RoomExists bool `json:"room_exists"`
+	// The IDs of the events in the current state of the room.
+	// This list will be in an arbitrary order.
+	// The events themselves can be retrieved with QueryEventsByID.
+	StateEventIDs []string `json:"state_event_ids"`
+}
+
+// QueryMembershipRequest is a request to QueryMembership
+type QueryMembershipRequest struct {
+	// The room ID to look up the membership in.
+	RoomID string `json:"room_id"`
+	// The user ID to look up the membership of.
+	UserID string `json:"user_id"`
+}
+
+// QueryMembershipResponse is a response to QueryMembership
+type QueryMembershipResponse struct {
+	// Copy of the request for debugging.
+	QueryMembershipRequest
+	// Does the room exist?
+	// If the room doesn't exist this will be false and Membership will be empty.
+	RoomExists bool `json:"room_exists"`
+	// The membership of the user in the current state of the room, e.g.
+	// "join" or "invite".
+	// This is empty if there is no m.room.member event for the user.
+	Membership string `json:"membership"`
+	// The ID of the m.room.member event for the user in the current state of
+	// the room, or empty if there is none.
+	EventID string `json:"event_id"`
+}
+
+// QueryEventsByRangeRequest is a request to QueryEventsByRange
+type QueryEventsByRangeRequest struct {
+	// The room ID to look up events in.
+	RoomID string `json:"room_id"`
+	// The user ID the events are for. Only the events this user is allowed to
+	// see according to the history visibility of the room are returned.
+	UserID string `json:"user_id"`
+	// The position to start from, excluded. If 0 the events are looked up
+	// from the start of the room, or from its end if Backwards is set.
+	From int64 `json:"from"`
+	// If set, the position of this event is used instead of From.
+	FromEventID string `json:"from_event_id,omitempty"`
+	// The position to stop at, excluded. If 0 there is no limit.
+	To int64 `json:"to"`
+	// Whether to look up the events before From instead of those after it.
+	Backwards bool `json:"backwards"`
+	// The maximum number of events to look at.
+	Limit int `json:"limit"`
+}
+
+// QueryEventsByRangeResponse is a response to QueryEventsByRange
+type QueryEventsByRangeResponse struct {
+	// Copy of the request for debugging.
+	QueryEventsByRangeRequest
+	// Does the room exist?
+	// If the room doesn't exist this will be false and Events will be empty.
+	RoomExists bool `json:"room_exists"`
+	// The events the user is allowed to see, in the order they were looked
+	// up in, i.e. from the newest to the oldest if Backwards is set.
+	Events []gomatrixserverlib.Event `json:"events"`
+	// The position to use as From to look up the same events again. This is
+	// From, or the position of FromEventID, unless it was 0, in which case
+	// it's the position right before the first event looked at.
+	Start int64 `json:"start"`
+	// The position of the last event looked at, which can be used as the From
+	// of the next request to carry on. Equal to From if there were no events
+	// left to look at.
+	End int64 `json:"end"`
+}
+
+// QueryBackfillRequest is a request to QueryBackfill.
+type QueryBackfillRequest struct {
+	// The room ID to look up events in.
+	RoomID string `json:"room_id"`
+	// The events to start walking back through the room from.
+	EarliestEventIDs []string `json:"earliest_event_ids"`
+	// The maximum number of events to return.
+	Limit int `json:"limit"`
+	// The server requesting the events, which only gets the events it is
+	// allowed to see according to the history visibility of the room.
+	// All the events are returned if empty.
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryBackfillResponse is a response to QueryBackfill.
+type QueryBackfillResponse struct {
+	// Copy of the request for debugging.
+	QueryBackfillRequest
+	// The events found by walking back through the prev_events of the
+	// earliest events, which are included, from the newest to the oldest.
+	Events []gomatrixserverlib.Event `json:"events"`
+	// The events in the auth chains of the events that aren't already part of
+	// Events.
+	AuthChainEvents []gomatrixserverlib.Event `json:"auth_chain_events"`
+}
+
+// QueryRelationsRequest is a request to QueryRelations.
+type QueryRelationsRequest struct {
+	// The IDs of the events to look up the relations to.
+	EventIDs []string `json:"event_ids"`
+	// The user ID of the user the relations are looked up for, used to tell
+	// whether they participated in threads.
+	UserID string `json:"user_id"`
+}
+
+// QueryRelationsResponse is a response to QueryRelations.
+type QueryRelationsResponse struct {
+	// Copy of the request for debugging.
+	QueryRelationsRequest
+	// The relations to the events, by event ID. Events without any relation
+	// are left out.
+	Relations map[string]EventRelations `json:"relations"`
+}
+
+// EventRelations are the aggregated relations of other events to an event.
+type EventRelations struct {
+	// The latest edit of the event by its sender, if any.
+	Replace *gomatrixserverlib.Event `json:"m.replace,omitempty"`
+	// The summary of the thread of replies to the event, if any.
+	Thread *ThreadSummary `json:"m.thread,omitempty"`
+	// The annotations of the event, e.g. reactions, from the most to the
+	// least used key.
+	Annotations []Annotation `json:"m.annotation,omitempty"`
+}
+
+// Annotation is the number of annotations of an event with a key.
+type Annotation struct {
+	// The type of the annotating events, i.e. "m.reaction".
+	Type string `json:"type"`
+	// The key of the annotations, e.g. the emoji of a reaction.
+	Key string `json:"key"`
+	// The number of annotations with the key.
+	Count int64 `json:"count"`
+}
+
+// ThreadSummary is the summary of the thread of replies to an event.
+type ThreadSummary struct {
+	// The number of replies in the thread.
+	Count int64 `json:"count"`
+	// The latest reply in the thread.
+	LatestEvent gomatrixserverlib.Event `json:"latest_event"`
+	// Whether the user sent the event at the root of the thread or any reply.
+	CurrentUserParticipated bool `json:"current_user_participated"`
+}
+
+// QueryRelationEventsRequest is a request to QueryRelationEvents.
+type QueryRelationEventsRequest struct {
+	// The room ID of the event to look up the relations to.
+	RoomID string `json:"room_id"`
+	// The ID of the event to look up the relations to.
+	EventID string `json:"event_id"`
+	// The type of the relations to look up, e.g. "m.thread".
+	RelType string `json:"rel_type"`
+	// The user ID of the user making the request. Only the events they are
+	// allowed to see are returned.
+	UserID string `json:"user_id"`
+	// The position to start looking up events before, from the newest to the
+	// oldest, or 0 to start from the newest event.
+	From int64 `json:"from"`
+	// The maximum number of events to look at.
+	Limit int `json:"limit"`
+}
+
+// QueryRelationEventsResponse is a response to QueryRelationEvents.
+type QueryRelationEventsResponse struct {
+	// Copy of the request for debugging.
+	QueryRelationEventsRequest
+	// Whether the event exists in the room and the user is allowed to see it.
+	EventExists bool `json:"event_exists"`
+	// The events the user is allowed to see, from the newest to the oldest.
+	Events []gomatrixserverlib.Event `json:"events"`
+	// The position to use as From to carry on, or 0 if there are no events
+	// left to look at.
+	Next int64 `json:"next"`
+}
+
 // RoomserverQueryAPI is used to query information from the room server.
 type RoomserverQueryAPI interface {
 	// Query the latest events and state for a room from the room server.
 	QueryLatestEventsAndState(
+		ctx context.Context,
 		request *QueryLatestEventsAndStateRequest,
 		response *QueryLatestEventsAndStateResponse,
 	) error
 
+	// Query the IDs of the events in the current state of a room.
+	QueryCurrentState(
+		ctx context.Context,
+		request *QueryCurrentStateRequest,
+		response *QueryCurrentStateResponse,
+	) error
+
+	// Query the current membership of a user in a room.
+	QueryMembership(
+		ctx context.Context,
+		request *QueryMembershipRequest,
+		response *QueryMembershipResponse,
+	) error
+
 	// Query the state after a list of events in a room from the room server.
 	QueryStateAfterEvents(
+		ctx context.Context,
 		request *QueryStateAfterEventsRequest,
 		response *QueryStateAfterEventsResponse,
 	) error
 
+	// Query the state before an event in a room along with its auth chain.
+	QueryStateAndAuthChain(
+		ctx context.Context,
+		request *QueryStateAndAuthChainRequest,
+		response *QueryStateAndAuthChainResponse,
+	) error
+
 	// Query a list of events by event ID.
 	QueryEventsByID(
+		ctx context.Context,
 		request *QueryEventsByIDRequest,
 		response *QueryEventsByIDResponse,
 	) error
 
+	// Query a range of events in a room, in the order they were received
+	// by the room server.
+	QueryEventsByRange(
+		ctx context.Context,
+		request *QueryEventsByRangeRequest,
+		response *QueryEventsByRangeResponse,
+	) error
+
+	// Query the events before a list of events in a room, walking back
+	// through the event graph, along with their auth chains.
+	QueryBackfill(
+		ctx context.Context,
+		request *QueryBackfillRequest,
+		response *QueryBackfillResponse,
+	) error
+
 	// Query a list of membership events for a room
 	QueryMembershipsForRoom(
+		ctx context.Context,
 		request *QueryMembershipsForRoomRequest,
 		response *QueryMembershipsForRoomResponse,
 	) error
 
 	// Query a list of invite event senders for a user in a room.
 	QueryInvitesForUser(
+		ctx context.Context,
 		request *QueryInvitesForUserRequest,
 		response *QueryInvitesForUserResponse,
 	) error
+
+	// Query the relations of other events, e.g. edits, to a list of events.
+	QueryRelations(
+		ctx context.Context,
+		request *QueryRelationsRequest,
+		response *QueryRelationsResponse,
+	) error
+
+	// Query the events related to an event by relations of a given type,
+	// from the newest to the oldest.
+	QueryRelationEvents(
+		ctx context.Context,
+		request *QueryRelationEventsRequest,
+		response *QueryRelationEventsResponse,
+	) error
 }
 
 // RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
 const RoomserverQueryLatestEventsAndStatePath = "/api/roomserver/queryLatestEventsAndState"
 
+// RoomserverQueryCurrentStatePath is the HTTP path for the QueryCurrentState API.
+const RoomserverQueryCurrentStatePath = "/api/roomserver/queryCurrentState"
+
+// RoomserverQueryMembershipPath is the HTTP path for the QueryMembership API.
+const RoomserverQueryMembershipPath = "/api/roomserver/queryMembership"
+
 // RoomserverQueryStateAfterEventsPath is the HTTP path for the QueryStateAfterEvents API.
 const RoomserverQueryStateAfterEventsPath = "/api/roomserver/queryStateAfterEvents"
 
+// RoomserverQueryStateAndAuthChainPath is the HTTP path for the QueryStateAndAuthChain API.
+const RoomserverQueryStateAndAuthChainPath = "/api/roomserver/queryStateAndAuthChain"
+
 // RoomserverQueryEventsByIDPath is the HTTP path for the QueryEventsByID API.
 const RoomserverQueryEventsByIDPath = "/api/roomserver/queryEventsByID"
 
+// RoomserverQueryEventsByRangePath is the HTTP path for the QueryEventsByRange API.
+const RoomserverQueryEventsByRangePath = "/api/roomserver/queryEventsByRange"
+
+// RoomserverQueryBackfillPath is the HTTP path for the QueryBackfill API.
+const RoomserverQueryBackfillPath = "/api/roomserver/queryBackfill"
+
 // RoomserverQueryMembershipsForRoomPath is the HTTP path for the QueryMembershipsForRoom API
 const RoomserverQueryMembershipsForRoomPath = "/api/roomserver/queryMembershipsForRoom"
 
 // RoomserverQueryInvitesForUserPath is the HTTP path for the QueryInvitesForUser API
 const RoomserverQueryInvitesForUserPath = "/api/roomserver/queryInvitesForUser"
 
+// RoomserverQueryRelationsPath is the HTTP path for the QueryRelations API.
+const RoomserverQueryRelationsPath = "/api/roomserver/queryRelations"
+
+// RoomserverQueryRelationEventsPath is the HTTP path for the QueryRelationEvents API.
+const RoomserverQueryRelationEventsPath = "/api/roomserver/queryRelationEvents"
+
 // NewRoomserverQueryAPIHTTP creates a RoomserverQueryAPI implemented by talking to a HTTP POST API.
 // If httpClient is nil then it uses the http.DefaultClient
 func NewRoomserverQueryAPIHTTP(roomserverURL string, httpClient *http.Client) RoomserverQueryAPI {
@@ -200,55 +509,138 @@ type httpRoomserverQueryAPI struct {
 
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
 	request *QueryLatestEventsAndStateRequest,
 	response *QueryLatestEventsAndStateResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverQueryLatestEventsAndStatePath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryCurrentState implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryCurrentState(
+	ctx context.Context,
+	request *QueryCurrentStateRequest,
+	response *QueryCurrentStateResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryCurrentStatePath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryMembership implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryMembership(
+	ctx context.Context,
+	request *QueryMembershipRequest,
+	response *QueryMembershipResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryMembershipPath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
 }
 
 // QueryStateAfterEvents implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryStateAfterEvents(
+	ctx context.Context,
 	request *QueryStateAfterEventsRequest,
 	response *QueryStateAfterEventsResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverQueryStateAfterEventsPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryStateAndAuthChain implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryStateAndAuthChain(
+	ctx context.Context,
+	request *QueryStateAndAuthChainRequest,
+	response *QueryStateAndAuthChainResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryStateAndAuthChainPath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
 }
 
 // QueryEventsByID implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryEventsByID(
+	ctx context.Context,
 	request *QueryEventsByIDRequest,
 	response *QueryEventsByIDResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverQueryEventsByIDPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryEventsByRange implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryEventsByRange(
+	ctx context.Context,
+	request *QueryEventsByRangeRequest,
+	response *QueryEventsByRangeResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryEventsByRangePath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryBackfill implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryBackfill(
+	ctx context.Context,
+	request *QueryBackfillRequest,
+	response *QueryBackfillResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryBackfillPath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
 }
 
 // QueryMembershipsForRoom implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryMembershipsForRoom(
+	ctx context.Context,
 	request *QueryMembershipsForRoomRequest,
 	response *QueryMembershipsForRoomResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverQueryMembershipsForRoomPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
 }
 
 // QueryInvitesForUser implements RoomserverQueryAPI
 func (h *httpRoomserverQueryAPI) QueryInvitesForUser(
+	ctx context.Context,
 	request *QueryInvitesForUserRequest,
 	response *QueryInvitesForUserResponse,
 ) error {
 	apiURL := h.roomserverURL + RoomserverQueryInvitesForUserPath
-	return postJSON(h.httpClient, apiURL, request, response)
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+// QueryRelations implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRelations(
+	ctx context.Context,
+	request *QueryRelationsRequest,
+	response *QueryRelationsResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryRelationsPath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
 }
 
-func postJSON(httpClient *http.Client, apiURL string, request, response interface{}) error {
+// QueryRelationEvents implements RoomserverQueryAPI
+func (h *httpRoomserverQueryAPI) QueryRelationEvents(
+	ctx context.Context,
+	request *QueryRelationEventsRequest,
+	response *QueryRelationEventsResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryRelationEventsPath
+	return postJSON(ctx, h.httpClient, apiURL, request, response)
+}
+
+func postJSON(
+	ctx context.Context, httpClient *http.Client,
+	apiURL string, request, response interface{},
+) error {
 	jsonBytes, err := json.Marshal(request)
 	if err != nil {
 		return err
 	}
-	res, err := httpClient.Post(apiURL, "application/json", bytes.NewReader(jsonBytes))
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := httpClient.Do(req.WithContext(ctx))
 	if res != nil {
 		defer res.Body.Close()
 	}
@@ -0,0 +1,118 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// A Receipt is sent by a user for an event in a room, e.g. marking the event
+// as read. Only the latest receipt of each type of a user in a room is kept.
+type Receipt struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// The type of the receipt, e.g. "m.read"
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	// When the receipt was sent
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// SetReceiptRequest is a request to SetReceipt
+type SetReceiptRequest struct {
+	Receipt Receipt `json:"receipt"`
+}
+
+// SetReceiptResponse is a response to SetReceipt
+type SetReceiptResponse struct {
+	// The position of the receipt in the receipts stream.
+	StreamPosition int64 `json:"stream_position"`
+}
+
+// QueryReceiptsRequest is a request to QueryReceipts
+type QueryReceiptsRequest struct {
+	// The rooms to get the receipts of.
+	RoomIDs []string `json:"room_ids"`
+	// Only the receipts sent after this position in the receipts stream are
+	// returned. 0 returns the latest receipts of each user in the rooms.
+	AfterPosition int64 `json:"after_position"`
+}
+
+// QueryReceiptsResponse is a response to QueryReceipts
+type QueryReceiptsResponse struct {
+	// The receipts sent in the rooms since the position of the request.
+	Receipts []Receipt `json:"receipts"`
+	// The latest position in the receipts stream, which every returned
+	// receipt is at or before.
+	StreamPosition int64 `json:"stream_position"`
+}
+
+// RoomserverReceiptAPI is used to store and retrieve the receipts sent in
+// rooms.
+type RoomserverReceiptAPI interface {
+	// Store a receipt, replacing the previous receipt of the same type sent
+	// by the user in the room.
+	SetReceipt(
+		req *SetReceiptRequest,
+		response *SetReceiptResponse,
+	) error
+
+	// Get the receipts sent in a set of rooms.
+	QueryReceipts(
+		req *QueryReceiptsRequest,
+		response *QueryReceiptsResponse,
+	) error
+}
+
+// RoomserverSetReceiptPath is the HTTP path for the SetReceipt API.
+const RoomserverSetReceiptPath = "/api/roomserver/setReceipt"
+
+// RoomserverQueryReceiptsPath is the HTTP path for the QueryReceipts API.
+const RoomserverQueryReceiptsPath = "/api/roomserver/queryReceipts"
+
+// NewRoomserverReceiptAPIHTTP creates a RoomserverReceiptAPI implemented by talking to a HTTP POST API.
+// If httpClient is nil then it uses the http.DefaultClient
+func NewRoomserverReceiptAPIHTTP(roomserverURL string, httpClient *http.Client) RoomserverReceiptAPI {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &httpRoomserverReceiptAPI{roomserverURL, httpClient}
+}
+
+type httpRoomserverReceiptAPI struct {
+	roomserverURL string
+	httpClient    *http.Client
+}
+
+// SetReceipt implements RoomserverReceiptAPI
+func (h *httpRoomserverReceiptAPI) SetReceipt(
+	request *SetReceiptRequest,
+	response *SetReceiptResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverSetReceiptPath
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
+}
+
+// QueryReceipts implements RoomserverReceiptAPI
+func (h *httpRoomserverReceiptAPI) QueryReceipts(
+	request *QueryReceiptsRequest,
+	response *QueryReceiptsResponse,
+) error {
+	apiURL := h.roomserverURL + RoomserverQueryReceiptsPath
+	return postJSON(context.TODO(), h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package extremities merges the forward extremities of rooms, i.e. the events
+// no other event follows, when there are too many of them. Rooms gain forward
+// extremities when events arrive out of order over federation, and resolving
+// the state after many extremities gets slow.
+package extremities
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Database has the storage APIs needed to find the rooms to clean up.
+type Database interface {
+	// Look up the IDs of the rooms with more than the given number of latest
+	// events.
+	// Returns an error if there was a problem talking to the database.
+	RoomIDsWithManyLatestEvents(ctx context.Context, maxLatestEvents int) ([]string, error)
+	// Look up the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	// Returns an error if there was a problem talking to the database.
+	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
+	// Lookup the membership event numeric IDs for all user that are or have
+	// been members of a given room. Only lookup events of "join" membership if
+	// joinOnly is set to true.
+	// Returns an error if there was a problem talking to the database.
+	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error)
+	// Look up the Events for a list of numeric event IDs.
+	// Returns a sorted list of events.
+	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+}
+
+// A Cleaner periodically sends an event to the rooms with more forward
+// extremities than configured, with all of them as its prev_events, so that
+// the room has a single forward extremity again.
+// The event is an "m.room.member" event of a local user joined to the room
+// that doesn't change their membership.
+type Cleaner struct {
+	DB       Database
+	Cfg      *config.Dendrite
+	InputAPI api.RoomserverInputAPI
+	QueryAPI api.RoomserverQueryAPI
+}
+
+// Start checking the rooms in a new goroutine, unless it is disabled in the
+// config.
+func (c *Cleaner) Start() {
+	if c.Cfg.RoomServer.MaxForwardExtremities < 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(c.Cfg.RoomServer.ForwardExtremitiesCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := c.cleanUpRooms(context.Background()); err != nil {
+				log.WithError(err).Warn("Failed to merge the forward extremities of rooms")
+			}
+		}
+	}()
+}
+
+func (c *Cleaner) cleanUpRooms(ctx context.Context) error {
+	roomIDs, err := c.DB.RoomIDsWithManyLatestEvents(ctx, c.Cfg.RoomServer.MaxForwardExtremities)
+	if err != nil {
+		return err
+	}
+	for _, roomID := range roomIDs {
+		// Carry on with the other rooms if one of them fails, since the error
+		// could be specific to the room.
+		if err = c.mergeForwardExtremities(ctx, roomID); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Warn("Failed to merge the forward extremities of room")
+		}
+	}
+	return nil
+}
+
+// mergeForwardExtremities sends an event to the room which follows all of its
+// latest events.
+func (c *Cleaner) mergeForwardExtremities(ctx context.Context, roomID string) error {
+	userID, err := c.localJoinedUser(ctx, roomID)
+	if err != nil || userID == "" {
+		// Only the servers with a user in the room can send events to it.
+		return err
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+	}
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+	if err != nil {
+		return err
+	}
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: eventsNeeded.Tuples(),
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err = c.QueryAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return err
+	}
+	if len(res.LatestEvents) <= c.Cfg.RoomServer.MaxForwardExtremities {
+		// The extremities were merged since we looked the room up.
+		return nil
+	}
+	builder.Depth = res.Depth
+	builder.PrevEvents = res.LatestEvents
+
+	// Copy the content of the current membership event of the user, so that
+	// neither their membership nor their profile changes.
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range res.StateEvents {
+		authEvents.AddEvent(&res.StateEvents[i]) // nolint: errcheck
+	}
+	member, err := authEvents.Member(userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		// The user left the room since we looked it up.
+		return nil
+	}
+	if err = builder.SetContent(json.RawMessage(member.Content())); err != nil {
+		return err
+	}
+	refs, err := eventsNeeded.AuthEventReferences(&authEvents)
+	if err != nil {
+		return err
+	}
+	builder.AuthEvents = refs
+
+	event, err := common.BuildEvent(
+		&builder, res.RoomVersion, time.Now(), c.Cfg.Matrix.ServerName, c.Cfg.Matrix.KeyID, c.Cfg.Matrix.PrivateKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:         api.KindNew,
+			Event:        event,
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(c.Cfg.Matrix.ServerName),
+		}},
+	}
+	var inputRes api.InputRoomEventsResponse
+	return c.InputAPI.InputRoomEvents(&inputReq, &inputRes)
+}
+
+// localJoinedUser returns the ID of a user of this server joined to the room,
+// or an empty string if there isn't one.
+func (c *Cleaner) localJoinedUser(ctx context.Context, roomID string) (string, error) {
+	roomNID, err := c.DB.RoomNID(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return "", err
+	}
+	eventNIDs, err := c.DB.GetMembershipEventNIDsForRoom(ctx, roomNID, true)
+	if err != nil {
+		return "", err
+	}
+	events, err := c.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return "", err
+	}
+	for _, event := range events {
+		if event.StateKey() == nil {
+			continue
+		}
+		_, domain, splitErr := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if splitErr == nil && domain == c.Cfg.Matrix.ServerName {
+			return *event.StateKey(), nil
+		}
+	}
+	return "", nil
+}
@@ -15,157 +15,249 @@
 package input
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
-	"sort"
 )
 
 // checkAuthEvents checks that the event passes authentication checks
 // Returns the numeric IDs for the auth events.
-func checkAuthEvents(db RoomEventDatabase, event gomatrixserverlib.Event, authEventIDs []string) ([]types.EventNID, error) {
+func checkAuthEvents(ctx context.Context, db RoomEventDatabase, event gomatrixserverlib.Event, authEventIDs []string) ([]types.EventNID, error) {
 	// Grab the numeric IDs for the supplied auth state events from the database.
-	authStateEntries, err := db.StateEntriesForEventIDs(authEventIDs)
+	authStateEntries, err := db.StateEntriesForEventIDs(ctx, authEventIDs)
 	if err != nil {
 		return nil, err
 	}
-	// TODO: check for duplicate state keys here.
-
-	// Work out which of the state events we actually need.
-	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event})
+	result := make([]types.EventNID, len(authStateEntries))
+	for i := range authStateEntries {
+		result[i] = authStateEntries[i].EventNID
+	}
 
 	// Load the actual auth events from the database.
-	authEvents, err := loadAuthEvents(db, stateNeeded, authStateEntries)
+	events, err := db.Events(ctx, result)
 	if err != nil {
 		return nil, err
 	}
+	authEvents := make([]gomatrixserverlib.Event, len(events))
+	for i := range events {
+		authEvents[i] = events[i].Event
+	}
 
 	// Check if the event is allowed.
-	if err = gomatrixserverlib.Allowed(event, &authEvents); err != nil {
+	if err = CheckEventAuthRules(event, authEvents); err != nil {
 		return nil, err
 	}
 
 	// Return the numeric IDs for the auth events.
-	result := make([]types.EventNID, len(authStateEntries))
-	for i := range authStateEntries {
-		result[i] = authStateEntries[i].EventNID
-	}
 	return result, nil
 }
 
-type authEvents struct {
-	stateKeyNIDMap map[string]types.EventStateKeyNID
-	state          stateEntryMap
-	events         eventMap
-}
-
-// Create implements gomatrixserverlib.AuthEventProvider
-func (ae *authEvents) Create() (*gomatrixserverlib.Event, error) {
-	return ae.lookupEventWithEmptyStateKey(types.MRoomCreateNID), nil
-}
-
-// PowerLevels implements gomatrixserverlib.AuthEventProvider
-func (ae *authEvents) PowerLevels() (*gomatrixserverlib.Event, error) {
-	return ae.lookupEventWithEmptyStateKey(types.MRoomPowerLevelsNID), nil
-}
-
-// JoinRules implements gomatrixserverlib.AuthEventProvider
-func (ae *authEvents) JoinRules() (*gomatrixserverlib.Event, error) {
-	return ae.lookupEventWithEmptyStateKey(types.MRoomJoinRulesNID), nil
-}
+// CheckEventAuthRules checks that an event passes the authorization rules of the
+// Matrix specification given its auth events.
+// https://matrix.org/docs/spec/rooms/v1#authorization-rules
+// As well as the rules for each type of event, which gomatrixserverlib implements,
+// this checks that the auth events are the ones the event should have.
+// Returns a *gomatrixserverlib.NotAllowed error if the event doesn't pass the rules,
+// or a common.UnsupportedRoomVersionError if it creates a room of a version this
+// server doesn't support.
+func CheckEventAuthRules(event gomatrixserverlib.Event, authEvents []gomatrixserverlib.Event) error {
+	if event.Type() == gomatrixserverlib.MRoomCreate {
+		// The create event is the first event in the room so there is nothing
+		// that can authorise it.
+		if len(authEvents) > 0 {
+			return notAllowed("create event %q has auth events", event.EventID())
+		}
+		if err := checkCreateEventContent(event); err != nil {
+			return err
+		}
+		provider := gomatrixserverlib.NewAuthEvents(nil)
+		return gomatrixserverlib.Allowed(event, &provider)
+	}
 
-// Memmber implements gomatrixserverlib.AuthEventProvider
-func (ae *authEvents) Member(stateKey string) (*gomatrixserverlib.Event, error) {
-	return ae.lookupEvent(types.MRoomMemberNID, stateKey), nil
-}
+	allowed := allowedAuthEventTuples(event)
+	provider := gomatrixserverlib.NewAuthEvents(nil)
+	seen := map[gomatrixserverlib.StateKeyTuple]bool{}
+	for i := range authEvents {
+		authEvent := &authEvents[i]
+		if authEvent.RoomID() != event.RoomID() {
+			return notAllowed("auth event %q is in room %q, not %q", authEvent.EventID(), authEvent.RoomID(), event.RoomID())
+		}
+		if authEvent.StateKey() == nil {
+			return notAllowed("auth event %q is not a state event", authEvent.EventID())
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: authEvent.Type(), StateKey: *authEvent.StateKey()}
+		if seen[tuple] {
+			return notAllowed("event %q has more than one %q auth event with state key %q", event.EventID(), tuple.EventType, tuple.StateKey)
+		}
+		if !allowed[tuple] {
+			return notAllowed("auth event %q with type %q and state key %q is not needed by event %q", authEvent.EventID(), tuple.EventType, tuple.StateKey, event.EventID())
+		}
+		seen[tuple] = true
+		provider.AddEvent(authEvent) // nolint: errcheck
+	}
+	if !seen[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}] {
+		return notAllowed("event %q has no create event in its auth events", event.EventID())
+	}
 
-// ThirdPartyInvite implements gomatrixserverlib.AuthEventProvider
-func (ae *authEvents) ThirdPartyInvite(stateKey string) (*gomatrixserverlib.Event, error) {
-	return ae.lookupEvent(types.MRoomThirdPartyInviteNID, stateKey), nil
+	if err := gomatrixserverlib.Allowed(event, &provider); err != nil {
+		return err
+	}
+	return checkVersion6AuthRules(event, &provider)
 }
 
-func (ae *authEvents) lookupEventWithEmptyStateKey(typeNID types.EventTypeNID) *gomatrixserverlib.Event {
-	eventNID, ok := ae.state.lookup(types.StateKeyTuple{typeNID, types.EmptyStateKeyNID})
-	if !ok {
-		return nil
+// checkVersion6AuthRules checks the authorization rules that room version 6
+// changes, since gomatrixserverlib follows the rules of the earlier versions.
+// m.room.aliases events lose their special case and need the sender to be in
+// the room with the power level for the event, like other state events, and
+// changing the power levels needed for notifications needs the sender to have
+// both the old and the new levels.
+// https://matrix.org/docs/spec/rooms/v6#authorization-rules
+func checkVersion6AuthRules(event gomatrixserverlib.Event, provider gomatrixserverlib.AuthEventProvider) error {
+	create, err := provider.Create()
+	if err != nil || create == nil {
+		return err
 	}
-	event, ok := ae.events.lookup(eventNID)
-	if !ok {
+	if roomVersion, _ := common.RoomVersionFromCreateEvent(*create); roomVersion != "6" {
 		return nil
 	}
-	return &event.Event
-}
-
-func (ae *authEvents) lookupEvent(typeNID types.EventTypeNID, stateKey string) *gomatrixserverlib.Event {
-	stateKeyNID, ok := ae.stateKeyNIDMap[stateKey]
-	if !ok {
-		return nil
+	powerLevelsEvent, err := provider.PowerLevels()
+	if err != nil {
+		return err
 	}
-	eventNID, ok := ae.state.lookup(types.StateKeyTuple{typeNID, stateKeyNID})
-	if !ok {
-		return nil
+	// Every member can send any event while the room has no power levels.
+	var powerLevels *common.PowerLevelContent
+	if powerLevelsEvent != nil {
+		content := common.DefaultPowerLevelContent()
+		powerLevels = &content
+		if err = json.Unmarshal(powerLevelsEvent.Content(), powerLevels); err != nil {
+			return notAllowed("power levels event %q has invalid content: %s", powerLevelsEvent.EventID(), err)
+		}
 	}
-	event, ok := ae.events.lookup(eventNID)
-	if !ok {
-		return nil
+
+	switch event.Type() {
+	case gomatrixserverlib.MRoomAliases:
+		member, err := provider.Member(event.Sender())
+		if err != nil {
+			return err
+		}
+		if member == nil {
+			return notAllowed("sender %q of event %q is not in the room", event.Sender(), event.EventID())
+		}
+		if membership, err := member.Membership(); err != nil || membership != "join" {
+			return notAllowed("sender %q of event %q is not in the room", event.Sender(), event.EventID())
+		}
+		if powerLevels == nil {
+			return nil
+		}
+		if level, needed := powerLevels.UserLevel(event.Sender()), powerLevels.EventLevel(event.Type(), true); level < needed {
+			return notAllowed("sender %q of event %q has power level %d < %d", event.Sender(), event.EventID(), level, needed)
+		}
+	case gomatrixserverlib.MRoomPowerLevels:
+		if powerLevels == nil {
+			return nil
+		}
+		newPowerLevels := common.DefaultPowerLevelContent()
+		if err := json.Unmarshal(event.Content(), &newPowerLevels); err != nil {
+			return notAllowed("power levels event %q has invalid content: %s", event.EventID(), err)
+		}
+		senderLevel := powerLevels.UserLevel(event.Sender())
+		for key, oldLevel := range powerLevels.Notifications {
+			if newLevel, ok := newPowerLevels.Notifications[key]; (!ok || newLevel != oldLevel) && oldLevel > senderLevel {
+				return notAllowed("sender %q of event %q can't change the %q notifications level %d", event.Sender(), event.EventID(), key, oldLevel)
+			}
+		}
+		for key, newLevel := range newPowerLevels.Notifications {
+			if oldLevel, ok := powerLevels.Notifications[key]; (!ok || newLevel != oldLevel) && newLevel > senderLevel {
+				return notAllowed("sender %q of event %q can't set the %q notifications level to %d", event.Sender(), event.EventID(), key, newLevel)
+			}
+		}
 	}
-	return &event.Event
+	return nil
 }
 
-// loadAuthEvents loads the events needed for authentication from the supplied room state.
-func loadAuthEvents(
-	db RoomEventDatabase,
-	needed gomatrixserverlib.StateNeeded,
-	state []types.StateEntry,
-) (result authEvents, err error) {
-	// Look up the numeric IDs for the state keys needed for auth.
-	var neededStateKeys []string
-	neededStateKeys = append(neededStateKeys, needed.Member...)
-	neededStateKeys = append(neededStateKeys, needed.ThirdPartyInvite...)
-	if result.stateKeyNIDMap, err = db.EventStateKeyNIDs(neededStateKeys); err != nil {
-		return
-	}
-
-	// Load the events we need.
-	result.state = state
-	var eventNIDs []types.EventNID
-	keyTuplesNeeded := stateKeyTuplesNeeded(result.stateKeyNIDMap, needed)
-	for _, keyTuple := range keyTuplesNeeded {
-		eventNID, ok := result.state.lookup(keyTuple)
-		if ok {
-			eventNIDs = append(eventNIDs, eventNID)
-		}
-	}
-	if result.events, err = db.Events(eventNIDs); err != nil {
-		return
+// checkAllowedByState checks that an event passes the authorization rules when
+// its auth events are taken from the state at a snapshot instead of from its
+// own auth events. This is used to soft fail events that pass the auth checks
+// against their auth events but not against the current state of the room.
+// https://matrix.org/docs/spec/server_server/unstable.html#soft-failure
+// Returns a *gomatrixserverlib.NotAllowed error if the event doesn't pass the rules.
+func checkAllowedByState(
+	ctx context.Context, db RoomEventDatabase, event gomatrixserverlib.Event, stateNID types.StateSnapshotNID,
+) error {
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event})
+	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(ctx, db, stateNID, stateNeeded.Tuples())
+	if err != nil {
+		return err
 	}
-	return
+	eventNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		eventNIDs[i] = stateEntries[i].EventNID
+	}
+	stateEvents, err := db.Events(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+	provider := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range stateEvents {
+		provider.AddEvent(&stateEvents[i].Event) // nolint: errcheck
+	}
+	if err = gomatrixserverlib.Allowed(event, &provider); err != nil {
+		return err
+	}
+	return checkVersion6AuthRules(event, &provider)
 }
 
-// stateKeyTuplesNeeded works out which numeric state key tuples we need to authenticate some events.
-func stateKeyTuplesNeeded(stateKeyNIDMap map[string]types.EventStateKeyNID, stateNeeded gomatrixserverlib.StateNeeded) []types.StateKeyTuple {
-	var keyTuples []types.StateKeyTuple
-	if stateNeeded.Create {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomCreateNID, types.EmptyStateKeyNID})
+// checkCreateEventContent checks the content of a create event, which must name
+// the creator of the room and a room version this server supports.
+func checkCreateEventContent(event gomatrixserverlib.Event) error {
+	var content struct {
+		Creator string `json:"creator"`
 	}
-	if stateNeeded.PowerLevels {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomPowerLevelsNID, types.EmptyStateKeyNID})
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return notAllowed("create event %q has invalid content: %s", event.EventID(), err)
 	}
-	if stateNeeded.JoinRules {
-		keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomJoinRulesNID, types.EmptyStateKeyNID})
+	if content.Creator == "" {
+		return notAllowed("create event %q has no creator", event.EventID())
 	}
-	for _, member := range stateNeeded.Member {
-		stateKeyNID, ok := stateKeyNIDMap[member]
-		if ok {
-			keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomMemberNID, stateKeyNID})
-		}
+	roomVersion, err := common.RoomVersionFromCreateEvent(event)
+	if err != nil {
+		return notAllowed("create event %q has invalid content: %s", event.EventID(), err)
 	}
-	for _, token := range stateNeeded.ThirdPartyInvite {
-		stateKeyNID, ok := stateKeyNIDMap[token]
-		if ok {
-			keyTuples = append(keyTuples, types.StateKeyTuple{types.MRoomThirdPartyInviteNID, stateKeyNID})
-		}
+	return common.CheckRoomVersion(event.RoomID(), roomVersion)
+}
+
+// allowedAuthEventTuples returns the types and state keys that the auth events of
+// an event can have, following the auth events selection algorithm.
+// https://matrix.org/docs/spec/server_server/unstable.html#auth-events-selection
+func allowedAuthEventTuples(event gomatrixserverlib.Event) map[gomatrixserverlib.StateKeyTuple]bool {
+	// Every event can be authorised by the create event, the power levels and
+	// the membership of its sender.
+	allowed := map[gomatrixserverlib.StateKeyTuple]bool{
+		{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}:             true,
+		{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}:        true,
+		{EventType: gomatrixserverlib.MRoomMember, StateKey: event.Sender()}: true,
 	}
-	return keyTuples
+	// The membership of the target of a member event, the join rules and the
+	// third party invites are the ones needed by the auth checks.
+	for _, tuple := range gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event}).Tuples() {
+		allowed[tuple] = true
+	}
+	// Invites can also be authorised by the join rules, even though the auth
+	// checks don't look at them.
+	if membership, err := event.Membership(); err == nil && membership == "invite" {
+		allowed[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}] = true
+	}
+	return allowed
+}
+
+func notAllowed(format string, args ...interface{}) error {
+	return &gomatrixserverlib.NotAllowed{Message: fmt.Sprintf(format, args...)}
 }
 
 // Map from event type, state key tuple to numeric event ID.
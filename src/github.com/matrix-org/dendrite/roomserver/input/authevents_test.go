@@ -15,8 +15,10 @@
 package input
 
 import (
-	"github.com/matrix-org/dendrite/roomserver/types"
 	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func benchmarkStateEntryMapLookup(entries, lookups int64, b *testing.B) {
@@ -129,3 +131,73 @@ func TestEventMap(t *testing.T) {
 	}
 
 }
+
+func mustEventFromJSON(t *testing.T, eventJSON string) gomatrixserverlib.Event {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestCheckEventAuthRules(t *testing.T) {
+	create := mustEventFromJSON(t, `{"event_id":"$create:a","room_id":"!r:a","sender":"@u:a","type":"m.room.create","state_key":"","content":{"creator":"@u:a"}}`)
+	join := mustEventFromJSON(t, `{"event_id":"$join:a","room_id":"!r:a","sender":"@u:a","type":"m.room.member","state_key":"@u:a","content":{"membership":"join"},"prev_events":[["$create:a",{}]]}`)
+	otherCreate := mustEventFromJSON(t, `{"event_id":"$create:b","room_id":"!r:b","sender":"@u:b","type":"m.room.create","state_key":"","content":{"creator":"@u:b"}}`)
+	message := mustEventFromJSON(t, `{"event_id":"$message:a","room_id":"!r:a","sender":"@u:a","type":"m.room.message","content":{"body":"hello"}}`)
+	joinRules := mustEventFromJSON(t, `{"event_id":"$join_rules:a","room_id":"!r:a","sender":"@u:a","type":"m.room.join_rules","state_key":"","content":{"join_rule":"public"}}`)
+
+	if err := CheckEventAuthRules(create, nil); err != nil {
+		t.Errorf("wanted the create event to be allowed, got %v", err)
+	}
+	if err := CheckEventAuthRules(join, []gomatrixserverlib.Event{create}); err != nil {
+		t.Errorf("wanted the first join to be allowed, got %v", err)
+	}
+	if err := CheckEventAuthRules(message, []gomatrixserverlib.Event{create, join}); err != nil {
+		t.Errorf("wanted the message to be allowed, got %v", err)
+	}
+
+	noCreator := mustEventFromJSON(t, `{"event_id":"$create:a","room_id":"!r:a","sender":"@u:a","type":"m.room.create","state_key":"","content":{}}`)
+	for name, test := range map[string]struct {
+		event      gomatrixserverlib.Event
+		authEvents []gomatrixserverlib.Event
+	}{
+		"create event with auth events": {create, []gomatrixserverlib.Event{otherCreate}},
+		"create event without creator":  {noCreator, nil},
+		"no create event":               {message, []gomatrixserverlib.Event{join}},
+		"duplicate auth events":         {message, []gomatrixserverlib.Event{create, join, join}},
+		"auth event from another room":  {message, []gomatrixserverlib.Event{otherCreate, join}},
+		"auth event not needed":         {message, []gomatrixserverlib.Event{create, join, joinRules}},
+		"auth event that isn't state":   {message, []gomatrixserverlib.Event{create, join, message}},
+		"sender not in the room":        {message, []gomatrixserverlib.Event{create}},
+	} {
+		err := CheckEventAuthRules(test.event, test.authEvents)
+		if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok {
+			t.Errorf("%s: wanted a NotAllowed error, got %v", name, err)
+		}
+	}
+}
+
+func TestCheckEventAuthRulesVersion6(t *testing.T) {
+	powerLevels := mustEventFromJSON(t, `{"event_id":"$power_levels:a","room_id":"!r:a","sender":"@u:a","type":"m.room.power_levels","state_key":"","content":{"users":{"@u:a":100,"@m:a":50},"notifications":{"room":50}}}`)
+	joinM := mustEventFromJSON(t, `{"event_id":"$join_m:a","room_id":"!r:a","sender":"@m:a","type":"m.room.member","state_key":"@m:a","content":{"membership":"join"}}`)
+	joinV := mustEventFromJSON(t, `{"event_id":"$join_v:a","room_id":"!r:a","sender":"@v:a","type":"m.room.member","state_key":"@v:a","content":{"membership":"join"}}`)
+	aliases := mustEventFromJSON(t, `{"event_id":"$aliases:a","room_id":"!r:a","sender":"@v:a","type":"m.room.aliases","state_key":"a","content":{"aliases":["#r:a"]}}`)
+	notifications := mustEventFromJSON(t, `{"event_id":"$notifications:a","room_id":"!r:a","sender":"@m:a","type":"m.room.power_levels","state_key":"","content":{"users":{"@u:a":100,"@m:a":50},"notifications":{"room":100}}}`)
+
+	for _, roomVersion := range []string{"5", "6"} {
+		create := mustEventFromJSON(t, `{"event_id":"$create:a","room_id":"!r:a","sender":"@u:a","type":"m.room.create","state_key":"","content":{"creator":"@u:a","room_version":"`+roomVersion+`"}}`)
+
+		// Room version 6 needs the power level of the event type for
+		// m.room.aliases events, and the old and new levels to change the
+		// power levels needed for notifications.
+		err := CheckEventAuthRules(aliases, []gomatrixserverlib.Event{create, powerLevels, joinV})
+		if _, notAllowed := err.(*gomatrixserverlib.NotAllowed); notAllowed != (roomVersion == "6") || (err != nil && !notAllowed) {
+			t.Errorf("room version %s: unexpected result for aliases without power: %v", roomVersion, err)
+		}
+		err = CheckEventAuthRules(notifications, []gomatrixserverlib.Event{create, powerLevels, joinM})
+		if _, notAllowed := err.(*gomatrixserverlib.NotAllowed); notAllowed != (roomVersion == "6") || (err != nil && !notAllowed) {
+			t.Errorf("room version %s: unexpected result for raising the notifications level: %v", roomVersion, err)
+		}
+	}
+}
@@ -16,11 +16,13 @@
 package input
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	sarama "gopkg.in/Shopify/sarama.v1"
 )
@@ -56,13 +58,14 @@ func (r *RoomserverInputAPI) InputRoomEvents(
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) error {
+	ctx := context.TODO()
 	for i := range request.InputRoomEvents {
-		if err := processRoomEvent(r.DB, r, request.InputRoomEvents[i]); err != nil {
+		if err := processRoomEvent(ctx, r.DB, r, request.InputRoomEvents[i]); err != nil {
 			return err
 		}
 	}
 	for i := range request.InputInviteEvents {
-		if err := processInviteEvent(r.DB, r, request.InputInviteEvents[i]); err != nil {
+		if err := processInviteEvent(ctx, r.DB, r, request.InputInviteEvents[i]); err != nil {
 			return err
 		}
 	}
@@ -79,6 +82,11 @@ func (r *RoomserverInputAPI) SetupHTTP(servMux *http.ServeMux) {
 				return util.MessageResponse(400, err.Error())
 			}
 			if err := r.InputRoomEvents(&request, &response); err != nil {
+				if _, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+					// The event was rejected by the auth rules rather than
+					// failing because of a problem in the roomserver.
+					return util.MessageResponse(403, err.Error())
+				}
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
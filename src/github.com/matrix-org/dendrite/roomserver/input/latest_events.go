@@ -16,6 +16,9 @@ package input
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -42,6 +45,7 @@ import (
 //      7 <----- latest
 //
 func updateLatestEvents(
+	ctx context.Context,
 	db RoomEventDatabase,
 	ow OutputRoomEventWriter,
 	roomNID types.RoomNID,
@@ -49,7 +53,7 @@ func updateLatestEvents(
 	event gomatrixserverlib.Event,
 	sendAsServer string,
 ) (err error) {
-	updater, err := db.GetLatestEventsForUpdate(roomNID)
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
 	if err != nil {
 		return
 	}
@@ -57,7 +61,7 @@ func updateLatestEvents(
 	defer common.EndTransaction(updater, &succeeded)
 
 	u := latestEventsUpdater{
-		db: db, updater: updater, ow: ow, roomNID: roomNID,
+		ctx: ctx, db: db, updater: updater, ow: ow, roomNID: roomNID,
 		stateAtEvent: stateAtEvent, event: event, sendAsServer: sendAsServer,
 	}
 	if err = u.doUpdateLatestEvents(); err != nil {
@@ -73,8 +77,9 @@ func updateLatestEvents(
 // The state could be passed using function arguments, but it becomes impractical
 // when there are so many variables to pass around.
 type latestEventsUpdater struct {
+	ctx          context.Context
 	db           RoomEventDatabase
-	updater      types.RoomRecentEventsUpdater
+	updater      RoomRecentEventsUpdater
 	ow           OutputRoomEventWriter
 	roomNID      types.RoomNID
 	stateAtEvent types.StateAtEvent
@@ -113,6 +118,21 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return nil
 	}
 
+	if u.oldStateNID != 0 {
+		// Check that the event is allowed by the current state of the room. Events
+		// that pass the auth checks against their auth events but not against the
+		// current state are soft failed: they are stored but they don't become one
+		// of the latest events and aren't sent to the output log as new events.
+		// https://matrix.org/docs/spec/server_server/unstable.html#soft-failure
+		if err = checkAllowedByState(u.ctx, u.db, u.event, u.oldStateNID); err != nil {
+			notAllowed, ok := err.(*gomatrixserverlib.NotAllowed)
+			if !ok {
+				return err
+			}
+			return u.softFail(notAllowed)
+		}
+	}
+
 	if err = u.updater.StorePreviousEvents(u.stateAtEvent.EventNID, prevEvents); err != nil {
 		return err
 	}
@@ -133,7 +153,7 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return err
 	}
 
-	updates, err := updateMemberships(u.db, u.updater, u.removed, u.added)
+	updates, err := updateMemberships(u.ctx, u.db, u.updater, u.removed, u.added)
 	if err != nil {
 		return err
 	}
@@ -144,6 +164,28 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 	}
 	updates = append(updates, *update)
 
+	// The auth checks only allow redactions by users with enough power, or
+	// from the server that sent the redacted event.
+	if u.event.Type() == "m.room.redaction" && u.event.Redacts() != "" {
+		allowed, err := u.redactionAllowed()
+		if err != nil {
+			return err
+		}
+		if allowed {
+			if err = u.updater.RedactEvent(u.event.Redacts()); err != nil {
+				return err
+			}
+			updates = append(updates, api.OutputEvent{
+				Type: api.OutputTypeRedactedEvent,
+				RedactedEvent: &api.OutputRedactedEvent{
+					RoomID:           u.event.RoomID(),
+					RedactedEventID:  u.event.Redacts(),
+					RedactionEventID: u.event.EventID(),
+				},
+			})
+		}
+	}
+
 	// Send the event to the output logs.
 	// We do this inside the database transaction to ensure that we only mark an event as sent if we sent it.
 	// (n.b. this means that it's possible that the same event will be sent twice if the transaction fails but
@@ -164,9 +206,82 @@ func (u *latestEventsUpdater) doUpdateLatestEvents() error {
 		return err
 	}
 
+	if err = u.updater.StoreRelation(u.stateAtEvent.EventNID, u.event); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// redactionAllowed returns whether the redaction being processed can be applied.
+// Since room version 3 event IDs don't give the server that sent the event, so
+// the auth checks allow redactions of any event and the redaction is only
+// applied if the sender is on the server of the sender of the redacted event,
+// or has the power level needed to redact events.
+// https://matrix.org/docs/spec/rooms/v3#handling-redactions
+func (u *latestEventsUpdater) redactionAllowed() (bool, error) {
+	if strings.Contains(u.event.Redacts(), ":") {
+		return true, nil
+	}
+	redacted, err := u.updater.EventsFromIDs(u.ctx, []string{u.event.Redacts()})
+	if err != nil || len(redacted) == 0 {
+		// Unknown events aren't redacted anyway.
+		return true, err
+	}
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', u.event.Sender())
+	if err != nil {
+		return false, nil
+	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', redacted[0].Sender()); err == nil && domain == senderDomain {
+		return true, nil
+	}
+
+	authEvents, err := u.updater.EventsFromIDs(u.ctx, u.event.AuthEventIDs())
+	if err != nil {
+		return false, err
+	}
+	var creator string
+	var powerLevels *common.PowerLevelContent
+	for _, authEvent := range authEvents {
+		switch authEvent.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			var content struct {
+				Creator string `json:"creator"`
+			}
+			if err = json.Unmarshal(authEvent.Content(), &content); err != nil {
+				return false, nil
+			}
+			creator = content.Creator
+		case gomatrixserverlib.MRoomPowerLevels:
+			content := common.DefaultPowerLevelContent()
+			if err = json.Unmarshal(authEvent.Content(), &content); err != nil {
+				return false, nil
+			}
+			powerLevels = &content
+		}
+	}
+	if powerLevels == nil {
+		// Only the creator of the room has power while the room has no power
+		// levels.
+		return u.event.Sender() == creator, nil
+	}
+	return powerLevels.UserLevel(u.event.Sender()) >= powerLevels.Redact, nil
+}
+
+// softFail marks the event as soft failed and tells the output log about it.
+func (u *latestEventsUpdater) softFail(reason *gomatrixserverlib.NotAllowed) error {
+	if err := u.updater.MarkEventAsSoftFailed(u.stateAtEvent.EventNID); err != nil {
+		return err
+	}
+	return u.ow.WriteOutputEvents(u.event.RoomID(), []api.OutputEvent{{
+		Type: api.OutputTypeSoftFailedEvent,
+		SoftFailedEvent: &api.OutputSoftFailedEvent{
+			Event:  u.event,
+			Reason: reason.Message,
+		},
+	}})
+}
+
 func (u *latestEventsUpdater) latestState() error {
 	var err error
 
@@ -174,18 +289,18 @@ func (u *latestEventsUpdater) latestState() error {
 	for i := range u.latest {
 		latestStateAtEvents[i] = u.latest[i].StateAtEvent
 	}
-	u.newStateNID, err = state.CalculateAndStoreStateAfterEvents(u.db, u.roomNID, latestStateAtEvents)
+	u.newStateNID, err = state.CalculateAndStoreStateAfterEvents(u.ctx, u.updater, u.roomNID, latestStateAtEvents)
 	if err != nil {
 		return err
 	}
 
-	u.removed, u.added, err = state.DifferenceBetweeenStateSnapshots(u.db, u.oldStateNID, u.newStateNID)
+	u.removed, u.added, err = state.DifferenceBetweeenStateSnapshots(u.ctx, u.updater, u.oldStateNID, u.newStateNID)
 	if err != nil {
 		return err
 	}
 
 	u.stateBeforeEventRemoves, u.stateBeforeEventAdds, err = state.DifferenceBetweeenStateSnapshots(
-		u.db, u.newStateNID, u.stateAtEvent.BeforeStateSnapshotNID,
+		u.ctx, u.updater, u.newStateNID, u.stateAtEvent.BeforeStateSnapshotNID,
 	)
 	if err != nil {
 		return err
@@ -253,7 +368,7 @@ func (u *latestEventsUpdater) makeOutputNewRoomEvent() (*api.OutputEvent, error)
 		stateEventNIDs = append(stateEventNIDs, entry.EventNID)
 	}
 	stateEventNIDs = stateEventNIDs[:util.SortAndUnique(eventNIDSorter(stateEventNIDs))]
-	eventIDMap, err := u.db.EventIDs(stateEventNIDs)
+	eventIDMap, err := u.db.EventIDs(u.ctx, stateEventNIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,509 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRoomEventDatabase is an in-memory RoomEventDatabase for a single room.
+// It stores every state snapshot as a list of state blocks, like the SQL
+// storage does, so that the state package works the same way on top of it.
+type fakeRoomEventDatabase struct {
+	events          []types.Event
+	eventNIDs       map[string]types.EventNID
+	eventTypeNIDs   map[string]types.EventTypeNID
+	stateKeyNIDs    map[string]types.EventStateKeyNID
+	stateBlocks     [][]types.StateEntry
+	snapshots       [][]types.StateBlockNID
+	stateAtEvents   map[types.EventNID]types.StateSnapshotNID
+	referenced      map[string]bool
+	sent            map[types.EventNID]bool
+	softFailed      map[types.EventNID]bool
+	redacted        map[string]bool
+	latest          []types.StateAtEventAndReference
+	lastEventSent   string
+	currentStateNID types.StateSnapshotNID
+}
+
+func newFakeRoomEventDatabase() *fakeRoomEventDatabase {
+	return &fakeRoomEventDatabase{
+		eventNIDs: map[string]types.EventNID{},
+		// The SQL storage starts with the numeric IDs that the roomserver
+		// assumes for these event types and state keys.
+		eventTypeNIDs: map[string]types.EventTypeNID{
+			gomatrixserverlib.MRoomCreate:           types.MRoomCreateNID,
+			gomatrixserverlib.MRoomPowerLevels:      types.MRoomPowerLevelsNID,
+			gomatrixserverlib.MRoomJoinRules:        types.MRoomJoinRulesNID,
+			gomatrixserverlib.MRoomThirdPartyInvite: types.MRoomThirdPartyInviteNID,
+			gomatrixserverlib.MRoomMember:           types.MRoomMemberNID,
+			"m.room.redaction":                      types.MRoomRedactionNID,
+			"m.room.history_visibility":             types.MRoomHistoryVisibilityNID,
+		},
+		stateKeyNIDs:  map[string]types.EventStateKeyNID{"": types.EmptyStateKeyNID},
+		stateAtEvents: map[types.EventNID]types.StateSnapshotNID{},
+		referenced:    map[string]bool{},
+		sent:          map[types.EventNID]bool{},
+		softFailed:    map[types.EventNID]bool{},
+		redacted:      map[string]bool{},
+	}
+}
+
+func (d *fakeRoomEventDatabase) stateEntry(event types.Event) types.StateEntry {
+	entry := types.StateEntry{EventNID: event.EventNID}
+	if event.StateKey() != nil {
+		entry.EventTypeNID = d.eventTypeNIDs[event.Type()]
+		entry.EventStateKeyNID = d.stateKeyNIDs[*event.StateKey()]
+	}
+	return entry
+}
+
+func (d *fakeRoomEventDatabase) eventByID(eventID string) (types.Event, error) {
+	eventNID, ok := d.eventNIDs[eventID]
+	if !ok {
+		return types.Event{}, types.MissingEventError("unknown event " + eventID)
+	}
+	return d.events[eventNID-1], nil
+}
+
+func (d *fakeRoomEventDatabase) StoreEvent(
+	ctx context.Context, event gomatrixserverlib.Event, authEventNIDs []types.EventNID,
+) (types.RoomNID, types.StateAtEvent, error) {
+	if _, ok := d.eventTypeNIDs[event.Type()]; !ok {
+		d.eventTypeNIDs[event.Type()] = types.EventTypeNID(len(d.eventTypeNIDs) + 1)
+	}
+	if stateKey := event.StateKey(); stateKey != nil {
+		if _, ok := d.stateKeyNIDs[*stateKey]; !ok {
+			d.stateKeyNIDs[*stateKey] = types.EventStateKeyNID(len(d.stateKeyNIDs) + 1)
+		}
+	}
+	eventNID, ok := d.eventNIDs[event.EventID()]
+	if !ok {
+		eventNID = types.EventNID(len(d.events) + 1)
+		d.events = append(d.events, types.Event{EventNID: eventNID, Event: event})
+		d.eventNIDs[event.EventID()] = eventNID
+	}
+	return 1, types.StateAtEvent{
+		BeforeStateSnapshotNID: d.stateAtEvents[eventNID],
+		StateEntry:             d.stateEntry(d.events[eventNID-1]),
+	}, nil
+}
+
+func (d *fakeRoomEventDatabase) StateEntriesForEventIDs(ctx context.Context, eventIDs []string) ([]types.StateEntry, error) {
+	var result []types.StateEntry
+	for _, eventID := range eventIDs {
+		event, err := d.eventByID(eventID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d.stateEntry(event))
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	d.stateAtEvents[eventNID] = stateNID
+	return nil
+}
+
+func (d *fakeRoomEventDatabase) GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (RoomRecentEventsUpdater, error) {
+	return &fakeRoomRecentEventsUpdater{d}, nil
+}
+
+func (d *fakeRoomEventDatabase) EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	result := map[types.EventNID]string{}
+	for _, eventNID := range eventNIDs {
+		result[eventNID] = d.events[eventNID-1].EventID()
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) MembershipUpdater(ctx context.Context, roomID, targetUserID string) (types.MembershipUpdater, error) {
+	return &fakeMembershipUpdater{}, nil
+}
+
+func (d *fakeRoomEventDatabase) RoomCount(ctx context.Context) (int64, error) {
+	return 1, nil
+}
+
+func (d *fakeRoomEventDatabase) AddState(
+	ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	blockNIDs := append([]types.StateBlockNID{}, stateBlockNIDs...)
+	if len(state) > 0 {
+		d.stateBlocks = append(d.stateBlocks, state)
+		blockNIDs = append(blockNIDs, types.StateBlockNID(len(d.stateBlocks)))
+	}
+	d.snapshots = append(d.snapshots, blockNIDs)
+	return types.StateSnapshotNID(len(d.snapshots)), nil
+}
+
+func (d *fakeRoomEventDatabase) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	var result []types.StateAtEvent
+	for _, eventID := range eventIDs {
+		event, err := d.eventByID(eventID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, types.StateAtEvent{
+			BeforeStateSnapshotNID: d.stateAtEvents[event.EventNID],
+			StateEntry:             d.stateEntry(event),
+		})
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error) {
+	result := map[string]types.EventTypeNID{}
+	for _, eventType := range eventTypes {
+		if eventTypeNID, ok := d.eventTypeNIDs[eventType]; ok {
+			result[eventType] = eventTypeNID
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	result := map[string]types.EventStateKeyNID{}
+	for _, stateKey := range eventStateKeys {
+		if stateKeyNID, ok := d.stateKeyNIDs[stateKey]; ok {
+			result[stateKey] = stateKeyNID
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	var result []types.StateBlockNIDList
+	for _, stateNID := range stateNIDs {
+		result = append(result, types.StateBlockNIDList{
+			StateSnapshotNID: stateNID,
+			StateBlockNIDs:   d.snapshots[stateNID-1],
+		})
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	var result []types.StateEntryList
+	for _, stateBlockNID := range stateBlockNIDs {
+		result = append(result, types.StateEntryList{
+			StateBlockNID: stateBlockNID,
+			StateEntries:  d.stateBlocks[stateBlockNID-1],
+		})
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) StateEntriesForTuples(
+	ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntryList, error) {
+	var result []types.StateEntryList
+	for _, stateBlockNID := range stateBlockNIDs {
+		list := types.StateEntryList{StateBlockNID: stateBlockNID}
+		for _, entry := range d.stateBlocks[stateBlockNID-1] {
+			for _, tuple := range stateKeyTuples {
+				if entry.StateKeyTuple == tuple {
+					list.StateEntries = append(list.StateEntries, entry)
+				}
+			}
+		}
+		result = append(result, list)
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventNID := range eventNIDs {
+		result = append(result, d.events[eventNID-1])
+	}
+	// The events are looked up in the result by numeric ID, so they are
+	// returned sorted by it like the SQL storage does.
+	sort.Slice(result, func(i, j int) bool { return result[i].EventNID < result[j].EventNID })
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	var result []types.Event
+	for _, eventID := range eventIDs {
+		if eventNID, ok := d.eventNIDs[eventID]; ok {
+			result = append(result, d.events[eventNID-1])
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeRoomEventDatabase) RoomVersion(ctx context.Context, roomNID types.RoomNID) (string, error) {
+	return "1", nil
+}
+
+// fakeRoomRecentEventsUpdater updates the latest events of a
+// fakeRoomEventDatabase directly, since it has no transactions.
+type fakeRoomRecentEventsUpdater struct {
+	*fakeRoomEventDatabase
+}
+
+func (u *fakeRoomRecentEventsUpdater) LatestEvents() []types.StateAtEventAndReference {
+	return u.latest
+}
+
+func (u *fakeRoomRecentEventsUpdater) LastEventIDSent() string {
+	return u.lastEventSent
+}
+
+func (u *fakeRoomRecentEventsUpdater) CurrentStateSnapshotNID() types.StateSnapshotNID {
+	return u.currentStateNID
+}
+
+func (u *fakeRoomRecentEventsUpdater) StorePreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
+	for _, ref := range previousEventReferences {
+		u.referenced[ref.EventID] = true
+	}
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) IsReferenced(eventReference gomatrixserverlib.EventReference) (bool, error) {
+	return u.referenced[eventReference.EventID], nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) SetLatestEvents(
+	roomNID types.RoomNID, latest []types.StateAtEventAndReference, lastEventNIDSent types.EventNID,
+	currentStateSnapshotNID types.StateSnapshotNID,
+) error {
+	u.latest = latest
+	u.lastEventSent = u.events[lastEventNIDSent-1].EventID()
+	u.currentStateNID = currentStateSnapshotNID
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
+	return u.sent[eventNID], nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error {
+	u.sent[eventNID] = true
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) MarkEventAsSoftFailed(eventNID types.EventNID) error {
+	u.softFailed[eventNID] = true
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) StoreRelation(eventNID types.EventNID, event gomatrixserverlib.Event) error {
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) RedactEvent(redactedEventID string) error {
+	u.redacted[redactedEventID] = true
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID) (types.MembershipUpdater, error) {
+	return &fakeMembershipUpdater{}, nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) Commit() error {
+	return nil
+}
+
+func (u *fakeRoomRecentEventsUpdater) Rollback() error {
+	return nil
+}
+
+// fakeMembershipUpdater ignores membership changes, which these tests don't
+// look at.
+type fakeMembershipUpdater struct{}
+
+func (m *fakeMembershipUpdater) IsInvite() bool { return false }
+func (m *fakeMembershipUpdater) IsJoin() bool   { return false }
+func (m *fakeMembershipUpdater) IsLeave() bool  { return true }
+func (m *fakeMembershipUpdater) Commit() error  { return nil }
+func (m *fakeMembershipUpdater) Rollback() error {
+	return nil
+}
+
+func (m *fakeMembershipUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, error) {
+	return true, nil
+}
+
+func (m *fakeMembershipUpdater) SetToJoin(senderUserID string, eventID string, isUpdate bool) ([]string, error) {
+	return nil, nil
+}
+
+func (m *fakeMembershipUpdater) SetToLeave(senderUserID string, eventID string) ([]string, error) {
+	return nil, nil
+}
+
+// fakeOutputRoomEventWriter keeps the output events it is given.
+type fakeOutputRoomEventWriter struct {
+	events []api.OutputEvent
+}
+
+func (w *fakeOutputRoomEventWriter) WriteOutputEvents(roomID string, updates []api.OutputEvent) error {
+	w.events = append(w.events, updates...)
+	return nil
+}
+
+// mustEventWithPrevEvents builds an event which refers to the given events
+// as its prev_events, with their reference hashes.
+func mustEventWithPrevEvents(t *testing.T, eventJSON string, prevEvents ...gomatrixserverlib.Event) gomatrixserverlib.Event {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(eventJSON), &fields); err != nil {
+		t.Fatal(err)
+	}
+	refs := make([]gomatrixserverlib.EventReference, len(prevEvents))
+	for i := range prevEvents {
+		refs[i] = prevEvents[i].EventReference()
+	}
+	fields["prev_events"] = refs
+	withPrevEvents, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustEventFromJSON(t, string(withPrevEvents))
+}
+
+func TestSoftFailedEventIsStoredButNotCurrent(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeRoomEventDatabase()
+	ow := &fakeOutputRoomEventWriter{}
+
+	// Alice creates a public room that Bob joins, then bans Bob. Bob sends a
+	// message on top of his join, which is allowed by its auth events but not
+	// by the current state of the room where he is banned.
+	events := []string{
+		`{"event_id":"$create:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.create","state_key":"","content":{"creator":"@alice:a"},"depth":1}`,
+		`{"event_id":"$join_alice:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.member","state_key":"@alice:a","content":{"membership":"join"},"depth":2,"auth_events":[["$create:a",{}]]}`,
+		`{"event_id":"$power_levels:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.power_levels","state_key":"","content":{"users":{"@alice:a":100}},"depth":3,"auth_events":[["$create:a",{}],["$join_alice:a",{}]]}`,
+		`{"event_id":"$join_rules:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.join_rules","state_key":"","content":{"join_rule":"public"},"depth":4,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_alice:a",{}]]}`,
+		`{"event_id":"$join_bob:b","room_id":"!r:a","sender":"@bob:b","type":"m.room.member","state_key":"@bob:b","content":{"membership":"join"},"depth":5,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_rules:a",{}]]}`,
+		`{"event_id":"$ban_bob:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.member","state_key":"@bob:b","content":{"membership":"ban"},"depth":6,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_alice:a",{}],["$join_bob:b",{}]]}`,
+	}
+	// Each event comes after the one before it.
+	var built []gomatrixserverlib.Event
+	for i, eventJSON := range events {
+		var event gomatrixserverlib.Event
+		if i == 0 {
+			event = mustEventWithPrevEvents(t, eventJSON)
+		} else {
+			event = mustEventWithPrevEvents(t, eventJSON, built[i-1])
+		}
+		built = append(built, event)
+		if err := processRoomEvent(ctx, db, ow, api.InputRoomEvent{
+			Kind: api.KindNew, Event: event, AuthEventIDs: event.AuthEventIDs(),
+		}); err != nil {
+			t.Fatalf("processing %q: %v", event.EventID(), err)
+		}
+	}
+	if len(db.latest) != 1 || db.latest[0].EventID != "$ban_bob:a" {
+		t.Fatalf("wanted the ban to be the latest event, got %v", db.latest)
+	}
+	stateBefore := db.currentStateNID
+	ow.events = nil
+
+	joinBob := built[4]
+	message := mustEventWithPrevEvents(t, `{"event_id":"$message:b","room_id":"!r:a","sender":"@bob:b","type":"m.room.message","content":{"body":"hello"},"depth":6,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_bob:b",{}]]}`, joinBob)
+	if err := processRoomEvent(ctx, db, ow, api.InputRoomEvent{
+		Kind: api.KindNew, Event: message, AuthEventIDs: message.AuthEventIDs(),
+	}); err != nil {
+		t.Fatalf("wanted the message to be processed, got %v", err)
+	}
+
+	stored, err := db.EventsFromIDs(ctx, []string{message.EventID()})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("wanted the message to be stored, got %v, %v", stored, err)
+	}
+	if !db.softFailed[stored[0].EventNID] {
+		t.Error("wanted the message to be marked as soft failed")
+	}
+	if db.sent[stored[0].EventNID] {
+		t.Error("wanted the message not to be marked as sent")
+	}
+	if len(db.latest) != 1 || db.latest[0].EventID != "$ban_bob:a" || db.currentStateNID != stateBefore {
+		t.Errorf("wanted the latest events and current state to be unchanged, got %v", db.latest)
+	}
+	if len(ow.events) != 1 || ow.events[0].Type != api.OutputTypeSoftFailedEvent {
+		t.Fatalf("wanted a single soft failed output event, got %v", ow.events)
+	}
+	if got := ow.events[0].SoftFailedEvent.Event.EventID(); got != message.EventID() {
+		t.Errorf("wanted the soft failed output event to be %q, got %q", message.EventID(), got)
+	}
+
+	// A message from Alice on top of the ban is allowed by the current state
+	// and becomes the latest event.
+	ban := built[5]
+	allowed := mustEventWithPrevEvents(t, `{"event_id":"$message:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.message","content":{"body":"hello"},"depth":7,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_alice:a",{}]]}`, ban)
+	if err := processRoomEvent(ctx, db, ow, api.InputRoomEvent{
+		Kind: api.KindNew, Event: allowed, AuthEventIDs: allowed.AuthEventIDs(),
+	}); err != nil {
+		t.Fatalf("wanted the message to be processed, got %v", err)
+	}
+	if len(db.latest) != 1 || db.latest[0].EventID != allowed.EventID() {
+		t.Errorf("wanted %q to be the latest event, got %v", allowed.EventID(), db.latest)
+	}
+}
+
+func TestRedactionIsAppliedAndWrittenToOutput(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeRoomEventDatabase()
+	ow := &fakeOutputRoomEventWriter{}
+
+	// Alice creates a room, sends a message and then redacts it.
+	events := []string{
+		`{"event_id":"$create:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.create","state_key":"","content":{"creator":"@alice:a"},"depth":1}`,
+		`{"event_id":"$join_alice:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.member","state_key":"@alice:a","content":{"membership":"join"},"depth":2,"auth_events":[["$create:a",{}]]}`,
+		`{"event_id":"$power_levels:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.power_levels","state_key":"","content":{"users":{"@alice:a":100}},"depth":3,"auth_events":[["$create:a",{}],["$join_alice:a",{}]]}`,
+		`{"event_id":"$message:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.message","content":{"body":"hello"},"depth":4,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_alice:a",{}]]}`,
+		`{"event_id":"$redaction:a","room_id":"!r:a","sender":"@alice:a","type":"m.room.redaction","redacts":"$message:a","content":{},"depth":5,"auth_events":[["$create:a",{}],["$power_levels:a",{}],["$join_alice:a",{}]]}`,
+	}
+	var built []gomatrixserverlib.Event
+	for i, eventJSON := range events {
+		var event gomatrixserverlib.Event
+		if i == 0 {
+			event = mustEventWithPrevEvents(t, eventJSON)
+		} else {
+			event = mustEventWithPrevEvents(t, eventJSON, built[i-1])
+		}
+		built = append(built, event)
+		ow.events = nil
+		if err := processRoomEvent(ctx, db, ow, api.InputRoomEvent{
+			Kind: api.KindNew, Event: event, AuthEventIDs: event.AuthEventIDs(),
+		}); err != nil {
+			t.Fatalf("processing %q: %v", event.EventID(), err)
+		}
+	}
+
+	if !db.redacted["$message:a"] {
+		t.Error("wanted the message to be redacted")
+	}
+	// The m.room.redaction event is written first, so that consumers have it
+	// when they redact their copy of the redacted event.
+	if len(ow.events) != 2 || ow.events[0].Type != api.OutputTypeNewRoomEvent || ow.events[1].Type != api.OutputTypeRedactedEvent {
+		t.Fatalf("wanted a new room event and a redacted event output, got %v", ow.events)
+	}
+	want := api.OutputRedactedEvent{RoomID: "!r:a", RedactedEventID: "$message:a", RedactionEventID: "$redaction:a"}
+	if got := *ow.events[1].RedactedEvent; got != want {
+		t.Errorf("wanted redacted event output %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package input
+
+import (
+	"context"
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var processedEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "processed_events_total",
+		Help:      "The number of room events processed, by event type",
+	},
+	[]string{"type"},
+)
+
+var processEventDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "process_event_duration_seconds",
+		Help:      "How long it takes from receiving a room event to storing it and its state",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	},
+)
+
+func init() {
+	prometheus.MustRegister(processedEvents, processEventDuration)
+}
+
+// SetupMetrics registers the metrics which need the database, i.e. the
+// number of rooms on the server. Must only be called once.
+func (r *RoomserverInputAPI) SetupMetrics() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "roomserver",
+			Name:      "rooms",
+			Help:      "The number of rooms known to the server",
+		},
+		func() float64 {
+			count, err := r.DB.RoomCount(context.Background())
+			if err != nil {
+				log.WithError(err).Warn("Failed to count the rooms")
+				return math.NaN()
+			}
+			return float64(count)
+		},
+	))
+}
@@ -15,8 +15,12 @@
 package query
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
 
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -32,35 +36,60 @@ type RoomserverQueryAPIDatabase interface {
 	// Look up the numeric ID for the room.
 	// Returns 0 if the room doesn't exists.
 	// Returns an error if there was a problem talking to the database.
-	RoomNID(roomID string) (types.RoomNID, error)
+	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
 	// Look up event references for the latest events in the room and the current state snapshot.
 	// Returns the latest events, the current state and the maximum depth of the latest events plus 1.
 	// Returns an error if there was a problem talking to the database.
-	LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error)
+	LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error)
 	// Look up the numeric IDs for a list of events.
 	// Returns an error if there was a problem talking to the database.
-	EventNIDs(eventIDs []string) (map[string]types.EventNID, error)
+	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	// Lookup the event IDs for a batch of event numeric IDs.
 	// Returns an error if the retrieval went wrong.
-	EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
+	// Look up at most limit events of a room which aren't outliers, between the
+	// low and high numeric IDs excluded, starting from the lowest ID or from
+	// the highest one if backwards is set.
+	// Returns an error if there was a problem talking to the database.
+	EventsInRange(ctx context.Context, roomNID types.RoomNID, low, high types.EventNID, backwards bool, limit int) ([]types.StateAtEvent, error)
 	// Lookup the membership of a given user in a given room.
 	// Returns the numeric ID of the latest membership event sent from this user
 	// in this room, along a boolean set to true if the user is still in this room,
 	// false if not.
 	// Returns an error if there was a problem talking to the database.
-	GetMembership(roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error)
+	GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error)
 	// Lookup the membership event numeric IDs for all user that are or have
 	// been members of a given room. Only lookup events of "join" membership if
 	// joinOnly is set to true.
 	// Returns an error if there was a problem talking to the database.
-	GetMembershipEventNIDsForRoom(roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error)
+	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error)
 	// Look up the active invites targeting a user in a room and return the
 	// numeric state key IDs for the user IDs who sent them.
 	// Returns an error if there was a problem talking to the database.
-	GetInvitesForUser(roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (senderUserNIDs []types.EventStateKeyNID, err error)
+	GetInvitesForUser(ctx context.Context, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (senderUserNIDs []types.EventStateKeyNID, err error)
 	// Look up the string event state keys for a list of numeric event state keys
 	// Returns an error if there was a problem talking to the database.
-	EventStateKeys([]types.EventStateKeyNID) (map[types.EventStateKeyNID]string, error)
+	EventStateKeys(ctx context.Context, eventStateKeyNIDs []types.EventStateKeyNID) (map[types.EventStateKeyNID]string, error)
+	// Look up the relations of the given type to a list of events, from the
+	// oldest to the newest.
+	// Returns an error if there was a problem talking to the database.
+	EventRelations(ctx context.Context, eventIDs []string, relType string) ([]types.EventRelation, error)
+	// Look up at most limit relations of the given type to an event, from the
+	// newest to the oldest, before the given numeric event ID unless it is 0.
+	// Returns an error if there was a problem talking to the database.
+	EventRelationsBefore(ctx context.Context, eventID, relType string, before types.EventNID, limit int) ([]types.EventRelation, error)
+	// Look up the IDs of the events among the given ones which the sender
+	// sent an event relating to with the given type.
+	// Returns an error if there was a problem talking to the database.
+	RelatedEventIDsForSender(ctx context.Context, eventIDs []string, relType, sender string) ([]string, error)
+	// Look up the summaries of the threads whose root is one of the given
+	// events, leaving out those without any reply.
+	// Returns an error if there was a problem talking to the database.
+	ThreadRoots(ctx context.Context, eventIDs []string) ([]types.ThreadRoot, error)
+	// Look up the annotations of the given events, from the most to the least
+	// used key.
+	// Returns an error if there was a problem talking to the database.
+	Annotations(ctx context.Context, eventIDs []string) ([]types.Annotation, error)
 }
 
 // RoomserverQueryAPI is an implementation of api.RoomserverQueryAPI
@@ -70,11 +99,12 @@ type RoomserverQueryAPI struct {
 
 // QueryLatestEventsAndState implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryLatestEventsAndState(
+	ctx context.Context,
 	request *api.QueryLatestEventsAndStateRequest,
 	response *api.QueryLatestEventsAndStateResponse,
 ) error {
 	response.QueryLatestEventsAndStateRequest = *request
-	roomNID, err := r.DB.RoomNID(request.RoomID)
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
@@ -82,19 +112,22 @@ func (r *RoomserverQueryAPI) QueryLatestEventsAndState(
 		return nil
 	}
 	response.RoomExists = true
+	if response.RoomVersion, err = r.DB.RoomVersion(ctx, roomNID); err != nil {
+		return err
+	}
 	var currentStateSnapshotNID types.StateSnapshotNID
-	response.LatestEvents, currentStateSnapshotNID, response.Depth, err = r.DB.LatestEventIDs(roomNID)
+	response.LatestEvents, currentStateSnapshotNID, response.Depth, err = r.DB.LatestEventIDs(ctx, roomNID)
 	if err != nil {
 		return err
 	}
 
 	// Look up the currrent state for the requested tuples.
-	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(r.DB, currentStateSnapshotNID, request.StateToFetch)
+	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(ctx, r.DB, currentStateSnapshotNID, request.StateToFetch)
 	if err != nil {
 		return err
 	}
 
-	stateEvents, err := r.loadStateEvents(stateEntries)
+	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
 	if err != nil {
 		return err
 	}
@@ -103,13 +136,130 @@ func (r *RoomserverQueryAPI) QueryLatestEventsAndState(
 	return nil
 }
 
+// QueryCurrentState implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryCurrentState(
+	ctx context.Context,
+	request *api.QueryCurrentStateRequest,
+	response *api.QueryCurrentStateResponse,
+) error {
+	response.QueryCurrentStateRequest = *request
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+	_, currentStateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+
+	var stateEntries []types.StateEntry
+	if len(request.StateToFetch) == 0 {
+		stateEntries, err = state.LoadStateAtSnapshot(ctx, r.DB, currentStateSnapshotNID)
+	} else {
+		stateEntries, err = state.LoadStateAtSnapshotForStringTuples(
+			ctx, r.DB, currentStateSnapshotNID, request.StateToFetch,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if len(request.EventTypes) > 0 {
+		if stateEntries, err = r.filterStateEntriesByType(ctx, stateEntries, request.EventTypes); err != nil {
+			return err
+		}
+	}
+
+	eventNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		eventNIDs[i] = stateEntries[i].EventNID
+	}
+	eventIDMap, err := r.DB.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+
+	response.StateEventIDs = make([]string, 0, len(eventIDMap))
+	for _, eventID := range eventIDMap {
+		response.StateEventIDs = append(response.StateEventIDs, eventID)
+	}
+	return nil
+}
+
+// QueryMembership implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryMembership(
+	ctx context.Context,
+	request *api.QueryMembershipRequest,
+	response *api.QueryMembershipResponse,
+) error {
+	response.QueryMembershipRequest = *request
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+	_, currentStateSnapshotNID, _, err := r.DB.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		return err
+	}
+
+	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(
+		ctx, r.DB, currentStateSnapshotNID,
+		[]gomatrixserverlib.StateKeyTuple{{EventType: "m.room.member", StateKey: request.UserID}},
+	)
+	if err != nil {
+		return err
+	}
+	memberEvents, err := r.loadStateEvents(ctx, stateEntries)
+	if err != nil {
+		return err
+	}
+	if len(memberEvents) == 0 {
+		return nil
+	}
+
+	response.EventID = memberEvents[0].EventID()
+	response.Membership, err = memberEvents[0].Membership()
+	return err
+}
+
+// filterStateEntriesByType only keeps the state entries for events with one of
+// the given types.
+func (r *RoomserverQueryAPI) filterStateEntriesByType(
+	ctx context.Context,
+	stateEntries []types.StateEntry, eventTypes []string,
+) ([]types.StateEntry, error) {
+	eventTypeNIDMap, err := r.DB.EventTypeNIDs(ctx, eventTypes)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[types.EventTypeNID]bool, len(eventTypeNIDMap))
+	for _, eventTypeNID := range eventTypeNIDMap {
+		wanted[eventTypeNID] = true
+	}
+	var result []types.StateEntry
+	for _, entry := range stateEntries {
+		if wanted[entry.EventTypeNID] {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
 // QueryStateAfterEvents implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryStateAfterEvents(
+	ctx context.Context,
 	request *api.QueryStateAfterEventsRequest,
 	response *api.QueryStateAfterEventsResponse,
 ) error {
 	response.QueryStateAfterEventsRequest = *request
-	roomNID, err := r.DB.RoomNID(request.RoomID)
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
@@ -117,8 +267,11 @@ func (r *RoomserverQueryAPI) QueryStateAfterEvents(
 		return nil
 	}
 	response.RoomExists = true
+	if response.RoomVersion, err = r.DB.RoomVersion(ctx, roomNID); err != nil {
+		return err
+	}
 
-	prevStates, err := r.DB.StateAtEventIDs(request.PrevEventIDs)
+	prevStates, err := r.DB.StateAtEventIDs(ctx, request.PrevEventIDs)
 	if err != nil {
 		switch err.(type) {
 		case types.MissingEventError:
@@ -130,12 +283,12 @@ func (r *RoomserverQueryAPI) QueryStateAfterEvents(
 	response.PrevEventsExist = true
 
 	// Look up the currrent state for the requested tuples.
-	stateEntries, err := state.LoadStateAfterEventsForStringTuples(r.DB, prevStates, request.StateToFetch)
+	stateEntries, err := state.LoadStateAfterEventsForStringTuples(ctx, r.DB, roomNID, prevStates, request.StateToFetch)
 	if err != nil {
 		return err
 	}
 
-	stateEvents, err := r.loadStateEvents(stateEntries)
+	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
 	if err != nil {
 		return err
 	}
@@ -144,42 +297,178 @@ func (r *RoomserverQueryAPI) QueryStateAfterEvents(
 	return nil
 }
 
+// QueryStateAndAuthChain implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryStateAndAuthChain(
+	ctx context.Context,
+	request *api.QueryStateAndAuthChainRequest,
+	response *api.QueryStateAndAuthChainResponse,
+) error {
+	response.QueryStateAndAuthChainRequest = *request
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+
+	events, err := r.DB.EventsFromIDs(ctx, []string{request.EventID})
+	if err != nil {
+		return err
+	}
+	if len(events) != 1 || events[0].RoomID() != request.RoomID {
+		return nil
+	}
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, []string{request.EventID})
+	if err != nil {
+		switch err.(type) {
+		case types.MissingEventError:
+			return nil
+		default:
+			return err
+		}
+	}
+	response.StateKnown = true
+
+	stateEntries, err := state.LoadStateAtSnapshot(ctx, r.DB, stateAtEvents[0].BeforeStateSnapshotNID)
+	if err != nil {
+		return err
+	}
+	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
+	if err != nil {
+		return err
+	}
+	authChain, err := r.authChainOf(ctx, stateEvents)
+	if err != nil {
+		return err
+	}
+
+	response.StateEvents = stateEvents
+	response.AuthChainEvents = authChain
+	return nil
+}
+
 // QueryEventsByID implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryEventsByID(
+	ctx context.Context,
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
 	response.QueryEventsByIDRequest = *request
 
-	eventNIDMap, err := r.DB.EventNIDs(request.EventIDs)
+	stateEvents, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
 	if err != nil {
 		return err
 	}
 
-	var eventNIDs []types.EventNID
-	for _, nid := range eventNIDMap {
-		eventNIDs = append(eventNIDs, nid)
+	events := make([]gomatrixserverlib.Event, len(stateEvents))
+	for i := range stateEvents {
+		events[i] = stateEvents[i].Event
 	}
 
-	events, err := r.loadEvents(eventNIDs)
-	if err != nil {
-		return err
+	if request.UserID != "" {
+		if events, err = r.filterVisibleEvents(ctx, request.UserID, events); err != nil {
+			return err
+		}
 	}
 
 	response.Events = events
 	return nil
 }
 
-func (r *RoomserverQueryAPI) loadStateEvents(stateEntries []types.StateEntry) ([]gomatrixserverlib.Event, error) {
+// filterVisibleEvents returns the events the user is allowed to see among the
+// given ones, which can be in different rooms.
+func (r *RoomserverQueryAPI) filterVisibleEvents(
+	ctx context.Context,
+	userID string, events []gomatrixserverlib.Event,
+) ([]gomatrixserverlib.Event, error) {
+	eventIDsByRoom := make(map[string][]string)
+	for _, event := range events {
+		eventIDsByRoom[event.RoomID()] = append(eventIDsByRoom[event.RoomID()], event.EventID())
+	}
+
+	visible := make(map[types.EventNID]bool)
+	for roomID, eventIDs := range eventIDsByRoom {
+		roomNID, err := r.DB.RoomNID(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		stateAtEvents, err := r.stateAtEventsWithState(ctx, eventIDs)
+		if err != nil {
+			return nil, err
+		}
+		visibleEvents, err := r.visibleEvents(ctx, roomNID, userID, stateAtEvents)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range visibleEvents {
+			visible[event.EventNID] = true
+		}
+	}
+
+	eventNIDs, err := r.DB.EventNIDs(ctx, eventIDsOf(events))
+	if err != nil {
+		return nil, err
+	}
+	var result []gomatrixserverlib.Event
+	for _, event := range events {
+		if visible[eventNIDs[event.EventID()]] {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// stateAtEventsWithState returns the state before the given events, leaving
+// out the events the roomserver doesn't know the state before, e.g. outliers.
+// Whether those events can be seen can't be worked out, so they are treated
+// as if they couldn't.
+func (r *RoomserverQueryAPI) stateAtEventsWithState(
+	ctx context.Context, eventIDs []string,
+) ([]types.StateAtEvent, error) {
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, eventIDs)
+	switch err.(type) {
+	case nil:
+		return stateAtEvents, nil
+	case types.MissingEventError:
+	default:
+		return nil, err
+	}
+
+	// Find out which events are missing their state one event at a time.
+	stateAtEvents = nil
+	for _, eventID := range eventIDs {
+		stateAtEvent, err := r.DB.StateAtEventIDs(ctx, []string{eventID})
+		switch err.(type) {
+		case nil:
+			stateAtEvents = append(stateAtEvents, stateAtEvent...)
+		case types.MissingEventError:
+		default:
+			return nil, err
+		}
+	}
+	return stateAtEvents, nil
+}
+
+func eventIDsOf(events []gomatrixserverlib.Event) []string {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	return eventIDs
+}
+
+func (r *RoomserverQueryAPI) loadStateEvents(ctx context.Context, stateEntries []types.StateEntry) ([]gomatrixserverlib.Event, error) {
 	eventNIDs := make([]types.EventNID, len(stateEntries))
 	for i := range stateEntries {
 		eventNIDs[i] = stateEntries[i].EventNID
 	}
-	return r.loadEvents(eventNIDs)
+	return r.loadEvents(ctx, eventNIDs)
 }
 
-func (r *RoomserverQueryAPI) loadEvents(eventNIDs []types.EventNID) ([]gomatrixserverlib.Event, error) {
-	stateEvents, err := r.DB.Events(eventNIDs)
+func (r *RoomserverQueryAPI) loadEvents(ctx context.Context, eventNIDs []types.EventNID) ([]gomatrixserverlib.Event, error) {
+	stateEvents, err := r.DB.Events(ctx, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -191,17 +480,394 @@ func (r *RoomserverQueryAPI) loadEvents(eventNIDs []types.EventNID) ([]gomatrixs
 	return result, nil
 }
 
+// QueryEventsByRange implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryEventsByRange(
+	ctx context.Context,
+	request *api.QueryEventsByRangeRequest,
+	response *api.QueryEventsByRangeResponse,
+) error {
+	response.QueryEventsByRangeRequest = *request
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomNID == 0 {
+		return nil
+	}
+	response.RoomExists = true
+
+	from := types.EventNID(request.From)
+	if request.FromEventID != "" {
+		eventNIDs, err := r.DB.EventNIDs(ctx, []string{request.FromEventID})
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if from, ok = eventNIDs[request.FromEventID]; !ok {
+			return types.MissingEventError(fmt.Sprintf("query: event %q missing from the database", request.FromEventID))
+		}
+	}
+	response.Start = int64(from)
+	response.End = int64(from)
+
+	low, high := from, types.EventNID(request.To)
+	if request.Backwards {
+		low, high = high, low
+	}
+	if high == 0 {
+		high = math.MaxInt64
+	}
+	stateAtEvents, err := r.DB.EventsInRange(ctx, roomNID, low, high, request.Backwards, request.Limit)
+	if err != nil {
+		return err
+	}
+	if len(stateAtEvents) == 0 {
+		return nil
+	}
+	response.End = int64(stateAtEvents[len(stateAtEvents)-1].EventNID)
+	if from == 0 {
+		response.Start = int64(stateAtEvents[0].EventNID) - 1
+		if request.Backwards {
+			response.Start = int64(stateAtEvents[0].EventNID) + 1
+		}
+	}
+
+	events, err := r.visibleEvents(ctx, roomNID, request.UserID, stateAtEvents)
+	if err != nil {
+		return err
+	}
+	response.Events = make([]gomatrixserverlib.Event, len(events))
+	for i := range events {
+		response.Events[i] = events[i].Event
+	}
+	return nil
+}
+
+// visibleEvents returns the events of the room the user is allowed to see,
+// in the same order as the given events.
+func (r *RoomserverQueryAPI) visibleEvents(
+	ctx context.Context,
+	roomNID types.RoomNID, userID string, stateAtEvents []types.StateAtEvent,
+) ([]types.Event, error) {
+	_, stillInRoom, err := r.DB.GetMembership(ctx, roomNID, userID)
+	if err != nil {
+		return nil, err
+	}
+	eventNIDs := make([]types.EventNID, len(stateAtEvents))
+	for i := range stateAtEvents {
+		eventNIDs[i] = stateAtEvents[i].EventNID
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	eventsByNID := make(map[types.EventNID]types.Event, len(events))
+	for _, event := range events {
+		eventsByNID[event.EventNID] = event
+	}
+
+	// Consecutive events often have the same state before them, so remember
+	// which snapshots we already looked at.
+	historyAtSnapshot := make(map[types.StateSnapshotNID]snapshotHistory)
+	var result []types.Event
+	for _, stateAtEvent := range stateAtEvents {
+		event, ok := eventsByNID[stateAtEvent.EventNID]
+		if !ok {
+			continue
+		}
+		snapshotNID := stateAtEvent.BeforeStateSnapshotNID
+		history, ok := historyAtSnapshot[snapshotNID]
+		if !ok {
+			history, err = r.historyAtSnapshot(ctx, snapshotNID, userID)
+			if err != nil {
+				return nil, err
+			}
+			historyAtSnapshot[snapshotNID] = history
+		}
+		if common.HistoryVisibilityFilter(&event.Event, history.visibility, common.MembershipHistory{
+			UserID: userID, AtEvent: history.membership, CurrentlyJoined: stillInRoom,
+		}) {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// snapshotHistory is the history visibility of a room and the membership of
+// a user in a state snapshot of the room.
+type snapshotHistory struct {
+	visibility string
+	membership string
+}
+
+// historyAtSnapshot returns the history visibility of the room and the
+// membership of the user in the state with the given numeric ID.
+func (r *RoomserverQueryAPI) historyAtSnapshot(
+	ctx context.Context, snapshotNID types.StateSnapshotNID, userID string,
+) (snapshotHistory, error) {
+	if snapshotNID == 0 {
+		// We don't know the state before the event, so only the user's own
+		// membership events can be seen.
+		return snapshotHistory{visibility: "joined"}, nil
+	}
+	stateEntries, err := state.LoadStateAtSnapshotForStringTuples(
+		ctx, r.DB, snapshotNID, []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.history_visibility", StateKey: ""},
+			{EventType: "m.room.member", StateKey: userID},
+		},
+	)
+	if err != nil {
+		return snapshotHistory{}, err
+	}
+	stateEvents, err := r.loadStateEvents(ctx, stateEntries)
+	if err != nil {
+		return snapshotHistory{}, err
+	}
+
+	// "shared" is the default history visibility.
+	history := snapshotHistory{visibility: "shared"}
+	for _, event := range stateEvents {
+		switch event.Type() {
+		case "m.room.history_visibility":
+			var content common.HistoryVisibilityContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				return snapshotHistory{}, err
+			}
+			history.visibility = content.HistoryVisibility
+		case "m.room.member":
+			if history.membership, err = event.Membership(); err != nil {
+				return snapshotHistory{}, err
+			}
+		}
+	}
+	return history, nil
+}
+
+// QueryBackfill implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryBackfill(
+	ctx context.Context,
+	request *api.QueryBackfillRequest,
+	response *api.QueryBackfillResponse,
+) error {
+	response.QueryBackfillRequest = *request
+
+	// Walk back through the prev_events of the earliest events one generation
+	// at a time, so that the newest events are returned first.
+	var events []gomatrixserverlib.Event
+	visited := make(map[string]bool)
+	frontier := request.EarliestEventIDs
+	for len(frontier) > 0 && len(events) < request.Limit {
+		for _, eventID := range frontier {
+			visited[eventID] = true
+		}
+		generation, err := r.DB.EventsFromIDs(ctx, frontier)
+		if err != nil {
+			return err
+		}
+		sort.Sort(eventsByDepthDescending(generation))
+		frontier = nil
+		for _, event := range generation {
+			if event.RoomID() != request.RoomID {
+				continue
+			}
+			if len(events) == request.Limit {
+				break
+			}
+			events = append(events, event.Event)
+			for _, prevEventID := range event.PrevEventIDs() {
+				if !visited[prevEventID] {
+					visited[prevEventID] = true
+					frontier = append(frontier, prevEventID)
+				}
+			}
+		}
+	}
+
+	if request.ServerName != "" {
+		var err error
+		if events, err = r.filterVisibleEventsForServer(ctx, request.ServerName, events); err != nil {
+			return err
+		}
+	}
+
+	authChain, err := r.authChainOf(ctx, events)
+	if err != nil {
+		return err
+	}
+
+	response.Events = events
+	response.AuthChainEvents = authChain
+	return nil
+}
+
+// filterVisibleEventsForServer returns the events the server is allowed to
+// see among the given ones, in the same order. Servers can see the events
+// sent while the history of the room was world_readable or shared, and the
+// other ones only if one of their users could see them.
+func (r *RoomserverQueryAPI) filterVisibleEventsForServer(
+	ctx context.Context,
+	serverName gomatrixserverlib.ServerName, events []gomatrixserverlib.Event,
+) ([]gomatrixserverlib.Event, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	stateAtEvents, err := r.stateAtEventsWithState(ctx, eventIDsOf(events))
+	if err != nil {
+		return nil, err
+	}
+
+	visible := make(map[types.EventNID]bool)
+	visibleAtSnapshot := make(map[types.StateSnapshotNID]bool)
+	for _, stateAtEvent := range stateAtEvents {
+		snapshotNID := stateAtEvent.BeforeStateSnapshotNID
+		snapshotVisible, ok := visibleAtSnapshot[snapshotNID]
+		if !ok {
+			snapshotVisible, err = r.isVisibleToServerAtSnapshot(ctx, snapshotNID, serverName)
+			if err != nil {
+				return nil, err
+			}
+			visibleAtSnapshot[snapshotNID] = snapshotVisible
+		}
+		visible[stateAtEvent.EventNID] = snapshotVisible
+	}
+
+	eventNIDs, err := r.DB.EventNIDs(ctx, eventIDsOf(events))
+	if err != nil {
+		return nil, err
+	}
+	var result []gomatrixserverlib.Event
+	for _, event := range events {
+		if visible[eventNIDs[event.EventID()]] {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// isVisibleToServerAtSnapshot returns whether the server can see the events
+// sent when the room was in the state with the given numeric ID.
+func (r *RoomserverQueryAPI) isVisibleToServerAtSnapshot(
+	ctx context.Context,
+	snapshotNID types.StateSnapshotNID, serverName gomatrixserverlib.ServerName,
+) (bool, error) {
+	if snapshotNID == 0 {
+		// We don't know the state before the event.
+		return false, nil
+	}
+	stateEntries, err := state.LoadStateAtSnapshot(ctx, r.DB, snapshotNID)
+	if err != nil {
+		return false, err
+	}
+	var wantedEntries []types.StateEntry
+	for _, entry := range stateEntries {
+		if entry.EventTypeNID == types.MRoomMemberNID {
+			wantedEntries = append(wantedEntries, entry)
+		}
+	}
+	visibilityEntries, err := state.LoadStateAtSnapshotForStringTuples(
+		ctx, r.DB, snapshotNID, []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.history_visibility", StateKey: ""},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	wantedEntries = append(wantedEntries, visibilityEntries...)
+	stateEvents, err := r.loadStateEvents(ctx, wantedEntries)
+	if err != nil {
+		return false, err
+	}
+
+	// "shared" is the default history visibility.
+	visibility := "shared"
+	var memberships []string
+	for _, event := range stateEvents {
+		switch event.Type() {
+		case "m.room.history_visibility":
+			var content common.HistoryVisibilityContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				return false, err
+			}
+			visibility = content.HistoryVisibility
+		case "m.room.member":
+			_, domain, err := gomatrixserverlib.SplitID('@', *event.StateKey())
+			if err != nil || domain != serverName {
+				continue
+			}
+			membership, err := event.Membership()
+			if err != nil {
+				return false, err
+			}
+			memberships = append(memberships, membership)
+		}
+	}
+	if visibility == "world_readable" || visibility == "shared" {
+		return true, nil
+	}
+	for _, membership := range memberships {
+		if common.HistoryVisibilityAllows(visibility, common.MembershipHistory{AtEvent: membership}) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type eventsByDepthDescending []types.Event
+
+func (s eventsByDepthDescending) Len() int           { return len(s) }
+func (s eventsByDepthDescending) Less(i, j int) bool { return s[i].Depth() > s[j].Depth() }
+func (s eventsByDepthDescending) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// authChainOf returns the events in the auth chains of the given events that
+// aren't one of the given events.
+func (r *RoomserverQueryAPI) authChainOf(
+	ctx context.Context, events []gomatrixserverlib.Event,
+) ([]gomatrixserverlib.Event, error) {
+	seen := make(map[string]bool)
+	for _, event := range events {
+		seen[event.EventID()] = true
+	}
+	var authChain []gomatrixserverlib.Event
+	var eventIDs []string
+	next := events
+	for len(next) > 0 {
+		eventIDs = eventIDs[:0]
+		for _, event := range next {
+			for _, authEventID := range event.AuthEventIDs() {
+				if !seen[authEventID] {
+					seen[authEventID] = true
+					eventIDs = append(eventIDs, authEventID)
+				}
+			}
+		}
+		if len(eventIDs) == 0 {
+			break
+		}
+		authEvents, err := r.DB.EventsFromIDs(ctx, eventIDs)
+		if err != nil {
+			return nil, err
+		}
+		next = make([]gomatrixserverlib.Event, len(authEvents))
+		for i := range authEvents {
+			next[i] = authEvents[i].Event
+		}
+		authChain = append(authChain, next...)
+	}
+	return authChain, nil
+}
+
 // QueryMembershipsForRoom implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryMembershipsForRoom(
+	ctx context.Context,
 	request *api.QueryMembershipsForRoomRequest,
 	response *api.QueryMembershipsForRoomResponse,
 ) error {
-	roomNID, err := r.DB.RoomNID(request.RoomID)
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
 
-	membershipEventNID, stillInRoom, err := r.DB.GetMembership(roomNID, request.Sender)
+	membershipEventNID, stillInRoom, err := r.DB.GetMembership(ctx, roomNID, request.Sender)
 	if err != nil {
 		return nil
 	}
@@ -218,14 +884,14 @@ func (r *RoomserverQueryAPI) QueryMembershipsForRoom(
 	var events []types.Event
 	if stillInRoom {
 		var eventNIDs []types.EventNID
-		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(roomNID, request.JoinedOnly)
+		eventNIDs, err = r.DB.GetMembershipEventNIDsForRoom(ctx, roomNID, request.JoinedOnly)
 		if err != nil {
 			return err
 		}
 
-		events, err = r.DB.Events(eventNIDs)
+		events, err = r.DB.Events(ctx, eventNIDs)
 	} else {
-		events, err = r.getMembershipsBeforeEventNID(membershipEventNID, request.JoinedOnly)
+		events, err = r.getMembershipsBeforeEventNID(ctx, membershipEventNID, request.JoinedOnly)
 	}
 
 	if err != nil {
@@ -244,22 +910,22 @@ func (r *RoomserverQueryAPI) QueryMembershipsForRoom(
 // of the event's room as it was when this event was fired, then filters the state events to
 // only keep the "m.room.member" events with a "join" membership. These events are returned.
 // Returns an error if there was an issue fetching the events.
-func (r *RoomserverQueryAPI) getMembershipsBeforeEventNID(eventNID types.EventNID, joinedOnly bool) ([]types.Event, error) {
+func (r *RoomserverQueryAPI) getMembershipsBeforeEventNID(ctx context.Context, eventNID types.EventNID, joinedOnly bool) ([]types.Event, error) {
 	events := []types.Event{}
 	// Lookup the event NID
-	eIDs, err := r.DB.EventIDs([]types.EventNID{eventNID})
+	eIDs, err := r.DB.EventIDs(ctx, []types.EventNID{eventNID})
 	if err != nil {
 		return nil, err
 	}
 	eventIDs := []string{eIDs[eventNID]}
 
-	prevState, err := r.DB.StateAtEventIDs(eventIDs)
+	prevState, err := r.DB.StateAtEventIDs(ctx, eventIDs)
 	if err != nil {
 		return nil, err
 	}
 
 	// Fetch the state as it was when this event was fired
-	stateEntries, err := state.LoadCombinedStateAfterEvents(r.DB, prevState)
+	stateEntries, err := state.LoadCombinedStateAfterEvents(ctx, r.DB, prevState)
 	if err != nil {
 		return nil, err
 	}
@@ -273,7 +939,7 @@ func (r *RoomserverQueryAPI) getMembershipsBeforeEventNID(eventNID types.EventNI
 	}
 
 	// Get all of the events in this state
-	stateEvents, err := r.DB.Events(eventNIDs)
+	stateEvents, err := r.DB.Events(ctx, eventNIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -299,26 +965,27 @@ func (r *RoomserverQueryAPI) getMembershipsBeforeEventNID(eventNID types.EventNI
 
 // QueryInvitesForUser implements api.RoomserverQueryAPI
 func (r *RoomserverQueryAPI) QueryInvitesForUser(
+	ctx context.Context,
 	request *api.QueryInvitesForUserRequest,
 	response *api.QueryInvitesForUserResponse,
 ) error {
-	roomNID, err := r.DB.RoomNID(request.RoomID)
+	roomNID, err := r.DB.RoomNID(ctx, request.RoomID)
 	if err != nil {
 		return err
 	}
 
-	targetUserNIDs, err := r.DB.EventStateKeyNIDs([]string{request.TargetUserID})
+	targetUserNIDs, err := r.DB.EventStateKeyNIDs(ctx, []string{request.TargetUserID})
 	if err != nil {
 		return err
 	}
 	targetUserNID := targetUserNIDs[request.TargetUserID]
 
-	senderUserNIDs, err := r.DB.GetInvitesForUser(roomNID, targetUserNID)
+	senderUserNIDs, err := r.DB.GetInvitesForUser(ctx, roomNID, targetUserNID)
 	if err != nil {
 		return err
 	}
 
-	senderUserIDs, err := r.DB.EventStateKeys(senderUserNIDs)
+	senderUserIDs, err := r.DB.EventStateKeys(ctx, senderUserNIDs)
 	if err != nil {
 		return err
 	}
@@ -330,6 +997,204 @@ func (r *RoomserverQueryAPI) QueryInvitesForUser(
 	return nil
 }
 
+// QueryRelations implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRelations(
+	ctx context.Context,
+	request *api.QueryRelationsRequest,
+	response *api.QueryRelationsResponse,
+) error {
+	response.QueryRelationsRequest = *request
+	response.Relations = map[string]api.EventRelations{}
+
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	eventIDs := make([]string, len(events))
+	senders := map[string]string{}
+	for i, event := range events {
+		eventIDs[i] = event.EventID()
+		senders[event.EventID()] = event.Sender()
+	}
+
+	if err = r.addLatestEdits(ctx, eventIDs, senders, response.Relations); err != nil {
+		return err
+	}
+	if err = r.addThreadSummaries(ctx, request.UserID, eventIDs, senders, response.Relations); err != nil {
+		return err
+	}
+	return r.addAnnotations(ctx, eventIDs, response.Relations)
+}
+
+// addAnnotations adds the annotations of the events to their relations.
+func (r *RoomserverQueryAPI) addAnnotations(
+	ctx context.Context, eventIDs []string, relations map[string]api.EventRelations,
+) error {
+	annotations, err := r.DB.Annotations(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	// The annotations are ordered from the most to the least used key.
+	for _, annotation := range annotations {
+		eventRelations := relations[annotation.RelatesToID]
+		eventRelations.Annotations = append(eventRelations.Annotations, api.Annotation{
+			Type:  "m.reaction",
+			Key:   annotation.Key,
+			Count: annotation.Count,
+		})
+		relations[annotation.RelatesToID] = eventRelations
+	}
+	return nil
+}
+
+// addLatestEdits adds the latest edits of the events, given with their
+// senders, to their relations.
+func (r *RoomserverQueryAPI) addLatestEdits(
+	ctx context.Context, eventIDs []string,
+	senders map[string]string, relations map[string]api.EventRelations,
+) error {
+	edits, err := r.DB.EventRelations(ctx, eventIDs, "m.replace")
+	if err != nil || len(edits) == 0 {
+		return err
+	}
+
+	// Only edits sent by the sender of the original event count.
+	latestEdits := map[string]types.EventNID{}
+	for _, edit := range edits {
+		if senders[edit.RelatesToID] == edit.Sender {
+			// The edits are ordered from the oldest to the newest.
+			latestEdits[edit.RelatesToID] = edit.EventNID
+		}
+	}
+
+	editNIDs := make([]types.EventNID, 0, len(latestEdits))
+	editedIDs := map[types.EventNID]string{}
+	for eventID, editNID := range latestEdits {
+		editNIDs = append(editNIDs, editNID)
+		editedIDs[editNID] = eventID
+	}
+	editEvents, err := r.DB.Events(ctx, editNIDs)
+	if err != nil {
+		return err
+	}
+	for i := range editEvents {
+		eventID := editedIDs[editEvents[i].EventNID]
+		eventRelations := relations[eventID]
+		eventRelations.Replace = &editEvents[i].Event
+		relations[eventID] = eventRelations
+	}
+	return nil
+}
+
+// addThreadSummaries adds the summaries of the threads whose root is one of
+// the events, given with their senders, to their relations.
+func (r *RoomserverQueryAPI) addThreadSummaries(
+	ctx context.Context, userID string, eventIDs []string,
+	senders map[string]string, relations map[string]api.EventRelations,
+) error {
+	roots, err := r.DB.ThreadRoots(ctx, eventIDs)
+	if err != nil || len(roots) == 0 {
+		return err
+	}
+
+	rootIDs := make([]string, len(roots))
+	latestNIDs := make([]types.EventNID, len(roots))
+	for i, root := range roots {
+		rootIDs[i] = root.RootEventID
+		latestNIDs[i] = root.LatestEventNID
+	}
+	latestEvents, err := r.DB.Events(ctx, latestNIDs)
+	if err != nil {
+		return err
+	}
+	latestEventsByNID := map[types.EventNID]gomatrixserverlib.Event{}
+	for _, event := range latestEvents {
+		latestEventsByNID[event.EventNID] = event.Event
+	}
+	participated := map[string]bool{}
+	if userID != "" {
+		repliedIDs, err := r.DB.RelatedEventIDsForSender(ctx, rootIDs, "m.thread", userID)
+		if err != nil {
+			return err
+		}
+		for _, eventID := range repliedIDs {
+			participated[eventID] = true
+		}
+	}
+
+	for _, root := range roots {
+		latestEvent, ok := latestEventsByNID[root.LatestEventNID]
+		if !ok {
+			// The latest reply was purged.
+			continue
+		}
+		eventRelations := relations[root.RootEventID]
+		eventRelations.Thread = &api.ThreadSummary{
+			Count:       root.ReplyCount,
+			LatestEvent: latestEvent,
+			CurrentUserParticipated: participated[root.RootEventID] ||
+				senders[root.RootEventID] == userID,
+		}
+		relations[root.RootEventID] = eventRelations
+	}
+	return nil
+}
+
+// QueryRelationEvents implements api.RoomserverQueryAPI
+func (r *RoomserverQueryAPI) QueryRelationEvents(
+	ctx context.Context,
+	request *api.QueryRelationEventsRequest,
+	response *api.QueryRelationEventsResponse,
+) error {
+	response.QueryRelationEventsRequest = *request
+	response.Events = []gomatrixserverlib.Event{}
+
+	events, err := r.DB.EventsFromIDs(ctx, []string{request.EventID})
+	if err != nil {
+		return err
+	}
+	if len(events) != 1 || events[0].RoomID() != request.RoomID {
+		return nil
+	}
+	visible, err := r.filterVisibleEvents(ctx, request.UserID, []gomatrixserverlib.Event{events[0].Event})
+	if err != nil || len(visible) == 0 {
+		return err
+	}
+	response.EventExists = true
+
+	related, err := r.DB.EventRelationsBefore(
+		ctx, request.EventID, request.RelType, types.EventNID(request.From), request.Limit,
+	)
+	if err != nil || len(related) == 0 {
+		return err
+	}
+	if len(related) == request.Limit {
+		response.Next = int64(related[len(related)-1].EventNID)
+	}
+
+	relatedNIDs := make([]types.EventNID, len(related))
+	for i := range related {
+		relatedNIDs[i] = related[i].EventNID
+	}
+	relatedEvents, err := r.DB.Events(ctx, relatedNIDs)
+	if err != nil {
+		return err
+	}
+	// The events are loaded in no particular order.
+	sort.Slice(relatedEvents, func(i, j int) bool {
+		return relatedEvents[i].EventNID > relatedEvents[j].EventNID
+	})
+	relatedEventsInRoom := make([]gomatrixserverlib.Event, 0, len(relatedEvents))
+	for _, event := range relatedEvents {
+		// Events can only relate to events in the same room.
+		if event.RoomID() == request.RoomID {
+			relatedEventsInRoom = append(relatedEventsInRoom, event.Event)
+		}
+	}
+	response.Events, err = r.filterVisibleEvents(ctx, request.UserID, relatedEventsInRoom)
+	return err
+}
+
 // SetupHTTP adds the RoomserverQueryAPI handlers to the http.ServeMux.
 func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 	servMux.Handle(
@@ -340,7 +1205,35 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 				return util.ErrorResponse(err)
 			}
-			if err := r.QueryLatestEventsAndState(&request, &response); err != nil {
+			if err := r.QueryLatestEventsAndState(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryCurrentStatePath,
+		common.MakeAPI("queryCurrentState", func(req *http.Request) util.JSONResponse {
+			var request api.QueryCurrentStateRequest
+			var response api.QueryCurrentStateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryCurrentState(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryMembershipPath,
+		common.MakeAPI("queryMembership", func(req *http.Request) util.JSONResponse {
+			var request api.QueryMembershipRequest
+			var response api.QueryMembershipResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryMembership(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
@@ -354,7 +1247,21 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 				return util.ErrorResponse(err)
 			}
-			if err := r.QueryStateAfterEvents(&request, &response); err != nil {
+			if err := r.QueryStateAfterEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryStateAndAuthChainPath,
+		common.MakeAPI("queryStateAndAuthChain", func(req *http.Request) util.JSONResponse {
+			var request api.QueryStateAndAuthChainRequest
+			var response api.QueryStateAndAuthChainResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryStateAndAuthChain(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
@@ -368,7 +1275,35 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 				return util.ErrorResponse(err)
 			}
-			if err := r.QueryEventsByID(&request, &response); err != nil {
+			if err := r.QueryEventsByID(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryEventsByRangePath,
+		common.MakeAPI("queryEventsByRange", func(req *http.Request) util.JSONResponse {
+			var request api.QueryEventsByRangeRequest
+			var response api.QueryEventsByRangeResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryEventsByRange(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryBackfillPath,
+		common.MakeAPI("queryBackfill", func(req *http.Request) util.JSONResponse {
+			var request api.QueryBackfillRequest
+			var response api.QueryBackfillResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryBackfill(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
@@ -382,7 +1317,7 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 				return util.ErrorResponse(err)
 			}
-			if err := r.QueryMembershipsForRoom(&request, &response); err != nil {
+			if err := r.QueryMembershipsForRoom(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
@@ -396,7 +1331,35 @@ func (r *RoomserverQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 				return util.ErrorResponse(err)
 			}
-			if err := r.QueryInvitesForUser(&request, &response); err != nil {
+			if err := r.QueryInvitesForUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRelationEventsPath,
+		common.MakeAPI("queryRelationEvents", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRelationEventsRequest
+			var response api.QueryRelationEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRelationEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRelationsPath,
+		common.MakeAPI("queryRelations", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRelationsRequest
+			var response api.QueryRelationsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRelations(req.Context(), &request, &response); err != nil {
 				return util.ErrorResponse(err)
 			}
 			return util.JSONResponse{Code: 200, JSON: &response}
@@ -0,0 +1,74 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// outlierDatabase is a room containing a single outlier, whose state the
+// roomserver doesn't know.
+type outlierDatabase struct {
+	RoomserverQueryAPIDatabase
+}
+
+func (db outlierDatabase) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
+	return 1, nil
+}
+
+func (db outlierDatabase) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return nil, types.MissingEventError("storage: missing state for event NID 1")
+}
+
+func (db outlierDatabase) GetMembership(
+	ctx context.Context, roomNID types.RoomNID, requestSenderUserID string,
+) (types.EventNID, bool, error) {
+	return 0, false, nil
+}
+
+func (db outlierDatabase) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	return nil, nil
+}
+
+func (db outlierDatabase) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	return map[string]types.EventNID{"$outlier:localhost": 1}, nil
+}
+
+func TestFilterVisibleEventsHidesOutliers(t *testing.T) {
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"type": "m.room.message",
+		"content": {"body": "hello", "msgtype": "m.text"},
+		"sender": "@bob:remote",
+		"room_id": "!test:localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$outlier:localhost"
+	}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := RoomserverQueryAPI{DB: outlierDatabase{}}
+	visible, err := r.filterVisibleEvents(context.Background(), "@alice:localhost", []gomatrixserverlib.Event{event})
+	if err != nil {
+		t.Fatalf("filterVisibleEvents: %s", err)
+	}
+	if len(visible) != 0 {
+		t.Errorf("wanted the outlier to be hidden, got %d events", len(visible))
+	}
+}
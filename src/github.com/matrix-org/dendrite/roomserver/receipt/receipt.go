@@ -0,0 +1,104 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receipt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/util"
+)
+
+// RoomserverReceiptAPIDatabase has the storage APIs needed to implement the receipt API.
+type RoomserverReceiptAPIDatabase interface {
+	// Store a receipt, replacing the previous receipt of the same type sent
+	// by the user in the room.
+	// Returns the position of the receipt in the receipts stream.
+	SetReceipt(ctx context.Context, receipt api.Receipt) (int64, error)
+	// Look up the receipts sent in the given rooms after a position in the
+	// receipts stream, up to the latest position.
+	// Returns the receipts and the latest position.
+	GetReceiptsInRooms(ctx context.Context, roomIDs []string, afterPos int64) ([]api.Receipt, int64, error)
+}
+
+// RoomserverReceiptAPI is an implementation of api.RoomserverReceiptAPI
+type RoomserverReceiptAPI struct {
+	DB RoomserverReceiptAPIDatabase
+}
+
+// SetReceipt implements api.RoomserverReceiptAPI
+func (r *RoomserverReceiptAPI) SetReceipt(
+	request *api.SetReceiptRequest,
+	response *api.SetReceiptResponse,
+) error {
+	streamPos, err := r.DB.SetReceipt(context.TODO(), request.Receipt)
+	if err != nil {
+		return err
+	}
+	response.StreamPosition = streamPos
+	return nil
+}
+
+// QueryReceipts implements api.RoomserverReceiptAPI
+func (r *RoomserverReceiptAPI) QueryReceipts(
+	request *api.QueryReceiptsRequest,
+	response *api.QueryReceiptsResponse,
+) error {
+	receipts, streamPos, err := r.DB.GetReceiptsInRooms(context.TODO(), request.RoomIDs, request.AfterPosition)
+	if err != nil {
+		return err
+	}
+	response.Receipts = receipts
+	if response.Receipts == nil {
+		response.Receipts = []api.Receipt{}
+	}
+	response.StreamPosition = streamPos
+	return nil
+}
+
+// SetupHTTP adds the RoomserverReceiptAPI handlers to the http.ServeMux.
+func (r *RoomserverReceiptAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(
+		api.RoomserverSetReceiptPath,
+		common.MakeAPI("setReceipt", func(req *http.Request) util.JSONResponse {
+			var request api.SetReceiptRequest
+			var response api.SetReceiptResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.SetReceipt(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryReceiptsPath,
+		common.MakeAPI("queryReceipts", func(req *http.Request) util.JSONResponse {
+			var request api.QueryReceiptsRequest
+			var response api.QueryReceiptsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryReceipts(&request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: 200, JSON: &response}
+		}),
+	)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retention redacts the events of rooms which are older than the
+// m.room.retention policy of the room allows. The events are redacted rather
+// than deleted so that the event graph of the room stays intact.
+// https://github.com/matrix-org/matrix-doc/pull/1763
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/input"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The maximum number of events redacted in a single database transaction,
+// and so written in a single OutputExpiredEvents.
+const maxEventsPerBatch = 1000
+
+// Database has the storage APIs needed to redact the expired events of rooms.
+type Database interface {
+	// Look up the IDs of the rooms which have an event of the given type.
+	// Returns an error if there was a problem talking to the database.
+	RoomIDsWithEventType(ctx context.Context, eventType string) ([]string, error)
+	// Look up the numeric ID for the room.
+	// Returns 0 if the room doesn't exists.
+	// Returns an error if there was a problem talking to the database.
+	RoomNID(ctx context.Context, roomID string) (types.RoomNID, error)
+	// Redact up to limit events of the room which aren't state events and
+	// were sent before the given time, and return their IDs.
+	// Returns an error if there was a problem talking to the database.
+	ExpireEvents(ctx context.Context, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, limit int) ([]string, error)
+}
+
+// An Expirer periodically redacts the events of the rooms with a
+// m.room.retention policy which are older than the max_lifetime of the
+// policy, and writes their IDs to the output log so that the other components
+// redact them too.
+type Expirer struct {
+	DB           Database
+	Cfg          *config.Dendrite
+	QueryAPI     api.RoomserverQueryAPI
+	OutputWriter input.OutputRoomEventWriter
+}
+
+// Start checking the rooms in a new goroutine.
+func (e *Expirer) Start() {
+	go func() {
+		ticker := time.NewTicker(e.Cfg.RoomServer.RetentionCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := e.expireRooms(context.Background()); err != nil {
+				log.WithError(err).Warn("Failed to redact the expired events of rooms")
+			}
+		}
+	}()
+}
+
+func (e *Expirer) expireRooms(ctx context.Context) error {
+	roomIDs, err := e.DB.RoomIDsWithEventType(ctx, "m.room.retention")
+	if err != nil {
+		return err
+	}
+	for _, roomID := range roomIDs {
+		// Carry on with the other rooms if one of them fails, since the error
+		// could be specific to the room.
+		if err = e.expireRoom(ctx, roomID); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Warn("Failed to redact the expired events of room")
+		}
+	}
+	return nil
+}
+
+// expireRoom redacts the events of the room which are older than the current
+// retention policy of the room allows, if it has one.
+func (e *Expirer) expireRoom(ctx context.Context, roomID string) error {
+	maxLifetime, err := e.maxLifetime(ctx, roomID)
+	if err != nil || maxLifetime <= 0 {
+		return err
+	}
+	roomNID, err := e.DB.RoomNID(ctx, roomID)
+	if err != nil || roomNID == 0 {
+		return err
+	}
+
+	before := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Duration(maxLifetime) * time.Millisecond))
+	for {
+		eventIDs, err := e.DB.ExpireEvents(ctx, roomNID, before, maxEventsPerBatch)
+		if err != nil {
+			return err
+		}
+		if len(eventIDs) > 0 {
+			err = e.OutputWriter.WriteOutputEvents(roomID, []api.OutputEvent{{
+				Type: api.OutputTypeExpiredEvents,
+				ExpiredEvents: &api.OutputExpiredEvents{
+					RoomID:   roomID,
+					EventIDs: eventIDs,
+				},
+			}})
+			if err != nil {
+				// The events are redacted in the roomserver, but other
+				// components still have them.
+				return err
+			}
+			log.WithFields(log.Fields{
+				"room_id":    roomID,
+				"num_events": len(eventIDs),
+			}).Info("Redacted the expired events of room")
+		}
+		if len(eventIDs) < maxEventsPerBatch {
+			return nil
+		}
+	}
+}
+
+// maxLifetime returns the max_lifetime of the current m.room.retention event
+// of the room, in milliseconds, or 0 if there is none.
+func (e *Expirer) maxLifetime(ctx context.Context, roomID string) (int64, error) {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.retention", StateKey: ""},
+		},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := e.QueryAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return 0, err
+	}
+	for _, event := range res.StateEvents {
+		var content common.RetentionContent
+		if err := json.Unmarshal(event.Content(), &content); err != nil {
+			// Ignore policies whose content can't be decoded.
+			return 0, nil
+		}
+		if content.MaxLifetime != nil {
+			return *content.MaxLifetime, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/admin"
+	"github.com/matrix-org/util"
+)
+
+const pathPrefixAdminV1 = "/_dendrite/admin/v1"
+
+// Setup configures the given mux with roomserver admin API listeners
+func Setup(
+	apiMux *mux.Router, purger *admin.Purger,
+	deviceDB *devices.Database, accountDB *accounts.Database,
+) {
+	adminmux := apiMux.PathPrefix(pathPrefixAdminV1).Subrouter()
+
+	adminmux.Handle("/purge_history/{roomID}/{eventID}",
+		common.MakeAuthAdminAPI("admin_purge_history", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.PurgeHistory(req, purger, vars["roomID"], vars["eventID"])
+		}),
+	).Methods("POST")
+	adminmux.Handle("/purge_history_status/{purgeID}",
+		common.MakeAuthAdminAPI("admin_purge_history_status", deviceDB, accountDB, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+			vars := mux.Vars(req)
+			return admin.GetPurgeStatus(req, purger, vars["purgeID"])
+		}),
+	).Methods("GET")
+}
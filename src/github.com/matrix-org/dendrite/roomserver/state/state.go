@@ -17,7 +17,9 @@
 package state
 
 import (
+	"context"
 	"fmt"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -29,47 +31,54 @@ import (
 // A RoomStateDatabase has the storage APIs needed to load state from the database
 type RoomStateDatabase interface {
 	// Store the room state at an event in the database
-	AddState(roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error)
+	AddState(ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error)
 	// Look up the state of a room at each event for a list of string event IDs.
 	// Returns an error if there is an error talking to the database
 	// Returns a types.MissingEventError if the room state for the event IDs aren't in the database
-	StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error)
+	StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error)
 	// Look up the numeric IDs for a list of string event types.
 	// Returns a map from string event type to numeric ID for the event type.
-	EventTypeNIDs(eventTypes []string) (map[string]types.EventTypeNID, error)
+	EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error)
 	// Look up the numeric IDs for a list of string event state keys.
 	// Returns a map from string state key to numeric ID for the state key.
-	EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error)
+	EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error)
 	// Look up the numeric state data IDs for each numeric state snapshot ID
 	// The returned slice is sorted by numeric state snapshot ID.
-	StateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
+	StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
 	// Look up the state data for each numeric state data ID
 	// The returned slice is sorted by numeric state data ID.
-	StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
+	StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
 	// Look up the state data for the state key tuples for each numeric state block ID
 	// This is used to fetch a subset of the room state at a snapshot.
 	// If a block doesn't contain any of the requested tuples then it can be discarded from the result.
 	// The returned slice is sorted by numeric state block ID.
-	StateEntriesForTuples(stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) (
+	StateEntriesForTuples(ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) (
 		[]types.StateEntryList, error,
 	)
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
-	Events(eventNIDs []types.EventNID) ([]types.Event, error)
+	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up the events for a list of string event IDs in a single query.
+	// Events missing from the database are omitted from the result.
+	// Returns an error if there was a problem talking to the database.
+	EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error)
+	// Look up the version of the room.
+	// Returns an error if there was a problem talking to the database.
+	RoomVersion(ctx context.Context, roomNID types.RoomNID) (string, error)
 }
 
 // LoadStateAtSnapshot loads the full state of a room at a particular snapshot.
 // This is typically the state before an event or the current state of a room.
 // Returns a sorted list of state entries or an error if there was a problem talking to the database.
-func LoadStateAtSnapshot(db RoomStateDatabase, stateNID types.StateSnapshotNID) ([]types.StateEntry, error) {
-	stateBlockNIDLists, err := db.StateBlockNIDs([]types.StateSnapshotNID{stateNID})
+func LoadStateAtSnapshot(ctx context.Context, db RoomStateDatabase, stateNID types.StateSnapshotNID) ([]types.StateEntry, error) {
+	stateBlockNIDLists, err := db.StateBlockNIDs(ctx, []types.StateSnapshotNID{stateNID})
 	if err != nil {
 		return nil, err
 	}
 	// We've asked for exactly one snapshot from the db so we should have exactly one entry in the result.
 	stateBlockNIDList := stateBlockNIDLists[0]
 
-	stateEntryLists, err := db.StateEntries(stateBlockNIDList.StateBlockNIDs)
+	stateEntryLists, err := db.StateEntries(ctx, stateBlockNIDList.StateBlockNIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +107,21 @@ func LoadStateAtSnapshot(db RoomStateDatabase, stateNID types.StateSnapshotNID)
 
 // LoadCombinedStateAfterEvents loads a snapshot of the state after each of the events
 // and combines those snapshots together into a single list.
-func LoadCombinedStateAfterEvents(db RoomStateDatabase, prevStates []types.StateAtEvent) ([]types.StateEntry, error) {
+func LoadCombinedStateAfterEvents(ctx context.Context, db RoomStateDatabase, prevStates []types.StateAtEvent) ([]types.StateEntry, error) {
+	stateSets, err := loadStateSetsAfterEvents(ctx, db, prevStates)
+	if err != nil {
+		return nil, err
+	}
+	var combined []types.StateEntry
+	for _, stateSet := range stateSets {
+		combined = append(combined, stateSet...)
+	}
+	return combined, nil
+}
+
+// loadStateSetsAfterEvents loads a snapshot of the state after each of the events.
+// Returns a sorted list of state entries for each of the events.
+func loadStateSetsAfterEvents(ctx context.Context, db RoomStateDatabase, prevStates []types.StateAtEvent) ([][]types.StateEntry, error) {
 	stateNIDs := make([]types.StateSnapshotNID, len(prevStates))
 	for i, state := range prevStates {
 		stateNIDs[i] = state.BeforeStateSnapshotNID
@@ -107,7 +130,7 @@ func LoadCombinedStateAfterEvents(db RoomStateDatabase, prevStates []types.State
 	// Deduplicate the IDs before passing them to the database.
 	// There could be duplicates because the events could be state events where
 	// the snapshot of the room state before them was the same.
-	stateBlockNIDLists, err := db.StateBlockNIDs(uniqueStateSnapshotNIDs(stateNIDs))
+	stateBlockNIDLists, err := db.StateBlockNIDs(ctx, uniqueStateSnapshotNIDs(stateNIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -120,16 +143,16 @@ func LoadCombinedStateAfterEvents(db RoomStateDatabase, prevStates []types.State
 	// Deduplicate the IDs before passing them to the database.
 	// There could be duplicates because a block of state entries could be reused by
 	// multiple snapshots.
-	stateEntryLists, err := db.StateEntries(uniqueStateBlockNIDs(stateBlockNIDs))
+	stateEntryLists, err := db.StateEntries(ctx, uniqueStateBlockNIDs(stateBlockNIDs))
 	if err != nil {
 		return nil, err
 	}
 	stateBlockNIDsMap := stateBlockNIDListMap(stateBlockNIDLists)
 	stateEntriesMap := stateEntryListMap(stateEntryLists)
 
-	// Combine the entries from all the snapshots of state after each prev event into a single list.
-	var combined []types.StateEntry
-	for _, prevState := range prevStates {
+	// Load the full state after each prev event.
+	stateSets := make([][]types.StateEntry, len(prevStates))
+	for i, prevState := range prevStates {
 		// Grab the list of state data NIDs for this snapshot.
 		stateBlockNIDs, ok := stateBlockNIDsMap.lookup(prevState.BeforeStateSnapshotNID)
 		if !ok {
@@ -161,14 +184,13 @@ func LoadCombinedStateAfterEvents(db RoomStateDatabase, prevStates []types.State
 		sort.Stable(stateEntryByStateKeySorter(fullState))
 		// Unique returns the last entry and hence the most recent entry for each state key.
 		fullState = fullState[:util.Unique(stateEntryByStateKeySorter(fullState))]
-		// Add the full state for this StateSnapshotNID.
-		combined = append(combined, fullState...)
+		stateSets[i] = fullState
 	}
-	return combined, nil
+	return stateSets, nil
 }
 
 // DifferenceBetweeenStateSnapshots works out which state entries have been added and removed between two snapshots.
-func DifferenceBetweeenStateSnapshots(db RoomStateDatabase, oldStateNID, newStateNID types.StateSnapshotNID) (
+func DifferenceBetweeenStateSnapshots(ctx context.Context, db RoomStateDatabase, oldStateNID, newStateNID types.StateSnapshotNID) (
 	removed, added []types.StateEntry, err error,
 ) {
 	if oldStateNID == newStateNID {
@@ -179,13 +201,13 @@ func DifferenceBetweeenStateSnapshots(db RoomStateDatabase, oldStateNID, newStat
 	var oldEntries []types.StateEntry
 	var newEntries []types.StateEntry
 	if oldStateNID != 0 {
-		oldEntries, err = LoadStateAtSnapshot(db, oldStateNID)
+		oldEntries, err = LoadStateAtSnapshot(ctx, db, oldStateNID)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 	if newStateNID != 0 {
-		newEntries, err = LoadStateAtSnapshot(db, newStateNID)
+		newEntries, err = LoadStateAtSnapshot(ctx, db, newStateNID)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -228,19 +250,19 @@ func DifferenceBetweeenStateSnapshots(db RoomStateDatabase, oldStateNID, newStat
 // This is typically the state before an event or the current state of a room.
 // Returns a sorted list of state entries or an error if there was a problem talking to the database.
 func LoadStateAtSnapshotForStringTuples(
-	db RoomStateDatabase, stateNID types.StateSnapshotNID, stateKeyTuples []gomatrixserverlib.StateKeyTuple,
+	ctx context.Context, db RoomStateDatabase, stateNID types.StateSnapshotNID, stateKeyTuples []gomatrixserverlib.StateKeyTuple,
 ) ([]types.StateEntry, error) {
-	numericTuples, err := stringTuplesToNumericTuples(db, stateKeyTuples)
+	numericTuples, err := stringTuplesToNumericTuples(ctx, db, stateKeyTuples)
 	if err != nil {
 		return nil, err
 	}
-	return loadStateAtSnapshotForNumericTuples(db, stateNID, numericTuples)
+	return loadStateAtSnapshotForNumericTuples(ctx, db, stateNID, numericTuples)
 }
 
 // stringTuplesToNumericTuples converts the string state key tuples into numeric IDs
 // If there isn't a numeric ID for either the event type or the event state key then the tuple is discarded.
 // Returns an error if there was a problem talking to the database.
-func stringTuplesToNumericTuples(db RoomStateDatabase, stringTuples []gomatrixserverlib.StateKeyTuple) ([]types.StateKeyTuple, error) {
+func stringTuplesToNumericTuples(ctx context.Context, db RoomStateDatabase, stringTuples []gomatrixserverlib.StateKeyTuple) ([]types.StateKeyTuple, error) {
 	eventTypes := make([]string, len(stringTuples))
 	stateKeys := make([]string, len(stringTuples))
 	for i := range stringTuples {
@@ -248,12 +270,12 @@ func stringTuplesToNumericTuples(db RoomStateDatabase, stringTuples []gomatrixse
 		stateKeys[i] = stringTuples[i].StateKey
 	}
 	eventTypes = util.UniqueStrings(eventTypes)
-	eventTypeMap, err := db.EventTypeNIDs(eventTypes)
+	eventTypeMap, err := db.EventTypeNIDs(ctx, eventTypes)
 	if err != nil {
 		return nil, err
 	}
 	stateKeys = util.UniqueStrings(stateKeys)
-	stateKeyMap, err := db.EventStateKeyNIDs(stateKeys)
+	stateKeyMap, err := db.EventStateKeyNIDs(ctx, stateKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -279,16 +301,16 @@ func stringTuplesToNumericTuples(db RoomStateDatabase, stringTuples []gomatrixse
 // This is typically the state before an event or the current state of a room.
 // Returns a sorted list of state entries or an error if there was a problem talking to the database.
 func loadStateAtSnapshotForNumericTuples(
-	db RoomStateDatabase, stateNID types.StateSnapshotNID, stateKeyTuples []types.StateKeyTuple,
+	ctx context.Context, db RoomStateDatabase, stateNID types.StateSnapshotNID, stateKeyTuples []types.StateKeyTuple,
 ) ([]types.StateEntry, error) {
-	stateBlockNIDLists, err := db.StateBlockNIDs([]types.StateSnapshotNID{stateNID})
+	stateBlockNIDLists, err := db.StateBlockNIDs(ctx, []types.StateSnapshotNID{stateNID})
 	if err != nil {
 		return nil, err
 	}
 	// We've asked for exactly one snapshot from the db so we should have exactly one entry in the result.
 	stateBlockNIDList := stateBlockNIDLists[0]
 
-	stateEntryLists, err := db.StateEntriesForTuples(stateBlockNIDList.StateBlockNIDs, stateKeyTuples)
+	stateEntryLists, err := db.StateEntriesForTuples(ctx, stateBlockNIDList.StateBlockNIDs, stateKeyTuples)
 	if err != nil {
 		return nil, err
 	}
@@ -323,23 +345,25 @@ func loadStateAtSnapshotForNumericTuples(
 // This is typically the state before an event.
 // Returns a sorted list of state entries or an error if there was a problem talking to the database.
 func LoadStateAfterEventsForStringTuples(
-	db RoomStateDatabase, prevStates []types.StateAtEvent, stateKeyTuples []gomatrixserverlib.StateKeyTuple,
+	ctx context.Context, db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent,
+	stateKeyTuples []gomatrixserverlib.StateKeyTuple,
 ) ([]types.StateEntry, error) {
-	numericTuples, err := stringTuplesToNumericTuples(db, stateKeyTuples)
+	numericTuples, err := stringTuplesToNumericTuples(ctx, db, stateKeyTuples)
 	if err != nil {
 		return nil, err
 	}
-	return loadStateAfterEventsForNumericTuples(db, prevStates, numericTuples)
+	return loadStateAfterEventsForNumericTuples(ctx, db, roomNID, prevStates, numericTuples)
 }
 
 func loadStateAfterEventsForNumericTuples(
-	db RoomStateDatabase, prevStates []types.StateAtEvent, stateKeyTuples []types.StateKeyTuple,
+	ctx context.Context, db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent,
+	stateKeyTuples []types.StateKeyTuple,
 ) ([]types.StateEntry, error) {
 	if len(prevStates) == 1 {
 		// Fast path for a single event.
 		prevState := prevStates[0]
 		result, err := loadStateAtSnapshotForNumericTuples(
-			db, prevState.BeforeStateSnapshotNID, stateKeyTuples,
+			ctx, db, prevState.BeforeStateSnapshotNID, stateKeyTuples,
 		)
 		if err != nil {
 			return nil, err
@@ -372,7 +396,11 @@ func loadStateAfterEventsForNumericTuples(
 
 	// TODO: Add metrics for this as it could take a long time for big rooms
 	// with large conflicts.
-	fullState, _, _, err := calculateStateAfterManyEvents(db, prevStates)
+	version, err := stateResolutionVersion(ctx, db, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	fullState, _, _, err := calculateStateAfterManyEvents(ctx, db, version, prevStates)
 	if err != nil {
 		return nil, err
 	}
@@ -491,7 +519,7 @@ func init() {
 // Stores the snapshot of the state in the database.
 // Returns a numeric ID for the snapshot of the state before the event.
 func CalculateAndStoreStateBeforeEvent(
-	db RoomStateDatabase, event gomatrixserverlib.Event, roomNID types.RoomNID,
+	ctx context.Context, db RoomStateDatabase, event gomatrixserverlib.Event, roomNID types.RoomNID,
 ) (types.StateSnapshotNID, error) {
 	// Load the state at the prev events.
 	prevEventRefs := event.PrevEvents()
@@ -500,25 +528,25 @@ func CalculateAndStoreStateBeforeEvent(
 		prevEventIDs[i] = prevEventRefs[i].EventID
 	}
 
-	prevStates, err := db.StateAtEventIDs(prevEventIDs)
+	prevStates, err := db.StateAtEventIDs(ctx, prevEventIDs)
 	if err != nil {
 		return 0, err
 	}
 
 	// The state before this event will be the state after the events that came before it.
-	return CalculateAndStoreStateAfterEvents(db, roomNID, prevStates)
+	return CalculateAndStoreStateAfterEvents(ctx, db, roomNID, prevStates)
 }
 
 // CalculateAndStoreStateAfterEvents finds the room state after the given events.
 // Stores the resulting state in the database and returns a numeric ID for that snapshot.
-func CalculateAndStoreStateAfterEvents(db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent) (types.StateSnapshotNID, error) {
+func CalculateAndStoreStateAfterEvents(ctx context.Context, db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent) (types.StateSnapshotNID, error) {
 	metrics := calculateStateMetrics{startTime: time.Now(), prevEventLength: len(prevStates)}
 
 	if len(prevStates) == 0 {
 		// 2) There weren't any prev_events for this event so the state is
 		// empty.
 		metrics.algorithm = "empty_state"
-		return metrics.stop(db.AddState(roomNID, nil, nil))
+		return metrics.stop(db.AddState(ctx, roomNID, nil, nil))
 	}
 
 	if len(prevStates) == 1 {
@@ -533,7 +561,7 @@ func CalculateAndStoreStateAfterEvents(db RoomStateDatabase, roomNID types.RoomN
 		}
 		// The previous event was a state event so we need to store a copy
 		// of the previous state updated with that event.
-		stateBlockNIDLists, err := db.StateBlockNIDs([]types.StateSnapshotNID{prevState.BeforeStateSnapshotNID})
+		stateBlockNIDLists, err := db.StateBlockNIDs(ctx, []types.StateSnapshotNID{prevState.BeforeStateSnapshotNID})
 		if err != nil {
 			metrics.algorithm = "_load_state_blocks"
 			return metrics.stop(0, err)
@@ -544,14 +572,14 @@ func CalculateAndStoreStateAfterEvents(db RoomStateDatabase, roomNID types.RoomN
 			// add the state event as a block of size one to the end of the blocks.
 			metrics.algorithm = "single_delta"
 			return metrics.stop(db.AddState(
-				roomNID, stateBlockNIDs, []types.StateEntry{prevState.StateEntry},
+				ctx, roomNID, stateBlockNIDs, []types.StateEntry{prevState.StateEntry},
 			))
 		}
 		// If there are too many deltas then we need to calculate the full state
 		// So fall through to calculateAndStoreStateAfterManyEvents
 	}
 
-	return calculateAndStoreStateAfterManyEvents(db, roomNID, prevStates, metrics)
+	return calculateAndStoreStateAfterManyEvents(ctx, db, roomNID, prevStates, metrics)
 }
 
 // maxStateBlockNIDs is the maximum number of state data blocks to use to encode a snapshot of room state.
@@ -565,10 +593,15 @@ const maxStateBlockNIDs = 64
 // This handles the slow path of calculateAndStoreStateAfterEvents for when there is more than one event.
 // Stores the resulting state and returns a numeric ID for the snapshot.
 func calculateAndStoreStateAfterManyEvents(
-	db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent, metrics calculateStateMetrics,
+	ctx context.Context, db RoomStateDatabase, roomNID types.RoomNID, prevStates []types.StateAtEvent, metrics calculateStateMetrics,
 ) (types.StateSnapshotNID, error) {
+	version, err := stateResolutionVersion(ctx, db, roomNID)
+	if err != nil {
+		metrics.algorithm = "_load_room_version"
+		return metrics.stop(0, err)
+	}
 
-	state, algorithm, conflictLength, err := calculateStateAfterManyEvents(db, prevStates)
+	state, algorithm, conflictLength, err := calculateStateAfterManyEvents(ctx, db, version, prevStates)
 	metrics.algorithm = algorithm
 	if err != nil {
 		return metrics.stop(0, err)
@@ -578,20 +611,37 @@ func calculateAndStoreStateAfterManyEvents(
 	// previous state.
 	metrics.conflictLength = conflictLength
 	metrics.fullStateLength = len(state)
-	return metrics.stop(db.AddState(roomNID, nil, state))
+	return metrics.stop(db.AddState(ctx, roomNID, nil, state))
+}
+
+// stateResolutionVersion returns the version of the state resolution algorithm
+// used in a room.
+func stateResolutionVersion(ctx context.Context, db RoomStateDatabase, roomNID types.RoomNID) (common.StateResolutionVersion, error) {
+	roomVersion, err := db.RoomVersion(ctx, roomNID)
+	if err != nil {
+		return 0, err
+	}
+	version, ok := common.RoomVersionStateResolutions[roomVersion]
+	if !ok {
+		return 0, fmt.Errorf("no state resolution algorithm for room version %q", roomVersion)
+	}
+	return version, nil
 }
 
 func calculateStateAfterManyEvents(
-	db RoomStateDatabase, prevStates []types.StateAtEvent,
+	ctx context.Context, db RoomStateDatabase, version common.StateResolutionVersion, prevStates []types.StateAtEvent,
 ) (state []types.StateEntry, algorithm string, conflictLength int, err error) {
-	var combined []types.StateEntry
 	// Conflict resolution.
 	// First stage: load the state after each of the prev events.
-	combined, err = LoadCombinedStateAfterEvents(db, prevStates)
+	stateSets, err := loadStateSetsAfterEvents(ctx, db, prevStates)
 	if err != nil {
 		algorithm = "_load_combined_state"
 		return
 	}
+	var combined []types.StateEntry
+	for _, stateSet := range stateSets {
+		combined = append(combined, stateSet...)
+	}
 
 	// Collect all the entries with the same type and key together.
 	// We don't care about the order here because the conflict resolution
@@ -600,7 +650,14 @@ func calculateStateAfterManyEvents(
 	combined = combined[:util.SortAndUnique(stateEntrySorter(combined))]
 
 	// Find the conflicts
-	conflicts := findDuplicateStateKeys(combined)
+	var conflicts []types.StateEntry
+	if version == common.StateResolutionV1 {
+		conflicts = findDuplicateStateKeys(combined)
+	} else {
+		// Since version 2 the state keys which are missing from some of the
+		// state sets are conflicted too.
+		conflicts = findConflictedStateKeys(stateSets, combined)
+	}
 
 	if len(conflicts) > 0 {
 		conflictLength = len(conflicts)
@@ -617,7 +674,7 @@ func calculateStateAfterManyEvents(
 		}
 
 		var resolved []types.StateEntry
-		resolved, err = resolveConflicts(db, notConflicted, conflicts)
+		resolved, err = resolveConflicts(ctx, db, version, stateSets, notConflicted, conflicts)
 		if err != nil {
 			algorithm = "_resolve_conflicts"
 			return
@@ -632,17 +689,35 @@ func calculateStateAfterManyEvents(
 	return
 }
 
-// resolveConflicts resolves a list of conflicted state entries. It takes two lists.
+// resolveConflicts resolves a list of conflicted state entries with the given version of the state
+// resolution algorithm. It takes the state after each of the prev events, and two lists.
 // The first is a list of all state entries that are not conflicted.
 // The second is a list of all state entries that are conflicted
 // A state entry is conflicted when there is more than one numeric event ID for the same state key tuple.
 // Returns a list that combines the entries without conflicts with the result of state resolution for the entries with conflicts.
 // The returned list is sorted by state key tuple.
 // Returns an error if there was a problem talking to the database.
-func resolveConflicts(db RoomStateDatabase, notConflicted, conflicted []types.StateEntry) ([]types.StateEntry, error) {
+func resolveConflicts(
+	ctx context.Context, db RoomStateDatabase, version common.StateResolutionVersion,
+	stateSets [][]types.StateEntry, notConflicted, conflicted []types.StateEntry,
+) ([]types.StateEntry, error) {
+	switch version {
+	case common.StateResolutionV1:
+		return resolveConflictsV1(ctx, db, notConflicted, conflicted)
+	case common.StateResolutionV2:
+		return resolveConflictsV2(ctx, db, stateSets, notConflicted, conflicted)
+	default:
+		return nil, fmt.Errorf("unknown state resolution version %d", version)
+	}
+}
+
+// resolveConflictsV1 resolves the conflicts with the original state resolution algorithm.
+// The state sets aren't needed because it only uses the conflicted events and the unconflicted
+// events needed to auth them.
+func resolveConflictsV1(ctx context.Context, db RoomStateDatabase, notConflicted, conflicted []types.StateEntry) ([]types.StateEntry, error) {
 
 	// Load the conflicted events
-	conflictedEvents, eventIDMap, err := loadStateEvents(db, conflicted)
+	conflictedEvents, eventIDMap, err := loadStateEvents(ctx, db, conflicted)
 	if err != nil {
 		return nil, err
 	}
@@ -654,7 +729,7 @@ func resolveConflicts(db RoomStateDatabase, notConflicted, conflicted []types.St
 	var neededStateKeys []string
 	neededStateKeys = append(neededStateKeys, needed.Member...)
 	neededStateKeys = append(neededStateKeys, needed.ThirdPartyInvite...)
-	stateKeyNIDMap, err := db.EventStateKeyNIDs(neededStateKeys)
+	stateKeyNIDMap, err := db.EventStateKeyNIDs(ctx, neededStateKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -667,7 +742,7 @@ func resolveConflicts(db RoomStateDatabase, notConflicted, conflicted []types.St
 			authEntries = append(authEntries, types.StateEntry{tuple, eventNID})
 		}
 	}
-	authEvents, _, err := loadStateEvents(db, authEntries)
+	authEvents, _, err := loadStateEvents(ctx, db, authEntries)
 	if err != nil {
 		return nil, err
 	}
@@ -689,6 +764,181 @@ func resolveConflicts(db RoomStateDatabase, notConflicted, conflicted []types.St
 	return notConflicted, nil
 }
 
+// resolveConflictsV2 resolves the conflicts with the state resolution algorithm of room version 2.
+// This needs the auth chains of the state sets to work out the auth difference between them.
+func resolveConflictsV2(
+	ctx context.Context, db RoomStateDatabase, stateSets [][]types.StateEntry, notConflicted, conflicted []types.StateEntry,
+) ([]types.StateEntry, error) {
+	conflictedEvents, eventIDMap, err := loadStateEvents(ctx, db, conflicted)
+	if err != nil {
+		return nil, err
+	}
+	notConflictedEvents, notConflictedEventIDMap, err := loadStateEvents(ctx, db, notConflicted)
+	if err != nil {
+		return nil, err
+	}
+	conflictedEventIDs := map[types.EventNID]string{}
+	for eventID, entry := range eventIDMap {
+		conflictedEventIDs[entry.EventNID] = eventID
+	}
+	for eventID, entry := range notConflictedEventIDMap {
+		eventIDMap[eventID] = entry
+	}
+
+	// Work out the auth difference, which is the events in the auth chains of some of the
+	// state sets but not all of them.
+	// The auth chain of the unconflicted events is common to all of them, so only the auth
+	// chains of the conflicted events in each state set can differ.
+	// TODO: This loads the auth chain of the whole room state every time there is a conflict.
+	// We could store the auth chains in the database to speed this up for big rooms.
+	chains := authChainLoader{db: db, events: map[string]types.Event{}}
+	notConflictedEventIDs := make([]string, len(notConflictedEvents))
+	for i := range notConflictedEvents {
+		notConflictedEventIDs[i] = notConflictedEvents[i].EventID()
+	}
+	commonChain, err := chains.authChain(ctx, notConflictedEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	chainCounts := map[string]int{}
+	for _, stateSet := range stateSets {
+		var setEventIDs []string
+		for _, entry := range stateSet {
+			if eventID, ok := conflictedEventIDs[entry.EventNID]; ok {
+				setEventIDs = append(setEventIDs, eventID)
+			}
+		}
+		chain, err := chains.authChain(ctx, setEventIDs)
+		if err != nil {
+			return nil, err
+		}
+		for eventID := range chain {
+			chainCounts[eventID]++
+		}
+	}
+	var authDifference []gomatrixserverlib.Event
+	for eventID, count := range chainCounts {
+		if count < len(stateSets) && !commonChain[eventID] {
+			authDifference = append(authDifference, chains.events[eventID].Event)
+		}
+	}
+	authEvents := make([]gomatrixserverlib.Event, 0, len(chains.events))
+	for _, event := range chains.events {
+		authEvents = append(authEvents, event.Event)
+	}
+
+	// Resolve the conflicts.
+	resolvedEvents := resolveStateConflictsV2(
+		conflictedEvents, notConflictedEvents, authEvents, authDifference,
+	)
+
+	// Map from the full events back to numeric state entries.
+	// The events from the auth difference may not be in any of the state sets so we need
+	// to look up the numeric IDs of their types and state keys.
+	var result []types.StateEntry
+	var fromAuthDifference []types.Event
+	for _, resolvedEvent := range resolvedEvents {
+		if entry, ok := eventIDMap[resolvedEvent.EventID()]; ok {
+			result = append(result, entry)
+		} else {
+			fromAuthDifference = append(fromAuthDifference, chains.events[resolvedEvent.EventID()])
+		}
+	}
+	entries, err := stateEntriesForEvents(ctx, db, fromAuthDifference)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, entries...)
+
+	// Sort the result so it can be searched.
+	sort.Sort(stateEntrySorter(result))
+	return result, nil
+}
+
+// An authChainLoader loads the auth chains of events from the database.
+// It keeps the events it has loaded so that they are only loaded once.
+type authChainLoader struct {
+	db     RoomStateDatabase
+	events map[string]types.Event
+}
+
+// authChain returns the set of the given event IDs along with the event IDs in their auth chains.
+// Events which are missing from the database are left out.
+// Returns an error if there was a problem talking to the database.
+func (l *authChainLoader) authChain(ctx context.Context, eventIDs []string) (map[string]bool, error) {
+	chain := map[string]bool{}
+	// Walk the auth chains breadth first so that each level only takes one query.
+	for len(eventIDs) > 0 {
+		var missing []string
+		for _, eventID := range eventIDs {
+			if _, ok := l.events[eventID]; !ok {
+				missing = append(missing, eventID)
+			}
+		}
+		if len(missing) > 0 {
+			events, err := l.db.EventsFromIDs(ctx, missing)
+			if err != nil {
+				return nil, err
+			}
+			for _, event := range events {
+				l.events[event.EventID()] = event
+			}
+		}
+		var next []string
+		for _, eventID := range eventIDs {
+			event, ok := l.events[eventID]
+			if !ok || chain[eventID] {
+				continue
+			}
+			chain[eventID] = true
+			for _, authEventID := range event.AuthEventIDs() {
+				if !chain[authEventID] {
+					next = append(next, authEventID)
+				}
+			}
+		}
+		eventIDs = next
+	}
+	return chain, nil
+}
+
+// stateEntriesForEvents looks up the numeric state entries for a list of state events.
+// Returns an error if there was a problem talking to the database.
+func stateEntriesForEvents(ctx context.Context, db RoomStateDatabase, events []types.Event) ([]types.StateEntry, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	var eventTypes, eventStateKeys []string
+	for _, event := range events {
+		eventTypes = append(eventTypes, event.Type())
+		eventStateKeys = append(eventStateKeys, *event.StateKey())
+	}
+	eventTypeNIDs, err := db.EventTypeNIDs(ctx, eventTypes)
+	if err != nil {
+		return nil, err
+	}
+	eventStateKeyNIDs, err := db.EventStateKeyNIDs(ctx, eventStateKeys)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]types.StateEntry, len(events))
+	for i, event := range events {
+		eventTypeNID, ok := eventTypeNIDs[event.Type()]
+		if !ok {
+			return nil, fmt.Errorf("missing numeric ID for event type %q", event.Type())
+		}
+		eventStateKeyNID, ok := eventStateKeyNIDs[*event.StateKey()]
+		if !ok {
+			return nil, fmt.Errorf("missing numeric ID for state key %q", *event.StateKey())
+		}
+		result[i] = types.StateEntry{
+			StateKeyTuple: types.StateKeyTuple{EventTypeNID: eventTypeNID, EventStateKeyNID: eventStateKeyNID},
+			EventNID:      event.EventNID,
+		}
+	}
+	return result, nil
+}
+
 // stateKeyTuplesNeeded works out which numeric state key tuples we need to authenticate some events.
 func stateKeyTuplesNeeded(stateKeyNIDMap map[string]types.EventStateKeyNID, stateNeeded gomatrixserverlib.StateNeeded) []types.StateKeyTuple {
 	var keyTuples []types.StateKeyTuple
@@ -720,12 +970,12 @@ func stateKeyTuplesNeeded(stateKeyNIDMap map[string]types.EventStateKeyNID, stat
 // Returns a list of state events in no particular order and a map from string event ID back to state entry.
 // The map can be used to recover which numeric state entry a given event is for.
 // Returns an error if there was a problem talking to the database.
-func loadStateEvents(db RoomStateDatabase, entries []types.StateEntry) ([]gomatrixserverlib.Event, map[string]types.StateEntry, error) {
+func loadStateEvents(ctx context.Context, db RoomStateDatabase, entries []types.StateEntry) ([]gomatrixserverlib.Event, map[string]types.StateEntry, error) {
 	eventNIDs := make([]types.EventNID, len(entries))
 	for i := range entries {
 		eventNIDs[i] = entries[i].EventNID
 	}
-	events, err := db.Events(eventNIDs)
+	events, err := db.Events(ctx, eventNIDs)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -742,6 +992,27 @@ func loadStateEvents(db RoomStateDatabase, entries []types.StateEntry) ([]gomatr
 	return result, eventIDMap, nil
 }
 
+// findConflictedStateKeys finds the state entries where the state key tuple either appears more than
+// once in a sorted list combining the state sets, or is missing from some of the state sets.
+// Returns a sorted list of those state entries.
+func findConflictedStateKeys(stateSets [][]types.StateEntry, combined []types.StateEntry) []types.StateEntry {
+	setCounts := map[types.StateKeyTuple]int{}
+	for _, stateSet := range stateSets {
+		for _, entry := range stateSet {
+			setCounts[entry.StateKeyTuple]++
+		}
+	}
+	duplicates := findDuplicateStateKeys(combined)
+	var result []types.StateEntry
+	for _, entry := range combined {
+		_, duplicated := stateEntryMap(duplicates).lookup(entry.StateKeyTuple)
+		if duplicated || setCounts[entry.StateKeyTuple] != len(stateSets) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
 // findDuplicateStateKeys finds the state entries where the state key tuple appears more than once in a sorted list.
 // Returns a sorted list of those state entries.
 func findDuplicateStateKeys(a []types.StateEntry) []types.StateEntry {
@@ -53,3 +53,36 @@ func TestFindDuplicateStateKeys(t *testing.T) {
 		}
 	}
 }
+
+func TestFindConflictedStateKeys(t *testing.T) {
+	stateSets := [][]types.StateEntry{{
+		{types.StateKeyTuple{1, 1}, 1},
+		{types.StateKeyTuple{2, 2}, 3},
+		{types.StateKeyTuple{3, 3}, 4},
+	}, {
+		{types.StateKeyTuple{1, 1}, 2},
+		{types.StateKeyTuple{2, 2}, 3},
+	}}
+	combined := []types.StateEntry{
+		{types.StateKeyTuple{1, 1}, 1},
+		{types.StateKeyTuple{1, 1}, 2},
+		{types.StateKeyTuple{2, 2}, 3},
+		{types.StateKeyTuple{3, 3}, 4},
+	}
+	// The state key tuple with different events is conflicted, and so is the
+	// one missing from the second state set.
+	want := []types.StateEntry{
+		{types.StateKeyTuple{1, 1}, 1},
+		{types.StateKeyTuple{1, 1}, 2},
+		{types.StateKeyTuple{3, 3}, 4},
+	}
+	got := findConflictedStateKeys(stateSets, combined)
+	if len(got) != len(want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sort"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// resolveStateConflictsV2 resolves the state of a room using the state
+// resolution algorithm of room versions 2 and later.
+// See https://matrix.org/docs/spec/rooms/v2#state-resolution
+//
+// The conflicted events are the state events which are different between the
+// state sets being resolved, and the unconflicted events are the ones that are
+// the same in all of them. The auth difference is the events which are in the
+// auth chain of some of the state sets but not all of them. The auth events
+// must include every event in the auth chains of the other events, so that
+// the auth events of each event can be found when checking it.
+//
+// Returns the full resolved state of the room, sorted by type and state key.
+func resolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference []gomatrixserverlib.Event) []gomatrixserverlib.Event {
+	r := stateResolverV2{
+		events:      map[string]*gomatrixserverlib.Event{},
+		powerLevels: map[string]int64{},
+		state:       map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event{},
+	}
+	for _, events := range [][]gomatrixserverlib.Event{authEvents, authDifference, conflicted, unconflicted} {
+		for i := range events {
+			r.events[events[i].EventID()] = &events[i]
+		}
+	}
+
+	// The full conflicted set is the union of the conflicted events and the
+	// auth difference.
+	fullConflicted := map[string]*gomatrixserverlib.Event{}
+	for _, events := range [][]gomatrixserverlib.Event{conflicted, authDifference} {
+		for i := range events {
+			fullConflicted[events[i].EventID()] = r.events[events[i].EventID()]
+		}
+	}
+
+	// Start with the unconflicted state, then apply the power events from the
+	// full conflicted set, along with the events they are authorised by.
+	for i := range unconflicted {
+		r.state[stateKeyTupleOf(&unconflicted[i])] = &unconflicted[i]
+	}
+	powerEvents := map[string]*gomatrixserverlib.Event{}
+	for _, event := range fullConflicted {
+		if isPowerEvent(event) {
+			r.addAuthChainInSet(event, fullConflicted, powerEvents)
+		}
+	}
+	r.iterativeAuthChecks(r.reverseTopologicalPowerOrdering(powerEvents))
+
+	// Then apply the rest of the full conflicted set, ordered by their
+	// position relative to the mainline of the resolved power levels.
+	var others []*gomatrixserverlib.Event
+	for eventID, event := range fullConflicted {
+		if _, ok := powerEvents[eventID]; !ok {
+			others = append(others, event)
+		}
+	}
+	r.iterativeAuthChecks(r.mainlineOrdering(others))
+
+	// Finally the unconflicted state is applied again, so that it cannot be
+	// replaced by events from the auth difference.
+	for i := range unconflicted {
+		r.state[stateKeyTupleOf(&unconflicted[i])] = &unconflicted[i]
+	}
+
+	result := make([]gomatrixserverlib.Event, 0, len(r.state))
+	for _, event := range r.state {
+		result = append(result, *event)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type() != result[j].Type() {
+			return result[i].Type() < result[j].Type()
+		}
+		return *result[i].StateKey() < *result[j].StateKey()
+	})
+	return result
+}
+
+// A stateResolverV2 tracks the internal state of the version 2 state
+// resolution algorithm.
+type stateResolverV2 struct {
+	// All the events known to the resolver by event ID.
+	events map[string]*gomatrixserverlib.Event
+	// The power levels of the senders of events, by event ID.
+	powerLevels map[string]int64
+	// The partially resolved state of the room.
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event
+}
+
+func stateKeyTupleOf(event *gomatrixserverlib.Event) gomatrixserverlib.StateKeyTuple {
+	return gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}
+}
+
+// isPowerEvent returns whether the event is one that changes who can do what
+// in the room: a power levels or join rules event, or a kick or a ban.
+func isPowerEvent(event *gomatrixserverlib.Event) bool {
+	switch event.Type() {
+	case gomatrixserverlib.MRoomPowerLevels, gomatrixserverlib.MRoomJoinRules:
+		return event.StateKeyEquals("")
+	case gomatrixserverlib.MRoomMember:
+		membership, err := event.Membership()
+		if err != nil {
+			return false
+		}
+		return (membership == "leave" || membership == "ban") && !event.StateKeyEquals(event.Sender())
+	}
+	return false
+}
+
+// addAuthChainInSet adds the event and the events in its auth chain which are
+// in the given set to the result.
+func (r *stateResolverV2) addAuthChainInSet(event *gomatrixserverlib.Event, set, result map[string]*gomatrixserverlib.Event) {
+	if _, ok := result[event.EventID()]; ok {
+		return
+	}
+	result[event.EventID()] = event
+	for _, authEventID := range event.AuthEventIDs() {
+		if authEvent, ok := set[authEventID]; ok {
+			r.addAuthChainInSet(authEvent, set, result)
+		}
+	}
+}
+
+// authEvent returns the event of the given type with an empty state key in
+// the auth events of the event, or nil if there isn't one.
+func (r *stateResolverV2) authEvent(event *gomatrixserverlib.Event, eventType string) *gomatrixserverlib.Event {
+	for _, authEventID := range event.AuthEventIDs() {
+		authEvent, ok := r.events[authEventID]
+		if ok && authEvent.Type() == eventType && authEvent.StateKeyEquals("") {
+			return authEvent
+		}
+	}
+	return nil
+}
+
+// senderPowerLevel returns the power level of the sender of the event given
+// by the power levels in its auth events. If there are no power levels then
+// the creator of the room has level 100 and everyone else has level 0.
+func (r *stateResolverV2) senderPowerLevel(event *gomatrixserverlib.Event) int64 {
+	if level, ok := r.powerLevels[event.EventID()]; ok {
+		return level
+	}
+	var level int64
+	if powerLevelsEvent := r.authEvent(event, gomatrixserverlib.MRoomPowerLevels); powerLevelsEvent != nil {
+		content := common.DefaultPowerLevelContent()
+		if err := json.Unmarshal(powerLevelsEvent.Content(), &content); err == nil {
+			level = int64(content.UserLevel(event.Sender()))
+		}
+	} else if createEvent := r.authEvent(event, gomatrixserverlib.MRoomCreate); createEvent != nil {
+		var content common.CreateContent
+		if err := json.Unmarshal(createEvent.Content(), &content); err == nil && content.Creator == event.Sender() {
+			level = 100
+		}
+	}
+	r.powerLevels[event.EventID()] = level
+	return level
+}
+
+// reverseTopologicalPowerOrdering sorts the events so that each event comes
+// after the events in its auth chain. Events which could go in either order
+// are sorted by descending power level of their senders, then by ascending
+// origin_server_ts, then by ascending event ID.
+func (r *stateResolverV2) reverseTopologicalPowerOrdering(events map[string]*gomatrixserverlib.Event) []*gomatrixserverlib.Event {
+	// Count the auth events of each event which haven't been sorted yet, and
+	// find the events which are authorised by each event.
+	waitingFor := map[string]int{}
+	authorises := map[string][]*gomatrixserverlib.Event{}
+	ready := powerOrderingHeap{resolver: r}
+	for eventID, event := range events {
+		for _, authEventID := range event.AuthEventIDs() {
+			if _, ok := events[authEventID]; ok {
+				waitingFor[eventID]++
+				authorises[authEventID] = append(authorises[authEventID], event)
+			}
+		}
+		if waitingFor[eventID] == 0 {
+			ready.events = append(ready.events, event)
+		}
+	}
+	heap.Init(&ready)
+
+	result := make([]*gomatrixserverlib.Event, 0, len(events))
+	for ready.Len() > 0 {
+		event := heap.Pop(&ready).(*gomatrixserverlib.Event)
+		result = append(result, event)
+		for _, next := range authorises[event.EventID()] {
+			waitingFor[next.EventID()]--
+			if waitingFor[next.EventID()] == 0 {
+				heap.Push(&ready, next)
+			}
+		}
+	}
+	return result
+}
+
+// A powerOrderingHeap is a heap of events whose auth events have already been
+// sorted, with the next event in the reverse topological power ordering first.
+type powerOrderingHeap struct {
+	resolver *stateResolverV2
+	events   []*gomatrixserverlib.Event
+}
+
+func (h *powerOrderingHeap) Len() int {
+	return len(h.events)
+}
+
+func (h *powerOrderingHeap) Less(i, j int) bool {
+	a, b := h.events[i], h.events[j]
+	if levelA, levelB := h.resolver.senderPowerLevel(a), h.resolver.senderPowerLevel(b); levelA != levelB {
+		return levelA > levelB
+	}
+	if a.OriginServerTS() != b.OriginServerTS() {
+		return a.OriginServerTS() < b.OriginServerTS()
+	}
+	return a.EventID() < b.EventID()
+}
+
+func (h *powerOrderingHeap) Swap(i, j int) {
+	h.events[i], h.events[j] = h.events[j], h.events[i]
+}
+
+func (h *powerOrderingHeap) Push(x interface{}) {
+	h.events = append(h.events, x.(*gomatrixserverlib.Event))
+}
+
+func (h *powerOrderingHeap) Pop() interface{} {
+	last := h.events[len(h.events)-1]
+	h.events = h.events[:len(h.events)-1]
+	return last
+}
+
+// mainlineOrdering sorts the events by the position of their closest power
+// levels event in the mainline of the resolved power levels event, which is
+// made of that event and the power levels events in its auth chain. Events
+// with the same position are sorted by ascending origin_server_ts, then by
+// ascending event ID.
+func (r *stateResolverV2) mainlineOrdering(events []*gomatrixserverlib.Event) []*gomatrixserverlib.Event {
+	// Walk the mainline back from the resolved power levels event. The oldest
+	// event in the mainline is at position 1, and events which aren't
+	// authorised by any event in the mainline are at position 0.
+	var mainline []string
+	for event := r.state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]; event != nil; event = r.authEvent(event, gomatrixserverlib.MRoomPowerLevels) {
+		mainline = append(mainline, event.EventID())
+	}
+	positions := map[string]int{}
+	for i, eventID := range mainline {
+		positions[eventID] = len(mainline) - i
+	}
+
+	eventPositions := map[string]int{}
+	for _, event := range events {
+		for closest := event; closest != nil; closest = r.authEvent(closest, gomatrixserverlib.MRoomPowerLevels) {
+			if position, ok := positions[closest.EventID()]; ok {
+				eventPositions[event.EventID()] = position
+				break
+			}
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if positionA, positionB := eventPositions[a.EventID()], eventPositions[b.EventID()]; positionA != positionB {
+			return positionA < positionB
+		}
+		if a.OriginServerTS() != b.OriginServerTS() {
+			return a.OriginServerTS() < b.OriginServerTS()
+		}
+		return a.EventID() < b.EventID()
+	})
+	return events
+}
+
+// iterativeAuthChecks applies each of the events in order to the partially
+// resolved state if it is allowed by its auth events, taking the ones which
+// have already been resolved from the state.
+func (r *stateResolverV2) iterativeAuthChecks(events []*gomatrixserverlib.Event) {
+	for _, event := range events {
+		authEvents := gomatrixserverlib.NewAuthEvents(nil)
+		for _, authEventID := range event.AuthEventIDs() {
+			if authEvent, ok := r.events[authEventID]; ok {
+				authEvents.AddEvent(authEvent) // nolint: errcheck
+			}
+		}
+		for _, tuple := range gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{*event}).Tuples() {
+			if resolved, ok := r.state[tuple]; ok {
+				authEvents.AddEvent(resolved) // nolint: errcheck
+			}
+		}
+		if gomatrixserverlib.Allowed(*event, &authEvents) == nil {
+			r.state[stateKeyTupleOf(event)] = event
+		}
+	}
+}
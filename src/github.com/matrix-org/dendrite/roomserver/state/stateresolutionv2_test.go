@@ -0,0 +1,373 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The test vectors below are the ones the Matrix specification uses for the
+// version 2 state resolution algorithm. Each test builds a DAG of events on
+// top of some initial events, working out the state at each event, and checks
+// the state at the "END" event.
+
+const (
+	stateResAlice   = "@alice:example.com"
+	stateResBob     = "@bob:example.com"
+	stateResCharlie = "@charlie:example.com"
+	stateResEvelyn  = "@evelyn:example.com"
+	stateResZara    = "@zara:example.com"
+	stateResRoomID  = "!test:example.com"
+	stateResJoin    = `{"membership":"join"}`
+	stateResBan     = `{"membership":"ban"}`
+)
+
+type stateResTestEvent struct {
+	id        string
+	sender    string
+	eventType string
+	stateKey  *string
+	content   string
+}
+
+func stateResStateKey(stateKey string) *string {
+	return &stateKey
+}
+
+func stateResEventID(id string) string {
+	return "$" + id + ":example.com"
+}
+
+var stateResInitialEvents = []stateResTestEvent{
+	{"CREATE", stateResAlice, gomatrixserverlib.MRoomCreate, stateResStateKey(""), `{"creator":"@alice:example.com"}`},
+	{"IMA", stateResAlice, gomatrixserverlib.MRoomMember, stateResStateKey(stateResAlice), stateResJoin},
+	{"IPOWER", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100}}`},
+	{"IJR", stateResAlice, gomatrixserverlib.MRoomJoinRules, stateResStateKey(""), `{"join_rule":"public"}`},
+	{"IMB", stateResBob, gomatrixserverlib.MRoomMember, stateResStateKey(stateResBob), stateResJoin},
+	{"IMC", stateResCharlie, gomatrixserverlib.MRoomMember, stateResStateKey(stateResCharlie), stateResJoin},
+	{"IMZ", stateResZara, gomatrixserverlib.MRoomMember, stateResStateKey(stateResZara), stateResJoin},
+	{"START", stateResZara, "m.room.message", nil, `{}`},
+	{"END", stateResZara, "m.room.message", nil, `{}`},
+}
+
+var stateResInitialEdges = []string{"START", "IMZ", "IMC", "IMB", "IJR", "IPOWER", "IMA", "CREATE"}
+
+// A stateResTestRoom builds the events of a test DAG and works out the state
+// at each of them.
+type stateResTestRoom struct {
+	t      *testing.T
+	events map[string]gomatrixserverlib.Event
+	states map[string]map[gomatrixserverlib.StateKeyTuple]string
+	ts     int64
+}
+
+func testStateResolutionV2(t *testing.T, events []stateResTestEvent, edges [][]string, wantIDs []string) {
+	testEvents := map[string]stateResTestEvent{}
+	prevs := map[string]map[string]bool{}
+	for _, event := range append(append([]stateResTestEvent{}, stateResInitialEvents...), events...) {
+		testEvents[event.id] = event
+		prevs[event.id] = map[string]bool{}
+	}
+	for _, chain := range append([][]string{stateResInitialEdges}, edges...) {
+		for i := 0; i+1 < len(chain); i++ {
+			prevs[chain[i]][chain[i+1]] = true
+		}
+	}
+
+	room := stateResTestRoom{
+		t:      t,
+		events: map[string]gomatrixserverlib.Event{},
+		states: map[string]map[gomatrixserverlib.StateKeyTuple]string{},
+	}
+	// Add the events in topological order, picking the first by ID when there
+	// is a choice.
+	for len(room.states) < len(testEvents) {
+		var ready []string
+		for id, prevIDs := range prevs {
+			if _, ok := room.states[id]; ok {
+				continue
+			}
+			allAdded := true
+			for prevID := range prevIDs {
+				if _, ok := room.states[prevID]; !ok {
+					allAdded = false
+				}
+			}
+			if allAdded {
+				ready = append(ready, id)
+			}
+		}
+		if len(ready) == 0 {
+			t.Fatal("the test DAG has a cycle")
+		}
+		sort.Strings(ready)
+		room.addEvent(testEvents[ready[0]], prevs[ready[0]])
+	}
+
+	want := map[gomatrixserverlib.StateKeyTuple]string{}
+	for tuple, eventID := range room.states["START"] {
+		want[tuple] = eventID
+	}
+	for _, id := range wantIDs {
+		event := testEvents[id]
+		want[gomatrixserverlib.StateKeyTuple{EventType: event.eventType, StateKey: *event.stateKey}] = stateResEventID(id)
+	}
+	got := room.states["END"]
+	if len(got) != len(want) {
+		t.Fatalf("wanted state %v, got %v", want, got)
+	}
+	for tuple, eventID := range want {
+		if got[tuple] != eventID {
+			t.Fatalf("wanted state %v, got %v", want, got)
+		}
+	}
+}
+
+func (r *stateResTestRoom) addEvent(testEvent stateResTestEvent, prevs map[string]bool) {
+	var prevIDs []string
+	for prevID := range prevs {
+		prevIDs = append(prevIDs, prevID)
+	}
+	sort.Strings(prevIDs)
+
+	var stateBefore map[gomatrixserverlib.StateKeyTuple]string
+	switch len(prevIDs) {
+	case 0:
+		stateBefore = map[gomatrixserverlib.StateKeyTuple]string{}
+	case 1:
+		stateBefore = r.states[prevIDs[0]]
+	default:
+		var stateSets []map[gomatrixserverlib.StateKeyTuple]string
+		for _, prevID := range prevIDs {
+			stateSets = append(stateSets, r.states[prevID])
+		}
+		stateBefore = r.resolve(stateSets)
+	}
+
+	fields := map[string]interface{}{
+		"event_id":         stateResEventID(testEvent.id),
+		"room_id":          stateResRoomID,
+		"sender":           testEvent.sender,
+		"type":             testEvent.eventType,
+		"content":          json.RawMessage(testEvent.content),
+		"origin_server_ts": r.ts,
+		"depth":            0,
+		"auth_events":      []interface{}{},
+		"prev_events":      []interface{}{},
+	}
+	r.ts++
+	if testEvent.stateKey != nil {
+		fields["state_key"] = *testEvent.stateKey
+	}
+	// Work out which auth events the event needs from the state before it.
+	event := r.newEvent(fields)
+	var authEvents []interface{}
+	for _, tuple := range gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.Event{event}).Tuples() {
+		if eventID, ok := stateBefore[tuple]; ok {
+			authEvents = append(authEvents, []interface{}{eventID, map[string]string{}})
+		}
+	}
+	fields["auth_events"] = authEvents
+	var prevEvents []interface{}
+	for _, prevID := range prevIDs {
+		prevEvents = append(prevEvents, []interface{}{stateResEventID(prevID), map[string]string{}})
+	}
+	fields["prev_events"] = prevEvents
+	event = r.newEvent(fields)
+	r.events[event.EventID()] = event
+
+	stateAfter := map[gomatrixserverlib.StateKeyTuple]string{}
+	for tuple, eventID := range stateBefore {
+		stateAfter[tuple] = eventID
+	}
+	if testEvent.stateKey != nil {
+		stateAfter[gomatrixserverlib.StateKeyTuple{EventType: testEvent.eventType, StateKey: *testEvent.stateKey}] = event.EventID()
+	}
+	r.states[testEvent.id] = stateAfter
+}
+
+func (r *stateResTestRoom) newEvent(fields map[string]interface{}) gomatrixserverlib.Event {
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return event
+}
+
+// authChain returns the IDs of the events and of the events in their auth chains.
+func (r *stateResTestRoom) authChain(eventIDs []string) map[string]bool {
+	chain := map[string]bool{}
+	for len(eventIDs) > 0 {
+		eventID := eventIDs[len(eventIDs)-1]
+		eventIDs = eventIDs[:len(eventIDs)-1]
+		if !chain[eventID] {
+			chain[eventID] = true
+			eventIDs = append(eventIDs, r.events[eventID].AuthEventIDs()...)
+		}
+	}
+	return chain
+}
+
+func (r *stateResTestRoom) resolve(stateSets []map[gomatrixserverlib.StateKeyTuple]string) map[gomatrixserverlib.StateKeyTuple]string {
+	// Split the state between the state keys with the same event in every
+	// state set and the conflicted ones.
+	var conflicted, unconflicted []gomatrixserverlib.Event
+	tuples := map[gomatrixserverlib.StateKeyTuple]bool{}
+	for _, stateSet := range stateSets {
+		for tuple := range stateSet {
+			tuples[tuple] = true
+		}
+	}
+	for tuple := range tuples {
+		eventIDs := map[string]bool{}
+		inAll := true
+		for _, stateSet := range stateSets {
+			if eventID, ok := stateSet[tuple]; ok {
+				eventIDs[eventID] = true
+			} else {
+				inAll = false
+			}
+		}
+		for eventID := range eventIDs {
+			if inAll && len(eventIDs) == 1 {
+				unconflicted = append(unconflicted, r.events[eventID])
+			} else {
+				conflicted = append(conflicted, r.events[eventID])
+			}
+		}
+	}
+
+	var authEvents, authDifference []gomatrixserverlib.Event
+	chainCounts := map[string]int{}
+	for _, stateSet := range stateSets {
+		var eventIDs []string
+		for _, eventID := range stateSet {
+			eventIDs = append(eventIDs, eventID)
+		}
+		for eventID := range r.authChain(eventIDs) {
+			chainCounts[eventID]++
+		}
+	}
+	for eventID, count := range chainCounts {
+		authEvents = append(authEvents, r.events[eventID])
+		if count < len(stateSets) {
+			authDifference = append(authDifference, r.events[eventID])
+		}
+	}
+
+	result := map[gomatrixserverlib.StateKeyTuple]string{}
+	for _, event := range resolveStateConflictsV2(conflicted, unconflicted, authEvents, authDifference) {
+		result[gomatrixserverlib.StateKeyTuple{EventType: event.Type(), StateKey: *event.StateKey()}] = event.EventID()
+	}
+	return result
+}
+
+func TestStateResolutionV2BanVsPowerLevels(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"PA", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"MA", stateResAlice, gomatrixserverlib.MRoomMember, stateResStateKey(stateResAlice), stateResJoin},
+		{"MB", stateResAlice, gomatrixserverlib.MRoomMember, stateResStateKey(stateResBob), stateResBan},
+		{"PB", stateResBob, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+	}, [][]string{
+		{"END", "MB", "MA", "PA", "START"},
+		{"END", "PB", "PA"},
+	}, []string{"PA", "MA", "MB"})
+}
+
+func TestStateResolutionV2JoinRuleEvasion(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"JR", stateResAlice, gomatrixserverlib.MRoomJoinRules, stateResStateKey(""), `{"join_rule":"private"}`},
+		{"ME", stateResEvelyn, gomatrixserverlib.MRoomMember, stateResStateKey(stateResEvelyn), stateResJoin},
+	}, [][]string{
+		{"END", "JR", "START"},
+		{"END", "ME", "START"},
+	}, []string{"JR"})
+}
+
+func TestStateResolutionV2OffTopicPowerLevels(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"PA", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"PB", stateResBob, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50,"@charlie:example.com":50}}`},
+		{"PC", stateResCharlie, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50,"@charlie:example.com":0}}`},
+	}, [][]string{
+		{"END", "PC", "PB", "PA", "START"},
+		{"END", "PA"},
+	}, []string{"PC"})
+}
+
+func TestStateResolutionV2TopicBasic(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":0}}`},
+		{"PB", stateResBob, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "T3", "PB", "PA1"},
+	}, []string{"PA2", "T2"})
+}
+
+func TestStateResolutionV2TopicReset(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T2", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"MB", stateResAlice, gomatrixserverlib.MRoomMember, stateResStateKey(stateResBob), stateResBan},
+	}, [][]string{
+		{"END", "MB", "T2", "PA", "T1", "START"},
+		{"END", "T1"},
+	}, []string{"T1", "MB", "PA"})
+}
+
+func TestStateResolutionV2Topic(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":0}}`},
+		{"PB", stateResBob, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"MZ1", stateResZara, "m.room.message", nil, `{}`},
+		{"T4", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "T4", "MZ1", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "MZ1", "T3", "PB", "PA1"},
+	}, []string{"T4", "PA2"})
+}
+
+func TestStateResolutionV2MainlineSort(t *testing.T) {
+	testStateResolutionV2(t, []stateResTestEvent{
+		{"T1", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA1", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T2", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+		{"PA2", stateResAlice, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50},"events":{"m.room.power_levels":100}}`},
+		{"PB", stateResBob, gomatrixserverlib.MRoomPowerLevels, stateResStateKey(""), `{"users":{"@alice:example.com":100,"@bob:example.com":50}}`},
+		{"T3", stateResBob, "m.room.topic", stateResStateKey(""), `{}`},
+		{"T4", stateResAlice, "m.room.topic", stateResStateKey(""), `{}`},
+	}, [][]string{
+		{"END", "T3", "PA2", "T2", "PA1", "T1", "START"},
+		{"END", "T4", "PB", "PA1"},
+	}, []string{"T3", "PA2"})
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventAnnotationsSchema = `
+-- Stores the number of annotations of events with each key, i.e. of the
+-- m.reaction events related to them by m.annotation relations.
+CREATE TABLE IF NOT EXISTS roomserver_event_annotations (
+    -- The ID of the room of the annotated event.
+    room_id TEXT NOT NULL,
+    -- The ID of the annotated event, which we may not have.
+    relates_to_id TEXT NOT NULL,
+    -- The type of the relation, i.e. "m.annotation".
+    rel_type TEXT NOT NULL,
+    -- The key of the annotations, e.g. the emoji of a reaction.
+    key TEXT NOT NULL,
+    -- The number of annotations of the event with the key.
+    count BIGINT NOT NULL,
+    PRIMARY KEY (room_id, relates_to_id, rel_type, key)
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_event_annotations_relates_to_idx
+    ON roomserver_event_annotations(relates_to_id);
+`
+
+const incrementAnnotationCountSQL = "" +
+	"INSERT INTO roomserver_event_annotations (room_id, relates_to_id, rel_type, key, count)" +
+	" VALUES ($1, $2, $3, $4, 1)" +
+	" ON CONFLICT (room_id, relates_to_id, rel_type, key) DO UPDATE" +
+	" SET count = roomserver_event_annotations.count + 1"
+
+const decrementAnnotationCountSQL = "" +
+	"UPDATE roomserver_event_annotations SET count = count - 1" +
+	" WHERE room_id = $1 AND relates_to_id = $2 AND rel_type = $3 AND key = $4 AND count > 0"
+
+type eventAnnotationsStatements struct {
+	incrementAnnotationCountStmt *sql.Stmt
+	decrementAnnotationCountStmt *sql.Stmt
+	selectAnnotationsStmt        *sql.Stmt
+}
+
+func (s *eventAnnotationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventAnnotationsSchema)
+	if err != nil {
+		return
+	}
+	return statementList{
+		{&s.incrementAnnotationCountStmt, incrementAnnotationCountSQL},
+		{&s.decrementAnnotationCountStmt, decrementAnnotationCountSQL},
+		{&s.selectAnnotationsStmt, selectAnnotationsSQL},
+	}.prepare(db)
+}
+
+func (s *eventAnnotationsStatements) incrementAnnotationCount(
+	ctx context.Context, txn *sql.Tx, roomID, relatesToID, relType, key string,
+) error {
+	_, err := common.TxStmt(txn, s.incrementAnnotationCountStmt).ExecContext(
+		ctx, roomID, relatesToID, relType, key,
+	)
+	return err
+}
+
+func (s *eventAnnotationsStatements) decrementAnnotationCount(
+	ctx context.Context, txn *sql.Tx, roomID, relatesToID, relType, key string,
+) error {
+	_, err := common.TxStmt(txn, s.decrementAnnotationCountStmt).ExecContext(
+		ctx, roomID, relatesToID, relType, key,
+	)
+	return err
+}
+
+// selectAnnotations returns the annotations of the given events, from the
+// most to the least used key.
+func (s *eventAnnotationsStatements) selectAnnotations(
+	ctx context.Context, relatesToIDs []string,
+) ([]types.Annotation, error) {
+	rows, err := s.selectAnnotationsStmt.QueryContext(ctx, common.StringArray(relatesToIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.Annotation
+	for rows.Next() {
+		var result types.Annotation
+		if err = rows.Scan(&result.RelatesToID, &result.RelType, &result.Key, &result.Count); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -15,8 +15,10 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
@@ -41,17 +43,19 @@ const insertEventJSONSQL = "" +
 	"INSERT INTO roomserver_event_json (event_nid, event_json) VALUES ($1, $2)" +
 	" ON CONFLICT DO NOTHING"
 
-// Bulk event JSON lookup by numeric event ID.
-// Sort by the numeric event ID.
-// This means that we can use binary search to lookup by numeric event ID.
-const bulkSelectEventJSONSQL = "" +
-	"SELECT event_nid, event_json FROM roomserver_event_json" +
-	" WHERE event_nid = ANY($1)" +
-	" ORDER BY event_nid ASC"
+const selectEventJSONSQL = "" +
+	"SELECT event_json FROM roomserver_event_json WHERE event_nid = $1"
+
+const updateEventJSONSQL = "" +
+	"UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = $2"
 
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt         *sql.Stmt
+	selectEventJSONStmt         *sql.Stmt
+	updateEventJSONStmt         *sql.Stmt
+	bulkSelectEventJSONStmt     *sql.Stmt
+	bulkSelectEventJSONByIDStmt *sql.Stmt
+	bulkDeleteEventJSONStmt     *sql.Stmt
 }
 
 func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
@@ -61,12 +65,37 @@ func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
 	}
 	return statementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.selectEventJSONStmt, selectEventJSONSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.bulkSelectEventJSONByIDStmt, bulkSelectEventJSONByIDSQL},
+		{&s.bulkDeleteEventJSONStmt, bulkDeleteEventJSONSQL},
 	}.prepare(db)
 }
 
-func (s *eventJSONStatements) insertEventJSON(eventNID types.EventNID, eventJSON []byte) error {
-	_, err := s.insertEventJSONStmt.Exec(int64(eventNID), eventJSON)
+func (s *eventJSONStatements) insertEventJSON(ctx context.Context, eventNID types.EventNID, eventJSON []byte) error {
+	_, err := s.insertEventJSONStmt.ExecContext(ctx, int64(eventNID), eventJSON)
+	return err
+}
+
+func (s *eventJSONStatements) selectEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (eventJSON []byte, err error) {
+	err = common.TxStmt(txn, s.selectEventJSONStmt).QueryRowContext(ctx, int64(eventNID)).Scan(&eventJSON)
+	return
+}
+
+func (s *eventJSONStatements) updateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	_, err := common.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, eventJSON, int64(eventNID))
+	return err
+}
+
+func (s *eventJSONStatements) bulkDeleteEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := common.TxStmt(txn, s.bulkDeleteEventJSONStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
 	return err
 }
 
@@ -75,18 +104,32 @@ type eventJSONPair struct {
 	EventJSON []byte
 }
 
-func (s *eventJSONStatements) bulkSelectEventJSON(eventNIDs []types.EventNID) ([]eventJSONPair, error) {
-	rows, err := s.bulkSelectEventJSONStmt.Query(eventNIDsAsArray(eventNIDs))
+func (s *eventJSONStatements) bulkSelectEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]eventJSONPair, error) {
+	rows, err := common.TxStmt(txn, s.bulkSelectEventJSONStmt).QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	return scanEventJSONPairs(rows, len(eventNIDs))
+}
+
+func (s *eventJSONStatements) bulkSelectEventJSONByID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]eventJSONPair, error) {
+	rows, err := common.TxStmt(txn, s.bulkSelectEventJSONByIDStmt).QueryContext(ctx, common.StringArray(eventIDs))
 	if err != nil {
 		return nil, err
 	}
+	return scanEventJSONPairs(rows, len(eventIDs))
+}
+
+// scanEventJSONPairs reads the rows of a bulk event JSON lookup for at most
+// maxResults events and closes them.
+func scanEventJSONPairs(rows *sql.Rows, maxResults int) ([]eventJSONPair, error) {
 	defer rows.Close()
 
-	// We know that we will only get as many results as event NIDs
-	// because of the unique constraint on event NIDs.
+	// We know that we will only get as many results as event IDs
+	// because of the unique constraint on event IDs.
 	// So we can allocate an array of the correct size now.
-	// We might get fewer results than NIDs so we adjust the length of the slice before returning it.
-	results := make([]eventJSONPair, len(eventNIDs))
+	// We might get fewer results than IDs so we adjust the length of the slice before returning it.
+	results := make([]eventJSONPair, maxResults)
 	i := 0
 	for ; rows.Next(); i++ {
 		result := &results[i]
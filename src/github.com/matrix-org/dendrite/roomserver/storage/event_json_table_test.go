@@ -0,0 +1,160 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// benchmarkDatabaseEnv names the environment variable holding the data source
+// name of a postgres database to run the benchmarks against, e.g.
+// "dbname=roomserver_bench sslmode=disable". The benchmarks store events in
+// it, so it shouldn't be a database in use.
+const benchmarkDatabaseEnv = "ROOMSERVER_BENCH_DATABASE"
+
+// BenchmarkEventsFromIDs compares fetching events by ID with a single query
+// joining the events table, as EventsFromIDs does, with looking up their
+// numeric IDs and then their JSON in two round trips.
+func BenchmarkEventsFromIDs(b *testing.B) {
+	dataSourceName := os.Getenv(benchmarkDatabaseEnv)
+	if dataSourceName == "" {
+		b.Skipf("%s isn't set", benchmarkDatabaseEnv)
+	}
+	ctx := context.Background()
+	db, err := Open(dataSourceName)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+
+	eventIDs := storeBenchmarkEvents(b, db, 100)
+
+	b.Run("join", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			events, err := db.EventsFromIDs(ctx, eventIDs)
+			if err != nil {
+				b.Fatalf("EventsFromIDs: %v", err)
+			}
+			if len(events) != len(eventIDs) {
+				b.Fatalf("EventsFromIDs: got %d events, want %d", len(events), len(eventIDs))
+			}
+		}
+	})
+
+	b.Run("two_queries", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			nids, err := db.EventNIDs(ctx, eventIDs)
+			if err != nil {
+				b.Fatalf("EventNIDs: %v", err)
+			}
+			eventNIDs := make([]types.EventNID, 0, len(nids))
+			for _, nid := range nids {
+				eventNIDs = append(eventNIDs, nid)
+			}
+			events, err := db.Events(ctx, eventNIDs)
+			if err != nil {
+				b.Fatalf("Events: %v", err)
+			}
+			if len(events) != len(eventIDs) {
+				b.Fatalf("Events: got %d events, want %d", len(events), len(eventIDs))
+			}
+		}
+	})
+}
+
+// referenceEventCount is the number of events in the reference set that
+// BenchmarkReferenceEvents stores and queries.
+const referenceEventCount = 10000
+
+// BenchmarkReferenceEvents stores a reference set of 10k events and then
+// fetches each of them by ID, logging the 99th percentile latency of both.
+func BenchmarkReferenceEvents(b *testing.B) {
+	dataSourceName := os.Getenv(benchmarkDatabaseEnv)
+	if dataSourceName == "" {
+		b.Skipf("%s isn't set", benchmarkDatabaseEnv)
+	}
+	ctx := context.Background()
+	db, err := Open(dataSourceName)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		eventIDs := storeBenchmarkEvents(b, db, referenceEventCount)
+		b.Logf("stored %d events in %v", len(eventIDs), time.Since(start))
+
+		latencies := make([]time.Duration, len(eventIDs))
+		for j, eventID := range eventIDs {
+			start = time.Now()
+			events, err := db.EventsFromIDs(ctx, []string{eventID})
+			if err != nil {
+				b.Fatalf("EventsFromIDs: %v", err)
+			}
+			if len(events) != 1 {
+				b.Fatalf("EventsFromIDs: got %d events, want 1", len(events))
+			}
+			latencies[j] = time.Since(start)
+		}
+		b.Logf("EventsFromIDs p99 latency: %v", percentile(latencies, 99))
+	}
+}
+
+// percentile returns the pth percentile of the durations, sorting them.
+func percentile(durations []time.Duration, p int) time.Duration {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[(len(durations)-1)*p/100]
+}
+
+// storeBenchmarkEvents stores count messages in a new room and returns their
+// IDs.
+func storeBenchmarkEvents(b *testing.B, db *Database, count int) []string {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	run := time.Now().UnixNano()
+	roomID := fmt.Sprintf("!bench%d:localhost", run)
+	eventIDs := make([]string, count)
+	for i := range eventIDs {
+		builder := gomatrixserverlib.EventBuilder{
+			Sender: "@alice:localhost",
+			RoomID: roomID,
+			Type:   "m.room.message",
+			Depth:  int64(i + 1),
+		}
+		if err = builder.SetContent(map[string]string{"msgtype": "m.text", "body": "hello"}); err != nil {
+			b.Fatal(err)
+		}
+		eventIDs[i] = fmt.Sprintf("$bench%d_%d:localhost", run, i)
+		event, err := builder.Build(eventIDs[i], time.Now(), "localhost", "ed25519:bench", privateKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err = db.StoreEvent(context.Background(), event, nil); err != nil {
+			b.Fatalf("StoreEvent: %v", err)
+		}
+	}
+	return eventIDs
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventRelationsSchema = `
+-- Stores the relations of events to other events, given by the m.relates_to
+-- of their content, e.g. edits.
+CREATE TABLE IF NOT EXISTS roomserver_event_relations (
+    -- The numeric ID of the event which relates to another one.
+    event_nid BIGINT NOT NULL PRIMARY KEY,
+    -- The ID of the event it relates to, which we may not have.
+    relates_to_id TEXT NOT NULL,
+    -- The type of the relation, e.g. "m.replace".
+    rel_type TEXT NOT NULL,
+    -- The user ID of the sender of the event.
+    sender TEXT NOT NULL,
+    -- The origin_server_ts of the event.
+    origin_server_ts BIGINT NOT NULL,
+    -- The key of the annotation for m.annotation relations, e.g. the emoji
+    -- of a reaction, and the empty string for other relations.
+    annotation_key TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_event_relations_relates_to_idx
+    ON roomserver_event_relations(relates_to_id, rel_type);
+-- Users can only annotate an event once with each key.
+CREATE UNIQUE INDEX IF NOT EXISTS roomserver_event_relations_annotation_idx
+    ON roomserver_event_relations(relates_to_id, sender, annotation_key)
+    WHERE rel_type = 'm.annotation';
+`
+
+const insertEventRelationSQL = "" +
+	"INSERT INTO roomserver_event_relations" +
+	" (event_nid, relates_to_id, rel_type, sender, origin_server_ts, annotation_key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT DO NOTHING"
+
+// Looks up the relations from the newest to the oldest, before the given
+// numeric event ID unless it is 0.
+const selectEventRelationsBeforeSQL = "" +
+	"SELECT event_nid, relates_to_id, sender FROM roomserver_event_relations" +
+	" WHERE relates_to_id = $1 AND rel_type = $2 AND ($3 = 0 OR event_nid < $3)" +
+	" ORDER BY event_nid DESC LIMIT $4"
+
+const deleteEventRelationSQL = "" +
+	"DELETE FROM roomserver_event_relations WHERE event_nid = $1" +
+	" RETURNING relates_to_id, rel_type, annotation_key"
+
+type eventRelationsStatements struct {
+	insertEventRelationStmt            *sql.Stmt
+	selectEventRelationsStmt           *sql.Stmt
+	selectEventRelationsBeforeStmt     *sql.Stmt
+	selectRelatedEventIDsForSenderStmt *sql.Stmt
+	deleteEventRelationStmt            *sql.Stmt
+	bulkDeleteEventRelationsStmt       *sql.Stmt
+}
+
+func (s *eventRelationsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventRelationsSchema)
+	if err != nil {
+		return
+	}
+	if eventRelationsMigrations != "" {
+		if _, err = db.Exec(eventRelationsMigrations); err != nil {
+			return
+		}
+	}
+	return statementList{
+		{&s.insertEventRelationStmt, insertEventRelationSQL},
+		{&s.selectEventRelationsStmt, selectEventRelationsSQL},
+		{&s.selectEventRelationsBeforeStmt, selectEventRelationsBeforeSQL},
+		{&s.selectRelatedEventIDsForSenderStmt, selectRelatedEventIDsForSenderSQL},
+		{&s.deleteEventRelationStmt, deleteEventRelationSQL},
+		{&s.bulkDeleteEventRelationsStmt, bulkDeleteEventRelationsSQL},
+	}.prepare(db)
+}
+
+// insertEventRelation stores the relation of an event and returns whether it
+// wasn't already stored, and for annotations whether the sender hadn't already
+// annotated the event with the same key.
+func (s *eventRelationsStatements) insertEventRelation(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+	relatesToID, relType, sender string, originServerTS int64, annotationKey string,
+) (bool, error) {
+	res, err := common.TxStmt(txn, s.insertEventRelationStmt).ExecContext(
+		ctx, int64(eventNID), relatesToID, relType, sender, originServerTS, annotationKey,
+	)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// selectEventRelations returns the relations of the given type to the given
+// events, from the oldest to the newest.
+func (s *eventRelationsStatements) selectEventRelations(
+	ctx context.Context, relatesToIDs []string, relType string,
+) ([]types.EventRelation, error) {
+	rows, err := s.selectEventRelationsStmt.QueryContext(ctx, common.StringArray(relatesToIDs), relType)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToEventRelations(rows)
+}
+
+func rowsToEventRelations(rows *sql.Rows) ([]types.EventRelation, error) {
+	defer rows.Close()
+	var results []types.EventRelation
+	for rows.Next() {
+		var (
+			result   types.EventRelation
+			eventNID int64
+		)
+		if err := rows.Scan(&eventNID, &result.RelatesToID, &result.Sender); err != nil {
+			return nil, err
+		}
+		result.EventNID = types.EventNID(eventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// selectEventRelationsBefore returns at most limit relations of the given
+// type to an event, from the newest to the oldest, before the given numeric
+// event ID unless it is 0.
+func (s *eventRelationsStatements) selectEventRelationsBefore(
+	ctx context.Context, relatesToID, relType string, before types.EventNID, limit int,
+) ([]types.EventRelation, error) {
+	rows, err := s.selectEventRelationsBeforeStmt.QueryContext(ctx, relatesToID, relType, int64(before), limit)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToEventRelations(rows)
+}
+
+// selectRelatedEventIDsForSender returns the IDs of the events among the given
+// ones which the sender sent an event relating to with the given type.
+func (s *eventRelationsStatements) selectRelatedEventIDsForSender(
+	ctx context.Context, relatesToIDs []string, relType, sender string,
+) ([]string, error) {
+	rows, err := s.selectRelatedEventIDsForSenderStmt.QueryContext(
+		ctx, common.StringArray(relatesToIDs), relType, sender,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var eventIDs []string
+	for rows.Next() {
+		var eventID string
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+// deleteEventRelation deletes the relation of an event and returns the ID of
+// the event it related to, the type of the relation and its annotation key.
+// Returns sql.ErrNoRows if the event didn't relate to another one.
+func (s *eventRelationsStatements) deleteEventRelation(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (relatesToID, relType, annotationKey string, err error) {
+	err = common.TxStmt(txn, s.deleteEventRelationStmt).QueryRowContext(
+		ctx, int64(eventNID),
+	).Scan(&relatesToID, &relType, &annotationKey)
+	return
+}
+
+func (s *eventRelationsStatements) bulkDeleteEventRelations(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) error {
+	_, err := common.TxStmt(txn, s.bulkDeleteEventRelationsStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
+	return err
+}
@@ -15,79 +15,27 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
-	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
-const eventsSchema = `
--- The events table holds metadata for each event, the actual JSON is stored
--- separately to keep the size of the rows small.
-CREATE SEQUENCE IF NOT EXISTS roomserver_event_nid_seq;
-CREATE TABLE IF NOT EXISTS roomserver_events (
-    -- Local numeric ID for the event.
-    event_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_event_nid_seq'),
-    -- Local numeric ID for the room the event is in.
-    -- This is never 0.
-    room_nid BIGINT NOT NULL,
-    -- Local numeric ID for the type of the event.
-    -- This is never 0.
-    event_type_nid BIGINT NOT NULL,
-    -- Local numeric ID for the state_key of the event
-    -- This is 0 if the event is not a state event.
-    event_state_key_nid BIGINT NOT NULL,
-    -- Whether the event has been written to the output log.
-    sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
-    -- Local numeric ID for the state at the event.
-    -- This is 0 if we don't know the state at the event.
-    -- If the state is not 0 then this event is part of the contiguous
-    -- part of the event graph
-    -- Since many different events can have the same state we store the
-    -- state into a separate state table and refer to it by numeric ID.
-    state_snapshot_nid BIGINT NOT NULL DEFAULT 0,
-    -- Depth of the event in the event graph.
-    depth BIGINT NOT NULL,
-    -- The textual event id.
-    -- Used to lookup the numeric ID when processing requests.
-    -- Needed for state resolution.
-    -- An event may only appear in this table once.
-    event_id TEXT NOT NULL CONSTRAINT roomserver_event_id_unique UNIQUE,
-    -- The sha256 reference hash for the event.
-    -- Needed for setting reference hashes when sending new events.
-    reference_sha256 BYTEA NOT NULL,
-    -- A list of numeric IDs for events that can authenticate this event.
-    auth_event_nids BIGINT[] NOT NULL
-);
-`
-
 const insertEventSQL = "" +
 	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth)" +
 	" VALUES ($1, $2, $3, $4, $5, $6, $7)" +
-	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
+	" ON CONFLICT (event_id)" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
 
 const selectEventSQL = "" +
 	"SELECT event_nid, state_snapshot_nid FROM roomserver_events WHERE event_id = $1"
 
-// Bulk lookup of events by string ID.
-// Sort by the numeric IDs for event type and state key.
-// This means we can use binary search to lookup entries by type and state key.
-const bulkSelectStateEventByIDSQL = "" +
-	"SELECT event_type_nid, event_state_key_nid, event_nid FROM roomserver_events" +
-	" WHERE event_id = ANY($1)" +
-	" ORDER BY event_type_nid, event_state_key_nid ASC"
-
-const bulkSelectStateAtEventByIDSQL = "" +
-	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid FROM roomserver_events" +
-	" WHERE event_id = ANY($1)"
-
 const updateEventStateSQL = "" +
-	"UPDATE roomserver_events SET state_snapshot_nid = $2 WHERE event_nid = $1"
+	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE event_nid = $2"
 
 const selectEventSentToOutputSQL = "" +
 	"SELECT sent_to_output FROM roomserver_events WHERE event_nid = $1"
@@ -95,24 +43,32 @@ const selectEventSentToOutputSQL = "" +
 const updateEventSentToOutputSQL = "" +
 	"UPDATE roomserver_events SET sent_to_output = TRUE WHERE event_nid = $1"
 
-const selectEventIDSQL = "" +
-	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
+const updateEventSoftFailedSQL = "" +
+	"UPDATE roomserver_events SET soft_failed = TRUE WHERE event_nid = $1"
 
-const bulkSelectStateAtEventAndReferenceSQL = "" +
-	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, event_id, reference_sha256" +
-	" FROM roomserver_events WHERE event_nid = ANY($1)"
+const updateEventRedactedSQL = "" +
+	"UPDATE roomserver_events SET redacted = TRUE WHERE event_nid = $1"
 
-const bulkSelectEventReferenceSQL = "" +
-	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_nid = ANY($1)"
+const selectEventNIDAndRoomNIDSQL = "" +
+	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_id = $1"
 
-const bulkSelectEventIDSQL = "" +
-	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid = ANY($1)"
+const selectEventIDSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE event_nid = $1"
 
-const bulkSelectEventNIDSQL = "" +
-	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id = ANY($1)"
+// Look up the events of a room which have been written to the output log or
+// soft failed, i.e. which aren't outliers, in a range of numeric IDs.
+const selectEventsInRangeSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND (sent_to_output = TRUE OR soft_failed = TRUE) AND event_nid > $2 AND event_nid < $3" +
+	" ORDER BY event_nid ASC LIMIT $4"
 
-const selectMaxEventDepthSQL = "" +
-	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
+const selectEventsInRangeBackwardsSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND (sent_to_output = TRUE OR soft_failed = TRUE) AND event_nid < $2 AND event_nid > $3" +
+	" ORDER BY event_nid DESC LIMIT $4"
+
+const selectEventDepthSQL = "" +
+	"SELECT depth FROM roomserver_events WHERE event_nid = $1"
 
 type eventStatements struct {
 	insertEventStmt                        *sql.Stmt
@@ -122,12 +78,21 @@ type eventStatements struct {
 	updateEventStateStmt                   *sql.Stmt
 	selectEventSentToOutputStmt            *sql.Stmt
 	updateEventSentToOutputStmt            *sql.Stmt
+	updateEventSoftFailedStmt              *sql.Stmt
 	selectEventIDStmt                      *sql.Stmt
 	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
 	bulkSelectEventReferenceStmt           *sql.Stmt
 	bulkSelectEventIDStmt                  *sql.Stmt
 	bulkSelectEventNIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                *sql.Stmt
+	selectEventsInRangeStmt                *sql.Stmt
+	selectEventsInRangeBackwardsStmt       *sql.Stmt
+	updateEventRedactedStmt                *sql.Stmt
+	selectEventNIDAndRoomNIDStmt           *sql.Stmt
+	selectEventDepthStmt                   *sql.Stmt
+	selectEventsToPurgeStmt                *sql.Stmt
+	selectEventsToExpireStmt               *sql.Stmt
+	bulkDeleteEventsStmt                   *sql.Stmt
 }
 
 func (s *eventStatements) prepare(db *sql.DB) (err error) {
@@ -135,6 +100,11 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 	if err != nil {
 		return
 	}
+	if eventsMigrations != "" {
+		if _, err = db.Exec(eventsMigrations); err != nil {
+			return
+		}
+	}
 
 	return statementList{
 		{&s.insertEventStmt, insertEventSQL},
@@ -144,16 +114,26 @@ func (s *eventStatements) prepare(db *sql.DB) (err error) {
 		{&s.updateEventStateStmt, updateEventStateSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
+		{&s.updateEventSoftFailedStmt, updateEventSoftFailedSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
 		{&s.bulkSelectStateAtEventAndReferenceStmt, bulkSelectStateAtEventAndReferenceSQL},
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
+		{&s.selectEventsInRangeStmt, selectEventsInRangeSQL},
+		{&s.selectEventsInRangeBackwardsStmt, selectEventsInRangeBackwardsSQL},
+		{&s.updateEventRedactedStmt, updateEventRedactedSQL},
+		{&s.selectEventNIDAndRoomNIDStmt, selectEventNIDAndRoomNIDSQL},
+		{&s.selectEventDepthStmt, selectEventDepthSQL},
+		{&s.selectEventsToPurgeStmt, selectEventsToPurgeSQL},
+		{&s.selectEventsToExpireStmt, selectEventsToExpireSQL},
+		{&s.bulkDeleteEventsStmt, bulkDeleteEventsSQL},
 	}.prepare(db)
 }
 
 func (s *eventStatements) insertEvent(
+	ctx context.Context,
 	roomNID types.RoomNID, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID,
 	eventID string,
 	referenceSHA256 []byte,
@@ -162,24 +142,24 @@ func (s *eventStatements) insertEvent(
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
-	err := s.insertEventStmt.QueryRow(
-		int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID), eventID, referenceSHA256,
+	err := s.insertEventStmt.QueryRowContext(
+		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID), eventID, referenceSHA256,
 		eventNIDsAsArray(authEventNIDs), depth,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
 
-func (s *eventStatements) selectEvent(eventID string) (types.EventNID, types.StateSnapshotNID, error) {
+func (s *eventStatements) selectEvent(ctx context.Context, eventID string) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
-	err := s.selectEventStmt.QueryRow(eventID).Scan(&eventNID, &stateNID)
+	err := s.selectEventStmt.QueryRowContext(ctx, eventID).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
 
 // bulkSelectStateEventByID lookups a list of state events by event ID.
 // If any of the requested events are missing from the database it returns a types.MissingEventError
-func (s *eventStatements) bulkSelectStateEventByID(eventIDs []string) ([]types.StateEntry, error) {
-	rows, err := s.bulkSelectStateEventByIDStmt.Query(pq.StringArray(eventIDs))
+func (s *eventStatements) bulkSelectStateEventByID(ctx context.Context, eventIDs []string) ([]types.StateEntry, error) {
+	rows, err := s.bulkSelectStateEventByIDStmt.QueryContext(ctx, common.StringArray(eventIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -216,8 +196,8 @@ func (s *eventStatements) bulkSelectStateEventByID(eventIDs []string) ([]types.S
 // bulkSelectStateAtEventByID lookups the state at a list of events by event ID.
 // If any of the requested events are missing from the database it returns a types.MissingEventError.
 // If we do not have the state for any of the requested events it returns a types.MissingEventError.
-func (s *eventStatements) bulkSelectStateAtEventByID(eventIDs []string) ([]types.StateAtEvent, error) {
-	rows, err := s.bulkSelectStateAtEventByIDStmt.Query(pq.StringArray(eventIDs))
+func (s *eventStatements) bulkSelectStateAtEventByID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StateAtEvent, error) {
+	rows, err := common.TxStmt(txn, s.bulkSelectStateAtEventByIDStmt).QueryContext(ctx, common.StringArray(eventIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -248,28 +228,110 @@ func (s *eventStatements) bulkSelectStateAtEventByID(eventIDs []string) ([]types
 	return results, err
 }
 
-func (s *eventStatements) updateEventState(eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
-	_, err := s.updateEventStateStmt.Exec(int64(eventNID), int64(stateNID))
+func (s *eventStatements) updateEventState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	_, err := s.updateEventStateStmt.ExecContext(ctx, int64(stateNID), int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) selectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error) {
+	err = common.TxStmt(txn, s.selectEventSentToOutputStmt).QueryRowContext(ctx, int64(eventNID)).Scan(&sentToOutput)
+	return
+}
+
+func (s *eventStatements) updateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	_, err := common.TxStmt(txn, s.updateEventSentToOutputStmt).ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) updateEventSoftFailed(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	_, err := common.TxStmt(txn, s.updateEventSoftFailedStmt).ExecContext(ctx, int64(eventNID))
 	return err
 }
 
-func (s *eventStatements) selectEventSentToOutput(txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error) {
-	err = common.TxStmt(txn, s.selectEventSentToOutputStmt).QueryRow(int64(eventNID)).Scan(&sentToOutput)
+func (s *eventStatements) updateEventRedacted(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
+	_, err := common.TxStmt(txn, s.updateEventRedactedStmt).ExecContext(ctx, int64(eventNID))
+	return err
+}
+
+func (s *eventStatements) selectEventNIDAndRoomNID(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (types.EventNID, types.RoomNID, error) {
+	var eventNID, roomNID int64
+	err := common.TxStmt(txn, s.selectEventNIDAndRoomNIDStmt).QueryRowContext(ctx, eventID).Scan(&eventNID, &roomNID)
+	return types.EventNID(eventNID), types.RoomNID(roomNID), err
+}
+
+func (s *eventStatements) selectEventDepth(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (depth int64, err error) {
+	err = common.TxStmt(txn, s.selectEventDepthStmt).QueryRowContext(ctx, int64(eventNID)).Scan(&depth)
 	return
 }
 
-func (s *eventStatements) updateEventSentToOutput(txn *sql.Tx, eventNID types.EventNID) error {
-	_, err := common.TxStmt(txn, s.updateEventSentToOutputStmt).Exec(int64(eventNID))
+// selectEventsToPurge returns the numeric IDs, the IDs and the state snapshots
+// of the events of the room which aren't state events and are less deep than
+// the given depth, except for the excluded ones.
+func (s *eventStatements) selectEventsToPurge(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, depth int64, excludedNIDs []types.EventNID,
+) ([]types.EventNID, []string, []types.StateSnapshotNID, error) {
+	rows, err := common.TxStmt(txn, s.selectEventsToPurgeStmt).QueryContext(
+		ctx, int64(roomNID), depth, eventNIDsAsArray(excludedNIDs),
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+	var eventNIDs []types.EventNID
+	var eventIDs []string
+	var stateNIDs []types.StateSnapshotNID
+	for rows.Next() {
+		var eventNID, stateNID int64
+		var eventID string
+		if err = rows.Scan(&eventNID, &eventID, &stateNID); err != nil {
+			return nil, nil, nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+		eventIDs = append(eventIDs, eventID)
+		if stateNID != 0 {
+			stateNIDs = append(stateNIDs, types.StateSnapshotNID(stateNID))
+		}
+	}
+	return eventNIDs, eventIDs, stateNIDs, rows.Err()
+}
+
+func (s *eventStatements) selectEventsToExpire(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, excludedNIDs []types.EventNID, limit int,
+) ([]types.EventNID, error) {
+	rows, err := common.TxStmt(txn, s.selectEventsToExpireStmt).QueryContext(
+		ctx, int64(roomNID), int64(types.MRoomRedactionNID), eventNIDsAsArray(excludedNIDs), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) bulkDeleteEvents(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) error {
+	_, err := common.TxStmt(txn, s.bulkDeleteEventsStmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs))
 	return err
 }
 
-func (s *eventStatements) selectEventID(txn *sql.Tx, eventNID types.EventNID) (eventID string, err error) {
-	err = common.TxStmt(txn, s.selectEventIDStmt).QueryRow(int64(eventNID)).Scan(&eventID)
+func (s *eventStatements) selectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error) {
+	err = common.TxStmt(txn, s.selectEventIDStmt).QueryRowContext(ctx, int64(eventNID)).Scan(&eventID)
 	return
 }
 
-func (s *eventStatements) bulkSelectStateAtEventAndReference(txn *sql.Tx, eventNIDs []types.EventNID) ([]types.StateAtEventAndReference, error) {
-	rows, err := common.TxStmt(txn, s.bulkSelectStateAtEventAndReferenceStmt).Query(eventNIDsAsArray(eventNIDs))
+func (s *eventStatements) bulkSelectStateAtEventAndReference(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]types.StateAtEventAndReference, error) {
+	rows, err := common.TxStmt(txn, s.bulkSelectStateAtEventAndReferenceStmt).QueryContext(ctx, eventNIDsAsArray(eventNIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -304,8 +366,8 @@ func (s *eventStatements) bulkSelectStateAtEventAndReference(txn *sql.Tx, eventN
 	return results, nil
 }
 
-func (s *eventStatements) bulkSelectEventReference(eventNIDs []types.EventNID) ([]gomatrixserverlib.EventReference, error) {
-	rows, err := s.bulkSelectEventReferenceStmt.Query(eventNIDsAsArray(eventNIDs))
+func (s *eventStatements) bulkSelectEventReference(ctx context.Context, eventNIDs []types.EventNID) ([]gomatrixserverlib.EventReference, error) {
+	rows, err := s.bulkSelectEventReferenceStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -325,8 +387,8 @@ func (s *eventStatements) bulkSelectEventReference(eventNIDs []types.EventNID) (
 }
 
 // bulkSelectEventID returns a map from numeric event ID to string event ID.
-func (s *eventStatements) bulkSelectEventID(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
-	rows, err := s.bulkSelectEventIDStmt.Query(eventNIDsAsArray(eventNIDs))
+func (s *eventStatements) bulkSelectEventID(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	rows, err := s.bulkSelectEventIDStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -349,8 +411,8 @@ func (s *eventStatements) bulkSelectEventID(eventNIDs []types.EventNID) (map[typ
 
 // bulkSelectEventNIDs returns a map from string event ID to numeric event ID.
 // If an event ID is not in the database then it is omitted from the map.
-func (s *eventStatements) bulkSelectEventNID(eventIDs []string) (map[string]types.EventNID, error) {
-	rows, err := s.bulkSelectEventNIDStmt.Query(pq.StringArray(eventIDs))
+func (s *eventStatements) bulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	rows, err := s.bulkSelectEventNIDStmt.QueryContext(ctx, common.StringArray(eventIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -367,16 +429,55 @@ func (s *eventStatements) bulkSelectEventNID(eventIDs []string) (map[string]type
 	return results, nil
 }
 
-func (s *eventStatements) selectMaxEventDepth(eventNIDs []types.EventNID) (int64, error) {
+func (s *eventStatements) selectMaxEventDepth(ctx context.Context, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
-	err := s.selectMaxEventDepthStmt.QueryRow(eventNIDsAsArray(eventNIDs)).Scan(&result)
+	err := s.selectMaxEventDepthStmt.QueryRowContext(ctx, eventNIDsAsArray(eventNIDs)).Scan(&result)
 	if err != nil {
 		return 0, err
 	}
 	return result, nil
 }
 
-func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
+// selectEventsInRange looks up at most limit events in the room between the
+// low and high numeric IDs, excluded, from the lowest ID or from the highest
+// one if backwards is set.
+func (s *eventStatements) selectEventsInRange(
+	ctx context.Context,
+	roomNID types.RoomNID, low, high types.EventNID, backwards bool, limit int,
+) ([]types.StateAtEvent, error) {
+	var rows *sql.Rows
+	var err error
+	if backwards {
+		rows, err = s.selectEventsInRangeBackwardsStmt.QueryContext(ctx, int64(roomNID), int64(high), int64(low), limit)
+	} else {
+		rows, err = s.selectEventsInRangeStmt.QueryContext(ctx, int64(roomNID), int64(low), int64(high), limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.StateAtEvent
+	for rows.Next() {
+		var (
+			eventTypeNID     int64
+			eventStateKeyNID int64
+			eventNID         int64
+			stateSnapshotNID int64
+		)
+		if err = rows.Scan(&eventTypeNID, &eventStateKeyNID, &eventNID, &stateSnapshotNID); err != nil {
+			return nil, err
+		}
+		var result types.StateAtEvent
+		result.EventTypeNID = types.EventTypeNID(eventTypeNID)
+		result.EventStateKeyNID = types.EventStateKeyNID(eventStateKeyNID)
+		result.EventNID = types.EventNID(eventNID)
+		result.BeforeStateSnapshotNID = types.StateSnapshotNID(stateSnapshotNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func eventNIDsAsArray(eventNIDs []types.EventNID) int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
 		nids[i] = int64(eventNIDs[i])
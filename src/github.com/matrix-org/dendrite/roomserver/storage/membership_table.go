@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/common"
@@ -80,13 +81,9 @@ const selectMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1"
 
-const selectMembershipForUpdateSQL = "" +
-	"SELECT membership_nid FROM roomserver_membership" +
-	" WHERE room_nid = $1 AND target_nid = $2 FOR UPDATE"
-
 const updateMembershipSQL = "" +
-	"UPDATE roomserver_membership SET sender_nid = $3, membership_nid = $4, event_nid = $5" +
-	" WHERE room_nid = $1 AND target_nid = $2"
+	"UPDATE roomserver_membership SET sender_nid = $1, membership_nid = $2, event_nid = $3" +
+	" WHERE room_nid = $4 AND target_nid = $5"
 
 type membershipStatements struct {
 	insertMembershipStmt                       *sql.Stmt
@@ -114,34 +111,38 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *membershipStatements) insertMembership(
+	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) error {
-	_, err := common.TxStmt(txn, s.insertMembershipStmt).Exec(roomNID, targetUserNID)
+	_, err := common.TxStmt(txn, s.insertMembershipStmt).ExecContext(ctx, roomNID, targetUserNID)
 	return err
 }
 
 func (s *membershipStatements) selectMembershipForUpdate(
+	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (membership membershipState, err error) {
-	err = common.TxStmt(txn, s.selectMembershipForUpdateStmt).QueryRow(
-		roomNID, targetUserNID,
+	err = common.TxStmt(txn, s.selectMembershipForUpdateStmt).QueryRowContext(
+		ctx, roomNID, targetUserNID,
 	).Scan(&membership)
 	return
 }
 
 func (s *membershipStatements) selectMembershipFromRoomAndTarget(
+	ctx context.Context,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (eventNID types.EventNID, membership membershipState, err error) {
-	err = s.selectMembershipFromRoomAndTargetStmt.QueryRow(
-		roomNID, targetUserNID,
+	err = s.selectMembershipFromRoomAndTargetStmt.QueryRowContext(
+		ctx, roomNID, targetUserNID,
 	).Scan(&membership, &eventNID)
 	return
 }
 
 func (s *membershipStatements) selectMembershipsFromRoom(
+	ctx context.Context,
 	roomNID types.RoomNID,
 ) (eventNIDs []types.EventNID, err error) {
-	rows, err := s.selectMembershipsFromRoomStmt.Query(roomNID)
+	rows, err := s.selectMembershipsFromRoomStmt.QueryContext(ctx, roomNID)
 	if err != nil {
 		return
 	}
@@ -156,9 +157,10 @@ func (s *membershipStatements) selectMembershipsFromRoom(
 	return
 }
 func (s *membershipStatements) selectMembershipsFromRoomAndMembership(
+	ctx context.Context,
 	roomNID types.RoomNID, membership membershipState,
 ) (eventNIDs []types.EventNID, err error) {
-	rows, err := s.selectMembershipsFromRoomAndMembershipStmt.Query(roomNID, membership)
+	rows, err := s.selectMembershipsFromRoomAndMembershipStmt.QueryContext(ctx, roomNID, membership)
 	if err != nil {
 		return
 	}
@@ -174,12 +176,13 @@ func (s *membershipStatements) selectMembershipsFromRoomAndMembership(
 }
 
 func (s *membershipStatements) updateMembership(
+	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	senderUserNID types.EventStateKeyNID, membership membershipState,
 	eventNID types.EventNID,
 ) error {
-	_, err := common.TxStmt(txn, s.updateMembershipStmt).Exec(
-		roomNID, targetUserNID, senderUserNID, membership, eventNID,
+	_, err := common.TxStmt(txn, s.updateMembershipStmt).ExecContext(
+		ctx, senderUserNID, membership, eventNID, roomNID, targetUserNID,
 	)
 	return err
 }
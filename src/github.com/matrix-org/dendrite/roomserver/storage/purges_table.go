@@ -0,0 +1,80 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+const purgesSchema = `
+-- Stores the status of the purges of the history of rooms, so that it can be
+-- looked up after the purge is done, or after the roomserver restarts.
+CREATE TABLE IF NOT EXISTS roomserver_purges (
+    -- The ID of the purge
+    purge_id TEXT NOT NULL PRIMARY KEY,
+    -- The ID of the room whose history is purged
+    room_id TEXT NOT NULL,
+    -- The status of the purge, i.e. active, complete or failed
+    status TEXT NOT NULL
+);
+`
+
+const upsertPurgeStatusSQL = "" +
+	"INSERT INTO roomserver_purges (purge_id, room_id, status) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (purge_id) DO UPDATE SET status = $3"
+
+const selectPurgeStatusSQL = "" +
+	"SELECT status FROM roomserver_purges WHERE purge_id = $1"
+
+const updatePurgeStatusesSQL = "" +
+	"UPDATE roomserver_purges SET status = $1 WHERE status = $2"
+
+type purgesStatements struct {
+	upsertPurgeStatusStmt   *sql.Stmt
+	selectPurgeStatusStmt   *sql.Stmt
+	updatePurgeStatusesStmt *sql.Stmt
+}
+
+func (s *purgesStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(purgesSchema)
+	if err != nil {
+		return
+	}
+	return statementList{
+		{&s.upsertPurgeStatusStmt, upsertPurgeStatusSQL},
+		{&s.selectPurgeStatusStmt, selectPurgeStatusSQL},
+		{&s.updatePurgeStatusesStmt, updatePurgeStatusesSQL},
+	}.prepare(db)
+}
+
+func (s *purgesStatements) upsertPurgeStatus(ctx context.Context, purgeID, roomID, status string) (err error) {
+	_, err = s.upsertPurgeStatusStmt.ExecContext(ctx, purgeID, roomID, status)
+	return
+}
+
+func (s *purgesStatements) selectPurgeStatus(ctx context.Context, purgeID string) (string, error) {
+	var status string
+	err := s.selectPurgeStatusStmt.QueryRowContext(ctx, purgeID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+func (s *purgesStatements) updatePurgeStatuses(ctx context.Context, oldStatus, newStatus string) (err error) {
+	_, err = s.updatePurgeStatusesStmt.ExecContext(ctx, newStatus, oldStatus)
+	return
+}
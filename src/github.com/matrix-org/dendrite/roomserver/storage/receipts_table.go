@@ -0,0 +1,85 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM roomserver_receipts"
+
+type receiptsStatements struct {
+	upsertReceiptStmt         *sql.Stmt
+	selectReceiptsInRoomsStmt *sql.Stmt
+	selectMaxReceiptIDStmt    *sql.Stmt
+}
+
+func (s *receiptsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(receiptsSchema)
+	if err != nil {
+		return
+	}
+	return statementList{
+		{&s.upsertReceiptStmt, upsertReceiptSQL},
+		{&s.selectReceiptsInRoomsStmt, selectReceiptsInRoomsSQL},
+		{&s.selectMaxReceiptIDStmt, selectMaxReceiptIDSQL},
+	}.prepare(db)
+}
+
+func (s *receiptsStatements) upsertReceipt(ctx context.Context, receipt api.Receipt) (id int64, err error) {
+	err = s.upsertReceiptStmt.QueryRowContext(
+		ctx, receipt.RoomID, receipt.UserID, receipt.Type, receipt.EventID, int64(receipt.Timestamp),
+	).Scan(&id)
+	return
+}
+
+// selectReceiptsInRooms returns the receipts in the given rooms whose latest
+// update is after afterID and at or before maxID.
+func (s *receiptsStatements) selectReceiptsInRooms(
+	ctx context.Context, roomIDs []string, afterID, maxID int64,
+) ([]api.Receipt, error) {
+	rows, err := s.selectReceiptsInRoomsStmt.QueryContext(ctx, common.StringArray(roomIDs), afterID, maxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var receipts []api.Receipt
+	for rows.Next() {
+		var ts int64
+		var r api.Receipt
+		if err = rows.Scan(&r.RoomID, &r.UserID, &r.Type, &r.EventID, &ts); err != nil {
+			return nil, err
+		}
+		r.Timestamp = gomatrixserverlib.Timestamp(ts)
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+func (s *receiptsStatements) selectMaxReceiptID(ctx context.Context) (id int64, err error) {
+	var nullableID sql.NullInt64
+	err = s.selectMaxReceiptIDStmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+func TestReceipts(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+
+	// Use rooms no other test run has sent receipts in.
+	suffix := fmt.Sprintf("%d:localhost", time.Now().UnixNano())
+	roomA, roomB, roomC := "!a"+suffix, "!b"+suffix, "!c"+suffix
+
+	_, startPos, err := db.GetReceiptsInRooms(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("GetReceiptsInRooms: %v", err)
+	}
+
+	first, err := db.SetReceipt(ctx, api.Receipt{
+		RoomID: roomA, UserID: "@alice:localhost", Type: "m.read", EventID: "$1:localhost",
+	})
+	if err != nil {
+		t.Fatalf("SetReceipt: %v", err)
+	}
+	second, err := db.SetReceipt(ctx, api.Receipt{
+		RoomID: roomA, UserID: "@alice:localhost", Type: "m.read", EventID: "$2:localhost",
+	})
+	if err != nil {
+		t.Fatalf("SetReceipt: %v", err)
+	}
+	if second <= first {
+		t.Errorf("SetReceipt: got position %d after %d, want a later one", second, first)
+	}
+	if _, err = db.SetReceipt(ctx, api.Receipt{
+		RoomID: roomC, UserID: "@bob:localhost", Type: "m.read", EventID: "$3:localhost",
+	}); err != nil {
+		t.Fatalf("SetReceipt: %v", err)
+	}
+
+	// Only the latest receipt of alice in the rooms asked for is returned.
+	receipts, pos, err := db.GetReceiptsInRooms(ctx, []string{roomA, roomB}, startPos)
+	if err != nil {
+		t.Fatalf("GetReceiptsInRooms: %v", err)
+	}
+	if len(receipts) != 1 || receipts[0].EventID != "$2:localhost" || receipts[0].UserID != "@alice:localhost" {
+		t.Errorf("GetReceiptsInRooms: got %+v, want the receipt of alice for $2:localhost", receipts)
+	}
+	if pos <= second {
+		t.Errorf("GetReceiptsInRooms: got position %d, want the one of the receipt in %s after %d", pos, roomC, second)
+	}
+
+	// Nothing was sent since then.
+	receipts, after, err := db.GetReceiptsInRooms(ctx, []string{roomA, roomB}, pos)
+	if err != nil {
+		t.Fatalf("GetReceiptsInRooms: %v", err)
+	}
+	if len(receipts) != 0 || after != pos {
+		t.Errorf("GetReceiptsInRooms: got %+v at %d, want no receipts at %d", receipts, after, pos)
+	}
+}
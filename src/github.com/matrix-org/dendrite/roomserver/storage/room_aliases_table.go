@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 )
 
@@ -24,14 +25,16 @@ CREATE TABLE IF NOT EXISTS roomserver_room_aliases (
     -- Alias of the room
     alias TEXT NOT NULL PRIMARY KEY,
     -- Room ID the alias refers to
-    room_id TEXT NOT NULL
+    room_id TEXT NOT NULL,
+    -- User ID of the creator of this alias, NULL if it isn't known
+    creator_id TEXT
 );
 
 CREATE INDEX IF NOT EXISTS roomserver_room_id_idx ON roomserver_room_aliases(room_id);
 `
 
 const insertRoomAliasSQL = "" +
-	"INSERT INTO roomserver_room_aliases (alias, room_id) VALUES ($1, $2)"
+	"INSERT INTO roomserver_room_aliases (alias, room_id, creator_id) VALUES ($1, $2, $3)"
 
 const selectRoomIDFromAliasSQL = "" +
 	"SELECT room_id FROM roomserver_room_aliases WHERE alias = $1"
@@ -39,14 +42,18 @@ const selectRoomIDFromAliasSQL = "" +
 const selectAliasesFromRoomIDSQL = "" +
 	"SELECT alias FROM roomserver_room_aliases WHERE room_id = $1"
 
+const selectCreatorIDFromAliasSQL = "" +
+	"SELECT creator_id FROM roomserver_room_aliases WHERE alias = $1"
+
 const deleteRoomAliasSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE alias = $1"
 
 type roomAliasesStatements struct {
-	insertRoomAliasStmt         *sql.Stmt
-	selectRoomIDFromAliasStmt   *sql.Stmt
-	selectAliasesFromRoomIDStmt *sql.Stmt
-	deleteRoomAliasStmt         *sql.Stmt
+	insertRoomAliasStmt          *sql.Stmt
+	selectRoomIDFromAliasStmt    *sql.Stmt
+	selectAliasesFromRoomIDStmt  *sql.Stmt
+	selectCreatorIDFromAliasStmt *sql.Stmt
+	deleteRoomAliasStmt          *sql.Stmt
 }
 
 func (s *roomAliasesStatements) prepare(db *sql.DB) (err error) {
@@ -54,30 +61,36 @@ func (s *roomAliasesStatements) prepare(db *sql.DB) (err error) {
 	if err != nil {
 		return
 	}
+	if roomAliasesMigrations != "" {
+		if _, err = db.Exec(roomAliasesMigrations); err != nil {
+			return
+		}
+	}
 	return statementList{
 		{&s.insertRoomAliasStmt, insertRoomAliasSQL},
 		{&s.selectRoomIDFromAliasStmt, selectRoomIDFromAliasSQL},
 		{&s.selectAliasesFromRoomIDStmt, selectAliasesFromRoomIDSQL},
+		{&s.selectCreatorIDFromAliasStmt, selectCreatorIDFromAliasSQL},
 		{&s.deleteRoomAliasStmt, deleteRoomAliasSQL},
 	}.prepare(db)
 }
 
-func (s *roomAliasesStatements) insertRoomAlias(alias string, roomID string) (err error) {
-	_, err = s.insertRoomAliasStmt.Exec(alias, roomID)
+func (s *roomAliasesStatements) insertRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) (err error) {
+	_, err = s.insertRoomAliasStmt.ExecContext(ctx, alias, roomID, creatorUserID)
 	return
 }
 
-func (s *roomAliasesStatements) selectRoomIDFromAlias(alias string) (roomID string, err error) {
-	err = s.selectRoomIDFromAliasStmt.QueryRow(alias).Scan(&roomID)
+func (s *roomAliasesStatements) selectRoomIDFromAlias(ctx context.Context, alias string) (roomID string, err error) {
+	err = s.selectRoomIDFromAliasStmt.QueryRowContext(ctx, alias).Scan(&roomID)
 	if err == sql.ErrNoRows {
 		return "", nil
 	}
 	return
 }
 
-func (s *roomAliasesStatements) selectAliasesFromRoomID(roomID string) (aliases []string, err error) {
+func (s *roomAliasesStatements) selectAliasesFromRoomID(ctx context.Context, roomID string) (aliases []string, err error) {
 	aliases = []string{}
-	rows, err := s.selectAliasesFromRoomIDStmt.Query(roomID)
+	rows, err := s.selectAliasesFromRoomIDStmt.QueryContext(ctx, roomID)
 	if err != nil {
 		return
 	}
@@ -94,7 +107,16 @@ func (s *roomAliasesStatements) selectAliasesFromRoomID(roomID string) (aliases
 	return
 }
 
-func (s *roomAliasesStatements) deleteRoomAlias(alias string) (err error) {
-	_, err = s.deleteRoomAliasStmt.Exec(alias)
+func (s *roomAliasesStatements) selectCreatorIDFromAlias(ctx context.Context, alias string) (string, error) {
+	var creatorID sql.NullString
+	err := s.selectCreatorIDFromAliasStmt.QueryRowContext(ctx, alias).Scan(&creatorID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return creatorID.String, err
+}
+
+func (s *roomAliasesStatements) deleteRoomAlias(ctx context.Context, alias string) (err error) {
+	_, err = s.deleteRoomAliasStmt.ExecContext(ctx, alias)
 	return
 }
@@ -15,36 +15,17 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 
-	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
-const roomsSchema = `
-CREATE SEQUENCE IF NOT EXISTS roomserver_room_nid_seq;
-CREATE TABLE IF NOT EXISTS roomserver_rooms (
-    -- Local numeric ID for the room.
-    room_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_room_nid_seq'),
-    -- Textual ID for the room.
-    room_id TEXT NOT NULL CONSTRAINT roomserver_room_id_unique UNIQUE,
-    -- The most recent events in the room that aren't referenced by another event.
-    -- This list may empty if the server hasn't joined the room yet.
-    -- (The server will be in that state while it stores the events for the initial state of the room)
-    latest_event_nids BIGINT[] NOT NULL DEFAULT '{}'::BIGINT[],
-    -- The last event written to the output log for this room.
-    last_event_sent_nid BIGINT NOT NULL DEFAULT 0,
-    -- The state of the room after the current set of latest events.
-    -- This will be 0 if there are no latest events in the room.
-    state_snapshot_nid BIGINT NOT NULL DEFAULT 0
-);
-`
-
 // Same as insertEventTypeNIDSQL
 const insertRoomNIDSQL = "" +
 	"INSERT INTO roomserver_rooms (room_id) VALUES ($1)" +
-	" ON CONFLICT ON CONSTRAINT roomserver_room_id_unique" +
+	" ON CONFLICT (room_id)" +
 	" DO NOTHING RETURNING (room_nid)"
 
 const selectRoomNIDSQL = "" +
@@ -53,18 +34,36 @@ const selectRoomNIDSQL = "" +
 const selectLatestEventNIDsSQL = "" +
 	"SELECT latest_event_nids, state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $1"
 
-const selectLatestEventNIDsForUpdateSQL = "" +
-	"SELECT latest_event_nids, last_event_sent_nid, state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $1 FOR UPDATE"
-
 const updateLatestEventNIDsSQL = "" +
-	"UPDATE roomserver_rooms SET latest_event_nids = $2, last_event_sent_nid = $3, state_snapshot_nid = $4 WHERE room_nid = $1"
+	"UPDATE roomserver_rooms SET latest_event_nids = $1, last_event_sent_nid = $2, state_snapshot_nid = $3 WHERE room_nid = $4"
+
+const selectRoomVersionSQL = "" +
+	"SELECT room_version FROM roomserver_rooms WHERE room_nid = $1"
+
+const updateRoomVersionSQL = "" +
+	"UPDATE roomserver_rooms SET room_version = $1 WHERE room_nid = $2"
+
+const selectRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_rooms"
+
+// Look up the rooms which have an event of the given type, whether it is in
+// the current state of the room or not.
+const selectRoomIDsWithEventTypeSQL = "" +
+	"SELECT room_id FROM roomserver_rooms WHERE room_nid IN (" +
+	" SELECT room_nid FROM roomserver_events WHERE event_type_nid = $1" +
+	")"
 
 type roomStatements struct {
-	insertRoomNIDStmt                  *sql.Stmt
-	selectRoomNIDStmt                  *sql.Stmt
-	selectLatestEventNIDsStmt          *sql.Stmt
-	selectLatestEventNIDsForUpdateStmt *sql.Stmt
-	updateLatestEventNIDsStmt          *sql.Stmt
+	insertRoomNIDStmt                     *sql.Stmt
+	selectRoomNIDStmt                     *sql.Stmt
+	selectLatestEventNIDsStmt             *sql.Stmt
+	selectLatestEventNIDsForUpdateStmt    *sql.Stmt
+	updateLatestEventNIDsStmt             *sql.Stmt
+	selectRoomVersionStmt                 *sql.Stmt
+	updateRoomVersionStmt                 *sql.Stmt
+	selectRoomCountStmt                   *sql.Stmt
+	selectRoomIDsWithManyLatestEventsStmt *sql.Stmt
+	selectRoomIDsWithEventTypeStmt        *sql.Stmt
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
@@ -72,31 +71,41 @@ func (s *roomStatements) prepare(db *sql.DB) (err error) {
 	if err != nil {
 		return
 	}
+	if roomsMigrations != "" {
+		if _, err = db.Exec(roomsMigrations); err != nil {
+			return
+		}
+	}
 	return statementList{
 		{&s.insertRoomNIDStmt, insertRoomNIDSQL},
 		{&s.selectRoomNIDStmt, selectRoomNIDSQL},
 		{&s.selectLatestEventNIDsStmt, selectLatestEventNIDsSQL},
 		{&s.selectLatestEventNIDsForUpdateStmt, selectLatestEventNIDsForUpdateSQL},
 		{&s.updateLatestEventNIDsStmt, updateLatestEventNIDsSQL},
+		{&s.selectRoomVersionStmt, selectRoomVersionSQL},
+		{&s.updateRoomVersionStmt, updateRoomVersionSQL},
+		{&s.selectRoomCountStmt, selectRoomCountSQL},
+		{&s.selectRoomIDsWithManyLatestEventsStmt, selectRoomIDsWithManyLatestEventsSQL},
+		{&s.selectRoomIDsWithEventTypeStmt, selectRoomIDsWithEventTypeSQL},
 	}.prepare(db)
 }
 
-func (s *roomStatements) insertRoomNID(txn *sql.Tx, roomID string) (types.RoomNID, error) {
+func (s *roomStatements) insertRoomNID(ctx context.Context, txn *sql.Tx, roomID string) (types.RoomNID, error) {
 	var roomNID int64
-	err := common.TxStmt(txn, s.insertRoomNIDStmt).QueryRow(roomID).Scan(&roomNID)
+	err := common.TxStmt(txn, s.insertRoomNIDStmt).QueryRowContext(ctx, roomID).Scan(&roomNID)
 	return types.RoomNID(roomNID), err
 }
 
-func (s *roomStatements) selectRoomNID(txn *sql.Tx, roomID string) (types.RoomNID, error) {
+func (s *roomStatements) selectRoomNID(ctx context.Context, txn *sql.Tx, roomID string) (types.RoomNID, error) {
 	var roomNID int64
-	err := common.TxStmt(txn, s.selectRoomNIDStmt).QueryRow(roomID).Scan(&roomNID)
+	err := common.TxStmt(txn, s.selectRoomNIDStmt).QueryRowContext(ctx, roomID).Scan(&roomNID)
 	return types.RoomNID(roomNID), err
 }
 
-func (s *roomStatements) selectLatestEventNIDs(roomNID types.RoomNID) ([]types.EventNID, types.StateSnapshotNID, error) {
-	var nids pq.Int64Array
+func (s *roomStatements) selectLatestEventNIDs(ctx context.Context, roomNID types.RoomNID) ([]types.EventNID, types.StateSnapshotNID, error) {
+	var nids int64Array
 	var stateSnapshotNID int64
-	err := s.selectLatestEventNIDsStmt.QueryRow(int64(roomNID)).Scan(&nids, &stateSnapshotNID)
+	err := s.selectLatestEventNIDsStmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nids, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -107,13 +116,13 @@ func (s *roomStatements) selectLatestEventNIDs(roomNID types.RoomNID) ([]types.E
 	return eventNIDs, types.StateSnapshotNID(stateSnapshotNID), nil
 }
 
-func (s *roomStatements) selectLatestEventsNIDsForUpdate(txn *sql.Tx, roomNID types.RoomNID) (
+func (s *roomStatements) selectLatestEventsNIDsForUpdate(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (
 	[]types.EventNID, types.EventNID, types.StateSnapshotNID, error,
 ) {
-	var nids pq.Int64Array
+	var nids int64Array
 	var lastEventSentNID int64
 	var stateSnapshotNID int64
-	err := common.TxStmt(txn, s.selectLatestEventNIDsForUpdateStmt).QueryRow(int64(roomNID)).Scan(&nids, &lastEventSentNID, &stateSnapshotNID)
+	err := common.TxStmt(txn, s.selectLatestEventNIDsForUpdateStmt).QueryRowContext(ctx, int64(roomNID)).Scan(&nids, &lastEventSentNID, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -125,11 +134,61 @@ func (s *roomStatements) selectLatestEventsNIDsForUpdate(txn *sql.Tx, roomNID ty
 }
 
 func (s *roomStatements) updateLatestEventNIDs(
+	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID,
 	stateSnapshotNID types.StateSnapshotNID,
 ) error {
-	_, err := common.TxStmt(txn, s.updateLatestEventNIDsStmt).Exec(
-		roomNID, eventNIDsAsArray(eventNIDs), int64(lastEventSentNID), int64(stateSnapshotNID),
+	_, err := common.TxStmt(txn, s.updateLatestEventNIDsStmt).ExecContext(
+		ctx, eventNIDsAsArray(eventNIDs), int64(lastEventSentNID), int64(stateSnapshotNID), roomNID,
 	)
 	return err
 }
+
+func (s *roomStatements) selectRoomVersion(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (roomVersion string, err error) {
+	err = common.TxStmt(txn, s.selectRoomVersionStmt).QueryRowContext(ctx, int64(roomNID)).Scan(&roomVersion)
+	return
+}
+
+func (s *roomStatements) updateRoomVersion(ctx context.Context, roomNID types.RoomNID, roomVersion string) error {
+	_, err := s.updateRoomVersionStmt.ExecContext(ctx, roomVersion, int64(roomNID))
+	return err
+}
+
+func (s *roomStatements) selectRoomCount(ctx context.Context) (count int64, err error) {
+	err = s.selectRoomCountStmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
+func (s *roomStatements) selectRoomIDsWithManyLatestEvents(ctx context.Context, maxLatestEvents int) ([]string, error) {
+	rows, err := s.selectRoomIDsWithManyLatestEventsStmt.QueryContext(ctx, maxLatestEvents)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+func (s *roomStatements) selectRoomIDsWithEventType(ctx context.Context, eventTypeNID types.EventTypeNID) ([]string, error) {
+	rows, err := s.selectRoomIDsWithEventTypeStmt.QueryContext(ctx, int64(eventTypeNID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
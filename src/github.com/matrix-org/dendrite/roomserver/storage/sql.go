@@ -30,6 +30,11 @@ type statements struct {
 	roomAliasesStatements
 	inviteStatements
 	membershipStatements
+	eventRelationsStatements
+	threadRootsStatements
+	eventAnnotationsStatements
+	receiptsStatements
+	purgesStatements
 }
 
 func (s *statements) prepare(db *sql.DB) error {
@@ -38,8 +43,8 @@ func (s *statements) prepare(db *sql.DB) error {
 	for _, prepare := range []func(db *sql.DB) error{
 		s.eventTypeStatements.prepare,
 		s.eventStateKeyStatements.prepare,
-		s.roomStatements.prepare,
 		s.eventStatements.prepare,
+		s.roomStatements.prepare,
 		s.eventJSONStatements.prepare,
 		s.stateSnapshotStatements.prepare,
 		s.stateBlockStatements.prepare,
@@ -47,6 +52,11 @@ func (s *statements) prepare(db *sql.DB) error {
 		s.roomAliasesStatements.prepare,
 		s.inviteStatements.prepare,
 		s.membershipStatements.prepare,
+		s.eventRelationsStatements.prepare,
+		s.threadRootsStatements.prepare,
+		s.eventAnnotationsStatements.prepare,
+		s.receiptsStatements.prepare,
+		s.purgesStatements.prepare,
 	} {
 		if err = prepare(db); err != nil {
 			return err
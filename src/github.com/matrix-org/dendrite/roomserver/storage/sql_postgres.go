@@ -0,0 +1,477 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !sqlite
+
+package storage
+
+import (
+	"database/sql/driver"
+
+	"github.com/lib/pq"
+)
+
+// The statements which differ between the postgres and SQLite databases.
+
+// An int64Array is a list of numeric IDs, which is sent to and read from the
+// database as a postgres BIGINT[].
+type int64Array []int64
+
+// Value implements driver.Valuer
+func (a int64Array) Value() (driver.Value, error) {
+	return pq.Int64Array(a).Value()
+}
+
+// Scan implements sql.Scanner
+func (a *int64Array) Scan(src interface{}) error {
+	return (*pq.Int64Array)(a).Scan(src)
+}
+
+// Columns added to tables after they were first created, which the CREATE
+// TABLE statements don't add to the tables of existing databases.
+const roomsMigrations = `
+-- Rooms stored before room versions were tracked are assumed to be version 1.
+ALTER TABLE roomserver_rooms ADD COLUMN IF NOT EXISTS room_version TEXT NOT NULL DEFAULT '1';
+`
+
+const eventsMigrations = `
+-- Events stored before soft failure was implemented weren't soft failed.
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS soft_failed BOOLEAN NOT NULL DEFAULT FALSE;
+-- Events stored before redactions were implemented weren't redacted.
+ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS redacted BOOLEAN NOT NULL DEFAULT FALSE;
+`
+
+const roomAliasesMigrations = `
+-- The creators of aliases weren't recorded before alias removal was restricted
+-- to them, so the aliases created before then don't have one.
+ALTER TABLE roomserver_room_aliases ADD COLUMN IF NOT EXISTS creator_id TEXT;
+`
+
+const eventRelationsMigrations = `
+-- Relations stored before annotations were implemented had no key.
+ALTER TABLE roomserver_event_relations ADD COLUMN IF NOT EXISTS annotation_key TEXT NOT NULL DEFAULT '';
+`
+
+const eventTypesSchema = `
+-- Numeric versions of the event "type"s. Event types tend to be taken from a
+-- small common pool. Assigning each a numeric ID should reduce the amount of
+-- data that needs to be stored and fetched from the database.
+-- It also means that many operations can work with int64 arrays rather than
+-- string arrays which may help reduce GC pressure.
+-- Well known event types are pre-assigned numeric IDs:
+--   1 -> m.room.create
+--   2 -> m.room.power_levels
+--   3 -> m.room.join_rules
+--   4 -> m.room.third_party_invite
+--   5 -> m.room.member
+--   6 -> m.room.redaction
+--   7 -> m.room.history_visibility
+-- Picking well-known numeric IDs for the events types that require special
+-- attention during state conflict resolution means that we write that code
+-- using numeric constants.
+-- It also means that the numeric IDs for common event types should be
+-- consistent between different instances which might make ad-hoc debugging
+-- easier.
+-- Other event types are automatically assigned numeric IDs starting from 2**16.
+-- This leaves room to add more pre-assigned numeric IDs and clearly separates
+-- the automatically assigned IDs from the pre-assigned IDs.
+CREATE SEQUENCE IF NOT EXISTS roomserver_event_type_nid_seq START 65536;
+CREATE TABLE IF NOT EXISTS roomserver_event_types (
+    -- Local numeric ID for the event type.
+    event_type_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_event_type_nid_seq'),
+    -- The string event_type.
+    event_type TEXT NOT NULL CONSTRAINT roomserver_event_type_unique UNIQUE
+);
+INSERT INTO roomserver_event_types (event_type_nid, event_type) VALUES
+    (1, 'm.room.create'),
+    (2, 'm.room.power_levels'),
+    (3, 'm.room.join_rules'),
+    (4, 'm.room.third_party_invite'),
+    (5, 'm.room.member'),
+    (6, 'm.room.redaction'),
+    (7, 'm.room.history_visibility') ON CONFLICT DO NOTHING;
+`
+
+// Bulk lookup from string event type to numeric ID for that event type.
+// Takes an array of strings as the query parameter.
+const bulkSelectEventTypeNIDSQL = "" +
+	"SELECT event_type, event_type_nid FROM roomserver_event_types" +
+	" WHERE event_type = ANY($1)"
+
+const eventStateKeysSchema = `
+-- Numeric versions of the event "state_key"s. State keys tend to be reused so
+-- assigning each string a numeric ID should reduce the amount of data that
+-- needs to be stored and fetched from the database.
+-- It also means that many operations can work with int64 arrays rather than
+-- string arrays which may help reduce GC pressure.
+-- Well known state keys are pre-assigned numeric IDs:
+--   1 -> "" (the empty string)
+-- Other state keys are automatically assigned numeric IDs starting from 2**16.
+-- This leaves room to add more pre-assigned numeric IDs and clearly separates
+-- the automatically assigned IDs from the pre-assigned IDs.
+CREATE SEQUENCE IF NOT EXISTS roomserver_event_state_key_nid_seq START 65536;
+CREATE TABLE IF NOT EXISTS roomserver_event_state_keys (
+    -- Local numeric ID for the state key.
+    event_state_key_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_event_state_key_nid_seq'),
+    event_state_key TEXT NOT NULL CONSTRAINT roomserver_event_state_key_unique UNIQUE
+);
+INSERT INTO roomserver_event_state_keys (event_state_key_nid, event_state_key) VALUES
+    (1, '') ON CONFLICT DO NOTHING;
+`
+
+// Bulk lookup from string state key to numeric ID for that state key.
+// Takes an array of strings as the query parameter.
+const bulkSelectEventStateKeyNIDSQL = "" +
+	"SELECT event_state_key, event_state_key_nid FROM roomserver_event_state_keys" +
+	" WHERE event_state_key = ANY($1)"
+
+// Bulk lookup from numeric ID to string state key for that state key.
+// Takes an array of strings as the query parameter.
+const bulkSelectEventStateKeySQL = "" +
+	"SELECT event_state_key, event_state_key_nid FROM roomserver_event_state_keys" +
+	" WHERE event_state_key_nid = ANY($1)"
+
+const roomsSchema = `
+CREATE SEQUENCE IF NOT EXISTS roomserver_room_nid_seq;
+CREATE TABLE IF NOT EXISTS roomserver_rooms (
+    -- Local numeric ID for the room.
+    room_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_room_nid_seq'),
+    -- Textual ID for the room.
+    room_id TEXT NOT NULL CONSTRAINT roomserver_room_id_unique UNIQUE,
+    -- The most recent events in the room that aren't referenced by another event.
+    -- This list may empty if the server hasn't joined the room yet.
+    -- (The server will be in that state while it stores the events for the initial state of the room)
+    latest_event_nids BIGINT[] NOT NULL DEFAULT '{}'::BIGINT[],
+    -- The last event written to the output log for this room.
+    last_event_sent_nid BIGINT NOT NULL DEFAULT 0,
+    -- The state of the room after the current set of latest events.
+    -- This will be 0 if there are no latest events in the room.
+    state_snapshot_nid BIGINT NOT NULL DEFAULT 0,
+    -- The version of the room, which is set from the m.room.create event.
+    room_version TEXT NOT NULL DEFAULT '1'
+);
+`
+
+const selectLatestEventNIDsForUpdateSQL = "" +
+	"SELECT latest_event_nids, last_event_sent_nid, state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $1 FOR UPDATE"
+
+const selectRoomIDsWithManyLatestEventsSQL = "" +
+	"SELECT room_id FROM roomserver_rooms WHERE COALESCE(array_length(latest_event_nids, 1), 0) > $1"
+
+const eventsSchema = `
+-- The events table holds metadata for each event, the actual JSON is stored
+-- separately to keep the size of the rows small.
+CREATE SEQUENCE IF NOT EXISTS roomserver_event_nid_seq;
+CREATE TABLE IF NOT EXISTS roomserver_events (
+    -- Local numeric ID for the event.
+    event_nid BIGINT PRIMARY KEY DEFAULT nextval('roomserver_event_nid_seq'),
+    -- Local numeric ID for the room the event is in.
+    -- This is never 0.
+    room_nid BIGINT NOT NULL,
+    -- Local numeric ID for the type of the event.
+    -- This is never 0.
+    event_type_nid BIGINT NOT NULL,
+    -- Local numeric ID for the state_key of the event
+    -- This is 0 if the event is not a state event.
+    event_state_key_nid BIGINT NOT NULL,
+    -- Whether the event has been written to the output log.
+    sent_to_output BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Local numeric ID for the state at the event.
+    -- This is 0 if we don't know the state at the event.
+    -- If the state is not 0 then this event is part of the contiguous
+    -- part of the event graph
+    -- Since many different events can have the same state we store the
+    -- state into a separate state table and refer to it by numeric ID.
+    state_snapshot_nid BIGINT NOT NULL DEFAULT 0,
+    -- Depth of the event in the event graph.
+    depth BIGINT NOT NULL,
+    -- The textual event id.
+    -- Used to lookup the numeric ID when processing requests.
+    -- Needed for state resolution.
+    -- An event may only appear in this table once.
+    event_id TEXT NOT NULL CONSTRAINT roomserver_event_id_unique UNIQUE,
+    -- The sha256 reference hash for the event.
+    -- Needed for setting reference hashes when sending new events.
+    reference_sha256 BYTEA NOT NULL,
+    -- A list of numeric IDs for events that can authenticate this event.
+    auth_event_nids BIGINT[] NOT NULL,
+    -- Whether the event was soft failed, i.e. it was allowed by its auth events
+    -- but not by the current state of the room when it was received. Soft
+    -- failed events aren't written to the output log as new events and are
+    -- never part of the latest events in the room.
+    soft_failed BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether the event was redacted by a m.room.redaction event, in which
+    -- case its JSON has been stripped by the redaction algorithm.
+    redacted BOOLEAN NOT NULL DEFAULT FALSE
+);
+`
+
+// Bulk lookup of events by string ID.
+// Sort by the numeric IDs for event type and state key.
+// This means we can use binary search to lookup entries by type and state key.
+const bulkSelectStateEventByIDSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid FROM roomserver_events" +
+	" WHERE event_id = ANY($1)" +
+	" ORDER BY event_type_nid, event_state_key_nid ASC"
+
+const bulkSelectStateAtEventByIDSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid FROM roomserver_events" +
+	" WHERE event_id = ANY($1)"
+
+const bulkSelectStateAtEventAndReferenceSQL = "" +
+	"SELECT event_type_nid, event_state_key_nid, event_nid, state_snapshot_nid, event_id, reference_sha256" +
+	" FROM roomserver_events WHERE event_nid = ANY($1)"
+
+const bulkSelectEventReferenceSQL = "" +
+	"SELECT event_id, reference_sha256 FROM roomserver_events WHERE event_nid = ANY($1)"
+
+const bulkSelectEventIDSQL = "" +
+	"SELECT event_nid, event_id FROM roomserver_events WHERE event_nid = ANY($1)"
+
+const bulkSelectEventNIDSQL = "" +
+	"SELECT event_id, event_nid FROM roomserver_events WHERE event_id = ANY($1)"
+
+const selectMaxEventDepthSQL = "" +
+	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
+
+// Look up the events of a room which aren't state events and are less deep in
+// the event graph than the given depth, except for the given ones.
+const selectEventsToPurgeSQL = "" +
+	"SELECT event_nid, event_id, state_snapshot_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND depth < $2 AND event_state_key_nid = 0 AND NOT (event_nid = ANY($3))"
+
+// Look up the events of a room which aren't state events, events of the given
+// type (m.room.redaction) or already redacted, from the least deep in the event
+// graph, except for the given ones.
+const selectEventsToExpireSQL = "" +
+	"SELECT event_nid FROM roomserver_events" +
+	" WHERE room_nid = $1 AND event_state_key_nid = 0 AND event_type_nid != $2" +
+	" AND redacted = FALSE AND sent_to_output = TRUE AND NOT (event_nid = ANY($3))" +
+	" ORDER BY depth ASC LIMIT $4"
+
+const bulkDeleteEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = ANY($1)"
+
+// Bulk event JSON lookup by numeric event ID.
+// Sort by the numeric event ID.
+// This means that we can use binary search to lookup by numeric event ID.
+const bulkSelectEventJSONSQL = "" +
+	"SELECT event_nid, event_json FROM roomserver_event_json" +
+	" WHERE event_nid = ANY($1)" +
+	" ORDER BY event_nid ASC"
+
+// Bulk event JSON lookup by string event ID.
+// This joins on the events table so that the events can be fetched in a
+// single round trip to the database rather than looking up their numeric
+// IDs first.
+const bulkSelectEventJSONByIDSQL = "" +
+	"SELECT roomserver_event_json.event_nid, event_json FROM roomserver_event_json" +
+	" JOIN roomserver_events ON roomserver_events.event_nid = roomserver_event_json.event_nid" +
+	" WHERE event_id = ANY($1)" +
+	" ORDER BY roomserver_event_json.event_nid ASC"
+
+const bulkDeleteEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1)"
+
+const stateSnapshotSchema = `
+-- The state of a room before an event.
+-- Stored as a list of state_block entries stored in a separate table.
+-- The actual state is constructed by combining all the state_block entries
+-- referenced by state_block_nids together. If the same state key tuple appears
+-- multiple times then the entry from the later state_block clobbers the earlier
+-- entries.
+-- This encoding format allows us to implement a delta encoding which is useful
+-- because room state tends to accumulate small changes over time. Although if
+-- the list of deltas becomes too long it becomes more efficient to encode
+-- the full state under single state_block_nid.
+CREATE SEQUENCE IF NOT EXISTS roomserver_state_snapshot_nid_seq;
+CREATE TABLE IF NOT EXISTS roomserver_state_snapshots (
+    -- Local numeric ID for the state.
+    state_snapshot_nid bigint PRIMARY KEY DEFAULT nextval('roomserver_state_snapshot_nid_seq'),
+    -- Local numeric ID of the room this state is for.
+    -- Unused in normal operation, but useful for background work or ad-hoc debugging.
+    room_nid bigint NOT NULL,
+    -- List of state_block_nids, stored sorted by state_block_nid.
+    state_block_nids bigint[] NOT NULL
+);
+`
+
+// Bulk state data NID lookup.
+// Sorting by state_snapshot_nid means we can use binary search over the result
+// to lookup the state data NIDs for a state snapshot NID.
+const bulkSelectStateBlockNIDsSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
+
+// Delete the given state snapshots of a room unless they are the current state
+// of the room or the state at one of its events.
+const deleteUnreferencedStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots" +
+	" WHERE state_snapshot_nid = ANY($1)" +
+	" AND state_snapshot_nid NOT IN (SELECT state_snapshot_nid FROM roomserver_rooms WHERE room_nid = $2)" +
+	" AND NOT EXISTS (" +
+	"  SELECT 1 FROM roomserver_events" +
+	"  WHERE roomserver_events.state_snapshot_nid = roomserver_state_snapshots.state_snapshot_nid" +
+	" )" +
+	" RETURNING state_block_nids"
+
+const stateDataSchema = `
+-- The state data map.
+-- Designed to give enough information to run the state resolution algorithm
+-- without hitting the database in the common case.
+-- TODO: Is it worth replacing the unique btree index with a covering index so
+-- that postgres could lookup the state using an index-only scan?
+-- The type and state_key are included in the index to make it easier to
+-- lookup a specific (type, state_key) pair for an event. It also makes it easy
+-- to read the state for a given state_block_nid ordered by (type, state_key)
+-- which in turn makes it easier to merge state data blocks.
+CREATE SEQUENCE IF NOT EXISTS roomserver_state_block_nid_seq;
+CREATE TABLE IF NOT EXISTS roomserver_state_block (
+    -- Local numeric ID for this state data.
+    state_block_nid bigint NOT NULL,
+    event_type_nid bigint NOT NULL,
+    event_state_key_nid bigint NOT NULL,
+    event_nid bigint NOT NULL,
+    UNIQUE (state_block_nid, event_type_nid, event_state_key_nid)
+);
+`
+
+const selectNextStateBlockNIDSQL = "" +
+	"SELECT nextval('roomserver_state_block_nid_seq')"
+
+// Bulk state lookup by numeric state block ID.
+// Sort by the state_block_nid, event_type_nid, event_state_key_nid
+// This means that all the entries for a given state_block_nid will appear
+// together in the list and those entries will sorted by event_type_nid
+// and event_state_key_nid. This property makes it easier to merge two
+// state data blocks together.
+const bulkSelectStateBlockEntriesSQL = "" +
+	"SELECT state_block_nid, event_type_nid, event_state_key_nid, event_nid" +
+	" FROM roomserver_state_block WHERE state_block_nid = ANY($1)" +
+	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
+
+// Bulk state lookup by numeric state block ID.
+// Filters the rows in each block to the requested types and state keys.
+// We would like to restrict to particular type state key pairs but we are
+// restricted by the query language to pull the cross product of a list
+// of types and a list state_keys. So we have to filter the result in the
+// application to restrict it to the list of event types and state keys we
+// actually wanted.
+const bulkSelectFilteredStateBlockEntriesSQL = "" +
+	"SELECT state_block_nid, event_type_nid, event_state_key_nid, event_nid" +
+	" FROM roomserver_state_block WHERE state_block_nid = ANY($1)" +
+	" AND event_type_nid = ANY($2) AND event_state_key_nid = ANY($3)" +
+	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
+
+// Delete the given state blocks unless a state snapshot is made of them.
+const deleteUnreferencedStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY($1)" +
+	" AND NOT EXISTS (" +
+	"  SELECT 1 FROM roomserver_state_snapshots" +
+	"  WHERE roomserver_state_block.state_block_nid = ANY(roomserver_state_snapshots.state_block_nids)" +
+	" )"
+
+const previousEventSchema = `
+-- The previous events table stores the event_ids referenced by the events
+-- stored in the events table.
+-- This is used to tell if a new event is already referenced by an event in
+-- the database.
+CREATE TABLE IF NOT EXISTS roomserver_previous_events (
+    -- The string event ID taken from the prev_events key of an event.
+    previous_event_id TEXT NOT NULL,
+    -- The SHA256 reference hash taken from the prev_events key of an event.
+    previous_reference_sha256 BYTEA NOT NULL,
+    -- A list of numeric event IDs of events that reference this prev_event.
+    event_nids BIGINT[] NOT NULL,
+    CONSTRAINT roomserver_previous_event_id_unique UNIQUE (previous_event_id, previous_reference_sha256)
+);
+`
+
+// Insert an entry into the previous_events table.
+// If there is already an entry indicating that an event references that previous event then
+// add the event NID to the list to indicate that this event references that previous event as well.
+// This should only be modified while holding a "FOR UPDATE" lock on the row in the rooms table for this room.
+// The lock is necessary to avoid data races when checking whether an event is already referenced by another event.
+const insertPreviousEventSQL = "" +
+	"INSERT INTO roomserver_previous_events" +
+	" (previous_event_id, previous_reference_sha256, event_nids)" +
+	" VALUES ($1, $2, array_append('{}'::bigint[], $3))" +
+	" ON CONFLICT ON CONSTRAINT roomserver_previous_event_id_unique" +
+	" DO UPDATE SET event_nids = array_append(roomserver_previous_events.event_nids, $3)" +
+	" WHERE $3 != ALL(roomserver_previous_events.event_nids)"
+
+const selectMembershipForUpdateSQL = "" +
+	"SELECT membership_nid FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND target_nid = $2 FOR UPDATE"
+
+const selectEventRelationsSQL = "" +
+	"SELECT event_nid, relates_to_id, sender FROM roomserver_event_relations" +
+	" WHERE relates_to_id = ANY($1) AND rel_type = $2" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC"
+
+const selectRelatedEventIDsForSenderSQL = "" +
+	"SELECT DISTINCT relates_to_id FROM roomserver_event_relations" +
+	" WHERE relates_to_id = ANY($1) AND rel_type = $2 AND sender = $3"
+
+const bulkDeleteEventRelationsSQL = "" +
+	"DELETE FROM roomserver_event_relations WHERE event_nid = ANY($1)"
+
+const selectAnnotationsSQL = "" +
+	"SELECT relates_to_id, rel_type, key, count FROM roomserver_event_annotations" +
+	" WHERE relates_to_id = ANY($1) AND count > 0" +
+	" ORDER BY count DESC, key ASC"
+
+const upsertThreadReplySQL = "" +
+	"INSERT INTO roomserver_thread_roots (root_event_id, reply_count, latest_event_nid)" +
+	" VALUES ($1, 1, $2)" +
+	" ON CONFLICT (root_event_id) DO UPDATE" +
+	" SET reply_count = roomserver_thread_roots.reply_count + 1," +
+	" latest_event_nid = GREATEST(roomserver_thread_roots.latest_event_nid, $2)"
+
+const selectThreadRootsSQL = "" +
+	"SELECT root_event_id, reply_count, latest_event_nid FROM roomserver_thread_roots" +
+	" WHERE root_event_id = ANY($1) AND reply_count > 0"
+
+const receiptsSchema = `
+-- The stream of receipt updates. The ID of a receipt changes every time it is updated.
+CREATE SEQUENCE IF NOT EXISTS roomserver_receipt_id_seq;
+
+-- Stores the latest receipt of each type sent by users in rooms.
+CREATE TABLE IF NOT EXISTS roomserver_receipts (
+    -- The position of the latest update to this receipt in the receipts stream
+    id BIGINT PRIMARY KEY DEFAULT nextval('roomserver_receipt_id_seq'),
+    -- The ID of the room the receipt is in
+    room_id TEXT NOT NULL,
+    -- The Matrix user ID of the user who sent the receipt
+    user_id TEXT NOT NULL,
+    -- The type of the receipt, e.g. m.read
+    receipt_type TEXT NOT NULL,
+    -- The ID of the event the receipt is for
+    event_id TEXT NOT NULL,
+    -- When the receipt was sent, as a millisecond posix timestamp
+    receipt_ts BIGINT NOT NULL,
+    CONSTRAINT roomserver_receipts_unique UNIQUE (room_id, user_id, receipt_type)
+);
+`
+
+const upsertReceiptSQL = "" +
+	"INSERT INTO roomserver_receipts (room_id, user_id, receipt_type, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT roomserver_receipts_unique" +
+	" DO UPDATE SET event_id = $4, receipt_ts = $5, id = nextval('roomserver_receipt_id_seq')" +
+	" RETURNING id"
+
+const selectReceiptsInRoomsSQL = "" +
+	"SELECT room_id, user_id, receipt_type, event_id, receipt_ts FROM roomserver_receipts" +
+	" WHERE room_id = ANY($1) AND id > $2 AND id <= $3"
@@ -15,72 +15,26 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sort"
 
-	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/util"
 )
 
-const stateDataSchema = `
--- The state data map.
--- Designed to give enough information to run the state resolution algorithm
--- without hitting the database in the common case.
--- TODO: Is it worth replacing the unique btree index with a covering index so
--- that postgres could lookup the state using an index-only scan?
--- The type and state_key are included in the index to make it easier to
--- lookup a specific (type, state_key) pair for an event. It also makes it easy
--- to read the state for a given state_block_nid ordered by (type, state_key)
--- which in turn makes it easier to merge state data blocks.
-CREATE SEQUENCE IF NOT EXISTS roomserver_state_block_nid_seq;
-CREATE TABLE IF NOT EXISTS roomserver_state_block (
-    -- Local numeric ID for this state data.
-    state_block_nid bigint NOT NULL,
-    event_type_nid bigint NOT NULL,
-    event_state_key_nid bigint NOT NULL,
-    event_nid bigint NOT NULL,
-    UNIQUE (state_block_nid, event_type_nid, event_state_key_nid)
-);
-`
-
 const insertStateDataSQL = "" +
 	"INSERT INTO roomserver_state_block (state_block_nid, event_type_nid, event_state_key_nid, event_nid)" +
 	" VALUES ($1, $2, $3, $4)"
 
-const selectNextStateBlockNIDSQL = "" +
-	"SELECT nextval('roomserver_state_block_nid_seq')"
-
-// Bulk state lookup by numeric state block ID.
-// Sort by the state_block_nid, event_type_nid, event_state_key_nid
-// This means that all the entries for a given state_block_nid will appear
-// together in the list and those entries will sorted by event_type_nid
-// and event_state_key_nid. This property makes it easier to merge two
-// state data blocks together.
-const bulkSelectStateBlockEntriesSQL = "" +
-	"SELECT state_block_nid, event_type_nid, event_state_key_nid, event_nid" +
-	" FROM roomserver_state_block WHERE state_block_nid = ANY($1)" +
-	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
-
-// Bulk state lookup by numeric state block ID.
-// Filters the rows in each block to the requested types and state keys.
-// We would like to restrict to particular type state key pairs but we are
-// restricted by the query language to pull the cross product of a list
-// of types and a list state_keys. So we have to filter the result in the
-// application to restrict it to the list of event types and state keys we
-// actually wanted.
-const bulkSelectFilteredStateBlockEntriesSQL = "" +
-	"SELECT state_block_nid, event_type_nid, event_state_key_nid, event_nid" +
-	" FROM roomserver_state_block WHERE state_block_nid = ANY($1)" +
-	" AND event_type_nid = ANY($2) AND event_state_key_nid = ANY($3)" +
-	" ORDER BY state_block_nid, event_type_nid, event_state_key_nid"
-
 type stateBlockStatements struct {
 	insertStateDataStmt                     *sql.Stmt
 	selectNextStateBlockNIDStmt             *sql.Stmt
 	bulkSelectStateBlockEntriesStmt         *sql.Stmt
 	bulkSelectFilteredStateBlockEntriesStmt *sql.Stmt
+	deleteUnreferencedStateBlocksStmt       *sql.Stmt
 }
 
 func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
@@ -94,13 +48,14 @@ func (s *stateBlockStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectNextStateBlockNIDStmt, selectNextStateBlockNIDSQL},
 		{&s.bulkSelectStateBlockEntriesStmt, bulkSelectStateBlockEntriesSQL},
 		{&s.bulkSelectFilteredStateBlockEntriesStmt, bulkSelectFilteredStateBlockEntriesSQL},
+		{&s.deleteUnreferencedStateBlocksStmt, deleteUnreferencedStateBlocksSQL},
 	}.prepare(db)
 }
 
-func (s *stateBlockStatements) bulkInsertStateData(stateBlockNID types.StateBlockNID, entries []types.StateEntry) error {
+func (s *stateBlockStatements) bulkInsertStateData(ctx context.Context, txn *sql.Tx, stateBlockNID types.StateBlockNID, entries []types.StateEntry) error {
 	for _, entry := range entries {
-		_, err := s.insertStateDataStmt.Exec(
-			int64(stateBlockNID),
+		_, err := common.TxStmt(txn, s.insertStateDataStmt).ExecContext(
+			ctx, int64(stateBlockNID),
 			int64(entry.EventTypeNID),
 			int64(entry.EventStateKeyNID),
 			int64(entry.EventNID),
@@ -112,18 +67,29 @@ func (s *stateBlockStatements) bulkInsertStateData(stateBlockNID types.StateBloc
 	return nil
 }
 
-func (s *stateBlockStatements) selectNextStateBlockNID() (types.StateBlockNID, error) {
+func (s *stateBlockStatements) deleteUnreferencedStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs []types.StateBlockNID,
+) error {
+	nids := make([]int64, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		nids[i] = int64(stateBlockNIDs[i])
+	}
+	_, err := common.TxStmt(txn, s.deleteUnreferencedStateBlocksStmt).ExecContext(ctx, int64Array(nids))
+	return err
+}
+
+func (s *stateBlockStatements) selectNextStateBlockNID(ctx context.Context, txn *sql.Tx) (types.StateBlockNID, error) {
 	var stateBlockNID int64
-	err := s.selectNextStateBlockNIDStmt.QueryRow().Scan(&stateBlockNID)
+	err := common.TxStmt(txn, s.selectNextStateBlockNIDStmt).QueryRowContext(ctx).Scan(&stateBlockNID)
 	return types.StateBlockNID(stateBlockNID), err
 }
 
-func (s *stateBlockStatements) bulkSelectStateBlockEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+func (s *stateBlockStatements) bulkSelectStateBlockEntries(ctx context.Context, txn *sql.Tx, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
 		nids[i] = int64(stateBlockNIDs[i])
 	}
-	rows, err := s.bulkSelectStateBlockEntriesStmt.Query(pq.Int64Array(nids))
+	rows, err := common.TxStmt(txn, s.bulkSelectStateBlockEntriesStmt).QueryContext(ctx, int64Array(nids))
 	if err != nil {
 		return nil, err
 	}
@@ -165,6 +131,7 @@ func (s *stateBlockStatements) bulkSelectStateBlockEntries(stateBlockNIDs []type
 }
 
 func (s *stateBlockStatements) bulkSelectFilteredStateBlockEntries(
+	ctx context.Context, txn *sql.Tx,
 	stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
 ) ([]types.StateEntryList, error) {
 	tuples := stateKeyTupleSorter(stateKeyTuples)
@@ -172,8 +139,8 @@ func (s *stateBlockStatements) bulkSelectFilteredStateBlockEntries(
 	sort.Sort(tuples)
 
 	eventTypeNIDArray, eventStateKeyNIDArray := tuples.typesAndStateKeysAsArrays()
-	rows, err := s.bulkSelectFilteredStateBlockEntriesStmt.Query(
-		stateBlockNIDsAsArray(stateBlockNIDs), eventTypeNIDArray, eventStateKeyNIDArray,
+	rows, err := common.TxStmt(txn, s.bulkSelectFilteredStateBlockEntriesStmt).QueryContext(
+		ctx, stateBlockNIDsAsArray(stateBlockNIDs), eventTypeNIDArray, eventStateKeyNIDArray,
 	)
 	if err != nil {
 		return nil, err
@@ -224,12 +191,12 @@ func (s *stateBlockStatements) bulkSelectFilteredStateBlockEntries(
 	return results, nil
 }
 
-func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) pq.Int64Array {
+func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) int64Array {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
 		nids[i] = int64(stateBlockNIDs[i])
 	}
-	return pq.Int64Array(nids)
+	return int64Array(nids)
 }
 
 type stateKeyTupleSorter []types.StateKeyTuple
@@ -246,9 +213,9 @@ func (s stateKeyTupleSorter) contains(value types.StateKeyTuple) bool {
 
 // List the unique eventTypeNIDs and eventStateKeyNIDs.
 // Assumes that the list is sorted.
-func (s stateKeyTupleSorter) typesAndStateKeysAsArrays() (eventTypeNIDs pq.Int64Array, eventStateKeyNIDs pq.Int64Array) {
-	eventTypeNIDs = make(pq.Int64Array, len(s))
-	eventStateKeyNIDs = make(pq.Int64Array, len(s))
+func (s stateKeyTupleSorter) typesAndStateKeysAsArrays() (eventTypeNIDs int64Array, eventStateKeyNIDs int64Array) {
+	eventTypeNIDs = make(int64Array, len(s))
+	eventStateKeyNIDs = make(int64Array, len(s))
 	for i := range s {
 		eventTypeNIDs[i] = int64(s[i].EventTypeNID)
 		eventStateKeyNIDs[i] = int64(s[i].EventStateKeyNID)
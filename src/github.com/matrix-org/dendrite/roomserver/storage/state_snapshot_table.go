@@ -15,51 +15,23 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
-	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
-const stateSnapshotSchema = `
--- The state of a room before an event.
--- Stored as a list of state_block entries stored in a separate table.
--- The actual state is constructed by combining all the state_block entries
--- referenced by state_block_nids together. If the same state key tuple appears
--- multiple times then the entry from the later state_block clobbers the earlier
--- entries.
--- This encoding format allows us to implement a delta encoding which is useful
--- because room state tends to accumulate small changes over time. Although if
--- the list of deltas becomes too long it becomes more efficient to encode
--- the full state under single state_block_nid.
-CREATE SEQUENCE IF NOT EXISTS roomserver_state_snapshot_nid_seq;
-CREATE TABLE IF NOT EXISTS roomserver_state_snapshots (
-    -- Local numeric ID for the state.
-    state_snapshot_nid bigint PRIMARY KEY DEFAULT nextval('roomserver_state_snapshot_nid_seq'),
-    -- Local numeric ID of the room this state is for.
-    -- Unused in normal operation, but useful for background work or ad-hoc debugging.
-    room_nid bigint NOT NULL,
-    -- List of state_block_nids, stored sorted by state_block_nid.
-    state_block_nids bigint[] NOT NULL
-);
-`
-
 const insertStateSQL = "" +
 	"INSERT INTO roomserver_state_snapshots (room_nid, state_block_nids)" +
 	" VALUES ($1, $2)" +
 	" RETURNING state_snapshot_nid"
 
-// Bulk state data NID lookup.
-// Sorting by state_snapshot_nid means we can use binary search over the result
-// to lookup the state data NIDs for a state snapshot NID.
-const bulkSelectStateBlockNIDsSQL = "" +
-	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
-	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
-
 type stateSnapshotStatements struct {
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	insertStateStmt                      *sql.Stmt
+	bulkSelectStateBlockNIDsStmt         *sql.Stmt
+	deleteUnreferencedStateSnapshotsStmt *sql.Stmt
 }
 
 func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
@@ -71,24 +43,25 @@ func (s *stateSnapshotStatements) prepare(db *sql.DB) (err error) {
 	return statementList{
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
+		{&s.deleteUnreferencedStateSnapshotsStmt, deleteUnreferencedStateSnapshotsSQL},
 	}.prepare(db)
 }
 
-func (s *stateSnapshotStatements) insertState(roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID) (stateNID types.StateSnapshotNID, err error) {
+func (s *stateSnapshotStatements) insertState(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID) (stateNID types.StateSnapshotNID, err error) {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
 		nids[i] = int64(stateBlockNIDs[i])
 	}
-	err = s.insertStateStmt.QueryRow(int64(roomNID), pq.Int64Array(nids)).Scan(&stateNID)
+	err = common.TxStmt(txn, s.insertStateStmt).QueryRowContext(ctx, int64(roomNID), int64Array(nids)).Scan(&stateNID)
 	return
 }
 
-func (s *stateSnapshotStatements) bulkSelectStateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+func (s *stateSnapshotStatements) bulkSelectStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
 	nids := make([]int64, len(stateNIDs))
 	for i := range stateNIDs {
 		nids[i] = int64(stateNIDs[i])
 	}
-	rows, err := s.bulkSelectStateBlockNIDsStmt.Query(pq.Int64Array(nids))
+	rows, err := common.TxStmt(txn, s.bulkSelectStateBlockNIDsStmt).QueryContext(ctx, int64Array(nids))
 	if err != nil {
 		return nil, err
 	}
@@ -97,7 +70,7 @@ func (s *stateSnapshotStatements) bulkSelectStateBlockNIDs(stateNIDs []types.Sta
 	i := 0
 	for ; rows.Next(); i++ {
 		result := &results[i]
-		var stateBlockNIDs pq.Int64Array
+		var stateBlockNIDs int64Array
 		if err := rows.Scan(&result.StateSnapshotNID, &stateBlockNIDs); err != nil {
 			return nil, err
 		}
@@ -111,3 +84,33 @@ func (s *stateSnapshotStatements) bulkSelectStateBlockNIDs(stateNIDs []types.Sta
 	}
 	return results, nil
 }
+
+// deleteUnreferencedStateSnapshots deletes the given state snapshots of the
+// room which aren't used anymore, and returns the state blocks they were made
+// of.
+func (s *stateSnapshotStatements) deleteUnreferencedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, stateNIDs []types.StateSnapshotNID,
+) ([]types.StateBlockNID, error) {
+	nids := make([]int64, len(stateNIDs))
+	for i := range stateNIDs {
+		nids[i] = int64(stateNIDs[i])
+	}
+	rows, err := common.TxStmt(txn, s.deleteUnreferencedStateSnapshotsStmt).QueryContext(
+		ctx, int64Array(nids), int64(roomNID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stateBlockNIDs []types.StateBlockNID
+	for rows.Next() {
+		var blockNIDs int64Array
+		if err = rows.Scan(&blockNIDs); err != nil {
+			return nil, err
+		}
+		for _, blockNID := range blockNIDs {
+			stateBlockNIDs = append(stateBlockNIDs, types.StateBlockNID(blockNID))
+		}
+	}
+	return stateBlockNIDs, rows.Err()
+}
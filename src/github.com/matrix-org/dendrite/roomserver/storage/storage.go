@@ -15,10 +15,13 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 
-	// Import the postgres database driver.
-	_ "github.com/lib/pq"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/input"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -29,11 +32,11 @@ type Database struct {
 	db         *sql.DB
 }
 
-// Open a postgres database.
+// Open a postgres database, or a SQLite one when built with the sqlite tag.
 func Open(dataSourceName string) (*Database, error) {
 	var d Database
 	var err error
-	if d.db, err = sql.Open("postgres", dataSourceName); err != nil {
+	if d.db, err = common.OpenDatabase(dataSourceName); err != nil {
 		return nil, err
 	}
 	if err = d.statements.prepare(d.db); err != nil {
@@ -43,7 +46,7 @@ func Open(dataSourceName string) (*Database, error) {
 }
 
 // StoreEvent implements input.EventDatabase
-func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []types.EventNID) (types.RoomNID, types.StateAtEvent, error) {
+func (d *Database) StoreEvent(ctx context.Context, event gomatrixserverlib.Event, authEventNIDs []types.EventNID) (types.RoomNID, types.StateAtEvent, error) {
 	var (
 		roomNID          types.RoomNID
 		eventTypeNID     types.EventTypeNID
@@ -53,11 +56,11 @@ func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []typ
 		err              error
 	)
 
-	if roomNID, err = d.assignRoomNID(nil, event.RoomID()); err != nil {
+	if roomNID, err = d.assignRoomNID(ctx, nil, event.RoomID()); err != nil {
 		return 0, types.StateAtEvent{}, err
 	}
 
-	if eventTypeNID, err = d.assignEventTypeNID(event.Type()); err != nil {
+	if eventTypeNID, err = d.assignEventTypeNID(ctx, event.Type()); err != nil {
 		return 0, types.StateAtEvent{}, err
 	}
 
@@ -65,12 +68,13 @@ func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []typ
 	// Assigned a numeric ID for the state_key if there is one present.
 	// Otherwise set the numeric ID for the state_key to 0.
 	if eventStateKey != nil {
-		if eventStateKeyNID, err = d.assignStateKeyNID(nil, *eventStateKey); err != nil {
+		if eventStateKeyNID, err = d.assignStateKeyNID(ctx, nil, *eventStateKey); err != nil {
 			return 0, types.StateAtEvent{}, err
 		}
 	}
 
 	if eventNID, stateNID, err = d.statements.insertEvent(
+		ctx,
 		roomNID,
 		eventTypeNID,
 		eventStateKeyNID,
@@ -81,17 +85,29 @@ func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []typ
 	); err != nil {
 		if err == sql.ErrNoRows {
 			// We've already inserted the event so select the numeric event ID
-			eventNID, stateNID, err = d.statements.selectEvent(event.EventID())
+			eventNID, stateNID, err = d.statements.selectEvent(ctx, event.EventID())
 		}
 		if err != nil {
 			return 0, types.StateAtEvent{}, err
 		}
 	}
 
-	if err = d.statements.insertEventJSON(eventNID, event.JSON()); err != nil {
+	if err = d.statements.insertEventJSON(ctx, eventNID, event.JSON()); err != nil {
 		return 0, types.StateAtEvent{}, err
 	}
 
+	// The version of the room is given by its create event, which may not be
+	// the first event we store for the room if we joined it over federation.
+	if event.Type() == "m.room.create" && event.StateKeyEquals("") {
+		roomVersion, err := common.RoomVersionFromCreateEvent(event)
+		if err != nil {
+			return 0, types.StateAtEvent{}, err
+		}
+		if err = d.statements.updateRoomVersion(ctx, roomNID, roomVersion); err != nil {
+			return 0, types.StateAtEvent{}, err
+		}
+	}
+
 	return roomNID, types.StateAtEvent{
 		BeforeStateSnapshotNID: stateNID,
 		StateEntry: types.StateEntry{
@@ -104,79 +120,101 @@ func (d *Database) StoreEvent(event gomatrixserverlib.Event, authEventNIDs []typ
 	}, nil
 }
 
-func (d *Database) assignRoomNID(txn *sql.Tx, roomID string) (types.RoomNID, error) {
+func (d *Database) assignRoomNID(ctx context.Context, txn *sql.Tx, roomID string) (types.RoomNID, error) {
 	// Check if we already have a numeric ID in the database.
-	roomNID, err := d.statements.selectRoomNID(txn, roomID)
+	roomNID, err := d.statements.selectRoomNID(ctx, txn, roomID)
 	if err == sql.ErrNoRows {
 		// We don't have a numeric ID so insert one into the database.
-		roomNID, err = d.statements.insertRoomNID(txn, roomID)
+		roomNID, err = d.statements.insertRoomNID(ctx, txn, roomID)
 		if err == sql.ErrNoRows {
 			// We raced with another insert so run the select again.
-			roomNID, err = d.statements.selectRoomNID(txn, roomID)
+			roomNID, err = d.statements.selectRoomNID(ctx, txn, roomID)
 		}
 	}
 	return roomNID, err
 }
 
-func (d *Database) assignEventTypeNID(eventType string) (types.EventTypeNID, error) {
+func (d *Database) assignEventTypeNID(ctx context.Context, eventType string) (types.EventTypeNID, error) {
 	// Check if we already have a numeric ID in the database.
-	eventTypeNID, err := d.statements.selectEventTypeNID(eventType)
+	eventTypeNID, err := d.statements.selectEventTypeNID(ctx, eventType)
 	if err == sql.ErrNoRows {
 		// We don't have a numeric ID so insert one into the database.
-		eventTypeNID, err = d.statements.insertEventTypeNID(eventType)
+		eventTypeNID, err = d.statements.insertEventTypeNID(ctx, eventType)
 		if err == sql.ErrNoRows {
 			// We raced with another insert so run the select again.
-			eventTypeNID, err = d.statements.selectEventTypeNID(eventType)
+			eventTypeNID, err = d.statements.selectEventTypeNID(ctx, eventType)
 		}
 	}
 	return eventTypeNID, err
 }
 
-func (d *Database) assignStateKeyNID(txn *sql.Tx, eventStateKey string) (types.EventStateKeyNID, error) {
+func (d *Database) assignStateKeyNID(ctx context.Context, txn *sql.Tx, eventStateKey string) (types.EventStateKeyNID, error) {
 	// Check if we already have a numeric ID in the database.
-	eventStateKeyNID, err := d.statements.selectEventStateKeyNID(txn, eventStateKey)
+	eventStateKeyNID, err := d.statements.selectEventStateKeyNID(ctx, txn, eventStateKey)
 	if err == sql.ErrNoRows {
 		// We don't have a numeric ID so insert one into the database.
-		eventStateKeyNID, err = d.statements.insertEventStateKeyNID(txn, eventStateKey)
+		eventStateKeyNID, err = d.statements.insertEventStateKeyNID(ctx, txn, eventStateKey)
 		if err == sql.ErrNoRows {
 			// We raced with another insert so run the select again.
-			eventStateKeyNID, err = d.statements.selectEventStateKeyNID(txn, eventStateKey)
+			eventStateKeyNID, err = d.statements.selectEventStateKeyNID(ctx, txn, eventStateKey)
 		}
 	}
 	return eventStateKeyNID, err
 }
 
 // StateEntriesForEventIDs implements input.EventDatabase
-func (d *Database) StateEntriesForEventIDs(eventIDs []string) ([]types.StateEntry, error) {
-	return d.statements.bulkSelectStateEventByID(eventIDs)
+func (d *Database) StateEntriesForEventIDs(ctx context.Context, eventIDs []string) ([]types.StateEntry, error) {
+	return d.statements.bulkSelectStateEventByID(ctx, eventIDs)
 }
 
 // EventTypeNIDs implements state.RoomStateDatabase
-func (d *Database) EventTypeNIDs(eventTypes []string) (map[string]types.EventTypeNID, error) {
-	return d.statements.bulkSelectEventTypeNID(eventTypes)
+func (d *Database) EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error) {
+	return d.statements.bulkSelectEventTypeNID(ctx, nil, eventTypes)
 }
 
 // EventStateKeyNIDs implements state.RoomStateDatabase
-func (d *Database) EventStateKeyNIDs(eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
-	return d.statements.bulkSelectEventStateKeyNID(eventStateKeys)
+func (d *Database) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return d.statements.bulkSelectEventStateKeyNID(ctx, nil, eventStateKeys)
 }
 
 // EventStateKeys implements query.RoomserverQueryAPIDatabase
-func (d *Database) EventStateKeys(eventStateKeyNIDs []types.EventStateKeyNID) (map[types.EventStateKeyNID]string, error) {
-	return d.statements.bulkSelectEventStateKey(eventStateKeyNIDs)
+func (d *Database) EventStateKeys(ctx context.Context, eventStateKeyNIDs []types.EventStateKeyNID) (map[types.EventStateKeyNID]string, error) {
+	return d.statements.bulkSelectEventStateKey(ctx, eventStateKeyNIDs)
 }
 
 // EventNIDs implements query.RoomserverQueryAPIDatabase
-func (d *Database) EventNIDs(eventIDs []string) (map[string]types.EventNID, error) {
-	return d.statements.bulkSelectEventNID(eventIDs)
+func (d *Database) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error) {
+	return d.statements.bulkSelectEventNID(ctx, eventIDs)
 }
 
 // Events implements input.EventDatabase
-func (d *Database) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
-	eventJSONs, err := d.statements.bulkSelectEventJSON(eventNIDs)
+func (d *Database) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	return d.events(ctx, nil, eventNIDs)
+}
+
+func (d *Database) events(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]types.Event, error) {
+	eventJSONs, err := d.statements.bulkSelectEventJSON(ctx, txn, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	return eventsFromJSON(eventJSONs)
+}
+
+// EventsFromIDs implements state.RoomStateDatabase
+func (d *Database) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	return d.eventsFromIDs(ctx, nil, eventIDs)
+}
+
+func (d *Database) eventsFromIDs(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.Event, error) {
+	eventJSONs, err := d.statements.bulkSelectEventJSONByID(ctx, txn, eventIDs)
 	if err != nil {
 		return nil, err
 	}
+	return eventsFromJSON(eventJSONs)
+}
+
+func eventsFromJSON(eventJSONs []eventJSONPair) ([]types.Event, error) {
+	var err error
 	results := make([]types.Event, len(eventJSONs))
 	for i, eventJSON := range eventJSONs {
 		result := &results[i]
@@ -191,72 +229,79 @@ func (d *Database) Events(eventNIDs []types.EventNID) ([]types.Event, error) {
 }
 
 // AddState implements input.EventDatabase
-func (d *Database) AddState(roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error) {
+func (d *Database) AddState(ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry) (types.StateSnapshotNID, error) {
+	return d.addState(ctx, nil, roomNID, stateBlockNIDs, state)
+}
+
+func (d *Database) addState(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
 	if len(state) > 0 {
-		stateBlockNID, err := d.statements.selectNextStateBlockNID()
+		stateBlockNID, err := d.statements.selectNextStateBlockNID(ctx, txn)
 		if err != nil {
 			return 0, err
 		}
-		if err = d.statements.bulkInsertStateData(stateBlockNID, state); err != nil {
+		if err = d.statements.bulkInsertStateData(ctx, txn, stateBlockNID, state); err != nil {
 			return 0, err
 		}
 		stateBlockNIDs = append(stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)], stateBlockNID)
 	}
 
-	return d.statements.insertState(roomNID, stateBlockNIDs)
+	return d.statements.insertState(ctx, txn, roomNID, stateBlockNIDs)
 }
 
 // SetState implements input.EventDatabase
-func (d *Database) SetState(eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
-	return d.statements.updateEventState(eventNID, stateNID)
+func (d *Database) SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	return d.statements.updateEventState(ctx, eventNID, stateNID)
 }
 
 // StateAtEventIDs implements input.EventDatabase
-func (d *Database) StateAtEventIDs(eventIDs []string) ([]types.StateAtEvent, error) {
-	return d.statements.bulkSelectStateAtEventByID(eventIDs)
+func (d *Database) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return d.statements.bulkSelectStateAtEventByID(ctx, nil, eventIDs)
 }
 
 // StateBlockNIDs implements state.RoomStateDatabase
-func (d *Database) StateBlockNIDs(stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
-	return d.statements.bulkSelectStateBlockNIDs(stateNIDs)
+func (d *Database) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return d.statements.bulkSelectStateBlockNIDs(ctx, nil, stateNIDs)
 }
 
 // StateEntries implements state.RoomStateDatabase
-func (d *Database) StateEntries(stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
-	return d.statements.bulkSelectStateBlockEntries(stateBlockNIDs)
+func (d *Database) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	return d.statements.bulkSelectStateBlockEntries(ctx, nil, stateBlockNIDs)
 }
 
 // EventIDs implements input.RoomEventDatabase
-func (d *Database) EventIDs(eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
-	return d.statements.bulkSelectEventID(eventNIDs)
+func (d *Database) EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error) {
+	return d.statements.bulkSelectEventID(ctx, eventNIDs)
 }
 
 // GetLatestEventsForUpdate implements input.EventDatabase
-func (d *Database) GetLatestEventsForUpdate(roomNID types.RoomNID) (types.RoomRecentEventsUpdater, error) {
-	txn, err := d.db.Begin()
+func (d *Database) GetLatestEventsForUpdate(ctx context.Context, roomNID types.RoomNID) (input.RoomRecentEventsUpdater, error) {
+	txn, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	eventNIDs, lastEventNIDSent, currentStateSnapshotNID, err := d.statements.selectLatestEventsNIDsForUpdate(txn, roomNID)
+	eventNIDs, lastEventNIDSent, currentStateSnapshotNID, err := d.statements.selectLatestEventsNIDsForUpdate(ctx, txn, roomNID)
 	if err != nil {
 		txn.Rollback()
 		return nil, err
 	}
-	stateAndRefs, err := d.statements.bulkSelectStateAtEventAndReference(txn, eventNIDs)
+	stateAndRefs, err := d.statements.bulkSelectStateAtEventAndReference(ctx, txn, eventNIDs)
 	if err != nil {
 		txn.Rollback()
 		return nil, err
 	}
 	var lastEventIDSent string
 	if lastEventNIDSent != 0 {
-		lastEventIDSent, err = d.statements.selectEventID(txn, lastEventNIDSent)
+		lastEventIDSent, err = d.statements.selectEventID(ctx, txn, lastEventNIDSent)
 		if err != nil {
 			txn.Rollback()
 			return nil, err
 		}
 	}
 	return &roomRecentEventsUpdater{
-		transaction{txn}, d, roomNID, stateAndRefs, lastEventIDSent, currentStateSnapshotNID,
+		transaction{ctx, txn}, d, roomNID, stateAndRefs, lastEventIDSent, currentStateSnapshotNID,
 	}, nil
 }
 
@@ -287,7 +332,7 @@ func (u *roomRecentEventsUpdater) CurrentStateSnapshotNID() types.StateSnapshotN
 // StorePreviousEvents implements types.RoomRecentEventsUpdater
 func (u *roomRecentEventsUpdater) StorePreviousEvents(eventNID types.EventNID, previousEventReferences []gomatrixserverlib.EventReference) error {
 	for _, ref := range previousEventReferences {
-		if err := u.d.statements.insertPreviousEvent(u.txn, ref.EventID, ref.EventSHA256, eventNID); err != nil {
+		if err := u.d.statements.insertPreviousEvent(u.ctx, u.txn, ref.EventID, ref.EventSHA256, eventNID); err != nil {
 			return err
 		}
 	}
@@ -296,7 +341,7 @@ func (u *roomRecentEventsUpdater) StorePreviousEvents(eventNID types.EventNID, p
 
 // IsReferenced implements types.RoomRecentEventsUpdater
 func (u *roomRecentEventsUpdater) IsReferenced(eventReference gomatrixserverlib.EventReference) (bool, error) {
-	err := u.d.statements.selectPreviousEventExists(u.txn, eventReference.EventID, eventReference.EventSHA256)
+	err := u.d.statements.selectPreviousEventExists(u.ctx, u.txn, eventReference.EventID, eventReference.EventSHA256)
 	if err == nil {
 		return true, nil
 	}
@@ -315,43 +360,335 @@ func (u *roomRecentEventsUpdater) SetLatestEvents(
 	for i := range latest {
 		eventNIDs[i] = latest[i].EventNID
 	}
-	return u.d.statements.updateLatestEventNIDs(u.txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID)
+	return u.d.statements.updateLatestEventNIDs(u.ctx, u.txn, roomNID, eventNIDs, lastEventNIDSent, currentStateSnapshotNID)
 }
 
 // HasEventBeenSent implements types.RoomRecentEventsUpdater
 func (u *roomRecentEventsUpdater) HasEventBeenSent(eventNID types.EventNID) (bool, error) {
-	return u.d.statements.selectEventSentToOutput(u.txn, eventNID)
+	return u.d.statements.selectEventSentToOutput(u.ctx, u.txn, eventNID)
 }
 
 // MarkEventAsSent implements types.RoomRecentEventsUpdater
 func (u *roomRecentEventsUpdater) MarkEventAsSent(eventNID types.EventNID) error {
-	return u.d.statements.updateEventSentToOutput(u.txn, eventNID)
+	return u.d.statements.updateEventSentToOutput(u.ctx, u.txn, eventNID)
+}
+
+// MarkEventAsSoftFailed implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) MarkEventAsSoftFailed(eventNID types.EventNID) error {
+	return u.d.statements.updateEventSoftFailed(u.ctx, u.txn, eventNID)
+}
+
+// StoreRelation implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) StoreRelation(eventNID types.EventNID, event gomatrixserverlib.Event) error {
+	var content common.RelatesToContent
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		// Events with content we can't decode don't relate to anything.
+		return nil
+	}
+	if content.RelatesTo == nil || content.RelatesTo.RelType == "" || content.RelatesTo.EventID == "" {
+		return nil
+	}
+	relatesTo := content.RelatesTo
+	var annotationKey string
+	if relatesTo.RelType == "m.annotation" {
+		if relatesTo.Key == "" {
+			return nil
+		}
+		annotationKey = relatesTo.Key
+	}
+	inserted, err := u.d.statements.insertEventRelation(
+		u.ctx, u.txn, eventNID, relatesTo.EventID, relatesTo.RelType,
+		event.Sender(), int64(event.OriginServerTS()), annotationKey,
+	)
+	if err != nil || !inserted {
+		// Users annotating an event with the same key twice are only counted
+		// once.
+		return err
+	}
+	switch relatesTo.RelType {
+	case "m.thread":
+		return u.d.statements.upsertThreadReply(u.ctx, u.txn, relatesTo.EventID, eventNID)
+	case "m.annotation":
+		return u.d.statements.incrementAnnotationCount(
+			u.ctx, u.txn, event.RoomID(), relatesTo.EventID, relatesTo.RelType, annotationKey,
+		)
+	}
+	return nil
+}
+
+// RedactEvent implements types.RoomRecentEventsUpdater
+func (u *roomRecentEventsUpdater) RedactEvent(redactedEventID string) error {
+	eventNID, roomNID, err := u.d.statements.selectEventNIDAndRoomNID(u.ctx, u.txn, redactedEventID)
+	if err == sql.ErrNoRows {
+		// TODO: Redact the event when we receive it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if roomNID != u.roomNID {
+		// Events can only be redacted by events in the same room.
+		return nil
+	}
+
+	eventJSON, err := u.d.statements.selectEventJSON(u.ctx, u.txn, eventNID)
+	if err != nil {
+		return err
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(eventJSON)
+	if err != nil {
+		return err
+	}
+	return u.d.redactEvent(u.ctx, u.txn, eventNID, event)
+}
+
+// redactEvent strips the event with the redaction algorithm, along with its
+// relation to other events, and marks it as redacted.
+func (d *Database) redactEvent(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, event gomatrixserverlib.Event,
+) error {
+	if err := d.statements.updateEventJSON(ctx, txn, eventNID, event.Redact().JSON()); err != nil {
+		return err
+	}
+	// The m.relates_to of the content is stripped by the redaction.
+	relatesToID, relType, annotationKey, err := d.statements.deleteEventRelation(ctx, txn, eventNID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		switch relType {
+		case "m.thread":
+			err = d.statements.decrementThreadReplyCount(ctx, txn, relatesToID)
+		case "m.annotation":
+			err = d.statements.decrementAnnotationCount(
+				ctx, txn, event.RoomID(), relatesToID, relType, annotationKey,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return d.statements.updateEventRedacted(ctx, txn, eventNID)
+}
+
+// The state of the room is looked up and stored in the transaction of the
+// updater, so that the state snapshots stored while updating the latest events
+// are only committed along with them, and so that SQLite, which only allows
+// one writer at a time, doesn't wait on this transaction to store them.
+
+// AddState implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) AddState(
+	ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	return u.d.addState(ctx, u.txn, roomNID, stateBlockNIDs, state)
+}
+
+// StateAtEventIDs implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) StateAtEventIDs(ctx context.Context, eventIDs []string) ([]types.StateAtEvent, error) {
+	return u.d.statements.bulkSelectStateAtEventByID(ctx, u.txn, eventIDs)
+}
+
+// EventTypeNIDs implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) EventTypeNIDs(ctx context.Context, eventTypes []string) (map[string]types.EventTypeNID, error) {
+	return u.d.statements.bulkSelectEventTypeNID(ctx, u.txn, eventTypes)
+}
+
+// EventStateKeyNIDs implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) EventStateKeyNIDs(ctx context.Context, eventStateKeys []string) (map[string]types.EventStateKeyNID, error) {
+	return u.d.statements.bulkSelectEventStateKeyNID(ctx, u.txn, eventStateKeys)
+}
+
+// StateBlockNIDs implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error) {
+	return u.d.statements.bulkSelectStateBlockNIDs(ctx, u.txn, stateNIDs)
+}
+
+// StateEntries implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error) {
+	return u.d.statements.bulkSelectStateBlockEntries(ctx, u.txn, stateBlockNIDs)
+}
+
+// StateEntriesForTuples implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) StateEntriesForTuples(
+	ctx context.Context,
+	stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
+) ([]types.StateEntryList, error) {
+	return u.d.statements.bulkSelectFilteredStateBlockEntries(ctx, u.txn, stateBlockNIDs, stateKeyTuples)
+}
+
+// Events implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	return u.d.events(ctx, u.txn, eventNIDs)
+}
+
+// EventsFromIDs implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error) {
+	return u.d.eventsFromIDs(ctx, u.txn, eventIDs)
+}
+
+// RoomVersion implements state.RoomStateDatabase
+func (u *roomRecentEventsUpdater) RoomVersion(ctx context.Context, roomNID types.RoomNID) (string, error) {
+	return u.d.statements.selectRoomVersion(ctx, u.txn, roomNID)
 }
 
 func (u *roomRecentEventsUpdater) MembershipUpdater(targetUserNID types.EventStateKeyNID) (types.MembershipUpdater, error) {
-	return u.d.membershipUpdaterTxn(u.txn, u.roomNID, targetUserNID)
+	return u.d.membershipUpdaterTxn(u.ctx, u.txn, u.roomNID, targetUserNID)
+}
+
+// PurgeHistory deletes the events of the room which aren't state events and
+// are less deep in the event graph than the given event, along with the state
+// snapshots and state blocks only they used. The latest events of the room are
+// never deleted, so neither are its forward extremities.
+// The room is locked while it is purged, and either all or none of the events
+// are deleted.
+// Returns the IDs of the deleted events.
+func (d *Database) PurgeHistory(
+	ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID,
+) (purgedEventIDs []string, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		latestEventNIDs, lastEventNIDSent, _, err := d.statements.selectLatestEventsNIDsForUpdate(ctx, txn, roomNID)
+		if err != nil {
+			return err
+		}
+		depth, err := d.statements.selectEventDepth(ctx, txn, eventNID)
+		if err != nil {
+			return err
+		}
+		// The last event sent to the output log is looked up when new events
+		// arrive, so it must be kept too.
+		keptEventNIDs := append(latestEventNIDs, lastEventNIDSent)
+		eventNIDs, eventIDs, stateNIDs, err := d.statements.selectEventsToPurge(ctx, txn, roomNID, depth, keptEventNIDs)
+		if err != nil || len(eventNIDs) == 0 {
+			return err
+		}
+		if err = d.statements.bulkDeleteEventJSON(ctx, txn, eventNIDs); err != nil {
+			return err
+		}
+		if err = d.statements.bulkDeleteEvents(ctx, txn, eventNIDs); err != nil {
+			return err
+		}
+		if err = d.statements.bulkDeleteEventRelations(ctx, txn, eventNIDs); err != nil {
+			return err
+		}
+		stateBlockNIDs, err := d.statements.deleteUnreferencedStateSnapshots(ctx, txn, roomNID, stateNIDs)
+		if err != nil {
+			return err
+		}
+		if err = d.statements.deleteUnreferencedStateBlocks(ctx, txn, stateBlockNIDs); err != nil {
+			return err
+		}
+		purgedEventIDs = eventIDs
+		return nil
+	})
+	return
+}
+
+// SetPurgeStatus sets the status of the purge of the history of the room with
+// the given ID.
+func (d *Database) SetPurgeStatus(ctx context.Context, purgeID, roomID, status string) error {
+	return d.statements.upsertPurgeStatus(ctx, purgeID, roomID, status)
+}
+
+// PurgeStatus returns the status of the purge with the given ID, or "" if
+// there is no such purge.
+func (d *Database) PurgeStatus(ctx context.Context, purgeID string) (string, error) {
+	return d.statements.selectPurgeStatus(ctx, purgeID)
+}
+
+// UpdatePurgeStatuses replaces the status of every purge with the old status
+// by the new status.
+func (d *Database) UpdatePurgeStatuses(ctx context.Context, oldStatus, newStatus string) error {
+	return d.statements.updatePurgeStatuses(ctx, oldStatus, newStatus)
 }
 
 // RoomNID implements query.RoomserverQueryAPIDB
-func (d *Database) RoomNID(roomID string) (types.RoomNID, error) {
-	roomNID, err := d.statements.selectRoomNID(nil, roomID)
+func (d *Database) RoomNID(ctx context.Context, roomID string) (types.RoomNID, error) {
+	roomNID, err := d.statements.selectRoomNID(ctx, nil, roomID)
 	if err == sql.ErrNoRows {
 		return 0, nil
 	}
 	return roomNID, err
 }
 
+// RoomVersion implements state.RoomStateDatabase
+func (d *Database) RoomVersion(ctx context.Context, roomNID types.RoomNID) (string, error) {
+	return d.statements.selectRoomVersion(ctx, nil, roomNID)
+}
+
+// RoomCount implements input.RoomEventDatabase
+func (d *Database) RoomCount(ctx context.Context) (int64, error) {
+	return d.statements.selectRoomCount(ctx)
+}
+
+// RoomIDsWithManyLatestEvents implements extremities.Database
+func (d *Database) RoomIDsWithManyLatestEvents(ctx context.Context, maxLatestEvents int) ([]string, error) {
+	return d.statements.selectRoomIDsWithManyLatestEvents(ctx, maxLatestEvents)
+}
+
+// RoomIDsWithEventType implements retention.Database
+func (d *Database) RoomIDsWithEventType(ctx context.Context, eventType string) ([]string, error) {
+	eventTypeNID, err := d.statements.selectEventTypeNID(ctx, eventType)
+	if err == sql.ErrNoRows {
+		// No event of this type was ever stored.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.statements.selectRoomIDsWithEventType(ctx, eventTypeNID)
+}
+
+// ExpireEvents redacts the events of the room which aren't state events and
+// were sent before the given time, up to the given number of events, and
+// returns their IDs. The events are looked at from the least deep in the event
+// graph, stopping at the first one which isn't old enough. The latest events of
+// the room are never redacted.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) ExpireEvents(
+	ctx context.Context, roomNID types.RoomNID, before gomatrixserverlib.Timestamp, limit int,
+) (expiredEventIDs []string, err error) {
+	err = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		latestEventNIDs, _, _, err := d.statements.selectLatestEventsNIDsForUpdate(ctx, txn, roomNID)
+		if err != nil {
+			return err
+		}
+		eventNIDs, err := d.statements.selectEventsToExpire(ctx, txn, roomNID, latestEventNIDs, limit)
+		if err != nil {
+			return err
+		}
+		for _, eventNID := range eventNIDs {
+			eventJSON, err := d.statements.selectEventJSON(ctx, txn, eventNID)
+			if err != nil {
+				return err
+			}
+			event, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false)
+			if err != nil {
+				return err
+			}
+			if event.OriginServerTS() >= before {
+				break
+			}
+			if err = d.redactEvent(ctx, txn, eventNID, event); err != nil {
+				return err
+			}
+			expiredEventIDs = append(expiredEventIDs, event.EventID())
+		}
+		return nil
+	})
+	return
+}
+
 // LatestEventIDs implements query.RoomserverQueryAPIDatabase
-func (d *Database) LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error) {
-	eventNIDs, currentStateSnapshotNID, err := d.statements.selectLatestEventNIDs(roomNID)
+func (d *Database) LatestEventIDs(ctx context.Context, roomNID types.RoomNID) ([]gomatrixserverlib.EventReference, types.StateSnapshotNID, int64, error) {
+	eventNIDs, currentStateSnapshotNID, err := d.statements.selectLatestEventNIDs(ctx, roomNID)
 	if err != nil {
 		return nil, 0, 0, err
 	}
-	references, err := d.statements.bulkSelectEventReference(eventNIDs)
+	references, err := d.statements.bulkSelectEventReference(ctx, eventNIDs)
 	if err != nil {
 		return nil, 0, 0, err
 	}
-	depth, err := d.statements.selectMaxEventDepth(eventNIDs)
+	depth, err := d.statements.selectMaxEventDepth(ctx, eventNIDs)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -360,41 +697,73 @@ func (d *Database) LatestEventIDs(roomNID types.RoomNID) ([]gomatrixserverlib.Ev
 
 // GetInvitesForUser implements query.RoomserverQueryAPIDatabase
 func (d *Database) GetInvitesForUser(
+	ctx context.Context,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (senderUserIDs []types.EventStateKeyNID, err error) {
-	return d.statements.selectInviteActiveForUserInRoom(targetUserNID, roomNID)
+	return d.statements.selectInviteActiveForUserInRoom(ctx, targetUserNID, roomNID)
 }
 
 // SetRoomAlias implements alias.RoomserverAliasAPIDB
-func (d *Database) SetRoomAlias(alias string, roomID string) error {
-	return d.statements.insertRoomAlias(alias, roomID)
+func (d *Database) SetRoomAlias(ctx context.Context, alias string, roomID string, creatorUserID string) error {
+	return d.statements.insertRoomAlias(ctx, alias, roomID, creatorUserID)
 }
 
 // GetRoomIDFromAlias implements alias.RoomserverAliasAPIDB
-func (d *Database) GetRoomIDFromAlias(alias string) (string, error) {
-	return d.statements.selectRoomIDFromAlias(alias)
+func (d *Database) GetRoomIDFromAlias(ctx context.Context, alias string) (string, error) {
+	return d.statements.selectRoomIDFromAlias(ctx, alias)
 }
 
 // GetAliasesFromRoomID implements alias.RoomserverAliasAPIDB
-func (d *Database) GetAliasesFromRoomID(roomID string) ([]string, error) {
-	return d.statements.selectAliasesFromRoomID(roomID)
+func (d *Database) GetAliasesFromRoomID(ctx context.Context, roomID string) ([]string, error) {
+	return d.statements.selectAliasesFromRoomID(ctx, roomID)
+}
+
+// GetCreatorIDForAlias implements alias.RoomserverAliasAPIDB
+func (d *Database) GetCreatorIDForAlias(ctx context.Context, alias string) (string, error) {
+	return d.statements.selectCreatorIDFromAlias(ctx, alias)
 }
 
 // RemoveRoomAlias implements alias.RoomserverAliasAPIDB
-func (d *Database) RemoveRoomAlias(alias string) error {
-	return d.statements.deleteRoomAlias(alias)
+func (d *Database) RemoveRoomAlias(ctx context.Context, alias string) error {
+	return d.statements.deleteRoomAlias(ctx, alias)
+}
+
+// SetReceipt implements receipt.RoomserverReceiptAPIDatabase
+func (d *Database) SetReceipt(ctx context.Context, receipt api.Receipt) (int64, error) {
+	return d.statements.upsertReceipt(ctx, receipt)
+}
+
+// GetReceiptsInRooms implements receipt.RoomserverReceiptAPIDatabase
+func (d *Database) GetReceiptsInRooms(
+	ctx context.Context, roomIDs []string, afterPos int64,
+) ([]api.Receipt, int64, error) {
+	// Find the latest position first, so that the receipts returned are
+	// exactly the ones up to the position the caller is told about.
+	maxPos, err := d.statements.selectMaxReceiptID(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if maxPos <= afterPos {
+		return nil, afterPos, nil
+	}
+	receipts, err := d.statements.selectReceiptsInRooms(ctx, roomIDs, afterPos, maxPos)
+	if err != nil {
+		return nil, 0, err
+	}
+	return receipts, maxPos, nil
 }
 
 // StateEntriesForTuples implements state.RoomStateDatabase
 func (d *Database) StateEntriesForTuples(
+	ctx context.Context,
 	stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple,
 ) ([]types.StateEntryList, error) {
-	return d.statements.bulkSelectFilteredStateBlockEntries(stateBlockNIDs, stateKeyTuples)
+	return d.statements.bulkSelectFilteredStateBlockEntries(ctx, nil, stateBlockNIDs, stateKeyTuples)
 }
 
 // MembershipUpdater implements input.RoomEventDatabase
-func (d *Database) MembershipUpdater(roomID, targetUserID string) (types.MembershipUpdater, error) {
-	txn, err := d.db.Begin()
+func (d *Database) MembershipUpdater(ctx context.Context, roomID, targetUserID string) (types.MembershipUpdater, error) {
+	txn, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -405,17 +774,17 @@ func (d *Database) MembershipUpdater(roomID, targetUserID string) (types.Members
 		}
 	}()
 
-	roomNID, err := d.assignRoomNID(txn, roomID)
+	roomNID, err := d.assignRoomNID(ctx, txn, roomID)
 	if err != nil {
 		return nil, err
 	}
 
-	targetUserNID, err := d.assignStateKeyNID(txn, targetUserID)
+	targetUserNID, err := d.assignStateKeyNID(ctx, txn, targetUserID)
 	if err != nil {
 		return nil, err
 	}
 
-	updater, err := d.membershipUpdaterTxn(txn, roomNID, targetUserNID)
+	updater, err := d.membershipUpdaterTxn(ctx, txn, roomNID, targetUserNID)
 	if err != nil {
 		return nil, err
 	}
@@ -433,20 +802,21 @@ type membershipUpdater struct {
 }
 
 func (d *Database) membershipUpdaterTxn(
+	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (types.MembershipUpdater, error) {
 
-	if err := d.statements.insertMembership(txn, roomNID, targetUserNID); err != nil {
+	if err := d.statements.insertMembership(ctx, txn, roomNID, targetUserNID); err != nil {
 		return nil, err
 	}
 
-	membership, err := d.statements.selectMembershipForUpdate(txn, roomNID, targetUserNID)
+	membership, err := d.statements.selectMembershipForUpdate(ctx, txn, roomNID, targetUserNID)
 	if err != nil {
 		return nil, err
 	}
 
 	return &membershipUpdater{
-		transaction{txn}, d, roomNID, targetUserNID, membership,
+		transaction{ctx, txn}, d, roomNID, targetUserNID, membership,
 	}, nil
 }
 
@@ -467,19 +837,19 @@ func (u *membershipUpdater) IsLeave() bool {
 
 // SetToInvite implements types.MembershipUpdater
 func (u *membershipUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, error) {
-	senderUserNID, err := u.d.assignStateKeyNID(u.txn, event.Sender())
+	senderUserNID, err := u.d.assignStateKeyNID(u.ctx, u.txn, event.Sender())
 	if err != nil {
 		return false, err
 	}
 	inserted, err := u.d.statements.insertInviteEvent(
-		u.txn, event.EventID(), u.roomNID, u.targetUserNID, senderUserNID, event.JSON(),
+		u.ctx, u.txn, event.EventID(), u.roomNID, u.targetUserNID, senderUserNID, event.JSON(),
 	)
 	if err != nil {
 		return false, err
 	}
 	if u.membership != membershipStateInvite {
 		if err = u.d.statements.updateMembership(
-			u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateInvite, 0,
+			u.ctx, u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateInvite, 0,
 		); err != nil {
 			return false, err
 		}
@@ -491,7 +861,7 @@ func (u *membershipUpdater) SetToInvite(event gomatrixserverlib.Event) (bool, er
 func (u *membershipUpdater) SetToJoin(senderUserID string, eventID string, isUpdate bool) ([]string, error) {
 	var inviteEventIDs []string
 
-	senderUserNID, err := u.d.assignStateKeyNID(u.txn, senderUserID)
+	senderUserNID, err := u.d.assignStateKeyNID(u.ctx, u.txn, senderUserID)
 	if err != nil {
 		return nil, err
 	}
@@ -499,7 +869,7 @@ func (u *membershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 	// If this is a join event update, there is no invite to update
 	if !isUpdate {
 		inviteEventIDs, err = u.d.statements.updateInviteRetired(
-			u.txn, u.roomNID, u.targetUserNID,
+			u.ctx, u.txn, u.roomNID, u.targetUserNID,
 		)
 		if err != nil {
 			return nil, err
@@ -507,14 +877,14 @@ func (u *membershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 	}
 
 	// Look up the NID of the new join event
-	nIDs, err := u.d.EventNIDs([]string{eventID})
+	nIDs, err := u.d.EventNIDs(u.ctx, []string{eventID})
 	if err != nil {
 		return nil, err
 	}
 
 	if u.membership != membershipStateJoin || isUpdate {
 		if err = u.d.statements.updateMembership(
-			u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateJoin, nIDs[eventID],
+			u.ctx, u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateJoin, nIDs[eventID],
 		); err != nil {
 			return nil, err
 		}
@@ -525,26 +895,26 @@ func (u *membershipUpdater) SetToJoin(senderUserID string, eventID string, isUpd
 
 // SetToLeave implements types.MembershipUpdater
 func (u *membershipUpdater) SetToLeave(senderUserID string, eventID string) ([]string, error) {
-	senderUserNID, err := u.d.assignStateKeyNID(u.txn, senderUserID)
+	senderUserNID, err := u.d.assignStateKeyNID(u.ctx, u.txn, senderUserID)
 	if err != nil {
 		return nil, err
 	}
 	inviteEventIDs, err := u.d.statements.updateInviteRetired(
-		u.txn, u.roomNID, u.targetUserNID,
+		u.ctx, u.txn, u.roomNID, u.targetUserNID,
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	// Look up the NID of the new leave event
-	nIDs, err := u.d.EventNIDs([]string{eventID})
+	nIDs, err := u.d.EventNIDs(u.ctx, []string{eventID})
 	if err != nil {
 		return nil, err
 	}
 
 	if u.membership != membershipStateLeaveOrBan {
 		if err = u.d.statements.updateMembership(
-			u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateLeaveOrBan, nIDs[eventID],
+			u.ctx, u.txn, u.roomNID, u.targetUserNID, senderUserNID, membershipStateLeaveOrBan, nIDs[eventID],
 		); err != nil {
 			return nil, err
 		}
@@ -552,20 +922,59 @@ func (u *membershipUpdater) SetToLeave(senderUserID string, eventID string) ([]s
 	return inviteEventIDs, nil
 }
 
+// EventsInRange implements query.RoomserverQueryAPIDB
+func (d *Database) EventsInRange(
+	ctx context.Context,
+	roomNID types.RoomNID, low, high types.EventNID, backwards bool, limit int,
+) ([]types.StateAtEvent, error) {
+	return d.statements.selectEventsInRange(ctx, roomNID, low, high, backwards, limit)
+}
+
+// EventRelations implements query.RoomserverQueryAPIDB
+func (d *Database) EventRelations(
+	ctx context.Context, eventIDs []string, relType string,
+) ([]types.EventRelation, error) {
+	return d.statements.selectEventRelations(ctx, eventIDs, relType)
+}
+
+// EventRelationsBefore implements query.RoomserverQueryAPIDB
+func (d *Database) EventRelationsBefore(
+	ctx context.Context, eventID, relType string, before types.EventNID, limit int,
+) ([]types.EventRelation, error) {
+	return d.statements.selectEventRelationsBefore(ctx, eventID, relType, before, limit)
+}
+
+// RelatedEventIDsForSender implements query.RoomserverQueryAPIDB
+func (d *Database) RelatedEventIDsForSender(
+	ctx context.Context, eventIDs []string, relType, sender string,
+) ([]string, error) {
+	return d.statements.selectRelatedEventIDsForSender(ctx, eventIDs, relType, sender)
+}
+
+// Annotations implements query.RoomserverQueryAPIDB
+func (d *Database) Annotations(ctx context.Context, eventIDs []string) ([]types.Annotation, error) {
+	return d.statements.selectAnnotations(ctx, eventIDs)
+}
+
+// ThreadRoots implements query.RoomserverQueryAPIDB
+func (d *Database) ThreadRoots(ctx context.Context, eventIDs []string) ([]types.ThreadRoot, error) {
+	return d.statements.selectThreadRoots(ctx, eventIDs)
+}
+
 // GetMembership implements query.RoomserverQueryAPIDB
-func (d *Database) GetMembership(roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error) {
-	txn, err := d.db.Begin()
+func (d *Database) GetMembership(ctx context.Context, roomNID types.RoomNID, requestSenderUserID string) (membershipEventNID types.EventNID, stillInRoom bool, err error) {
+	txn, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return
 	}
 	defer txn.Commit()
 
-	requestSenderUserNID, err := d.assignStateKeyNID(txn, requestSenderUserID)
+	requestSenderUserNID, err := d.assignStateKeyNID(ctx, txn, requestSenderUserID)
 	if err != nil {
 		return
 	}
 
-	senderMembershipEventNID, senderMembership, err := d.statements.selectMembershipFromRoomAndTarget(roomNID, requestSenderUserNID)
+	senderMembershipEventNID, senderMembership, err := d.statements.selectMembershipFromRoomAndTarget(ctx, roomNID, requestSenderUserNID)
 	if err == sql.ErrNoRows {
 		// The user has never been a member of that room
 		return 0, false, nil
@@ -577,15 +986,16 @@ func (d *Database) GetMembership(roomNID types.RoomNID, requestSenderUserID stri
 }
 
 // GetMembershipEventNIDsForRoom implements query.RoomserverQueryAPIDB
-func (d *Database) GetMembershipEventNIDsForRoom(roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error) {
+func (d *Database) GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool) ([]types.EventNID, error) {
 	if joinOnly {
-		return d.statements.selectMembershipsFromRoomAndMembership(roomNID, membershipStateJoin)
+		return d.statements.selectMembershipsFromRoomAndMembership(ctx, roomNID, membershipStateJoin)
 	}
 
-	return d.statements.selectMembershipsFromRoom(roomNID)
+	return d.statements.selectMembershipsFromRoom(ctx, roomNID)
 }
 
 type transaction struct {
+	ctx context.Context
 	txn *sql.Tx
 }
 
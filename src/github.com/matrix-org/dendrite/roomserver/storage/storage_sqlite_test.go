@@ -0,0 +1,403 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build sqlite
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// newSQLiteTestDatabase opens a room server database in a new SQLite file.
+// The returned function removes the file.
+func newSQLiteTestDatabase(t *testing.T) (*Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-roomserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open("file:" + filepath.Join(dir, "roomserver.db"))
+	if err != nil {
+		os.RemoveAll(dir) // nolint: errcheck
+		t.Fatalf("Open: %v", err)
+	}
+	return db, func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+// buildTestEvent builds an event signed with a new key.
+func buildTestEvent(
+	t *testing.T, eventID, eventType string, stateKey *string,
+	prevEvents []gomatrixserverlib.EventReference, depth int64,
+) gomatrixserverlib.Event {
+	return buildTestEventAt(t, time.Now(), eventID, eventType, stateKey, prevEvents, depth)
+}
+
+// buildTestEventAt builds an event sent at the given time, signed with a new
+// key.
+func buildTestEventAt(
+	t *testing.T, ts time.Time, eventID, eventType string, stateKey *string,
+	prevEvents []gomatrixserverlib.EventReference, depth int64,
+) gomatrixserverlib.Event {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:     "@alice:localhost",
+		RoomID:     "!room:localhost",
+		Type:       eventType,
+		StateKey:   stateKey,
+		PrevEvents: prevEvents,
+		Depth:      depth,
+	}
+	if err = builder.SetContent(map[string]string{"creator": "@alice:localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	event, err := builder.Build(eventID, ts, "localhost", "ed25519:test", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestSQLiteLatestEvents(t *testing.T) {
+	db, removeDB := newSQLiteTestDatabase(t)
+	defer removeDB()
+	ctx := context.Background()
+
+	emptyStateKey := ""
+	create := buildTestEvent(t, "$create:localhost", "m.room.create", &emptyStateKey, nil, 1)
+	roomNID, _, err := db.StoreEvent(ctx, create, nil)
+	if err != nil {
+		t.Fatalf("StoreEvent: %v", err)
+	}
+	message := buildTestEvent(
+		t, "$message:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{create.EventReference()}, 2,
+	)
+	if _, _, err = db.StoreEvent(ctx, message, nil); err != nil {
+		t.Fatalf("StoreEvent: %v", err)
+	}
+	reply := buildTestEvent(
+		t, "$reply:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{message.EventReference()}, 3,
+	)
+	_, stateAtReply, err := db.StoreEvent(ctx, reply, nil)
+	if err != nil {
+		t.Fatalf("StoreEvent: %v", err)
+	}
+
+	// Event types that aren't one of the well known ones get numeric IDs
+	// after the ones reserved for them.
+	typeNIDs, err := db.EventTypeNIDs(ctx, []string{"org.example.message"})
+	if err != nil {
+		t.Fatalf("EventTypeNIDs: %v", err)
+	}
+	if typeNIDs["org.example.message"] <= 65535 {
+		t.Errorf("EventTypeNIDs: got %d, want a numeric ID after 65535", typeNIDs["org.example.message"])
+	}
+
+	// The state is stored through the updater, in its transaction, which
+	// holds the write lock of the database until it is committed.
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("GetLatestEventsForUpdate: %v", err)
+	}
+	entries, err := db.StateEntriesForEventIDs(ctx, []string{create.EventID()})
+	if err != nil {
+		t.Fatalf("StateEntriesForEventIDs: %v", err)
+	}
+	snapshotNID, err := updater.AddState(ctx, roomNID, nil, entries)
+	if err != nil {
+		t.Fatalf("AddState: %v", err)
+	}
+	if err = updater.StorePreviousEvents(stateAtReply.EventNID, reply.PrevEvents()); err != nil {
+		t.Fatalf("StorePreviousEvents: %v", err)
+	}
+	// Storing them again leaves them unchanged.
+	if err = updater.StorePreviousEvents(stateAtReply.EventNID, reply.PrevEvents()); err != nil {
+		t.Fatalf("StorePreviousEvents: %v", err)
+	}
+	referenced, err := updater.IsReferenced(message.EventReference())
+	if err != nil {
+		t.Fatalf("IsReferenced: %v", err)
+	}
+	if !referenced {
+		t.Errorf("IsReferenced: got false for %s, want true", message.EventID())
+	}
+	latest := []types.StateAtEventAndReference{{
+		StateAtEvent:   stateAtReply,
+		EventReference: reply.EventReference(),
+	}}
+	if err = updater.SetLatestEvents(roomNID, latest, stateAtReply.EventNID, snapshotNID); err != nil {
+		t.Fatalf("SetLatestEvents: %v", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	refs, currentNID, _, err := db.LatestEventIDs(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("LatestEventIDs: %v", err)
+	}
+	if len(refs) != 1 || refs[0].EventID != reply.EventID() || currentNID != snapshotNID {
+		t.Errorf("LatestEventIDs: got %v at %d, want %s at %d", refs, currentNID, reply.EventID(), snapshotNID)
+	}
+
+	blockNIDs, err := db.StateBlockNIDs(ctx, []types.StateSnapshotNID{snapshotNID})
+	if err != nil {
+		t.Fatalf("StateBlockNIDs: %v", err)
+	}
+	if len(blockNIDs) != 1 {
+		t.Fatalf("StateBlockNIDs: got %v, want the blocks of %d", blockNIDs, snapshotNID)
+	}
+	stateEntries, err := db.StateEntries(ctx, blockNIDs[0].StateBlockNIDs)
+	if err != nil {
+		t.Fatalf("StateEntries: %v", err)
+	}
+	if len(stateEntries) != 1 || len(stateEntries[0].StateEntries) != 1 ||
+		stateEntries[0].StateEntries[0] != entries[0] {
+		t.Errorf("StateEntries: got %v, want %v", stateEntries, entries)
+	}
+
+	// Purging the history before the reply removes the message but keeps
+	// the create event, as it is a state event.
+	purged, err := db.PurgeHistory(ctx, roomNID, stateAtReply.EventNID)
+	if err != nil {
+		t.Fatalf("PurgeHistory: %v", err)
+	}
+	if len(purged) != 1 || purged[0] != message.EventID() {
+		t.Errorf("PurgeHistory: got %v, want [%s]", purged, message.EventID())
+	}
+	events, err := db.EventsFromIDs(ctx, []string{create.EventID(), message.EventID(), reply.EventID()})
+	if err != nil {
+		t.Fatalf("EventsFromIDs: %v", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("EventsFromIDs: got %d events, want the create event and the reply", len(events))
+	}
+}
+
+func TestSQLitePurgeHistory(t *testing.T) {
+	db, removeDB := newSQLiteTestDatabase(t)
+	defer removeDB()
+	ctx := context.Background()
+
+	// The room has a message, a topic and another message, followed by a
+	// reply. A side branch with an old message is also a forward extremity.
+	emptyStateKey := ""
+	create := buildTestEvent(t, "$create:localhost", "m.room.create", &emptyStateKey, nil, 1)
+	first := buildTestEvent(t, "$first:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{create.EventReference()}, 2)
+	side := buildTestEvent(t, "$side:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{first.EventReference()}, 3)
+	topic := buildTestEvent(t, "$topic:localhost", "m.room.topic", &emptyStateKey,
+		[]gomatrixserverlib.EventReference{first.EventReference()}, 3)
+	second := buildTestEvent(t, "$second:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{topic.EventReference()}, 4)
+	reply := buildTestEvent(t, "$reply:localhost", "org.example.message", nil,
+		[]gomatrixserverlib.EventReference{second.EventReference()}, 5)
+	var roomNID types.RoomNID
+	stateAtEvents := map[string]types.StateAtEvent{}
+	for _, event := range []gomatrixserverlib.Event{create, first, side, topic, second, reply} {
+		var err error
+		if roomNID, stateAtEvents[event.EventID()], err = db.StoreEvent(ctx, event, nil); err != nil {
+			t.Fatalf("StoreEvent: %v", err)
+		}
+	}
+
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("GetLatestEventsForUpdate: %v", err)
+	}
+	latest := []types.StateAtEventAndReference{
+		{StateAtEvent: stateAtEvents[side.EventID()], EventReference: side.EventReference()},
+		{StateAtEvent: stateAtEvents[reply.EventID()], EventReference: reply.EventReference()},
+	}
+	if err = updater.SetLatestEvents(roomNID, latest, stateAtEvents[reply.EventID()].EventNID, 0); err != nil {
+		t.Fatalf("SetLatestEvents: %v", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// Purging the history before the second message only purges the first
+	// message, the only one less deep than it.
+	purged, err := db.PurgeHistory(ctx, roomNID, stateAtEvents[second.EventID()].EventNID)
+	if err != nil {
+		t.Fatalf("PurgeHistory: %v", err)
+	}
+	if len(purged) != 1 || purged[0] != first.EventID() {
+		t.Errorf("PurgeHistory: got %v, want [%s]", purged, first.EventID())
+	}
+
+	// Purging the history before the reply purges the second message, but
+	// keeps the state events and the forward extremities of the room.
+	purged, err = db.PurgeHistory(ctx, roomNID, stateAtEvents[reply.EventID()].EventNID)
+	if err != nil {
+		t.Fatalf("PurgeHistory: %v", err)
+	}
+	if len(purged) != 1 || purged[0] != second.EventID() {
+		t.Errorf("PurgeHistory: got %v, want [%s]", purged, second.EventID())
+	}
+	eventIDs := []string{create.EventID(), first.EventID(), side.EventID(), topic.EventID(), second.EventID(), reply.EventID()}
+	events, err := db.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventsFromIDs: %v", err)
+	}
+	kept := map[string]bool{}
+	for _, event := range events {
+		kept[event.EventID()] = true
+	}
+	for _, eventID := range eventIDs {
+		want := eventID != first.EventID() && eventID != second.EventID()
+		if kept[eventID] != want {
+			t.Errorf("EventsFromIDs: got %s kept %t, want %t", eventID, kept[eventID], want)
+		}
+	}
+}
+
+func TestSQLiteExpireEvents(t *testing.T) {
+	db, removeDB := newSQLiteTestDatabase(t)
+	defer removeDB()
+	ctx := context.Background()
+
+	// The room has old messages with a topic and a redaction between them,
+	// then a recent message, an old message sent after it, e.g. by a server
+	// with a slow clock, and an old message which is the latest event.
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	emptyStateKey := ""
+	var events []gomatrixserverlib.Event
+	addEvent := func(ts time.Time, eventID, eventType string, stateKey *string) gomatrixserverlib.Event {
+		var prevEvents []gomatrixserverlib.EventReference
+		if len(events) > 0 {
+			prevEvents = []gomatrixserverlib.EventReference{events[len(events)-1].EventReference()}
+		}
+		event := buildTestEventAt(t, ts, eventID, eventType, stateKey, prevEvents, int64(len(events)+1))
+		events = append(events, event)
+		return event
+	}
+	create := addEvent(old, "$create:localhost", "m.room.create", &emptyStateKey)
+	first := addEvent(old, "$first:localhost", "org.example.message", nil)
+	topic := addEvent(old, "$topic:localhost", "m.room.topic", &emptyStateKey)
+	redaction := addEvent(old, "$redaction:localhost", "m.room.redaction", nil)
+	second := addEvent(old, "$second:localhost", "org.example.message", nil)
+	recent := addEvent(now, "$recent:localhost", "org.example.message", nil)
+	late := addEvent(old, "$late:localhost", "org.example.message", nil)
+	latest := addEvent(old, "$latest:localhost", "org.example.message", nil)
+
+	var roomNID types.RoomNID
+	var stateAtLatest types.StateAtEvent
+	var eventNIDs []types.EventNID
+	for _, event := range events {
+		var stateAtEvent types.StateAtEvent
+		var err error
+		if roomNID, stateAtEvent, err = db.StoreEvent(ctx, event, nil); err != nil {
+			t.Fatalf("StoreEvent: %v", err)
+		}
+		eventNIDs = append(eventNIDs, stateAtEvent.EventNID)
+		stateAtLatest = stateAtEvent
+	}
+	updater, err := db.GetLatestEventsForUpdate(ctx, roomNID)
+	if err != nil {
+		t.Fatalf("GetLatestEventsForUpdate: %v", err)
+	}
+	// Only the events sent to the output log can expire.
+	for _, eventNID := range eventNIDs {
+		if err = updater.MarkEventAsSent(eventNID); err != nil {
+			t.Fatalf("MarkEventAsSent: %v", err)
+		}
+	}
+	latestEvents := []types.StateAtEventAndReference{
+		{StateAtEvent: stateAtLatest, EventReference: latest.EventReference()},
+	}
+	if err = updater.SetLatestEvents(roomNID, latestEvents, stateAtLatest.EventNID, 0); err != nil {
+		t.Fatalf("SetLatestEvents: %v", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// The old messages expire, but not the state events or the redaction.
+	// The recent message stops the expiry, so the late one is kept.
+	before := gomatrixserverlib.AsTimestamp(now.Add(-time.Hour))
+	expired, err := db.ExpireEvents(ctx, roomNID, before, 10)
+	if err != nil {
+		t.Fatalf("ExpireEvents: %v", err)
+	}
+	if len(expired) != 2 || expired[0] != first.EventID() || expired[1] != second.EventID() {
+		t.Errorf("ExpireEvents: got %v, want [%s %s]", expired, first.EventID(), second.EventID())
+	}
+	// The expired events are redacted, and don't expire again.
+	expired, err = db.ExpireEvents(ctx, roomNID, before, 10)
+	if err != nil {
+		t.Fatalf("ExpireEvents: %v", err)
+	}
+	if len(expired) != 0 {
+		t.Errorf("ExpireEvents: got %v, want no events", expired)
+	}
+
+	stored, err := db.EventsFromIDs(ctx, []string{
+		create.EventID(), first.EventID(), topic.EventID(), redaction.EventID(),
+		second.EventID(), recent.EventID(), late.EventID(), latest.EventID(),
+	})
+	if err != nil {
+		t.Fatalf("EventsFromIDs: %v", err)
+	}
+	if len(stored) != len(events) {
+		t.Fatalf("EventsFromIDs: got %d events, want %d", len(stored), len(events))
+	}
+	for _, event := range stored {
+		wantRedacted := event.EventID() == first.EventID() || event.EventID() == second.EventID()
+		if redacted := string(event.Content()) == "{}"; redacted != wantRedacted {
+			t.Errorf("EventsFromIDs: got %s redacted %t, want %t", event.EventID(), redacted, wantRedacted)
+		}
+	}
+}
+
+func TestSQLitePurgeStatus(t *testing.T) {
+	db, removeDB := newSQLiteTestDatabase(t)
+	defer removeDB()
+	ctx := context.Background()
+
+	if status, err := db.PurgeStatus(ctx, "unknown"); err != nil || status != "" {
+		t.Errorf("PurgeStatus: got (%q, %v) for an unknown purge, want none", status, err)
+	}
+	for _, purge := range []struct{ purgeID, status string }{
+		{"a", "active"}, {"b", "active"}, {"b", "complete"}, {"c", "active"},
+	} {
+		if err := db.SetPurgeStatus(ctx, purge.purgeID, "!room:localhost", purge.status); err != nil {
+			t.Fatalf("SetPurgeStatus: %v", err)
+		}
+	}
+	if err := db.UpdatePurgeStatuses(ctx, "active", "failed"); err != nil {
+		t.Fatalf("UpdatePurgeStatuses: %v", err)
+	}
+	for purgeID, want := range map[string]string{"a": "failed", "b": "complete", "c": "failed"} {
+		if status, err := db.PurgeStatus(ctx, purgeID); err != nil || status != want {
+			t.Errorf("PurgeStatus: got (%q, %v) for %q, want %q", status, err, purgeID, want)
+		}
+	}
+}
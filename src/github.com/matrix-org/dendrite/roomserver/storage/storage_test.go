@@ -0,0 +1,49 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+// testDatabaseEnv names the environment variable holding the data source name
+// of a postgres database to run the tests against, e.g.
+// "dbname=roomserver_test sslmode=disable". The tests are skipped if it isn't
+// set.
+const testDatabaseEnv = "ROOMSERVER_TEST_DATABASE"
+
+// newTestDatabase opens the room server database named by testDatabaseEnv.
+func newTestDatabase(t *testing.T) *Database {
+	dataSourceName := os.Getenv(testDatabaseEnv)
+	if dataSourceName == "" {
+		t.Skipf("%s isn't set", testDatabaseEnv)
+	}
+	db, err := Open(dataSourceName)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return db
+}
+
+// TestOpenMigratesExistingDatabase checks that opening a database whose tables
+// already exist succeeds, so that the ALTER TABLE statements in the migrations
+// can upgrade the tables of existing deployments.
+func TestOpenMigratesExistingDatabase(t *testing.T) {
+	newTestDatabase(t)
+	if _, err := Open(os.Getenv(testDatabaseEnv)); err != nil {
+		t.Fatalf("Open of an existing database: %v", err)
+	}
+}
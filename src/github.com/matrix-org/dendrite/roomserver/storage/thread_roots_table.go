@@ -0,0 +1,97 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const threadRootsSchema = `
+-- Stores a summary of the threads of replies to events, i.e. of the events
+-- related to them by m.thread relations.
+CREATE TABLE IF NOT EXISTS roomserver_thread_roots (
+    -- The ID of the event at the root of the thread, which we may not have.
+    root_event_id TEXT NOT NULL PRIMARY KEY,
+    -- The number of replies in the thread.
+    reply_count BIGINT NOT NULL,
+    -- The numeric ID of the latest reply in the thread.
+    latest_event_nid BIGINT NOT NULL
+);
+`
+
+const decrementThreadReplyCountSQL = "" +
+	"UPDATE roomserver_thread_roots SET reply_count = reply_count - 1" +
+	" WHERE root_event_id = $1 AND reply_count > 0"
+
+type threadRootsStatements struct {
+	upsertThreadReplyStmt         *sql.Stmt
+	decrementThreadReplyCountStmt *sql.Stmt
+	selectThreadRootsStmt         *sql.Stmt
+}
+
+func (s *threadRootsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(threadRootsSchema)
+	if err != nil {
+		return
+	}
+	return statementList{
+		{&s.upsertThreadReplyStmt, upsertThreadReplySQL},
+		{&s.decrementThreadReplyCountStmt, decrementThreadReplyCountSQL},
+		{&s.selectThreadRootsStmt, selectThreadRootsSQL},
+	}.prepare(db)
+}
+
+func (s *threadRootsStatements) upsertThreadReply(
+	ctx context.Context, txn *sql.Tx, rootEventID string, eventNID types.EventNID,
+) error {
+	_, err := common.TxStmt(txn, s.upsertThreadReplyStmt).ExecContext(ctx, rootEventID, int64(eventNID))
+	return err
+}
+
+func (s *threadRootsStatements) decrementThreadReplyCount(
+	ctx context.Context, txn *sql.Tx, rootEventID string,
+) error {
+	_, err := common.TxStmt(txn, s.decrementThreadReplyCountStmt).ExecContext(ctx, rootEventID)
+	return err
+}
+
+// selectThreadRoots returns the threads whose root is one of the given events
+// and which have at least one reply.
+func (s *threadRootsStatements) selectThreadRoots(
+	ctx context.Context, rootEventIDs []string,
+) ([]types.ThreadRoot, error) {
+	rows, err := s.selectThreadRootsStmt.QueryContext(ctx, common.StringArray(rootEventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []types.ThreadRoot
+	for rows.Next() {
+		var (
+			result         types.ThreadRoot
+			latestEventNID int64
+		)
+		if err = rows.Scan(&result.RootEventID, &result.ReplyCount, &latestEventNID); err != nil {
+			return nil, err
+		}
+		result.LatestEventNID = types.EventNID(latestEventNID)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -124,6 +124,40 @@ const (
 	EmptyStateKeyNID = 1
 )
 
+// An EventRelation is an event which relates to another event through the
+// m.relates_to of its content.
+type EventRelation struct {
+	// The numeric ID of the event which relates to the other one.
+	EventNID EventNID
+	// The ID of the event it relates to.
+	RelatesToID string
+	// The user ID of the sender of the event.
+	Sender string
+}
+
+// A ThreadRoot is a summary of the thread of replies to an event.
+type ThreadRoot struct {
+	// The ID of the event at the root of the thread.
+	RootEventID string
+	// The number of replies in the thread.
+	ReplyCount int64
+	// The numeric ID of the latest reply in the thread.
+	LatestEventNID EventNID
+}
+
+// An Annotation is the number of annotations of an event with a key, e.g. the
+// number of reactions to it with an emoji.
+type Annotation struct {
+	// The ID of the annotated event.
+	RelatesToID string
+	// The type of the relation, i.e. "m.annotation".
+	RelType string
+	// The key of the annotations.
+	Key string
+	// The number of annotations with the key.
+	Count int64
+}
+
 // StateBlockNIDList is used to return the result of bulk StateBlockNID lookups from the database.
 type StateBlockNIDList struct {
 	StateSnapshotNID StateSnapshotNID
@@ -164,6 +198,16 @@ type RoomRecentEventsUpdater interface {
 	HasEventBeenSent(eventNID EventNID) (bool, error)
 	// Mark the event as having been sent to the output logs.
 	MarkEventAsSent(eventNID EventNID) error
+	// Mark the event as soft failed, i.e. as allowed by its auth events but
+	// not by the current state of the room.
+	MarkEventAsSoftFailed(eventNID EventNID) error
+	// Store the relation of the event to another event, if its content has an
+	// m.relates_to. Does nothing for events without one.
+	StoreRelation(eventNID EventNID, event gomatrixserverlib.Event) error
+	// Strip the stored JSON of the event with the given ID using the
+	// redaction algorithm and mark it as redacted. Does nothing if the event
+	// is unknown or in another room.
+	RedactEvent(redactedEventID string) error
 	// Build a membership updater for the target user in this room.
 	// It will share the same transaction as this updater.
 	MembershipUpdater(targetUserNID EventStateKeyNID) (MembershipUpdater, error)
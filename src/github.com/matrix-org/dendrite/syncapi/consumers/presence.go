@@ -0,0 +1,81 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputPresenceEvent consumes presence updates that originated in the client API server.
+type OutputPresenceEvent struct {
+	presenceConsumer *common.ContinualConsumer
+	notifier         *sync.Notifier
+}
+
+// NewOutputPresenceEvent creates a new OutputPresenceEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputPresenceEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store *storage.SyncServerDatabase,
+) *OutputPresenceEvent {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputPresenceEvent{
+		presenceConsumer: &consumer,
+		notifier:         n,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputPresenceEvent) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a new presence update
+// from the client API or federation API server output log. The presence is already stored in the
+// account database, so the users sharing a room with the user only need to be
+// woken up.
+func (s *OutputPresenceEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.PresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server presence log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":  output.UserID,
+		"presence": output.Presence,
+	}).Debug("received presence from client API server")
+
+	s.notifier.OnNewPresence(output.UserID, output.StreamPosition)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputReceiptEvent consumes receipts that originated in the client API server.
+type OutputReceiptEvent struct {
+	receiptConsumer *common.ContinualConsumer
+	notifier        *sync.Notifier
+}
+
+// NewOutputReceiptEvent creates a new OutputReceiptEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputReceiptEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store *storage.SyncServerDatabase,
+) *OutputReceiptEvent {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputReceiptEvent{
+		receiptConsumer: &consumer,
+		notifier:        n,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputReceiptEvent) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a new receipt from the
+// client API server output log. The receipt is already stored in the account
+// database, so the users joined to the room only need to be woken up.
+func (s *OutputReceiptEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.ReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server receipt log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"room_id":  output.RoomID,
+		"user_id":  output.UserID,
+		"event_id": output.EventID,
+	}).Debug("received receipt from client API server")
+
+	s.notifier.OnNewReceipt(output.RoomID, output.StreamPosition)
+
+	return nil
+}
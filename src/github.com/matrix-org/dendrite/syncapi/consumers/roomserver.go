@@ -15,6 +15,7 @@
 package consumers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -35,6 +36,8 @@ type OutputRoomEvent struct {
 	db                 *storage.SyncServerDatabase
 	notifier           *sync.Notifier
 	query              api.RoomserverQueryAPI
+	// The user the m.room.redaction entries of expired events are sent by.
+	systemUserID string
 }
 
 type prevEventRef struct {
@@ -62,6 +65,7 @@ func NewOutputRoomEvent(
 		db:                 store,
 		notifier:           n,
 		query:              queryAPI,
+		systemUserID:       cfg.SystemUserID(),
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -85,6 +89,18 @@ func (s *OutputRoomEvent) onMessage(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
+	if output.Type == api.OutputTypePurgedHistory {
+		return s.onPurgedHistory(output.PurgedHistory)
+	}
+
+	if output.Type == api.OutputTypeExpiredEvents {
+		return s.onExpiredEvents(output.ExpiredEvents)
+	}
+
+	if output.Type == api.OutputTypeRedactedEvent {
+		return s.onRedactedEvent(output.RedactedEvent)
+	}
+
 	if output.Type != api.OutputTypeNewRoomEvent {
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -140,6 +156,45 @@ func (s *OutputRoomEvent) onMessage(msg *sarama.ConsumerMessage) error {
 }
 
 // lookupStateEvents looks up the state events that are added by a new event.
+// onPurgedHistory deletes the events which were purged from the history of a
+// room by the roomserver.
+func (s *OutputRoomEvent) onPurgedHistory(purged *api.OutputPurgedHistory) error {
+	log.WithFields(log.Fields{
+		"room_id":    purged.RoomID,
+		"num_events": len(purged.EventIDs),
+	}).Info("received purged history from roomserver")
+	return s.db.PurgeEvents(purged.EventIDs)
+}
+
+// onExpiredEvents redacts the events which were redacted by the roomserver
+// because of the retention policy of their room, and notifies the users in the
+// room of the redactions.
+func (s *OutputRoomEvent) onExpiredEvents(expired *api.OutputExpiredEvents) error {
+	log.WithFields(log.Fields{
+		"room_id":    expired.RoomID,
+		"num_events": len(expired.EventIDs),
+	}).Info("received expired events from roomserver")
+	redactions, syncStreamPos, err := s.db.ExpireEvents(expired.EventIDs, s.systemUserID)
+	if err != nil {
+		return err
+	}
+	if len(redactions) > 0 {
+		s.notifier.OnNewEvent(&redactions[len(redactions)-1], "", syncStreamPos)
+	}
+	return nil
+}
+
+// onRedactedEvent redacts the event which was redacted by the roomserver
+// because of an m.room.redaction event.
+func (s *OutputRoomEvent) onRedactedEvent(redacted *api.OutputRedactedEvent) error {
+	log.WithFields(log.Fields{
+		"room_id":            redacted.RoomID,
+		"redacted_event_id":  redacted.RedactedEventID,
+		"redaction_event_id": redacted.RedactionEventID,
+	}).Info("received redacted event from roomserver")
+	return s.db.RedactEvent(redacted.RoomID, redacted.RedactedEventID)
+}
+
 func (s *OutputRoomEvent) lookupStateEvents(
 	addsStateEventIDs []string, event gomatrixserverlib.Event,
 ) ([]gomatrixserverlib.Event, error) {
@@ -180,7 +235,7 @@ func (s *OutputRoomEvent) lookupStateEvents(
 	// from the roomserver using the query API.
 	eventReq := api.QueryEventsByIDRequest{EventIDs: missing}
 	var eventResp api.QueryEventsByIDResponse
-	if err := s.query.QueryEventsByID(&eventReq, &eventResp); err != nil {
+	if err := s.query.QueryEventsByID(context.Background(), &eventReq, &eventResp); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,84 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// OutputSendToDeviceEvent consumes to-device messages that originated in the client API server.
+type OutputSendToDeviceEvent struct {
+	sendToDeviceConsumer *common.ContinualConsumer
+	notifier             *sync.Notifier
+}
+
+// NewOutputSendToDeviceEvent creates a new OutputSendToDeviceEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputSendToDeviceEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store *storage.SyncServerDatabase,
+) *OutputSendToDeviceEvent {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputSendToDeviceEvent{
+		sendToDeviceConsumer: &consumer,
+		notifier:             n,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputSendToDeviceEvent) Start() error {
+	return s.sendToDeviceConsumer.Start()
+}
+
+// onMessage is called when the sync server receives new to-device messages
+// from the client API server output log. The messages for local users are
+// already stored in the account database, so the users only need to be woken
+// up.
+func (s *OutputSendToDeviceEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.SendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server send to device log: message parse failure")
+		return nil
+	}
+	if len(output.LocalUserIDs) == 0 {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sender": output.Sender,
+		"type":   output.Type,
+	}).Debug("received to-device messages from client API server")
+
+	s.notifier.OnNewSendToDevice(output.LocalUserIDs, output.StreamPosition)
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/typing"
+	sarama "gopkg.in/Shopify/sarama.v1"
+)
+
+// defaultTypingTimeout is how long a user is considered typing for if the
+// client didn't say.
+const defaultTypingTimeout = 30 * time.Second
+
+// OutputTypingEvent consumes typing notifications that originated in the client API server.
+type OutputTypingEvent struct {
+	typingConsumer *common.ContinualConsumer
+	cache          *typing.Cache
+}
+
+// NewOutputTypingEvent creates a new OutputTypingEvent consumer. Call Start() to begin consuming from the client API server.
+func NewOutputTypingEvent(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	cache *typing.Cache,
+	store *storage.SyncServerDatabase,
+) *OutputTypingEvent {
+
+	consumer := common.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputTypingEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputTypingEvent{
+		typingConsumer: &consumer,
+		cache:          cache,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the client API server
+func (s *OutputTypingEvent) Start() error {
+	return s.typingConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a new typing notification
+// from the client API server output log.
+func (s *OutputTypingEvent) onMessage(msg *sarama.ConsumerMessage) error {
+	var output common.TypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("client API server typing log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"room_id": output.RoomID,
+		"user_id": output.UserID,
+		"typing":  output.Typing,
+	}).Debug("received typing notification from client API server")
+
+	if !output.Typing {
+		s.cache.RemoveUser(output.UserID, output.RoomID)
+		return nil
+	}
+
+	timeout := time.Duration(output.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultTypingTimeout
+	}
+	s.cache.AddTypingUser(output.UserID, output.RoomID, timeout)
+
+	return nil
+}
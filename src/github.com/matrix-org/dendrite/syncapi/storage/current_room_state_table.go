@@ -59,6 +59,9 @@ const upsertRoomStateSQL = "" +
 const deleteRoomStateByEventIDSQL = "" +
 	"DELETE FROM syncapi_current_room_state WHERE event_id = $1"
 
+const updateRoomStateEventJSONSQL = "" +
+	"UPDATE syncapi_current_room_state SET event_json = $2 WHERE event_id = $1"
+
 const selectRoomIDsWithMembershipSQL = "" +
 	"SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = $2"
 
@@ -77,6 +80,7 @@ const selectEventsWithEventIDsSQL = "" +
 type currentRoomStateStatements struct {
 	upsertRoomStateStmt             *sql.Stmt
 	deleteRoomStateByEventIDStmt    *sql.Stmt
+	updateEventJSONStmt             *sql.Stmt
 	selectRoomIDsWithMembershipStmt *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
@@ -95,6 +99,9 @@ func (s *currentRoomStateStatements) prepare(db *sql.DB) (err error) {
 	if s.deleteRoomStateByEventIDStmt, err = db.Prepare(deleteRoomStateByEventIDSQL); err != nil {
 		return
 	}
+	if s.updateEventJSONStmt, err = db.Prepare(updateRoomStateEventJSONSQL); err != nil {
+		return
+	}
 	if s.selectRoomIDsWithMembershipStmt, err = db.Prepare(selectRoomIDsWithMembershipSQL); err != nil {
 		return
 	}
@@ -170,6 +177,13 @@ func (s *currentRoomStateStatements) deleteRoomStateByEventID(txn *sql.Tx, event
 	return err
 }
 
+// updateEventJSON replaces the JSON of the state event with the given event ID,
+// if it is in the current state of its room.
+func (s *currentRoomStateStatements) updateEventJSON(txn *sql.Tx, eventID string, eventJSON []byte) error {
+	_, err := common.TxStmt(txn, s.updateEventJSONStmt).Exec(eventID, eventJSON)
+	return err
+}
+
 func (s *currentRoomStateStatements) upsertRoomState(
 	txn *sql.Tx, event gomatrixserverlib.Event, membership *string, addedAt int64,
 ) error {
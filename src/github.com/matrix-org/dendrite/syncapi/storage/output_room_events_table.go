@@ -59,6 +59,12 @@ const selectRecentEventsSQL = "" +
 	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
 	" ORDER BY id DESC LIMIT $4"
 
+const deleteEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = ANY($1)"
+
+const updateEventJSONSQL = "" +
+	"UPDATE syncapi_output_room_events SET event_json = $2 WHERE event_id = $1"
+
 const selectMaxIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
 
@@ -75,6 +81,8 @@ type outputRoomEventsStatements struct {
 	selectMaxIDStmt        *sql.Stmt
 	selectRecentEventsStmt *sql.Stmt
 	selectStateInRangeStmt *sql.Stmt
+	deleteEventsStmt       *sql.Stmt
+	updateEventJSONStmt    *sql.Stmt
 }
 
 func (s *outputRoomEventsStatements) prepare(db *sql.DB) (err error) {
@@ -97,6 +105,12 @@ func (s *outputRoomEventsStatements) prepare(db *sql.DB) (err error) {
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
 		return
 	}
+	if s.deleteEventsStmt, err = db.Prepare(deleteEventsSQL); err != nil {
+		return
+	}
+	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -214,6 +228,17 @@ func (s *outputRoomEventsStatements) selectEvents(txn *sql.Tx, eventIDs []string
 	return rowsToStreamEvents(rows)
 }
 
+// deleteEvents deletes the events with the given event IDs.
+func (s *outputRoomEventsStatements) deleteEvents(txn *sql.Tx, eventIDs []string) error {
+	_, err := common.TxStmt(txn, s.deleteEventsStmt).Exec(pq.StringArray(eventIDs))
+	return err
+}
+
+func (s *outputRoomEventsStatements) updateEventJSON(txn *sql.Tx, eventID string, eventJSON []byte) error {
+	_, err := common.TxStmt(txn, s.updateEventJSONStmt).Exec(eventID, eventJSON)
+	return err
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]streamEvent, error) {
 	var result []streamEvent
 	for rows.Next() {
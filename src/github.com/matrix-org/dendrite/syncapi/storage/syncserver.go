@@ -15,8 +15,13 @@
 package storage
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
+
 	// Import the postgres database driver.
 	_ "github.com/lib/pq"
 	"github.com/matrix-org/dendrite/common"
@@ -39,6 +44,10 @@ type streamEvent struct {
 	streamPosition types.StreamPosition
 }
 
+// VisibilityFilter returns the events the user is allowed to see among the
+// given events of a room, in the same order.
+type VisibilityFilter func(events []gomatrixserverlib.Event) ([]gomatrixserverlib.Event, error)
+
 // SyncServerDatabase represents a sync server database
 type SyncServerDatabase struct {
 	db          *sql.DB
@@ -91,6 +100,110 @@ func (d *SyncServerDatabase) Events(eventIDs []string) ([]gomatrixserverlib.Even
 	return streamEventsToEvents(streamEvents), nil
 }
 
+// PurgeEvents deletes the events with the given event IDs, after their history
+// has been purged by the roomserver.
+func (d *SyncServerDatabase) PurgeEvents(eventIDs []string) error {
+	return d.events.deleteEvents(nil, eventIDs)
+}
+
+// expiryRedaction is the JSON of the m.room.redaction entries written to the
+// stream when events expire, so that clients redact their copies of the
+// events. They aren't signed, and aren't known to the roomserver or other
+// servers. The redacted event ID is also in the content, where newer room
+// versions put it.
+type expiryRedaction struct {
+	EventID        string                      `json:"event_id"`
+	Type           string                      `json:"type"`
+	RoomID         string                      `json:"room_id"`
+	Sender         string                      `json:"sender"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+	Redacts        string                      `json:"redacts"`
+	Content        struct {
+		Redacts string `json:"redacts"`
+		Reason  string `json:"reason"`
+	} `json:"content"`
+}
+
+// ExpireEvents redacts the events with the given event IDs, after they were
+// redacted by the roomserver because of the retention policy of their room,
+// and writes a m.room.redaction entry sent by the given system user to the
+// stream for each of them. Events which aren't stored or are already redacted
+// are skipped.
+// Returns the entries written and the stream position of the last one.
+func (d *SyncServerDatabase) ExpireEvents(eventIDs []string, systemUserID string) (
+	redactions []gomatrixserverlib.Event, streamPos types.StreamPosition, returnErr error,
+) {
+	returnErr = common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		events, err := d.events.selectEvents(txn, eventIDs)
+		if err != nil {
+			return err
+		}
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		for _, event := range events {
+			redacted := event.Redact()
+			if bytes.Equal(redacted.JSON(), event.JSON()) {
+				continue
+			}
+			if err = d.events.updateEventJSON(txn, event.EventID(), redacted.JSON()); err != nil {
+				return err
+			}
+
+			entry := expiryRedaction{
+				EventID:        types.ExpiryRedactionIDPrefix + strings.TrimPrefix(event.EventID(), "$"),
+				Type:           "m.room.redaction",
+				RoomID:         event.RoomID(),
+				Sender:         systemUserID,
+				OriginServerTS: now,
+				Redacts:        event.EventID(),
+			}
+			entry.Content.Redacts = event.EventID()
+			entry.Content.Reason = "Expired by the retention policy of the room"
+			entryJSON, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			redaction, err := gomatrixserverlib.NewEventFromTrustedJSON(entryJSON, false)
+			if err != nil {
+				return err
+			}
+			pos, err := d.events.insertEvent(txn, &redaction, nil, nil)
+			if err != nil {
+				return err
+			}
+			redactions = append(redactions, redaction)
+			streamPos = types.StreamPosition(pos)
+		}
+		return nil
+	})
+	return
+}
+
+// RedactEvent redacts the event with the given event ID, after it was redacted
+// by the roomserver because of an m.room.redaction event in the given room.
+// Does nothing if the event isn't stored, is in another room or is already
+// redacted. Clients are told about the redaction by the m.room.redaction event
+// itself.
+func (d *SyncServerDatabase) RedactEvent(roomID, redactedEventID string) error {
+	return common.WithTransaction(d.db, func(txn *sql.Tx) error {
+		events, err := d.events.selectEvents(txn, []string{redactedEventID})
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		event := events[0]
+		if event.RoomID() != roomID {
+			return nil
+		}
+		redacted := event.Redact()
+		if bytes.Equal(redacted.JSON(), event.JSON()) {
+			return nil
+		}
+		if err = d.events.updateEventJSON(txn, event.EventID(), redacted.JSON()); err != nil {
+			return err
+		}
+		return d.roomstate.updateEventJSON(txn, event.EventID(), redacted.JSON())
+	})
+}
+
 // WriteEvent into the database. It is not safe to call this function from multiple goroutines, as it would create races
 // when generating the stream position for this event. Returns the sync stream position for the inserted event.
 // Returns an error if there was a problem inserting this event.
@@ -153,6 +266,12 @@ func (d *SyncServerDatabase) GetStateEvent(evType string, roomID string, stateKe
 	return d.roomstate.selectStateEvent(evType, roomID, stateKey)
 }
 
+// JoinedRoomIDs returns the IDs of the rooms the user is currently joined to.
+// Returns an error if there was an issue during the retrieval
+func (d *SyncServerDatabase) JoinedRoomIDs(userID string) ([]string, error) {
+	return d.roomstate.selectRoomIDsWithMembership(nil, userID, "join")
+}
+
 // PartitionOffsets implements common.PartitionStorer
 func (d *SyncServerDatabase) PartitionOffsets(topic string) ([]common.PartitionOffset, error) {
 	return d.partitions.SelectPartitionOffsets(topic)
@@ -173,7 +292,10 @@ func (d *SyncServerDatabase) SyncStreamPosition() (types.StreamPosition, error)
 }
 
 // IncrementalSync returns all the data needed in order to create an incremental sync response.
-func (d *SyncServerDatabase) IncrementalSync(userID string, fromPos, toPos types.StreamPosition, numRecentEventsPerRoom int) (res *types.Response, returnErr error) {
+// The timelines only hold the events the user is allowed to see.
+func (d *SyncServerDatabase) IncrementalSync(
+	userID string, fromPos, toPos types.StreamPosition, numRecentEventsPerRoom int, visible VisibilityFilter,
+) (res *types.Response, returnErr error) {
 	returnErr = common.WithTransaction(d.db, func(txn *sql.Tx) error {
 		// Work out which rooms to return in the response. This is done by getting not only the currently
 		// joined rooms, but also which rooms have membership transitions for this user between the 2 stream positions.
@@ -189,35 +311,35 @@ func (d *SyncServerDatabase) IncrementalSync(userID string, fromPos, toPos types
 			endPos := toPos
 			if delta.membershipPos > 0 && delta.membership == "leave" {
 				// make sure we don't leak recent events after the leave event.
-				// TODO: History visibility makes this somewhat complex to handle correctly. For example:
+				// The events the user can't see according to the history visibility of the
+				// room are filtered out, but this doesn't handle every case, for example:
 				// TODO: This doesn't work for join -> leave in a single /sync request (see events prior to join).
 				// TODO: This will fail on join -> leave -> sensitive msg -> join -> leave
 				//       in a single /sync request
 				// This is all "okay" assuming history_visibility == "shared" which it is by default.
 				endPos = delta.membershipPos
 			}
-			recentStreamEvents, err := d.events.selectRecentEvents(txn, delta.roomID, fromPos, endPos, numRecentEventsPerRoom)
+			recentEvents, limited, err := d.selectVisibleRecentEvents(
+				txn, delta.roomID, fromPos, endPos, numRecentEventsPerRoom, visible,
+			)
 			if err != nil {
 				return err
 			}
-			recentEvents := streamEventsToEvents(recentStreamEvents)
 			delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
 
 			switch delta.membership {
 			case "join":
 				jr := types.NewJoinResponse()
 				jr.Timeline.Events = gomatrixserverlib.ToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-				jr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+				jr.Timeline.Limited = limited
 				jr.State.Events = gomatrixserverlib.ToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 				res.Rooms.Join[delta.roomID] = *jr
 			case "leave":
 				fallthrough // transitions to leave are the same as ban
 			case "ban":
-				// TODO: recentEvents may contain events that this user is not allowed to see because they are
-				//       no longer in the room.
 				lr := types.NewLeaveResponse()
 				lr.Timeline.Events = gomatrixserverlib.ToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-				lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+				lr.Timeline.Limited = limited
 				lr.State.Events = gomatrixserverlib.ToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 				res.Rooms.Leave[delta.roomID] = *lr
 			}
@@ -230,7 +352,10 @@ func (d *SyncServerDatabase) IncrementalSync(userID string, fromPos, toPos types
 }
 
 // CompleteSync a complete /sync API response for the given user.
-func (d *SyncServerDatabase) CompleteSync(userID string, numRecentEventsPerRoom int) (res *types.Response, returnErr error) {
+// The timelines only hold the events the user is allowed to see.
+func (d *SyncServerDatabase) CompleteSync(
+	userID string, numRecentEventsPerRoom int, visible VisibilityFilter,
+) (res *types.Response, returnErr error) {
 	// This needs to be all done in a transaction as we need to do multiple SELECTs, and we need to have
 	// a consistent view of the database throughout. This includes extracting the sync stream position.
 	// This does have the unfortunate side-effect that all the matrixy logic resides in this function,
@@ -258,13 +383,12 @@ func (d *SyncServerDatabase) CompleteSync(userID string, numRecentEventsPerRoom
 			}
 			// TODO: When filters are added, we may need to call this multiple times to get enough events.
 			//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-			recentStreamEvents, err := d.events.selectRecentEvents(
-				txn, roomID, types.StreamPosition(0), pos, numRecentEventsPerRoom,
+			recentEvents, _, err := d.selectVisibleRecentEvents(
+				txn, roomID, types.StreamPosition(0), pos, numRecentEventsPerRoom, visible,
 			)
 			if err != nil {
 				return err
 			}
-			recentEvents := streamEventsToEvents(recentStreamEvents)
 
 			stateEvents = removeDuplicates(stateEvents, recentEvents)
 			jr := types.NewJoinResponse()
@@ -279,6 +403,35 @@ func (d *SyncServerDatabase) CompleteSync(userID string, numRecentEventsPerRoom
 	return
 }
 
+// selectVisibleRecentEvents returns the latest events of the room between the
+// two stream positions that the user is allowed to see, at most limit of them.
+// The events are looked at a page at a time until there are enough visible
+// ones, so that hidden events don't take the place of visible ones. Returns
+// whether there are older events between the positions which were left out.
+func (d *SyncServerDatabase) selectVisibleRecentEvents(
+	txn *sql.Tx, roomID string, fromPos, toPos types.StreamPosition, limit int, visible VisibilityFilter,
+) ([]gomatrixserverlib.Event, bool, error) {
+	var events []gomatrixserverlib.Event
+	for len(events) < limit {
+		streamEvents, err := d.events.selectRecentEvents(txn, roomID, fromPos, toPos, limit)
+		if err != nil {
+			return nil, false, err
+		}
+		page, err := visible(streamEventsToEvents(streamEvents))
+		if err != nil {
+			return nil, false, err
+		}
+		events = append(page, events...)
+		if len(streamEvents) < limit {
+			// There are no more events between the positions.
+			return events, false, nil
+		}
+		toPos = streamEvents[0].streamPosition - 1
+	}
+	// Keep the latest events if the last page had more than enough.
+	return events[len(events)-limit:], true, nil
+}
+
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
 // Returns a map following the format data[roomID] = []dataTypes
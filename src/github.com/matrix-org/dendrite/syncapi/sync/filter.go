@@ -0,0 +1,130 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// errUnknownFilter is returned by getFilter if the requested filter ID doesn't
+// exist for this user.
+type errUnknownFilter struct{}
+
+func (e errUnknownFilter) Error() string {
+	return "unknown filter ID"
+}
+
+// errBadFilter is returned by getFilter if the filter given inline in the
+// request isn't a valid filter definition.
+type errBadFilter struct {
+	err error
+}
+
+func (e errBadFilter) Error() string {
+	return "invalid filter: " + e.err.Error()
+}
+
+// getFilter returns the filter given as the "filter" query parameter of a
+// /sync request. The parameter is either the ID of a filter previously
+// uploaded by the user, or a filter definition encoded as JSON.
+// Returns an empty filter if filterParam is empty.
+func getFilter(accountDB *accounts.Database, userID string, filterParam string) (*authtypes.Filter, error) {
+	if filterParam == "" {
+		return &authtypes.Filter{}, nil
+	}
+	if strings.HasPrefix(filterParam, "{") {
+		var filter authtypes.Filter
+		if err := json.Unmarshal([]byte(filterParam), &filter); err != nil {
+			return nil, errBadFilter{err}
+		}
+		if err := filter.Validate(); err != nil {
+			return nil, errBadFilter{err}
+		}
+		return &filter, nil
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := accountDB.GetFilter(localpart, filterParam)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownFilter{}
+	}
+	return filter, err
+}
+
+// filterResponse removes from the response the rooms and events which don't
+// pass the given filter.
+func filterResponse(res *types.Response, filter *authtypes.Filter) {
+	res.AccountData.Events = filterEvents(res.AccountData.Events, &filter.AccountData)
+	res.Presence.Events = filterEvents(res.Presence.Events, &filter.Presence)
+
+	for roomID, jr := range res.Rooms.Join {
+		if !filter.Room.AllowsRoom(roomID) {
+			delete(res.Rooms.Join, roomID)
+			continue
+		}
+		jr.State.Events = filterRoomEvents(jr.State.Events, roomID, &filter.Room.State)
+		jr.Timeline.Events = filterRoomEvents(jr.Timeline.Events, roomID, &filter.Room.Timeline)
+		jr.Ephemeral.Events = filterRoomEvents(jr.Ephemeral.Events, roomID, &filter.Room.Ephemeral)
+		jr.AccountData.Events = filterRoomEvents(jr.AccountData.Events, roomID, &filter.Room.AccountData)
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID := range res.Rooms.Invite {
+		if !filter.Room.AllowsRoom(roomID) {
+			delete(res.Rooms.Invite, roomID)
+		}
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		if !filter.Room.IncludeLeave || !filter.Room.AllowsRoom(roomID) {
+			delete(res.Rooms.Leave, roomID)
+			continue
+		}
+		lr.State.Events = filterRoomEvents(lr.State.Events, roomID, &filter.Room.State)
+		lr.Timeline.Events = filterRoomEvents(lr.Timeline.Events, roomID, &filter.Room.Timeline)
+		res.Rooms.Leave[roomID] = lr
+	}
+}
+
+func filterRoomEvents(
+	events []gomatrixserverlib.ClientEvent, roomID string, filter *authtypes.RoomEventFilter,
+) []gomatrixserverlib.ClientEvent {
+	if !filter.AllowsRoom(roomID) {
+		return []gomatrixserverlib.ClientEvent{}
+	}
+	return filterEvents(events, &filter.EventFilter)
+}
+
+func filterEvents(
+	events []gomatrixserverlib.ClientEvent, filter *authtypes.EventFilter,
+) []gomatrixserverlib.ClientEvent {
+	filtered := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if filter.AllowsEvent(ev.Type, ev.Sender) {
+			filtered = append(filtered, ev)
+		}
+	}
+	if filter.Limit > 0 && len(filtered) > filter.Limit {
+		filtered = filtered[len(filtered)-filter.Limit:]
+	}
+	return filtered
+}
@@ -34,7 +34,7 @@ type Notifier struct {
 	// Protects currPos and userStreams.
 	streamLock *sync.Mutex
 	// The latest sync stream position
-	currPos types.StreamPosition
+	currPos types.SyncPosition
 	// A map of user_id => UserStream which can be used to wake a given user's /sync request.
 	userStreams map[string]*UserStream
 }
@@ -42,7 +42,7 @@ type Notifier struct {
 // NewNotifier creates a new notifier set to the given stream position.
 // In order for this to be of any use, the Notifier needs to be told all rooms and
 // the joined users within each of them by calling Notifier.Load(*storage.SyncServerDatabase).
-func NewNotifier(pos types.StreamPosition) *Notifier {
+func NewNotifier(pos types.SyncPosition) *Notifier {
 	return &Notifier{
 		currPos:             pos,
 		roomIDToJoinedUsers: make(map[string]userIDSet),
@@ -60,7 +60,7 @@ func (n *Notifier) OnNewEvent(ev *gomatrixserverlib.Event, userID string, pos ty
 	// This needs to be done PRIOR to waking up users as they will read this value.
 	n.streamLock.Lock()
 	defer n.streamLock.Unlock()
-	n.currPos = pos
+	n.currPos.PDUPosition = pos
 
 	if ev != nil {
 		// Map this event's room_id to a list of joined users, and wake them up.
@@ -92,15 +92,98 @@ func (n *Notifier) OnNewEvent(ev *gomatrixserverlib.Event, userID string, pos ty
 		}
 
 		for _, userID := range userIDs {
-			n.wakeupUser(userID, pos)
+			n.wakeupUser(userID, n.currPos)
 		}
 	} else if len(userID) > 0 {
-		n.wakeupUser(userID, pos)
+		n.wakeupUser(userID, n.currPos)
 	}
 }
 
-// WaitForEvents blocks until there are new events for this request.
-func (n *Notifier) WaitForEvents(req syncRequest) types.StreamPosition {
+// OnNewTyping is called when the users typing in a room change, with the new
+// position in the typing stream. It wakes up the users joined to the room.
+// It is safe to call this concurrently with OnNewEvent.
+func (n *Notifier) OnNewTyping(roomID string, typingPos int64) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	if typingPos > n.currPos.TypingPosition {
+		n.currPos.TypingPosition = typingPos
+	}
+
+	for _, userID := range n.joinedUsers(roomID) {
+		n.wakeupUser(userID, n.currPos)
+	}
+}
+
+// OnNewReceipt is called when a user sends a receipt in a room, with the
+// position of the receipt in the receipts stream. It wakes up the users joined
+// to the room.
+func (n *Notifier) OnNewReceipt(roomID string, receiptPos int64) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	if receiptPos > n.currPos.ReceiptPosition {
+		n.currPos.ReceiptPosition = receiptPos
+	}
+
+	for _, userID := range n.joinedUsers(roomID) {
+		n.wakeupUser(userID, n.currPos)
+	}
+}
+
+// OnNewPresence is called when a user updates their presence, with the
+// position of the update in the presence stream. It wakes up the user and the
+// users sharing a room with them.
+func (n *Notifier) OnNewPresence(userID string, presencePos int64) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	if presencePos > n.currPos.PresencePosition {
+		n.currPos.PresencePosition = presencePos
+	}
+
+	for _, userID := range n.usersSharingRooms(userID) {
+		n.wakeupUser(userID, n.currPos)
+	}
+}
+
+// OnNewSendToDevice is called when to-device messages are sent to devices of
+// the given users, with the position of the messages in the to-device stream.
+// It wakes up the users.
+func (n *Notifier) OnNewSendToDevice(userIDs []string, toDevicePos int64) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	if toDevicePos > n.currPos.ToDevicePosition {
+		n.currPos.ToDevicePosition = toDevicePos
+	}
+
+	for _, userID := range userIDs {
+		n.wakeupUser(userID, n.currPos)
+	}
+}
+
+// UsersSharingRooms returns the IDs of the users joined to a room the given
+// user is joined to, including the user themselves.
+func (n *Notifier) UsersSharingRooms(userID string) []string {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+	return n.usersSharingRooms(userID)
+}
+
+// Not thread-safe: must be called with the stream lock held
+func (n *Notifier) usersSharingRooms(userID string) []string {
+	users := userIDSet{userID: true}
+	for _, joinedUsers := range n.roomIDToJoinedUsers {
+		if joinedUsers[userID] {
+			for u := range joinedUsers {
+				users.add(u)
+			}
+		}
+	}
+	return users.values()
+}
+
+// WaitForEvents blocks until there are new events for this request, or until
+// the request's context is done. In the latter case, the position the request
+// is at is returned.
+func (n *Notifier) WaitForEvents(req syncRequest) types.SyncPosition {
 	// Do what synapse does: https://github.com/matrix-org/synapse/blob/v0.20.0/synapse/notifier.py#L298
 	// - Bucket request into a lookup map keyed off a list of joined room IDs and separately a user ID
 	// - Incoming events wake requests for a matching room ID
@@ -127,7 +210,7 @@ func (n *Notifier) WaitForEvents(req syncRequest) types.StreamPosition {
 	// give up the stream lock prior to waiting on the user lock
 	stream := n.fetchUserStream(req.userID, true)
 	n.streamLock.Unlock()
-	return stream.Wait(currentPos)
+	return stream.Wait(req.ctx, currentPos)
 }
 
 // Load the membership states required to notify users correctly.
@@ -155,7 +238,7 @@ func (n *Notifier) setUsersJoinedToRooms(roomIDToUserIDs map[string][]string) {
 	}
 }
 
-func (n *Notifier) wakeupUser(userID string, newPos types.StreamPosition) {
+func (n *Notifier) wakeupUser(userID string, newPos types.SyncPosition) {
 	stream := n.fetchUserStream(userID, false)
 	if stream == nil {
 		return
@@ -21,9 +21,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
-	"github.com/matrix-org/util"
 )
 
 var (
@@ -90,7 +90,7 @@ func init() {
 
 // Test that the current position is returned if a request is already behind.
 func TestImmediateNotification(t *testing.T) {
-	n := NewNotifier(streamPositionBefore)
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
 	pos, err := waitForEvents(n, newTestSyncRequest(alice, streamPositionVeryOld))
 	if err != nil {
 		t.Fatalf("TestImmediateNotification error: %s", err)
@@ -102,7 +102,7 @@ func TestImmediateNotification(t *testing.T) {
 
 // Test that new events to a joined room unblocks the request.
 func TestNewEventAndJoinedToRoom(t *testing.T) {
-	n := NewNotifier(streamPositionBefore)
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
 	n.setUsersJoinedToRooms(map[string][]string{
 		roomID: {alice, bob},
 	})
@@ -128,9 +128,91 @@ func TestNewEventAndJoinedToRoom(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that typing in a joined room unblocks the request.
+func TestNewTypingAndJoinedToRoom(t *testing.T) {
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, streamPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewTypingAndJoinedToRoom error: %s", err)
+		}
+		if pos != streamPositionBefore {
+			t.Errorf("TestNewTypingAndJoinedToRoom want %d, got %d", streamPositionBefore, pos)
+		}
+		wg.Done()
+	}()
+
+	stream := n.fetchUserStream(bob, true)
+	waitForBlocking(stream, 1)
+
+	n.OnNewTyping(roomID, 1)
+
+	wg.Wait()
+}
+
+// Test that a presence update from a user sharing a room unblocks the request.
+func TestNewPresenceAndSharingRoom(t *testing.T) {
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice, bob},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, streamPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewPresenceAndSharingRoom error: %s", err)
+		}
+		if pos != streamPositionBefore {
+			t.Errorf("TestNewPresenceAndSharingRoom want %d, got %d", streamPositionBefore, pos)
+		}
+		wg.Done()
+	}()
+
+	stream := n.fetchUserStream(bob, true)
+	waitForBlocking(stream, 1)
+
+	n.OnNewPresence(alice, 1)
+
+	wg.Wait()
+}
+
+// Test that a to-device message unblocks the request of the user it is for,
+// even if they don't share a room with the sender.
+func TestNewSendToDeviceForUser(t *testing.T) {
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, streamPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewSendToDeviceForUser error: %s", err)
+		}
+		if pos != streamPositionBefore {
+			t.Errorf("TestNewSendToDeviceForUser want %d, got %d", streamPositionBefore, pos)
+		}
+		wg.Done()
+	}()
+
+	stream := n.fetchUserStream(bob, true)
+	waitForBlocking(stream, 1)
+
+	n.OnNewSendToDevice([]string{bob}, 1)
+
+	wg.Wait()
+}
+
 // Test that an invite unblocks the request
 func TestNewInviteEventForUser(t *testing.T) {
-	n := NewNotifier(streamPositionBefore)
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
 	n.setUsersJoinedToRooms(map[string][]string{
 		roomID: {alice, bob},
 	})
@@ -158,7 +240,7 @@ func TestNewInviteEventForUser(t *testing.T) {
 
 // Test that all blocked requests get woken up on a new event.
 func TestMultipleRequestWakeup(t *testing.T) {
-	n := NewNotifier(streamPositionBefore)
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
 	n.setUsersJoinedToRooms(map[string][]string{
 		roomID: {alice, bob},
 	})
@@ -196,7 +278,7 @@ func TestMultipleRequestWakeup(t *testing.T) {
 func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	// listen as bob. Make bob leave room. Make alice send event to room.
 	// Make sure alice gets woken up only and not bob as well.
-	n := NewNotifier(streamPositionBefore)
+	n := NewNotifier(types.SyncPosition{PDUPosition: streamPositionBefore})
 	n.setUsersJoinedToRooms(map[string][]string{
 		roomID: {alice, bob},
 	})
@@ -259,13 +341,13 @@ func waitForEvents(n *Notifier, req syncRequest) (types.StreamPosition, error) {
 	done := make(chan types.StreamPosition, 1)
 	go func() {
 		newPos := n.WaitForEvents(req)
-		done <- newPos
+		done <- newPos.PDUPosition
 		close(done)
 	}()
 	select {
 	case <-time.After(5 * time.Second):
 		return types.StreamPosition(0), fmt.Errorf(
-			"waitForEvents timed out waiting for %s (pos=%d)", req.userID, req.since,
+			"waitForEvents timed out waiting for %s (pos=%s)", req.userID, req.since,
 		)
 	case p := <-done:
 		return p, nil
@@ -282,11 +364,12 @@ func waitForBlocking(s *UserStream, numBlocking int) {
 
 func newTestSyncRequest(userID string, since types.StreamPosition) syncRequest {
 	return syncRequest{
+		ctx:           context.Background(),
 		userID:        userID,
 		timeout:       1 * time.Minute,
-		since:         since,
+		since:         types.SyncPosition{PDUPosition: since},
 		wantFullState: false,
 		limit:         defaultTimelineLimit,
-		log:           util.GetLogger(context.TODO()),
+		log:           common.GetLogger(context.TODO()),
 	}
 }
@@ -15,13 +15,17 @@
 package sync
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/common"
 	"github.com/matrix-org/dendrite/syncapi/types"
-	"github.com/matrix-org/util"
 )
 
 const defaultSyncTimeout = time.Duration(30) * time.Second
@@ -29,12 +33,17 @@ const defaultTimelineLimit = 20
 
 // syncRequest represents a /sync request, with sensible defaults/sanity checks applied.
 type syncRequest struct {
+	ctx           context.Context
 	userID        string
 	limit         int
 	timeout       time.Duration
-	since         types.StreamPosition
+	since         types.SyncPosition
 	wantFullState bool
-	log           *log.Entry
+	// The presence the user is set to by syncing, one of the presence states
+	// in authtypes. Defaults to online.
+	setPresence string
+	filter      *authtypes.Filter
+	log         *log.Entry
 }
 
 func newSyncRequest(req *http.Request, userID string) (*syncRequest, error) {
@@ -45,17 +54,36 @@ func newSyncRequest(req *http.Request, userID string) (*syncRequest, error) {
 	if err != nil {
 		return nil, err
 	}
-	// TODO: Additional query params: set_presence, filter
+	setPresence := req.URL.Query().Get("set_presence")
+	switch setPresence {
+	case "":
+		setPresence = authtypes.PresenceOnline
+	case authtypes.PresenceOnline, authtypes.PresenceUnavailable, authtypes.PresenceOffline:
+	default:
+		return nil, fmt.Errorf("invalid set_presence %q", setPresence)
+	}
 	return &syncRequest{
+		ctx:           req.Context(),
 		userID:        userID,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         defaultTimelineLimit, // TODO: read from filter
-		log:           util.GetLogger(req.Context()),
+		setPresence:   setPresence,
+		limit:         defaultTimelineLimit,
+		filter:        &authtypes.Filter{},
+		log:           common.GetLogger(req.Context()),
 	}, nil
 }
 
+// applyFilter sets the filter for this request, updating the timeline limit
+// if the filter specifies one.
+func (r *syncRequest) applyFilter(filter *authtypes.Filter) {
+	r.filter = filter
+	if filter.Room.Timeline.Limit > 0 {
+		r.limit = filter.Room.Timeline.Limit
+	}
+}
+
 func getTimeout(timeoutMS string) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
@@ -67,13 +95,29 @@ func getTimeout(timeoutMS string) time.Duration {
 	return time.Duration(i) * time.Millisecond
 }
 
-func getSyncStreamPosition(since string) (types.StreamPosition, error) {
+// getSyncStreamPosition parses a since token. Tokens are made of the positions
+// in the room event, typing, receipt, presence and to-device streams separated
+// by underscores.
+// Missing positions at the end of the token default to 0, so that tokens
+// issued before a stream was added are still accepted.
+func getSyncStreamPosition(since string) (types.SyncPosition, error) {
 	if since == "" {
-		return types.StreamPosition(0), nil
+		return types.SyncPosition{}, nil
 	}
-	i, err := strconv.Atoi(since)
-	if err != nil {
-		return types.StreamPosition(0), err
+	parts := strings.SplitN(since, "_", 5)
+	positions := make([]int64, 5)
+	for i, part := range parts {
+		pos, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return types.SyncPosition{}, err
+		}
+		positions[i] = pos
 	}
-	return types.StreamPosition(i), nil
+	return types.SyncPosition{
+		PDUPosition:      types.StreamPosition(positions[0]),
+		TypingPosition:   positions[1],
+		ReceiptPosition:  positions[2],
+		PresencePosition: positions[3],
+		ToDevicePosition: positions[4],
+	}, nil
 }
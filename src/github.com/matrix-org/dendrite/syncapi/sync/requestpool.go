@@ -15,7 +15,10 @@
 package sync
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -23,22 +26,39 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/presence"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/common"
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/syncapi/typing"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
-	db        *storage.SyncServerDatabase
-	accountDB *accounts.Database
-	notifier  *Notifier
+	db          *storage.SyncServerDatabase
+	accountDB   *accounts.Database
+	notifier    *Notifier
+	typingCache *typing.Cache
+	queryAPI    api.RoomserverQueryAPI
+	receiptAPI  api.RoomserverReceiptAPI
+	// Sends the presence of users when syncing changes it.
+	presenceProducer *producers.PresenceProducer
+	// The sender of the m.room.redaction entries of expired events.
+	systemUserID string
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db *storage.SyncServerDatabase, n *Notifier, adb *accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db *storage.SyncServerDatabase, n *Notifier, adb *accounts.Database, typingCache *typing.Cache,
+	queryAPI api.RoomserverQueryAPI, receiptAPI api.RoomserverReceiptAPI,
+	presenceProducer *producers.PresenceProducer, cfg *config.Dendrite,
+) *RequestPool {
+	return &RequestPool{db, adb, n, typingCache, queryAPI, receiptAPI, presenceProducer, cfg.SystemUserID()}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -46,7 +66,7 @@ func NewRequestPool(db *storage.SyncServerDatabase, n *Notifier, adb *accounts.D
 // until a response is ready, or it times out.
 func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtypes.Device) util.JSONResponse {
 	// Extract values from request
-	logger := util.GetLogger(req.Context())
+	logger := common.GetLogger(req.Context())
 	userID := device.UserID
 	syncReq, err := newSyncRequest(req, userID)
 	if err != nil {
@@ -55,62 +75,198 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 			JSON: jsonerror.Unknown(err.Error()),
 		}
 	}
+	filter, err := getFilter(rp.accountDB, userID, req.URL.Query().Get("filter"))
+	if _, ok := err.(errUnknownFilter); ok {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	} else if _, ok := err.(errBadFilter); ok {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	} else if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncReq.applyFilter(filter)
 	logger.WithFields(log.Fields{
 		"userID":  userID,
 		"since":   syncReq.since,
 		"timeout": syncReq.timeout,
 	}).Info("Incoming /sync request")
 
-	// Fork off 2 goroutines: one to do the work, and one to serve as a timeout.
-	// Whichever returns first is the one we will serve back to the client.
-	timeoutChan := make(chan struct{})
-	timer := time.AfterFunc(syncReq.timeout, func() {
-		close(timeoutChan) // signal that the timeout has expired
-	})
-
-	done := make(chan util.JSONResponse)
-	go func() {
-		currentPos := rp.notifier.WaitForEvents(*syncReq)
-		// We stop the timer BEFORE calculating the response so the cpu work
-		// done to calculate the response is not timed. This stops us from
-		// doing lots of work then timing out and sending back an empty response.
-		timer.Stop()
-		syncData, err := rp.currentSyncForUser(*syncReq, currentPos)
-		var res util.JSONResponse
-		if err != nil {
-			res = httputil.LogThenError(req, err)
-		} else {
-			syncData, err = rp.appendAccountData(syncData, device.UserID, *syncReq, currentPos)
-			if err != nil {
-				res = httputil.LogThenError(req, err)
-			} else {
-				res = util.JSONResponse{
-					Code: 200,
-					JSON: syncData,
-				}
-			}
-		}
-		done <- res
-		close(done)
-	}()
+	// The user is active while syncing. Failing to record it shouldn't stop
+	// them from syncing.
+	if err = presence.SetPresenceFromSync(
+		rp.accountDB, rp.presenceProducer, userID, syncReq.setPresence, time.Now(),
+	); err != nil {
+		logger.WithError(err).Warn("Failed to update the presence of the user")
+	}
 
-	select {
-	case <-timeoutChan: // timeout fired
+	// Wait for new events until the timeout expires or the client goes away.
+	// An initial sync doesn't wait, and returns straight away with the current
+	// state of the rooms. The deadline only applies to the wait, so the work done
+	// to calculate the response is not timed. This stops us from doing lots of
+	// work then timing out and sending back an empty response.
+	timeout := syncReq.timeout
+	if syncReq.since == (types.SyncPosition{}) {
+		timeout = 0
+	}
+	ctx, cancel := context.WithTimeout(syncReq.ctx, timeout)
+	defer cancel()
+	waitReq := *syncReq
+	waitReq.ctx = ctx
+	currentPos := rp.notifier.WaitForEvents(waitReq)
+	if currentPos == syncReq.since && syncReq.since != (types.SyncPosition{}) {
+		// The wait ended with nothing new for this user
+		res := types.NewResponse(syncReq.since.PDUPosition)
+		res.NextBatch = syncReq.since.String()
 		return util.JSONResponse{
 			Code: 200,
-			JSON: types.NewResponse(syncReq.since),
+			JSON: res,
 		}
-	case res := <-done: // received a response
-		return res
+	}
+
+	syncData, err := rp.currentSyncForUser(*syncReq, currentPos)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncData, err = rp.appendAccountData(syncData, device.UserID, *syncReq, currentPos.PDUPosition)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncData, err = rp.appendTypingEvents(syncData, device.UserID, *syncReq)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncData, receiptPos, err := rp.appendReceipts(syncData, device.UserID, *syncReq)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncData, presencePos, err := rp.appendPresence(syncData, device.UserID, *syncReq)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	syncData, toDevicePos, limited, err := rp.appendToDeviceMessages(syncData, device, *syncReq)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	// Receipts, presence and to-device messages are stored in the database
+	// before the notifier hears about them, so the response can be ahead of
+	// the notifier.
+	if receiptPos > currentPos.ReceiptPosition {
+		currentPos.ReceiptPosition = receiptPos
+	}
+	if presencePos > currentPos.PresencePosition {
+		currentPos.PresencePosition = presencePos
+	}
+	// If there are more to-device messages than fit in the response, the
+	// next sync must start from the last one sent.
+	if limited || toDevicePos > currentPos.ToDevicePosition {
+		currentPos.ToDevicePosition = toDevicePos
+	}
+	// Complete syncs are computed at the latest position in the database, which
+	// may be after the one the notifier knows about.
+	dataPos, err := getSyncStreamPosition(syncData.NextBatch)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	currentPos.PDUPosition = dataPos.PDUPosition
+	syncData.NextBatch = currentPos.String()
+	filterResponse(syncData, syncReq.filter)
+	if err = rp.appendRelations(req.Context(), syncData, device.UserID); err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: syncData,
 	}
 }
 
-func (rp *RequestPool) currentSyncForUser(req syncRequest, currentPos types.StreamPosition) (*types.Response, error) {
+func (rp *RequestPool) currentSyncForUser(req syncRequest, currentPos types.SyncPosition) (*types.Response, error) {
 	// TODO: handle ignored users
-	if req.since == types.StreamPosition(0) {
-		return rp.db.CompleteSync(req.userID, req.limit)
+	visible := rp.visibilityFilter(req.ctx, req.userID)
+	if req.since.PDUPosition == types.StreamPosition(0) {
+		return rp.db.CompleteSync(req.userID, req.limit, visible)
+	}
+	return rp.db.IncrementalSync(req.userID, req.since.PDUPosition, currentPos.PDUPosition, req.limit, visible)
+}
+
+// visibilityFilter returns a filter keeping the timeline events the user is
+// allowed to see according to the history visibility of the rooms. The
+// m.room.redaction entries of expired events, which the roomserver doesn't
+// know about, are visible if the events are. Other redactions are filtered
+// like any other event.
+func (rp *RequestPool) visibilityFilter(ctx context.Context, userID string) storage.VisibilityFilter {
+	return func(events []gomatrixserverlib.Event) ([]gomatrixserverlib.Event, error) {
+		if len(events) == 0 {
+			return events, nil
+		}
+		var eventIDs []string
+		for i := range events {
+			eventIDs = append(eventIDs, events[i].EventID())
+			if redactedID := rp.expiredEventID(&events[i]); redactedID != "" {
+				eventIDs = append(eventIDs, redactedID)
+			}
+		}
+		queryReq := api.QueryEventsByIDRequest{EventIDs: eventIDs, UserID: userID}
+		var queryRes api.QueryEventsByIDResponse
+		if err := rp.queryAPI.QueryEventsByID(ctx, &queryReq, &queryRes); err != nil {
+			return nil, err
+		}
+		visible := make(map[string]bool, len(queryRes.Events))
+		for _, event := range queryRes.Events {
+			visible[event.EventID()] = true
+		}
+		return rp.visibleEvents(events, visible), nil
+	}
+}
+
+// visibleEvents returns the events whose IDs are in the visible set, along
+// with the m.room.redaction entries of expired visible events.
+func (rp *RequestPool) visibleEvents(events []gomatrixserverlib.Event, visible map[string]bool) []gomatrixserverlib.Event {
+	var result []gomatrixserverlib.Event
+	for i := range events {
+		if visible[events[i].EventID()] || visible[rp.expiredEventID(&events[i])] {
+			result = append(result, events[i])
+		}
+	}
+	return result
+}
+
+// expiredEventID returns the ID of the event redacted by a m.room.redaction
+// entry the sync server made up when the event expired, or an empty string
+// for any other event. The entries are told apart by their event ID prefix
+// and by being sent by the system user, which remote servers can't forge.
+func (rp *RequestPool) expiredEventID(event *gomatrixserverlib.Event) string {
+	if event.Type() != "m.room.redaction" || event.Sender() != rp.systemUserID ||
+		!strings.HasPrefix(event.EventID(), types.ExpiryRedactionIDPrefix) {
+		return ""
+	}
+	var content struct {
+		Redacts string `json:"redacts"`
 	}
-	return rp.db.IncrementalSync(req.userID, req.since, currentPos, req.limit)
+	if err := json.Unmarshal(event.Content(), &content); err != nil {
+		return ""
+	}
+	return content.Redacts
+}
+
+// appendRelations bundles the relations of other events, e.g. the latest
+// edits and thread summaries, to the timeline events of the rooms in the response.
+func (rp *RequestPool) appendRelations(ctx context.Context, data *types.Response, userID string) error {
+	for _, jr := range data.Rooms.Join {
+		if err := common.AddRelations(ctx, rp.queryAPI, userID, jr.Timeline.Events, gomatrixserverlib.FormatSync); err != nil {
+			return err
+		}
+	}
+	for _, lr := range data.Rooms.Leave {
+		if err := common.AddRelations(ctx, rp.queryAPI, userID, lr.Timeline.Events, gomatrixserverlib.FormatSync); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (rp *RequestPool) appendAccountData(
@@ -123,7 +279,7 @@ func (rp *RequestPool) appendAccountData(
 		return nil, err
 	}
 
-	if req.since == types.StreamPosition(0) {
+	if req.since.PDUPosition == types.StreamPosition(0) {
 		// If this is the initial sync, we don't need to check if a data has
 		// already been sent. Instead, we send the whole batch.
 		var global []gomatrixserverlib.ClientEvent
@@ -145,7 +301,7 @@ func (rp *RequestPool) appendAccountData(
 	}
 
 	// Sync is not initial, get all account data since the latest sync
-	dataTypes, err := rp.db.GetAccountDataInRange(userID, req.since, currentPos)
+	dataTypes, err := rp.db.GetAccountDataInRange(userID, req.since.PDUPosition, currentPos)
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +324,10 @@ func (rp *RequestPool) appendAccountData(
 
 		// Append the data to the response
 		if len(roomID) > 0 {
-			jr := data.Rooms.Join[roomID]
+			jr, ok := data.Rooms.Join[roomID]
+			if !ok {
+				jr = *types.NewJoinResponse()
+			}
 			jr.AccountData.Events = events
 			data.Rooms.Join[roomID] = jr
 		} else {
@@ -178,3 +337,218 @@ func (rp *RequestPool) appendAccountData(
 
 	return data, nil
 }
+
+// appendTypingEvents adds an m.typing event to the ephemeral events of every
+// room the user is joined to in which the users typing changed since the
+// request's since token. On an initial sync, every room with users typing is
+// included.
+func (rp *RequestPool) appendTypingEvents(
+	data *types.Response, userID string, req syncRequest,
+) (*types.Response, error) {
+	since := req.since.TypingPosition
+	if since > rp.typingCache.GetLatestPosition() {
+		// The typing stream is only held in memory, so it went back to the
+		// start if the server restarted since the client last synced.
+		since = 0
+	}
+
+	for _, roomID := range rp.typingCache.RoomsUpdatedAfter(since) {
+		jr, ok := data.Rooms.Join[roomID]
+		if !ok {
+			// The room isn't in the response, check if the user is joined to it.
+			joined, err := rp.isJoined(userID, roomID)
+			if err != nil {
+				return nil, err
+			}
+			if !joined {
+				continue
+			}
+			jr = *types.NewJoinResponse()
+		}
+
+		ev, err := rp.typingEvent(roomID)
+		if err != nil {
+			return nil, err
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, *ev)
+		data.Rooms.Join[roomID] = jr
+	}
+
+	return data, nil
+}
+
+// typingEvent returns the m.typing event listing the users currently typing
+// in the room.
+func (rp *RequestPool) typingEvent(roomID string) (*gomatrixserverlib.ClientEvent, error) {
+	content, err := json.Marshal(map[string][]string{
+		"user_ids": rp.typingCache.GetTypingUsers(roomID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &gomatrixserverlib.ClientEvent{
+		Type:    "m.typing",
+		Content: content,
+	}, nil
+}
+
+// isJoined returns true if the user's current membership in the room is join.
+func (rp *RequestPool) isJoined(userID, roomID string) (bool, error) {
+	ev, err := rp.db.GetStateEvent("m.room.member", roomID, userID)
+	if err != nil || ev == nil {
+		return false, err
+	}
+	membership, err := ev.Membership()
+	if err != nil {
+		return false, err
+	}
+	return membership == "join", nil
+}
+
+// appendReceipts adds an m.receipt event to the ephemeral events of every room
+// the user is joined to in which receipts were sent since the request's since
+// token. On an initial sync, the latest receipts in every room are included.
+// Returns the position in the receipts stream the response is at.
+func (rp *RequestPool) appendReceipts(
+	data *types.Response, userID string, req syncRequest,
+) (*types.Response, int64, error) {
+	roomIDs, err := rp.db.JoinedRoomIDs(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	queryReq := api.QueryReceiptsRequest{
+		RoomIDs:       roomIDs,
+		AfterPosition: req.since.ReceiptPosition,
+	}
+	var queryRes api.QueryReceiptsResponse
+	if err = rp.receiptAPI.QueryReceipts(&queryReq, &queryRes); err != nil {
+		return nil, 0, err
+	}
+
+	events, err := receiptEvents(queryRes.Receipts)
+	if err != nil {
+		return nil, 0, err
+	}
+	for roomID, event := range events {
+		jr, ok := data.Rooms.Join[roomID]
+		if !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, event)
+		data.Rooms.Join[roomID] = jr
+	}
+
+	return data, queryRes.StreamPosition, nil
+}
+
+// receiptEvents aggregates receipts into an m.receipt event for each room
+// they were sent in.
+func receiptEvents(receipts []api.Receipt) (map[string]gomatrixserverlib.ClientEvent, error) {
+	// Map of room ID => event ID => receipt type => user ID => receipt
+	type receiptInfo struct {
+		Timestamp gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	contents := make(map[string]map[string]map[string]map[string]receiptInfo)
+	for _, r := range receipts {
+		if contents[r.RoomID] == nil {
+			contents[r.RoomID] = make(map[string]map[string]map[string]receiptInfo)
+		}
+		if contents[r.RoomID][r.EventID] == nil {
+			contents[r.RoomID][r.EventID] = make(map[string]map[string]receiptInfo)
+		}
+		if contents[r.RoomID][r.EventID][r.Type] == nil {
+			contents[r.RoomID][r.EventID][r.Type] = make(map[string]receiptInfo)
+		}
+		contents[r.RoomID][r.EventID][r.Type][r.UserID] = receiptInfo{r.Timestamp}
+	}
+
+	events := make(map[string]gomatrixserverlib.ClientEvent, len(contents))
+	for roomID, content := range contents {
+		contentJSON, err := json.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		events[roomID] = gomatrixserverlib.ClientEvent{
+			Type:    "m.receipt",
+			Content: contentJSON,
+		}
+	}
+	return events, nil
+}
+
+// appendPresence adds an m.presence event to the presence events of the
+// response for the user and each user sharing a room with them whose presence
+// changed since the request's since token. On an initial sync, the presence of
+// all of them is included.
+// Returns the position in the presence stream the response is at.
+func (rp *RequestPool) appendPresence(
+	data *types.Response, userID string, req syncRequest,
+) (*types.Response, int64, error) {
+	userIDs := rp.notifier.UsersSharingRooms(userID)
+	presences, pos, err := rp.accountDB.GetPresencesForUsers(userIDs, req.since.PresencePosition)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// https://matrix.org/docs/spec/client_server/r0.2.0.html#m-presence
+	type presenceContent struct {
+		Presence        string `json:"presence"`
+		LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+		StatusMsg       string `json:"status_msg,omitempty"`
+		CurrentlyActive bool   `json:"currently_active"`
+	}
+	for _, p := range presences {
+		content, err := json.Marshal(presenceContent{
+			Presence:        p.Presence,
+			LastActiveAgo:   int64(time.Since(p.LastActiveTS.Time()) / time.Millisecond),
+			StatusMsg:       p.StatusMsg,
+			CurrentlyActive: p.Presence == authtypes.PresenceOnline,
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		data.Presence.Events = append(data.Presence.Events, gomatrixserverlib.ClientEvent{
+			Type:    "m.presence",
+			Sender:  p.UserID,
+			Content: content,
+		})
+	}
+
+	return data, pos, nil
+}
+
+// maxToDeviceMessages is the maximum number of to-device messages included in
+// a /sync response.
+const maxToDeviceMessages = 100
+
+// appendToDeviceMessages adds the to-device messages sent to the device since
+// the request's since token to the response. The messages up to the since
+// token were received by the device, so they are deleted first.
+// Returns the position in the to-device stream the response is at, and
+// whether there were more messages than could be included.
+func (rp *RequestPool) appendToDeviceMessages(
+	data *types.Response, device *authtypes.Device, req syncRequest,
+) (*types.Response, int64, bool, error) {
+	since := req.since.ToDevicePosition
+	if since > 0 {
+		if err := rp.accountDB.DeleteToDeviceMessages(device.UserID, device.ID, since); err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	messages, pos, err := rp.accountDB.GetToDeviceMessages(
+		device.UserID, device.ID, since, maxToDeviceMessages,
+	)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	for _, m := range messages {
+		data.ToDevice.Events = append(data.ToDevice.Events, gomatrixserverlib.ClientEvent{
+			Type:    m.Type,
+			Sender:  m.Sender,
+			Content: []byte(m.Content),
+		})
+	}
+
+	return data, pos, len(messages) == maxToDeviceMessages, nil
+}
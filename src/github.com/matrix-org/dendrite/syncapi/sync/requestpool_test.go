@@ -0,0 +1,77 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestVisibleEventsExpiryRedactions(t *testing.T) {
+	rp := &RequestPool{systemUserID: "@system:localhost"}
+	redaction := func(eventID, sender, redacts string) gomatrixserverlib.Event {
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+			"event_id": "`+eventID+`", "type": "m.room.redaction", "room_id": "!room:localhost",
+			"sender": "`+sender+`", "content": {"redacts": "`+redacts+`"}
+		}`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	events := []gomatrixserverlib.Event{
+		// An expiry entry of a visible event.
+		redaction("$expired_a:localhost", "@system:localhost", "$a:localhost"),
+		// An expiry entry of an event the user can't see.
+		redaction("$expired_b:localhost", "@system:localhost", "$b:localhost"),
+		// A real redaction of a visible event, sent while the user couldn't
+		// see the room.
+		redaction("$c:localhost", "@alice:localhost", "$a:localhost"),
+		// A remote redaction pretending to be an expiry entry.
+		redaction("$expired_d:evil.com", "@mallory:evil.com", "$a:localhost"),
+	}
+	visible := map[string]bool{"$a:localhost": true}
+
+	result := rp.visibleEvents(events, visible)
+	if len(result) != 1 || result[0].EventID() != "$expired_a:localhost" {
+		t.Errorf("wanted only the expiry entry of the visible event, got %d events", len(result))
+	}
+}
+
+func TestReceiptEvents(t *testing.T) {
+	receipts := []api.Receipt{
+		{RoomID: "!a:localhost", UserID: "@alice:localhost", Type: "m.read", EventID: "$1:localhost", Timestamp: 10},
+		{RoomID: "!a:localhost", UserID: "@bob:localhost", Type: "m.read", EventID: "$1:localhost", Timestamp: 20},
+		{RoomID: "!b:localhost", UserID: "@alice:localhost", Type: "m.read", EventID: "$2:localhost", Timestamp: 30},
+	}
+	events, err := receiptEvents(receipts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("wanted an m.receipt event for each of the 2 rooms, got %+v", events)
+	}
+	for roomID, want := range map[string]string{
+		"!a:localhost": `{"$1:localhost":{"m.read":{"@alice:localhost":{"ts":10},"@bob:localhost":{"ts":20}}}}`,
+		"!b:localhost": `{"$2:localhost":{"m.read":{"@alice:localhost":{"ts":30}}}}`,
+	} {
+		event := events[roomID]
+		if event.Type != "m.receipt" || string(event.Content) != want {
+			t.Errorf("wanted an m.receipt event with content %s in %s, got %s %s", want, roomID, event.Type, event.Content)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// OnIncomingTypingRequest implements GET /rooms/{roomID}/typing, responding
+// with an m.typing event listing the users currently typing in the room.
+// Only users joined to the room can see who is typing in it.
+func (rp *RequestPool) OnIncomingTypingRequest(
+	req *http.Request, device *authtypes.Device, roomID string,
+) util.JSONResponse {
+	joined, err := rp.isJoined(device.UserID, roomID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	if !joined {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+
+	ev, err := rp.typingEvent(roomID)
+	if err != nil {
+		return httputil.LogThenError(req, err)
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ev,
+	}
+}
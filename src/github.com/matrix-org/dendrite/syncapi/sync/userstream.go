@@ -15,6 +15,7 @@
 package sync
 
 import (
+	"context"
 	"sync"
 
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -25,11 +26,14 @@ import (
 // goroutines can Broadcast(streamPosition) to other goroutines.
 type UserStream struct {
 	UserID string
-	// Because this is a Cond, we can notify all waiting goroutines so this works
-	// across devices for the same user. Protects pos.
-	cond *sync.Cond
+	// Protects pos, signalChannel and numWaiting.
+	lock sync.Mutex
+	// Closed to wake up all the goroutines waiting on this stream, so this works
+	// across devices for the same user. It is replaced by a new channel on
+	// every Broadcast().
+	signalChannel chan struct{}
 	// The position to broadcast to callers of Wait().
-	pos types.StreamPosition
+	pos types.SyncPosition
 	// The number of goroutines blocked on Wait() - used for testing and metrics
 	numWaiting int
 }
@@ -37,43 +41,56 @@ type UserStream struct {
 // NewUserStream creates a new user stream
 func NewUserStream(userID string) *UserStream {
 	return &UserStream{
-		UserID: userID,
-		cond:   sync.NewCond(&sync.Mutex{}),
+		UserID:        userID,
+		signalChannel: make(chan struct{}),
 	}
 }
 
-// Wait blocks until there is a new stream position for this user, which is then returned.
+// Wait blocks until there is a new stream position for this user, which is then returned,
+// or until the context is done, in which case waitAtPos is returned.
 // waitAtPos should be the position the stream thinks it should be waiting at.
-func (s *UserStream) Wait(waitAtPos types.StreamPosition) (pos types.StreamPosition) {
-	s.cond.L.Lock()
+func (s *UserStream) Wait(ctx context.Context, waitAtPos types.SyncPosition) (pos types.SyncPosition) {
+	s.lock.Lock()
 	// Before we start blocking, we need to make sure that we didn't race with a call
 	// to Broadcast() between calling Wait() and actually sleeping. We check the last
 	// broadcast pos to see if it is newer than the pos we are meant to wait at. If it
 	// is newer, something has Broadcast to this stream more recently so return immediately.
-	if s.pos > waitAtPos {
+	if s.pos.IsAfter(waitAtPos) {
 		pos = s.pos
-		s.cond.L.Unlock()
+		s.lock.Unlock()
 		return
 	}
 	s.numWaiting++
-	s.cond.Wait()
-	pos = s.pos
+	signalChannel := s.signalChannel
+	s.lock.Unlock()
+
+	pos = waitAtPos
+	select {
+	case <-signalChannel:
+		s.lock.Lock()
+		pos = s.pos
+		s.lock.Unlock()
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
 	s.numWaiting--
-	s.cond.L.Unlock()
+	s.lock.Unlock()
 	return
 }
 
 // Broadcast a new stream position for this user.
-func (s *UserStream) Broadcast(pos types.StreamPosition) {
-	s.cond.L.Lock()
+func (s *UserStream) Broadcast(pos types.SyncPosition) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.pos = pos
-	s.cond.L.Unlock()
-	s.cond.Broadcast()
+	close(s.signalChannel)
+	s.signalChannel = make(chan struct{})
 }
 
 // NumWaiting returns the number of goroutines waiting for Wait() to return. Used for metrics and testing.
 func (s *UserStream) NumWaiting() int {
-	s.cond.L.Lock()
-	defer s.cond.L.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.numWaiting
 }
@@ -20,6 +20,11 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
+// ExpiryRedactionIDPrefix is the prefix of the event IDs of the m.room.redaction
+// entries the sync server makes up when events expire. Their sender is the
+// system user of the server.
+const ExpiryRedactionIDPrefix = "$expired_"
+
 // StreamPosition represents the offset in the sync stream a client is at.
 type StreamPosition int64
 
@@ -28,6 +33,39 @@ func (sp StreamPosition) String() string {
 	return strconv.FormatInt(int64(sp), 10)
 }
 
+// SyncPosition is the position of a client in the streams of data a /sync
+// response is made of: the stream of room events and account data stored in
+// the database, the in-memory stream of typing notifications, and the streams
+// of receipts, presence updates and to-device messages stored in the account
+// database.
+type SyncPosition struct {
+	PDUPosition      StreamPosition
+	TypingPosition   int64
+	ReceiptPosition  int64
+	PresencePosition int64
+	ToDevicePosition int64
+}
+
+// String implements the Stringer interface. The result is used as the
+// next_batch token of /sync responses.
+func (sp SyncPosition) String() string {
+	return sp.PDUPosition.String() + "_" +
+		strconv.FormatInt(sp.TypingPosition, 10) + "_" +
+		strconv.FormatInt(sp.ReceiptPosition, 10) + "_" +
+		strconv.FormatInt(sp.PresencePosition, 10) + "_" +
+		strconv.FormatInt(sp.ToDevicePosition, 10)
+}
+
+// IsAfter returns true if any of the positions is after the matching
+// position in other.
+func (sp SyncPosition) IsAfter(other SyncPosition) bool {
+	return sp.PDUPosition > other.PDUPosition ||
+		sp.TypingPosition > other.TypingPosition ||
+		sp.ReceiptPosition > other.ReceiptPosition ||
+		sp.PresencePosition > other.PresencePosition ||
+		sp.ToDevicePosition > other.ToDevicePosition
+}
+
 // Response represents a /sync API response. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
 type Response struct {
 	NextBatch   string `json:"next_batch"`
@@ -42,6 +80,9 @@ type Response struct {
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
+	ToDevice struct {
+		Events []gomatrixserverlib.ClientEvent `json:"events"`
+	} `json:"to_device"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -62,6 +103,7 @@ func NewResponse(pos StreamPosition) *Response {
 	//       This also applies to NewJoinResponse, NewInviteResponse and NewLeaveResponse.
 	res.AccountData.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
+	res.ToDevice.Events = make([]gomatrixserverlib.ClientEvent, 0)
 
 	return &res
 }
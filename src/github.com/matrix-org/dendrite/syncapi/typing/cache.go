@@ -0,0 +1,155 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package typing keeps track of the users currently typing in each room.
+// Typing notifications are ephemeral, so they are only held in memory.
+package typing
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// roomData holds the users typing in a room.
+type roomData struct {
+	// The position in the typing stream of the latest change in the room.
+	position int64
+	// A map of user ID => timer removing the user once their typing
+	// notification expires.
+	userSet map[string]*time.Timer
+}
+
+// Cache holds the users typing in each room, along with a stream position
+// which is incremented every time the users typing in a room change.
+// It is safe for concurrent use.
+type Cache struct {
+	mutex          sync.Mutex
+	latestPosition int64
+	rooms          map[string]*roomData
+	// Called after every change, with the room it happened in and the new
+	// position in the typing stream.
+	onUpdate func(roomID string, position int64)
+}
+
+// NewCache creates a new, empty, typing cache. onUpdate, if not nil, is
+// called after every change in the users typing in a room, including when a
+// typing notification expires.
+func NewCache(onUpdate func(roomID string, position int64)) *Cache {
+	return &Cache{
+		rooms:    make(map[string]*roomData),
+		onUpdate: onUpdate,
+	}
+}
+
+// GetLatestPosition returns the position in the typing stream of the latest
+// change.
+func (c *Cache) GetLatestPosition() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.latestPosition
+}
+
+// GetTypingUsers returns the IDs of the users typing in the room, sorted.
+func (c *Cache) GetTypingUsers(roomID string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	users := []string{}
+	if room, ok := c.rooms[roomID]; ok {
+		for userID := range room.userSet {
+			users = append(users, userID)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// RoomsUpdatedAfter returns the IDs of the rooms in which the users typing
+// changed after the given position in the typing stream.
+func (c *Cache) RoomsUpdatedAfter(position int64) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	roomIDs := []string{}
+	for roomID, room := range c.rooms {
+		if room.position > position {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
+// AddTypingUser marks the user as typing in the room until the given timeout
+// expires. If the user was already typing, their timeout is reset.
+func (c *Cache) AddTypingUser(userID, roomID string, timeout time.Duration) {
+	c.mutex.Lock()
+	room, ok := c.rooms[roomID]
+	if !ok {
+		room = &roomData{userSet: make(map[string]*time.Timer)}
+		c.rooms[roomID] = room
+	}
+	if timer, ok := room.userSet[userID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		c.removeUser(userID, roomID, timer)
+	})
+	room.userSet[userID] = timer
+	position := c.advance(room)
+	c.mutex.Unlock()
+
+	c.notify(roomID, position)
+}
+
+// RemoveUser marks the user as no longer typing in the room.
+func (c *Cache) RemoveUser(userID, roomID string) {
+	c.removeUser(userID, roomID, nil)
+}
+
+// removeUser removes the user from the users typing in the room. If timer
+// isn't nil, the user is only removed if that timer is still the one which
+// would expire their typing notification, i.e. if it wasn't reset since.
+func (c *Cache) removeUser(userID, roomID string, timer *time.Timer) {
+	c.mutex.Lock()
+	room, ok := c.rooms[roomID]
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	current, ok := room.userSet[userID]
+	if !ok || (timer != nil && current != timer) {
+		c.mutex.Unlock()
+		return
+	}
+	current.Stop()
+	delete(room.userSet, userID)
+	position := c.advance(room)
+	c.mutex.Unlock()
+
+	c.notify(roomID, position)
+}
+
+// advance moves the typing stream forward for a change in the given room.
+// The cache mutex must be held.
+func (c *Cache) advance(room *roomData) int64 {
+	c.latestPosition++
+	room.position = c.latestPosition
+	return c.latestPosition
+}
+
+func (c *Cache) notify(roomID string, position int64) {
+	if c.onUpdate != nil {
+		c.onUpdate(roomID, position)
+	}
+}
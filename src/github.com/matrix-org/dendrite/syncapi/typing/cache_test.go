@@ -0,0 +1,79 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package typing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddAndRemoveTypingUsers(t *testing.T) {
+	var updates []int64
+	c := NewCache(func(roomID string, position int64) {
+		updates = append(updates, position)
+	})
+
+	c.AddTypingUser("@bob:localhost", "!room:localhost", time.Minute)
+	c.AddTypingUser("@alice:localhost", "!room:localhost", time.Minute)
+	if got, want := c.GetTypingUsers("!room:localhost"), []string{"@alice:localhost", "@bob:localhost"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want typing users %v, got %v", want, got)
+	}
+
+	c.RemoveUser("@bob:localhost", "!room:localhost")
+	if got, want := c.GetTypingUsers("!room:localhost"), []string{"@alice:localhost"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want typing users %v, got %v", want, got)
+	}
+
+	// Removing a user who isn't typing doesn't change anything.
+	c.RemoveUser("@bob:localhost", "!room:localhost")
+	if got, want := updates, []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want updates %v, got %v", want, got)
+	}
+	if got := c.GetLatestPosition(); got != 3 {
+		t.Fatalf("want latest position 3, got %d", got)
+	}
+}
+
+func TestTypingUsersExpire(t *testing.T) {
+	updated := make(chan int64, 10)
+	c := NewCache(func(roomID string, position int64) {
+		updated <- position
+	})
+
+	c.AddTypingUser("@alice:localhost", "!room:localhost", 10*time.Millisecond)
+	<-updated
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("typing notification didn't expire")
+	}
+	if got := c.GetTypingUsers("!room:localhost"); len(got) != 0 {
+		t.Fatalf("want no typing users, got %v", got)
+	}
+}
+
+func TestRoomsUpdatedAfter(t *testing.T) {
+	c := NewCache(nil)
+	c.AddTypingUser("@alice:localhost", "!a:localhost", time.Minute)
+	c.AddTypingUser("@alice:localhost", "!b:localhost", time.Minute)
+
+	if got, want := c.RoomsUpdatedAfter(1), []string{"!b:localhost"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want rooms %v, got %v", want, got)
+	}
+	if got := c.RoomsUpdatedAfter(2); len(got) != 0 {
+		t.Fatalf("want no rooms, got %v", got)
+	}
+}
@@ -12,6 +12,15 @@ gb build github.com/matrix-org/dendrite/cmd/dendrite-media-api-server
 gb build github.com/matrix-org/dendrite/cmd/mediaapi-integration-tests
 gb build github.com/matrix-org/dendrite/cmd/client-api-proxy
 
+# Run the storage tests against postgres
+createdb accounts_test
+ACCOUNTS_TEST_DATABASE="dbname=accounts_test sslmode=disable" gb test github.com/matrix-org/dendrite/clientapi/auth/storage/accounts
+createdb roomserver_test
+ROOMSERVER_TEST_DATABASE="dbname=roomserver_test sslmode=disable" gb test github.com/matrix-org/dendrite/roomserver/storage
+
+# Run the storage tests against SQLite
+gb test -tags sqlite github.com/matrix-org/dendrite/clientapi/auth/storage/... github.com/matrix-org/dendrite/mediaapi/storage github.com/matrix-org/dendrite/roomserver/storage
+
 # Run the pre commit hooks
 ./hooks/pre-commit
 